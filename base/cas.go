@@ -0,0 +1,28 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import "time"
+
+// The lower 16 bits of a CAS are the logical counter of the hybrid logical clock, the rest nanoseconds since the epoch
+const CasLogicalClockMask = 0xFFFF
+
+// When the revision with the CAS was written, according to the clock of the node that wrote it
+func CasToTime(cas uint64) time.Time {
+	return time.Unix(0, int64(cas&^CasLogicalClockMask)).UTC()
+}
+
+// RFC3339 timestamp of the CAS, for the reports. Empty for a CAS of 0, which no revision has
+func CasTimestamp(cas uint64) string {
+	if cas == 0 {
+		return ""
+	}
+	return CasToTime(cas).Format(time.RFC3339Nano)
+}
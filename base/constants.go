@@ -9,7 +9,14 @@
 
 package base
 
-import "time"
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Version of the tool, recorded in the manifest of each run. Set at build time by the Makefile
+var ToolVersion = "dev"
 
 const NumberOfVbuckets = 1024
 const DcpHandlerChanSize = 100000
@@ -17,6 +24,9 @@ const FileNamePrefix = "diffTool"
 const FileNameDelimiter = "_"
 const FileDirDelimiter = "/"
 const BucketBufferCapacity = 100000
+
+// Size in bytes of the DCP connection buffer that kv-engine may fill before waiting for a buffer acknowledgement
+const DcpConnectionBufferSize = 20 * 1024 * 1024
 const FileModeReadWrite = 0666
 const StreamingBucketName = "xdcrDiffTool"
 const VbucketSeqnoStatName = "vbucket-seqno"
@@ -27,21 +37,62 @@ const TargetFileDir = "target"
 const CheckpointFileDir = "checkpoint"
 const FileDifferDir = "fileDiff"
 const MutationDifferDir = "mutationDiff"
+const RemediationDir = "remediation"
+const JobsWorkDir = "jobs"
+
+// Each run is described by this file in mutationDifferDir
+const RunManifestFileName = "manifest.json"
+
+// Runs under runsDir are named by their start time in this format unless runId is given
+const RunIdTimeFormat = "20060102-150405"
+
 const DiffKeysFileName = "diffKeys"
 const DiffDetailsFileName = "diffDetails"
+const SpillDirName = "spill"
+const UploadStagingDirName = "uploadStaging"
 const DiffKeysSrcMigrationHintSuffix = "hint"
 const MutationDiffFileName = "mutationDiffDetails"
+const MutationDiffJsonLinesFileName = "mutationDiffDetails.jsonl"
 const MutationDiffColIdMapping = "mutationDiffColIdMapping"
 const MutationDiffMigrationDetails = "mutationMigrationDetails"
 const DiffErrorKeysFileName = "diffKeysWithError"
+const MutationDiffUnverifiedKeysFileName = "mutationDiffUnverifiedKeys"
+
+// Directory of fileDifferDir that the keys mutationDifferMaxDuration left unverified are written to, as diff keys files
+// that a follow-up run can take as its fileDifferDir
+const UnverifiedDiffKeysDirName = "unverifiedDiffKeys"
+
+// Error of the keys left unverified once mutationDifferMaxDuration is reached
+const MutationDifferMaxDurationError = "mutationDifferMaxDuration reached before the key was verified"
 const StatsReportInterval = 5
+
+// Number of the slowest dcp handlers whose throughput is logged with each status report
+const SlowestDcpHandlersToReport = 5
+
+// Mutation differ workers fetch and diff the keys this many batches at a time, so that only the docs of these keys are
+// held at once
+const MutationDifferBatchesPerChunk = 100
+
+// Number of diff keys read ahead of the mutation differ workers
+const MutationDifferFetchChanSize = 100000
+
+// Diff keys files of the target larger than this in total are split by key hash into partitions of about this size,
+// under DiffKeysPartitionDirName in mutationDifferDir, so that only the target keys of one partition are held at once
+const MutationDifferTgtDiffKeysPartitionBytes = 64 * 1024 * 1024
+const DiffKeysPartitionDirName = "diffKeysPartitions"
+
+// Batches of gets a mutation differ worker keeps in flight on each KV node, rather than waiting for each in turn
+const MutationDifferBatchesInFlightPerKvNode = 4
 const SourceClusterName = "source"
 const TargetClusterName = "target"
 const SelfReferenceName = "xdcrDifftoolSelfRef"
 const ManifestFileName = "manifest"
+const CompactionTmpFileSuffix = ".compacting"
 
 const NodesKey = "nodes"
+const PoolsPath = "/pools"
 const PoolsDefaultBucketPath = "/pools/default/buckets/"
+const ClusterUUIDKey = "uuid"
 const SASLPasswordKey = "saslPassword"
 const HttpGet = "GET"
 
@@ -57,6 +108,7 @@ const MaxNumOfGetStatsRetry = 10
 const MaxNumOfSendBatchRetry = 10
 const DelayBetweenSourceAndTarget uint64 = 2
 const CheckpointInterval = 600
+const CheckpointRetention = 10
 
 const ClusterRunMinPortNo uint16 = 9000
 const ClusterRunMaxPortNo uint16 = 9007
@@ -70,7 +122,7 @@ const ClusterRunMaxPortNo uint16 = 9007
 //	expiry   - 4 bytes
 //	opCode   - 2 bytes
 //	datatype - 2 byte
-//	hash     - 64 bytes
+//	hash     - 64 bytes, zero padded for hash algorithms with shorter digests
 //	collectionId - 4 bytes
 //	migrationFilterLen - 2 bytes
 //	(variable) - each filterID is 2 bytes
@@ -82,6 +134,81 @@ func GetFixedSizeMutationLen(keyLen int, colMigrationFilterMatched []uint8) int
 	return KeyLenVariable + keyLen + BodyLength + MigrationFilterLen + len(colMigrationFilterMatched)*2
 }
 
+// Data files whose header records HashAlgorithmNone hold only what tells whether a doc exists, in a compact layout of
+//
+//	seqno    - 8 bytes
+//	opCode   - 2 bytes
+//	collectionId - 4 bytes
+//
+// between the key and the migration filters
+const CompactBodyLength = 14
+
+func IsCompactMutationLayout(hashAlgorithm string) bool {
+	return hashAlgorithm == HashAlgorithmNone
+}
+
+// Length of the part of a mutation in data files of the given hash algorithm between the key and the migration filters
+func GetMutationBodyLength(hashAlgorithm string) int {
+	if IsCompactMutationLayout(hashAlgorithm) {
+		return CompactBodyLength
+	}
+	return BodyLength
+}
+
+func GetMutationLen(hashAlgorithm string, keyLen int, colMigrationFilterMatched []uint8) int {
+	return KeyLenVariable + keyLen + GetMutationBodyLength(hashAlgorithm) + MigrationFilterLen + len(colMigrationFilterMatched)*2
+}
+
+const (
+	HashAlgorithmSha512   = "sha512" // This is the default
+	HashAlgorithmXxhash64 = "xxhash64"
+	HashAlgorithmBlake3   = "blake3"
+	// Not a hash. With keyOnly, the bodies and the metadata of the docs are not recorded at all, and the data files
+	// are written in the compact layout
+	HashAlgorithmNone = "none"
+)
+
+// The index of each algorithm is the ID recorded in the data file header
+var HashAlgorithms = []string{HashAlgorithmSha512, HashAlgorithmXxhash64, HashAlgorithmBlake3, HashAlgorithmNone}
+
+// Data files start with a header of
+//
+//	marker        - 2 bytes
+//	hashAlgorithm - 2 bytes
+//
+// The marker is not a valid key length, which tells the header apart from the first mutation of
+// data files written before the header existed. Those always hold sha512 hashes
+const DataFileHeaderMarker = 0xFFFF
+const DataFileHeaderLen = 4
+
+func GetDataFileHeader(hashAlgorithm string) ([]byte, error) {
+	for id, algorithm := range HashAlgorithms {
+		if algorithm == hashAlgorithm {
+			header := make([]byte, DataFileHeaderLen)
+			binary.BigEndian.PutUint16(header[0:2], DataFileHeaderMarker)
+			binary.BigEndian.PutUint16(header[2:4], uint16(id))
+			return header, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %v", hashAlgorithm)
+}
+
+// Returns the hash algorithm recorded at the start of the data and the length of the header,
+// which is 0 if there is none
+func ParseDataFileHeader(data []byte) (string, int, error) {
+	if len(data) < KeyLenVariable || binary.BigEndian.Uint16(data[0:2]) != DataFileHeaderMarker {
+		return HashAlgorithmSha512, 0, nil
+	}
+	if len(data) < DataFileHeaderLen {
+		return "", 0, fmt.Errorf("truncated data file header")
+	}
+	id := int(binary.BigEndian.Uint16(data[2:4]))
+	if id >= len(HashAlgorithms) {
+		return "", 0, fmt.Errorf("unknown hash algorithm ID %v in data file header", id)
+	}
+	return HashAlgorithms[id], DataFileHeaderLen, nil
+}
+
 var VersionForRBACSupport = []int{5, 0}
 
 var ClusterCompatibilityKey = "clusterCompatibility"
@@ -102,6 +229,10 @@ const HttpsPrefix = "https://"
 const CouchbasePrefix = "couchbase://"
 const CouchbaseSecurePrefix = "couchbases://"
 
+// ns_server ports used when given a couchbase:// or couchbases:// connection string, which has no management port
+const MgmtPort = 8091
+const MgmtSecurePort = 18091
+
 var SetupTimeout = 5 * time.Second
 
 const JSONDataType = 1
@@ -113,3 +244,122 @@ const (
 )
 
 var MutationDiffCompareType = []string{MutationCompareTypeMetadata, MutationCompareTypeBodyOnly, MutationCompareTypeBodyAndMeta}
+
+const (
+	MutationDiffOutputFormatJson      = "json" // This is the default
+	MutationDiffOutputFormatJsonLines = "jsonl"
+)
+
+var MutationDiffOutputFormats = []string{MutationDiffOutputFormatJson, MutationDiffOutputFormatJsonLines}
+
+const (
+	// Writes the source doc to the target along with its metadata, as XDCR would
+	RepairModeSetWithMeta = "setWithMeta"
+	// Touches the source doc so that XDCR replicates it again
+	RepairModeTouchSource = "touchSource"
+)
+
+var RepairModes = []string{RepairModeSetWithMeta, RepairModeTouchSource}
+
+const (
+	// One data file per vbucket and bin, the default
+	DataStoreFiles = "files"
+	// An embedded Badger key value store per cluster, keyed by vbucket, collection and key
+	DataStoreBadger = "badger"
+)
+
+var DataStores = []string{DataStoreFiles, DataStoreBadger}
+
+// How data files are compressed on disk. Compressed data files are made of blocks compressed on their own, one per
+// buffer flush, so that they can be appended to
+const (
+	DataFileCompressionNone   = "none"
+	DataFileCompressionGzip   = "gzip"
+	DataFileCompressionSnappy = "snappy"
+)
+
+var DataFileCompressions = []string{DataFileCompressionNone, DataFileCompressionGzip, DataFileCompressionSnappy}
+
+const MutationDiffRepairLogFileName = "mutationDiffRepairLog"
+const RemediationKeysFileName = "keysToReplicate"
+const RemediationScriptFileName = "copyToTarget.sh"
+
+const MutationDiffSeverityFileName = "mutationDiffSeverity"
+const MutationDiffSummaryFileName = "mutationDiffSummary"
+const FileDiffSummaryFileName = "fileDiffSummary"
+const CasToleranceMs = 1000
+const ConvergenceHistoryFileName = "convergenceHistory"
+
+// The keys that remain after each convergence attempt are written to a directory named after the attempt under this one
+const ConvergenceDirName = "convergence"
+
+const OutputSinkSummarySuffix = "summary"
+const MaxTTLKey = "maxTTL"
+const MutationDiffConflictResolutionFileName = "mutationDiffConflictResolution"
+const MutationDiffBinaryDetailsFileName = "mutationDiffBinaryDetails"
+const MutationDiffJsonFieldDetailsFileName = "mutationDiffJsonFieldDetails"
+const CheckPermissionsPath = "/pools/default/checkPermissions"
+const DiffKeysCollectionSuffix = "col"
+const CheckpointTempFileSuffix = ".tmp"
+const CheckpointBackupFileSuffix = ".bak"
+
+// Longest line expected in mutationDiffDetails.jsonl, which holds the docs of both sides
+const MaxDiffRecordSize = 64 * 1024 * 1024
+
+// Virtual xattr listing the names of the user and system xattrs of a doc
+const XattrTocPath = "$XTOC"
+
+// Max number of lookups in a single subdoc request
+const MaxSubdocOps = 16
+
+// Xattrs that XDCR maintains separately on each cluster, and thus are expected to differ
+var XattrsIgnoredByDiff = []string{"_vv", "_mou"}
+
+// System xattrs that Sync Gateway keeps its mobile metadata in. Each cluster fronted by Sync Gateway updates
+// its own, so they are expected to differ
+var SyncGatewayXattrs = []string{"_sync", "_globalSync"}
+
+// Width of the progress bars in the periodic status logs
+const StatusLogProgressBarWidth = 20
+
+// How often the log file is checked for rotation
+var LogFileRotationCheckInterval = 5 * time.Second
+
+// Key length assumed when estimating the size of the data files ahead of data generation
+const DiskSpaceEstimateKeyLen = 32
+
+// How often the size of the data files is checked against maxDiskGB
+var DiskQuotaCheckInterval = 10 * time.Second
+
+// How long a stopping DcpHandler keeps processing the mutations still queued before dropping the rest
+var DcpHandlerDrainTimeout = 30 * time.Second
+
+// autoTune sizes the bins so that each data file holds about this many items, up to AutoTuneMaxBins bins
+const AutoTuneItemsPerBin = 10000
+const AutoTuneMaxBins = 64
+
+// File descriptors that autoTune leaves out of the file descriptor pool, for connections, logs and checkpoints
+const AutoTuneReservedFileDesc = 256
+
+// Workers autoTune starts per CPU. DCP handlers and mutation differ workers mostly wait on the network, while file
+// differ workers mostly hash and compare
+const AutoTuneDcpWorkersPerCPU = 8
+const AutoTuneFileDifferWorkersPerCPU = 2
+const AutoTuneMutationDifferWorkersPerCPU = 8
+
+// Key of the item count in the basic stats of a bucket
+const BasicStatsKey = "basicStats"
+const ItemCountKey = "itemCount"
+
+// Keys are sampled in steps of 1/SampleResolution of the key space, i.e. samplePercent has 4 significant decimals
+const SampleResolution = 1000000
+
+// With completeBySeqno, a vbucket whose high seqno has moved more than this many seqnos past the end seqno it was
+// streamed to by the time all the vbuckets have completed was changing during the capture
+const ChangingVbucketSeqnoThreshold = 100
+
+// Annotates the summaries of runs during which vbuckets were changing, since some of their diffs may only be noise
+const DataChangingWarning = "data was changing during capture"
+
+// Bound of binaryDiffHexDumpBytes, so that a diff record does not grow into a dump of the whole doc
+const MaxBinaryDiffHexDumpBytes = 1024
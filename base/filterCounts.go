@@ -0,0 +1,42 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import "fmt"
+
+// What the replication filter did with the mutations streamed from a cluster. Only mutations of live docs are
+// filtered, so deletions, expirations and system events are not counted. Filtered and UnableToFilter mutations
+// are left out of the data files
+type FilterCounts struct {
+	Passed         int64
+	Filtered       int64
+	UnableToFilter int64
+}
+
+func (c *FilterCounts) Record(filterResult FilterResultType) {
+	switch filterResult {
+	case Filtered:
+		c.Filtered++
+	case UnableToFilter:
+		c.UnableToFilter++
+	default:
+		c.Passed++
+	}
+}
+
+func (c *FilterCounts) Add(other *FilterCounts) {
+	c.Passed += other.Passed
+	c.Filtered += other.Filtered
+	c.UnableToFilter += other.UnableToFilter
+}
+
+func (c *FilterCounts) String() string {
+	return fmt.Sprintf("passed=%v filtered=%v unableToFilter=%v", c.Passed, c.Filtered, c.UnableToFilter)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/couchbase/gocbcore/v9"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +26,13 @@ type PasswordAuth struct {
 type CertificateAuth struct {
 	PasswordAuth
 	CertificateBytes []byte
+	// PEM encoded x.509 client certificate and key. If set, they are used to authenticate instead of the password
+	ClientCertificate []byte
+	ClientKey         []byte
+}
+
+func (c *CertificateAuth) hasClientCertificate() bool {
+	return len(c.ClientCertificate) > 0 && len(c.ClientKey) > 0
 }
 
 func (c *CertificateAuth) SupportsTLS() bool {
@@ -36,16 +44,111 @@ func (c *CertificateAuth) SupportsNonTLS() bool {
 }
 
 func (c *CertificateAuth) Certificate(req gocbcore.AuthCertRequest) (*tls.Certificate, error) {
+	if c.hasClientCertificate() {
+		keyPair, err := tls.X509KeyPair(c.ClientCertificate, c.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		return &keyPair, nil
+	}
 	return &tls.Certificate{Certificate: [][]byte{c.CertificateBytes}}, nil
 }
 
 func (c *CertificateAuth) Credentials(req gocbcore.AuthCredsRequest) ([]gocbcore.UserPassPair, error) {
+	if c.hasClientCertificate() {
+		// The identity comes from the client certificate
+		return []gocbcore.UserPassPair{{}}, nil
+	}
 	return []gocbcore.UserPassPair{{
 		Username: c.Username,
 		Password: c.Password,
 	}}, nil
 }
 
+// If set, the only SASL mechanism KV connections authenticate with
+// Process wide, and read by every run in progress, so it is only accessed atomically
+var forcedKVAuthMechanism atomic.Value
+
+// An empty mechanism lets the mechanisms be negotiated again
+func SetForcedKVAuthMechanism(mechanism gocbcore.AuthMechanism) {
+	forcedKVAuthMechanism.Store(mechanism)
+}
+
+func GetForcedKVAuthMechanism() gocbcore.AuthMechanism {
+	mechanism, _ := forcedKVAuthMechanism.Load().(gocbcore.AuthMechanism)
+	return mechanism
+}
+
+var KVAuthMechanisms = []gocbcore.AuthMechanism{
+	gocbcore.PlainAuthMechanism,
+	gocbcore.ScramSha1AuthMechanism,
+	gocbcore.ScramSha256AuthMechanism,
+	gocbcore.ScramSha512AuthMechanism,
+}
+
+func ParseKVAuthMechanism(mechanism string) (gocbcore.AuthMechanism, error) {
+	for _, m := range KVAuthMechanisms {
+		if strings.EqualFold(mechanism, string(m)) {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("invalid KV auth mechanism %v. Accepted values are %v", mechanism, KVAuthMechanisms)
+}
+
+// Over TLS, the password is already protected, so the SDK default of PLAIN is kept
+// Otherwise only SCRAM-SHA512 and SCRAM-SHA256 are negotiated, so that clusters that disable PLAIN can be connected to
+func GetKVAuthMechanisms(useTLS bool) []gocbcore.AuthMechanism {
+	if mechanism := GetForcedKVAuthMechanism(); mechanism != "" {
+		return []gocbcore.AuthMechanism{mechanism}
+	}
+	if useTLS {
+		return nil
+	}
+	return []gocbcore.AuthMechanism{gocbcore.ScramSha512AuthMechanism, gocbcore.ScramSha256AuthMechanism}
+}
+
+const NetworkTypeDefault = "default"
+const NetworkTypeExternal = "external"
+
+var NetworkTypes = []string{NetworkTypeDefault, NetworkTypeExternal}
+
+// The addresses agents connect to the nodes with, NetworkTypeDefault for their internal addresses or NetworkTypeExternal
+// for their alternate addresses, e.g. behind Kubernetes or cloud NAT. If empty, gocbcore uses the network that the
+// bootstrap address belongs to
+// Process wide, and read by every run in progress, so it is only accessed atomically
+var networkType atomic.Value
+
+func SetNetworkType(network string) {
+	networkType.Store(network)
+}
+
+func GetNetworkType() string {
+	network, _ := networkType.Load().(string)
+	return network
+}
+
+func ValidateNetworkType(networkType string) error {
+	for _, t := range NetworkTypes {
+		if networkType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid network %v. Accepted values are %v", networkType, NetworkTypes)
+}
+
+// Adds the network option to a connection string for gocb, which has no other way to set it
+func AddNetworkTypeToConnStr(connStr string) string {
+	network := GetNetworkType()
+	if network == "" {
+		return connStr
+	}
+	delimiter := "?"
+	if strings.Contains(connStr, "?") {
+		delimiter = "&"
+	}
+	return fmt.Sprintf("%v%vnetwork=%v", connStr, delimiter, network)
+}
+
 type RetryStrategy struct{}
 
 func (rs *RetryStrategy) RetryAfter(req gocbcore.RetryRequest,
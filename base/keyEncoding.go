@@ -0,0 +1,63 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keys that EncodeKey writes as base64 start with KeyBase64Prefix
+const KeyBase64Prefix = "b64:"
+
+// Whether the key would corrupt a log line, or not make it through JSON as it is. Keys that start with
+// KeyBase64Prefix are encoded too, so that DecodeKey cannot mistake them for encoded ones
+func keyNeedsEncoding(key string) bool {
+	if !utf8.ValidString(key) || strings.HasPrefix(key, KeyBase64Prefix) {
+		return true
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the key as it is, or KeyBase64Prefix followed by its base64 encoding when it holds invalid UTF-8 or
+// control characters, which would otherwise be mangled by JSON or break the log line or the file it is written to
+func EncodeKey(key string) string {
+	if !keyNeedsEncoding(key) {
+		return key
+	}
+	return KeyBase64Prefix + base64.StdEncoding.EncodeToString([]byte(key))
+}
+
+// Reverses EncodeKey
+func DecodeKey(encoded string) (string, error) {
+	if !strings.HasPrefix(encoded, KeyBase64Prefix) {
+		return encoded, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded[len(KeyBase64Prefix):])
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// Tags a document key, []byte or string, as user data once it is encoded by EncodeKey
+func TagKey(key interface{}) string {
+	if bytes, ok := key.([]byte); ok {
+		return TagUD(EncodeKey(string(bytes)))
+	}
+	return TagUD(EncodeKey(key.(string)))
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const KeyRangeDelimiter = ".."
+
+// Restricts the keys that are recorded and diffed to those starting with Prefix and, byte-wise, between Start
+// and End, both inclusive. Empty fields do not restrict. Unlike the replication filter, it only looks at the key
+type KeyRange struct {
+	Prefix string
+	Start  string
+	End    string
+}
+
+// Parses a keyRange of the form start..end, where either end may be left out, e.g. "user_1000.." or "..user_2000"
+func ParseKeyRange(prefix, keyRange string) (KeyRange, error) {
+	r := KeyRange{Prefix: prefix}
+	if keyRange == "" {
+		return r, nil
+	}
+	parts := strings.Split(keyRange, KeyRangeDelimiter)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("Invalid keyRange '%v'. Expected start%vend", keyRange, KeyRangeDelimiter)
+	}
+	r.Start, r.End = parts[0], parts[1]
+	if r.Start != "" && r.End != "" && r.Start > r.End {
+		return r, fmt.Errorf("Invalid keyRange '%v'. Start is after end", keyRange)
+	}
+	return r, nil
+}
+
+func (r KeyRange) Contains(key []byte) bool {
+	if r.Prefix != "" && !bytes.HasPrefix(key, []byte(r.Prefix)) {
+		return false
+	}
+	if r.Start != "" && bytes.Compare(key, []byte(r.Start)) < 0 {
+		return false
+	}
+	if r.End != "" && bytes.Compare(key, []byte(r.End)) > 0 {
+		return false
+	}
+	return true
+}
+
+func (r KeyRange) IsAll() bool {
+	return r == KeyRange{}
+}
+
+func (r KeyRange) String() string {
+	var parts []string
+	if r.Prefix != "" {
+		parts = append(parts, fmt.Sprintf("prefix %q", r.Prefix))
+	}
+	if r.Start != "" || r.End != "" {
+		parts = append(parts, fmt.Sprintf("range %q%v%q", r.Start, KeyRangeDelimiter, r.End))
+	}
+	return strings.Join(parts, " and ")
+}
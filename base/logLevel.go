@@ -0,0 +1,28 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import "fmt"
+
+const LogLevelDebug = "debug"
+const LogLevelInfo = "info"
+const LogLevelWarn = "warn"
+const LogLevelError = "error"
+
+var LogLevels = []string{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError}
+
+func ValidateLogLevel(level string) error {
+	for _, l := range LogLevels {
+		if level == l {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %v. Accepted values are %v", level, LogLevels)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync/atomic"
+)
+
+const RedactionLevelNone = "none"
+const RedactionLevelPartial = "partial"
+const RedactionLevelFull = "full"
+
+var RedactionLevels = []string{RedactionLevelNone, RedactionLevelPartial, RedactionLevelFull}
+
+const UserDataStartTag = "<ud>"
+const UserDataEndTag = "</ud>"
+
+// How user data, i.e. document keys, bodies and xattrs, is written to the logs and the mutation differ reports
+// RedactionLevelPartial wraps it in <ud></ud> tags, for it to be redacted later the way the Couchbase Server logs
+// are, and RedactionLevelFull replaces it with its SHA1 hash within the tags, so that the same key still shows up
+// the same throughout
+// Process wide, and read by every run in progress, so it is only accessed atomically
+var redactionLevel atomic.Value
+
+func SetRedactionLevel(level string) {
+	redactionLevel.Store(level)
+}
+
+// RedactionLevelNone if never set
+func GetRedactionLevel() string {
+	level, _ := redactionLevel.Load().(string)
+	if level == "" {
+		return RedactionLevelNone
+	}
+	return level
+}
+
+func ValidateRedactionLevel(level string) error {
+	for _, l := range RedactionLevels {
+		if level == l {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid redaction level %v. Accepted values are %v", level, RedactionLevels)
+}
+
+func IsRedactionOn() bool {
+	level := GetRedactionLevel()
+	return level == RedactionLevelPartial || level == RedactionLevelFull
+}
+
+// Tags user data according to the redaction level. []byte, i.e. keys, is taken as a string
+func TagUD(data interface{}) string {
+	var str string
+	if bytes, ok := data.([]byte); ok {
+		str = string(bytes)
+	} else {
+		str = fmt.Sprintf("%v", data)
+	}
+	switch GetRedactionLevel() {
+	case RedactionLevelPartial:
+		return UserDataStartTag + str + UserDataEndTag
+	case RedactionLevelFull:
+		return fmt.Sprintf("%v%x%v", UserDataStartTag, sha1.Sum([]byte(str)), UserDataEndTag)
+	}
+	return str
+}
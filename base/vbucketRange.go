@@ -0,0 +1,54 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package base
+
+import "fmt"
+
+// A range of vbuckets, both ends inclusive, so that several instances of the tool can each stream and diff
+// a disjoint part of a bucket
+type VbucketRange struct {
+	Start uint16
+	End   uint16
+}
+
+var AllVbuckets = VbucketRange{Start: 0, End: NumberOfVbuckets - 1}
+
+// The share of the vbuckets of the instance at nodeIndex, from 0, out of totalNodes instances
+// Shares differ in size by at most one vbucket
+func NodeVbucketRange(nodeIndex, totalNodes int) VbucketRange {
+	return VbucketRange{
+		Start: uint16(nodeIndex * NumberOfVbuckets / totalNodes),
+		End:   uint16((nodeIndex+1)*NumberOfVbuckets/totalNodes - 1),
+	}
+}
+
+func (r VbucketRange) Contains(vbno uint16) bool {
+	return vbno >= r.Start && vbno <= r.End
+}
+
+func (r VbucketRange) Count() int {
+	return int(r.End) - int(r.Start) + 1
+}
+
+func (r VbucketRange) IsAll() bool {
+	return r == AllVbuckets
+}
+
+func (r VbucketRange) Vbnos() []uint16 {
+	vbnos := make([]uint16, 0, r.Count())
+	for vbno := int(r.Start); vbno <= int(r.End); vbno++ {
+		vbnos = append(vbnos, uint16(vbno))
+	}
+	return vbnos
+}
+
+func (r VbucketRange) String() string {
+	return fmt.Sprintf("%v-%v", r.Start, r.End)
+}
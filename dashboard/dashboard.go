@@ -0,0 +1,256 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dashboard
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ansiClearScreen = "\033[2J"
+	ansiCursorHome  = "\033[H"
+	ansiHideCursor  = "\033[?25l"
+	ansiShowCursor  = "\033[?25h"
+
+	progressBarWidth = 40
+	heatmapWidth     = 64
+)
+
+// Returns the number of units done and the total number of units for a stage
+type ProgressFunc func() (done uint64, total uint64)
+
+// Returns a monotonically increasing counter, used to derive a rate
+type CounterFunc func() uint64
+
+// Returns whether each vbucket has completed, indexed by vbno
+type VbStatesFunc func() []bool
+
+type stage struct {
+	name      string
+	progress  ProgressFunc
+	startTime time.Time
+}
+
+type throughput struct {
+	name    string
+	counter CounterFunc
+	prev    uint64
+	rate    uint64
+}
+
+type counter struct {
+	name    string
+	counter CounterFunc
+}
+
+type heatmap struct {
+	name     string
+	vbStates VbStatesFunc
+}
+
+// Dashboard periodically redraws a summary of a live run in place on a terminal
+type Dashboard struct {
+	out             io.Writer
+	refreshInterval time.Duration
+	startTime       time.Time
+
+	mtx         sync.Mutex
+	stages      []*stage
+	throughputs []*throughput
+	counters    []*counter
+	heatmaps    []*heatmap
+
+	finChan  chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewDashboard(out io.Writer, refreshInterval time.Duration) *Dashboard {
+	return &Dashboard{
+		out:             out,
+		refreshInterval: refreshInterval,
+		finChan:         make(chan bool),
+	}
+}
+
+func (d *Dashboard) AddStage(name string, progress ProgressFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.stages = append(d.stages, &stage{name: name, progress: progress, startTime: time.Now()})
+}
+
+func (d *Dashboard) AddThroughput(name string, c CounterFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.throughputs = append(d.throughputs, &throughput{name: name, counter: c})
+}
+
+func (d *Dashboard) AddCounter(name string, c CounterFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.counters = append(d.counters, &counter{name: name, counter: c})
+}
+
+func (d *Dashboard) AddVbHeatmap(name string, vbStates VbStatesFunc) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.heatmaps = append(d.heatmaps, &heatmap{name: name, vbStates: vbStates})
+}
+
+func (d *Dashboard) Start() {
+	d.startTime = time.Now()
+	fmt.Fprint(d.out, ansiHideCursor+ansiClearScreen)
+	d.wg.Add(1)
+	go d.run()
+}
+
+func (d *Dashboard) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.finChan)
+		d.wg.Wait()
+		// Leave the last frame on screen
+		d.redraw()
+		fmt.Fprint(d.out, ansiShowCursor)
+	})
+}
+
+func (d *Dashboard) run() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	d.redraw()
+	for {
+		select {
+		case <-ticker.C:
+			d.redraw()
+		case <-d.finChan:
+			return
+		}
+	}
+}
+
+func (d *Dashboard) redraw() {
+	d.mtx.Lock()
+	frame := d.render()
+	d.mtx.Unlock()
+	fmt.Fprint(d.out, ansiCursorHome+string(frame))
+}
+
+// mtx should be held
+func (d *Dashboard) render() []byte {
+	var buffer bytes.Buffer
+	elapsed := time.Since(d.startTime).Truncate(time.Second)
+	buffer.WriteString(fmt.Sprintf("xdcrDiffer - elapsed %v\033[K\n\033[K\n", elapsed))
+
+	if len(d.stages) > 0 {
+		buffer.WriteString("Stages:\033[K\n")
+		for _, s := range d.stages {
+			done, total := s.progress()
+			buffer.WriteString(fmt.Sprintf("  %-24s %s%s\033[K\n", s.name, ProgressBar(done, total, progressBarWidth),
+				FormatEta(done, total, time.Since(s.startTime))))
+		}
+		buffer.WriteString("\033[K\n")
+	}
+
+	if len(d.throughputs) > 0 {
+		buffer.WriteString("Throughput:\033[K\n")
+		seconds := uint64(d.refreshInterval / time.Second)
+		if seconds == 0 {
+			seconds = 1
+		}
+		for _, t := range d.throughputs {
+			cur := t.counter()
+			if cur >= t.prev {
+				t.rate = (cur - t.prev) / seconds
+			}
+			t.prev = cur
+			buffer.WriteString(fmt.Sprintf("  %-24s %v items/sec (total %v)\033[K\n", t.name, t.rate, cur))
+		}
+		buffer.WriteString("\033[K\n")
+	}
+
+	if len(d.counters) > 0 {
+		buffer.WriteString("Diffs:\033[K\n")
+		for _, c := range d.counters {
+			buffer.WriteString(fmt.Sprintf("  %-24s %v\033[K\n", c.name, c.counter()))
+		}
+		buffer.WriteString("\033[K\n")
+	}
+
+	for _, h := range d.heatmaps {
+		buffer.WriteString(fmt.Sprintf("%v vbucket completion ('#' completed, '.' in progress):\033[K\n", h.name))
+		for _, line := range VbHeatmapLines(h.vbStates(), heatmapWidth) {
+			buffer.WriteString("  " + line + "\033[K\n")
+		}
+		buffer.WriteString("\033[K\n")
+	}
+	// Clear anything left over from a previous, longer frame
+	buffer.WriteString("\033[J")
+	return buffer.Bytes()
+}
+
+// Renders "[#####-----]  50.0% (5/10)"
+func ProgressBar(done, total uint64, width int) string {
+	if total == 0 {
+		return fmt.Sprintf("[%s]   n/a", strings.Repeat("-", width))
+	}
+	if done > total {
+		done = total
+	}
+	filled := int(float64(done) / float64(total) * float64(width))
+	percent := float64(done) / float64(total) * 100
+	return fmt.Sprintf("[%s%s] %5.1f%% (%v/%v)", strings.Repeat("#", filled), strings.Repeat("-", width-filled),
+		percent, done, total)
+}
+
+// Estimates the time left from the average rate so far
+// Returns false if nothing is done yet, or everything is
+func Eta(done, total uint64, elapsed time.Duration) (time.Duration, bool) {
+	if done == 0 || done >= total || elapsed <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done)), true
+}
+
+// Returns the ETA to append to a progress bar, or an empty string if it cannot be estimated
+func FormatEta(done, total uint64, elapsed time.Duration) string {
+	eta, ok := Eta(done, total, elapsed)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" ETA %v", eta.Truncate(time.Second))
+}
+
+// Lays out vbucket states in rows of the given width
+func VbHeatmapLines(vbStates []bool, width int) []string {
+	var lines []string
+	for i := 0; i < len(vbStates); i += width {
+		end := i + width
+		if end > len(vbStates) {
+			end = len(vbStates)
+		}
+		var line strings.Builder
+		for _, completed := range vbStates[i:end] {
+			if completed {
+				line.WriteByte('#')
+			} else {
+				line.WriteByte('.')
+			}
+		}
+		lines = append(lines, line.String())
+	}
+	return lines
+}
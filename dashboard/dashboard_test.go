@@ -0,0 +1,68 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dashboard
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressBar(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("[#####-----]  50.0% (5/10)", ProgressBar(5, 10, 10))
+	assert.Equal("[##########] 100.0% (10/10)", ProgressBar(12, 10, 10))
+	assert.Equal("[----------]   n/a", ProgressBar(0, 0, 10))
+}
+
+func TestEta(t *testing.T) {
+	assert := assert.New(t)
+
+	eta, ok := Eta(25, 100, 10*time.Second)
+	assert.True(ok)
+	assert.Equal(30*time.Second, eta)
+	assert.Equal(" ETA 30s", FormatEta(25, 100, 10*time.Second))
+
+	_, ok = Eta(0, 100, 10*time.Second)
+	assert.False(ok)
+	_, ok = Eta(100, 100, 10*time.Second)
+	assert.False(ok)
+	assert.Equal("", FormatEta(0, 0, time.Second))
+}
+
+func TestVbHeatmapLines(t *testing.T) {
+	assert := assert.New(t)
+
+	states := make([]bool, 10)
+	states[0] = true
+	states[9] = true
+	lines := VbHeatmapLines(states, 4)
+	assert.Equal([]string{"#...", "....", ".#"}, lines)
+}
+
+func TestDashboardRender(t *testing.T) {
+	assert := assert.New(t)
+
+	var out bytes.Buffer
+	d := NewDashboard(&out, time.Second)
+	d.AddStage("source DCP", func() (uint64, uint64) { return 1, 2 })
+	d.AddCounter("diff keys", func() uint64 { return 42 })
+	d.Start()
+	d.Stop()
+
+	rendered := out.String()
+	assert.True(strings.Contains(rendered, "source DCP"))
+	assert.True(strings.Contains(rendered, "50.0%"))
+	assert.True(strings.Contains(rendered, "42"))
+}
@@ -1,5 +1,8 @@
 package dcp
 
+import "xdcrDiffer/base"
+
+// ColFilterCnts holds what the replication filter did with the mutations of the vb by collection ID
 type Checkpoint struct {
 	Vbuuid             uint64
 	Seqno              uint64
@@ -7,6 +10,7 @@ type Checkpoint struct {
 	SnapshotEndSeqno   uint64
 	FilteredCnt        uint64
 	FailedFilterCnt    uint64
+	ColFilterCnts      map[uint32]*base.FilterCounts `json:",omitempty"`
 }
 
 // vbucket timestamp required by dcp
@@ -0,0 +1,203 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Loads a checkpoint file written by a run
+func LoadCheckpointFile(checkpointFileName string) (*CheckpointDoc, error) {
+	checkpointFileBytes, err := ioutil.ReadFile(checkpointFileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseCheckpointDoc(checkpointFileName, checkpointFileBytes)
+}
+
+// Returns a checkpoint doc holding the current vbuuid and high seqno of each vbucket of the bucket, as if a run had
+// just streamed all of it
+func LiveCheckpointDoc(ref *metadata.RemoteClusterReference, kvPort uint16, bucketName string, timeout time.Duration) (*CheckpointDoc, error) {
+	agent, err := newBucketAgent(ref, kvPort, bucketName, "xdcrDifferCheckpointCompare")
+	if err != nil {
+		return nil, err
+	}
+	defer agent.Close()
+
+	statsMap := make(map[string]map[string]string)
+	var statsErr error
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(1)
+	_, err = agent.Stats(gocbcore.StatsOptions{
+		Key:           base.VbucketSeqnoStatName,
+		Deadline:      time.Now().Add(timeout),
+		RetryStrategy: &base.RetryStrategy{},
+	}, func(result *gocbcore.StatsResult, cbErr error) {
+		defer waitGroup.Done()
+		if cbErr != nil {
+			statsErr = cbErr
+			return
+		}
+		errMap := make(xdcrBase.ErrorMap)
+		for server, singleServerStats := range result.Servers {
+			if singleServerStats.Error != nil {
+				errMap[server] = singleServerStats.Error
+				continue
+			}
+			statsMap[server] = singleServerStats.Stats
+		}
+		if len(errMap) > 0 {
+			statsErr = fmt.Errorf(xdcrBase.FlattenErrorMap(errMap))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	waitGroup.Wait()
+	if statsErr != nil {
+		return nil, statsErr
+	}
+
+	vbuuidMap := make(map[uint16]uint64)
+	highSeqnoMap := make(map[uint16]uint64)
+	err = utils.ParseHighSeqnoStat(statsMap, highSeqnoMap, vbuuidMap, true)
+	if err != nil {
+		return nil, err
+	}
+	checkpointDoc := &CheckpointDoc{Checkpoints: make(map[uint16]*Checkpoint)}
+	for vbno, highSeqno := range highSeqnoMap {
+		checkpointDoc.Checkpoints[vbno] = &Checkpoint{Vbuuid: vbuuidMap[vbno], Seqno: highSeqno}
+	}
+	if len(checkpointDoc.Checkpoints) < base.NumberOfVbuckets {
+		return nil, fmt.Errorf("stats of bucket %v have less than 1024 vbuckets", bucketName)
+	}
+	return checkpointDoc, nil
+}
+
+// Where a vbucket is in two checkpoints
+type VbCheckpointDiff struct {
+	Vbno      uint16
+	OldVbuuid uint64
+	NewVbuuid uint64
+	OldSeqno  uint64
+	NewSeqno  uint64
+}
+
+// Number of seqnos the vbucket moved on by, negative if it went back
+func (d *VbCheckpointDiff) SeqnoDelta() int64 {
+	return int64(d.NewSeqno) - int64(d.OldSeqno)
+}
+
+// What changed from an old checkpoint to a newer one, or to the live state of the bucket
+type CheckpointComparison struct {
+	// Vbuckets whose vbuuid or seqno differ, by vbno
+	Diffs []*VbCheckpointDiff
+	// Vbuckets in only one of the checkpoints
+	MissingVbs []uint16
+	// Sum of the seqno deltas of the vbuckets that moved on
+	TotalSeqnoDelta uint64
+	// Vbuckets that failed over in between, which a resume from the old checkpoint may stream again from a rollback point
+	VbuuidChangedVbs []uint16
+	// Vbuckets that went back, i.e. were rolled back or the old checkpoint is the newer one
+	SeqnoWentBackVbs []uint16
+}
+
+// A resume from the old checkpoint only streams the mutations past it when no vbucket failed over or went back
+func (c *CheckpointComparison) ResumeSafe() bool {
+	return len(c.MissingVbs) == 0 && len(c.VbuuidChangedVbs) == 0 && len(c.SeqnoWentBackVbs) == 0
+}
+
+// Compares each vbucket of newDoc to where it was in oldDoc
+func CompareCheckpoints(oldDoc, newDoc *CheckpointDoc) *CheckpointComparison {
+	comparison := &CheckpointComparison{}
+	vbnos := make(map[uint16]bool)
+	for vbno := range oldDoc.Checkpoints {
+		vbnos[vbno] = true
+	}
+	for vbno := range newDoc.Checkpoints {
+		vbnos[vbno] = true
+	}
+	var sortedVbnos []uint16
+	for vbno := range vbnos {
+		sortedVbnos = append(sortedVbnos, vbno)
+	}
+	sort.Slice(sortedVbnos, func(i, j int) bool { return sortedVbnos[i] < sortedVbnos[j] })
+
+	for _, vbno := range sortedVbnos {
+		oldCkpt, newCkpt := oldDoc.Checkpoints[vbno], newDoc.Checkpoints[vbno]
+		if oldCkpt == nil || newCkpt == nil {
+			comparison.MissingVbs = append(comparison.MissingVbs, vbno)
+			continue
+		}
+		if oldCkpt.Vbuuid == newCkpt.Vbuuid && oldCkpt.Seqno == newCkpt.Seqno {
+			continue
+		}
+		diff := &VbCheckpointDiff{
+			Vbno:      vbno,
+			OldVbuuid: oldCkpt.Vbuuid,
+			NewVbuuid: newCkpt.Vbuuid,
+			OldSeqno:  oldCkpt.Seqno,
+			NewSeqno:  newCkpt.Seqno,
+		}
+		comparison.Diffs = append(comparison.Diffs, diff)
+		if diff.OldVbuuid != diff.NewVbuuid {
+			comparison.VbuuidChangedVbs = append(comparison.VbuuidChangedVbs, vbno)
+		}
+		if diff.NewSeqno < diff.OldSeqno {
+			comparison.SeqnoWentBackVbs = append(comparison.SeqnoWentBackVbs, vbno)
+		} else {
+			comparison.TotalSeqnoDelta += diff.NewSeqno - diff.OldSeqno
+		}
+	}
+	return comparison
+}
+
+// A summary, followed by a table of the vbuckets that differ
+func (c *CheckpointComparison) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%v vbuckets differ, seqnos moved on by %v in total\n", len(c.Diffs), c.TotalSeqnoDelta)
+	if len(c.MissingVbs) > 0 {
+		fmt.Fprintf(&builder, "Vbuckets in only one of the checkpoints: %v\n", c.MissingVbs)
+	}
+	if len(c.VbuuidChangedVbs) > 0 {
+		fmt.Fprintf(&builder, "Vbuckets whose vbuuid changed: %v\n", c.VbuuidChangedVbs)
+	}
+	if len(c.SeqnoWentBackVbs) > 0 {
+		fmt.Fprintf(&builder, "Vbuckets whose seqno went back: %v\n", c.SeqnoWentBackVbs)
+	}
+	if c.ResumeSafe() {
+		fmt.Fprintf(&builder, "Resuming from the old checkpoint is safe\n")
+	} else {
+		fmt.Fprintf(&builder, "Resuming from the old checkpoint is not safe, vbuckets above may be streamed again or miss mutations\n")
+	}
+	if len(c.Diffs) == 0 {
+		return builder.String()
+	}
+
+	writer := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "\nVBUCKET\tOLD VBUUID\tNEW VBUUID\tOLD SEQNO\tNEW SEQNO\tDELTA\n")
+	for _, diff := range c.Diffs {
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n", diff.Vbno, diff.OldVbuuid, diff.NewVbuuid, diff.OldSeqno, diff.NewSeqno, diff.SeqnoDelta())
+	}
+	writer.Flush()
+	return builder.String()
+}
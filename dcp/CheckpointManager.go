@@ -1,11 +1,14 @@
 package dcp
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +18,7 @@ import (
 	xdcrLog "github.com/couchbase/goxdcr/log"
 	"github.com/rcrowley/go-metrics"
 	"xdcrDiffer/base"
+	"xdcrDiffer/dashboard"
 	"xdcrDiffer/utils"
 )
 
@@ -23,6 +27,7 @@ type CheckpointManager struct {
 	clusterName           string
 	oldCheckpointFileName string
 	newCheckpointFileName string
+	store                 CheckpointStore
 	cluster               *gocb.Cluster
 	startVBTS             map[uint16]*VBTS
 	vbuuidMap             map[uint16]uint64
@@ -31,7 +36,9 @@ type CheckpointManager struct {
 	endSeqnoMap           map[uint16]uint64
 	filteredCnt           map[uint16]metrics.Counter
 	failedFilterCnt       map[uint16]metrics.Counter
-	finChan               chan bool
+	colFilterCnts         map[uint16]*vbFilterCounts
+	ctx                   context.Context
+	cancel                context.CancelFunc
 	// channel to signal the completion of start vbts computation
 	startVbtsDoneChan     chan bool
 	bucketOpTimeout       time.Duration
@@ -39,12 +46,22 @@ type CheckpointManager struct {
 	getStatsRetryInterval time.Duration
 	getStatsMaxBackoff    time.Duration
 	checkpointInterval    int
+	checkpointRetention   int
 	started               bool
 	stateLock             sync.RWMutex
 	logger                *xdcrLog.CommonLogger
 	completeBySeqno       bool
 	logOnceCount          uint64
 	lastRemainingMap      map[uint16]uint64
+	// Seqnos of the previous status report, for verboseProgress
+	lastVbSeqnos map[uint16]uint64
+	// Time and sum of seqnos when status reporting started, to estimate the time left from
+	statusStartTime time.Time
+	statusStartSum  uint64
+	// vbuckets whose high seqno moved more than base.ChangingVbucketSeqnoThreshold past their end seqno while
+	// streaming, and by how much. Set by recheckHighSeqnos once all the vbuckets have completed
+	changedVbs     map[uint16]uint64
+	changedVbsLock sync.RWMutex
 
 	kvSSLPortMap    xdcrBase.SSLPortMap
 	kvVbMap         map[string][]uint16
@@ -54,34 +71,42 @@ type CheckpointManager struct {
 
 func NewCheckpointManager(dcpDriver *DcpDriver, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName, clusterName string,
 	bucketOpTimeout time.Duration, maxNumOfGetStatsRetry int, getStatsRetryInterval, getStatsMaxBackoff time.Duration,
-	checkpointInterval int, startVbtsDoneChan chan bool, logger *xdcrLog.CommonLogger, completeBySeqno bool) *CheckpointManager {
+	checkpointInterval, checkpointRetention int, startVbtsDoneChan chan bool, logger *xdcrLog.CommonLogger, completeBySeqno bool, store CheckpointStore) *CheckpointManager {
+	if store == nil {
+		store = &FileCheckpointStore{}
+	}
+	ctx, cancel := context.WithCancel(dcpDriver.ctx)
 	cm := &CheckpointManager{
 		dcpDriver:             dcpDriver,
 		clusterName:           clusterName,
 		startVBTS:             make(map[uint16]*VBTS),
 		seqnoMap:              make(map[uint16]*SeqnoWithLock),
 		snapshots:             make(map[uint16]*Snapshot),
-		finChan:               make(chan bool),
+		ctx:                   ctx,
+		cancel:                cancel,
 		endSeqnoMap:           make(map[uint16]uint64),
 		filteredCnt:           make(map[uint16]metrics.Counter),
 		failedFilterCnt:       make(map[uint16]metrics.Counter),
+		colFilterCnts:         make(map[uint16]*vbFilterCounts),
 		bucketOpTimeout:       bucketOpTimeout,
 		maxNumOfGetStatsRetry: maxNumOfGetStatsRetry,
 		getStatsRetryInterval: getStatsRetryInterval,
 		getStatsMaxBackoff:    getStatsMaxBackoff,
 		checkpointInterval:    checkpointInterval,
+		checkpointRetention:   checkpointRetention,
 		startVbtsDoneChan:     startVbtsDoneChan,
 		logger:                logger,
 		completeBySeqno:       completeBySeqno,
+		store:                 store,
 	}
 
 	if checkpointFileDir != "" {
 		if oldCheckpointFileName != "" {
-			cm.oldCheckpointFileName = checkpointFileDir + base.FileDirDelimiter + clusterName + base.FileNameDelimiter + oldCheckpointFileName
+			cm.oldCheckpointFileName = utils.JoinPath(checkpointFileDir, clusterName+base.FileNameDelimiter+oldCheckpointFileName)
 		}
 
 		if newCheckpointFileName != "" {
-			cm.newCheckpointFileName = checkpointFileDir + base.FileDirDelimiter + clusterName + base.FileNameDelimiter + newCheckpointFileName
+			cm.newCheckpointFileName = utils.JoinPath(checkpointFileDir, clusterName+base.FileNameDelimiter+newCheckpointFileName)
 		}
 	}
 
@@ -91,6 +116,7 @@ func NewCheckpointManager(dcpDriver *DcpDriver, checkpointFileDir, oldCheckpoint
 		cm.snapshots[vbno] = &Snapshot{}
 		cm.filteredCnt[vbno] = metrics.NewCounter()
 		cm.failedFilterCnt[vbno] = metrics.NewCounter()
+		cm.colFilterCnts[vbno] = newVbFilterCounts()
 	}
 
 	return cm
@@ -122,6 +148,18 @@ func (cm *CheckpointManager) OutputEndSeqnoMapDiff() map[uint16]uint64 {
 	return diffMap
 }
 
+// Sum of the seqnos left to stream in the vbuckets of the driver
+func (cm *CheckpointManager) remainingSeqnos() uint64 {
+	var remaining uint64
+	for _, vbno := range cm.dcpDriver.vbRange.Vbnos() {
+		startSeqno := cm.seqnoMap[vbno].getSeqno()
+		if endSeqno := cm.endSeqnoMap[vbno]; endSeqno > startSeqno {
+			remaining += endSeqno - startSeqno
+		}
+	}
+	return remaining
+}
+
 func (cm *CheckpointManager) Start() error {
 	err := cm.initialize()
 	if err != nil {
@@ -162,7 +200,7 @@ func (cm *CheckpointManager) Stop() error {
 		}
 	}
 
-	close(cm.finChan)
+	cm.cancel()
 
 	return nil
 }
@@ -182,19 +220,33 @@ func (cm *CheckpointManager) periodicalCheckpointing() {
 		case <-ticker.C:
 			cm.checkpointOnce(iter)
 			iter++
-		case <-cm.finChan:
+		case <-cm.ctx.Done():
 			return
 		}
 	}
 }
 
 func (cm *CheckpointManager) checkpointOnce(iter int) error {
-	checkpointFileName := cm.newCheckpointFileName + base.FileNameDelimiter + fmt.Sprintf("%v", iter)
+	checkpointFileName := cm.periodicCheckpointFileName(iter)
 	err := cm.saveCheckpoint(checkpointFileName)
 	if err != nil {
 		cm.logger.Errorf("%v error saving checkpoint %v. err=%v\n", cm.clusterName, checkpointFileName, err)
+		return err
 	}
-	return err
+
+	// Only once the new generation is saved, so that there are always checkpointRetention complete ones
+	if cm.checkpointRetention > 0 && iter >= cm.checkpointRetention {
+		prunedFileName := cm.periodicCheckpointFileName(iter - cm.checkpointRetention)
+		pruneErr := cm.store.Remove(prunedFileName)
+		if pruneErr != nil {
+			cm.logger.Warnf("%v error removing old checkpoint %v. err=%v\n", cm.clusterName, prunedFileName, pruneErr)
+		}
+	}
+	return nil
+}
+
+func (cm *CheckpointManager) periodicCheckpointFileName(iter int) string {
+	return cm.newCheckpointFileName + base.FileNameDelimiter + fmt.Sprintf("%v", iter)
 }
 
 func (cm *CheckpointManager) reportStatus() {
@@ -207,7 +259,7 @@ func (cm *CheckpointManager) reportStatus() {
 		select {
 		case <-ticker.C:
 			prevSum = cm.reportStatusOnce(prevSum)
-		case <-cm.finChan:
+		case <-cm.ctx.Done():
 			prevSum = cm.reportStatusOnce(prevSum)
 			return
 		}
@@ -231,7 +283,16 @@ func (cm *CheckpointManager) reportStatusOnce(prevSum uint64) uint64 {
 	} else {
 		cm.logger.Infof("%v %v processed %v mutations, filtered %v mutations, %v failed filtering.\n",
 			time.Now(), cm.clusterName, sum, filtered, failedFilter)
+		cm.statusStartTime = time.Now()
+		cm.statusStartSum = sum
+	}
+	if cm.completeBySeqno {
+		cm.logger.Infof("%v %v progress %v\n", time.Now(), cm.clusterName, cm.progressString(sum))
+	}
+	if cm.dcpDriver.verboseProgress {
+		cm.logVbProgress()
 	}
+	cm.dcpDriver.reportThroughput()
 	if cm.completeBySeqno && cm.logOnceCount%10 == 0 {
 		diffMap := cm.OutputEndSeqnoMapDiff()
 		cm.logger.Infof("%v remaining seqnomap: %v\n", cm.clusterName, diffMap)
@@ -249,6 +310,57 @@ func (cm *CheckpointManager) reportStatusOnce(prevSum uint64) uint64 {
 	return sum
 }
 
+// Logs the seqno of each vbucket of the driver that has not completed, along with its end seqno when completing by
+// seqno, the furthest behind first. Those that have not moved since the previous report are marked with a *
+func (cm *CheckpointManager) logVbProgress() {
+	vbSeqnos := make(map[uint16]uint64)
+	var lagging []uint16
+	for _, vbno := range cm.dcpDriver.vbRange.Vbnos() {
+		seqno := cm.seqnoMap[vbno].getSeqno()
+		vbSeqnos[vbno] = seqno
+		if !cm.completeBySeqno || seqno < cm.endSeqnoMap[vbno] {
+			lagging = append(lagging, vbno)
+		}
+	}
+	if cm.completeBySeqno {
+		sort.SliceStable(lagging, func(i, j int) bool {
+			return cm.endSeqnoMap[lagging[i]]-vbSeqnos[lagging[i]] > cm.endSeqnoMap[lagging[j]]-vbSeqnos[lagging[j]]
+		})
+	}
+
+	format := "vbno:seqno"
+	if cm.completeBySeqno {
+		format = "vbno:seqno/endSeqno"
+	}
+	var progress strings.Builder
+	for _, vbno := range lagging {
+		fmt.Fprintf(&progress, " %v:%v", vbno, vbSeqnos[vbno])
+		if cm.completeBySeqno {
+			fmt.Fprintf(&progress, "/%v", cm.endSeqnoMap[vbno])
+		}
+		if lastSeqno, ok := cm.lastVbSeqnos[vbno]; ok && lastSeqno == vbSeqnos[vbno] {
+			progress.WriteString("*")
+		}
+	}
+	cm.lastVbSeqnos = vbSeqnos
+	cm.logger.Infof("%v %v vbuckets not completed, as %v:%v\n", cm.clusterName, len(lagging), format, progress.String())
+}
+
+// Progress towards the end seqnos, with the time left estimated from the rate since status reporting started,
+// so that the seqnos already processed before a resume do not count toward the rate
+func (cm *CheckpointManager) progressString(sum uint64) string {
+	var endSum uint64
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		endSum += cm.endSeqnoMap[vbno]
+	}
+	progress := dashboard.ProgressBar(sum, endSum, base.StatusLogProgressBarWidth)
+	if sum >= cm.statusStartSum && endSum >= cm.statusStartSum {
+		progress += dashboard.FormatEta(sum-cm.statusStartSum, endSum-cm.statusStartSum, time.Since(cm.statusStartTime))
+	}
+	return progress
+}
+
 func (cm *CheckpointManager) initialize() error {
 	err := cm.initializeCluster()
 	if err != nil {
@@ -310,7 +422,12 @@ func (cm *CheckpointManager) getVbuuidsAndHighSeqnos() error {
 	}
 
 	var sum uint64
-	for _, seqno := range endSeqnoMap {
+	for vb, seqno := range endSeqnoMap {
+		if !cm.dcpDriver.vbRange.Contains(vb) {
+			// Not streamed, so that progress only counts the vbuckets of this driver
+			endSeqnoMap[vb] = 0
+			continue
+		}
 		sum += seqno
 	}
 	cm.logger.Infof("%v total mutations=%v\n", cm.clusterName, sum)
@@ -337,6 +454,48 @@ func (cm *CheckpointManager) getVbuuidsAndHighSeqnos() error {
 	return nil
 }
 
+// Fetches the high seqnos again once all the vbuckets have completed, to tell the vbuckets that kept changing while
+// they were streamed up to their end seqnos, i.e. whose data files are not a consistent cut of the bucket
+func (cm *CheckpointManager) recheckHighSeqnos() error {
+	statsMap, err := cm.getStatsWithRetry()
+	if err != nil {
+		return err
+	}
+
+	highSeqnoMap := make(map[uint16]uint64)
+	err = utils.ParseHighSeqnoStat(statsMap, highSeqnoMap, make(map[uint16]uint64), true)
+	if err != nil {
+		return err
+	}
+
+	changedVbs := make(map[uint16]uint64)
+	for _, vbno := range cm.dcpDriver.vbRange.Vbnos() {
+		endSeqno := cm.endSeqnoMap[vbno]
+		// The high seqno is lower after a failover, which the rollback handling takes care of
+		if highSeqno := highSeqnoMap[vbno]; highSeqno > endSeqno+base.ChangingVbucketSeqnoThreshold {
+			changedVbs[vbno] = highSeqno - endSeqno
+		}
+	}
+	if len(changedVbs) > 0 {
+		cm.logger.Warnf("%v %v: %v vbuckets moved past their end seqno by more than %v seqnos while streaming, by vbucket: %v\n",
+			cm.clusterName, base.DataChangingWarning, len(changedVbs), base.ChangingVbucketSeqnoThreshold, changedVbs)
+	} else {
+		cm.logger.Infof("%v high seqnos rechecked, no vbucket moved past its end seqno by more than %v seqnos while streaming\n",
+			cm.clusterName, base.ChangingVbucketSeqnoThreshold)
+	}
+
+	cm.changedVbsLock.Lock()
+	cm.changedVbs = changedVbs
+	cm.changedVbsLock.Unlock()
+	return nil
+}
+
+func (cm *CheckpointManager) getChangedVbs() map[uint16]uint64 {
+	cm.changedVbsLock.RLock()
+	defer cm.changedVbsLock.RUnlock()
+	return cm.changedVbs
+}
+
 // get stats is likely to time out. add retry
 func (cm *CheckpointManager) getStatsWithRetry() (map[string]map[string]string, error) {
 	var statsMap = make(map[string]map[string]string)
@@ -399,7 +558,7 @@ func (cm *CheckpointManager) getStatsWithRetry() (map[string]map[string]string,
 		return err
 	}
 
-	opErr := utils.ExponentialBackoffExecutor("getStatsWithRetry", cm.getStatsRetryInterval, cm.maxNumOfGetStatsRetry,
+	opErr := utils.ExponentialBackoffExecutorWithContext(cm.ctx, "getStatsWithRetry", cm.getStatsRetryInterval, cm.maxNumOfGetStatsRetry,
 		base.GetStatsBackoffFactor, cm.getStatsMaxBackoff, getStatsFunc)
 	if opErr != nil {
 		return nil, opErr
@@ -420,7 +579,30 @@ func (cm *CheckpointManager) setStartVBTS() error {
 			return err
 		}
 
+		failoverLogs, err := cm.getFailoverLogs()
+		if err != nil {
+			cm.logger.Errorf("%v error getting failover logs. err=%v\n", cm.clusterName, err)
+			return err
+		}
+
 		for vbno, checkpoint := range checkpointDoc.Checkpoints {
+			validCheckpoint := validateCheckpoint(checkpoint, failoverLogs[vbno])
+			if validCheckpoint != checkpoint {
+				cm.logger.Warnf("%v checkpoint of vb %v at vbuuid %v seqno %v is not in the failover log %v. Resuming from seqno %v\n",
+					cm.clusterName, vbno, checkpoint.Vbuuid, checkpoint.Seqno, failoverLogs[vbno], validCheckpoint.Seqno)
+				err = cm.dcpDriver.truncateVbFiles(vbno, validCheckpoint.Seqno)
+				if err != nil {
+					return err
+				}
+				checkpoint = validCheckpoint
+			}
+			if cm.dcpDriver.deltaDiff && cm.dcpDriver.vbRange.Contains(vbno) {
+				// Only what is streamed from the checkpoint on is to be diffed
+				err = cm.dcpDriver.truncateVbFiles(vbno, 0)
+				if err != nil {
+					return err
+				}
+			}
 			cm.startVBTS[vbno] = &VBTS{
 				Checkpoint: checkpoint,
 				EndSeqno:   cm.endSeqnoMap[vbno],
@@ -432,12 +614,17 @@ func (cm *CheckpointManager) setStartVBTS() error {
 			// update start Seqno as that in checkpoint doc
 			cm.seqnoMap[vbno].setSeqno(checkpoint.Seqno)
 			sum += checkpoint.Seqno
+			if cm.dcpDriver.deltaDiff {
+				// The counters only cover the mutations that are diffed
+				continue
+			}
 			totalFiltered += checkpoint.FilteredCnt
 			totalFailedFilter += checkpoint.FailedFilterCnt
 
 			// Resume previous counters
 			cm.filteredCnt[vbno].Inc(int64(checkpoint.FilteredCnt))
 			cm.failedFilterCnt[vbno].Inc(int64(checkpoint.FailedFilterCnt))
+			cm.colFilterCnts[vbno].add(checkpoint.ColFilterCnts)
 		}
 	} else {
 		var vbno uint16
@@ -457,31 +644,182 @@ func (cm *CheckpointManager) setStartVBTS() error {
 	return nil
 }
 
+// Retrieves the failover log of every vb over a short-lived DCP connection
+func (cm *CheckpointManager) getFailoverLogs() (map[uint16][]gocbcore.FailoverEntry, error) {
+	auth, bucketConnStr, err := initializeBucketWithSecurity(cm.dcpDriver, cm.kvVbMap, cm.kvSSLPortMap, true)
+	if err != nil {
+		return nil, err
+	}
+
+	cm.gocbcoreDcpFeed, err = NewGocbcoreDCPFeed(fmt.Sprintf("xdcrDifferCheckpointMgr_%v", cm.clusterName), []string{bucketConnStr},
+		cm.dcpDriver.bucketName, auth, cm.dcpDriver.capabilities.HasCollectionSupport(), 0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer cm.gocbcoreDcpFeed.dcpAgent.Close()
+
+	failoverLogs := make(map[uint16][]gocbcore.FailoverEntry)
+	var failoverLogsLock sync.Mutex
+	var waitGroup sync.WaitGroup
+	var firstErr error
+
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		curVbno := vbno
+		waitGroup.Add(1)
+		_, err = cm.gocbcoreDcpFeed.dcpAgent.GetFailoverLog(curVbno, func(entries []gocbcore.FailoverEntry, cbErr error) {
+			defer waitGroup.Done()
+			failoverLogsLock.Lock()
+			defer failoverLogsLock.Unlock()
+			if cbErr != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("vb %v: %v", curVbno, cbErr)
+				}
+				return
+			}
+			failoverLogs[curVbno] = entries
+		})
+		if err != nil {
+			waitGroup.Done()
+			failoverLogsLock.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("vb %v: %v", curVbno, err)
+			}
+			failoverLogsLock.Unlock()
+			break
+		}
+	}
+	waitGroup.Wait()
+
+	return failoverLogs, firstErr
+}
+
+// Returns the checkpoint to resume a vb from, given its failover log, newest entry first
+// A checkpoint whose vbuuid is no longer in the log is stale and the vb is streamed again from 0
+// A checkpoint taken past the point where its branch of history was failed over from resumes from that point
+func validateCheckpoint(checkpoint *Checkpoint, failoverLog []gocbcore.FailoverEntry) *Checkpoint {
+	if checkpoint.Seqno == 0 {
+		return checkpoint
+	}
+	for i, entry := range failoverLog {
+		if uint64(entry.VbUUID) != checkpoint.Vbuuid {
+			continue
+		}
+		if i == 0 || checkpoint.Seqno <= uint64(failoverLog[i-1].SeqNo) {
+			return checkpoint
+		}
+		branchEndSeqno := uint64(failoverLog[i-1].SeqNo)
+		return &Checkpoint{
+			Vbuuid:             checkpoint.Vbuuid,
+			Seqno:              branchEndSeqno,
+			SnapshotStartSeqno: branchEndSeqno,
+			SnapshotEndSeqno:   branchEndSeqno,
+			FilteredCnt:        checkpoint.FilteredCnt,
+			FailedFilterCnt:    checkpoint.FailedFilterCnt,
+			ColFilterCnts:      checkpoint.ColFilterCnts,
+		}
+	}
+	return &Checkpoint{}
+}
+
 func (cm *CheckpointManager) GetStartVBTS(vbno uint16) *VBTS {
 	return cm.startVBTS[vbno]
 }
 
 func (cm *CheckpointManager) loadCheckpoints() (*CheckpointDoc, error) {
-	checkpointFileBytes, err := ioutil.ReadFile(cm.oldCheckpointFileName)
+	checkpointDoc, err := cm.loadCheckpointFile(cm.oldCheckpointFileName)
+	if err != nil {
+		// The previous generation is still good to resume from, only with more to stream again
+		backupFileName := cm.oldCheckpointFileName + base.CheckpointBackupFileSuffix
+		var backupErr error
+		checkpointDoc, backupErr = cm.loadCheckpointFile(backupFileName)
+		if backupErr != nil {
+			return nil, err
+		}
+		cm.logger.Warnf("Unable to load checkpoint file %v, loaded %v instead. err=%v\n", cm.oldCheckpointFileName, backupFileName, err)
+	}
+	return checkpointDoc, nil
+}
+
+func (cm *CheckpointManager) loadCheckpointFile(checkpointFileName string) (*CheckpointDoc, error) {
+	checkpointFileBytes, err := cm.store.Load(checkpointFileName)
 	if err != nil {
 		cm.logger.Errorf("Error opening checkpoint file. err=%v\n", err)
 		return nil, err
 	}
 
-	checkpointDoc := &CheckpointDoc{}
-	err = json.Unmarshal(checkpointFileBytes, checkpointDoc)
+	checkpointDoc, err := parseCheckpointDoc(checkpointFileName, checkpointFileBytes)
 	if err != nil {
 		cm.logger.Errorf("Error unmarshalling checkpoint file. err=%v\n", err)
 		return nil, err
 	}
+	return checkpointDoc, nil
+}
+
+func parseCheckpointDoc(checkpointFileName string, checkpointFileBytes []byte) (*CheckpointDoc, error) {
+	checkpointDoc := &CheckpointDoc{}
+	err := json.Unmarshal(checkpointFileBytes, checkpointDoc)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(checkpointDoc.Checkpoints) < base.NumberOfVbuckets {
-		return nil, fmt.Errorf("checkpoint file %v has less than 1024 vbuckets.", cm.oldCheckpointFileName)
+		return nil, fmt.Errorf("checkpoint file %v has less than 1024 vbuckets.", checkpointFileName)
 	}
 
 	return checkpointDoc, nil
 }
 
+// Returns the name of the newest checkpoint in checkpointFileDir, periodic or final, for which both the
+// source and the target checkpoint files are complete, to be used as old checkpoint file name for both
+// Returns an empty name if there is none
+func FindNewestCheckpoint(checkpointFileDir string) (string, error) {
+	entries, err := ioutil.ReadDir(checkpointFileDir)
+	if err != nil {
+		return "", err
+	}
+
+	sourcePrefix := base.SourceClusterName + base.FileNameDelimiter
+	var newestName string
+	var newestTime time.Time
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), sourcePrefix) ||
+			strings.HasSuffix(entry.Name(), base.CheckpointTempFileSuffix) || strings.HasSuffix(entry.Name(), base.CheckpointBackupFileSuffix) {
+			continue
+		}
+		name := strings.TrimPrefix(entry.Name(), sourcePrefix)
+
+		// The older of the two files is when the pair became complete
+		pairTime := entry.ModTime()
+		complete := true
+		for _, clusterName := range []string{base.SourceClusterName, base.TargetClusterName} {
+			checkpointFileName := utils.JoinPath(checkpointFileDir, clusterName+base.FileNameDelimiter+name)
+			info, statErr := os.Stat(checkpointFileName)
+			if statErr != nil {
+				complete = false
+				break
+			}
+			checkpointFileBytes, readErr := ioutil.ReadFile(checkpointFileName)
+			if readErr != nil {
+				complete = false
+				break
+			}
+			if _, parseErr := parseCheckpointDoc(checkpointFileName, checkpointFileBytes); parseErr != nil {
+				complete = false
+				break
+			}
+			if info.ModTime().Before(pairTime) {
+				pairTime = info.ModTime()
+			}
+		}
+		if complete && (newestName == "" || pairTime.After(newestTime)) {
+			newestName = name
+			newestTime = pairTime
+		}
+	}
+	return newestName, nil
+}
+
 func (cm *CheckpointManager) SaveCheckpoint() error {
 	if cm.newCheckpointFileName == "" {
 		// checkpointing disabled
@@ -495,9 +833,6 @@ func (cm *CheckpointManager) saveCheckpoint(checkpointFileName string) error {
 	cm.logger.Infof("%v starting to save checkpoint %v\n", cm.clusterName, checkpointFileName)
 	defer cm.logger.Infof("%v completed saving checkpoint %v\n", cm.clusterName, checkpointFileName)
 
-	// delete existing file if exists
-	os.Remove(checkpointFileName)
-
 	checkpointDoc := &CheckpointDoc{
 		Checkpoints: make(map[uint16]*Checkpoint),
 	}
@@ -532,6 +867,7 @@ func (cm *CheckpointManager) saveCheckpoint(checkpointFileName string) error {
 			SnapshotEndSeqno:   snapshotEndSeqno,
 			FilteredCnt:        filteredCnt,
 			FailedFilterCnt:    failedFilterCnt,
+			ColFilterCnts:      cm.colFilterCnts[vbno].clone(),
 		}
 	}
 
@@ -540,29 +876,57 @@ func (cm *CheckpointManager) saveCheckpoint(checkpointFileName string) error {
 		return err
 	}
 
-	checkpointFile, err := os.OpenFile(checkpointFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
+	err = cm.store.Save(checkpointFileName, value)
 	if err != nil {
 		return err
 	}
 
-	defer checkpointFile.Close()
+	cm.logger.Infof("----------------------------------------------------------------\n")
+	cm.logger.Infof("%v saved checkpoints to %v. totalMutationsChecked=%v filtered=%v filterErr=%v\n",
+		cm.clusterName, checkpointFileName, total, totalFiltered, totalFailedFilter)
+	return nil
+}
+
+// Writes to a temp file that replaces the checkpoint file only once complete, so that a crash
+// mid-write never destroys the existing checkpoint. The previous generation is kept as a backup
+func writeCheckpointFile(checkpointFileName string, value []byte) error {
+	tempFileName := checkpointFileName + base.CheckpointTempFileSuffix
+	checkpointFile, err := os.OpenFile(tempFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
 
 	numOfBytes, err := checkpointFile.Write(value)
+	if err == nil && numOfBytes != len(value) {
+		err = fmt.Errorf("Incomplete write. expected=%v, actual=%v", len(value), numOfBytes)
+	}
+	if err == nil {
+		err = checkpointFile.Sync()
+	}
+	closeErr := checkpointFile.Close()
+	if err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(tempFileName)
 		return err
 	}
-	if numOfBytes != len(value) {
-		return fmt.Errorf("Incomplete write. expected=%v, actual=%v", len(value), numOfBytes)
-	}
 
-	cm.logger.Infof("----------------------------------------------------------------\n")
-	cm.logger.Infof("%v saved checkpoints to %v. totalMutationsChecked=%v filtered=%v filterErr=%v\n",
-		cm.clusterName, checkpointFileName, total, totalFiltered, totalFailedFilter)
-	return nil
+	if _, err = os.Stat(checkpointFileName); err == nil {
+		err = os.Rename(checkpointFileName, checkpointFileName+base.CheckpointBackupFileSuffix)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(tempFileName, checkpointFileName)
 }
 
 // Returns false if mutation is filtered (should not be recorded into bucket)
-func (cm *CheckpointManager) RecordFilterEvent(vbno uint16, filterResult base.FilterResultType) bool {
+func (cm *CheckpointManager) RecordFilterEvent(mut *Mutation, filterResult base.FilterResultType) bool {
+	vbno := mut.Vbno
+	if mut.IsMutation() {
+		cm.colFilterCnts[vbno].record(mut.ColId, filterResult)
+	}
 	switch filterResult {
 	case base.Filtered:
 		cm.filteredCnt[vbno].Inc(1)
@@ -586,16 +950,39 @@ func (cm *CheckpointManager) HandleMutationEvent(mut *Mutation, filterResult bas
 		}
 		if mut.Seqno <= endSeqno {
 			cm.seqnoMap[mut.Vbno].setSeqno(mut.Seqno)
-			return cm.RecordFilterEvent(mut.Vbno, filterResult)
+			return cm.RecordFilterEvent(mut, filterResult)
 		} else {
 			return false
 		}
 	} else {
 		cm.seqnoMap[mut.Vbno].setSeqno(mut.Seqno)
-		return cm.RecordFilterEvent(mut.Vbno, filterResult)
+		return cm.RecordFilterEvent(mut, filterResult)
 	}
 }
 
+// Resets the start VBTS of the vb to the seqno that kv-engine rolled it back to
+// The current vbuuid is used. Should its failover entry begin after the seqno, kv-engine asks for a further rollback
+func (cm *CheckpointManager) HandleRollback(vbno uint16, rollbackSeqno uint64) {
+	vbts := cm.startVBTS[vbno]
+	vbts.Checkpoint = &Checkpoint{
+		Vbuuid:             cm.vbuuidMap[vbno],
+		Seqno:              rollbackSeqno,
+		SnapshotStartSeqno: rollbackSeqno,
+		SnapshotEndSeqno:   rollbackSeqno,
+	}
+	if rollbackSeqno == 0 {
+		vbts.Checkpoint.Vbuuid = 0
+		// Everything is streamed again, so are the filtered mutations
+		cm.filteredCnt[vbno].Clear()
+		cm.failedFilterCnt[vbno].Clear()
+		cm.colFilterCnts[vbno].clear()
+	}
+	vbts.NoNeedToStartDcpStream = cm.dcpDriver.completeBySeqno && rollbackSeqno >= vbts.EndSeqno
+
+	cm.seqnoMap[vbno].setSeqno(rollbackSeqno)
+	cm.updateSnapshot(vbno, rollbackSeqno, rollbackSeqno)
+}
+
 func (cm *CheckpointManager) updateSnapshot(vbno uint16, startSeqno, endSeqno uint64) {
 	snapshot := cm.snapshots[vbno]
 	snapshot.lock.Lock()
@@ -622,13 +1009,22 @@ func (cm *CheckpointManager) initializeBucket() error {
 	useTLS, x509Provider, authProvider, err := getAgentConfigs(auth)
 
 	agentConfig := &gocbcore.AgentConfig{
-		MemdAddrs:         []string{bucketConnStr},
 		BucketName:        cm.dcpDriver.bucketName,
 		UserAgent:         fmt.Sprintf("xdcrDifferCheckpointMgr"),
 		UseTLS:            useTLS,
 		Auth:              authProvider,
 		TLSRootCAProvider: x509Provider,
+		AuthMechanisms:    base.GetKVAuthMechanisms(useTLS),
 		UseCollections:    cm.dcpDriver.capabilities.HasCollectionSupport(),
+		NetworkType:       base.GetNetworkType(),
+	}
+	if base.GetNetworkType() == base.NetworkTypeExternal {
+		err = agentConfig.FromConnStr(bucketConnStr)
+		if err != nil {
+			return err
+		}
+	} else {
+		agentConfig.MemdAddrs = []string{bucketConnStr}
 	}
 
 	agent, err := gocbcore.CreateAgent(agentConfig)
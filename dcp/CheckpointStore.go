@@ -0,0 +1,221 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Persists serialized checkpoint docs under the checkpoint file names
+type CheckpointStore interface {
+	Load(name string) ([]byte, error)
+	Save(name string, value []byte) error
+	// Removing a checkpoint that does not exist is not an error
+	Remove(name string) error
+}
+
+// Keeps checkpoints as local files
+type FileCheckpointStore struct{}
+
+func (s *FileCheckpointStore) Load(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (s *FileCheckpointStore) Save(name string, value []byte) error {
+	return writeCheckpointFile(name, value)
+}
+
+// Removes the backup generation along with the checkpoint
+func (s *FileCheckpointStore) Remove(name string) error {
+	for _, fileName := range []string{name, name + base.CheckpointBackupFileSuffix} {
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps checkpoints as documents in a metadata bucket, keyed by run ID and checkpoint file name,
+// so that a run can be resumed from another machine or container
+type BucketCheckpointStore struct {
+	agent          *gocbcore.Agent
+	bucketName     string
+	scopeName      string
+	collectionName string
+	runId          string
+	timeout        time.Duration
+}
+
+func NewBucketCheckpointStore(ref *metadata.RemoteClusterReference, kvPort uint16, bucketName, scopeName, collectionName, runId string, timeout time.Duration) (*BucketCheckpointStore, error) {
+	agent, err := newBucketAgent(ref, kvPort, bucketName, "xdcrDifferCheckpointStore")
+	if err != nil {
+		return nil, err
+	}
+
+	return &BucketCheckpointStore{
+		agent:          agent,
+		bucketName:     bucketName,
+		scopeName:      scopeName,
+		collectionName: collectionName,
+		runId:          runId,
+		timeout:        timeout,
+	}, nil
+}
+
+// Returns a KV agent of the bucket, bootstrapped from the reference host on kvPort, once it is ready
+func newBucketAgent(ref *metadata.RemoteClusterReference, kvPort uint16, bucketName, userAgent string) (*gocbcore.Agent, error) {
+	pwAuth := base.PasswordAuth{
+		Username: ref.UserName(),
+		Password: ref.Password(),
+	}
+	var auth interface{} = &pwAuth
+	if ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
+		auth = &base.CertificateAuth{
+			PasswordAuth:      pwAuth,
+			CertificateBytes:  ref.Certificates(),
+			ClientCertificate: ref.ClientCertificate(),
+			ClientKey:         ref.ClientKey(),
+		}
+	}
+	useTLS, x509Provider, authProvider, err := getAgentConfigs(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	agentConfig := &gocbcore.AgentConfig{
+		BucketName:        bucketName,
+		UserAgent:         userAgent,
+		UseTLS:            useTLS,
+		Auth:              authProvider,
+		TLSRootCAProvider: x509Provider,
+		AuthMechanisms:    base.GetKVAuthMechanisms(useTLS),
+		UseCollections:    true,
+		NetworkType:       base.GetNetworkType(),
+	}
+	err = agentConfig.FromConnStr(utils.PopulateCCCPConnectString(ref.HostName(), useTLS, kvPort))
+	if err != nil {
+		return nil, err
+	}
+
+	agent, err := gocbcore.CreateAgent(agentConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	signal := make(chan error, 1)
+	_, err = agent.WaitUntilReady(time.Now().Add(base.SetupTimeout), gocbcore.WaitUntilReadyOptions{
+		DesiredState:  gocbcore.ClusterStateOnline,
+		ServiceTypes:  []gocbcore.ServiceType{gocbcore.MemdService},
+		RetryStrategy: &base.RetryStrategy{},
+	}, func(res *gocbcore.WaitUntilReadyResult, er error) {
+		signal <- er
+	})
+	if err == nil {
+		err = <-signal
+	}
+	if err != nil {
+		go agent.Close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+// The directory of the checkpoint file does not matter to the bucket
+func (s *BucketCheckpointStore) key(name string) string {
+	return fmt.Sprintf("%v::%v", s.runId, filepath.Base(name))
+}
+
+func (s *BucketCheckpointStore) Load(name string) ([]byte, error) {
+	type getResult struct {
+		value []byte
+		err   error
+	}
+	resultCh := make(chan getResult, 1)
+	_, err := s.agent.Get(gocbcore.GetOptions{
+		Key:            []byte(s.key(name)),
+		ScopeName:      s.scopeName,
+		CollectionName: s.collectionName,
+		Deadline:       time.Now().Add(s.timeout),
+	}, func(result *gocbcore.GetResult, err error) {
+		if err != nil {
+			resultCh <- getResult{err: err}
+			return
+		}
+		resultCh <- getResult{value: result.Value}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := <-resultCh
+	if result.err != nil {
+		return nil, fmt.Errorf("loading %v from bucket %v: %v", s.key(name), s.bucketName, result.err)
+	}
+	return result.value, nil
+}
+
+func (s *BucketCheckpointStore) Save(name string, value []byte) error {
+	errCh := make(chan error, 1)
+	_, err := s.agent.Set(gocbcore.SetOptions{
+		Key:            []byte(s.key(name)),
+		Value:          value,
+		ScopeName:      s.scopeName,
+		CollectionName: s.collectionName,
+		Deadline:       time.Now().Add(s.timeout),
+	}, func(result *gocbcore.StoreResult, err error) {
+		errCh <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = <-errCh
+	if err != nil {
+		return fmt.Errorf("saving %v to bucket %v: %v", s.key(name), s.bucketName, err)
+	}
+	return nil
+}
+
+func (s *BucketCheckpointStore) Remove(name string) error {
+	errCh := make(chan error, 1)
+	_, err := s.agent.Delete(gocbcore.DeleteOptions{
+		Key:            []byte(s.key(name)),
+		ScopeName:      s.scopeName,
+		CollectionName: s.collectionName,
+		Deadline:       time.Now().Add(s.timeout),
+	}, func(result *gocbcore.DeleteResult, err error) {
+		errCh <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = <-errCh
+	if err != nil && !errors.Is(err, gocbcore.ErrDocumentNotFound) {
+		return fmt.Errorf("removing %v from bucket %v: %v", s.key(name), s.bucketName, err)
+	}
+	return nil
+}
+
+func (s *BucketCheckpointStore) Close() error {
+	return s.agent.Close()
+}
@@ -10,7 +10,10 @@
 package dcp
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	gocb "github.com/couchbase/gocb/v2"
 	gocbcore "github.com/couchbase/gocbcore/v9"
@@ -38,7 +41,8 @@ type DcpClient struct {
 	numberClosing       uint32
 	closeStreamsDoneCh  chan bool
 	activeStreams       uint32
-	finChan             chan bool
+	ctx                 context.Context
+	cancel              context.CancelFunc
 	startVbtsDoneChan   chan bool
 	logger              *xdcrLog.CommonLogger
 	capabilities        metadata.Capability
@@ -55,6 +59,7 @@ type DcpClient struct {
 }
 
 func NewDcpClient(dcpDriver *DcpDriver, i int, vbList []uint16, waitGroup *sync.WaitGroup, startVbtsDoneChan chan bool, capabilities metadata.Capability, collectionIds []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping) *DcpClient {
+	ctx, cancel := context.WithCancel(dcpDriver.ctx)
 	return &DcpClient{
 		Name:                fmt.Sprintf("%v_%v", dcpDriver.Name, i),
 		dcpDriver:           dcpDriver,
@@ -63,7 +68,8 @@ func NewDcpClient(dcpDriver *DcpDriver, i int, vbList []uint16, waitGroup *sync.
 		dcpHandlers:         make([]*DcpHandler, dcpDriver.numberOfWorkers),
 		vbHandlerMap:        make(map[uint16]*DcpHandler),
 		closeStreamsDoneCh:  make(chan bool),
-		finChan:             make(chan bool),
+		ctx:                 ctx,
+		cancel:              cancel,
 		startVbtsDoneChan:   startVbtsDoneChan,
 		logger:              dcpDriver.logger,
 		capabilities:        capabilities,
@@ -102,7 +108,7 @@ func (c *DcpClient) reportActiveStreams() {
 				c.logger.Infof("%v all streams active. Stop reporting\n", c.Name)
 				goto done
 			}
-		case <-c.finChan:
+		case <-c.ctx.Done():
 			goto done
 		}
 	}
@@ -119,7 +125,7 @@ func (c *DcpClient) closeCompletedStreams() {
 			for _, vbno := range c.vbList {
 				c.closeStreamIfCompleted(vbno)
 			}
-		case <-c.finChan:
+		case <-c.ctx.Done():
 			goto done
 		}
 	}
@@ -153,7 +159,7 @@ func (c *DcpClient) Stop() error {
 
 	defer c.waitGroup.Done()
 
-	close(c.finChan)
+	c.cancel()
 
 	c.numberClosing = uint32(len(c.vbList))
 	for _, i := range c.vbList {
@@ -216,19 +222,34 @@ func (c *DcpClient) initializeCluster() (err error) {
 }
 
 func initializeClusterWithSecurity(dcpDriver *DcpDriver) (*gocb.Cluster, error) {
-	clusterOpts := gocb.ClusterOptions{}
-
-	if dcpDriver.ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
-		tlsCert := tls.Certificate{Certificate: [][]byte{dcpDriver.ref.Certificates()}}
-		clusterOpts.Authenticator = gocb.CertificateAuthenticator{ClientCertificate: &tlsCert}
-	} else {
-		clusterOpts.Authenticator = gocb.PasswordAuthenticator{
+	clusterOpts := gocb.ClusterOptions{
+		Authenticator: gocb.PasswordAuthenticator{
 			Username: dcpDriver.ref.UserName(),
 			Password: dcpDriver.ref.Password(),
+		},
+	}
+
+	secure := dcpDriver.ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps
+	if secure {
+		// The reference certificate is the CA to verify the cluster with
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(dcpDriver.ref.Certificates()) {
+			return nil, xdcrBase.InvalidCerfiticateError
+		}
+		clusterOpts.SecurityConfig = gocb.SecurityConfig{
+			TLSRootCAs: certPool,
+		}
+
+		if len(dcpDriver.ref.ClientCertificate()) > 0 {
+			keyPair, err := tls.X509KeyPair(dcpDriver.ref.ClientCertificate(), dcpDriver.ref.ClientKey())
+			if err != nil {
+				return nil, err
+			}
+			clusterOpts.Authenticator = gocb.CertificateAuthenticator{ClientCertificate: &keyPair}
 		}
 	}
 
-	cluster, err := gocb.Connect(utils.PopulateCCCPConnectString(dcpDriver.url), clusterOpts)
+	cluster, err := gocb.Connect(base.AddNetworkTypeToConnStr(utils.PopulateCCCPConnectString(dcpDriver.url, secure, dcpDriver.kvPort)), clusterOpts)
 	if err != nil {
 		dcpDriver.logger.Errorf("Error connecting to cluster %v. err=%v\n", dcpDriver.url, err)
 		return nil, err
@@ -242,16 +263,30 @@ func (c *DcpClient) initializeBucket() (err error) {
 		return err
 	}
 
-	c.gocbcoreDcpFeed, err = NewGocbcoreDCPFeed(c.Name, []string{bucketConnStr}, c.dcpDriver.bucketName, auth, c.capabilities.HasCollectionSupport())
+	c.gocbcoreDcpFeed, err = NewGocbcoreDCPFeed(c.Name, []string{bucketConnStr}, c.dcpDriver.bucketName, auth, c.capabilities.HasCollectionSupport(), c.dcpDriver.dcpBufferSize, c.dcpDriver.dcpCompression)
 	return
 }
 
+// On the external network, the connection string is that of externalBootstrapConnStr, which is always prefixed
 func initializeBucketWithSecurity(dcpDriver *DcpDriver, kvVbMap map[string][]uint16, kvSSLPortMap map[string]uint16, tagPrefix bool) (interface{}, string, error) {
 	var auth interface{}
 	pwAuth := base.PasswordAuth{
 		Username: dcpDriver.ref.UserName(),
 		Password: dcpDriver.ref.Password(),
 	}
+	secure := dcpDriver.ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps
+	if base.GetNetworkType() == base.NetworkTypeExternal {
+		auth = &pwAuth
+		if secure {
+			auth = &base.CertificateAuth{
+				PasswordAuth:      pwAuth,
+				CertificateBytes:  dcpDriver.ref.Certificates(),
+				ClientCertificate: dcpDriver.ref.ClientCertificate(),
+				ClientKey:         dcpDriver.ref.ClientKey(),
+			}
+		}
+		return auth, externalBootstrapConnStr(dcpDriver.ref, secure, dcpDriver.kvPort), nil
+	}
 
 	var bucketConnStr string
 	for k, _ := range kvVbMap {
@@ -259,10 +294,12 @@ func initializeBucketWithSecurity(dcpDriver *DcpDriver, kvVbMap map[string][]uin
 		break
 	}
 
-	if dcpDriver.ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
+	if secure {
 		auth = &base.CertificateAuth{
-			PasswordAuth:     pwAuth,
-			CertificateBytes: dcpDriver.ref.Certificates(),
+			PasswordAuth:      pwAuth,
+			CertificateBytes:  dcpDriver.ref.Certificates(),
+			ClientCertificate: dcpDriver.ref.ClientCertificate(),
+			ClientKey:         dcpDriver.ref.ClientKey(),
 		}
 
 		sslPort, found := kvSSLPortMap[bucketConnStr]
@@ -282,6 +319,18 @@ func initializeBucketWithSecurity(dcpDriver *DcpDriver, kvVbMap map[string][]uin
 	return auth, bucketConnStr, nil
 }
 
+// The vbucket map only holds the internal addresses of the nodes, which cannot be reached from outside their network
+// On the external network, agents bootstrap from the address of the reference instead, and gocbcore then connects to
+// the alternate addresses of the nodes from the cluster config
+func externalBootstrapConnStr(ref *metadata.RemoteClusterReference, secure bool, kvPort uint16) string {
+	if secure {
+		return utils.PopulateCCCPConnectString(ref.HostName(), true, kvPort)
+	}
+	connStr := ref.HostName()
+	base.TagHttpPrefix(&connStr)
+	return base.GetConnStr([]string{connStr})
+}
+
 func (c *DcpClient) initializeDcpHandlers() error {
 	loadDistribution := utils.BalanceLoad(c.dcpDriver.numberOfWorkers, len(c.vbList))
 	for i := 0; i < c.dcpDriver.numberOfWorkers; i++ {
@@ -320,7 +369,7 @@ func (c *DcpClient) handleDcpStreams() {
 	// wait for start vbts done signal from checkpoint manager
 	select {
 	case <-c.startVbtsDoneChan:
-	case <-c.finChan:
+	case <-c.ctx.Done():
 		return
 	}
 
@@ -343,30 +392,58 @@ func (c *DcpClient) openDcpStreams() error {
 	vbListCopy := utils.DeepCopyUint16Array(c.vbList)
 	utils.ShuffleVbList(vbListCopy)
 	for _, vbno := range vbListCopy {
-		vbts := c.dcpDriver.checkpointManager.GetStartVBTS(vbno)
-		if vbts.NoNeedToStartDcpStream {
-			c.dcpDriver.handleVbucketCompletion(vbno, nil, "no mutations to stream")
-			continue
+		err := c.openDcpStream(vbno)
+		if err != nil {
+			return err
 		}
+	}
 
-		snapshotStartSeqno := vbts.Checkpoint.Seqno
-		snapshotEndSeqno := vbts.Checkpoint.Seqno
+	return nil
+}
 
-		if c.dcpAgent == nil {
-			c.dcpAgent = c.gocbcoreDcpFeed.dcpAgent
-		}
+func (c *DcpClient) openDcpStream(vbno uint16) error {
+	vbts := c.dcpDriver.checkpointManager.GetStartVBTS(vbno)
+	if vbts.NoNeedToStartDcpStream {
+		c.dcpDriver.handleVbucketCompletion(vbno, nil, "no mutations to stream")
+		return nil
+	}
 
-		_, err := c.dcpAgent.OpenStream(vbno, 0, gocbcore.VbUUID(vbts.Checkpoint.Vbuuid), gocbcore.SeqNo(vbts.Checkpoint.Seqno),
-			gocbcore.SeqNo(math.MaxUint64 /*vbts.EndSeqno*/), gocbcore.SeqNo(snapshotStartSeqno), gocbcore.SeqNo(snapshotEndSeqno), c.vbHandlerMap[vbno],
-			c.getOpenStreamOptions(), c.openStreamFunc)
+	snapshotStartSeqno := vbts.Checkpoint.Seqno
+	snapshotEndSeqno := vbts.Checkpoint.Seqno
 
-		if err != nil {
-			c.logger.Errorf("err opening dcp stream for vb %v. err=%v\n", vbno, err)
-			return err
-		}
+	if c.dcpAgent == nil {
+		c.dcpAgent = c.gocbcoreDcpFeed.dcpAgent
 	}
 
-	return nil
+	_, err := c.dcpAgent.OpenStream(vbno, 0, gocbcore.VbUUID(vbts.Checkpoint.Vbuuid), gocbcore.SeqNo(vbts.Checkpoint.Seqno),
+		gocbcore.SeqNo(math.MaxUint64 /*vbts.EndSeqno*/), gocbcore.SeqNo(snapshotStartSeqno), gocbcore.SeqNo(snapshotEndSeqno), c.vbHandlerMap[vbno],
+		c.getOpenStreamOptions(), c.openStreamFunc(vbno, vbts.Checkpoint.Seqno))
+
+	if err != nil {
+		c.logger.Errorf("err opening dcp stream for vb %v. err=%v\n", vbno, err)
+	}
+	return err
+}
+
+// Rewinds the vb to the seqno kv-engine asked to roll back to and streams it again from there
+func (c *DcpClient) handleRollback(vbno uint16, requestedSeqno, rollbackSeqno uint64) {
+	if rollbackSeqno >= requestedSeqno {
+		c.reportError(fmt.Errorf("%v vb %v asked to roll back to %v, which is not before the requested seqno %v", c.Name, vbno, rollbackSeqno, requestedSeqno))
+		return
+	}
+	c.logger.Warnf("%v rolling back vb %v from seqno %v to %v\n", c.Name, vbno, requestedSeqno, rollbackSeqno)
+
+	err := c.dcpDriver.truncateVbFiles(vbno, rollbackSeqno)
+	if err != nil {
+		c.reportError(fmt.Errorf("%v unable to truncate the data files of vb %v for rollback: %v", c.Name, vbno, err))
+		return
+	}
+	c.dcpDriver.checkpointManager.HandleRollback(vbno, rollbackSeqno)
+
+	err = c.openDcpStream(vbno)
+	if err != nil {
+		c.reportError(fmt.Errorf("%v: %v", c.Name, err))
+	}
 }
 
 func (c *DcpClient) closeStream(vbno uint16) error {
@@ -380,12 +457,18 @@ func (c *DcpClient) closeStream(vbno uint16) error {
 	return err
 }
 
-func (c *DcpClient) openStreamFunc(f []gocbcore.FailoverEntry, err error) {
-	if err != nil {
-		wrappedErr := fmt.Errorf("%v openStreamCallback reported err: %v", c.Name, err)
-		c.reportError(wrappedErr)
-	} else {
-		atomic.AddUint32(&c.activeStreams, 1)
+func (c *DcpClient) openStreamFunc(vbno uint16, requestedSeqno uint64) gocbcore.OpenStreamCallback {
+	return func(f []gocbcore.FailoverEntry, err error) {
+		var rollbackErr gocbcore.DCPRollbackError
+		if errors.As(err, &rollbackErr) {
+			// Not done inline since the stream is reopened from here
+			go c.handleRollback(vbno, requestedSeqno, uint64(rollbackErr.SeqNo))
+		} else if err != nil {
+			wrappedErr := fmt.Errorf("%v openStreamCallback reported err: %v", c.Name, err)
+			c.reportError(wrappedErr)
+		} else {
+			atomic.AddUint32(&c.activeStreams, 1)
+		}
 	}
 }
 
@@ -402,7 +485,11 @@ func (c *DcpClient) closeStreamFunc(err error) {
 	// (-1)
 	streamsLeft := atomic.AddUint32(&c.numberClosing, ^uint32(0))
 	if streamsLeft == 0 {
-		c.closeStreamsDoneCh <- true
+		// Nothing may be waiting, so do not hold up the callback once the client has stopped
+		select {
+		case c.closeStreamsDoneCh <- true:
+		case <-c.ctx.Done():
+		}
 	}
 }
 
@@ -10,6 +10,8 @@
 package dcp
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	gocbcore "github.com/couchbase/gocbcore/v9"
 	xdcrBase "github.com/couchbase/goxdcr/base"
@@ -17,11 +19,14 @@ import (
 	xdcrLog "github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	xdcrUtils "github.com/couchbase/goxdcr/utils"
+	"io/ioutil"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/objectStore"
 	"xdcrDiffer/utils"
 )
 
@@ -51,7 +56,8 @@ type DcpDriver struct {
 	// 2 - stopped
 	state               DriverState
 	stateLock           sync.RWMutex
-	finChan             chan bool
+	ctx                 context.Context
+	cancel              context.CancelFunc
 	logger              *xdcrLog.CommonLogger
 	filter              xdcrParts.Filter
 	capabilities        metadata.Capability
@@ -60,13 +66,58 @@ type DcpDriver struct {
 	dataPool            xdcrBase.DataPool
 	utils               xdcrUtils.UtilsIface
 	bufferCapacity      int
-	migrationMapping    metadata.CollectionNamespaceMapping
+	dcpBufferSize       int
+	dcpCompression      bool
+	hashAlgorithm       string
+	// One of base.DataFileCompressions
+	dataFileCompression string
+	// Key the data files are encrypted with, nil to write them in plaintext
+	encryptionKey    []byte
+	uploadStagingDir string
+	migrationMapping metadata.CollectionNamespaceMapping
+	// when set, mutations are handed to the sink instead of being written to data files
+	mutationSink MutationSink
+	// vbuckets whose data files are complete, in the order they completed
+	vbFlushedChan chan uint16
+	// vbuckets streamed by this driver. The others are completed from the start
+	vbRange base.VbucketRange
+	// called with the estimated size of the data files before streaming starts, when completing by seqno
+	diskSpaceCheck DiskSpaceCheck
+	// percentage of keys recorded, 100 for all of them
+	samplePercent float64
+	// keys recorded, independently of the replication filter
+	keyRange base.KeyRange
+	// when resuming from an old checkpoint, whether to drop what earlier runs recorded, so that only the
+	// mutations after the checkpoint are diffed
+	deltaDiff bool
+	// whether to strip the Sync Gateway xattrs from the values before hashing them
+	ignoreSyncGatewayXattrs bool
+	// KV port to bootstrap from the address of the cluster with, 0 for the default one
+	kvPort uint16
+	// whether to log the seqno of each vbucket that has not completed with each status report
+	verboseProgress bool
+	// time of the previous throughput report, only accessed by the status report go routine
+	lastThroughputTime time.Time
 
 	// various counters
 	totalNumReceivedFromDCP      uint64
 	totalSysEventReceivedFromDCP uint64
 }
 
+// Receives serialized mutations in place of the data files, e.g. for the in-memory pipeline mode
+type MutationSink interface {
+	AddMutation(isSource bool, vbno uint16, serializedMut []byte) error
+}
+
+// Returns an error if there is not enough disk space for the data files that the named driver is about to write
+type DiskSpaceCheck func(name string, estimatedBytes uint64) error
+
+// Implemented by the sinks that keep mutations across runs, which, like data files, need the mutations of a vb
+// after the seqno it is rolled back or resumed to dropped
+type MutationTruncater interface {
+	TruncateVb(vbno uint16, seqno uint64) error
+}
+
 type VBStateWithLock struct {
 	vbState VBState
 	lock    sync.RWMutex
@@ -88,48 +139,142 @@ const (
 	DriverStateStopped DriverState = iota
 )
 
-func NewDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfClients, numberOfWorkers, numberOfBins, dcpHandlerChanSize int, bucketOpTimeout time.Duration, maxNumOfGetStatsRetry int, getStatsRetryInterval, getStatsMaxBackoff time.Duration, checkpointInterval int, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIds []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping) *DcpDriver {
+// What a DcpDriver streams and how
+type DcpDriverOptions struct {
+	Name       string
+	Url        string
+	BucketName string
+	Ref        *metadata.RemoteClusterReference
+	// Directory of the data files
+	FileDir               string
+	CheckpointFileDir     string
+	OldCheckpointFileName string
+	NewCheckpointFileName string
+	NumberOfClients       int
+	// Workers of each client
+	NumberOfWorkers       int
+	NumberOfBins          int
+	DcpHandlerChanSize    int
+	BucketOpTimeout       time.Duration
+	MaxNumOfGetStatsRetry int
+	GetStatsRetryInterval time.Duration
+	GetStatsMaxBackoff    time.Duration
+	// Seconds between checkpoints, 0 to only checkpoint on shutdown
+	CheckpointInterval  int
+	CheckpointRetention int
+	CompleteBySeqno     bool
+	FdPool              fdp.FdPoolIface
+	Filter              xdcrParts.Filter
+	Capabilities        metadata.Capability
+	CollectionIds       []uint32
+	ColMigrationFilters []string
+	Utils               xdcrUtils.UtilsIface
+	BufferCapacity      int
+	DcpBufferSize       int
+	DcpCompression      bool
+	HashAlgorithm       string
+	// One of base.DataFileCompressions
+	DataFileCompression string
+	// Key the data files are encrypted with, nil to write them in plaintext
+	EncryptionKey []byte
+	// Local directory that data files in object storage are staged in, a part at a time, before being uploaded
+	UploadStagingDir string
+	MigrationMapping metadata.CollectionNamespaceMapping
+	// When set, mutations are handed to the sink instead of being written to data files
+	MutationSink    MutationSink
+	CheckpointStore CheckpointStore
+	// vbuckets streamed by the driver. The others are completed from the start
+	VbRange base.VbucketRange
+	// Called with the estimated size of the data files before streaming starts, when completing by seqno
+	DiskSpaceCheck DiskSpaceCheck
+	// Percentage of keys recorded, 100 for all of them
+	SamplePercent float64
+	// Keys recorded, independently of the replication filter
+	KeyRange base.KeyRange
+	// When resuming from an old checkpoint, whether to drop what earlier runs recorded
+	DeltaDiff bool
+	// Whether to strip the Sync Gateway xattrs from the values before hashing them
+	IgnoreSyncGatewayXattrs bool
+	// KV port to bootstrap from the address of the cluster with, 0 for the default one
+	KvPort uint16
+	// Whether to log the seqno of each vbucket that has not completed with each status report
+	VerboseProgress bool
+}
+
+func NewDcpDriver(ctx context.Context, logger *xdcrLog.CommonLogger, options *DcpDriverOptions, errChan chan error, waitGroup *sync.WaitGroup) *DcpDriver {
+	numberOfClients := options.NumberOfClients
+	numberOfWorkers := options.NumberOfWorkers
+	vbRange := options.VbRange
+	// Each client and each worker is to have at least one vbucket to stream
+	if numberOfClients > vbRange.Count() {
+		numberOfClients = vbRange.Count()
+	}
+	if numberOfWorkers > vbRange.Count()/numberOfClients {
+		numberOfWorkers = vbRange.Count() / numberOfClients
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	dcpDriver := &DcpDriver{
-		Name:                name,
-		url:                 url,
-		bucketName:          bucketName,
-		ref:                 ref,
-		fileDir:             fileDir,
-		numberOfClients:     numberOfClients,
-		numberOfWorkers:     numberOfWorkers,
-		numberOfBins:        numberOfBins,
-		dcpHandlerChanSize:  dcpHandlerChanSize,
-		completeBySeqno:     completeBySeqno,
-		errChan:             errChan,
-		waitGroup:           waitGroup,
-		clients:             make([]*DcpClient, numberOfClients),
-		childWaitGroup:      &sync.WaitGroup{},
-		vbStateMap:          make(map[uint16]*VBStateWithLock),
-		fdPool:              fdPool,
-		state:               DriverStateNew,
-		finChan:             make(chan bool),
-		startVbtsDoneChan:   make(chan bool),
-		logger:              logger,
-		filter:              filter,
-		capabilities:        capabilities,
-		collectionIDs:       collectionIds,
-		colMigrationFilters: colMigrationFilters,
-		utils:               utils,
-		bufferCapacity:      bufferCap,
-		migrationMapping:    migrationMapping,
+		Name:                    options.Name,
+		url:                     options.Url,
+		bucketName:              options.BucketName,
+		ref:                     options.Ref,
+		fileDir:                 options.FileDir,
+		numberOfClients:         numberOfClients,
+		numberOfWorkers:         numberOfWorkers,
+		numberOfBins:            options.NumberOfBins,
+		dcpHandlerChanSize:      options.DcpHandlerChanSize,
+		completeBySeqno:         options.CompleteBySeqno,
+		errChan:                 errChan,
+		waitGroup:               waitGroup,
+		clients:                 make([]*DcpClient, numberOfClients),
+		childWaitGroup:          &sync.WaitGroup{},
+		vbStateMap:              make(map[uint16]*VBStateWithLock),
+		fdPool:                  options.FdPool,
+		state:                   DriverStateNew,
+		ctx:                     ctx,
+		cancel:                  cancel,
+		startVbtsDoneChan:       make(chan bool),
+		logger:                  logger,
+		filter:                  options.Filter,
+		capabilities:            options.Capabilities,
+		collectionIDs:           options.CollectionIds,
+		colMigrationFilters:     options.ColMigrationFilters,
+		utils:                   options.Utils,
+		bufferCapacity:          options.BufferCapacity,
+		dcpBufferSize:           options.DcpBufferSize,
+		dcpCompression:          options.DcpCompression,
+		hashAlgorithm:           options.HashAlgorithm,
+		dataFileCompression:     options.DataFileCompression,
+		encryptionKey:           options.EncryptionKey,
+		uploadStagingDir:        options.UploadStagingDir,
+		migrationMapping:        options.MigrationMapping,
+		mutationSink:            options.MutationSink,
+		vbFlushedChan:           make(chan uint16, base.NumberOfVbuckets),
+		vbRange:                 vbRange,
+		diskSpaceCheck:          options.DiskSpaceCheck,
+		samplePercent:           options.SamplePercent,
+		keyRange:                options.KeyRange,
+		deltaDiff:               options.DeltaDiff,
+		ignoreSyncGatewayXattrs: options.IgnoreSyncGatewayXattrs,
+		kvPort:                  options.KvPort,
+		verboseProgress:         options.VerboseProgress,
 	}
 
 	var vbno uint16
 	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		vbState := VBStateNormal
+		if !vbRange.Contains(vbno) {
+			vbState = VBStateCompleted
+		}
 		dcpDriver.vbStateMap[vbno] = &VBStateWithLock{
-			vbState: VBStateNormal,
+			vbState: vbState,
 		}
 	}
 
-	dcpDriver.checkpointManager = NewCheckpointManager(dcpDriver, checkpointFileDir, oldCheckpointFileName,
-		newCheckpointFileName, name, bucketOpTimeout, maxNumOfGetStatsRetry,
-		getStatsRetryInterval, getStatsMaxBackoff, checkpointInterval, dcpDriver.startVbtsDoneChan, logger,
-		completeBySeqno)
+	dcpDriver.checkpointManager = NewCheckpointManager(dcpDriver, options.CheckpointFileDir, options.OldCheckpointFileName,
+		options.NewCheckpointFileName, options.Name, options.BucketOpTimeout, options.MaxNumOfGetStatsRetry,
+		options.GetStatsRetryInterval, options.GetStatsMaxBackoff, options.CheckpointInterval, options.CheckpointRetention,
+		dcpDriver.startVbtsDoneChan, logger, options.CompleteBySeqno, options.CheckpointStore)
 
 	base.TagHttpPrefix(&dcpDriver.url)
 
@@ -153,6 +298,14 @@ func (d *DcpDriver) Start() error {
 
 	d.logger.Infof("%v started checkpoint manager.\n", d.Name)
 
+	if d.diskSpaceCheck != nil && d.completeBySeqno {
+		err = d.diskSpaceCheck(d.Name, d.EstimatedDataSize())
+		if err != nil {
+			d.logger.Errorf("%v disk space check failed. err=%v\n", d.Name, err)
+			return err
+		}
+	}
+
 	d.initializeDcpClients()
 
 	err = d.startDcpClients()
@@ -185,11 +338,19 @@ func (d *DcpDriver) checkForCompletion() {
 			}
 			if numOfCompletedVb == base.NumberOfVbuckets {
 				d.logger.Infof("%v all vbuckets have completed for dcp driver\n", d.Name)
+				if d.completeBySeqno {
+					if err := d.checkpointManager.recheckHighSeqnos(); err != nil {
+						d.logger.Warnf("%v unable to recheck high seqnos. err=%v\n", d.Name, err)
+					}
+				}
 				d.Stop()
 				return
 			}
-		case <-d.finChan:
-			d.logger.Infof("%v Received close channel", d.Name)
+		case <-d.ctx.Done():
+			// Either Stop() has been called, or the context of the run has been canceled, which stops the driver
+			// the same way, with the data files flushed and a checkpoint saved
+			d.logger.Infof("%v context done. err=%v\n", d.Name, d.ctx.Err())
+			d.Stop()
 			return
 		}
 	}
@@ -214,7 +375,7 @@ func (d *DcpDriver) Stop() error {
 	defer d.logger.Infof("Dcp driver %v stopped\n", d.Name)
 	defer d.waitGroup.Done()
 
-	close(d.finChan)
+	d.cancel()
 
 	for i, dcpClient := range d.clients {
 		if dcpClient != nil {
@@ -237,6 +398,24 @@ func (d *DcpDriver) Stop() error {
 	return nil
 }
 
+// vbuckets whose high seqno had moved more than base.ChangingVbucketSeqnoThreshold past the end seqno they were
+// streamed to by the time all of them completed, and by how much. Diffs in these vbuckets may only be changes made
+// during the capture. Only known when completing by seqno, once the driver has stopped
+func (d *DcpDriver) ChangedVbuckets() map[uint16]uint64 {
+	return d.checkpointManager.getChangedVbs()
+}
+
+// Estimates the bytes of data files still to be written, from the seqnos left to stream and an assumed key length
+// An upper bound, since the seqnos of mutations deduplicated by DCP are not streamed. Only known when completing
+// by seqno, once the checkpoint manager has started. Scaled down to the sample when only sampling keys
+func (d *DcpDriver) EstimatedDataSize() uint64 {
+	estimate := d.checkpointManager.remainingSeqnos() * uint64(base.GetMutationLen(d.hashAlgorithm, base.DiskSpaceEstimateKeyLen, nil))
+	if d.samplePercent < 100 {
+		estimate = uint64(float64(estimate) * d.samplePercent / 100)
+	}
+	return estimate
+}
+
 func (d *DcpDriver) FilteredCount() int64 {
 	var vbno uint16
 	var filtered int64
@@ -246,17 +425,83 @@ func (d *DcpDriver) FilteredCount() int64 {
 	return filtered
 }
 
+// What the replication filter did with the mutations streamed so far, including those of resumed checkpoints,
+// in total and by collection ID
+func (d *DcpDriver) FilterCounts() (*base.FilterCounts, map[uint32]*base.FilterCounts) {
+	byCollection := make(map[uint32]*base.FilterCounts)
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		d.checkpointManager.colFilterCnts[vbno].addTo(byCollection)
+	}
+	total := &base.FilterCounts{}
+	for _, colCounts := range byCollection {
+		total.Add(colCounts)
+	}
+	return total, byCollection
+}
+
+// Returns the number of mutations processed so far and the number to be processed before completion
+// Total is 0 when the driver is not completing by seqno or has not retrieved the end seqnos yet
+func (d *DcpDriver) Progress() (uint64, uint64) {
+	if !d.completeBySeqno || !d.checkpointManager.isStarted() {
+		return 0, 0
+	}
+	var processed uint64
+	var total uint64
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		processed += d.checkpointManager.seqnoMap[vbno].getSeqno()
+		total += d.checkpointManager.endSeqnoMap[vbno]
+	}
+	return processed, total
+}
+
+// Index is vbno. Returns the seqno processed so far on each vb, and the seqno each vb is to complete at
+// endSeqnos is nil unless completeBySeqno is set. Both are nil until the checkpoint manager has started
+func (d *DcpDriver) VbSeqnos() (seqnos []uint64, endSeqnos []uint64) {
+	if !d.checkpointManager.isStarted() {
+		return nil, nil
+	}
+	seqnos = make([]uint64, base.NumberOfVbuckets)
+	if d.completeBySeqno {
+		endSeqnos = make([]uint64, base.NumberOfVbuckets)
+	}
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		seqnos[vbno] = d.checkpointManager.seqnoMap[vbno].getSeqno()
+		if endSeqnos != nil {
+			endSeqnos[vbno] = d.checkpointManager.endSeqnoMap[vbno]
+		}
+	}
+	return seqnos, endSeqnos
+}
+
+func (d *DcpDriver) NumReceived() uint64 {
+	return atomic.LoadUint64(&d.totalNumReceivedFromDCP)
+}
+
+// Index is vbno, value is true if processing on the vb has been completed
+func (d *DcpDriver) VbCompletionStates() []bool {
+	states := make([]bool, base.NumberOfVbuckets)
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		states[vbno] = d.getVbState(vbno) != VBStateNormal
+	}
+	return states
+}
+
 func (d *DcpDriver) initializeDcpClients() {
 	d.stateLock.Lock()
 	defer d.stateLock.Unlock()
 
-	loadDistribution := utils.BalanceLoad(d.numberOfClients, base.NumberOfVbuckets)
+	vbnos := d.vbRange.Vbnos()
+	loadDistribution := utils.BalanceLoad(d.numberOfClients, len(vbnos))
 	for i := 0; i < d.numberOfClients; i++ {
 		lowIndex := loadDistribution[i][0]
 		highIndex := loadDistribution[i][1]
 		vbList := make([]uint16, highIndex-lowIndex)
 		for j := lowIndex; j < highIndex; j++ {
-			vbList[j-lowIndex] = uint16(j)
+			vbList[j-lowIndex] = vbnos[j]
 		}
 
 		d.childWaitGroup.Add(1)
@@ -301,13 +546,96 @@ func (d *DcpDriver) setState(state DriverState) {
 
 func (d *DcpDriver) reportError(err error) {
 	// avoid printing spurious errors if we are stopping
-	if d.getState() != DriverStateStopped {
+	// Not using getState() since this can be called by a handler that Stop() is waiting for while holding the state lock
+	if d.ctx.Err() == nil {
 		d.logger.Infof("%s dcp driver encountered error=%v\n", d.Name, err)
 	}
 
 	utils.AddToErrorChan(d.errChan, err)
 }
 
+// Drops the mutations of the vb after seqno from its data files, which may hold mutations streamed
+// by a previous run up to the checkpoint the vb was rolled back from
+func (d *DcpDriver) truncateVbFiles(vbno uint16, seqno uint64) error {
+	if d.mutationSink != nil {
+		if truncater, ok := d.mutationSink.(MutationTruncater); ok {
+			return truncater.TruncateVb(vbno, seqno)
+		}
+		return nil
+	}
+	if objectStore.IsURI(d.fileDir) {
+		return fmt.Errorf("data files in object storage %v cannot be truncated", d.fileDir)
+	}
+	for i := 0; i < d.numberOfBins; i++ {
+		fileName := utils.GetFileName(d.fileDir, vbno, i)
+		fileData, err := ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// The run that wrote the file may have been stopped before closing it
+		fileData, err = utils.DecryptUnclosedDataFile(d.encryptionKey, fileData)
+		if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		data, compression, err := utils.DecompressDataFile(fileData)
+		if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		kept, err := truncateMutationsAfterSeqno(data, seqno)
+		if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		if len(kept) == len(data) {
+			continue
+		}
+		// Written back as one block, which can be appended to as before
+		kept, err = utils.CompressDataFileBlock(compression, kept)
+		if err != nil {
+			return err
+		}
+		err = utils.WriteDataFile(d.encryptionKey, fileName, kept, base.FileModeReadWrite)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the data file header and the serialized mutations in data whose seqno is not after the given seqno
+func truncateMutationsAfterSeqno(data []byte, seqno uint64) ([]byte, error) {
+	hashAlgorithm, headerLen, err := base.ParseDataFileHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	bodyLength := base.GetMutationBodyLength(hashAlgorithm)
+	kept := make([]byte, 0, len(data))
+	kept = append(kept, data[:headerLen]...)
+	for pos := headerLen; pos < len(data); {
+		if pos+base.KeyLenVariable > len(data) {
+			return nil, fmt.Errorf("truncated mutation at offset %v", pos)
+		}
+		keyLen := int(binary.BigEndian.Uint16(data[pos : pos+base.KeyLenVariable]))
+		filterLenPos := pos + base.KeyLenVariable + keyLen + bodyLength
+		if filterLenPos+base.MigrationFilterLen > len(data) {
+			return nil, fmt.Errorf("truncated mutation at offset %v", pos)
+		}
+		numFilters := int(binary.BigEndian.Uint16(data[filterLenPos : filterLenPos+base.MigrationFilterLen]))
+		end := filterLenPos + base.MigrationFilterLen + numFilters*2
+		if end > len(data) {
+			return nil, fmt.Errorf("truncated mutation at offset %v", pos)
+		}
+		// Seqno directly follows the key in both layouts
+		seqnoPos := pos + base.KeyLenVariable + keyLen
+		if binary.BigEndian.Uint64(data[seqnoPos:seqnoPos+8]) <= seqno {
+			kept = append(kept, data[pos:end]...)
+		}
+		pos = end
+	}
+	return kept, nil
+}
+
 func allowedCompletionError(err error) bool {
 	switch err {
 	case gocbcore.ErrDCPStreamClosed:
@@ -323,16 +651,59 @@ func (d *DcpDriver) handleVbucketCompletion(vbno uint16, err error, reason strin
 		d.reportError(wrappedErr)
 	} else {
 		if d.completeBySeqno {
+			var completed bool
 			vbStateWithLock := d.vbStateMap[vbno]
 			vbStateWithLock.lock.Lock()
-			defer vbStateWithLock.lock.Unlock()
 			if vbStateWithLock.vbState == VBStateNormal {
 				vbStateWithLock.vbState = VBStateCompleted
+				completed = true
+			}
+			vbStateWithLock.lock.Unlock()
+
+			if completed {
+				d.notifyVbCompleted(vbno)
 			}
 		}
 	}
 }
 
+// The handler owning the vb, if any, flushes it once it is done with the queued mutations
+// Otherwise nothing has been buffered for the vb and its data files are complete already
+func (d *DcpDriver) notifyVbCompleted(vbno uint16) {
+	// Not using getDcpClients() since this can be called while Stop() holds the state lock
+	// clients are only populated once, before any stream is opened
+	for _, dcpClient := range d.clients {
+		if dcpClient == nil {
+			continue
+		}
+		if handler, ok := dcpClient.vbHandlerMap[vbno]; ok {
+			handler.notifyVbEnded(vbno)
+			return
+		}
+	}
+	d.markVbFlushed(vbno)
+}
+
+func (d *DcpDriver) markVbFlushed(vbno uint16) {
+	select {
+	case d.vbFlushedChan <- vbno:
+	default:
+		// each vb completes only once, so this should not happen
+		d.logger.Warnf("%v unable to report vb %v as flushed\n", d.Name, vbno)
+	}
+}
+
+// Whether the mutation is the last one to be processed for its vbucket when completing by seqno
+func (d *DcpDriver) isLastMutationForVb(mut *Mutation) bool {
+	return d.completeBySeqno && mut.Seqno >= d.checkpointManager.endSeqnoMap[mut.Vbno]
+}
+
+// Receives the vbuckets whose data files have been fully written, only when completing by seqno
+// Can be used to start diffing those vbuckets while others are still streaming
+func (d *DcpDriver) VbFlushedChan() <-chan uint16 {
+	return d.vbFlushedChan
+}
+
 func (d *DcpDriver) getVbState(vbno uint16) VBState {
 	vbStateWithLock := d.vbStateMap[vbno]
 	vbStateWithLock.lock.RLock()
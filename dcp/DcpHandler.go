@@ -10,14 +10,23 @@
 package dcp
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha512"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/couchbase/gocbcore/v9"
+	"github.com/couchbase/gocbcore/v9/memd"
 	"github.com/couchbase/gomemcached"
 	mcc "github.com/couchbase/gomemcached/client"
 	xdcrBase "github.com/couchbase/goxdcr/base"
@@ -25,8 +34,11 @@ import (
 	xdcrLog "github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	xdcrUtils "github.com/couchbase/goxdcr/utils"
+	"github.com/golang/snappy"
+	"github.com/zeebo/blake3"
 	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/objectStore"
 	"xdcrDiffer/utils"
 )
 
@@ -39,7 +51,8 @@ type DcpHandler struct {
 	numberOfBins            int
 	dataChan                chan *Mutation
 	waitGrp                 sync.WaitGroup
-	finChan                 chan bool
+	ctx                     context.Context
+	cancel                  context.CancelFunc
 	bucketMap               map[uint16]map[int]*Bucket
 	fdPool                  fdp.FdPoolIface
 	logger                  *xdcrLog.CommonLogger
@@ -53,12 +66,24 @@ type DcpHandler struct {
 	utils                   xdcrUtils.UtilsIface
 	bufferCap               int
 	migrationMapping        metadata.CollectionNamespaceMapping
+	// vbuckets whose stream has completed, to be flushed once queued mutations are processed
+	vbEndedChan chan uint16
+	// only accessed by the processData go routine
+	flushedVbs map[uint16]bool
+	// closed by Stop() to have processData drain dataChan and exit
+	finChan chan bool
+	// counters for the throughput stats, accessed atomically
+	numProcessed uint64
+	bytesWritten uint64
+	// numProcessed as of the previous status report, only accessed by the status report go routine
+	lastNumProcessed uint64
 }
 
 func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uint16, numberOfBins, dataChanSize int, fdPool fdp.FdPoolIface, incReceivedCounter, incSysEvtReceived func(), colMigrationFilters []string, utils xdcrUtils.UtilsIface, bufferCap int, migrationMapping metadata.CollectionNamespaceMapping) (*DcpHandler, error) {
 	if len(vbList) == 0 {
 		return nil, fmt.Errorf("vbList is empty for handler %v", index)
 	}
+	ctx, cancel := context.WithCancel(dcpClient.ctx)
 	return &DcpHandler{
 		dcpClient:             dcpClient,
 		fileDir:               fileDir,
@@ -66,7 +91,8 @@ func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uin
 		vbList:                vbList,
 		numberOfBins:          numberOfBins,
 		dataChan:              make(chan *Mutation, dataChanSize),
-		finChan:               make(chan bool),
+		ctx:                   ctx,
+		cancel:                cancel,
 		bucketMap:             make(map[uint16]map[int]*Bucket),
 		fdPool:                fdPool,
 		logger:                dcpClient.logger,
@@ -79,6 +105,9 @@ func NewDcpHandler(dcpClient *DcpClient, fileDir string, index int, vbList []uin
 		isSource:              strings.Contains(dcpClient.Name, base.SourceClusterName),
 		bufferCap:             bufferCap,
 		migrationMapping:      migrationMapping,
+		vbEndedChan:           make(chan uint16, len(vbList)),
+		flushedVbs:            make(map[uint16]bool),
+		finChan:               make(chan bool),
 	}, nil
 }
 
@@ -94,10 +123,13 @@ func (dh *DcpHandler) Start() error {
 	return nil
 }
 
+// Stops taking mutations in, processes those still queued so that they make it into the data files and the
+// checkpoint, then flushes and closes the data files. Queued mutations still left after base.DcpHandlerDrainTimeout
+// are dropped, which the checkpoint accounts for
 func (dh *DcpHandler) Stop() {
+	dh.cancel()
 	close(dh.finChan)
-	// this sometimes does not return after a long time
-	//dh.waitGrp.Wait()
+	dh.waitGrp.Wait()
 
 	dh.cleanup()
 }
@@ -118,11 +150,15 @@ func (d *DcpHandler) compileMigrCollectionFiltersIfNeeded() error {
 }
 
 func (dh *DcpHandler) initialize() error {
+	// No data files are needed when mutations go to a sink
 	for _, vbno := range dh.vbList {
+		if dh.dcpClient.dcpDriver.mutationSink != nil {
+			break
+		}
 		innerMap := make(map[int]*Bucket)
 		dh.bucketMap[vbno] = innerMap
 		for i := 0; i < dh.numberOfBins; i++ {
-			bucket, err := NewBucket(dh.fileDir, vbno, i, dh.fdPool, dh.logger, dh.bufferCap)
+			bucket, err := NewBucket(dh.fileDir, vbno, i, dh.fdPool, dh.logger, dh.bufferCap, dh.dcpClient.dcpDriver.hashAlgorithm, dh.dcpClient.dcpDriver.dataFileCompression, dh.dcpClient.dcpDriver.encryptionKey, dh.dcpClient.dcpDriver.uploadStagingDir)
 			if err != nil {
 				return err
 			}
@@ -137,6 +173,9 @@ func (dh *DcpHandler) initialize() error {
 }
 
 func (dh *DcpHandler) cleanup() {
+	if dh.dcpClient.dcpDriver.mutationSink != nil {
+		return
+	}
 	for _, vbno := range dh.vbList {
 		innerMap := dh.bucketMap[vbno]
 		if innerMap == nil {
@@ -163,15 +202,64 @@ func (dh *DcpHandler) processData() {
 	for {
 		select {
 		case <-dh.finChan:
+			dh.drain()
 			goto done
 		case mut := <-dh.dataChan:
 			dh.processMutation(mut)
+		case vbno := <-dh.vbEndedChan:
+			// All mutations of the vb were queued before its stream ended, so process whatever is queued first
+			for i := len(dh.dataChan); i > 0; i-- {
+				dh.processMutation(<-dh.dataChan)
+			}
+			dh.flushVb(vbno)
 		}
 	}
 done:
 }
 
+// Processes the mutations and the ended vbs queued by the time the handler is stopped. dh.ctx is done by then, so
+// nothing more is queued
+func (dh *DcpHandler) drain() {
+	deadline := time.Now().Add(base.DcpHandlerDrainTimeout)
+	var drained int
+	for {
+		if time.Now().After(deadline) {
+			dh.logger.Warnf("%v DcpHandler %v timed out after draining %v mutations. Dropping the %v still queued\n",
+				dh.dcpClient.Name, dh.index, drained, len(dh.dataChan))
+			return
+		}
+		select {
+		case mut := <-dh.dataChan:
+			dh.processMutation(mut)
+			drained++
+		case vbno := <-dh.vbEndedChan:
+			for i := len(dh.dataChan); i > 0; i-- {
+				dh.processMutation(<-dh.dataChan)
+				drained++
+			}
+			dh.flushVb(vbno)
+		default:
+			if drained > 0 {
+				dh.logger.Infof("%v DcpHandler %v drained %v mutations on stop\n", dh.dcpClient.Name, dh.index, drained)
+			}
+			return
+		}
+	}
+}
+
 func (dh *DcpHandler) processMutation(mut *Mutation) {
+	atomic.AddUint64(&dh.numProcessed, 1)
+	if dh.dcpClient.dcpDriver.isLastMutationForVb(mut) {
+		// Nothing more will be written for the vb once this mutation is processed
+		defer dh.flushVb(mut.Vbno)
+	}
+
+	err := mut.Decompress()
+	if err != nil {
+		// The compressed value is hashed instead. It will not match the other side and is verified by the mutation differ
+		dh.logger.Warnf("%v DcpHandler %v unable to decompress value of key %v in vb %v - %v", dh.dcpClient.Name, dh.index, base.TagKey(mut.Key), mut.Vbno, err)
+	}
+
 	var matched bool
 	var replicationFilterResult base.FilterResultType
 
@@ -200,6 +288,33 @@ func (dh *DcpHandler) processMutation(mut *Mutation) {
 		}
 	}
 
+	if dh.colMigrationFiltersOn && len(filterIdsMatched) > 0 {
+		mut.ColFiltersMatched = filterIdsMatched
+	}
+
+	// Keys out of the sample or the key range are still checkpointed above, so that the vbuckets complete as usual
+	if !dh.dcpClient.dcpDriver.keyRange.Contains(mut.Key) || !utils.IsKeyInSample(mut.Key, dh.dcpClient.dcpDriver.samplePercent) {
+		return
+	}
+
+	if dh.dcpClient.dcpDriver.ignoreSyncGatewayXattrs && dh.dcpClient.dcpDriver.hashAlgorithm != base.HashAlgorithmNone {
+		err = mut.StripXattrs(base.SyncGatewayXattrs)
+		if err != nil {
+			// The value is hashed as is. It will not match the other side and is verified by the mutation differ
+			dh.logger.Warnf("%v DcpHandler %v unable to strip xattrs of key %v in vb %v - %v", dh.dcpClient.Name, dh.index, base.TagKey(mut.Key), mut.Vbno, err)
+		}
+	}
+
+	if mutationSink := dh.dcpClient.dcpDriver.mutationSink; mutationSink != nil {
+		serialized := mut.SerializeWithHash(dh.dcpClient.dcpDriver.hashAlgorithm)
+		atomic.AddUint64(&dh.bytesWritten, uint64(len(serialized)))
+		err := mutationSink.AddMutation(dh.isSource, mut.Vbno, serialized)
+		if err != nil {
+			dh.logger.Errorf("%v DcpHandler %v unable to add mutation for vb %v to sink - %v", dh.dcpClient.Name, dh.index, mut.Vbno, err)
+		}
+		return
+	}
+
 	vbno := mut.Vbno
 	index := utils.GetBucketIndexFromKey(mut.Key, dh.numberOfBins)
 	innerMap := dh.bucketMap[vbno]
@@ -211,10 +326,38 @@ func (dh *DcpHandler) processMutation(mut *Mutation) {
 		panic(fmt.Sprintf("cannot find bucket for index %v", index))
 	}
 
-	if dh.colMigrationFiltersOn && len(filterIdsMatched) > 0 {
-		mut.ColFiltersMatched = filterIdsMatched
+	var serialized []byte
+	if base.IsCompactMutationLayout(dh.dcpClient.dcpDriver.hashAlgorithm) {
+		serialized = mut.SerializeCompact()
+	} else {
+		serialized = mut.SerializeWithHash(dh.dcpClient.dcpDriver.hashAlgorithm)
+	}
+	atomic.AddUint64(&dh.bytesWritten, uint64(len(serialized)))
+	bucket.write(serialized)
+}
+
+// Called by the dcp driver when a vbucket has completed
+func (dh *DcpHandler) notifyVbEnded(vbno uint16) {
+	select {
+	case dh.vbEndedChan <- vbno:
+	default:
+		// each vb is owned by one handler and only ends once, so this should not happen
+		dh.logger.Warnf("%v DcpHandler %v unable to queue ended vb %v\n", dh.dcpClient.Name, dh.index, vbno)
 	}
-	bucket.write(mut.Serialize())
+}
+
+// Writes out whatever is buffered for the vbucket and closes its data files, so that they are complete and the
+// file differ can register them with the fd pool, then lets the driver know
+func (dh *DcpHandler) flushVb(vbno uint16) {
+	if dh.flushedVbs[vbno] {
+		return
+	}
+	dh.flushedVbs[vbno] = true
+
+	for _, bucket := range dh.bucketMap[vbno] {
+		bucket.close()
+	}
+	dh.dcpClient.dcpDriver.markVbFlushed(vbno)
 }
 
 func (dh *DcpHandler) replicationFilter(mut *Mutation, matched bool, filterResult base.FilterResultType) base.FilterResultType {
@@ -227,7 +370,7 @@ func (dh *DcpHandler) replicationFilter(mut *Mutation, matched bool, filterResul
 		}
 		if err != nil {
 			filterResult = base.UnableToFilter
-			dh.logger.Warnf("Err %v - (%v) when filtering mutation %v", err, errStr, mut)
+			dh.logger.Warnf("Err %v - (%v) when filtering mutation of key %v in vb %v seqno %v", err, errStr, base.TagKey(mut.Key), mut.Vbno, mut.Seqno)
 		}
 	}
 	return filterResult
@@ -237,7 +380,7 @@ func (dh *DcpHandler) writeToDataChan(mut *Mutation) {
 	select {
 	case dh.dataChan <- mut:
 	// provides an alternative exit path when dh stops
-	case <-dh.finChan:
+	case <-dh.ctx.Done():
 	}
 }
 
@@ -322,8 +465,8 @@ func (dh *DcpHandler) checkColMigrationDataCloned(mut *Mutation) {
 	dummyReq.Req = &gomemcached.MCRequest{}
 	matchedNamespaces, errMap, errMCReqMap := dh.migrationMapping.GetTargetUsingMigrationFilter(uprEvent, dummyReq, dh.logger)
 	if len(matchedNamespaces) > 1 {
-		dh.logger.Debugf("Document %s (%x) with length %v opCode %v matched more than once: %v, errMap %v, errMCReqMap %v",
-			uprEvent.UprEvent.Key, uprEvent.UprEvent.Key, len(uprEvent.UprEvent.Key), uprEvent.UprEvent.Opcode, matchedNamespaces.String(), errMap, errMCReqMap)
+		dh.logger.Debugf("Document %v with length %v opCode %v matched more than once: %v, errMap %v, errMCReqMap %v",
+			base.TagUD(fmt.Sprintf("%v (%x)", base.EncodeKey(string(uprEvent.UprEvent.Key)), uprEvent.UprEvent.Key)), len(uprEvent.UprEvent.Key), uprEvent.UprEvent.Opcode, matchedNamespaces.String(), errMap, errMCReqMap)
 	}
 }
 
@@ -340,16 +483,47 @@ type Bucket struct {
 	logger *xdcrLog.CommonLogger
 
 	bufferCap int
+	// Each flush is compressed into a block of its own, unless none
+	compression string
+	// Each flush is then encrypted into blocks of its own, unless nil. The last block is sealed when the bucket is closed
+	encrypter io.WriteCloser
+	// Set once the file is closed, which is as soon as its vb is flushed when completing by seqno
+	closed bool
 }
 
-func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIface, logger *xdcrLog.CommonLogger, bufferCap int) (*Bucket, error) {
+func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIface, logger *xdcrLog.CommonLogger, bufferCap int, hashAlgorithm, compression string, encryptionKey []byte, uploadStagingDir string) (*Bucket, error) {
 	fileName := utils.GetFileName(fileDir, vbno, bucketIndex)
 	var cb fdp.FileOp
 	var closeOp func() error
 	var err error
 	var file *os.File
 
-	if fdPool == nil {
+	// Objects cannot be appended to, so they are always written from scratch
+	needsHeader := true
+	var numBlocks uint64
+	if !objectStore.IsURI(fileName) {
+		needsHeader, err = checkDataFileHeader(fileName, hashAlgorithm, compression, encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		// Blocks appended to an encrypted file are numbered after the ones already in it
+		if encryptionKey != nil {
+			numBlocks, err = countDataFileBlocks(fileName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if objectStore.IsURI(fileName) {
+		// Uploaded in parts as it is written, and completed when the bucket is closed
+		writer, err := objectStore.Create(fileName, 0, uploadStagingDir)
+		if err != nil {
+			return nil, err
+		}
+		cb = writer.Write
+		closeOp = writer.Close
+	} else if fdPool == nil {
 		file, err = os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, base.FileModeReadWrite)
 		if err != nil {
 			return nil, err
@@ -363,16 +537,126 @@ func NewBucket(fileDir string, vbno uint16, bucketIndex int, fdPool fdp.FdPoolIf
 			return fdPool.DeRegisterFileHandle(fileName)
 		}
 	}
-	return &Bucket{
-		data:      make([]byte, bufferCap),
-		index:     0,
-		file:      file,
-		fileName:  fileName,
-		fdPoolCb:  cb,
-		closeOp:   closeOp,
-		logger:    logger,
-		bufferCap: bufferCap,
-	}, nil
+	bucket := &Bucket{
+		data:        make([]byte, bufferCap),
+		index:       0,
+		file:        file,
+		fileName:    fileName,
+		fdPoolCb:    cb,
+		closeOp:     closeOp,
+		logger:      logger,
+		bufferCap:   bufferCap,
+		compression: compression,
+	}
+	if encryptionKey != nil {
+		var fileWriter io.Writer = file
+		if cb != nil {
+			fileWriter = fileOpWriter(cb)
+		}
+		bucket.encrypter = utils.NewDataFileAppender(encryptionKey, fileWriter, numBlocks)
+	}
+	if needsHeader {
+		header, err := base.GetDataFileHeader(hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		// Goes out with the first flush
+		bucket.write(header)
+	}
+	return bucket, nil
+}
+
+// Returns the number of encrypted blocks the data file already holds, if any
+func countDataFileBlocks(fileName string) (uint64, error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	numBlocks, err := utils.CountDataFileBlocks(file)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", fileName, err)
+	}
+	return numBlocks, nil
+}
+
+type fileOpWriter fdp.FileOp
+
+func (op fileOpWriter) Write(p []byte) (int, error) {
+	return op(p)
+}
+
+// Returns whether the data file is new and needs a header. A data file that is appended to,
+// i.e. when resuming from a checkpoint, must already hold hashes of the given algorithm, compressed and
+// encrypted the same way
+func checkDataFileHeader(fileName, hashAlgorithm, compression string, encryptionKey []byte) (bool, error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	encryptionPrefix := make([]byte, utils.DataFileEncryptionMagicLen)
+	bytesRead, err := io.ReadFull(file, encryptionPrefix)
+	if bytesRead == 0 {
+		return true, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	encryptionPrefix = encryptionPrefix[:bytesRead]
+	encrypted := utils.IsDataFileEncrypted(encryptionPrefix)
+	if encrypted && encryptionKey == nil {
+		return false, fmt.Errorf("%v is encrypted, which cannot be appended to without an encryption key", fileName)
+	} else if !encrypted && encryptionKey != nil {
+		return false, fmt.Errorf("%v is not encrypted, which cannot be appended to with an encryption key", fileName)
+	}
+	var reader io.Reader = io.MultiReader(bytes.NewReader(encryptionPrefix), file)
+	if encrypted {
+		reader, err = utils.NewDataFileDecrypter(encryptionKey, reader)
+		if err != nil {
+			return false, fmt.Errorf("%v: %v", fileName, err)
+		}
+	}
+
+	prefix := make([]byte, utils.DataFileCompressionMagicLen)
+	bytesRead, err = io.ReadFull(reader, prefix)
+	if bytesRead == 0 {
+		return true, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	prefix = prefix[:bytesRead]
+	fileCompression := utils.DetectDataFileCompression(prefix)
+	if fileCompression != compression {
+		return false, fmt.Errorf("%v is compressed with %v, which cannot be appended to with %v", fileName, fileCompression, compression)
+	}
+	decompressor, err := utils.NewDataFileDecompressor(fileCompression, io.MultiReader(bytes.NewReader(prefix), reader))
+	if err != nil {
+		return false, fmt.Errorf("%v: %v", fileName, err)
+	}
+
+	data := make([]byte, base.DataFileHeaderLen)
+	bytesRead, err = io.ReadFull(decompressor, data)
+	if bytesRead == 0 {
+		return true, nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	fileHashAlgorithm, _, err := base.ParseDataFileHeader(data[:bytesRead])
+	if err != nil {
+		return false, fmt.Errorf("%v: %v", fileName, err)
+	}
+	if fileHashAlgorithm != hashAlgorithm {
+		return false, fmt.Errorf("%v holds %v hashes, which cannot be appended to with %v hashes", fileName, fileHashAlgorithm, hashAlgorithm)
+	}
+	return false, nil
 }
 
 func (b *Bucket) write(item []byte) error {
@@ -392,26 +676,55 @@ func (b *Bucket) flushToFile() error {
 	var numOfBytes int
 	var err error
 
+	data := b.data[:b.index]
+	if b.compression != base.DataFileCompressionNone || b.encrypter != nil {
+		if b.index == 0 {
+			// An empty block would still take up its framing
+			return nil
+		}
+		data, err = utils.CompressDataFileBlock(b.compression, data)
+		if err != nil {
+			return err
+		}
+	}
+	if b.encrypter != nil {
+		_, err = b.encrypter.Write(data)
+		if err != nil {
+			return err
+		}
+		b.index = 0
+		return nil
+	}
 	if b.fdPoolCb != nil {
-		numOfBytes, err = b.fdPoolCb(b.data[:b.index])
+		numOfBytes, err = b.fdPoolCb(data)
 	} else {
-		numOfBytes, err = b.file.Write(b.data[:b.index])
+		numOfBytes, err = b.file.Write(data)
 	}
 	if err != nil {
 		return err
 	}
-	if numOfBytes != b.index {
-		return fmt.Errorf("Incomplete write. expected=%v, actual=%v", b.index, numOfBytes)
+	if numOfBytes != len(data) {
+		return fmt.Errorf("Incomplete write. expected=%v, actual=%v", len(data), numOfBytes)
 	}
 	b.index = 0
 	return nil
 }
 
 func (b *Bucket) close() {
+	if b.closed {
+		return
+	}
+	b.closed = true
 	err := b.flushToFile()
 	if err != nil {
 		b.logger.Errorf("Error flushing to file %v at bucket close err=%v\n", b.fileName, err)
 	}
+	if b.encrypter != nil {
+		err = b.encrypter.Close()
+		if err != nil {
+			b.logger.Errorf("Error sealing the last block of file %v at bucket close err=%v\n", b.fileName, err)
+		}
+	}
 	if b.fdPoolCb != nil {
 		err = b.closeOp()
 		if err != nil {
@@ -456,6 +769,109 @@ func CreateMutation(vbno uint16, key []byte, seqno, revId, cas uint64, flags, ex
 	}
 }
 
+// Replaces a snappy compressed value with the decompressed one, so that the body hash and the datatype
+// do not depend on whether compression was negotiated on either side
+func (m *Mutation) Decompress() error {
+	if m.Datatype&uint8(memd.DatatypeFlagCompressed) == 0 {
+		return nil
+	}
+	value, err := snappy.Decode(nil, m.Value)
+	if err != nil {
+		return err
+	}
+	m.Value = value
+	m.Datatype &^= uint8(memd.DatatypeFlagCompressed)
+	return nil
+}
+
+// Removes the named xattrs from a decompressed value. The xattr datatype is cleared if no xattrs are left,
+// so that the datatype matches a doc that never had them
+// A value with xattrs starts with the length of the xattrs, followed by each name and value pair, as
+// pair length, name, a zero byte, value and a zero byte, followed by the body
+func (m *Mutation) StripXattrs(names []string) error {
+	if m.Datatype&uint8(memd.DatatypeFlagXattrs) == 0 || m.Datatype&uint8(memd.DatatypeFlagCompressed) != 0 {
+		return nil
+	}
+	if len(m.Value) < 4 {
+		return fmt.Errorf("value of %v bytes is too short to hold xattrs", len(m.Value))
+	}
+	xattrsEnd := 4 + int(binary.BigEndian.Uint32(m.Value[:4]))
+	if xattrsEnd > len(m.Value) {
+		return fmt.Errorf("xattrs end at %v, past the value of %v bytes", xattrsEnd, len(m.Value))
+	}
+
+	var kept []byte
+	for pos := 4; pos < xattrsEnd; {
+		if pos+4 > xattrsEnd {
+			return fmt.Errorf("xattr at %v is truncated", pos)
+		}
+		pairEnd := pos + 4 + int(binary.BigEndian.Uint32(m.Value[pos:pos+4]))
+		if pairEnd > xattrsEnd {
+			return fmt.Errorf("xattr at %v ends at %v, past the xattrs", pos, pairEnd)
+		}
+		nameLen := bytes.IndexByte(m.Value[pos+4:pairEnd], 0)
+		if nameLen < 0 {
+			return fmt.Errorf("xattr at %v has no name", pos)
+		}
+		if !isXattrIn(string(m.Value[pos+4:pos+4+nameLen]), names) {
+			kept = append(kept, m.Value[pos:pairEnd]...)
+		}
+		pos = pairEnd
+	}
+
+	body := m.Value[xattrsEnd:]
+	if len(kept) == 0 {
+		m.Value = body
+		m.Datatype &^= uint8(memd.DatatypeFlagXattrs)
+		return nil
+	}
+	value := make([]byte, 4+len(kept)+len(body))
+	binary.BigEndian.PutUint32(value[:4], uint32(len(kept)))
+	copy(value[4:], kept)
+	copy(value[4+len(kept):], body)
+	m.Value = value
+	return nil
+}
+
+// Puts the given xattrs in front of a decompressed value that holds none, in the layout that StripXattrs reads,
+// and sets the xattr datatype. The names are sorted so that the same xattrs always make the same value
+func (m *Mutation) PrependXattrs(xattrs map[string]json.RawMessage) {
+	if len(xattrs) == 0 {
+		return
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []byte
+	pairLenBytes := make([]byte, 4)
+	for _, name := range names {
+		binary.BigEndian.PutUint32(pairLenBytes, uint32(len(name)+1+len(xattrs[name])+1))
+		pairs = append(pairs, pairLenBytes...)
+		pairs = append(pairs, name...)
+		pairs = append(pairs, 0)
+		pairs = append(pairs, xattrs[name]...)
+		pairs = append(pairs, 0)
+	}
+	value := make([]byte, 4+len(pairs)+len(m.Value))
+	binary.BigEndian.PutUint32(value[:4], uint32(len(pairs)))
+	copy(value[4:], pairs)
+	copy(value[4+len(pairs):], m.Value)
+	m.Value = value
+	m.Datatype |= uint8(memd.DatatypeFlagXattrs)
+}
+
+func isXattrIn(name string, names []string) bool {
+	for _, oneName := range names {
+		if name == oneName {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Mutation) IsExpiration() bool {
 	return m.OpCode == gomemcached.UPR_EXPIRATION
 }
@@ -513,9 +929,21 @@ func (m *Mutation) ToUprEvent() *xdcrBase.WrappedUprEvent {
 //	colFiltersLen - 2 byte (number of collection migration filters)
 //	(per col filter) - 2 byte
 func (mut *Mutation) Serialize() []byte {
+	return mut.SerializeWithHash(base.HashAlgorithmSha512)
+}
+
+// Same as Serialize, with the body hashed by the given algorithm
+// With base.HashAlgorithmNone, only the key, seqno, opcode and collection are recorded and the rest is zeroed, so
+// that only whether the doc exists is diffed. This is the layout mutation sinks are given. Data files are written
+// with SerializeCompact instead
+func (mut *Mutation) SerializeWithHash(hashAlgorithm string) []byte {
 	keyLen := len(mut.Key)
 	ret := make([]byte, base.GetFixedSizeMutationLen(keyLen, mut.ColFiltersMatched))
-	bodyHash := sha512.Sum512(mut.Value)
+	bodyHash := hashBody(hashAlgorithm, mut.Value)
+	revId, cas, flags, expiry, datatype := mut.RevId, mut.Cas, mut.Flags, mut.Expiry, mut.Datatype
+	if hashAlgorithm == base.HashAlgorithmNone {
+		revId, cas, flags, expiry, datatype = 0, 0, 0, 0, 0
+	}
 
 	pos := 0
 	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(keyLen))
@@ -524,17 +952,17 @@ func (mut *Mutation) Serialize() []byte {
 	pos += keyLen
 	binary.BigEndian.PutUint64(ret[pos:pos+8], mut.Seqno)
 	pos += 8
-	binary.BigEndian.PutUint64(ret[pos:pos+8], mut.RevId)
+	binary.BigEndian.PutUint64(ret[pos:pos+8], revId)
 	pos += 8
-	binary.BigEndian.PutUint64(ret[pos:pos+8], mut.Cas)
+	binary.BigEndian.PutUint64(ret[pos:pos+8], cas)
 	pos += 8
-	binary.BigEndian.PutUint32(ret[pos:pos+4], mut.Flags)
+	binary.BigEndian.PutUint32(ret[pos:pos+4], flags)
 	pos += 4
-	binary.BigEndian.PutUint32(ret[pos:pos+4], mut.Expiry)
+	binary.BigEndian.PutUint32(ret[pos:pos+4], expiry)
 	pos += 4
 	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(mut.OpCode))
 	pos += 2
-	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(mut.Datatype))
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(datatype))
 	pos += 2
 	copy(ret[pos:], bodyHash[:])
 	pos += 64
@@ -548,3 +976,53 @@ func (mut *Mutation) Serialize() []byte {
 	}
 	return ret
 }
+
+// serialize mutation into []byte in the compact layout of data files with base.HashAlgorithmNone
+// format:
+//
+//	keyLen   - 2 bytes
+//	Key  - length specified by keyLen
+//	Seqno    - 8 bytes
+//	opType   - 2 byte
+//	collectionId - 4 bytes
+//	colFiltersLen - 2 byte (number of collection migration filters)
+//	(per col filter) - 2 byte
+func (mut *Mutation) SerializeCompact() []byte {
+	keyLen := len(mut.Key)
+	ret := make([]byte, base.GetMutationLen(base.HashAlgorithmNone, keyLen, mut.ColFiltersMatched))
+
+	pos := 0
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(keyLen))
+	pos += 2
+	copy(ret[pos:pos+keyLen], mut.Key)
+	pos += keyLen
+	binary.BigEndian.PutUint64(ret[pos:pos+8], mut.Seqno)
+	pos += 8
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(mut.OpCode))
+	pos += 2
+	binary.BigEndian.PutUint32(ret[pos:pos+4], mut.ColId)
+	pos += 4
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(len(mut.ColFiltersMatched)))
+	pos += 2
+	for _, colFilterId := range mut.ColFiltersMatched {
+		binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(colFilterId))
+		pos += 2
+	}
+	return ret
+}
+
+// Digests shorter than sha512 are zero padded, so the serialized layout is the same for all algorithms
+func hashBody(hashAlgorithm string, value []byte) [sha512.Size]byte {
+	var hash [sha512.Size]byte
+	switch hashAlgorithm {
+	case base.HashAlgorithmNone:
+	case base.HashAlgorithmXxhash64:
+		binary.BigEndian.PutUint64(hash[:8], xxhash.Sum64(value))
+	case base.HashAlgorithmBlake3:
+		digest := blake3.Sum256(value)
+		copy(hash[:], digest[:])
+	default:
+		hash = sha512.Sum512(value)
+	}
+	return hash
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp
+
+import (
+	"sync"
+
+	"xdcrDiffer/base"
+)
+
+// Filter counts of a vbucket by collection ID. The mutations of a vb are processed by one DcpHandler, but
+// a rollback may clear the counts from the dcp stream callback, and the driver may read them at any time
+type vbFilterCounts struct {
+	counts map[uint32]*base.FilterCounts
+	lock   sync.RWMutex
+}
+
+func newVbFilterCounts() *vbFilterCounts {
+	return &vbFilterCounts{counts: make(map[uint32]*base.FilterCounts)}
+}
+
+func (v *vbFilterCounts) record(colId uint32, filterResult base.FilterResultType) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	colCounts, exists := v.counts[colId]
+	if !exists {
+		colCounts = &base.FilterCounts{}
+		v.counts[colId] = colCounts
+	}
+	colCounts.Record(filterResult)
+}
+
+// Resumes the counts saved in a checkpoint
+func (v *vbFilterCounts) add(byCollection map[uint32]*base.FilterCounts) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	addFilterCounts(v.counts, byCollection)
+}
+
+// Adds the counts of the vb to byCollection
+func (v *vbFilterCounts) addTo(byCollection map[uint32]*base.FilterCounts) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	addFilterCounts(byCollection, v.counts)
+}
+
+func addFilterCounts(dst, src map[uint32]*base.FilterCounts) {
+	for colId, colCounts := range src {
+		if _, exists := dst[colId]; !exists {
+			dst[colId] = &base.FilterCounts{}
+		}
+		dst[colId].Add(colCounts)
+	}
+}
+
+// A copy of the counts to save in a checkpoint. nil if nothing has been counted
+func (v *vbFilterCounts) clone() map[uint32]*base.FilterCounts {
+	v.lock.RLock()
+	isEmpty := len(v.counts) == 0
+	v.lock.RUnlock()
+	if isEmpty {
+		return nil
+	}
+	byCollection := make(map[uint32]*base.FilterCounts)
+	v.addTo(byCollection)
+	return byCollection
+}
+
+func (v *vbFilterCounts) clear() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.counts = make(map[uint32]*base.FilterCounts)
+}
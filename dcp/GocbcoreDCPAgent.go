@@ -13,6 +13,12 @@ import (
 type GocbcoreDCPFeed struct {
 	base.GocbcoreAgentCommon
 	dcpAgent *gocbcore.DCPAgent
+	// Size of the DCP connection buffer. gocbcore acknowledges the consumed bytes once the handler
+	// callbacks return, so a handler blocked on a full channel holds kv-engine back
+	bufferSize int
+	// Whether to negotiate snappy. Values are left compressed by gocbcore and decompressed by the
+	// DcpHandler workers instead of the connection's read loop
+	compression bool
 }
 
 func (f *GocbcoreDCPFeed) setupDCPAgent(auth interface{}, collections bool) error {
@@ -69,14 +75,19 @@ func (f *GocbcoreDCPFeed) setupDCPAgentConfig(authMech interface{}, collections
 		return nil, false, err
 	}
 	return &gocbcore.DCPAgentConfig{
-		UserAgent:         f.Name,
-		BucketName:        f.BucketName,
-		Auth:              auth,
-		ConnectTimeout:    f.SetupTimeout,
-		KVConnectTimeout:  f.SetupTimeout,
-		UseCollections:    collections,
-		UseTLS:            useTLS,
-		TLSRootCAProvider: x509Provider,
+		UserAgent:            f.Name,
+		BucketName:           f.BucketName,
+		Auth:                 auth,
+		ConnectTimeout:       f.SetupTimeout,
+		KVConnectTimeout:     f.SetupTimeout,
+		UseCollections:       collections,
+		UseTLS:               useTLS,
+		TLSRootCAProvider:    x509Provider,
+		AuthMechanisms:       base.GetKVAuthMechanisms(useTLS),
+		DCPBufferSize:        f.bufferSize,
+		UseCompression:       f.compression,
+		DisableDecompression: true,
+		NetworkType:          base.GetNetworkType(),
 	}, useTLS, nil
 }
 
@@ -140,7 +151,7 @@ func (f *GocbcoreDCPFeed) setupGocbcoreDCPAgent(config *gocbcore.DCPAgentConfig,
 	return
 }
 
-func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth interface{}, collections bool) (*GocbcoreDCPFeed, error) {
+func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth interface{}, collections bool, bufferSize int, compression bool) (*GocbcoreDCPFeed, error) {
 	gocbcoreDcpFeed := &GocbcoreDCPFeed{
 		GocbcoreAgentCommon: base.GocbcoreAgentCommon{
 			Name:         id,
@@ -148,7 +159,9 @@ func NewGocbcoreDCPFeed(id string, servers []string, bucketName string, auth int
 			BucketName:   bucketName,
 			SetupTimeout: base.SetupTimeout,
 		},
-		dcpAgent: nil,
+		dcpAgent:    nil,
+		bufferSize:  bufferSize,
+		compression: compression,
 	}
 
 	err := gocbcoreDcpFeed.setupDCPAgent(auth, collections)
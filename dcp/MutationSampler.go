@@ -0,0 +1,168 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	gocbcore "github.com/couchbase/gocbcore/v9"
+	"github.com/couchbase/gomemcached"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	xdcrLog "github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	xdcrUtils "github.com/couchbase/goxdcr/utils"
+)
+
+// Collects the first mutations of live docs streamed, up to limit. Deletions, expirations and system events
+// have no body to look at, and are skipped
+// implements StreamObserver
+type mutationSampler struct {
+	limit     int
+	mutations []*Mutation
+	lock      sync.Mutex
+	doneChan  chan bool
+}
+
+func (s *mutationSampler) add(mut *Mutation) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.mutations) >= s.limit {
+		return
+	}
+	s.mutations = append(s.mutations, mut)
+	if len(s.mutations) == s.limit {
+		close(s.doneChan)
+	}
+}
+
+func (s *mutationSampler) sampled() []*Mutation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mutations
+}
+
+func (s *mutationSampler) SnapshotMarker(startSeqno, endSeqno uint64, vbno uint16, streamID uint16, snapshotType gocbcore.SnapshotState) {
+}
+
+func (s *mutationSampler) Mutation(seqno, revId uint64, flags, expiry, lockTime uint32, cas uint64, datatype uint8, vbno uint16, collectionID uint32, streamID uint16, key, value []byte) {
+	s.add(CreateMutation(vbno, key, seqno, revId, cas, flags, expiry, gomemcached.UPR_MUTATION, value, datatype, collectionID))
+}
+
+func (s *mutationSampler) Deletion(seqno, revId uint64, deleteTime uint32, cas uint64, datatype uint8, vbno uint16, collectionID uint32, streamID uint16, key, value []byte) {
+}
+
+func (s *mutationSampler) Expiration(seqno, revId uint64, deleteTime uint32, cas uint64, vbno uint16, collectionID uint32, streamID uint16, key []byte) {
+}
+
+func (s *mutationSampler) End(vbno uint16, streamID uint16, err error) {
+}
+
+func (s *mutationSampler) CreateCollection(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, scopeID uint32, collectionID uint32, ttl uint32, streamID uint16, key []byte) {
+}
+
+func (s *mutationSampler) DeleteCollection(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, scopeID uint32, collectionID uint32, streamID uint16) {
+}
+
+func (s *mutationSampler) FlushCollection(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, collectionID uint32) {
+}
+
+func (s *mutationSampler) CreateScope(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, scopeID uint32, streamID uint16, key []byte) {
+}
+
+func (s *mutationSampler) DeleteScope(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, scopeID uint32, streamID uint16) {
+}
+
+func (s *mutationSampler) ModifyCollection(seqNo uint64, version uint8, vbID uint16, manifestUID uint64, collectionID uint32, ttl uint32, streamID uint16) {
+}
+
+func (s *mutationSampler) OSOSnapshot(vbID uint16, snapshotType uint32, streamID uint16) {
+}
+
+func (s *mutationSampler) SeqNoAdvanced(vbID uint16, bySeqno uint64, streamID uint16) {
+}
+
+// Streams the given vbuckets of a bucket from the start over a short-lived DCP connection, and returns the first
+// limit mutations of live docs, with their xattrs and bodies as the data generation DcpHandlers get them
+// Fewer are returned if the timeout passes or ctx is canceled first. Nothing is written to disk
+func SampleMutations(ctx context.Context, logger *xdcrLog.CommonLogger, name, bucketName string, ref *metadata.RemoteClusterReference,
+	capabilities metadata.Capability, collectionIds []uint32, utils xdcrUtils.UtilsIface, vbnos []uint16, limit int,
+	timeout time.Duration, kvPort uint16) ([]*Mutation, error) {
+	// Only what the connection helpers use
+	dcpDriver := &DcpDriver{
+		Name:         name,
+		bucketName:   bucketName,
+		ref:          ref,
+		capabilities: capabilities,
+		utils:        utils,
+		logger:       logger,
+		kvPort:       kvPort,
+	}
+	kvVbMap, err := initializeKVVBMap(dcpDriver)
+	if err != nil {
+		return nil, err
+	}
+	var kvSSLPortMap map[string]uint16
+	if ref.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
+		kvSSLPortMap, err = initializeSSLPorts(dcpDriver)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auth, bucketConnStr, err := initializeBucketWithSecurity(dcpDriver, kvVbMap, kvSSLPortMap, true)
+	if err != nil {
+		return nil, err
+	}
+
+	feed, err := NewGocbcoreDCPFeed(fmt.Sprintf("xdcrDifferSampler_%v", name), []string{bucketConnStr}, bucketName, auth,
+		capabilities.HasCollectionSupport(), 0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer feed.dcpAgent.Close()
+
+	var streamOpts gocbcore.OpenStreamOptions
+	if len(collectionIds) > 0 {
+		streamOpts.FilterOptions = &gocbcore.OpenStreamFilterOptions{CollectionIDs: collectionIds}
+	}
+	sampler := &mutationSampler{
+		limit:    limit,
+		doneChan: make(chan bool),
+	}
+	for _, vbno := range vbnos {
+		curVbno := vbno
+		_, err = feed.dcpAgent.OpenStream(curVbno, 0, 0, 0, gocbcore.SeqNo(math.MaxUint64), 0, 0, sampler, streamOpts,
+			func(entries []gocbcore.FailoverEntry, cbErr error) {
+				if cbErr != nil {
+					logger.Warnf("%v unable to open dcp stream for vb %v to sample from. err=%v\n", name, curVbno, cbErr)
+				}
+			})
+		if err != nil {
+			return nil, fmt.Errorf("%v error opening dcp stream for vb %v. err=%v", name, curVbno, err)
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sampler.doneChan:
+	case <-timer.C:
+		logger.Infof("%v timed out after sampling %v of %v mutations\n", name, len(sampler.sampled()), limit)
+	case <-ctx.Done():
+	}
+
+	for _, vbno := range vbnos {
+		feed.dcpAgent.CloseStream(vbno, gocbcore.CloseStreamOptions{}, func(error) {})
+	}
+	return sampler.sampled(), nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package dcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"xdcrDiffer/base"
+)
+
+// Throughput of a DcpHandler, or of all the handlers of a DcpClient, since the previous status report
+type ThroughputStats struct {
+	Name            string
+	MutationsPerSec float64
+	// Mutations queued in the data channel, out of its capacity
+	Queued   int
+	QueueCap int
+	// Bytes of serialized mutations written since the start
+	BytesWritten uint64
+}
+
+func (s *ThroughputStats) String() string {
+	return fmt.Sprintf("%v %.1f mutations/s, channel %v/%v, %v bytes written", s.Name, s.MutationsPerSec, s.Queued, s.QueueCap, s.BytesWritten)
+}
+
+func (s *ThroughputStats) add(other *ThroughputStats) {
+	s.MutationsPerSec += other.MutationsPerSec
+	s.Queued += other.Queued
+	s.QueueCap += other.QueueCap
+	s.BytesWritten += other.BytesWritten
+}
+
+// Only called by the status report go routine, which is the only one to access lastNumProcessed
+func (dh *DcpHandler) throughputStats(elapsed time.Duration) *ThroughputStats {
+	numProcessed := atomic.LoadUint64(&dh.numProcessed)
+	stats := &ThroughputStats{
+		Name:         fmt.Sprintf("%v handler %v", dh.dcpClient.Name, dh.index),
+		Queued:       len(dh.dataChan),
+		QueueCap:     cap(dh.dataChan),
+		BytesWritten: atomic.LoadUint64(&dh.bytesWritten),
+	}
+	if elapsed > 0 {
+		stats.MutationsPerSec = float64(numProcessed-dh.lastNumProcessed) / elapsed.Seconds()
+	}
+	dh.lastNumProcessed = numProcessed
+	return stats
+}
+
+// Whether all the vbuckets of the handler have completed, after which its throughput no longer matters
+func (dh *DcpHandler) isDone() bool {
+	for _, vbno := range dh.vbList {
+		if dh.dcpClient.dcpDriver.getVbState(vbno) == VBStateNormal {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the throughput of each client, and of the handlers that have not completed, the slowest first
+func (d *DcpDriver) throughputStats() (clientStats, handlerStats []*ThroughputStats) {
+	now := time.Now()
+	var elapsed time.Duration
+	if !d.lastThroughputTime.IsZero() {
+		elapsed = now.Sub(d.lastThroughputTime)
+	}
+	d.lastThroughputTime = now
+
+	for _, client := range d.getDcpClients() {
+		if client == nil {
+			continue
+		}
+		stats := &ThroughputStats{Name: client.Name}
+		for _, handler := range client.dcpHandlers {
+			if handler == nil {
+				continue
+			}
+			handlerStat := handler.throughputStats(elapsed)
+			stats.add(handlerStat)
+			if !handler.isDone() {
+				handlerStats = append(handlerStats, handlerStat)
+			}
+		}
+		clientStats = append(clientStats, stats)
+	}
+	sort.SliceStable(handlerStats, func(i, j int) bool {
+		return handlerStats[i].MutationsPerSec < handlerStats[j].MutationsPerSec
+	})
+	return clientStats, handlerStats
+}
+
+// Logs the throughput of each client, and of the slowest handlers that have not completed, to tell handlers that
+// hold a run back. Throughput is only known from the second report on, once the clients have started
+func (d *DcpDriver) reportThroughput() {
+	if d.getState() != DriverStateStarted {
+		return
+	}
+	firstReport := d.lastThroughputTime.IsZero()
+	clientStats, handlerStats := d.throughputStats()
+	if firstReport {
+		return
+	}
+
+	var clients []string
+	for _, stats := range clientStats {
+		clients = append(clients, stats.String())
+	}
+	d.logger.Infof("%v dcp clients: %v\n", d.Name, strings.Join(clients, "; "))
+
+	if len(handlerStats) > base.SlowestDcpHandlersToReport {
+		handlerStats = handlerStats[:base.SlowestDcpHandlersToReport]
+	}
+	var handlers []string
+	for _, stats := range handlerStats {
+		handlers = append(handlers, stats.String())
+	}
+	if len(handlers) > 0 {
+		d.logger.Infof("%v slowest dcp handlers: %v\n", d.Name, strings.Join(handlers, "; "))
+	}
+}
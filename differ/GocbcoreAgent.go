@@ -2,18 +2,30 @@ package differ
 
 import (
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/couchbase/gocbcore/v9"
+	"github.com/couchbase/gocbcore/v9/memd"
 	xdcrBase "github.com/couchbase/goxdcr/base"
 	"github.com/couchbase/goxdcr/metadata"
 	"reflect"
 	"time"
 	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
 )
 
 type GocbcoreAgent struct {
 	base.GocbcoreAgentCommon
 	agent *gocbcore.Agent
+	// Throttles the reads issued to the cluster. Nil if unlimited
+	rateLimiter *utils.RateLimiter
+}
+
+// Limits Get, GetMeta and LookupXattrs to opsPerSec, across all the callers of this agent
+// 0 means unlimited
+func (a *GocbcoreAgent) SetRateLimit(opsPerSec int) {
+	a.rateLimiter = utils.NewRateLimiter(opsPerSec)
 }
 
 func (a *GocbcoreAgent) setupAgent(auth interface{}, batchSize int, capability metadata.Capability) error {
@@ -71,6 +83,8 @@ func (a *GocbcoreAgent) setupAgentConfig(authIn interface{}, capability metadata
 		KVConnectTimeout:  a.SetupTimeout,
 		UseTLS:            useTLS,
 		TLSRootCAProvider: x509Provider,
+		AuthMechanisms:    base.GetKVAuthMechanisms(useTLS),
+		NetworkType:       base.GetNetworkType(),
 	}, nil
 }
 
@@ -103,6 +117,7 @@ func (a *GocbcoreAgent) setupGocbcoreAgent(config *gocbcore.AgentConfig) (err er
 }
 
 func (a *GocbcoreAgent) Get(key string, callbackFunc func(result *gocbcore.GetResult, err error), colId uint32) error {
+	a.rateLimiter.Wait()
 	opts := gocbcore.GetOptions{
 		Key:           []byte(key),
 		RetryStrategy: nil,
@@ -113,6 +128,7 @@ func (a *GocbcoreAgent) Get(key string, callbackFunc func(result *gocbcore.GetRe
 }
 
 func (a *GocbcoreAgent) GetMeta(key string, callbackFunc func(result *gocbcore.GetMetaResult, err error), colId uint32) error {
+	a.rateLimiter.Wait()
 	opts := gocbcore.GetMetaOptions{
 		Key:           []byte(key),
 		RetryStrategy: nil,
@@ -122,6 +138,153 @@ func (a *GocbcoreAgent) GetMeta(key string, callbackFunc func(result *gocbcore.G
 	return err
 }
 
+// Looks up the names of the user and system xattrs of the doc, and then their values
+// The names only include the xattrs that the privileges of the user allow reading
+func (a *GocbcoreAgent) LookupXattrs(key string, callbackFunc func(xattrs map[string]json.RawMessage, err error), colId uint32) error {
+	// The lookups of the values are chained from the callbacks and are not throttled on their own
+	a.rateLimiter.Wait()
+	tocOps := []gocbcore.SubDocOp{{
+		Op:    memd.SubDocOpGet,
+		Flags: memd.SubdocFlagXattrPath,
+		Path:  base.XattrTocPath,
+	}}
+	return a.lookupIn(key, tocOps, func(results []gocbcore.SubDocResult, err error) {
+		if err != nil {
+			callbackFunc(nil, err)
+			return
+		}
+		if results[0].Err != nil {
+			callbackFunc(nil, results[0].Err)
+			return
+		}
+		var names []string
+		err = json.Unmarshal(results[0].Value, &names)
+		if err != nil {
+			callbackFunc(nil, fmt.Errorf("unmarshal %v of %v: %v", base.XattrTocPath, key, err))
+			return
+		}
+		a.lookupXattrValues(key, names, make(map[string]json.RawMessage), callbackFunc, colId)
+	}, colId)
+}
+
+// Looks up at most MaxSubdocOps xattrs per request, chaining the requests until all names are done
+func (a *GocbcoreAgent) lookupXattrValues(key string, names []string, xattrs map[string]json.RawMessage, callbackFunc func(xattrs map[string]json.RawMessage, err error), colId uint32) {
+	if len(names) == 0 {
+		callbackFunc(xattrs, nil)
+		return
+	}
+	numOps := len(names)
+	if numOps > base.MaxSubdocOps {
+		numOps = base.MaxSubdocOps
+	}
+	ops := make([]gocbcore.SubDocOp, numOps)
+	for i := 0; i < numOps; i++ {
+		ops[i] = gocbcore.SubDocOp{
+			Op:    memd.SubDocOpGet,
+			Flags: memd.SubdocFlagXattrPath,
+			Path:  names[i],
+		}
+	}
+	err := a.lookupIn(key, ops, func(results []gocbcore.SubDocResult, err error) {
+		if err != nil {
+			callbackFunc(nil, err)
+			return
+		}
+		for i, result := range results {
+			if result.Err != nil {
+				if errors.Is(result.Err, gocbcore.ErrPathNotFound) {
+					// Removed since the names were looked up
+					continue
+				}
+				callbackFunc(nil, result.Err)
+				return
+			}
+			xattrs[names[i]] = result.Value
+		}
+		a.lookupXattrValues(key, names[numOps:], xattrs, callbackFunc, colId)
+	}, colId)
+	if err != nil {
+		callbackFunc(nil, err)
+	}
+}
+
+func (a *GocbcoreAgent) lookupIn(key string, ops []gocbcore.SubDocOp, callbackFunc func(results []gocbcore.SubDocResult, err error), colId uint32) error {
+	opts := gocbcore.LookupInOptions{
+		Key:           []byte(key),
+		Flags:         memd.SubdocDocFlagAccessDeleted,
+		Ops:           ops,
+		RetryStrategy: nil,
+		CollectionID:  colId,
+	}
+	_, err := a.agent.LookupIn(opts, func(result *gocbcore.LookupInResult, err error) {
+		if err != nil {
+			callbackFunc(nil, err)
+			return
+		}
+		callbackFunc(result.Ops, nil)
+	})
+	return err
+}
+
+func (a *GocbcoreAgent) Set(key string, value []byte, callbackFunc func(result *gocbcore.StoreResult, err error), colId uint32) error {
+	opts := gocbcore.SetOptions{
+		Key:           []byte(key),
+		Value:         value,
+		Datatype:      base.JSONDataType,
+		RetryStrategy: nil,
+		CollectionID:  colId,
+	}
+	_, err := a.agent.Set(opts, callbackFunc)
+	return err
+}
+
+// Writes the doc with the given metadata instead of generating new ones, as XDCR does
+func (a *GocbcoreAgent) SetWithMeta(key string, value []byte, datatype uint8, flags, expiry uint32, cas gocbcore.Cas, revNo uint64, callbackFunc func(result *gocbcore.SetMetaResult, err error), colId uint32) error {
+	opts := gocbcore.SetMetaOptions{
+		Key:           []byte(key),
+		Value:         value,
+		Datatype:      datatype,
+		Flags:         flags,
+		Expiry:        expiry,
+		Cas:           cas,
+		RevNo:         revNo,
+		RetryStrategy: nil,
+		CollectionID:  colId,
+	}
+	_, err := a.agent.SetMeta(opts, callbackFunc)
+	return err
+}
+
+// Sets the expiry of the doc, which gives it a new CAS
+func (a *GocbcoreAgent) Touch(key string, expiry uint32, callbackFunc func(result *gocbcore.TouchResult, err error), colId uint32) error {
+	opts := gocbcore.TouchOptions{
+		Key:           []byte(key),
+		Expiry:        expiry,
+		RetryStrategy: nil,
+		CollectionID:  colId,
+	}
+	_, err := a.agent.Touch(opts, callbackFunc)
+	return err
+}
+
+// Same as Set, but addresses the collection by name, the default collection if the names are empty
+func (a *GocbcoreAgent) SetInCollection(key string, value []byte, scopeName, collectionName string, callbackFunc func(result *gocbcore.StoreResult, err error)) error {
+	opts := gocbcore.SetOptions{
+		Key:            []byte(key),
+		Value:          value,
+		Datatype:       base.JSONDataType,
+		RetryStrategy:  nil,
+		ScopeName:      scopeName,
+		CollectionName: collectionName,
+	}
+	_, err := a.agent.Set(opts, callbackFunc)
+	return err
+}
+
+func (a *GocbcoreAgent) Close() error {
+	return a.agent.Close()
+}
+
 func NewGocbcoreAgent(id string, servers []string, bucketName string, auth interface{}, batchSize int, capability metadata.Capability) (*GocbcoreAgent, error) {
 	gocbcoreAgent := &GocbcoreAgent{
 		GocbcoreAgentCommon: base.GocbcoreAgentCommon{
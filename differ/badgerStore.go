@@ -0,0 +1,124 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// kvBackend on top of Badger. Sets and deletes are batched until flushed, since committing them one by one would
+// not keep up with DCP
+type badgerBackend struct {
+	db        *badger.DB
+	batch     *badger.WriteBatch
+	batchLock sync.RWMutex
+}
+
+func openBadgerBackend(dir string) (*badgerBackend, error) {
+	// Badger logs at info level otherwise
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerBackend{
+		db:    db,
+		batch: db.NewWriteBatch(),
+	}, nil
+}
+
+// The write batch is safe to add to concurrently, the lock only keeps it from being swapped out under the callers
+func (b *badgerBackend) set(key, value []byte) error {
+	b.batchLock.RLock()
+	defer b.batchLock.RUnlock()
+	return b.batch.Set(key, value)
+}
+
+func (b *badgerBackend) delete(key []byte) error {
+	b.batchLock.RLock()
+	defer b.batchLock.RUnlock()
+	return b.batch.Delete(key)
+}
+
+func (b *badgerBackend) get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+// A write batch cannot be added to once flushed, so a new one takes its place
+func (b *badgerBackend) flush() error {
+	b.batchLock.Lock()
+	defer b.batchLock.Unlock()
+	err := b.batch.Flush()
+	b.batch = b.db.NewWriteBatch()
+	return err
+}
+
+func (b *badgerBackend) newIterator(prefix []byte, withValues bool) kvIterator {
+	txn := b.db.NewTransaction(false)
+	options := badger.DefaultIteratorOptions
+	options.Prefix = prefix
+	options.PrefetchValues = withValues
+	return &badgerIterator{
+		txn:    txn,
+		iter:   txn.NewIterator(options),
+		prefix: prefix,
+	}
+}
+
+// Whatever was not flushed is dropped
+func (b *badgerBackend) close() error {
+	b.batchLock.Lock()
+	b.batch.Cancel()
+	b.batchLock.Unlock()
+	return b.db.Close()
+}
+
+// Reads from a snapshot of the store taken when the iterator was created
+type badgerIterator struct {
+	txn     *badger.Txn
+	iter    *badger.Iterator
+	prefix  []byte
+	started bool
+}
+
+func (i *badgerIterator) next() bool {
+	if !i.started {
+		i.iter.Seek(i.prefix)
+		i.started = true
+	} else {
+		i.iter.Next()
+	}
+	return i.iter.ValidForPrefix(i.prefix)
+}
+
+func (i *badgerIterator) key() []byte {
+	return i.iter.Item().KeyCopy(nil)
+}
+
+func (i *badgerIterator) value() ([]byte, error) {
+	return i.iter.Item().ValueCopy(nil)
+}
+
+func (i *badgerIterator) close() {
+	i.iter.Close()
+	i.txn.Discard()
+}
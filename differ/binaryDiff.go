@@ -0,0 +1,159 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/couchbase/gocbcore/v9"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Docs without the JSON bit set are opaque bytes to the differ
+func isBinaryDatatype(datatype uint8) bool {
+	return datatype&base.JSONDataType == 0
+}
+
+func isBinaryGetResult(resultRaw interface{}) bool {
+	result, ok := resultRaw.(*gocbcore.GetResult)
+	return ok && result != nil && isBinaryDatatype(result.Datatype)
+}
+
+// Compares bodies byte for byte, which holds for both JSON and binary docs
+// An empty body and a nil body are considered the same
+func areRawBodiesTheSame(body1, body2 []byte) bool {
+	if len(body1) != len(body2) {
+		return false
+	}
+	return bytes.Equal(body1, body2)
+}
+
+// How a mismatched doc differs when either side is binary, which has no fields to point at
+type BinaryDiff struct {
+	SourceSize int
+	TargetSize int
+	// TargetSize - SourceSize
+	SizeDelta int
+	// SHA-256 of each body, in hex
+	SourceHash string
+	TargetHash string
+	// Offset of the first byte that differs, i.e. the size of the shorter body when it is a prefix of the other
+	FirstDiffOffset int
+	// Up to binaryHexDumpLen bytes of each body from FirstDiffOffset on, in hex. Only set when enabled
+	SourceHexDump string `json:",omitempty"`
+	TargetHexDump string `json:",omitempty"`
+}
+
+func firstDiffOffset(body1, body2 []byte) int {
+	i := 0
+	for i < len(body1) && i < len(body2) && body1[i] == body2[i] {
+		i++
+	}
+	return i
+}
+
+// Up to maxLen bytes of body from offset on, in hex, tagged as user data
+func hexDump(body []byte, offset, maxLen int) string {
+	if offset >= len(body) {
+		return ""
+	}
+	end := len(body)
+	if end-offset > maxLen {
+		end = offset + maxLen
+	}
+	return base.TagUD(hex.EncodeToString(body[offset:end]))
+}
+
+func sha256Hex(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns how the bodies of the source and target results differ if either side is binary, or nil otherwise
+// Bodies are hex dumped from where they diverge for up to hexDumpLen bytes, or not at all if it is 0
+func binaryDiff(srcResult, tgtResult *GocbResult, hexDumpLen int) *BinaryDiff {
+	if srcResult == nil || tgtResult == nil || srcResult.GetResult == nil || tgtResult.GetResult == nil {
+		return nil
+	}
+	src := srcResult.GetResult
+	tgt := tgtResult.GetResult
+	if !isBinaryDatatype(src.Datatype) && !isBinaryDatatype(tgt.Datatype) {
+		return nil
+	}
+	diff := &BinaryDiff{
+		SourceSize:      len(src.Value),
+		TargetSize:      len(tgt.Value),
+		SizeDelta:       len(tgt.Value) - len(src.Value),
+		SourceHash:      sha256Hex(src.Value),
+		TargetHash:      sha256Hex(tgt.Value),
+		FirstDiffOffset: firstDiffOffset(src.Value, tgt.Value),
+	}
+	if hexDumpLen > 0 {
+		diff.SourceHexDump = hexDump(src.Value, diff.FirstDiffOffset, hexDumpLen)
+		diff.TargetHexDump = hexDump(tgt.Value, diff.FirstDiffOffset, hexDumpLen)
+	}
+	return diff
+}
+
+// The binary diff of a record, only set for mismatches
+func (d *MutationDiffer) recordBinaryDiff(category string, results []*GocbResult) *BinaryDiff {
+	if category != "Mismatch" || len(results) < 2 {
+		return nil
+	}
+	return binaryDiff(results[0], results[1], d.binaryHexDumpLen)
+}
+
+// For mismatched docs where either side is binary, the sizes, hashes and where the bodies diverge are reported
+func (d *MutationDiffer) compileBinaryDiffs() map[uint32]map[string]*BinaryDiff {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+
+	diffs := make(map[uint32]map[string]*BinaryDiff)
+	for colId, srcDiffPerCol := range d.srcDiff {
+		for key, pair := range srcDiffPerCol {
+			diff := d.recordBinaryDiff("Mismatch", pair)
+			if diff == nil {
+				continue
+			}
+			if _, exists := diffs[colId]; !exists {
+				diffs[colId] = make(map[string]*BinaryDiff)
+			}
+			diffs[colId][key] = diff
+		}
+	}
+	return diffs
+}
+
+func (d *MutationDiffer) writeBinaryDetails() error {
+	if d.compareType == base.MutationCompareTypeMetadata {
+		// Bodies are not fetched
+		return nil
+	}
+
+	diffs := d.compileBinaryDiffs()
+	var count int
+	for _, diffsPerCol := range diffs {
+		count += len(diffsPerCol)
+	}
+	if count > 0 {
+		d.logger.Infof("%v mismatched docs are binary. How they differ is written to %v", count, base.MutationDiffBinaryDetailsFileName)
+	}
+
+	diffsBytes, err := json.Marshal(redactKeys(diffs))
+	if err != nil {
+		return err
+	}
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffBinaryDetailsFileName)
+	return utils.WriteDataFile(d.encryptionKey, fileName, diffsBytes, base.FileModeReadWrite)
+}
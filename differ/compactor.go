@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"xdcrDiffer/base"
+	"xdcrDiffer/objectStore"
+	"xdcrDiffer/utils"
+)
+
+type compactionKey struct {
+	colId uint32
+	key   string
+}
+
+type compactionRecord struct {
+	seqno uint64
+	start int
+	end   int
+}
+
+// Rewrites a data file so that only the newest record (by seqno) of each key is kept
+// Records are kept in the order they were originally written. A compressed or encrypted data file is rewritten as
+// one block compressed the same way, and encrypted with encryptionKey
+// Returns the file sizes before and after compaction
+func CompactDataFile(fileName string, encryptionKey []byte) (int64, int64, error) {
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	decrypted, err := utils.DecryptDataFile(encryptionKey, fileData)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to decrypt %v: %v", fileName, err)
+	}
+	data, compression, err := utils.DecompressDataFile(decrypted)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to decompress %v: %v", fileName, err)
+	}
+
+	// The header is kept as is
+	hashAlgorithm, headerLen, err := base.ParseDataFileHeader(data)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to parse %v: %v", fileName, err)
+	}
+
+	reader := bytes.NewReader(data[headerLen:])
+	newestRecords := make(map[compactionKey]*compactionRecord)
+	var order []compactionKey
+	for reader.Len() > 0 {
+		start := len(data) - reader.Len()
+		entry, err := getOneEntry(reader.Read, base.IsCompactMutationLayout(hashAlgorithm))
+		if err != nil {
+			return 0, 0, fmt.Errorf("Unable to parse %v at offset %v: %v", fileName, start, err)
+		}
+		end := len(data) - reader.Len()
+
+		key := compactionKey{colId: entry.ColId, key: entry.Key}
+		curRecord, exists := newestRecords[key]
+		if !exists {
+			order = append(order, key)
+			newestRecords[key] = &compactionRecord{seqno: entry.Seqno, start: start, end: end}
+		} else if entry.Seqno > curRecord.seqno {
+			// Same rule as when the file differ dedups entries
+			newestRecords[key] = &compactionRecord{seqno: entry.Seqno, start: start, end: end}
+		}
+	}
+
+	if len(order) == 0 {
+		return int64(len(fileData)), int64(len(fileData)), nil
+	}
+
+	compacted := make([]byte, 0, len(data))
+	compacted = append(compacted, data[:headerLen]...)
+	for _, key := range order {
+		record := newestRecords[key]
+		compacted = append(compacted, data[record.start:record.end]...)
+	}
+
+	if len(compacted) == len(data) {
+		// Nothing to compact
+		return int64(len(fileData)), int64(len(fileData)), nil
+	}
+	compacted, err = utils.CompressDataFileBlock(compression, compacted)
+	if err != nil {
+		return 0, 0, err
+	}
+	compacted, err = utils.EncryptDataFile(encryptionKey, compacted)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Write to a temp file first so that an interrupted compaction does not lose data
+	tmpFileName := fileName + base.CompactionTmpFileSuffix
+	err = os.WriteFile(tmpFileName, compacted, base.FileModeReadWrite)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return 0, 0, err
+	}
+	return int64(len(fileData)), int64(len(compacted)), nil
+}
+
+// Compacts all the data files of a data directory. Bins with no data file are skipped
+// Returns the total sizes before and after compaction
+func CompactDataFiles(fileDir string, numberOfBins int, encryptionKey []byte) (int64, int64, error) {
+	if objectStore.IsURI(fileDir) {
+		return 0, 0, fmt.Errorf("data files in object storage %v cannot be compacted in place", fileDir)
+	}
+	var totalBefore int64
+	var totalAfter int64
+	var vbno uint16
+	for vbno = 0; vbno < base.NumberOfVbuckets; vbno++ {
+		for bucketIndex := 0; bucketIndex < numberOfBins; bucketIndex++ {
+			fileName := utils.GetFileName(fileDir, vbno, bucketIndex)
+			if _, err := os.Stat(fileName); os.IsNotExist(err) {
+				continue
+			}
+			before, after, err := CompactDataFile(fileName, encryptionKey)
+			if err != nil {
+				return totalBefore, totalAfter, err
+			}
+			totalBefore += before
+			totalAfter += after
+		}
+	}
+	return totalBefore, totalAfter, nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+type ComparatorVerdict int
+
+const (
+	// Let the built-in comparison for the compare type decide
+	ComparatorVerdictDefer ComparatorVerdict = iota
+	// The docs are equivalent, even if the built-in comparison says otherwise
+	ComparatorVerdictSame ComparatorVerdict = iota
+	// The docs differ, even if the built-in comparison says otherwise
+	ComparatorVerdictDifferent ComparatorVerdict = iota
+)
+
+// A custom comparison for callers embedding the differ, i.e. to ignore some fields or derived data
+// The results are *gocbcore.GetResult for the body compare types, and *gocbcore.GetMetaResult for meta
+// It is only called when the doc exists on both sides and neither is binary, and may be called from multiple go routines at once
+type Comparator func(key string, sourceResult, targetResult interface{}) ComparatorVerdict
+
+// Must be called before Run()
+func (d *MutationDiffer) SetComparator(comparator Comparator) {
+	d.comparator = comparator
+}
+
+func (d *MutationDiffer) areResultsTheSame(key string, builtIn func(a, b interface{}) bool, sourceResult, targetResult interface{}) bool {
+	if d.keyOnly {
+		return true
+	}
+	// Binary docs have no fields to apply custom rules to
+	if d.comparator != nil && !isBinaryGetResult(sourceResult) && !isBinaryGetResult(targetResult) {
+		switch d.comparator(key, sourceResult, targetResult) {
+		case ComparatorVerdictSame:
+			return true
+		case ComparatorVerdictDifferent:
+			return false
+		}
+	}
+	return builtIn(sourceResult, targetResult)
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"sort"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+type ConflictFinding string
+
+const (
+	// The source revision wins under the conflict resolution type, so the target should have been overwritten
+	FindingTargetHoldsStaleLosingRevision ConflictFinding = "TargetHoldsStaleLosingRevision"
+	// The target revision wins, i.e. it was written on the target after the source revision
+	FindingSourceHoldsStaleLosingRevision ConflictFinding = "SourceHoldsStaleLosingRevision"
+	// Custom conflict resolution, a tie, or not enough metadata to tell
+	FindingUndetermined ConflictFinding = "Undetermined"
+)
+
+var ConflictFindingOrder = []ConflictFinding{FindingTargetHoldsStaleLosingRevision, FindingSourceHoldsStaleLosingRevision, FindingUndetermined}
+
+type ConflictResolutionEntry struct {
+	Category string
+	ColId    uint32
+	Key      string
+	// When each side's revision was written, as decoded from its CAS, to tell how stale the losing one is
+	SourceCasTime string `json:",omitempty"`
+	TargetCasTime string `json:",omitempty"`
+}
+
+type ConflictResolutionReport struct {
+	ConflictResolutionType string
+	Summary                map[ConflictFinding]int
+	Details                map[ConflictFinding][]*ConflictResolutionEntry
+}
+
+func NewConflictResolutionReport(crType string) *ConflictResolutionReport {
+	report := &ConflictResolutionReport{
+		ConflictResolutionType: crType,
+		Summary:                make(map[ConflictFinding]int),
+		Details:                make(map[ConflictFinding][]*ConflictResolutionEntry),
+	}
+	for _, finding := range ConflictFindingOrder {
+		report.Summary[finding] = 0
+		report.Details[finding] = []*ConflictResolutionEntry{}
+	}
+	return report
+}
+
+func (r *ConflictResolutionReport) add(finding ConflictFinding, category string, colId uint32, key string, results []*GocbResult) {
+	r.Summary[finding]++
+	entry := &ConflictResolutionEntry{
+		Category: category,
+		ColId:    colId,
+		Key:      base.TagKey(key),
+	}
+	if len(results) >= 2 {
+		entry.SourceCasTime = results[0].casTimestamp()
+		entry.TargetCasTime = results[1].casTimestamp()
+	}
+	r.Details[finding] = append(r.Details[finding], entry)
+}
+
+func (r *ConflictResolutionReport) sort() {
+	for _, entries := range r.Details {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Category != entries[j].Category {
+				return entries[i].Category < entries[j].Category
+			}
+			if entries[i].ColId != entries[j].ColId {
+				return entries[i].ColId < entries[j].ColId
+			}
+			return entries[i].Key < entries[j].Key
+		})
+	}
+}
+
+// Returns 1 if a is greater, -1 if b is greater, and 0 if they are equal
+func compareUint64(a, b uint64) int {
+	if a > b {
+		return 1
+	} else if a < b {
+		return -1
+	}
+	return 0
+}
+
+// Returns > 0 if the source revision wins, < 0 if the target revision wins, and 0 if it cannot be told
+// Follows the order of metadata KV uses: revId first for seqno, CAS first for lww, then expiry and flags
+func compareRevisions(crType string, srcResult, tgtResult *GocbResult) int {
+	if srcResult == nil || tgtResult == nil {
+		return 0
+	}
+
+	var order [][2]uint64
+	if srcResult.GetMetaResult != nil && tgtResult.GetMetaResult != nil {
+		src := srcResult.GetMetaResult
+		tgt := tgtResult.GetMetaResult
+		revId := [2]uint64{src.SeqNo, tgt.SeqNo}
+		cas := [2]uint64{uint64(src.Cas), uint64(tgt.Cas)}
+		switch crType {
+		case xdcrBase.ConflictResolutionType_Seqno:
+			order = append(order, revId, cas)
+		case xdcrBase.ConflictResolutionType_Lww:
+			order = append(order, cas, revId)
+		default:
+			return 0
+		}
+		order = append(order, [2]uint64{uint64(src.Expiry), uint64(tgt.Expiry)}, [2]uint64{uint64(src.Flags), uint64(tgt.Flags)})
+	} else if srcResult.GetResult != nil && tgtResult.GetResult != nil {
+		// Without the revId, only lww can be told apart
+		if crType != xdcrBase.ConflictResolutionType_Lww {
+			return 0
+		}
+		src := srcResult.GetResult
+		tgt := tgtResult.GetResult
+		order = append(order, [2]uint64{uint64(src.Cas), uint64(tgt.Cas)}, [2]uint64{uint64(src.Flags), uint64(tgt.Flags)})
+	} else {
+		return 0
+	}
+
+	for _, pair := range order {
+		if result := compareUint64(pair[0], pair[1]); result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func conflictFinding(crType string, srcResult, tgtResult *GocbResult) ConflictFinding {
+	result := compareRevisions(crType, srcResult, tgtResult)
+	if result > 0 {
+		return FindingTargetHoldsStaleLosingRevision
+	} else if result < 0 {
+		return FindingSourceHoldsStaleLosingRevision
+	}
+	return FindingUndetermined
+}
+
+// XDCR requires both buckets to have the same conflict resolution type. If they do not, nothing can be told
+func (d *MutationDiffer) conflictResolutionType() string {
+	if d.srcConflictResolutionType != d.tgtConflictResolutionType {
+		d.logger.Warnf("Source bucket conflict resolution type %v differs from target bucket conflict resolution type %v",
+			d.srcConflictResolutionType, d.tgtConflictResolutionType)
+	}
+	return d.commonConflictResolutionType()
+}
+
+// Same as conflictResolutionType, without the warning, for the writers that run after the report
+func (d *MutationDiffer) commonConflictResolutionType() string {
+	if d.srcConflictResolutionType != d.tgtConflictResolutionType {
+		return ""
+	}
+	return d.srcConflictResolutionType
+}
+
+// Only the categories of docs that exist on both sides, or were deleted on one of them, have revisions to resolve
+func hasConflictFinding(category string) bool {
+	switch category {
+	case "Mismatch", "DeletedFromSource", "DeletedFromTarget", "TombstoneMismatch":
+		return true
+	}
+	return false
+}
+
+// The finding of one difference, as set on its DiffRecord. Empty for the categories that have none
+func recordConflictFinding(crType string, category string, results []*GocbResult) ConflictFinding {
+	if !hasConflictFinding(category) {
+		return ""
+	}
+	var srcResult, tgtResult *GocbResult
+	if len(results) >= 2 {
+		srcResult, tgtResult = results[0], results[1]
+	}
+	return conflictFinding(crType, srcResult, tgtResult)
+}
+
+// For each doc that exists on both sides but differs, states which side should win under the conflict resolution type
+func (d *MutationDiffer) compileConflictResolutionReport() *ConflictResolutionReport {
+	crType := d.conflictResolutionType()
+	report := NewConflictResolutionReport(crType)
+	d.forEachDiff(func(category string, colId uint32, key string, severity Severity, results []*GocbResult) {
+		if !hasConflictFinding(category) {
+			return
+		}
+		report.add(recordConflictFinding(crType, category, results), category, colId, key, results)
+	})
+	report.sort()
+	return report
+}
+
+func (d *MutationDiffer) writeConflictResolutionReport() error {
+	report := d.compileConflictResolutionReport()
+	d.logger.Infof("Differences by conflict resolution (%v): TargetHoldsStaleLosingRevision=%v SourceHoldsStaleLosingRevision=%v Undetermined=%v",
+		report.ConflictResolutionType, report.Summary[FindingTargetHoldsStaleLosingRevision],
+		report.Summary[FindingSourceHoldsStaleLosingRevision], report.Summary[FindingUndetermined])
+
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffConflictResolutionFileName)
+	return utils.WriteDataFile(d.encryptionKey, fileName, reportBytes, base.FileModeReadWrite)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// The diff keys of both sides whose keys hash to the same partition. A key of either side only needs to be combined
+// with the keys of the other side in the same partition
+type diffKeysPartition struct {
+	streamSource func(fn func(colId uint32, key string) error) error
+	streamTarget func(fn func(colId uint32, key string) error) error
+}
+
+// Splits the diff keys by key hash into enough partitions under dir for the target keys of each to take about
+// partitionBytes. If the target diff keys files take less than that already, there is a single partition, which
+// streams the files themselves
+func (d *MutationDiffer) partitionDiffKeys(srcDiffKeysFiles, tgtDiffKeysFiles []string, dir string, partitionBytes int64) ([]*diffKeysPartition, error) {
+	var tgtSize int64
+	for _, fileName := range tgtDiffKeysFiles {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		tgtSize += info.Size()
+	}
+	numPartitions := int(tgtSize/partitionBytes) + 1
+	if numPartitions == 1 {
+		return []*diffKeysPartition{{
+			streamSource: func(fn func(colId uint32, key string) error) error {
+				return streamDiffKeysFiles(d.encryptionKey, srcDiffKeysFiles, fn)
+			},
+			streamTarget: func(fn func(colId uint32, key string) error) error {
+				return streamDiffKeysFiles(d.encryptionKey, tgtDiffKeysFiles, fn)
+			},
+		}}, nil
+	}
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	srcPartitionFiles, err := d.writeDiffKeysPartitions(srcDiffKeysFiles, dir, base.SourceClusterName, numPartitions)
+	if err != nil {
+		return nil, err
+	}
+	tgtPartitionFiles, err := d.writeDiffKeysPartitions(tgtDiffKeysFiles, dir, base.TargetClusterName, numPartitions)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]*diffKeysPartition, numPartitions)
+	for i := range partitions {
+		srcPartitionFile, tgtPartitionFile := srcPartitionFiles[i], tgtPartitionFiles[i]
+		partitions[i] = &diffKeysPartition{
+			streamSource: func(fn func(colId uint32, key string) error) error {
+				return streamDiffKeysPartitionFile(d.encryptionKey, srcPartitionFile, fn)
+			},
+			streamTarget: func(fn func(colId uint32, key string) error) error {
+				return streamDiffKeysPartitionFile(d.encryptionKey, tgtPartitionFile, fn)
+			},
+		}
+	}
+	return partitions, nil
+}
+
+func streamDiffKeysFiles(encryptionKey []byte, fileNames []string, fn func(colId uint32, key string) error) error {
+	for _, fileName := range fileNames {
+		err := streamDiffKeysFile(encryptionKey, fileName, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the names of the partition files, in partition order
+// A partition file holds the collection ID, the key length and the key of each key, encrypted like the diff keys files
+func (d *MutationDiffer) writeDiffKeysPartitions(diffKeysFiles []string, dir, side string, numPartitions int) ([]string, error) {
+	fileNames := make([]string, numPartitions)
+	files := make([]*os.File, numPartitions)
+	encrypters := make([]io.WriteCloser, numPartitions)
+	writers := make([]*bufio.Writer, numPartitions)
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+	}()
+	for i := range files {
+		fileNames[i] = utils.JoinPath(dir, fmt.Sprintf("%v%v%v", side, base.FileNameDelimiter, i))
+		file, err := os.OpenFile(fileNames[i], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = file
+		encrypters[i] = utils.NewDataFileEncrypter(d.encryptionKey, file)
+		writers[i] = bufio.NewWriter(encrypters[i])
+	}
+
+	header := make([]byte, 8)
+	err := streamDiffKeysFiles(d.encryptionKey, diffKeysFiles, func(colId uint32, key string) error {
+		writer := writers[crc32.ChecksumIEEE([]byte(key))%uint32(numPartitions)]
+		binary.BigEndian.PutUint32(header[0:4], colId)
+		binary.BigEndian.PutUint32(header[4:8], uint32(len(key)))
+		if _, err := writer.Write(header); err != nil {
+			return err
+		}
+		_, err := writer.WriteString(key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, writer := range writers {
+		if err = writer.Flush(); err != nil {
+			return nil, err
+		}
+		if err = encrypters[i].Close(); err != nil {
+			return nil, err
+		}
+		if err = files[i].Close(); err != nil {
+			return nil, err
+		}
+		files[i] = nil
+	}
+	return fileNames, nil
+}
+
+func streamDiffKeysPartitionFile(encryptionKey []byte, fileName string, fn func(colId uint32, key string) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dataReader, err := utils.NewDataFileReader(encryptionKey, file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fileName, err)
+	}
+	reader := bufio.NewReader(dataReader)
+
+	header := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		key := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+		if _, err = io.ReadFull(reader, key); err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		if err = fn(binary.BigEndian.Uint32(header[0:4]), string(key)); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends the fetch entries of the partition, deduplicated the way dedupFetchLists does. Only the target keys of the
+// partition are loaded, and the source ones are combined with them one at a time
+func (d *MutationDiffer) sendPartitionFetchEntries(partition *diffKeysPartition, sendEntry func(entry *MutationDifferFetchEntry)) error {
+	tgtDiffKeys := make(DiffKeysMap)
+	err := partition.streamTarget(func(colId uint32, key string) error {
+		tgtDiffKeys[colId] = append(tgtDiffKeys[colId], key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
+
+	// The target entries are only checked against source entries of the same key, so only those are indexed
+	combinedFetchIdx := make(MutationDiffFetchListIdx)
+	err = partition.streamSource(func(colId uint32, key string) error {
+		srcFetchEntry := newFetchEntry(colId, key, d.colIdsMap, d.migrationHintMap)
+		if srcFetchEntry == nil {
+			// Shouldn't happen
+			return nil
+		}
+		combinedEntry := combineWithTargetEntries(srcFetchEntry, tgtPovFetchIdx)
+		if _, exists := tgtPovFetchIdx[key]; exists {
+			combinedFetchIdx.AddEntry(combinedEntry)
+		}
+		sendEntry(combinedEntry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	addUncoveredTargetEntries(tgtPovFetchList, combinedFetchIdx, sendEntry)
+	return nil
+}
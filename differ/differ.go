@@ -10,6 +10,7 @@
 package differ
 
 import (
+	"bytes"
 	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
@@ -21,7 +22,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"xdcrDiffer/base"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/objectStore"
 	"xdcrDiffer/utils"
 )
 
@@ -50,6 +53,8 @@ type FilesDiffer struct {
 
 	file1ItemCount int
 	file2ItemCount int
+	// Keys found on both sides and matching
+	matchedCount int
 
 	// For 1->N,  it is possible for doc is mapped to multiple filter IDs
 	duplicatedHintMap DuplicatedHintMap
@@ -82,7 +87,7 @@ func (d DuplicatedHintMap) ToIntMap() map[string][]int {
 		for _, j := range v {
 			intSlice = append(intSlice, int(j))
 		}
-		outputMap[k] = intSlice
+		outputMap[base.EncodeKey(k)] = intSlice
 	}
 	return outputMap
 }
@@ -93,13 +98,32 @@ type FileAttributes struct {
 	sortedEntries map[uint32][]*oneEntry
 	readOp        fdp.FileOp
 	closeOp       func() error
+
+	// Files larger than memoryBudget are sorted externally under tmpDir instead of being loaded
+	// into entries. 0 means no limit
+	memoryBudget   int64
+	tmpDir         string
+	sortDir        string
+	sortedColFiles map[uint32]string
+
+	// Set when the entries are read from the records of vbno in a store instead of from a file
+	store *KVStore
+	vbno  uint16
+
+	// Number of deduped entries loaded
+	itemCount int
+	// Algorithm the body hashes in the file were computed with
+	hashAlgorithm string
+	// Key the file, and the sorted runs written from it, are encrypted with
+	encryptionKey []byte
 }
 
 func NewFileAttribute(fileName string) *FileAttributes {
 	attr := &FileAttributes{
-		name:          fileName,
-		entries:       make(map[uint32]map[string]*oneEntry),
-		sortedEntries: make(map[uint32][]*oneEntry),
+		name:           fileName,
+		entries:        make(map[uint32]map[string]*oneEntry),
+		sortedEntries:  make(map[uint32][]*oneEntry),
+		sortedColFiles: make(map[uint32]string),
 	}
 	return attr
 }
@@ -121,7 +145,16 @@ type oneEntry struct {
 
 func (oneEntry *oneEntry) String() string {
 	return fmt.Sprintf("<Key>: %v <Seqno>: %v <RevId>: %v <Cas>: %v <Flags>: %v <Expiry>: %v <OpCode>: %v <DataType>: %v <Hash>: %s <colId>: %v",
-		oneEntry.Key, oneEntry.Seqno, oneEntry.RevId, oneEntry.Cas, oneEntry.Flags, oneEntry.Expiry, oneEntry.OpCode, oneEntry.Datatype, hex.EncodeToString(oneEntry.BodyHash[:]), oneEntry.ColId)
+		base.EncodeKey(oneEntry.Key), oneEntry.Seqno, oneEntry.RevId, oneEntry.Cas, oneEntry.Flags, oneEntry.Expiry, oneEntry.OpCode, oneEntry.Datatype, hex.EncodeToString(oneEntry.BodyHash[:]), oneEntry.ColId)
+}
+
+// The key is written encoded by base.EncodeKey, like the diff keys
+func (oneEntry *oneEntry) MarshalJSON() ([]byte, error) {
+	type plainEntry oneEntry
+	return json.Marshal(&struct {
+		Key string
+		*plainEntry
+	}{base.EncodeKey(oneEntry.Key), (*plainEntry)(oneEntry)})
 }
 
 type entryPair [2]*oneEntry
@@ -214,25 +247,47 @@ func NewFilesDifferWithFDPool(file1, file2 string, fdPool *fdp.FdPool, collectio
 	differ := NewFilesDiffer(file1, file2, collectionMapping, colFilterStrings, colFilterTgtIds)
 	if fdPool != nil {
 		differ.fdPool = fdPool
-		differ.file1.readOp, err = fdPool.RegisterReadOnlyFileHandle(file1)
-		if err != nil {
-			return nil, err
-		}
-		differ.file1.closeOp = func() error {
-			return fdPool.DeRegisterFileHandle(file1)
-		}
-		differ.file2.readOp, err = fdPool.RegisterReadOnlyFileHandle(file2)
-		if err != nil {
-			return nil, err
+		// Objects are read over HTTP and hold no file descriptor open
+		if !objectStore.IsURI(file1) {
+			differ.file1.readOp, err = fdPool.RegisterReadOnlyFileHandle(file1)
+			if err != nil {
+				return nil, err
+			}
+			differ.file1.closeOp = func() error {
+				return fdPool.DeRegisterFileHandle(file1)
+			}
 		}
-		differ.file2.closeOp = func() error {
-			return fdPool.DeRegisterFileHandle(file2)
+		if !objectStore.IsURI(file2) {
+			differ.file2.readOp, err = fdPool.RegisterReadOnlyFileHandle(file2)
+			if err != nil {
+				return nil, err
+			}
+			differ.file2.closeOp = func() error {
+				return fdPool.DeRegisterFileHandle(file2)
+			}
 		}
 	}
 	return differ, nil
 }
 
-func getOneEntry(readOp fdp.FileOp) (*oneEntry, error) {
+// Caps the memory used to load each of the two files. Larger files are sorted externally in tmpDir
+// and streamed through the diff
+func (differ *FilesDiffer) SetMemoryBudget(budget int64, tmpDir string) {
+	differ.file1.memoryBudget = budget
+	differ.file1.tmpDir = tmpDir
+	differ.file2.memoryBudget = budget
+	differ.file2.tmpDir = tmpDir
+}
+
+// Key the data files were encrypted with, nil if they are in plaintext
+func (differ *FilesDiffer) SetEncryptionKey(key []byte) {
+	differ.file1.encryptionKey = key
+	differ.file2.encryptionKey = key
+}
+
+// Reads an entry in the layout data files of the given hash algorithm are written in. The compact layout leaves
+// the metadata and the body hash of the entry zeroed
+func getOneEntry(readOp fdp.FileOp, compact bool) (*oneEntry, error) {
 	entry := &oneEntry{}
 
 	keyLenBytes := make([]byte, 2)
@@ -256,33 +311,35 @@ func getOneEntry(readOp fdp.FileOp) (*oneEntry, error) {
 	}
 	entry.Seqno = binary.BigEndian.Uint64(seqnoBytes)
 
-	revIdBytes := make([]byte, 8)
-	bytesRead, err = readOp(revIdBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read revIdBytes, bytes read: %v, err: %v", bytesRead, err)
-	}
-	entry.RevId = binary.BigEndian.Uint64(revIdBytes)
+	if !compact {
+		revIdBytes := make([]byte, 8)
+		bytesRead, err = readOp(revIdBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read revIdBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		entry.RevId = binary.BigEndian.Uint64(revIdBytes)
 
-	casBytes := make([]byte, 8)
-	bytesRead, err = readOp(casBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read casBytes, bytes read: %v, err: %v", bytesRead, err)
-	}
-	entry.Cas = binary.BigEndian.Uint64(casBytes)
+		casBytes := make([]byte, 8)
+		bytesRead, err = readOp(casBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read casBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		entry.Cas = binary.BigEndian.Uint64(casBytes)
 
-	flagBytes := make([]byte, 4)
-	bytesRead, err = readOp(flagBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read flagsBytes, bytes read: %v, err: %v", bytesRead, err)
-	}
-	entry.Flags = binary.BigEndian.Uint32(flagBytes)
+		flagBytes := make([]byte, 4)
+		bytesRead, err = readOp(flagBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read flagsBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		entry.Flags = binary.BigEndian.Uint32(flagBytes)
 
-	expiryBytes := make([]byte, 4)
-	bytesRead, err = readOp(expiryBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read expiryBytes, bytes read: %v, err: %v", bytesRead, err)
+		expiryBytes := make([]byte, 4)
+		bytesRead, err = readOp(expiryBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read expiryBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		entry.Expiry = binary.BigEndian.Uint32(expiryBytes)
 	}
-	entry.Expiry = binary.BigEndian.Uint32(expiryBytes)
 
 	opCodeBytes := make([]byte, 2)
 	bytesRead, err = readOp(opCodeBytes)
@@ -291,19 +348,21 @@ func getOneEntry(readOp fdp.FileOp) (*oneEntry, error) {
 	}
 	entry.OpCode = gomemcached.CommandCode(binary.BigEndian.Uint16(opCodeBytes))
 
-	dataTypeBytes := make([]byte, 2)
-	bytesRead, err = readOp(dataTypeBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read dataTypeBytes, bytes read: %v, err: %v", bytesRead, err)
-	}
-	entry.Datatype = uint8(binary.BigEndian.Uint16(dataTypeBytes))
+	if !compact {
+		dataTypeBytes := make([]byte, 2)
+		bytesRead, err = readOp(dataTypeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read dataTypeBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		entry.Datatype = uint8(binary.BigEndian.Uint16(dataTypeBytes))
 
-	hashBytes := make([]byte, sha512.Size)
-	bytesRead, err = readOp(hashBytes)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read hashBytes, bytes read: %v, err: %v", bytesRead, err)
+		hashBytes := make([]byte, sha512.Size)
+		bytesRead, err = readOp(hashBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read hashBytes, bytes read: %v, err: %v", bytesRead, err)
+		}
+		copy(entry.BodyHash[:], hashBytes)
 	}
-	copy(entry.BodyHash[:], hashBytes)
 
 	collectionIdBytes := make([]byte, 4)
 	bytesRead, err = readOp(collectionIdBytes)
@@ -341,7 +400,7 @@ func (attr *FileAttributes) fillAndDedupEntries() error {
 	var entry *oneEntry
 
 	for {
-		entry, err = getOneEntry(attr.readOp)
+		entry, err = getOneEntry(attr.readOp, base.IsCompactMutationLayout(attr.hashAlgorithm))
 		if err != nil {
 			break
 		}
@@ -381,8 +440,26 @@ func (attr *FileAttributes) LoadFileIntoBuffer() error {
 	if len(attr.name) == 0 {
 		return fmt.Errorf("No file specified")
 	}
+	if attr.store != nil {
+		// Already deduped and sorted by the store, so only the count is needed
+		attr.hashAlgorithm = attr.store.hashAlgorithm
+		attr.itemCount = attr.store.countVb(attr.vbno)
+		return nil
+	}
+	var size int64 = -1
 	if attr.readOp != nil && attr.closeOp != nil {
 		defer attr.closeOp()
+	} else if objectStore.IsURI(attr.name) {
+		reader, err := objectStore.Open(attr.name)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		size = reader.Size()
+		// Reads the whole entry field even when it spans two ranged GETs
+		attr.readOp = func(p []byte) (int, error) {
+			return io.ReadFull(reader, p)
+		}
 	} else {
 		file, err := os.Open(attr.name)
 		defer file.Close()
@@ -391,14 +468,145 @@ func (attr *FileAttributes) LoadFileIntoBuffer() error {
 		}
 		attr.readOp = file.Read
 	}
-	err := attr.fillAndDedupEntries()
+	err := attr.decryptIfNeeded()
+	if err != nil {
+		return err
+	}
+	err = attr.decompressIfNeeded()
+	if err != nil {
+		return err
+	}
+	err = attr.readHeader()
+	if err != nil {
+		return err
+	}
+	if attr.memoryBudget > 0 {
+		if size < 0 {
+			if info, err := os.Stat(attr.name); err == nil {
+				size = info.Size()
+			}
+		}
+		if size > attr.memoryBudget {
+			return attr.sortExternally()
+		}
+	}
+	err = attr.fillAndDedupEntries()
 	if err != nil {
 		return err
 	}
 	attr.sortEntries()
+	for _, entriesOfThisCollection := range attr.entries {
+		attr.itemCount += len(entriesOfThisCollection)
+	}
 	return nil
 }
 
+// Encrypted data files are told apart by their first bytes, which are handed back to the reads otherwise
+// They are decrypted before they are decompressed
+func (attr *FileAttributes) decryptIfNeeded() error {
+	prefix := make([]byte, utils.DataFileEncryptionMagicLen)
+	bytesRead, err := io.ReadFull(fileOpReader(attr.readOp), prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	prefix = prefix[:bytesRead]
+	if !utils.IsDataFileEncrypted(prefix) {
+		attr.readOp = prependReadOp(prefix, attr.readOp)
+		return nil
+	}
+	reader, err := utils.NewDataFileDecrypter(attr.encryptionKey, io.MultiReader(bytes.NewReader(prefix), fileOpReader(attr.readOp)))
+	if err != nil {
+		return fmt.Errorf("%v: %v", attr.name, err)
+	}
+	// Decrypted reads come back one block at a time
+	attr.readOp = func(p []byte) (int, error) {
+		return io.ReadFull(reader, p)
+	}
+	return nil
+}
+
+// Compressed data files are told apart by their first bytes, which are handed back to the reads otherwise
+// The size compared against the memory budget remains that of the file on disk
+func (attr *FileAttributes) decompressIfNeeded() error {
+	prefix := make([]byte, utils.DataFileCompressionMagicLen)
+	bytesRead, err := io.ReadFull(fileOpReader(attr.readOp), prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	prefix = prefix[:bytesRead]
+	compression := utils.DetectDataFileCompression(prefix)
+	if compression == base.DataFileCompressionNone {
+		attr.readOp = prependReadOp(prefix, attr.readOp)
+		return nil
+	}
+	reader, err := utils.NewDataFileDecompressor(compression, io.MultiReader(bytes.NewReader(prefix), fileOpReader(attr.readOp)))
+	if err != nil {
+		return fmt.Errorf("%v: %v", attr.name, err)
+	}
+	// Decompressed reads may come back short of what is asked for
+	attr.readOp = func(p []byte) (int, error) {
+		return io.ReadFull(reader, p)
+	}
+	return nil
+}
+
+// Lets a read op be used as an io.Reader
+type fileOpReader fdp.FileOp
+
+func (op fileOpReader) Read(p []byte) (int, error) {
+	return op(p)
+}
+
+// Reads the data file header. Files written before the header existed start with their first entry,
+// which is handed back to the entry reads
+func (attr *FileAttributes) readHeader() error {
+	header := make([]byte, base.DataFileHeaderLen)
+	markerBytes := header[:base.KeyLenVariable]
+	bytesRead, err := attr.readOp(markerBytes)
+	if err != nil {
+		if strings.Contains(err.Error(), io.EOF.Error()) {
+			// Empty file
+			return nil
+		}
+		return err
+	}
+	if bytesRead < len(markerBytes) {
+		return fmt.Errorf("Unable to read data file header of %v, bytes read: %v", attr.name, bytesRead)
+	}
+
+	if binary.BigEndian.Uint16(markerBytes) != base.DataFileHeaderMarker {
+		attr.hashAlgorithm = base.HashAlgorithmSha512
+		attr.readOp = prependReadOp(markerBytes, attr.readOp)
+		return nil
+	}
+
+	bytesRead, err = attr.readOp(header[base.KeyLenVariable:])
+	if err != nil || bytesRead < len(header)-base.KeyLenVariable {
+		return fmt.Errorf("Unable to read data file header of %v, bytes read: %v, err: %v", attr.name, bytesRead, err)
+	}
+	attr.hashAlgorithm, _, err = base.ParseDataFileHeader(header)
+	if err != nil {
+		return fmt.Errorf("%v: %v", attr.name, err)
+	}
+	return nil
+}
+
+// Returns a read op that returns the given bytes before reading on
+func prependReadOp(prefix []byte, readOp fdp.FileOp) fdp.FileOp {
+	return func(p []byte) (int, error) {
+		if len(prefix) == 0 {
+			return readOp(p)
+		}
+		bytesCopied := copy(p, prefix)
+		prefix = prefix[bytesCopied:]
+		if bytesCopied == len(p) {
+			return bytesCopied, nil
+		}
+		bytesRead, err := readOp(p[bytesCopied:])
+		return bytesCopied + bytesRead, err
+	}
+}
+
 func (differ *FilesDiffer) asyncLoad(attr *FileAttributes, err *error) {
 	defer differ.dataLoadWg.Done()
 	*err = attr.LoadFileIntoBuffer()
@@ -410,7 +618,7 @@ func (differ *FilesDiffer) asyncLoad(attr *FileAttributes, err *error) {
 // 1. map of [sourceColId] -> [key]
 // 2. map of [targetColId] -> [key]
 // 3. map of [sourceDocId] -> Maps to which target collection IDs (migration mode only)
-func (differ *FilesDiffer) diffSorted() (map[uint32][]string, map[uint32][]string, map[string][]uint32) {
+func (differ *FilesDiffer) diffSorted() (map[uint32][]string, map[uint32][]string, map[string][]uint32, error) {
 	srcDiffMap := make(map[uint32][]string)
 	tgtDiffMap := make(map[uint32][]string)
 
@@ -423,89 +631,99 @@ func (differ *FilesDiffer) diffSorted() (map[uint32][]string, map[uint32][]strin
 	for srcColId, tgtColIds := range differ.collectionIdMapping {
 		srcDedupMap := make(map[string]bool)
 		for _, tgtColId := range tgtColIds {
-			diffKeys := make([]string, 0)
-			file1Len := len(differ.file1.sortedEntries[srcColId])
-			file2Len := len(differ.file2.sortedEntries[tgtColId])
-
-			if file1Len == 0 && file2Len == 0 && !colMigrationMode {
-				//return srcDiffKeys
-				continue
+			iter1, err := differ.file1.iterator(srcColId)
+			if err != nil {
+				return srcDiffMap, tgtDiffMap, migrationHintMap, err
 			}
-
-			var i int
-			var j int
-
-			for i < file1Len && j < file2Len {
-				item1 := differ.file1.sortedEntries[srcColId][i]
-				item2 := differ.file2.sortedEntries[tgtColId][j]
-				differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
-
-				keyCompare, match := item1.Diff(*item2)
-				validComparison := !colMigrationMode || item1.MapsToTargetCol(item2.ColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation() && item2.IsMutation()
-				if match {
-					// Both items are the same
-					i++
-					j++
-				} else {
-					if keyCompare == 0 {
-						// Both document are the same, but others mismatched
-						if validComparison {
-							var onePair entryPair
-							onePair[0] = item1
-							onePair[1] = item2
-							differ.BothExistButMismatch = append(differ.BothExistButMismatch, &onePair)
-							diffKeys = append(diffKeys, item1.Key)
-							addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
-							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
-						}
-						i++
-						j++
-					} else if keyCompare < 0 {
-						// Like "a" < "b", where a is 1 and b is 2
-						if validComparison {
-							differ.MissingFromFile2 = append(differ.MissingFromFile2, item1)
-							diffKeys = append(diffKeys, item1.Key)
-							addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
-							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
-						}
-						i++
-					} else {
-						// "b" > "a", leading to keyCompare > 0
-						if validComparison {
-							differ.MissingFromFile1 = append(differ.MissingFromFile1, item2)
-							diffKeys = append(diffKeys, item2.Key)
-							addToSrcDiffMapIfNotAdded(srcDedupMap, item2.Key, srcDiffMap, srcColId)
-							tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item2.Key)
-						}
-						j++
-					}
-				}
+			iter2, err := differ.file2.iterator(tgtColId)
+			if err != nil {
+				iter1.close()
+				return srcDiffMap, tgtDiffMap, migrationHintMap, err
+			}
+			err = differ.diffCollectionPair(srcColId, tgtColId, iter1, iter2, colMigrationMode, srcDedupMap, srcDiffMap, tgtDiffMap, migrationHintMap)
+			iter1.close()
+			iter2.close()
+			if err != nil {
+				return srcDiffMap, tgtDiffMap, migrationHintMap, err
 			}
+		}
+	}
+	return srcDiffMap, tgtDiffMap, migrationHintMap, nil
+}
 
-			for ; i < file1Len; i++ {
-				// This means that all the rest of the entries in file1 are missing from file2
-				item1 := differ.file1.sortedEntries[srcColId][i]
-				differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
-				validComparison := !colMigrationMode || item1.MapsToTargetCol(tgtColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation()
+// Merge-joins the key ordered entries of a source collection and one of its target collections
+func (differ *FilesDiffer) diffCollectionPair(srcColId, tgtColId uint32, iter1, iter2 entryIterator, colMigrationMode bool,
+	srcDedupMap map[string]bool, srcDiffMap, tgtDiffMap map[uint32][]string, migrationHintMap map[string][]uint32) error {
+	item1 := iter1.next()
+	item2 := iter2.next()
+
+	for item1 != nil && item2 != nil {
+		differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
+
+		keyCompare, match := item1.Diff(*item2)
+		validComparison := !colMigrationMode || item1.MapsToTargetCol(item2.ColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation() && item2.IsMutation()
+		if match {
+			// Both items are the same
+			differ.matchedCount++
+			item1 = iter1.next()
+			item2 = iter2.next()
+		} else {
+			if keyCompare == 0 {
+				// Both document are the same, but others mismatched
+				if validComparison {
+					var onePair entryPair
+					onePair[0] = item1
+					onePair[1] = item2
+					differ.BothExistButMismatch = append(differ.BothExistButMismatch, &onePair)
+					addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
+					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
+				}
+				item1 = iter1.next()
+				item2 = iter2.next()
+			} else if keyCompare < 0 {
+				// Like "a" < "b", where a is 1 and b is 2
 				if validComparison {
 					differ.MissingFromFile2 = append(differ.MissingFromFile2, item1)
 					addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
+					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item1.Key)
 				}
-			}
-
-			// iterative migration means that it is possible target has more docs than the source as customers
-			// do migration with a set of rules, and then do another set of migration with another set of rules, etc
-			// Do not check the rest if it is migration mode
-			if !colMigrationMode {
-				for ; j < file2Len; j++ {
-					// This means that all the rest of the entries in file2 are missing from file1
-					differ.MissingFromFile1 = append(differ.MissingFromFile1, differ.file2.sortedEntries[tgtColId][j])
-					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], differ.file2.sortedEntries[tgtColId][j].Key)
+				item1 = iter1.next()
+			} else {
+				// "b" > "a", leading to keyCompare > 0
+				if validComparison {
+					differ.MissingFromFile1 = append(differ.MissingFromFile1, item2)
+					addToSrcDiffMapIfNotAdded(srcDedupMap, item2.Key, srcDiffMap, srcColId)
+					tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item2.Key)
 				}
+				item2 = iter2.next()
 			}
 		}
 	}
-	return srcDiffMap, tgtDiffMap, migrationHintMap
+
+	for ; item1 != nil; item1 = iter1.next() {
+		// This means that all the rest of the entries in file1 are missing from file2
+		differ.addMigrationHintIfNeeded(colMigrationMode, item1, migrationHintMap)
+		validComparison := !colMigrationMode || item1.MapsToTargetCol(tgtColId, differ.colFilterTgtIds, tgtColId) && item1.IsMutation()
+		if validComparison {
+			differ.MissingFromFile2 = append(differ.MissingFromFile2, item1)
+			addToSrcDiffMapIfNotAdded(srcDedupMap, item1.Key, srcDiffMap, srcColId)
+		}
+	}
+	if iter1.err() != nil {
+		return iter1.err()
+	}
+
+	// iterative migration means that it is possible target has more docs than the source as customers
+	// do migration with a set of rules, and then do another set of migration with another set of rules, etc
+	// Do not check the rest if it is migration mode
+	if !colMigrationMode {
+		for ; item2 != nil; item2 = iter2.next() {
+			// This means that all the rest of the entries in file2 are missing from file1
+			differ.MissingFromFile1 = append(differ.MissingFromFile1, item2)
+			tgtDiffMap[tgtColId] = append(tgtDiffMap[tgtColId], item2.Key)
+		}
+	}
+	return iter2.err()
 }
 
 func addToSrcDiffMapIfNotAdded(srcDedupMap map[string]bool, key string, srcDiffMap map[uint32][]string, srcColId uint32) {
@@ -528,24 +746,22 @@ func (differ *FilesDiffer) Diff() (srcDiffMap, tgtDiffMap map[uint32][]string, m
 	go differ.asyncLoad(&differ.file2, &differ.err2)
 	differ.dataLoadWg.Wait()
 
-	if differ.err1 != nil {
-		fmt.Printf("Error when loading file1 contents: %v\n", differ.err1)
-	}
-	if differ.err2 != nil {
-		fmt.Printf("Error when loading file2 contents: %v\n", differ.err2)
+	if differ.file1.itemCount > 0 && differ.file2.itemCount > 0 && differ.file1.hashAlgorithm != differ.file2.hashAlgorithm {
+		err = fmt.Errorf("%v holds %v hashes while %v holds %v hashes", differ.file1.name, differ.file1.hashAlgorithm, differ.file2.name, differ.file2.hashAlgorithm)
+		return
 	}
 
-	srcDiffMap, tgtDiffMap, migrationHintMap = differ.diffSorted()
-	diffBytes, err = differ.diffToJson()
+	defer differ.file1.cleanupSortedFiles()
+	defer differ.file2.cleanupSortedFiles()
 
-	// Count source items
-	for _, entryMap := range differ.file1.entries {
-		differ.file1ItemCount += len(entryMap)
-	}
-	// Count target Items
-	for _, entryMap := range differ.file2.entries {
-		differ.file2ItemCount += len(entryMap)
+	srcDiffMap, tgtDiffMap, migrationHintMap, err = differ.diffSorted()
+	if err != nil {
+		return
 	}
+	diffBytes, err = differ.diffToJson()
+
+	differ.file1ItemCount = differ.file1.itemCount
+	differ.file2ItemCount = differ.file2.itemCount
 	return srcDiffMap, tgtDiffMap, migrationHintMap, diffBytes, err
 }
 
@@ -554,7 +770,7 @@ func (differ *FilesDiffer) PrettyPrintResult() {
 	missing1Cnt := len(differ.MissingFromFile1)
 	missing2Cnt := len(differ.MissingFromFile2)
 
-	if len(differ.file1.entries) == 0 && len(differ.file2.entries) == 0 {
+	if differ.file1.itemCount == 0 && differ.file2.itemCount == 0 {
 		fmt.Printf("Diff tool has not been run yet\n")
 	} else if mismatchCnt == 0 && missing1Cnt == 0 && missing2Cnt == 0 {
 		fmt.Printf("Both sides match\n")
@@ -10,15 +10,21 @@
 package differ
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	xdcrLog "github.com/couchbase/goxdcr/log"
 	"xdcrDiffer/base"
+	"xdcrDiffer/dashboard"
 	fdp "xdcrDiffer/fileDescriptorPool"
 	"xdcrDiffer/utils"
 )
@@ -27,6 +33,87 @@ import (
 type DiffKeysMap map[uint32][]string
 type MigrationHintMap map[string][]uint32
 
+// Keys are written encoded by base.EncodeKey, so that those that are not valid UTF-8 make it through JSON intact
+func (d DiffKeysMap) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+	encoded := make(map[uint32][]string, len(d))
+	for colId, keys := range d {
+		if keys == nil {
+			encoded[colId] = nil
+			continue
+		}
+		encodedKeys := make([]string, len(keys))
+		for i, key := range keys {
+			encodedKeys[i] = base.EncodeKey(key)
+		}
+		encoded[colId] = encodedKeys
+	}
+	return json.Marshal(encoded)
+}
+
+func (d *DiffKeysMap) UnmarshalJSON(data []byte) error {
+	var encoded map[uint32][]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	if encoded == nil {
+		*d = nil
+		return nil
+	}
+	decoded := make(DiffKeysMap, len(encoded))
+	for colId, keys := range encoded {
+		if keys == nil {
+			decoded[colId] = nil
+			continue
+		}
+		decodedKeys := make([]string, len(keys))
+		for i, key := range keys {
+			decodedKey, err := base.DecodeKey(key)
+			if err != nil {
+				return fmt.Errorf("invalid key %v of collection %v: %v", base.TagUD(key), colId, err)
+			}
+			decodedKeys[i] = decodedKey
+		}
+		decoded[colId] = decodedKeys
+	}
+	*d = decoded
+	return nil
+}
+
+func (m MigrationHintMap) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	encoded := make(map[string][]uint32, len(m))
+	for key, colIds := range m {
+		encoded[base.EncodeKey(key)] = colIds
+	}
+	return json.Marshal(encoded)
+}
+
+func (m *MigrationHintMap) UnmarshalJSON(data []byte) error {
+	var encoded map[string][]uint32
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	if encoded == nil {
+		*m = nil
+		return nil
+	}
+	decoded := make(MigrationHintMap, len(encoded))
+	for key, colIds := range encoded {
+		decodedKey, err := base.DecodeKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid key %v: %v", base.TagUD(key), err)
+		}
+		decoded[decodedKey] = colIds
+	}
+	*m = decoded
+	return nil
+}
+
 func (d *DiffKeysMap) GetTotalCount() int {
 	if d == nil {
 		return 0
@@ -50,29 +137,12 @@ func (d *DiffKeysMap) ToFetchEntries(mappings map[uint32][]uint32, migrationHint
 		return fetchList, index
 	}
 
-	migrationMode := len(migrationHintMap) > 0
-
 	for srcColId, keys := range *d {
 		for _, oneKey := range keys {
-			var tgtList []uint32
-			var ok bool
-
-			if migrationMode {
-				tgtList = migrationHintMap[oneKey]
-			} else {
-				tgtList, ok = mappings[srcColId]
-				if !ok {
-					if len(migrationHintMap) == 0 {
-						// Shouldn't happen
-						continue
-					}
-				}
-			}
-
-			entry := &MutationDifferFetchEntry{
-				SrcColId:  srcColId,
-				TgtColIds: tgtList,
-				Key:       oneKey,
+			entry := newFetchEntry(srcColId, oneKey, mappings, migrationHintMap)
+			if entry == nil {
+				// Shouldn't happen
+				continue
 			}
 			fetchList = append(fetchList, entry)
 			index.AddEntry(entry)
@@ -82,6 +152,130 @@ func (d *DiffKeysMap) ToFetchEntries(mappings map[uint32][]uint32, migrationHint
 	return fetchList, index
 }
 
+// Returns the fetch entry of one key, or nil if the collection of the key has no mapping
+func newFetchEntry(srcColId uint32, key string, mappings map[uint32][]uint32, migrationHintMap MigrationHintMap) *MutationDifferFetchEntry {
+	var tgtList []uint32
+	if len(migrationHintMap) > 0 {
+		tgtList = migrationHintMap[key]
+	} else {
+		var ok bool
+		tgtList, ok = mappings[srcColId]
+		if !ok {
+			return nil
+		}
+	}
+	return &MutationDifferFetchEntry{
+		SrcColId:  srcColId,
+		TgtColIds: tgtList,
+		Key:       key,
+	}
+}
+
+// Calls fn with each key of a diff keys file, as written from a DiffKeysMap, one at a time rather than
+// loading the whole map. Stops at the first error fn returns
+func streamDiffKeysFile(encryptionKey []byte, fileName string, fn func(colId uint32, key string) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := utils.NewDataFileReader(encryptionKey, file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fileName, err)
+	}
+	err = streamDiffKeys(reader, fn)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fileName, err)
+	}
+	return nil
+}
+
+func streamDiffKeys(reader io.Reader, fn func(colId uint32, key string) error) error {
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		// A nil DiffKeysMap
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("diff keys should be an object, not %v", token)
+	}
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		colId, err := strconv.ParseUint(token.(string), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid collection ID %v: %v", token, err)
+		}
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			continue
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return fmt.Errorf("diff keys of collection %v should be an array, not %v", colId, token)
+		}
+		for decoder.More() {
+			var encodedKey string
+			if err = decoder.Decode(&encodedKey); err != nil {
+				return err
+			}
+			key, err := base.DecodeKey(encodedKey)
+			if err != nil {
+				return fmt.Errorf("invalid key %v of collection %v: %v", base.TagUD(encodedKey), colId, err)
+			}
+			if err = fn(uint32(colId), key); err != nil {
+				return err
+			}
+		}
+		// The closing bracket of the array
+		if _, err = decoder.Token(); err != nil {
+			return err
+		}
+	}
+	// The closing brace of the object
+	_, err = decoder.Token()
+	return err
+}
+
+// Writes the keys of each collection to its own file next to diffKeysFileName, so that a single
+// collection can be verified or re-diffed without the others. Files of collections that no longer
+// have diffs are removed
+func (d *DiffKeysMap) WritePerCollection(encryptionKey []byte, diffKeysFileName string) error {
+	staleFiles, err := filepath.Glob(fmt.Sprintf("%v%v%v%v*", diffKeysFileName, base.FileNameDelimiter,
+		base.DiffKeysCollectionSuffix, base.FileNameDelimiter))
+	if err != nil {
+		return err
+	}
+	for _, staleFile := range staleFiles {
+		if err = os.Remove(staleFile); err != nil {
+			return err
+		}
+	}
+	if d == nil {
+		return nil
+	}
+
+	for colId, keys := range *d {
+		diffKeysBytes, err := json.Marshal(DiffKeysMap{colId: keys})
+		if err != nil {
+			return err
+		}
+		err = utils.WriteDataFile(encryptionKey, utils.DiffKeysCollectionFileName(diffKeysFileName, colId), diffKeysBytes, base.FileModeReadWrite)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *DiffKeysMap) Merge(other DiffKeysMap) {
 	if d == nil || other == nil {
 		return
@@ -123,6 +317,13 @@ func (m *MutationDifferFetchEntry) Clone() *MutationDifferFetchEntry {
 	}
 }
 
+// Returns a copy of the entry with its key encoded by base.EncodeKey, for the files that list fetch entries
+func (m *MutationDifferFetchEntry) withEncodedKey() *MutationDifferFetchEntry {
+	clone := m.Clone()
+	clone.Key = base.EncodeKey(m.Key)
+	return clone
+}
+
 // Typically used from the target's point of view
 // If a target entry doesn't exist in the source
 // then flip this around to the source's point of view
@@ -186,6 +387,18 @@ type DifferDriver struct {
 	MapLock           *sync.RWMutex
 	srcMigrationHint  MigrationHintMap
 	DuplicatedHint    DuplicatedHintMap
+	// Memory budget of each file loaded by the file differs. 0 means no limit
+	fileMemoryBudget int64
+	// Key the data files and the diff outputs are encrypted with, nil for plaintext
+	encryptionKey []byte
+	// vbuckets to diff
+	vbRange base.VbucketRange
+	// Set when the records are kept in stores instead of data files
+	sourceStore *KVStore
+	targetStore *KVStore
+	// Totals of the run, complete once Run() returns
+	Summary FileDiffSummary
+	logger  *xdcrLog.CommonLogger
 }
 
 func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName string, numberOfWorkers, numberOfBins, numberOfFds int, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32) *DifferDriver {
@@ -215,11 +428,51 @@ func NewDifferDriver(sourceFileDir, targetFileDir, diffFileDir, diffKeysFileName
 		TgtVbItemCntMap:   make(map[uint16]int),
 		MapLock:           &sync.RWMutex{},
 		DuplicatedHint:    DuplicatedHintMap{},
+		vbRange:           base.AllVbuckets,
+		logger:            xdcrLog.NewLogger("FileDiffer", xdcrLog.DefaultLoggerContext),
+	}
+}
+
+// Caps the memory used by all file differs combined. Each worker diffs two files at a time, and files
+// that do not fit in their share are sorted externally under the diff file directory
+func (dr *DifferDriver) SetMemoryBudget(totalBytes int64) {
+	dr.fileMemoryBudget = totalBytes / int64(dr.numberOfWorkers*2)
+	if totalBytes > 0 && dr.fileMemoryBudget == 0 {
+		dr.fileMemoryBudget = 1
+	}
+}
+
+// Diffs the records in the given stores instead of the data files. Must be called before Run()
+func (dr *DifferDriver) SetKVStores(sourceStore, targetStore *KVStore) {
+	dr.sourceStore = sourceStore
+	dr.targetStore = targetStore
+}
+
+// Reads the data files through the given pool instead of one of its own, e.g. the one data generation wrote them
+// through. Must be called before Run()
+func (dr *DifferDriver) SetFileDescPool(fdPool *fdp.FdPool) {
+	dr.fileDescPool = fdPool
+}
+
+// Key the data files were written with and the diff outputs are to be encrypted with, nil for plaintext.
+// Must be called before Run()
+func (dr *DifferDriver) SetEncryptionKey(key []byte) {
+	dr.encryptionKey = key
+}
+
+// Must be called before Run()
+func (dr *DifferDriver) SetVbucketRange(vbRange base.VbucketRange) {
+	dr.vbRange = vbRange
+	if dr.numberOfWorkers > vbRange.Count() {
+		dr.numberOfWorkers = vbRange.Count()
 	}
 }
 
-func (dr *DifferDriver) Run() error {
-	loadDistribution := utils.BalanceLoad(dr.numberOfWorkers, base.NumberOfVbuckets)
+// Canceling ctx stops the handlers once they are done with the vbucket they are diffing. The diff keys of the
+// vbuckets diffed so far are still written, and ctx.Err() is returned
+func (dr *DifferDriver) Run(ctx context.Context) error {
+	vbnos := dr.vbRange.Vbnos()
+	loadDistribution := utils.BalanceLoad(dr.numberOfWorkers, len(vbnos))
 
 	go dr.reportStatus()
 
@@ -230,13 +483,13 @@ func (dr *DifferDriver) Run() error {
 		highIndex := loadDistribution[i][1]
 		vbList := make([]uint16, highIndex-lowIndex)
 		for j := lowIndex; j < highIndex; j++ {
-			vbList[j-lowIndex] = uint16(j)
+			vbList[j-lowIndex] = vbnos[j]
 		}
 
 		dr.waitGroup.Add(1)
 		differHandler := NewDifferHandler(dr, i, dr.sourceFileDir, dr.targetFileDir, vbList, dr.numberOfBins, dr.waitGroup, dr.fileDescPool, dr.collectionMapping, dr.colFilterStrings, dr.colFilterTgtIds)
 		differHandlers = append(differHandlers, differHandler)
-		go differHandler.run()
+		go differHandler.run(ctx)
 	}
 	dr.waitGroup.Wait()
 
@@ -245,11 +498,78 @@ func (dr *DifferDriver) Run() error {
 	// Thus, merge is needed to ensure a complete view of all documents across all VBs
 	for _, handler := range differHandlers {
 		dr.DuplicatedHint.Merge(handler.duplicatedHintMap)
+		dr.Summary.add(&handler.summary)
 	}
 
 	dr.Stop()
 
-	return nil
+	return ctx.Err()
+}
+
+// Diffs each vbucket as soon as both sides report its data files as complete, while other vbuckets may
+// still be streaming. Vbuckets not reported by the time dataGenDoneChan is closed are diffed at that point
+// Canceling ctx has the same effect as with Run()
+func (dr *DifferDriver) RunStreaming(ctx context.Context, srcVbsReady, tgtVbsReady <-chan uint16, dataGenDoneChan <-chan bool) error {
+	go dr.reportStatus()
+
+	vbChan := make(chan uint16, base.NumberOfVbuckets)
+	go dispatchReadyVbs(ctx, dr.vbRange, srcVbsReady, tgtVbsReady, dataGenDoneChan, vbChan)
+
+	var differHandlers []*DifferHandler
+	for i := 0; i < dr.numberOfWorkers; i++ {
+		dr.waitGroup.Add(1)
+		differHandler := NewDifferHandler(dr, i, dr.sourceFileDir, dr.targetFileDir, nil, dr.numberOfBins, dr.waitGroup, dr.fileDescPool, dr.collectionMapping, dr.colFilterStrings, dr.colFilterTgtIds)
+		differHandlers = append(differHandlers, differHandler)
+		go differHandler.runFromChan(ctx, vbChan)
+	}
+	dr.waitGroup.Wait()
+
+	for _, handler := range differHandlers {
+		dr.DuplicatedHint.Merge(handler.duplicatedHintMap)
+		dr.Summary.add(&handler.summary)
+	}
+
+	dr.Stop()
+
+	return ctx.Err()
+}
+
+// Sends each vb of vbRange to vbChan once it has been received from both srcVbsReady and tgtVbsReady, or all the
+// remaining ones once dataGenDoneChan is closed. Stops dispatching once ctx is done
+func dispatchReadyVbs(ctx context.Context, vbRange base.VbucketRange, srcVbsReady, tgtVbsReady <-chan uint16, dataGenDoneChan <-chan bool, vbChan chan uint16) {
+	defer close(vbChan)
+
+	srcReady := make([]bool, base.NumberOfVbuckets)
+	tgtReady := make([]bool, base.NumberOfVbuckets)
+	dispatched := make([]bool, base.NumberOfVbuckets)
+	var numDispatched int
+
+	dispatchIfReady := func(vbno uint16) {
+		if srcReady[vbno] && tgtReady[vbno] && !dispatched[vbno] {
+			dispatched[vbno] = true
+			numDispatched++
+			vbChan <- vbno
+		}
+	}
+
+	for numDispatched < vbRange.Count() {
+		select {
+		case vbno := <-srcVbsReady:
+			srcReady[vbno] = true
+			dispatchIfReady(vbno)
+		case vbno := <-tgtVbsReady:
+			tgtReady[vbno] = true
+			dispatchIfReady(vbno)
+		case <-dataGenDoneChan:
+			for _, vbno := range vbRange.Vbnos() {
+				srcReady[vbno] = true
+				tgtReady[vbno] = true
+				dispatchIfReady(vbno)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func (dr *DifferDriver) Stop() {
@@ -260,20 +580,24 @@ func (dr *DifferDriver) cleanup() {
 	close(dr.finChan)
 	err := dr.writeDiffKeys()
 	if err != nil {
-		fmt.Printf("Error writing srcDiff fetchList. err=%v\n", err)
+		dr.logger.Errorf("Error writing srcDiff fetchList. err=%v\n", err)
 	}
 }
 
 func (dr *DifferDriver) reportStatus() {
 	ticker := time.NewTicker(time.Duration(base.StatsReportInterval) * time.Second)
 	defer ticker.Stop()
+	startTime := time.Now()
 
 	for {
 		select {
 		case <-ticker.C:
 			vbCompleted := atomic.LoadUint32(&dr.vbCompleted)
-			fmt.Printf("%v File differ processed %v vbuckets\n", time.Now(), vbCompleted)
-			if vbCompleted == base.NumberOfVbuckets {
+			numVbs := uint64(dr.vbRange.Count())
+			dr.logger.Infof("File differ processed %v vbuckets %v%v\n", vbCompleted,
+				dashboard.ProgressBar(uint64(vbCompleted), numVbs, base.StatusLogProgressBarWidth),
+				dashboard.FormatEta(uint64(vbCompleted), numVbs, time.Since(startTime)))
+			if uint64(vbCompleted) == numVbs {
 				return
 			}
 		case <-dr.finChan:
@@ -282,6 +606,17 @@ func (dr *DifferDriver) reportStatus() {
 	}
 }
 
+// Returns the number of vbuckets diffed so far out of the total
+func (dr *DifferDriver) Progress() (uint64, uint64) {
+	return uint64(atomic.LoadUint32(&dr.vbCompleted)), uint64(dr.vbRange.Count())
+}
+
+func (dr *DifferDriver) NumSrcDiffKeys() uint64 {
+	dr.stateLock.RLock()
+	defer dr.stateLock.RUnlock()
+	return uint64(dr.srcDiffKeys.GetTotalCount())
+}
+
 func (dr *DifferDriver) addSrcDiffKeys(diffKeys map[uint32][]string, migrationHints map[string][]uint32) {
 	dr.stateLock.Lock()
 	defer dr.stateLock.Unlock()
@@ -340,6 +675,10 @@ func (dr *DifferDriver) writeSrcDiffKeys(isSrc bool, waitGrp *sync.WaitGroup) er
 	if err != nil {
 		return err
 	}
+	diffKeysBytes, err = utils.EncryptDataFile(dr.encryptionKey, diffKeysBytes)
+	if err != nil {
+		return err
+	}
 
 	diffKeysFileName := utils.DiffKeysFileName(isSrc, dr.diffFileDir, dr.diffKeysFileName)
 	diffKeysFile, err := os.OpenFile(diffKeysFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
@@ -348,6 +687,14 @@ func (dr *DifferDriver) writeSrcDiffKeys(isSrc bool, waitGrp *sync.WaitGroup) er
 	}
 	_, err = diffKeysFile.Write(diffKeysBytes)
 	diffKeysFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = diffKeys.WritePerCollection(dr.encryptionKey, diffKeysFileName)
+	if err != nil {
+		return err
+	}
 
 	if isSrc && len(dr.colFilterStrings) > 0 {
 		migrationHintFile := fmt.Sprintf("%v_%v", diffKeysFileName, base.DiffKeysSrcMigrationHintSuffix)
@@ -355,7 +702,7 @@ func (dr *DifferDriver) writeSrcDiffKeys(isSrc bool, waitGrp *sync.WaitGroup) er
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(migrationHintFile, data, 0644)
+		err = utils.WriteDataFile(dr.encryptionKey, migrationHintFile, data, 0644)
 		if err != nil {
 			return err
 		}
@@ -378,6 +725,7 @@ type DifferHandler struct {
 	colFilterTgtIds   []uint32
 
 	duplicatedHintMap DuplicatedHintMap
+	summary           FileDiffSummary
 }
 
 func NewDifferHandler(driver *DifferDriver, index int, sourceFileDir, targetFileDir string, vbList []uint16, numberOfBins int, waitGroup *sync.WaitGroup, fdPool *fdp.FdPool, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32) *DifferHandler {
@@ -397,69 +745,129 @@ func NewDifferHandler(driver *DifferDriver, index int, sourceFileDir, targetFile
 	}
 }
 
-func (dh *DifferHandler) run() error {
+func (dh *DifferHandler) run(ctx context.Context) error {
 	//fmt.Printf("DiffHandler %v starting\n", dh.index)
 	//defer fmt.Printf("DiffHandler %v stopping\n", dh.index)
 	defer dh.waitGroup.Done()
 
 	err := dh.initialize()
 	if err != nil {
-		fmt.Printf("%v srcDiff handler failed to initialize. err=%v\n", dh.index, err)
+		dh.driver.logger.Errorf("%v srcDiff handler failed to initialize. err=%v\n", dh.index, err)
 		return err
 	}
+	defer dh.cleanup()
 
-	var vbno uint16
-	for _, vbno = range dh.vbList {
-		srcVbItemCnt := 0
-		tgtVbItemCnt := 0
-		for bucketIndex := 0; bucketIndex < dh.numberOfBins; bucketIndex++ {
-			sourceFileName := utils.GetFileName(dh.sourceFileDir, vbno, bucketIndex)
-			targetFileName := utils.GetFileName(dh.targetFileDir, vbno, bucketIndex)
+	for _, vbno := range dh.vbList {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = dh.diffVb(vbno)
+		if err != nil {
+			return err
+		}
+	}
 
-			filesDiffer, err := NewFilesDifferWithFDPool(sourceFileName, targetFileName, dh.fileDescPool, dh.collectionMapping, dh.colFilterStrings, dh.colFilterTgtIds)
-			if err != nil {
-				// Most likely FD overrun, program should exit. Print a msg just in case
-				fmt.Printf("Creating file differ for files %v and %v resulted in error: %v\n",
-					sourceFileName, targetFileName, err)
-				return err
-			}
+	return nil
+}
 
-			srcDiffMap, tgtDiffMap, migrationHints, diffBytes, err := filesDiffer.Diff()
-			if err != nil {
-				fmt.Printf("error getting srcDiff from file differ. err=%v\n", err)
-				continue
-			}
-			if len(srcDiffMap) > 0 || len(tgtDiffMap) > 0 {
-				if len(srcDiffMap) > 0 {
-					dh.driver.addSrcDiffKeys(srcDiffMap, migrationHints)
-				}
-				if len(tgtDiffMap) > 0 {
-					dh.driver.addTgtDiffKeys(tgtDiffMap)
-				}
-				dh.writeDiffBytes(diffBytes)
-			}
-			srcVbItemCnt += filesDiffer.file1ItemCount
-			tgtVbItemCnt += filesDiffer.file2ItemCount
+// Same as run(), but diffs vbuckets as they are sent over vbChan, until it is closed
+func (dh *DifferHandler) runFromChan(ctx context.Context, vbChan <-chan uint16) error {
+	defer dh.waitGroup.Done()
 
-			dh.duplicatedHintMap.Merge(filesDiffer.duplicatedHintMap)
+	err := dh.initialize()
+	if err != nil {
+		dh.driver.logger.Errorf("%v srcDiff handler failed to initialize. err=%v\n", dh.index, err)
+		return err
+	}
+	defer dh.cleanup()
+
+	for vbno := range vbChan {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		atomic.AddInt64(&dh.driver.SourceItemCount, int64(srcVbItemCnt))
-		atomic.AddInt64(&dh.driver.TargetItemCount, int64(tgtVbItemCnt))
+		err = dh.diffVb(vbno)
+		if err != nil {
+			return err
+		}
+	}
 
-		dh.driver.MapLock.Lock()
-		dh.driver.SrcVbItemCntMap[vbno] = srcVbItemCnt
-		dh.driver.TgtVbItemCntMap[vbno] = tgtVbItemCnt
-		dh.driver.MapLock.Unlock()
-		atomic.AddUint32(&dh.driver.vbCompleted, 1)
+	return nil
+}
+
+// Diffs all bins of the given vbucket, or its records in the stores
+func (dh *DifferHandler) diffVb(vbno uint16) error {
+	srcVbItemCnt := 0
+	tgtVbItemCnt := 0
+	numberOfBins := dh.numberOfBins
+	if dh.driver.sourceStore != nil {
+		// The records of a vbucket are not split into bins in a store
+		numberOfBins = 1
 	}
+	for bucketIndex := 0; bucketIndex < numberOfBins; bucketIndex++ {
+		filesDiffer, err := dh.newFilesDiffer(vbno, bucketIndex)
+		if err != nil {
+			return err
+		}
 
-	dh.cleanup()
+		srcDiffMap, tgtDiffMap, migrationHints, diffBytes, err := filesDiffer.Diff()
+		if filesDiffer.err1 != nil {
+			dh.driver.logger.Errorf("Error when loading %v contents: %v\n", filesDiffer.file1.name, filesDiffer.err1)
+		}
+		if filesDiffer.err2 != nil {
+			dh.driver.logger.Errorf("Error when loading %v contents: %v\n", filesDiffer.file2.name, filesDiffer.err2)
+		}
+		if err != nil {
+			dh.driver.logger.Errorf("error getting srcDiff from file differ. err=%v\n", err)
+			dh.summary.Errors++
+			continue
+		}
+		if len(srcDiffMap) > 0 || len(tgtDiffMap) > 0 {
+			if len(srcDiffMap) > 0 {
+				dh.driver.addSrcDiffKeys(srcDiffMap, migrationHints)
+			}
+			if len(tgtDiffMap) > 0 {
+				dh.driver.addTgtDiffKeys(tgtDiffMap)
+			}
+			dh.writeDiffBytes(diffBytes)
+		}
+		srcVbItemCnt += filesDiffer.file1ItemCount
+		tgtVbItemCnt += filesDiffer.file2ItemCount
 
+		dh.duplicatedHintMap.Merge(filesDiffer.duplicatedHintMap)
+		dh.summary.add(filesDiffer.summary())
+	}
+	atomic.AddInt64(&dh.driver.SourceItemCount, int64(srcVbItemCnt))
+	atomic.AddInt64(&dh.driver.TargetItemCount, int64(tgtVbItemCnt))
+
+	dh.driver.MapLock.Lock()
+	dh.driver.SrcVbItemCntMap[vbno] = srcVbItemCnt
+	dh.driver.TgtVbItemCntMap[vbno] = tgtVbItemCnt
+	dh.driver.MapLock.Unlock()
+	atomic.AddUint32(&dh.driver.vbCompleted, 1)
 	return nil
 }
 
+func (dh *DifferHandler) newFilesDiffer(vbno uint16, bucketIndex int) (*FilesDiffer, error) {
+	if dh.driver.sourceStore != nil {
+		return NewKVStoresDiffer(dh.driver.sourceStore, dh.driver.targetStore, vbno, dh.collectionMapping, dh.colFilterStrings, dh.colFilterTgtIds), nil
+	}
+
+	sourceFileName := utils.GetFileName(dh.sourceFileDir, vbno, bucketIndex)
+	targetFileName := utils.GetFileName(dh.targetFileDir, vbno, bucketIndex)
+	filesDiffer, err := NewFilesDifferWithFDPool(sourceFileName, targetFileName, dh.fileDescPool, dh.collectionMapping, dh.colFilterStrings, dh.colFilterTgtIds)
+	if err != nil {
+		// Most likely FD overrun, program should exit. Print a msg just in case
+		dh.driver.logger.Errorf("Creating file differ for files %v and %v resulted in error: %v\n",
+			sourceFileName, targetFileName, err)
+		return nil, err
+	}
+	filesDiffer.SetMemoryBudget(dh.driver.fileMemoryBudget, dh.driver.diffFileDir)
+	filesDiffer.SetEncryptionKey(dh.driver.encryptionKey)
+	return filesDiffer, nil
+}
+
 func (dh *DifferHandler) initialize() error {
-	diffDetailsFileName := dh.driver.diffFileDir + base.FileDirDelimiter + base.DiffDetailsFileName + base.FileNameDelimiter + fmt.Sprintf("%v", dh.index)
+	diffDetailsFileName := utils.JoinPath(dh.driver.diffFileDir, base.DiffDetailsFileName+base.FileNameDelimiter+fmt.Sprintf("%v", dh.index))
 	diffDetailsFile, err := os.OpenFile(diffDetailsFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
 	if err != nil {
 		return err
@@ -469,9 +877,13 @@ func (dh *DifferHandler) initialize() error {
 }
 
 func (dh *DifferHandler) writeDiffBytes(diffBytes []byte) error {
-	_, err := dh.diffDetailsFile.Write(diffBytes)
+	diffBytes, err := utils.EncryptDataFile(dh.driver.encryptionKey, diffBytes)
+	if err != nil {
+		return err
+	}
+	_, err = dh.diffDetailsFile.Write(diffBytes)
 	if err != nil {
-		fmt.Printf("Diff handler %v error writing srcDiff details. err=%v\n", dh.index, err)
+		dh.driver.logger.Errorf("Diff handler %v error writing srcDiff details. err=%v\n", dh.index, err)
 	}
 	return err
 }
@@ -10,18 +10,29 @@
 package differ
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"github.com/couchbase/gocbcore/v9"
 	"github.com/couchbase/gomemcached"
+	xdcrBase "github.com/couchbase/goxdcr/base"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"xdcrDiffer/base"
 	"xdcrDiffer/dcp"
 	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/utils"
 )
 
 const MaxUint64 = ^uint64(0)
@@ -375,6 +386,174 @@ func TestLoadSameFileWPool(t *testing.T) {
 	fmt.Println("============== Test case end: TestLoadSameFileWPool =================")
 }
 
+func TestExternalSortFiles(t *testing.T) {
+	fmt.Println("============== Test case start: TestExternalSortFiles =================")
+	assert := assert.New(t)
+
+	file1 := "/tmp/test1.bin"
+	file2 := "/tmp/test2.bin"
+	defer os.Remove(file1)
+	defer os.Remove(file2)
+
+	entries := 10000
+	extraEntries := 5
+
+	err := genSameFiles(entries, file1, file2)
+	assert.Nil(err)
+
+	// Add more records to one file
+	f, err := os.OpenFile(file1, os.O_APPEND|os.O_WRONLY, 644)
+	assert.Nil(err)
+	_, err = f.Write(genMultipleRecords(extraEntries))
+	assert.Nil(err)
+	f.Close()
+
+	inMemoryDiffer := NewFilesDiffer(file1, file2, nil, nil, nil)
+	_, _, _, _, err = inMemoryDiffer.Diff()
+	assert.Nil(err)
+
+	// Small enough for each file to be sorted in multiple runs
+	externalDiffer := NewFilesDiffer(file1, file2, nil, nil, nil)
+	externalDiffer.SetMemoryBudget(100*1024, "/tmp")
+	srcDiffMap, _, _, _, err := externalDiffer.Diff()
+	assert.Nil(err)
+
+	assert.Equal(0, len(externalDiffer.file1.entries))
+	assert.NotEqual("", externalDiffer.file1.sortDir)
+	_, err = os.Stat(externalDiffer.file1.sortDir)
+	assert.True(os.IsNotExist(err))
+
+	assert.Equal(extraEntries, len(srcDiffMap[0]))
+	assert.Equal(extraEntries, len(externalDiffer.MissingFromFile2))
+	assert.Equal(0, len(externalDiffer.MissingFromFile1))
+	assert.Equal(0, len(externalDiffer.BothExistButMismatch))
+	assert.Equal(inMemoryDiffer.file1ItemCount, externalDiffer.file1ItemCount)
+	assert.Equal(inMemoryDiffer.file2ItemCount, externalDiffer.file2ItemCount)
+	fmt.Println("============== Test case end: TestExternalSortFiles =================")
+}
+
+func genHashedFile(fileName, hashAlgorithm string, mutations []*dcp.Mutation) error {
+	data, err := base.GetDataFileHeader(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+	for _, mutation := range mutations {
+		// As the DCP handler writes them
+		if base.IsCompactMutationLayout(hashAlgorithm) {
+			data = append(data, mutation.SerializeCompact()...)
+		} else {
+			data = append(data, mutation.SerializeWithHash(hashAlgorithm)...)
+		}
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+func TestDataFileHashAlgorithm(t *testing.T) {
+	fmt.Println("============== Test case start: TestDataFileHashAlgorithm =================")
+	assert := assert.New(t)
+
+	file1 := "/tmp/test1.bin"
+	file2 := "/tmp/test2.bin"
+	defer os.Remove(file1)
+	defer os.Remove(file2)
+
+	var mutations []*dcp.Mutation
+	for i := 0; i < 100; i++ {
+		key, seqno, revId, cas, flags, expiry, opCode, _, _, colId, _ := genTestData(true, false)
+		mutations = append(mutations, &dcp.Mutation{
+			Key:    []byte(key),
+			Seqno:  seqno,
+			RevId:  revId,
+			Cas:    cas,
+			Flags:  flags,
+			Expiry: expiry,
+			OpCode: opCode,
+			Value:  []byte(key),
+			ColId:  colId,
+		})
+	}
+
+	assert.Nil(genHashedFile(file1, base.HashAlgorithmXxhash64, mutations))
+	assert.Nil(genHashedFile(file2, base.HashAlgorithmXxhash64, mutations))
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+	srcDiffMap, tgtDiffMap, _, _, err := differ.Diff()
+	assert.Nil(err)
+	assert.Equal(base.HashAlgorithmXxhash64, differ.file1.hashAlgorithm)
+	assert.Equal(len(mutations), differ.file1ItemCount)
+	assert.Equal(0, len(srcDiffMap))
+	assert.Equal(0, len(tgtDiffMap))
+
+	// Hashes of different algorithms cannot be compared
+	assert.Nil(genHashedFile(file2, base.HashAlgorithmBlake3, mutations))
+	differ = NewFilesDiffer(file1, file2, nil, nil, nil)
+	_, _, _, _, err = differ.Diff()
+	assert.NotNil(err)
+	fmt.Println("============== Test case end: TestDataFileHashAlgorithm =================")
+}
+
+func TestKeyOnlyDataFiles(t *testing.T) {
+	fmt.Println("============== Test case start: TestKeyOnlyDataFiles =================")
+	assert := assert.New(t)
+
+	file1 := "/tmp/test1.bin"
+	file2 := "/tmp/test2.bin"
+	defer os.Remove(file1)
+	defer os.Remove(file2)
+
+	var srcMutations, tgtMutations []*dcp.Mutation
+	for i := 0; i < 100; i++ {
+		key, seqno, revId, cas, flags, expiry, opCode, _, _, colId, _ := genTestData(true, false)
+		mutation := &dcp.Mutation{
+			Key:    []byte(key),
+			Seqno:  seqno,
+			RevId:  revId,
+			Cas:    cas,
+			Flags:  flags,
+			Expiry: expiry,
+			OpCode: opCode,
+			Value:  []byte(key),
+			ColId:  colId,
+		}
+		srcMutations = append(srcMutations, mutation)
+		// Everything but the key and whether the doc exists differs on the target
+		tgtMutation := *mutation
+		tgtMutation.RevId++
+		tgtMutation.Cas++
+		tgtMutation.Value = []byte("other")
+		tgtMutations = append(tgtMutations, &tgtMutation)
+	}
+	missingKey := string(tgtMutations[0].Key)
+	tgtMutations = tgtMutations[1:]
+
+	assert.Nil(genHashedFile(file1, base.HashAlgorithmNone, srcMutations))
+	assert.Nil(genHashedFile(file2, base.HashAlgorithmNone, tgtMutations))
+	differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+	srcDiffMap, tgtDiffMap, _, _, err := differ.Diff()
+	assert.Nil(err)
+	assert.Equal(base.HashAlgorithmNone, differ.file1.hashAlgorithm)
+	assert.Equal(0, len(differ.BothExistButMismatch))
+	assert.Equal(1, len(differ.MissingFromFile2))
+	assert.Equal(missingKey, differ.MissingFromFile2[0].Key)
+	assert.Equal(1, len(srcDiffMap[srcMutations[0].ColId]))
+	assert.Equal(0, len(tgtDiffMap))
+
+	// Only what tells whether a doc exists is written
+	fileInfo, err := os.Stat(file1)
+	assert.Nil(err)
+	expectedSize := base.DataFileHeaderLen
+	for _, mutation := range srcMutations {
+		expectedSize += base.GetMutationLen(base.HashAlgorithmNone, len(mutation.Key), nil)
+	}
+	assert.Equal(int64(expectedSize), fileInfo.Size())
+
+	// Compaction reads the compact layout as well
+	assert.Nil(genHashedFile(file1, base.HashAlgorithmNone, append(srcMutations, srcMutations[1])))
+	before, after, err := CompactDataFile(file1, nil)
+	assert.Nil(err)
+	assert.Equal(before-int64(base.GetMutationLen(base.HashAlgorithmNone, len(srcMutations[1].Key), nil)), after)
+	fmt.Println("============== Test case end: TestKeyOnlyDataFiles =================")
+}
+
 func TestNoFilePool(t *testing.T) {
 	fmt.Println("============== Test case start: TestNoFilePool =================")
 	assert := assert.New(t)
@@ -384,3 +563,1178 @@ func TestNoFilePool(t *testing.T) {
 	assert.Nil(differDriver.fileDescPool)
 	fmt.Println("============== Test case end: TestNoFilePool =================")
 }
+
+func TestMemoryDiffer(t *testing.T) {
+	fmt.Println("============== Test case start: TestMemoryDiffer =================")
+	assert := assert.New(t)
+
+	diffDir := "/tmp/memoryDifferTest"
+	assert.Nil(os.MkdirAll(diffDir, 0777))
+	defer os.RemoveAll(diffDir)
+
+	memoryDiffer := NewMemoryDiffer(diffDir, "diffKeys", nil)
+
+	entries := 1000
+	for i := 0; i < entries; i++ {
+		_, _, _, _, _, _, _, _, record, _, _ := genTestData(true, false)
+		assert.Nil(memoryDiffer.AddMutation(true, uint16(i%1024), record))
+		assert.Nil(memoryDiffer.AddMutation(false, uint16(i%1024), record))
+	}
+
+	srcOnlyKey, _, _, _, _, _, _, _, srcOnlyRecord, _, _ := genTestData(true, false)
+	assert.Nil(memoryDiffer.AddMutation(true, 1, srcOnlyRecord))
+
+	mismatchedKey, _, _, _, _, _, _, _, mismatchedRecord, _, _ := genTestData(true, false)
+	assert.Nil(memoryDiffer.AddMutation(true, 2, mismatchedRecord))
+	mismatchedMut := dcp.Mutation{
+		Key:    []byte(mismatchedKey),
+		Seqno:  1,
+		RevId:  1,
+		Cas:    1,
+		OpCode: gomemcached.UPR_MUTATION,
+		Value:  []byte("differentValue"),
+	}
+	assert.Nil(memoryDiffer.AddMutation(false, 2, mismatchedMut.Serialize()))
+
+	assert.Nil(memoryDiffer.Run(context.Background()))
+	assert.Equal(int64(entries+2), memoryDiffer.SourceItemCount)
+	assert.Equal(int64(entries+1), memoryDiffer.TargetItemCount)
+	assert.Len(memoryDiffer.MissingFromTarget, 1)
+	assert.Equal(srcOnlyKey, memoryDiffer.MissingFromTarget[0].Key)
+	assert.Len(memoryDiffer.BothExistButMismatch, 1)
+	assert.Equal(mismatchedKey, memoryDiffer.BothExistButMismatch[0][0].Key)
+	assert.Len(memoryDiffer.MissingFromSource, 0)
+
+	_, err := os.Stat(diffDir + "/diffKeys_source")
+	assert.Nil(err)
+	fmt.Println("============== Test case end: TestMemoryDiffer =================")
+}
+
+func TestMemoryDifferStreamingWithSpill(t *testing.T) {
+	fmt.Println("============== Test case start: TestMemoryDifferStreamingWithSpill =================")
+	assert := assert.New(t)
+
+	diffDir := "/tmp/memoryDifferStreamingTest"
+	spillDir := diffDir + "/" + base.SpillDirName
+	assert.Nil(os.MkdirAll(spillDir, 0777))
+	defer os.RemoveAll(diffDir)
+
+	memoryDiffer := NewMemoryDiffer(diffDir, "diffKeys", nil)
+	// Every vbucket is over its share, so each mutation is spilled as it is added
+	memoryDiffer.SetMemoryBudget(1, spillDir)
+
+	entries := 100
+	for i := 0; i < entries; i++ {
+		_, _, _, _, _, _, _, _, record, _, _ := genTestData(true, false)
+		assert.Nil(memoryDiffer.AddMutation(true, 0, record))
+		assert.Nil(memoryDiffer.AddMutation(false, 0, record))
+	}
+	srcOnlyKey, _, _, _, _, _, _, _, srcOnlyRecord, _, _ := genTestData(true, false)
+	assert.Nil(memoryDiffer.AddMutation(true, 1, srcOnlyRecord))
+
+	srcVbsReady := make(chan uint16, base.NumberOfVbuckets)
+	tgtVbsReady := make(chan uint16, base.NumberOfVbuckets)
+	dataGenDoneChan := make(chan bool)
+	srcVbsReady <- 0
+	tgtVbsReady <- 0
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- memoryDiffer.RunStreaming(context.Background(), srcVbsReady, tgtVbsReady, dataGenDoneChan)
+	}()
+	for diffed, _ := memoryDiffer.Progress(); diffed == 0; diffed, _ = memoryDiffer.Progress() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(uint64(0), memoryDiffer.NumDiffs())
+	close(dataGenDoneChan)
+
+	assert.Nil(<-errChan)
+	assert.Equal(int64(entries+1), memoryDiffer.SourceItemCount)
+	assert.Equal(int64(entries), memoryDiffer.TargetItemCount)
+	assert.Len(memoryDiffer.MissingFromTarget, 1)
+	assert.Equal(srcOnlyKey, memoryDiffer.MissingFromTarget[0].Key)
+	assert.Len(memoryDiffer.BothExistButMismatch, 0)
+	spillFiles, err := os.ReadDir(spillDir)
+	assert.Nil(err)
+	assert.Len(spillFiles, 0)
+	fmt.Println("============== Test case end: TestMemoryDifferStreamingWithSpill =================")
+}
+
+func TestMemoryDifferCanceled(t *testing.T) {
+	fmt.Println("============== Test case start: TestMemoryDifferCanceled =================")
+	assert := assert.New(t)
+
+	diffDir := "/tmp/memoryDifferCanceledTest"
+	assert.Nil(os.MkdirAll(diffDir, 0777))
+	defer os.RemoveAll(diffDir)
+
+	memoryDiffer := NewMemoryDiffer(diffDir, "diffKeys", nil)
+	_, _, _, _, _, _, _, _, srcOnlyRecord, _, _ := genTestData(true, false)
+	assert.Nil(memoryDiffer.AddMutation(true, 0, srcOnlyRecord))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, memoryDiffer.Run(ctx))
+	diffed, _ := memoryDiffer.Progress()
+	assert.Equal(uint64(0), diffed)
+	// The output is still written, for the vbuckets diffed before the cancellation
+	_, err := os.Stat(diffDir + "/diffKeys_source")
+	assert.Nil(err)
+	fmt.Println("============== Test case end: TestMemoryDifferCanceled =================")
+}
+
+func TestCompactDataFile(t *testing.T) {
+	fmt.Println("============== Test case start: TestCompactDataFile =================")
+	assert := assert.New(t)
+
+	file := "/tmp/compactTest.bin"
+	defer os.Remove(file)
+
+	entries := 100
+	data := genMultipleRecords(entries)
+
+	// Append an older and a newer record for an existing key
+	key, seqno, revId, cas, flags, expiry, opCode, _, _, _, _ := genTestData(true, false)
+	mut := dcp.Mutation{Key: []byte(key), Seqno: seqno, RevId: revId, Cas: cas, Flags: flags, Expiry: expiry, OpCode: opCode, Value: []byte(key)}
+	data = append(data, mut.Serialize()...)
+	mut.Seqno = seqno - 1
+	data = append(data, mut.Serialize()...)
+	mut.Seqno = seqno + 1
+	mut.Value = []byte("newerValue")
+	newestRecord := mut.Serialize()
+	data = append(data, newestRecord...)
+	assert.Nil(ioutil.WriteFile(file, data, 0644))
+
+	before, after, err := CompactDataFile(file, nil)
+	assert.Nil(err)
+	assert.Equal(int64(len(data)), before)
+
+	compacted, err := ioutil.ReadFile(file)
+	assert.Nil(err)
+	assert.Equal(int64(len(compacted)), after)
+	assert.Equal(len(data)-2*len(newestRecord), len(compacted))
+	assert.True(bytes.HasSuffix(compacted, newestRecord))
+
+	// Compacting again is a no-op
+	before, after, err = CompactDataFile(file, nil)
+	assert.Nil(err)
+	assert.Equal(before, after)
+	fmt.Println("============== Test case end: TestCompactDataFile =================")
+}
+
+func TestCompressedDataFiles(t *testing.T) {
+	fmt.Println("============== Test case start: TestCompressedDataFiles =================")
+	assert := assert.New(t)
+
+	plainFile := "/tmp/compressedTestPlain.bin"
+	compressedFile := "/tmp/compressedTest.bin"
+	defer os.Remove(plainFile)
+	defer os.Remove(compressedFile)
+
+	header, err := base.GetDataFileHeader(base.HashAlgorithmSha512)
+	assert.Nil(err)
+	firstBlock := append(header, genMultipleRecords(50)...)
+	secondBlock := genMultipleRecords(50)
+	assert.Nil(ioutil.WriteFile(plainFile, append(append([]byte{}, firstBlock...), secondBlock...), 0644))
+
+	for _, compression := range []string{base.DataFileCompressionGzip, base.DataFileCompressionSnappy} {
+		// Written in two blocks, as two flushes of a bucket would
+		var data []byte
+		for _, block := range [][]byte{firstBlock, secondBlock} {
+			compressed, err := utils.CompressDataFileBlock(compression, block)
+			assert.Nil(err)
+			data = append(data, compressed...)
+		}
+		assert.Equal(compression, utils.DetectDataFileCompression(data))
+		assert.Nil(ioutil.WriteFile(compressedFile, data, 0644))
+
+		differ := NewFilesDiffer(compressedFile, plainFile, nil, nil, nil)
+		srcDiffMap, tgtDiffMap, _, _, err := differ.Diff()
+		assert.Nil(err)
+		assert.Equal(100, differ.file1ItemCount)
+		assert.Equal(100, differ.file2ItemCount)
+		assert.Equal(0, len(srcDiffMap))
+		assert.Equal(0, len(tgtDiffMap))
+
+		// Nothing to compact, so the file is left as is
+		before, after, err := CompactDataFile(compressedFile, nil)
+		assert.Nil(err)
+		assert.Equal(int64(len(data)), before)
+		assert.Equal(before, after)
+	}
+	assert.Equal(base.DataFileCompressionNone, utils.DetectDataFileCompression(header))
+	fmt.Println("============== Test case end: TestCompressedDataFiles =================")
+}
+
+func TestDedupBySeqno(t *testing.T) {
+	fmt.Println("============== Test case start: TestDedupBySeqno =================")
+	assert := assert.New(t)
+
+	file1 := "/tmp/test1.bin"
+	file2 := "/tmp/test2.bin"
+	defer os.Remove(file1)
+	defer os.Remove(file2)
+
+	data := genMultipleRecords(1000)
+
+	// The same key mutated twice, with the records arriving in a different order on each side
+	key, seqno, revId, cas, flags, expiry, opCode, _, _, _, _ := genTestData(true, false)
+	mut := dcp.Mutation{Key: []byte(key), Seqno: seqno, RevId: revId, Cas: cas, Flags: flags, Expiry: expiry, OpCode: opCode, Value: []byte(key)}
+	olderRecord := mut.Serialize()
+	mut.Seqno = seqno + 1
+	mut.RevId = revId + 1
+	mut.Value = []byte("newerValue")
+	newerRecord := mut.Serialize()
+
+	data1 := append(append(append([]byte{}, data...), olderRecord...), newerRecord...)
+	data2 := append(append(append([]byte{}, data...), newerRecord...), olderRecord...)
+	assert.Nil(ioutil.WriteFile(file1, data1, 0644))
+	assert.Nil(ioutil.WriteFile(file2, data2, 0644))
+
+	for _, memoryBudget := range []int64{0, 16 * 1024} {
+		differ := NewFilesDiffer(file1, file2, nil, nil, nil)
+		differ.SetMemoryBudget(memoryBudget, "/tmp")
+		srcDiffMap, tgtDiffMap, _, _, err := differ.Diff()
+		assert.Nil(err)
+		assert.Equal(0, len(srcDiffMap))
+		assert.Equal(0, len(tgtDiffMap))
+		assert.Equal(differ.file1ItemCount, differ.file2ItemCount)
+	}
+	fmt.Println("============== Test case end: TestDedupBySeqno =================")
+}
+
+func TestSeverity(t *testing.T) {
+	fmt.Println("============== Test case start: TestSeverity =================")
+	assert := assert.New(t)
+
+	casTolerance := time.Second
+	baseCas := gocbcore.Cas(time.Now().UnixNano())
+
+	srcGet := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte("value"), Cas: baseCas}}
+	tgtGetBodyDiff := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte("otherValue"), Cas: baseCas}}
+	tgtGetCasClose := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte("value"), Cas: baseCas + 10}}
+	tgtGetCasFar := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte("value"), Cas: baseCas + gocbcore.Cas(2*casTolerance)}}
+	assert.Equal(SeverityHigh, mismatchSeverity(srcGet, tgtGetBodyDiff, casTolerance))
+	assert.Equal(SeverityLow, mismatchSeverity(srcGet, tgtGetCasClose, casTolerance))
+	assert.Equal(SeverityMedium, mismatchSeverity(srcGet, tgtGetCasFar, casTolerance))
+
+	srcMeta := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: baseCas, SeqNo: 1}}
+	tgtMetaCasClose := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: baseCas - 10, SeqNo: 1}}
+	tgtMetaRevDiff := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: baseCas, SeqNo: 2}}
+	assert.Equal(SeverityLow, mismatchSeverity(srcMeta, tgtMetaCasClose, casTolerance))
+	assert.Equal(SeverityMedium, mismatchSeverity(srcMeta, tgtMetaRevDiff, casTolerance))
+
+	tombstone := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: baseCas, Deleted: 1}}
+	assert.Equal(SeverityInfo, missingSeverity(tombstone))
+	assert.Equal(SeverityHigh, missingSeverity(srcMeta))
+	fmt.Println("============== Test case end: TestSeverity =================")
+}
+
+func TestJsonAwareBodyCompare(t *testing.T) {
+	fmt.Println("============== Test case start: TestJsonAwareBodyCompare =================")
+	assert := assert.New(t)
+
+	src := &gocbcore.GetResult{Value: []byte(`{"name":"a","tags":[1,2],"id":12345678901234567890}`), Datatype: base.JSONDataType}
+	tgtReordered := &gocbcore.GetResult{Value: []byte(`{ "id": 12345678901234567890, "tags": [1, 2], "name": "a" }`), Datatype: base.JSONDataType}
+	tgtDifferent := &gocbcore.GetResult{Value: []byte(`{"name":"a","tags":[2,1],"id":12345678901234567890}`), Datatype: base.JSONDataType}
+	tgtNumberOff := &gocbcore.GetResult{Value: []byte(`{"name":"a","tags":[1,2],"id":12345678901234567891}`), Datatype: base.JSONDataType}
+	tgtBinary := &gocbcore.GetResult{Value: tgtReordered.Value}
+
+	assert.False(areGetResultsBodyTheSame(src, tgtReordered))
+	assert.True(areGetResultsJsonBodyTheSame(src, tgtReordered))
+	assert.False(areGetResultsJsonBodyTheSame(src, tgtDifferent))
+	assert.False(areGetResultsJsonBodyTheSame(src, tgtNumberOff))
+	// Binary docs are compared byte for byte
+	assert.False(areGetResultsJsonBodyTheSame(src, tgtBinary))
+
+	casTolerance := time.Second
+	srcResult := &GocbResult{GetResult: src}
+	tgtResult := &GocbResult{GetResult: tgtReordered}
+	assert.Equal(SeverityHigh, mismatchSeverityJsonAware(srcResult, tgtResult, casTolerance, false))
+	assert.Equal(SeverityLow, mismatchSeverityJsonAware(srcResult, tgtResult, casTolerance, true))
+	fmt.Println("============== Test case end: TestJsonAwareBodyCompare =================")
+}
+
+func TestXattrsCompare(t *testing.T) {
+	fmt.Println("============== Test case start: TestXattrsCompare =================")
+	assert := assert.New(t)
+
+	srcXattrs := map[string]json.RawMessage{
+		"_sync": json.RawMessage(`{"rev":"1-abc","seq":5}`),
+		"user":  json.RawMessage(`"value"`),
+		"_vv":   json.RawMessage(`{"src":"0x1"}`),
+	}
+	tgtReordered := map[string]json.RawMessage{
+		"_sync": json.RawMessage(`{ "seq": 5, "rev": "1-abc" }`),
+		"user":  json.RawMessage(`"value"`),
+		"_vv":   json.RawMessage(`{"tgt":"0x2"}`),
+	}
+	tgtMissingUser := map[string]json.RawMessage{
+		"_sync": json.RawMessage(`{"rev":"1-abc","seq":5}`),
+	}
+	tgtDrifted := map[string]json.RawMessage{
+		"_sync": json.RawMessage(`{"rev":"2-def","seq":6}`),
+		"user":  json.RawMessage(`"value"`),
+	}
+
+	assert.True(areXattrsTheSame(srcXattrs, tgtReordered))
+	assert.False(areXattrsTheSame(srcXattrs, tgtMissingUser))
+	assert.False(areXattrsTheSame(tgtMissingUser, srcXattrs))
+	assert.False(areXattrsTheSame(srcXattrs, tgtDrifted))
+	assert.True(areXattrsTheSame(map[string]json.RawMessage{}, map[string]json.RawMessage{"_mou": json.RawMessage(`{}`)}))
+
+	// Only _sync drifted, which Sync Gateway maintains on each side
+	assert.True(areXattrsTheSameIgnoringSyncGateway(srcXattrs, tgtDrifted, true))
+	assert.False(areXattrsTheSameIgnoringSyncGateway(srcXattrs, tgtMissingUser, true))
+	assert.True(areXattrsTheSameIgnoringSyncGateway(map[string]json.RawMessage{}, map[string]json.RawMessage{"_globalSync": json.RawMessage(`{}`)}, true))
+
+	result := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: 1, SeqNo: 2}, Xattrs: tgtMissingUser}
+	resultBytes, err := json.Marshal(result)
+	assert.Nil(err)
+	var fields map[string]interface{}
+	assert.Nil(json.Unmarshal(resultBytes, &fields))
+	assert.Equal(float64(2), fields["SeqNo"])
+	assert.NotNil(fields["Xattrs"])
+	fmt.Println("============== Test case end: TestXattrsCompare =================")
+}
+
+func TestComparator(t *testing.T) {
+	fmt.Println("============== Test case start: TestComparator =================")
+	assert := assert.New(t)
+
+	srcResult := &gocbcore.GetResult{Value: []byte(`{"name":"a","updatedAt":1}`), Datatype: base.JSONDataType}
+	tgtResult := &gocbcore.GetResult{Value: []byte(`{"name":"a","updatedAt":2}`), Datatype: base.JSONDataType}
+
+	differ := &MutationDiffer{}
+	assert.False(differ.areResultsTheSame("key", areGetResultsBodyTheSame, srcResult, tgtResult))
+
+	differ.SetComparator(func(key string, sourceResult, targetResult interface{}) ComparatorVerdict {
+		if key == "ignoredKey" {
+			return ComparatorVerdictSame
+		}
+		if key == "alwaysDifferent" {
+			return ComparatorVerdictDifferent
+		}
+		return ComparatorVerdictDefer
+	})
+	assert.True(differ.areResultsTheSame("ignoredKey", areGetResultsBodyTheSame, srcResult, tgtResult))
+	assert.False(differ.areResultsTheSame("alwaysDifferent", areGetResultsBodyTheSame, srcResult, srcResult))
+	assert.False(differ.areResultsTheSame("key", areGetResultsBodyTheSame, srcResult, tgtResult))
+	assert.True(differ.areResultsTheSame("key", areGetResultsBodyTheSame, srcResult, srcResult))
+
+	// The comparator is not consulted for binary docs
+	srcBinary := &gocbcore.GetResult{Value: []byte{0x01, 0x02}}
+	tgtBinary := &gocbcore.GetResult{Value: []byte{0x01, 0x03}}
+	assert.False(differ.areResultsTheSame("ignoredKey", areGetResultsBodyTheSame, srcBinary, tgtBinary))
+	fmt.Println("============== Test case end: TestComparator =================")
+}
+
+func TestExpiryExplainedByMaxTTL(t *testing.T) {
+	fmt.Println("============== Test case start: TestExpiryExplainedByMaxTTL =================")
+	assert := assert.New(t)
+
+	now := time.Now()
+	maxTTL := uint32(3600)
+	cappedExpiry := uint32(now.Unix()) + maxTTL/2
+
+	src := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1}
+	tgtCapped := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: cappedExpiry}
+	assert.True(isExpiryExplainedByMaxTTL(src, tgtCapped, maxTTL, now))
+	assert.False(isExpiryExplainedByMaxTTL(src, tgtCapped, 0, now))
+
+	// Source expiry is sooner than the target one, which maxTTL cannot cause
+	srcSooner := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: cappedExpiry - 10}
+	assert.False(isExpiryExplainedByMaxTTL(srcSooner, tgtCapped, maxTTL, now))
+
+	// Target expiry further out than maxTTL allows
+	tgtTooFar := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: uint32(now.Unix()) + 2*maxTTL}
+	assert.False(isExpiryExplainedByMaxTTL(src, tgtTooFar, maxTTL, now))
+
+	// Differs in more than just the expiry
+	tgtRevDiff := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 2, Expiry: cappedExpiry}
+	assert.False(isExpiryExplainedByMaxTTL(src, tgtRevDiff, maxTTL, now))
+
+	assert.Equal(maxTTL, getMaxTTLFromBucketInfo(map[string]interface{}{"maxTTL": float64(maxTTL)}))
+	assert.Equal(uint32(0), getMaxTTLFromBucketInfo(map[string]interface{}{}))
+	fmt.Println("============== Test case end: TestExpiryExplainedByMaxTTL =================")
+}
+
+func TestConflictFinding(t *testing.T) {
+	fmt.Println("============== Test case start: TestConflictFinding =================")
+	assert := assert.New(t)
+
+	// Source has the higher revId, target has the higher CAS
+	src := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: 100, SeqNo: 5}}
+	tgt := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: 200, SeqNo: 3}}
+	assert.Equal(FindingTargetHoldsStaleLosingRevision, conflictFinding(xdcrBase.ConflictResolutionType_Seqno, src, tgt))
+	assert.Equal(FindingSourceHoldsStaleLosingRevision, conflictFinding(xdcrBase.ConflictResolutionType_Lww, src, tgt))
+	assert.Equal(FindingUndetermined, conflictFinding(xdcrBase.ConflictResolutionType_Custom, src, tgt))
+
+	// Without the revId, seqno cannot be told
+	srcGet := &GocbResult{GetResult: &gocbcore.GetResult{Cas: 300}}
+	tgtGet := &GocbResult{GetResult: &gocbcore.GetResult{Cas: 200}}
+	assert.Equal(FindingUndetermined, conflictFinding(xdcrBase.ConflictResolutionType_Seqno, srcGet, tgtGet))
+	assert.Equal(FindingTargetHoldsStaleLosingRevision, conflictFinding(xdcrBase.ConflictResolutionType_Lww, srcGet, tgtGet))
+
+	assert.Equal(FindingUndetermined, conflictFinding(xdcrBase.ConflictResolutionType_Lww, src, src))
+
+	// Records only get a finding for the categories with both sides
+	assert.Equal(FindingSourceHoldsStaleLosingRevision, recordConflictFinding(xdcrBase.ConflictResolutionType_Lww, "Mismatch", []*GocbResult{src, tgt}))
+	assert.Equal(FindingUndetermined, recordConflictFinding(xdcrBase.ConflictResolutionType_Lww, "DeletedFromTarget", []*GocbResult{src}))
+	assert.Equal(ConflictFinding(""), recordConflictFinding(xdcrBase.ConflictResolutionType_Lww, "MissingFromTarget", []*GocbResult{src}))
+	fmt.Println("============== Test case end: TestConflictFinding =================")
+}
+
+func TestBinaryDiffs(t *testing.T) {
+	fmt.Println("============== Test case start: TestBinaryDiffs =================")
+	assert := assert.New(t)
+
+	assert.True(areRawBodiesTheSame(nil, []byte{}))
+	assert.False(areRawBodiesTheSame([]byte{0x00}, []byte{0x00, 0x00}))
+
+	srcBinary := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte{0x01, 0x02, 0x03}}}
+	tgtBinary := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte{0x01}}}
+	srcJson := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte(`{"a":1}`), Datatype: base.JSONDataType}}
+	tgtJson := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte(`{"a":2}`), Datatype: base.JSONDataType}}
+
+	differ := &MutationDiffer{
+		stateLock: &sync.RWMutex{},
+		srcDiff: map[uint32]map[string][]*GocbResult{
+			0: {
+				"binaryKey": {srcBinary, tgtBinary},
+				"jsonKey":   {srcJson, tgtJson},
+			},
+		},
+	}
+	diffs := differ.compileBinaryDiffs()
+	assert.Len(diffs[0], 1)
+	srcHash := sha256.Sum256(srcBinary.Value)
+	tgtHash := sha256.Sum256(tgtBinary.Value)
+	assert.Equal(&BinaryDiff{SourceSize: 3, TargetSize: 1, SizeDelta: -2, SourceHash: hex.EncodeToString(srcHash[:]),
+		TargetHash: hex.EncodeToString(tgtHash[:]), FirstDiffOffset: 1}, diffs[0]["binaryKey"])
+
+	// The hex dumps start where the bodies diverge, and are bounded
+	differ.binaryHexDumpLen = 2
+	srcLong := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte{0x01, 0x02, 0x03, 0x04, 0x05}}}
+	tgtLong := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte{0x01, 0x02, 0xff, 0x04}}}
+	diff := differ.recordBinaryDiff("Mismatch", []*GocbResult{srcLong, tgtLong})
+	assert.Equal(2, diff.FirstDiffOffset)
+	assert.Equal("0304", diff.SourceHexDump)
+	assert.Equal("ff04", diff.TargetHexDump)
+	diff = differ.recordBinaryDiff("Mismatch", []*GocbResult{srcBinary, tgtBinary})
+	assert.Equal("0203", diff.SourceHexDump)
+	assert.Equal("", diff.TargetHexDump)
+	assert.Nil(differ.recordBinaryDiff("Mismatch", []*GocbResult{srcJson, tgtJson}))
+	assert.Nil(differ.recordBinaryDiff("MissingFromTarget", []*GocbResult{srcBinary}))
+	fmt.Println("============== Test case end: TestBinaryDiffs =================")
+}
+
+func TestMergeOutputs(t *testing.T) {
+	fmt.Println("============== Test case start: TestMergeOutputs =================")
+	assert := assert.New(t)
+	workDir, err := ioutil.TempDir("", "mergeOutputsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	writeOutput := func(name string, key string, colId uint32, changedVbs map[uint16]uint64) string {
+		outputDir := workDir + base.FileDirDelimiter + name
+		fileDiffDir := outputDir + base.FileDirDelimiter + base.FileDifferDir
+		mutationDiffDir := outputDir + base.FileDirDelimiter + base.MutationDifferDir
+		assert.Nil(os.MkdirAll(fileDiffDir, 0777))
+		assert.Nil(os.MkdirAll(mutationDiffDir, 0777))
+		assert.Nil(writeJsonFile(nil, utils.DiffKeysFileName(true, fileDiffDir, base.DiffKeysFileName), DiffKeysMap{colId: {key}}))
+		fileDiffSummary := &FileDiffSummary{SourceKeysScanned: 10, BodyMismatch: 1,
+			SourceFilterCounts:             &base.FilterCounts{Passed: 10, Filtered: 3},
+			SourceFilterCountsByCollection: map[uint32]*base.FilterCounts{colId: {Passed: 10, Filtered: 3}}}
+		if len(changedVbs) > 0 {
+			fileDiffSummary.TargetChangedVbuckets = changedVbs
+			fileDiffSummary.Warning = base.DataChangingWarning
+		}
+		assert.Nil(writeSummaryFile(fileDiffDir+base.FileDirDelimiter+base.FileDiffSummaryFileName, fileDiffSummary))
+		assert.Nil(writeSummaryFile(mutationDiffDir+base.FileDirDelimiter+base.MutationDiffSummaryFileName, &MutationDiffSummary{KeysChecked: 1, BodyMismatch: 1}))
+		details := map[string]interface{}{"Mismatch": map[uint32]map[string][]*GocbResult{colId: {key: nil}}}
+		assert.Nil(writeJsonFile(nil, mutationDiffDir+base.FileDirDelimiter+base.MutationDiffFileName, details))
+		jsonLines := fmt.Sprintf("{\"Category\":\"Mismatch\",\"ColId\":%v,\"Key\":\"%v\"}\n{\"Summary\":{\"KeysChecked\":1}}\n", colId, key)
+		assert.Nil(ioutil.WriteFile(mutationDiffDir+base.FileDirDelimiter+base.MutationDiffJsonLinesFileName, []byte(jsonLines), base.FileModeReadWrite))
+		return outputDir
+	}
+	outputDirs := []string{writeOutput("node0", "key0", 8, nil), writeOutput("node1", "key1", 8, map[uint16]uint64{600: 250})}
+	mergedFileDiffDir := workDir + base.FileDirDelimiter + base.FileDifferDir
+	mergedMutationDiffDir := workDir + base.FileDirDelimiter + base.MutationDifferDir
+	assert.Nil(MergeOutputs(outputDirs, mergedFileDiffDir, mergedMutationDiffDir, nil))
+
+	var diffKeys DiffKeysMap
+	_, err = readJsonFile(nil, utils.DiffKeysFileName(true, mergedFileDiffDir, base.DiffKeysFileName), &diffKeys)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{8: {"key0", "key1"}}, diffKeys)
+	exists, err := readJsonFile(nil, utils.DiffKeysFileName(false, mergedFileDiffDir, base.DiffKeysFileName), &diffKeys)
+	assert.Nil(err)
+	assert.False(exists)
+
+	var fileDiffSummary FileDiffSummary
+	_, err = readJsonFile(nil, mergedFileDiffDir+base.FileDirDelimiter+base.FileDiffSummaryFileName, &fileDiffSummary)
+	assert.Nil(err)
+	assert.Equal(FileDiffSummary{SourceKeysScanned: 20, BodyMismatch: 2,
+		SourceFilterCounts:             &base.FilterCounts{Passed: 20, Filtered: 6},
+		SourceFilterCountsByCollection: map[uint32]*base.FilterCounts{8: {Passed: 20, Filtered: 6}},
+		TargetChangedVbuckets:          map[uint16]uint64{600: 250},
+		Warning:                        base.DataChangingWarning}, fileDiffSummary)
+
+	var details map[string]map[uint32]map[string][]*GocbResult
+	_, err = readJsonFile(nil, mergedMutationDiffDir+base.FileDirDelimiter+base.MutationDiffFileName, &details)
+	assert.Nil(err)
+	assert.Len(details["Mismatch"][8], 2)
+
+	jsonLines, err := ioutil.ReadFile(mergedMutationDiffDir + base.FileDirDelimiter + base.MutationDiffJsonLinesFileName)
+	assert.Nil(err)
+	lines := bytes.Split(bytes.TrimSpace(jsonLines), []byte("\n"))
+	assert.Len(lines, 3)
+	var footer struct {
+		Summary *MutationDiffSummary
+	}
+	assert.Nil(json.Unmarshal(lines[2], &footer))
+	assert.Equal(&MutationDiffSummary{KeysChecked: 2, BodyMismatch: 2}, footer.Summary)
+	fmt.Println("============== Test case end: TestMergeOutputs =================")
+}
+
+func TestRepairLogEntries(t *testing.T) {
+	fmt.Println("============== Test case start: TestRepairLogEntries =================")
+	assert := assert.New(t)
+
+	// Source collection 8 is replicated to target collections 9 and 10
+	differ := &MutationDiffer{
+		stateLock:           &sync.RWMutex{},
+		reverseTgtColIdsMap: compileReverseMap(map[uint32][]uint32{8: {9, 10}}),
+		missingFromTarget: map[uint32]map[string]*GocbResult{
+			9:  {"key1": nil, "key0": nil},
+			10: {"key0": nil},
+		},
+	}
+	entries := differ.getRepairLogEntries(base.RepairModeSetWithMeta, false)
+	assert.Equal([]*RepairLogEntry{
+		{Key: "key0", SrcColId: 8, TgtColId: 9, Mode: base.RepairModeSetWithMeta},
+		{Key: "key0", SrcColId: 8, TgtColId: 10, Mode: base.RepairModeSetWithMeta},
+		{Key: "key1", SrcColId: 8, TgtColId: 9, Mode: base.RepairModeSetWithMeta},
+	}, entries)
+
+	// A single touch repairs key0 on both target collections
+	entries = differ.getRepairLogEntries(base.RepairModeTouchSource, true)
+	assert.Equal([]*RepairLogEntry{
+		{Key: "key0", SrcColId: 8, Mode: base.RepairModeTouchSource, DryRun: true},
+		{Key: "key1", SrcColId: 8, Mode: base.RepairModeTouchSource, DryRun: true},
+	}, entries)
+	fmt.Println("============== Test case end: TestRepairLogEntries =================")
+}
+
+func TestWriteRemediation(t *testing.T) {
+	fmt.Println("============== Test case start: TestWriteRemediation =================")
+	assert := assert.New(t)
+	workDir, err := ioutil.TempDir("", "remediationTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	// Source collection 8 is replicated to target collections 9 and 10
+	differ := &MutationDiffer{
+		stateLock:           &sync.RWMutex{},
+		reverseTgtColIdsMap: compileReverseMap(map[uint32][]uint32{8: {9, 10}}),
+		missingFromTarget:   map[uint32]map[string]*GocbResult{9: {"key1": nil}},
+		tgtDiff:             map[uint32]map[string][]*GocbResult{9: {"it's": nil}, 10: {"it's": nil}},
+		deletedFromTarget:   map[uint32]map[string][]*GocbResult{},
+	}
+	numEntries, err := differ.WriteRemediation(workDir, map[uint32]string{8: "S1.col1"}, map[uint32]string{9: "S2.col2"})
+	assert.Nil(err)
+	assert.Equal(3, numEntries)
+
+	keys, err := ioutil.ReadFile(workDir + base.FileDirDelimiter + base.RemediationKeysFileName + "_S1.col1")
+	assert.Nil(err)
+	assert.Equal("it's\nkey1\n", string(keys))
+
+	script, err := ioutil.ReadFile(workDir + base.FileDirDelimiter + base.RemediationScriptFileName)
+	assert.Nil(err)
+	lines := strings.Split(strings.TrimSpace(string(script)), "\n")
+	assert.Equal([]string{
+		`copy_doc 'it'\''s' '--scope=S1 --collection=col1' '--scope=S2 --collection=col2'`,
+		`copy_doc 'it'\''s' '--scope=S1 --collection=col1' ''`,
+		`copy_doc 'key1' '--scope=S1 --collection=col1' '--scope=S2 --collection=col2'`,
+	}, lines[len(lines)-3:])
+	fmt.Println("============== Test case end: TestWriteRemediation =================")
+}
+
+func TestKVStoresDiffer(t *testing.T) {
+	fmt.Println("============== Test case start: TestKVStoresDiffer =================")
+	assert := assert.New(t)
+
+	sourceDir := "/tmp/kvStoreTest/source"
+	targetDir := "/tmp/kvStoreTest/target"
+	defer os.RemoveAll("/tmp/kvStoreTest")
+	sourceStore, err := OpenKVStore(base.DataStoreBadger, sourceDir)
+	assert.Nil(err)
+	targetStore, err := OpenKVStore(base.DataStoreBadger, targetDir)
+	assert.Nil(err)
+	assert.Nil(sourceStore.CheckHashAlgorithm(base.HashAlgorithmSha512))
+	assert.Nil(targetStore.CheckHashAlgorithm(base.HashAlgorithmSha512))
+	assert.NotNil(targetStore.CheckHashAlgorithm(base.HashAlgorithmBlake3))
+
+	entries := 1000
+	for i := 0; i < entries; i++ {
+		_, _, _, _, _, _, _, _, record, _, _ := genTestData(true, false)
+		assert.Nil(sourceStore.AddMutation(true, 0, record))
+		assert.Nil(targetStore.AddMutation(false, 0, record))
+	}
+	srcOnlyKey, _, _, _, _, _, _, _, srcOnlyRecord, _, _ := genTestData(true, false)
+	assert.Nil(sourceStore.AddMutation(true, 0, srcOnlyRecord))
+
+	// The newer record replaces the older one
+	mismatchedKey, _, _, _, _, _, _, _, mismatchedRecord, _, _ := genTestData(true, false)
+	assert.Nil(sourceStore.AddMutation(true, 0, mismatchedRecord))
+	assert.Nil(targetStore.AddMutation(false, 0, mismatchedRecord))
+	mismatchedMut := dcp.Mutation{
+		Key:    []byte(mismatchedKey),
+		Seqno:  MaxUint64,
+		RevId:  1,
+		Cas:    1,
+		OpCode: gomemcached.UPR_MUTATION,
+		Value:  []byte("differentValue"),
+	}
+	assert.Nil(targetStore.AddMutation(false, 0, mismatchedMut.Serialize()))
+	assert.Nil(sourceStore.Flush())
+	assert.Nil(targetStore.Flush())
+
+	differ := NewKVStoresDiffer(sourceStore, targetStore, 0, nil, nil, nil)
+	srcDiffMap, _, _, _, err := differ.Diff()
+	assert.Nil(err)
+	assert.Equal(entries+2, differ.file1ItemCount)
+	assert.Equal(entries+1, differ.file2ItemCount)
+	assert.Len(differ.MissingFromFile2, 1)
+	assert.Equal(srcOnlyKey, differ.MissingFromFile2[0].Key)
+	assert.Len(differ.BothExistButMismatch, 1)
+	assert.Equal(mismatchedKey, differ.BothExistButMismatch[0][0].Key)
+	assert.Len(differ.MissingFromFile1, 0)
+	assert.Len(srcDiffMap[0], 2)
+
+	// Resuming from before the mismatched record drops it
+	assert.Nil(targetStore.TruncateVb(0, MaxUint64-1))
+	differ = NewKVStoresDiffer(sourceStore, targetStore, 0, nil, nil, nil)
+	_, _, _, _, err = differ.Diff()
+	assert.Nil(err)
+	assert.Len(differ.BothExistButMismatch, 0)
+	assert.Len(differ.MissingFromFile2, 2)
+
+	assert.Nil(sourceStore.Close())
+	assert.Nil(targetStore.Close())
+	fmt.Println("============== Test case end: TestKVStoresDiffer =================")
+}
+
+func TestDiffTombstones(t *testing.T) {
+	fmt.Println("============== Test case start: TestDiffTombstones =================")
+	assert := assert.New(t)
+
+	differ := &MutationDiffer{
+		stateLock:         &sync.RWMutex{},
+		compareTombstones: true,
+		missingFromSource: make(map[uint32]map[string]*GocbResult),
+		missingFromTarget: make(map[uint32]map[string]*GocbResult),
+		srcDiff:           make(map[uint32]map[string][]*GocbResult),
+		tgtDiff:           make(map[uint32]map[string][]*GocbResult),
+		deletedFromSource: make(map[uint32]map[string][]*GocbResult),
+		deletedFromTarget: make(map[uint32]map[string][]*GocbResult),
+		xattrMismatch:     make(map[uint32]map[string][]*GocbResult),
+		tombstoneMismatch: make(map[uint32]map[string][]*GocbResult),
+	}
+	colIds := map[uint32][]uint32{0: {0}}
+	dw := NewDifferWorker(context.Background(), differ, nil, nil, nil, nil, nil, &sync.WaitGroup{}, colIds,
+		compileReverseMap(colIds), nil, base.MutationCompareTypeBodyOnly, 0)
+
+	alive := &gocbcore.GetResult{Value: []byte(`{"a":1}`), Cas: 100}
+	aliveMeta := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1}
+	tombstone := &gocbcore.GetMetaResult{Cas: 200, SeqNo: 2, Deleted: 1}
+	olderTombstone := &gocbcore.GetMetaResult{Cas: 150, SeqNo: 2, Deleted: 1}
+	setResult := func(results map[uint32]map[string]Result, key string, result *gocbcore.GetResult) {
+		if _, exists := results[0]; !exists {
+			results[0] = make(map[string]Result)
+		}
+		var err error
+		if result == nil {
+			err = gocbcore.ErrDocumentNotFound
+		}
+		results[0][key] = &GetResult{}
+		results[0][key].Set(key, result, err)
+	}
+	setMeta := func(metas map[uint32]map[string]*gocbcore.GetMetaResult, key string, meta *gocbcore.GetMetaResult) {
+		if _, exists := metas[0]; !exists {
+			metas[0] = make(map[string]*gocbcore.GetMetaResult)
+		}
+		metas[0][key] = meta
+	}
+
+	// Deleted on the source only
+	setResult(dw.sourceResults, "deletedOnSource", nil)
+	setResult(dw.targetResults, "deletedOnSource", alive)
+	setMeta(dw.sourceMetas, "deletedOnSource", tombstone)
+	setMeta(dw.targetMetas, "deletedOnSource", aliveMeta)
+	// Never existed on the target, as the lookup did not find it either
+	setResult(dw.sourceResults, "missingOnTarget", alive)
+	setResult(dw.targetResults, "missingOnTarget", nil)
+	setMeta(dw.sourceMetas, "missingOnTarget", aliveMeta)
+	// Deleted on both sides, with different tombstones
+	setResult(dw.sourceResults, "deletedOnBoth", nil)
+	setResult(dw.targetResults, "deletedOnBoth", nil)
+	setMeta(dw.sourceMetas, "deletedOnBoth", tombstone)
+	setMeta(dw.targetMetas, "deletedOnBoth", olderTombstone)
+	// Deleted on both sides, with the same tombstone
+	setResult(dw.sourceResults, "sameTombstone", nil)
+	setResult(dw.targetResults, "sameTombstone", nil)
+	setMeta(dw.sourceMetas, "sameTombstone", tombstone)
+	setMeta(dw.targetMetas, "sameTombstone", tombstone)
+
+	dw.diff()
+	assert.Len(differ.deletedFromSource[0], 1)
+	assert.Equal(tombstone, differ.deletedFromSource[0]["deletedOnSource"][0].GetMetaResult)
+	assert.Len(differ.missingFromTarget[0], 1)
+	assert.NotNil(differ.missingFromTarget[0]["missingOnTarget"])
+	assert.Len(differ.tombstoneMismatch[0], 1)
+	assert.NotNil(differ.tombstoneMismatch[0]["deletedOnBoth"])
+	assert.Len(differ.missingFromSource, 0)
+	assert.Len(differ.srcDiff, 0)
+	assert.Equal(3, differ.compileSummary().NumDiffs())
+	fmt.Println("============== Test case end: TestDiffTombstones =================")
+}
+
+func TestExpiryTolerance(t *testing.T) {
+	fmt.Println("============== Test case start: TestExpiryTolerance =================")
+	assert := assert.New(t)
+
+	src := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: 1700000000}
+	tgtClose := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: 1700000003}
+	tgtFar := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1, Expiry: 1700000010}
+	tgtNoExpiry := &gocbcore.GetMetaResult{Cas: 100, SeqNo: 1}
+
+	assert.False(areGetMetaResultsTheSame(src, tgtClose))
+	assert.True(areGetMetaResultsTheSameWithExpiryTolerance(src, tgtClose, 5))
+	assert.True(areGetMetaResultsTheSameWithExpiryTolerance(tgtClose, src, 5))
+	assert.False(areGetMetaResultsTheSameWithExpiryTolerance(src, tgtFar, 5))
+	assert.False(areGetMetaResultsTheSameWithExpiryTolerance(src, tgtNoExpiry, 5))
+	fmt.Println("============== Test case end: TestExpiryTolerance =================")
+}
+
+func TestRedaction(t *testing.T) {
+	fmt.Println("============== Test case start: TestRedaction =================")
+	assert := assert.New(t)
+	defer func() { base.SetRedactionLevel(base.RedactionLevelNone) }()
+
+	result := &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte(`{"secret":1}`), Cas: 100},
+		Xattrs: map[string]json.RawMessage{"_sync": json.RawMessage(`{"rev":"1-a"}`)}}
+	results := map[uint32]map[string]*GocbResult{8: {"doc1": result}}
+
+	base.SetRedactionLevel(base.RedactionLevelNone)
+	assert.Equal("doc1", base.TagUD([]byte("doc1")))
+	assert.Equal(results, redactKeys(results))
+
+	base.SetRedactionLevel(base.RedactionLevelPartial)
+	assert.Equal("<ud>doc1</ud>", base.TagUD([]byte("doc1")))
+	redacted := redactKeys(results).(map[uint32]map[string]*GocbResult)
+	assert.Equal(result, redacted[8]["<ud>doc1</ud>"])
+	resultBytes, err := json.Marshal(result)
+	assert.Nil(err)
+	fields := make(map[string]interface{})
+	assert.Nil(json.Unmarshal(resultBytes, &fields))
+	assert.Equal(`<ud>{"secret":1}</ud>`, fields["Value"])
+	assert.Equal(map[string]interface{}{"_sync": `<ud>{"rev":"1-a"}</ud>`}, fields["Xattrs"])
+	assert.Equal(float64(100), fields["Cas"])
+
+	base.SetRedactionLevel(base.RedactionLevelFull)
+	hashed := base.TagUD("doc1")
+	assert.True(strings.HasPrefix(hashed, base.UserDataStartTag))
+	assert.False(strings.Contains(hashed, "doc1"))
+	assert.Equal(hashed, base.TagUD([]byte("doc1")))
+	fmt.Println("============== Test case end: TestRedaction =================")
+}
+
+func TestJsonFieldDiff(t *testing.T) {
+	fmt.Println("============== Test case start: TestJsonFieldDiff =================")
+	assert := assert.New(t)
+
+	jsonResult := func(body string) *GocbResult {
+		return &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte(body), Datatype: base.JSONDataType}}
+	}
+	src := jsonResult(`{"name":"a","age":1,"address":{"city":"x","zip":"1"},"tags":["t1","t2"],"a/b":1,"big":12345678901234567890}`)
+	tgt := jsonResult(`{"name":"a","age":"1","address":{"city":"y"},"tags":["t1","t2","t3"],"a/b":2,"big":12345678901234567891,"new":true}`)
+	assert.Equal(&JsonFieldDiff{
+		Added:   []string{"/new", "/tags/2"},
+		Removed: []string{"/address/zip"},
+		Changed: []string{"/a~1b", "/address/city", "/age", "/big"},
+	}, jsonFieldDiff(src, tgt))
+
+	// Only the key order and whitespace differ
+	assert.Nil(jsonFieldDiff(jsonResult(`{"a":1,"b":2}`), jsonResult(`{ "b": 2, "a": 1 }`)))
+	// A type change at the top is a change of the whole body
+	assert.Equal(&JsonFieldDiff{Changed: []string{""}}, jsonFieldDiff(jsonResult(`{"a":1}`), jsonResult(`[1]`)))
+	// Binary and invalid JSON bodies have no fields
+	assert.Nil(jsonFieldDiff(jsonResult(`{"a":1}`), &GocbResult{GetResult: &gocbcore.GetResult{Value: []byte{0x1}}}))
+	assert.Nil(jsonFieldDiff(jsonResult(`{"a":1}`), jsonResult(`{"a":`)))
+	assert.Nil(jsonFieldDiff(jsonResult(`{"a":1}`), &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{}}))
+
+	// Only mismatches get a field diff
+	assert.NotNil(recordFieldDiff("Mismatch", []*GocbResult{src, tgt}))
+	assert.Nil(recordFieldDiff("DeletedFromTarget", []*GocbResult{src, tgt}))
+	assert.Nil(recordFieldDiff("MissingFromTarget", []*GocbResult{src}))
+	fmt.Println("============== Test case end: TestJsonFieldDiff =================")
+}
+
+func TestCasTimestamp(t *testing.T) {
+	fmt.Println("============== Test case start: TestCasTimestamp =================")
+	assert := assert.New(t)
+
+	written := time.Date(2024, 5, 1, 12, 0, 0, 500000000, time.UTC)
+	// The logical counter in the lower 16 bits is not part of the time
+	cas := uint64(written.UnixNano())&^base.CasLogicalClockMask | 0x1234
+	assert.True(written.Sub(base.CasToTime(cas)) < 0x10000*time.Nanosecond)
+	assert.False(base.CasToTime(cas).After(written))
+	assert.True(strings.HasPrefix(base.CasTimestamp(cas), "2024-05-01T12:00:00.4999"))
+	assert.True(strings.HasSuffix(base.CasTimestamp(cas), "Z"))
+	assert.Equal("", base.CasTimestamp(0))
+
+	src := &GocbResult{GetMetaResult: &gocbcore.GetMetaResult{Cas: gocbcore.Cas(cas), SeqNo: 2}}
+	tgt := &GocbResult{GetResult: &gocbcore.GetResult{Cas: gocbcore.Cas(cas + 0x10000)}}
+	for _, result := range []*GocbResult{src, tgt} {
+		resultBytes, err := json.Marshal(result)
+		assert.Nil(err)
+		var fields map[string]interface{}
+		assert.Nil(json.Unmarshal(resultBytes, &fields))
+		assert.Equal(result.casTimestamp(), fields["CasTime"])
+		assert.NotNil(fields["Cas"])
+	}
+	assert.NotEqual(src.casTimestamp(), tgt.casTimestamp())
+
+	report := NewConflictResolutionReport(xdcrBase.ConflictResolutionType_Lww)
+	report.add(FindingSourceHoldsStaleLosingRevision, "Mismatch", 8, "doc1", []*GocbResult{src, tgt})
+	report.add(FindingTargetHoldsStaleLosingRevision, "DeletedFromTarget", 8, "doc2", []*GocbResult{src})
+	entry := report.Details[FindingSourceHoldsStaleLosingRevision][0]
+	assert.Equal(base.CasTimestamp(cas), entry.SourceCasTime)
+	assert.Equal(base.CasTimestamp(cas+0x10000), entry.TargetCasTime)
+	assert.Equal("", report.Details[FindingTargetHoldsStaleLosingRevision][0].SourceCasTime)
+	fmt.Println("============== Test case end: TestCasTimestamp =================")
+}
+
+func TestEncryptedDataFiles(t *testing.T) {
+	fmt.Println("============== Test case start: TestEncryptedDataFiles =================")
+	assert := assert.New(t)
+
+	plainFile := "/tmp/encryptedTestPlain.bin"
+	encryptedFile := "/tmp/encryptedTest.bin"
+	defer os.Remove(plainFile)
+	defer os.Remove(encryptedFile)
+
+	header, err := base.GetDataFileHeader(base.HashAlgorithmSha512)
+	assert.Nil(err)
+	firstBlock := append(header, genMultipleRecords(50)...)
+	secondBlock := genMultipleRecords(50)
+	assert.Nil(ioutil.WriteFile(plainFile, append(append([]byte{}, firstBlock...), secondBlock...), 0644))
+
+	key, err := utils.ParseDataFileEncryptionKey(strings.Repeat("0123456789abcdef", 4))
+	assert.Nil(err)
+	for _, compression := range []string{base.DataFileCompressionNone, base.DataFileCompressionSnappy} {
+		// Written in two blocks, as two flushes of a bucket would
+		var buf bytes.Buffer
+		var blockEnds []int
+		encrypter := utils.NewDataFileEncrypter(key, &buf)
+		for _, block := range [][]byte{firstBlock, secondBlock} {
+			compressed, err := utils.CompressDataFileBlock(compression, block)
+			assert.Nil(err)
+			_, err = encrypter.Write(compressed)
+			assert.Nil(err)
+			blockEnds = append(blockEnds, buf.Len())
+		}
+		assert.Nil(encrypter.Close())
+		data := buf.Bytes()
+		assert.True(utils.IsDataFileEncrypted(data))
+
+		// Blocks cut off the end, dropped or out of order fail to decrypt
+		swapped := append(append(append([]byte{}, data[blockEnds[0]:blockEnds[1]]...), data[:blockEnds[0]]...), data[blockEnds[1]:]...)
+		for _, tampered := range [][]byte{data[:blockEnds[1]], data[blockEnds[0]:], swapped} {
+			_, err = utils.DecryptDataFile(key, tampered)
+			assert.NotNil(err)
+		}
+		_, err = utils.DecryptUnclosedDataFile(key, data[:blockEnds[1]])
+		assert.Nil(err)
+		assert.False(bytes.Contains(data, header))
+		assert.Nil(ioutil.WriteFile(encryptedFile, data, 0644))
+
+		differ := NewFilesDiffer(encryptedFile, plainFile, nil, nil, nil)
+		differ.SetEncryptionKey(key)
+		srcDiffMap, tgtDiffMap, _, _, err := differ.Diff()
+		assert.Nil(err)
+		assert.Equal(100, differ.file1ItemCount)
+		assert.Equal(100, differ.file2ItemCount)
+		assert.Equal(0, len(srcDiffMap))
+		assert.Equal(0, len(tgtDiffMap))
+	}
+
+	// Diff outputs are read back with the key they were written with
+	diffKeysFile := "/tmp/encryptedTestDiffKeys.json"
+	defer os.Remove(diffKeysFile)
+	assert.Nil(writeJsonFile(key, diffKeysFile, DiffKeysMap{8: {"doc1"}}))
+	var diffKeys DiffKeysMap
+	_, err = readJsonFile(key, diffKeysFile, &diffKeys)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{8: {"doc1"}}, diffKeys)
+
+	_, err = readJsonFile(nil, diffKeysFile, &diffKeys)
+	assert.NotNil(err)
+	differ := NewFilesDiffer(encryptedFile, plainFile, nil, nil, nil)
+	_, _, _, _, err = differ.Diff()
+	assert.NotNil(err)
+	fmt.Println("============== Test case end: TestEncryptedDataFiles =================")
+}
+
+func TestStreamDiffKeys(t *testing.T) {
+	fmt.Println("============== Test case start: TestStreamDiffKeys =================")
+	assert := assert.New(t)
+
+	diffKeysFile := "/tmp/streamTestDiffKeys.json"
+	defer os.Remove(diffKeysFile)
+	diffKeys := DiffKeysMap{0: {"doc1", "doc\"2"}, 8: {"doc3"}, 9: nil}
+	assert.Nil(writeJsonFile(nil, diffKeysFile, diffKeys))
+
+	streamed := make(DiffKeysMap)
+	assert.Nil(streamDiffKeysFile(nil, diffKeysFile, func(colId uint32, key string) error {
+		streamed[colId] = append(streamed[colId], key)
+		return nil
+	}))
+	delete(diffKeys, 9)
+	assert.Equal(diffKeys, streamed)
+
+	// Errors of the callback stop the stream
+	var numKeys int
+	stopErr := fmt.Errorf("stop")
+	assert.Equal(stopErr, streamDiffKeys(strings.NewReader(`{"0":["doc1","doc2"]}`), func(colId uint32, key string) error {
+		numKeys++
+		return stopErr
+	}))
+	assert.Equal(1, numKeys)
+
+	assert.Nil(streamDiffKeys(strings.NewReader(`null`), nil))
+	assert.NotNil(streamDiffKeys(strings.NewReader(`["doc1"]`), nil))
+	assert.NotNil(streamDiffKeys(strings.NewReader(`{"col":["doc1"]}`), nil))
+	assert.NotNil(streamDiffKeys(strings.NewReader(`{"0":["doc1"`), func(colId uint32, key string) error { return nil }))
+	fmt.Println("============== Test case end: TestStreamDiffKeys =================")
+}
+
+func TestEncodeKey(t *testing.T) {
+	fmt.Println("============== Test case start: TestEncodeKey =================")
+	assert := assert.New(t)
+
+	for _, key := range []string{"doc1", "doc\n1", "doc\x001", "\xff\xfe", "b64:doc1", "\u00e9t\u00e9"} {
+		decoded, err := base.DecodeKey(base.EncodeKey(key))
+		assert.Nil(err)
+		assert.Equal(key, decoded)
+	}
+	assert.Equal("doc1", base.EncodeKey("doc1"))
+	assert.Equal("\u00e9t\u00e9", base.EncodeKey("\u00e9t\u00e9"))
+	assert.True(strings.HasPrefix(base.EncodeKey("doc\n1"), base.KeyBase64Prefix))
+	assert.True(strings.HasPrefix(base.EncodeKey("b64:doc1"), base.KeyBase64Prefix))
+	assert.False(strings.Contains(base.TagKey([]byte("doc\n1")), "\n"))
+	_, err := base.DecodeKey(base.KeyBase64Prefix + "!")
+	assert.NotNil(err)
+
+	// Keys that are not valid UTF-8 would be replaced by U+FFFD if they were written to JSON as they are
+	diffKeysFile := "/tmp/encodedTestDiffKeys.json"
+	defer os.Remove(diffKeysFile)
+	diffKeys := DiffKeysMap{0: {"doc1", "doc\xff"}, 8: {"doc\n3"}}
+	assert.Nil(writeJsonFile(nil, diffKeysFile, diffKeys))
+	var read DiffKeysMap
+	exists, err := readJsonFile(nil, diffKeysFile, &read)
+	assert.True(exists)
+	assert.Nil(err)
+	assert.Equal(diffKeys, read)
+	streamed := make(DiffKeysMap)
+	assert.Nil(streamDiffKeysFile(nil, diffKeysFile, func(colId uint32, key string) error {
+		streamed[colId] = append(streamed[colId], key)
+		return nil
+	}))
+	assert.Equal(diffKeys, streamed)
+
+	hints := MigrationHintMap{"doc\xff": {8, 9}}
+	hintsBytes, err := json.Marshal(hints)
+	assert.Nil(err)
+	var readHints MigrationHintMap
+	assert.Nil(json.Unmarshal(hintsBytes, &readHints))
+	assert.Equal(hints, readHints)
+
+	entryBytes, err := json.Marshal([]*oneEntry{{Key: "doc\xff", Seqno: 5}})
+	assert.Nil(err)
+	var entries []map[string]interface{}
+	assert.Nil(json.Unmarshal(entryBytes, &entries))
+	assert.Equal(base.EncodeKey("doc\xff"), entries[0]["Key"])
+	assert.Equal(float64(5), entries[0]["Seqno"])
+
+	redacted := redactKeys(map[uint32]map[string]*GocbResult{8: {"doc\n1": nil}}).(map[uint32]map[string]*GocbResult)
+	_, exists = redacted[8][base.EncodeKey("doc\n1")]
+	assert.True(exists)
+	fmt.Println("============== Test case end: TestEncodeKey =================")
+}
+
+func TestStreamedDedupMatchesDedupFetchLists(t *testing.T) {
+	fmt.Println("============== Test case start: TestStreamedDedupMatchesDedupFetchLists =================")
+	assert := assert.New(t)
+
+	colIdsMap := map[uint32][]uint32{0: {0}, 8: {8, 9}}
+	reverseColIdsMap := compileReverseMap(colIdsMap)
+	srcDiffKeys := DiffKeysMap{0: {"doc1", "doc2"}, 8: {"doc3", "doc4"}}
+	tgtDiffKeys := DiffKeysMap{0: {"doc2", "doc5"}, 9: {"doc3", "doc6"}}
+
+	srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(colIdsMap, nil)
+	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(reverseColIdsMap, nil)
+	expected := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
+
+	// Source entries one at a time, indexing only those of keys the target has, as streamAndDiff does
+	var streamed MutationDiffFetchList
+	combinedFetchIdx := make(MutationDiffFetchListIdx)
+	for _, srcFetchEntry := range srcPovFetchList {
+		combinedEntry := combineWithTargetEntries(srcFetchEntry, tgtPovFetchIdx)
+		if _, exists := tgtPovFetchIdx[combinedEntry.Key]; exists {
+			combinedFetchIdx.AddEntry(combinedEntry)
+		}
+		streamed = append(streamed, combinedEntry)
+	}
+	addUncoveredTargetEntries(tgtPovFetchList, combinedFetchIdx, func(entry *MutationDifferFetchEntry) {
+		streamed = append(streamed, entry)
+	})
+	assert.Equal(expected, streamed)
+	fmt.Println("============== Test case end: TestStreamedDedupMatchesDedupFetchLists =================")
+}
+
+func TestPartitionedDiffKeysMatchDedupFetchLists(t *testing.T) {
+	fmt.Println("============== Test case start: TestPartitionedDiffKeysMatchDedupFetchLists =================")
+	assert := assert.New(t)
+	dir := t.TempDir()
+	key, err := utils.ParseDataFileEncryptionKey(strings.Repeat("0123456789abcdef", 4))
+	assert.Nil(err)
+
+	colIdsMap := map[uint32][]uint32{0: {0}, 8: {8, 9}}
+	differ := &MutationDiffer{colIdsMap: colIdsMap, reverseTgtColIdsMap: compileReverseMap(colIdsMap), encryptionKey: key}
+	srcDiffKeys := make(DiffKeysMap)
+	tgtDiffKeys := make(DiffKeysMap)
+	for i := 0; i < 200; i++ {
+		srcDiffKeys[uint32(i%2*8)] = append(srcDiffKeys[uint32(i%2*8)], fmt.Sprintf("doc\n%v", i))
+		if i%3 == 0 {
+			tgtDiffKeys[uint32(i%2*9)] = append(tgtDiffKeys[uint32(i%2*9)], fmt.Sprintf("doc\n%v", i))
+		}
+		tgtDiffKeys[0] = append(tgtDiffKeys[0], fmt.Sprintf("tgtOnly%v", i))
+	}
+	srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(differ.colIdsMap, nil)
+	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(differ.reverseTgtColIdsMap, nil)
+	expected := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
+
+	srcFileName := utils.JoinPath(dir, "srcDiffKeys")
+	tgtFileName := utils.JoinPath(dir, "tgtDiffKeys")
+	for fileName, diffKeys := range map[string]DiffKeysMap{srcFileName: srcDiffKeys, tgtFileName: tgtDiffKeys} {
+		diffKeysBytes, err := json.Marshal(diffKeys)
+		assert.Nil(err)
+		assert.Nil(utils.WriteDataFile(key, fileName, diffKeysBytes, base.FileModeReadWrite))
+	}
+
+	partitionDir := utils.JoinPath(dir, base.DiffKeysPartitionDirName)
+	for _, partitionBytes := range []int64{base.MutationDifferTgtDiffKeysPartitionBytes, 512} {
+		partitions, err := differ.partitionDiffKeys([]string{srcFileName}, []string{tgtFileName}, partitionDir, partitionBytes)
+		assert.Nil(err)
+		if partitionBytes == 512 {
+			assert.True(len(partitions) > 1)
+		} else {
+			assert.Len(partitions, 1)
+		}
+		var streamed MutationDiffFetchList
+		for _, partition := range partitions {
+			assert.Nil(differ.sendPartitionFetchEntries(partition, func(entry *MutationDifferFetchEntry) {
+				streamed = append(streamed, entry)
+			}))
+		}
+		assert.ElementsMatch(expected, streamed)
+	}
+	fmt.Println("============== Test case end: TestPartitionedDiffKeysMatchDedupFetchLists =================")
+}
+
+func TestBatchRangesByKvNode(t *testing.T) {
+	fmt.Println("============== Test case start: TestBatchRangesByKvNode =================")
+	assert := assert.New(t)
+
+	differ := &MutationDiffer{batchSize: 3, srcVbKvNodes: make(map[uint16]string)}
+	for vbno := uint16(0); vbno < base.NumberOfVbuckets; vbno++ {
+		differ.srcVbKvNodes[vbno] = fmt.Sprintf("node%v", vbno%3)
+	}
+	dw := &DifferWorker{differ: differ}
+	keys := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("doc%v", i)
+		keys[key] = true
+		dw.fetchList = append(dw.fetchList, &MutationDifferFetchEntry{Key: key})
+	}
+
+	kvNodeOf := func(key string) string {
+		return differ.srcVbKvNodes[utils.GetVbucketFromKey([]byte(key))]
+	}
+	kvNodeBatches := dw.batchRangesByKvNode()
+	assert.Len(dw.fetchList, len(keys))
+	nextIndex := 0
+	for _, batchRanges := range kvNodeBatches {
+		assert.NotEmpty(batchRanges)
+		kvNode := kvNodeOf(dw.fetchList[batchRanges[0][0]].Key)
+		for _, batchRange := range batchRanges {
+			// The batches of each node cover the fetch list in order, and are full but for the last one
+			assert.Equal(nextIndex, batchRange[0])
+			assert.True(batchRange[1]-batchRange[0] <= differ.batchSize)
+			for _, fetchItem := range dw.fetchList[batchRange[0]:batchRange[1]] {
+				assert.Equal(kvNode, kvNodeOf(fetchItem.Key))
+				assert.True(keys[fetchItem.Key])
+				delete(keys, fetchItem.Key)
+			}
+			nextIndex = batchRange[1]
+		}
+		for _, batchRange := range batchRanges[:len(batchRanges)-1] {
+			assert.Equal(differ.batchSize, batchRange[1]-batchRange[0])
+		}
+	}
+	assert.Equal(len(dw.fetchList), nextIndex)
+	assert.Empty(keys)
+	fmt.Println("============== Test case end: TestBatchRangesByKvNode =================")
+}
+
+func TestWriteUnverifiedDiffKeys(t *testing.T) {
+	fmt.Println("============== Test case start: TestWriteUnverifiedDiffKeys =================")
+	assert := assert.New(t)
+	workDir, err := ioutil.TempDir("", "unverifiedDiffKeysTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	differ := &MutationDiffer{
+		stateLock:      &sync.RWMutex{},
+		unverifiedKeys: []*UnverifiedKey{{MutationDifferFetchEntry: &MutationDifferFetchEntry{SrcColId: 8, TgtColIds: []uint32{9}, Key: "key0"}, Error: "timeout"}},
+	}
+	skipped := MutationDiffFetchList{{SrcColId: 8, TgtColIds: []uint32{9}, Key: "key1"}, {SrcColId: 8, TgtColIds: []uint32{9}, Key: "key0"}}
+	// Keys skipped before the deadline are keys with errors
+	differ.addSkippedKeys(skipped[:1])
+	assert.Len(differ.keysWithError, 1)
+	assert.Len(differ.unverifiedKeys, 1)
+
+	atomic.StoreUint32(&differ.deadlineReached, 1)
+	assert.True(differ.DeadlineReached())
+	differ.addSkippedKeys(skipped)
+	assert.Len(differ.keysWithError, 1)
+	assert.Len(differ.unverifiedKeys, 3)
+	assert.Equal(base.MutationDifferMaxDurationError, differ.unverifiedKeys[2].Error)
+
+	dir := workDir + base.FileDirDelimiter + base.UnverifiedDiffKeysDirName
+	numKeys, err := differ.WriteUnverifiedDiffKeys(dir)
+	assert.Nil(err)
+	assert.Equal(2, numKeys)
+
+	var diffKeys DiffKeysMap
+	_, err = readJsonFile(nil, utils.DiffKeysFileName(true, dir, base.DiffKeysFileName), &diffKeys)
+	assert.Nil(err)
+	assert.Equal(DiffKeysMap{8: {"key0", "key1"}}, diffKeys)
+	diffKeys = nil
+	exists, err := readJsonFile(nil, utils.DiffKeysFileName(false, dir, base.DiffKeysFileName), &diffKeys)
+	assert.Nil(err)
+	assert.True(exists)
+	assert.Empty(diffKeys)
+	fmt.Println("============== Test case end: TestWriteUnverifiedDiffKeys =================")
+}
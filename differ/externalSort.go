@@ -0,0 +1,381 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Rough number of bytes an entry holds in memory on top of its key, used to size the sorted runs
+const entryMemoryOverhead = 256
+
+const sortedRunFilePrefix = "run"
+const sortedColFilePrefix = "col"
+
+// Iterates over the entries of one collection in key order
+type entryIterator interface {
+	// Returns nil once there are no more entries or reading failed
+	next() *oneEntry
+	// Returns the error that stopped the iteration, if any
+	err() error
+	close() error
+}
+
+type sliceEntryIterator struct {
+	entries []*oneEntry
+	idx     int
+}
+
+func (it *sliceEntryIterator) next() *oneEntry {
+	if it.idx >= len(it.entries) {
+		return nil
+	}
+	entry := it.entries[it.idx]
+	it.idx++
+	return entry
+}
+
+func (it *sliceEntryIterator) err() error {
+	return nil
+}
+
+func (it *sliceEntryIterator) close() error {
+	return nil
+}
+
+type fileEntryIterator struct {
+	file    *os.File
+	reader  *bufio.Reader
+	readErr error
+}
+
+func newFileEntryIterator(encryptionKey []byte, fileName string) (*fileEntryIterator, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := utils.NewDataFileReader(encryptionKey, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileEntryIterator{
+		file:   file,
+		reader: bufio.NewReader(reader),
+	}, nil
+}
+
+func (it *fileEntryIterator) readOp(p []byte) (int, error) {
+	return io.ReadFull(it.reader, p)
+}
+
+func (it *fileEntryIterator) next() *oneEntry {
+	if it.readErr != nil {
+		return nil
+	}
+	entry, err := getOneEntry(it.readOp, false)
+	if err != nil {
+		if !strings.Contains(err.Error(), io.EOF.Error()) {
+			it.readErr = err
+		}
+		return nil
+	}
+	return entry
+}
+
+func (it *fileEntryIterator) err() error {
+	return it.readErr
+}
+
+func (it *fileEntryIterator) close() error {
+	return it.file.Close()
+}
+
+// Serializes the entry in the same layout as the DCP data files so that getOneEntry can read it back
+func (entry *oneEntry) serialize() []byte {
+	keyLen := len(entry.Key)
+	ret := make([]byte, base.GetFixedSizeMutationLen(keyLen, entry.ColFiltersMatched))
+
+	pos := 0
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(keyLen))
+	pos += 2
+	copy(ret[pos:pos+keyLen], entry.Key)
+	pos += keyLen
+	binary.BigEndian.PutUint64(ret[pos:pos+8], entry.Seqno)
+	pos += 8
+	binary.BigEndian.PutUint64(ret[pos:pos+8], entry.RevId)
+	pos += 8
+	binary.BigEndian.PutUint64(ret[pos:pos+8], entry.Cas)
+	pos += 8
+	binary.BigEndian.PutUint32(ret[pos:pos+4], entry.Flags)
+	pos += 4
+	binary.BigEndian.PutUint32(ret[pos:pos+4], entry.Expiry)
+	pos += 4
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(entry.OpCode))
+	pos += 2
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(entry.Datatype))
+	pos += 2
+	copy(ret[pos:], entry.BodyHash[:])
+	pos += len(entry.BodyHash)
+	binary.BigEndian.PutUint32(ret[pos:pos+4], entry.ColId)
+	pos += 4
+	binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(len(entry.ColFiltersMatched)))
+	pos += 2
+	for _, colFilterId := range entry.ColFiltersMatched {
+		binary.BigEndian.PutUint16(ret[pos:pos+2], uint16(colFilterId))
+		pos += 2
+	}
+	return ret
+}
+
+// Orders by collection, then key, and puts the newest seqno of a key first so that deduping keeps it
+func entryLess(a, b *oneEntry) bool {
+	if a.ColId != b.ColId {
+		return a.ColId < b.ColId
+	}
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Seqno > b.Seqno
+}
+
+func writeEntriesToFile(encryptionKey []byte, fileName string, entries []*oneEntry) error {
+	return writeEntriesToFileWithFlag(encryptionKey, fileName, os.O_TRUNC, entries)
+}
+
+func appendEntriesToFile(encryptionKey []byte, fileName string, entries []*oneEntry) error {
+	return writeEntriesToFileWithFlag(encryptionKey, fileName, os.O_APPEND, entries)
+}
+
+func writeEntriesToFileWithFlag(encryptionKey []byte, fileName string, flag int, entries []*oneEntry) error {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|flag, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Blocks appended to an encrypted file are numbered after the ones already in it
+	var numBlocks uint64
+	if flag == os.O_APPEND && encryptionKey != nil {
+		numBlocks, err = utils.CountDataFileBlocks(file)
+		if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+	}
+	encrypter := utils.NewDataFileAppender(encryptionKey, file, numBlocks)
+	writer := bufio.NewWriter(encrypter)
+	for _, entry := range entries {
+		_, err = writer.Write(entry.serialize())
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
+// Reads the file in chunks that fit within the memory budget, writing each chunk out as a sorted run,
+// and then merges the runs into one sorted and deduped file per collection
+func (attr *FileAttributes) sortExternally() error {
+	var err error
+	attr.sortDir, err = ioutil.TempDir(attr.tmpDir, filepath.Base(attr.name))
+	if err != nil {
+		return err
+	}
+
+	var runFiles []string
+	var chunk []*oneEntry
+	var chunkSize int64
+
+	flushChunk := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		sort.Slice(chunk, func(i, j int) bool { return entryLess(chunk[i], chunk[j]) })
+		runFileName := filepath.Join(attr.sortDir, fmt.Sprintf("%v_%v", sortedRunFilePrefix, len(runFiles)))
+		err := writeEntriesToFile(attr.encryptionKey, runFileName, chunk)
+		if err != nil {
+			return err
+		}
+		runFiles = append(runFiles, runFileName)
+		chunk = nil
+		chunkSize = 0
+		return nil
+	}
+
+	for {
+		entry, err := getOneEntry(attr.readOp, base.IsCompactMutationLayout(attr.hashAlgorithm))
+		if err != nil {
+			if strings.Contains(err.Error(), io.EOF.Error()) {
+				break
+			}
+			return err
+		}
+		chunk = append(chunk, entry)
+		chunkSize += int64(len(entry.Key)) + entryMemoryOverhead
+		if chunkSize >= attr.memoryBudget {
+			err = flushChunk()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = flushChunk()
+	if err != nil {
+		return err
+	}
+
+	return attr.mergeRuns(runFiles)
+}
+
+type runHeapItem struct {
+	entry *oneEntry
+	run   *fileEntryIterator
+}
+
+type runHeap []*runHeapItem
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return entryLess(h[i].entry, h[j].entry) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runHeapItem)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+type sortedColWriter struct {
+	file      *os.File
+	encrypter io.WriteCloser
+	writer    *bufio.Writer
+}
+
+// K-way merge of the sorted runs. Only the first, and thus newest, entry of each key is kept
+func (attr *FileAttributes) mergeRuns(runFiles []string) error {
+	h := &runHeap{}
+	var runs []*fileEntryIterator
+	defer func() {
+		for _, run := range runs {
+			run.close()
+		}
+		for _, runFileName := range runFiles {
+			os.Remove(runFileName)
+		}
+	}()
+
+	for _, runFileName := range runFiles {
+		run, err := newFileEntryIterator(attr.encryptionKey, runFileName)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		entry := run.next()
+		if run.err() != nil {
+			return run.err()
+		}
+		if entry != nil {
+			heap.Push(h, &runHeapItem{entry: entry, run: run})
+		}
+	}
+
+	colWriters := make(map[uint32]*sortedColWriter)
+	defer func() {
+		for _, colWriter := range colWriters {
+			colWriter.file.Close()
+		}
+	}()
+
+	var lastEntry *oneEntry
+	for h.Len() > 0 {
+		item := heap.Pop(h).(*runHeapItem)
+		entry := item.entry
+
+		if lastEntry == nil || lastEntry.ColId != entry.ColId || lastEntry.Key != entry.Key {
+			colWriter, exists := colWriters[entry.ColId]
+			if !exists {
+				fileName := filepath.Join(attr.sortDir, fmt.Sprintf("%v_%v", sortedColFilePrefix, entry.ColId))
+				file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+				if err != nil {
+					return err
+				}
+				encrypter := utils.NewDataFileEncrypter(attr.encryptionKey, file)
+				colWriter = &sortedColWriter{file: file, encrypter: encrypter, writer: bufio.NewWriter(encrypter)}
+				colWriters[entry.ColId] = colWriter
+				attr.sortedColFiles[entry.ColId] = fileName
+			}
+			_, err := colWriter.writer.Write(entry.serialize())
+			if err != nil {
+				return err
+			}
+			attr.itemCount++
+			lastEntry = entry
+		}
+
+		nextEntry := item.run.next()
+		if item.run.err() != nil {
+			return item.run.err()
+		}
+		if nextEntry != nil {
+			item.entry = nextEntry
+			heap.Push(h, item)
+		}
+	}
+
+	for _, colWriter := range colWriters {
+		err := colWriter.writer.Flush()
+		if err != nil {
+			return err
+		}
+		err = colWriter.encrypter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns an iterator over the sorted entries of the given collection, whether they were sorted
+// in memory, externally or by a store
+func (attr *FileAttributes) iterator(colId uint32) (entryIterator, error) {
+	if attr.store != nil {
+		return attr.store.iterator(attr.vbno, colId), nil
+	}
+	if attr.sortDir == "" {
+		return &sliceEntryIterator{entries: attr.sortedEntries[colId]}, nil
+	}
+	fileName, exists := attr.sortedColFiles[colId]
+	if !exists {
+		return &sliceEntryIterator{}, nil
+	}
+	return newFileEntryIterator(attr.encryptionKey, fileName)
+}
+
+func (attr *FileAttributes) cleanupSortedFiles() {
+	if attr.sortDir != "" {
+		os.RemoveAll(attr.sortDir)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/couchbase/gocbcore/v9"
+)
+
+// Must be called before Run()
+// When set, JSON bodies are considered the same if they hold the same values, regardless of key order and whitespace
+func (d *MutationDiffer) SetJsonAwareBodyCompare(jsonAware bool) {
+	d.jsonAwareBodyCompare = jsonAware
+}
+
+// Numbers are kept as written, so that large integers are not rounded through float64
+func unmarshalJsonBody(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+// Binary bodies, and bodies that are not valid JSON, are always compared byte for byte
+func areBodiesTheSame(result1, result2 *gocbcore.GetResult, jsonAware bool) bool {
+	if areRawBodiesTheSame(result1.Value, result2.Value) {
+		return true
+	}
+	if !jsonAware || isBinaryDatatype(result1.Datatype) || isBinaryDatatype(result2.Datatype) {
+		return false
+	}
+
+	value1, err := unmarshalJsonBody(result1.Value)
+	if err != nil {
+		return false
+	}
+	value2, err := unmarshalJsonBody(result2.Value)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(value1, value2)
+}
+
+func areGetResultsJsonBodyTheSame(result1Raw, result2Raw interface{}) bool {
+	result1 := result1Raw.(*gocbcore.GetResult)
+	result2 := result2Raw.(*gocbcore.GetResult)
+
+	if result1 == nil {
+		return result2 == nil
+	}
+	if result2 == nil {
+		return false
+	}
+
+	return areBodiesTheSame(result1, result2, true)
+}
+
+func areGetResultsJsonAwareTheSame(result1Raw, result2Raw interface{}) bool {
+	return areGetResultsJsonBodyTheSame(result1Raw, result2Raw) && areGetResultsMetaTheSame(result1Raw, result2Raw)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Fields that diverged between the JSON bodies of a mismatched doc, as JSON Pointer paths, i.e. /address/city or
+// /tags/0. The path of the whole body is the empty string
+type JsonFieldDiff struct {
+	// Only in the target body
+	Added []string `json:",omitempty"`
+	// Only in the source body
+	Removed []string `json:",omitempty"`
+	// In both bodies, with different values or types
+	Changed []string `json:",omitempty"`
+}
+
+func (diff *JsonFieldDiff) isEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+// Escapes a field name into a JSON Pointer reference token
+func jsonPointerToken(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// Objects are compared field by field and arrays element by element. Anything else differs as a whole
+func diffJsonValues(path string, srcValue, tgtValue interface{}, diff *JsonFieldDiff) {
+	switch src := srcValue.(type) {
+	case map[string]interface{}:
+		tgt, ok := tgtValue.(map[string]interface{})
+		if !ok {
+			break
+		}
+		names := make([]string, 0, len(src)+len(tgt))
+		for name := range src {
+			names = append(names, name)
+		}
+		for name := range tgt {
+			if _, exists := src[name]; !exists {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fieldPath := path + "/" + jsonPointerToken(name)
+			srcField, inSrc := src[name]
+			tgtField, inTgt := tgt[name]
+			switch {
+			case !inTgt:
+				diff.Removed = append(diff.Removed, fieldPath)
+			case !inSrc:
+				diff.Added = append(diff.Added, fieldPath)
+			default:
+				diffJsonValues(fieldPath, srcField, tgtField, diff)
+			}
+		}
+		return
+	case []interface{}:
+		tgt, ok := tgtValue.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(src) || i < len(tgt); i++ {
+			elemPath := fmt.Sprintf("%v/%v", path, i)
+			switch {
+			case i >= len(tgt):
+				diff.Removed = append(diff.Removed, elemPath)
+			case i >= len(src):
+				diff.Added = append(diff.Added, elemPath)
+			default:
+				diffJsonValues(elemPath, src[i], tgt[i], diff)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(srcValue, tgtValue) {
+		diff.Changed = append(diff.Changed, path)
+	}
+}
+
+// Returns the fields that diverged between the bodies of the source and target results, or nil if either side is
+// missing its body, is binary or is not valid JSON, or if the bodies hold the same values, e.g. only their key
+// order or whitespace differs
+func jsonFieldDiff(srcResult, tgtResult *GocbResult) *JsonFieldDiff {
+	if srcResult == nil || tgtResult == nil || srcResult.GetResult == nil || tgtResult.GetResult == nil {
+		return nil
+	}
+	src := srcResult.GetResult
+	tgt := tgtResult.GetResult
+	if isBinaryDatatype(src.Datatype) || isBinaryDatatype(tgt.Datatype) {
+		return nil
+	}
+	srcValue, err := unmarshalJsonBody(src.Value)
+	if err != nil {
+		return nil
+	}
+	tgtValue, err := unmarshalJsonBody(tgt.Value)
+	if err != nil {
+		return nil
+	}
+
+	diff := &JsonFieldDiff{}
+	diffJsonValues("", srcValue, tgtValue, diff)
+	if diff.isEmpty() {
+		return nil
+	}
+	// Field names are user data
+	for _, paths := range [][]string{diff.Added, diff.Removed, diff.Changed} {
+		for i, path := range paths {
+			paths[i] = base.TagUD(path)
+		}
+	}
+	return diff
+}
+
+// The field diff of a record, only set for mismatches
+func recordFieldDiff(category string, results []*GocbResult) *JsonFieldDiff {
+	if category != "Mismatch" || len(results) < 2 {
+		return nil
+	}
+	return jsonFieldDiff(results[0], results[1])
+}
+
+// For mismatched docs whose bodies are both JSON, the fields that diverged
+func (d *MutationDiffer) compileJsonFieldDiffs() map[uint32]map[string]*JsonFieldDiff {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+
+	diffs := make(map[uint32]map[string]*JsonFieldDiff)
+	for colId, srcDiffPerCol := range d.srcDiff {
+		for key, pair := range srcDiffPerCol {
+			diff := recordFieldDiff("Mismatch", pair)
+			if diff == nil {
+				continue
+			}
+			if _, exists := diffs[colId]; !exists {
+				diffs[colId] = make(map[string]*JsonFieldDiff)
+			}
+			diffs[colId][key] = diff
+		}
+	}
+	return diffs
+}
+
+func (d *MutationDiffer) writeJsonFieldDetails() error {
+	if d.compareType == base.MutationCompareTypeMetadata {
+		// Bodies are not fetched
+		return nil
+	}
+
+	diffs := d.compileJsonFieldDiffs()
+	var count int
+	for _, diffsPerCol := range diffs {
+		count += len(diffsPerCol)
+	}
+	if count > 0 {
+		d.logger.Infof("%v mismatched docs have JSON fields that diverged. Their paths are written to %v", count, base.MutationDiffJsonFieldDetailsFileName)
+	}
+
+	diffsBytes, err := json.Marshal(redactKeys(diffs))
+	if err != nil {
+		return err
+	}
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffJsonFieldDetailsFileName)
+	return utils.WriteDataFile(d.encryptionKey, fileName, diffsBytes, base.FileModeReadWrite)
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/couchbase/gocbcore/v9"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// A key that could not be fetched, along with the last error seen
+type UnverifiedKey struct {
+	*MutationDifferFetchEntry
+	Error string
+}
+
+// Errors that may go away when the same key is fetched again
+func isTransientKVError(err error) bool {
+	return errors.Is(err, gocbcore.ErrTimeout) || errors.Is(err, gocbcore.ErrTemporaryFailure) ||
+		errors.Is(err, gocbcore.ErrOverload)
+}
+
+// Any error other than the key not being found means that the key cannot be diffed
+func isFetchError(err error) bool {
+	return err != nil && !isKeyNotFoundError(err)
+}
+
+// Returns the first error that prevents the entry from being diffed, from either side
+func (dw *DifferWorker) getFetchError(fetchItem *MutationDifferFetchEntry) error {
+	if result, exists := dw.sourceResults[fetchItem.SrcColId][fetchItem.Key]; exists && isFetchError(result.Error()) {
+		return result.Error()
+	}
+	for _, tgtColId := range fetchItem.TgtColIds {
+		if result, exists := dw.targetResults[tgtColId][fetchItem.Key]; exists && isFetchError(result.Error()) {
+			return result.Error()
+		}
+	}
+	return nil
+}
+
+// Keys of the batch that failed on either side are fetched again, using the same backoff as the batches,
+// for as long as the errors are transient. Keys that still fail are recorded as unverified and left out
+// of the diff, instead of being reported as differences
+func (dw *DifferWorker) retryKeysWithErrors(fetchList MutationDiffFetchList) {
+	getFailedEntries := func(entries MutationDiffFetchList) (MutationDiffFetchList, MutationDiffFetchList) {
+		var transient, permanent MutationDiffFetchList
+		for _, fetchItem := range entries {
+			err := dw.getFetchError(fetchItem)
+			if err == nil {
+				continue
+			}
+			if isTransientKVError(err) {
+				transient = append(transient, fetchItem)
+			} else {
+				permanent = append(permanent, fetchItem)
+			}
+		}
+		return transient, permanent
+	}
+
+	toRetry, failed := getFailedEntries(fetchList)
+	if len(toRetry) > 0 {
+		retryFunc := func() error {
+			batch := newBatchFromFetchList(dw, toRetry)
+			err := batch.send()
+			if err != nil {
+				return err
+			}
+			dw.mergeResults(batch)
+			var permanent MutationDiffFetchList
+			toRetry, permanent = getFailedEntries(toRetry)
+			failed = append(failed, permanent...)
+			if len(toRetry) > 0 {
+				return fmt.Errorf("%v keys failed with transient errors", len(toRetry))
+			}
+			return nil
+		}
+		opErr := utils.ExponentialBackoffExecutorWithContext(dw.ctx, "retryKeysWithErrors", dw.differ.sendBatchRetryInterval, dw.differ.maxNumOfSendBatchRetry,
+			base.SendBatchBackoffFactor, dw.differ.sendBatchMaxBackoff, retryFunc)
+		if opErr != nil {
+			failed = append(failed, toRetry...)
+		}
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+	dw.logger.Warnf("Unable to fetch %v keys after retrying. They are recorded as unverified\n", len(failed))
+	unverifiedKeys := make([]*UnverifiedKey, 0, len(failed))
+	for _, fetchItem := range failed {
+		unverifiedKey := &UnverifiedKey{MutationDifferFetchEntry: fetchItem}
+		if err := dw.getFetchError(fetchItem); err != nil {
+			unverifiedKey.Error = err.Error()
+		}
+		unverifiedKeys = append(unverifiedKeys, unverifiedKey)
+		// Leave the key out of the diff on both sides
+		delete(dw.sourceResults[fetchItem.SrcColId], fetchItem.Key)
+		for _, tgtColId := range fetchItem.TgtColIds {
+			delete(dw.targetResults[tgtColId], fetchItem.Key)
+		}
+	}
+	dw.differ.addUnverifiedKeys(unverifiedKeys)
+}
+
+func (d *MutationDiffer) addUnverifiedKeys(unverifiedKeys []*UnverifiedKey) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.unverifiedKeys = append(d.unverifiedKeys, unverifiedKeys...)
+	atomic.AddUint32(&d.numKeysUnverified, uint32(len(unverifiedKeys)))
+}
+
+func (d *MutationDiffer) writeUnverifiedKeys() error {
+	d.stateLock.RLock()
+	unverifiedKeys := make([]*UnverifiedKey, len(d.unverifiedKeys))
+	for i, unverifiedKey := range d.unverifiedKeys {
+		unverifiedKeys[i] = &UnverifiedKey{MutationDifferFetchEntry: unverifiedKey.withEncodedKey(), Error: unverifiedKey.Error}
+	}
+	d.stateLock.RUnlock()
+	unverifiedKeysBytes, err := json.Marshal(unverifiedKeys)
+	if err != nil {
+		return err
+	}
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffUnverifiedKeysFileName)
+	return utils.WriteDataFile(d.encryptionKey, fileName, unverifiedKeysBytes, base.FileModeReadWrite)
+}
+
+// Writes the keys recorded as unverified as the source diff keys files of dir, along with empty target ones, so that a
+// follow-up run given dir as its fileDifferDir only verifies them. Returns the number of keys written
+func (d *MutationDiffer) WriteUnverifiedDiffKeys(dir string) (int, error) {
+	srcDiffKeys := make(DiffKeysMap)
+	seen := make(map[uint32]map[string]bool)
+	d.stateLock.RLock()
+	for _, unverifiedKey := range d.unverifiedKeys {
+		if seen[unverifiedKey.SrcColId] == nil {
+			seen[unverifiedKey.SrcColId] = make(map[string]bool)
+		}
+		if seen[unverifiedKey.SrcColId][unverifiedKey.Key] {
+			continue
+		}
+		seen[unverifiedKey.SrcColId][unverifiedKey.Key] = true
+		srcDiffKeys[unverifiedKey.SrcColId] = append(srcDiffKeys[unverifiedKey.SrcColId], unverifiedKey.Key)
+	}
+	d.stateLock.RUnlock()
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return 0, err
+	}
+	for i, diffKeys := range []DiffKeysMap{srcDiffKeys, make(DiffKeysMap)} {
+		diffKeysBytes, err := json.Marshal(diffKeys)
+		if err != nil {
+			return 0, err
+		}
+		diffKeysFileName := utils.DiffKeysFileName(i == 0, dir, base.DiffKeysFileName)
+		err = utils.WriteDataFile(d.encryptionKey, diffKeysFileName, diffKeysBytes, base.FileModeReadWrite)
+		if err != nil {
+			return 0, err
+		}
+		err = diffKeys.WritePerCollection(d.encryptionKey, diffKeysFileName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return srcDiffKeys.GetTotalCount(), nil
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"xdcrDiffer/base"
+)
+
+// Records are keyed by
+//
+//	vbno  - 2 bytes
+//	colId - 4 bytes
+//	key   - the rest
+//
+// so that the records of a vbucket, and of each collection within it, are adjacent and ordered by key
+const kvStoreVbPrefixLen = 2
+const kvStoreColPrefixLen = 6
+
+// Vbnos are below 0xFF00, so this is never mistaken for a record
+var kvStoreHashAlgorithmKey = []byte("\xff\xffhashAlgorithm")
+
+// An embedded, ordered key value store
+type kvBackend interface {
+	set(key, value []byte) error
+	delete(key []byte) error
+	// Returns nil if the key does not exist
+	get(key []byte) ([]byte, error)
+	// Makes the sets and deletes so far visible to get and the iterators
+	flush() error
+	// Iterates over the keys that start with prefix, in order. Values are not read unless withValues is set
+	newIterator(prefix []byte, withValues bool) kvIterator
+	close() error
+}
+
+type kvIterator interface {
+	// Moves to the first key on the first call, and to the next one after that. Returns false past the last key
+	next() bool
+	key() []byte
+	value() ([]byte, error)
+	close()
+}
+
+// KVStore keeps the mutation records of one cluster in an embedded key value store, in place of the data files
+// Each record replaces the older record of its key as it is added, and the records of a collection of a vbucket are
+// read back in key order, so the file differ neither dedups nor sorts, and numberOfBins and the file descriptor pool
+// do not apply. The store is kept across runs, so a resumed run only streams the mutations since the checkpoint
+// Implements dcp.MutationSink and dcp.MutationTruncater
+type KVStore struct {
+	dir     string
+	backend kvBackend
+	// Empty until the first mutations are added
+	hashAlgorithm string
+}
+
+// Opens the store of the given base.DataStores backend under dir, creating it if needed
+func OpenKVStore(backendName, dir string) (*KVStore, error) {
+	var backend kvBackend
+	var err error
+	switch backendName {
+	case base.DataStoreBadger:
+		backend, err = openBadgerBackend(dir)
+	default:
+		return nil, fmt.Errorf("%v is not an embedded data store", backendName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hashAlgorithm, err := backend.get(kvStoreHashAlgorithmKey)
+	if err != nil {
+		backend.close()
+		return nil, err
+	}
+	return &KVStore{
+		dir:           dir,
+		backend:       backend,
+		hashAlgorithm: string(hashAlgorithm),
+	}, nil
+}
+
+// Must be called before adding mutations. As with data files, a store that holds hashes of one algorithm cannot
+// be added to with hashes of another
+func (s *KVStore) CheckHashAlgorithm(hashAlgorithm string) error {
+	if s.hashAlgorithm == "" {
+		err := s.backend.set(kvStoreHashAlgorithmKey, []byte(hashAlgorithm))
+		if err != nil {
+			return err
+		}
+		s.hashAlgorithm = hashAlgorithm
+		return s.backend.flush()
+	}
+	if s.hashAlgorithm != hashAlgorithm {
+		return fmt.Errorf("%v holds %v hashes, which cannot be added to with %v hashes", s.dir, s.hashAlgorithm, hashAlgorithm)
+	}
+	return nil
+}
+
+// Takes a mutation serialized by the DCP handler, the same format as what is written into data files
+// The mutations of a vbucket are streamed in seqno order, so the record added last is the newest
+func (s *KVStore) AddMutation(isSource bool, vbno uint16, serializedMut []byte) error {
+	entry, err := getOneEntry(bytes.NewReader(serializedMut).Read, false)
+	if err != nil {
+		return err
+	}
+	return s.backend.set(kvStoreKey(vbno, entry.ColId, entry.Key), serializedMut)
+}
+
+// Removes the records of the vbucket that are after seqno, which the stream will send again from there
+func (s *KVStore) TruncateVb(vbno uint16, seqno uint64) error {
+	err := s.backend.flush()
+	if err != nil {
+		return err
+	}
+	iter := s.backend.newIterator(kvStoreVbPrefix(vbno), true)
+	defer iter.close()
+	for iter.next() {
+		value, err := iter.value()
+		if err != nil {
+			return err
+		}
+		entry, err := getOneEntry(bytes.NewReader(value).Read, false)
+		if err != nil {
+			return fmt.Errorf("%v vb %v: %v", s.dir, vbno, err)
+		}
+		if entry.Seqno > seqno {
+			err = s.backend.delete(iter.key())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.backend.flush()
+}
+
+// Makes the mutations added so far readable
+func (s *KVStore) Flush() error {
+	return s.backend.flush()
+}
+
+func (s *KVStore) Close() error {
+	err := s.backend.flush()
+	closeErr := s.backend.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (s *KVStore) vbName(vbno uint16) string {
+	return fmt.Sprintf("%v vb %v", s.dir, vbno)
+}
+
+func (s *KVStore) countVb(vbno uint16) int {
+	var count int
+	iter := s.backend.newIterator(kvStoreVbPrefix(vbno), false)
+	defer iter.close()
+	for iter.next() {
+		count++
+	}
+	return count
+}
+
+func (s *KVStore) iterator(vbno uint16, colId uint32) entryIterator {
+	return &kvEntryIterator{iter: s.backend.newIterator(kvStoreColPrefix(vbno, colId), true)}
+}
+
+type kvEntryIterator struct {
+	iter    kvIterator
+	readErr error
+}
+
+func (it *kvEntryIterator) next() *oneEntry {
+	if it.readErr != nil || !it.iter.next() {
+		return nil
+	}
+	value, err := it.iter.value()
+	if err != nil {
+		it.readErr = err
+		return nil
+	}
+	entry, err := getOneEntry(bytes.NewReader(value).Read, false)
+	if err != nil {
+		it.readErr = err
+		return nil
+	}
+	return entry
+}
+
+func (it *kvEntryIterator) err() error {
+	return it.readErr
+}
+
+func (it *kvEntryIterator) close() error {
+	it.iter.close()
+	return nil
+}
+
+func kvStoreVbPrefix(vbno uint16) []byte {
+	prefix := make([]byte, kvStoreVbPrefixLen)
+	binary.BigEndian.PutUint16(prefix, vbno)
+	return prefix
+}
+
+func kvStoreColPrefix(vbno uint16, colId uint32) []byte {
+	prefix := make([]byte, kvStoreColPrefixLen)
+	binary.BigEndian.PutUint16(prefix[0:kvStoreVbPrefixLen], vbno)
+	binary.BigEndian.PutUint32(prefix[kvStoreVbPrefixLen:], colId)
+	return prefix
+}
+
+func kvStoreKey(vbno uint16, colId uint32, key string) []byte {
+	return append(kvStoreColPrefix(vbno, colId), key...)
+}
+
+// Diffs the records of a vbucket in the source and target stores, the same way as the files differ diffs a pair
+// of data files
+func NewKVStoresDiffer(sourceStore, targetStore *KVStore, vbno uint16, collectionMapping map[uint32][]uint32, colFilterStrings []string, colFilterTgtIds []uint32) *FilesDiffer {
+	differ := NewFilesDiffer(sourceStore.vbName(vbno), targetStore.vbName(vbno), collectionMapping, colFilterStrings, colFilterTgtIds)
+	differ.file1.store = sourceStore
+	differ.file1.vbno = vbno
+	differ.file2.store = targetStore
+	differ.file2.vbno = vbno
+	return differ
+}
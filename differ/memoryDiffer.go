@@ -0,0 +1,411 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// The join key is the target side's point of view, since a source collection may map to multiple target collections
+type memoryJoinKey struct {
+	tgtColId uint32
+	key      string
+}
+
+type memoryJoinEntry struct {
+	source *oneEntry
+	target *oneEntry
+}
+
+type memoryVbJoin struct {
+	entries map[memoryJoinKey]*memoryJoinEntry
+	// Approximate bytes held by entries
+	size int64
+	// Whether some of the entries have been written out to the spill files of the vb
+	spilled bool
+	lock    sync.Mutex
+}
+
+// MemoryDiffer is used in place of the data files and the file differ when a bucket fits in memory
+// Both DCP streams feed mutations into a hash join keyed by document key. Each vbucket is diffed in one pass, either
+// once both streams are done with Run, or as soon as both streams have completed the vbucket with RunStreaming,
+// which then frees its entries. The output is the same as that of the file differ so the mutation differ can follow
+// With a memory budget, the entries of vbuckets that take more than their share once the budget is exceeded are
+// spilled to files, and read back when the vbucket is diffed
+type MemoryDiffer struct {
+	diffFileDir       string
+	diffKeysFileName  string
+	collectionMapping map[uint32][]uint32
+	vbJoins           []*memoryVbJoin
+	vbRange           base.VbucketRange
+
+	memoryBudget int64
+	spillDir     string
+	memoryUsed   int64
+	vbDiffed     uint32
+
+	// Key the spilled entries and the diff outputs are encrypted with, nil for plaintext
+	encryptionKey []byte
+
+	// Protects the results below while vbuckets are diffed
+	resultsLock sync.RWMutex
+	srcDiffKeys DiffKeysMap
+	tgtDiffKeys DiffKeysMap
+
+	MissingFromSource    []*oneEntry
+	MissingFromTarget    []*oneEntry
+	BothExistButMismatch []*entryPair
+
+	SourceItemCount int64
+	TargetItemCount int64
+}
+
+func NewMemoryDiffer(diffFileDir, diffKeysFileName string, collectionMapping map[uint32][]uint32) *MemoryDiffer {
+	if len(collectionMapping) == 0 {
+		// This means this is legacy mode - no collection support
+		collectionMapping = make(map[uint32][]uint32)
+		collectionMapping[0] = []uint32{0}
+	}
+	differ := &MemoryDiffer{
+		diffFileDir:       diffFileDir,
+		diffKeysFileName:  diffKeysFileName,
+		collectionMapping: collectionMapping,
+		vbJoins:           make([]*memoryVbJoin, base.NumberOfVbuckets),
+		vbRange:           base.AllVbuckets,
+		srcDiffKeys:       make(DiffKeysMap),
+		tgtDiffKeys:       make(DiffKeysMap),
+	}
+	for i := 0; i < base.NumberOfVbuckets; i++ {
+		differ.vbJoins[i] = &memoryVbJoin{entries: make(map[memoryJoinKey]*memoryJoinEntry)}
+	}
+	return differ
+}
+
+// Only the vbuckets in vbRange are diffed, the others are expected to have no mutations
+func (m *MemoryDiffer) SetVbucketRange(vbRange base.VbucketRange) {
+	m.vbRange = vbRange
+}
+
+// Caps the memory taken by the entries to roughly budget bytes, spilling the rest into spillDir, which must exist
+// Must be called before any mutation is added. 0 means no limit
+func (m *MemoryDiffer) SetMemoryBudget(budget int64, spillDir string) {
+	m.memoryBudget = budget
+	m.spillDir = spillDir
+}
+
+// Must be called before any mutation is added
+func (m *MemoryDiffer) SetEncryptionKey(key []byte) {
+	m.encryptionKey = key
+}
+
+// Takes a mutation serialized by the DCP handler, the same format as what is written into data files
+func (m *MemoryDiffer) AddMutation(isSource bool, vbno uint16, serializedMut []byte) error {
+	entry, err := getOneEntry(bytes.NewReader(serializedMut).Read, false)
+	if err != nil {
+		return err
+	}
+
+	vbJoin := m.vbJoins[vbno]
+	vbJoin.lock.Lock()
+	defer vbJoin.lock.Unlock()
+	m.addEntryNoLock(vbJoin, isSource, entry, int64(len(serializedMut)))
+
+	if m.memoryBudget > 0 && atomic.LoadInt64(&m.memoryUsed) > m.memoryBudget &&
+		vbJoin.size >= m.memoryBudget/base.NumberOfVbuckets {
+		return m.spillNoLock(vbno, vbJoin)
+	}
+	return nil
+}
+
+// Vb lock should be held
+func (m *MemoryDiffer) addEntryNoLock(vbJoin *memoryVbJoin, isSource bool, entry *oneEntry, size int64) {
+	var tgtColIds []uint32
+	if isSource {
+		tgtColIds = m.collectionMapping[entry.ColId]
+	} else {
+		tgtColIds = []uint32{entry.ColId}
+	}
+
+	for _, tgtColId := range tgtColIds {
+		joinKey := memoryJoinKey{tgtColId: tgtColId, key: entry.Key}
+		joinEntry, exists := vbJoin.entries[joinKey]
+		if !exists {
+			joinEntry = &memoryJoinEntry{}
+			vbJoin.entries[joinKey] = joinEntry
+		}
+		// Keep only the newest record per key, like the file differ's dedup
+		if isSource {
+			if joinEntry.source == nil {
+				m.addSizeNoLock(vbJoin, size)
+			}
+			if joinEntry.source == nil || entry.Seqno > joinEntry.source.Seqno {
+				joinEntry.source = entry
+			}
+		} else {
+			if joinEntry.target == nil {
+				m.addSizeNoLock(vbJoin, size)
+			}
+			if joinEntry.target == nil || entry.Seqno > joinEntry.target.Seqno {
+				joinEntry.target = entry
+			}
+		}
+	}
+}
+
+func (m *MemoryDiffer) addSizeNoLock(vbJoin *memoryVbJoin, size int64) {
+	vbJoin.size += size
+	atomic.AddInt64(&m.memoryUsed, size)
+}
+
+func (m *MemoryDiffer) spillFileName(vbno uint16, isSource bool) string {
+	side := base.TargetClusterName
+	if isSource {
+		side = base.SourceClusterName
+	}
+	return filepath.Join(m.spillDir, fmt.Sprintf("%v%v%v", vbno, base.FileNameDelimiter, side))
+}
+
+// Appends the entries of the vb to its spill files and frees them. Vb lock should be held
+func (m *MemoryDiffer) spillNoLock(vbno uint16, vbJoin *memoryVbJoin) error {
+	var sourceEntries, targetEntries []*oneEntry
+	// A source entry is shared by the join keys of all the target collections it maps to
+	spilledSources := make(map[*oneEntry]bool)
+	for _, joinEntry := range vbJoin.entries {
+		if joinEntry.source != nil && !spilledSources[joinEntry.source] {
+			spilledSources[joinEntry.source] = true
+			sourceEntries = append(sourceEntries, joinEntry.source)
+		}
+		if joinEntry.target != nil {
+			targetEntries = append(targetEntries, joinEntry.target)
+		}
+	}
+	err := appendEntriesToFile(m.encryptionKey, m.spillFileName(vbno, true), sourceEntries)
+	if err != nil {
+		return err
+	}
+	err = appendEntriesToFile(m.encryptionKey, m.spillFileName(vbno, false), targetEntries)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&m.memoryUsed, -vbJoin.size)
+	vbJoin.size = 0
+	vbJoin.entries = make(map[memoryJoinKey]*memoryJoinEntry)
+	vbJoin.spilled = true
+	return nil
+}
+
+// Adds the spilled entries back into the join, which keeps the newest record per key whatever the order
+// Vb lock should be held
+func (m *MemoryDiffer) loadSpilledNoLock(vbno uint16, vbJoin *memoryVbJoin) error {
+	for _, isSource := range []bool{true, false} {
+		fileName := m.spillFileName(vbno, isSource)
+		iter, err := newFileEntryIterator(m.encryptionKey, fileName)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for entry := iter.next(); entry != nil; entry = iter.next() {
+			m.addEntryNoLock(vbJoin, isSource, entry, 0)
+		}
+		err = iter.err()
+		iter.close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", fileName, err)
+		}
+		os.Remove(fileName)
+	}
+	vbJoin.spilled = false
+	return nil
+}
+
+// Should only be called once both DCP streams have completed
+// Canceling ctx stops diffing after the current vbucket. The output of the vbuckets diffed so far is still written,
+// and ctx.Err() is returned
+func (m *MemoryDiffer) Run(ctx context.Context) error {
+	for _, vbno := range m.vbRange.Vbnos() {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := m.diffVb(vbno); err != nil {
+			return err
+		}
+	}
+	if err := m.writeOutput(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Diffs each vbucket as soon as it has been received from both srcVbsReady and tgtVbsReady, or once
+// dataGenDoneChan is closed, while the other vbuckets are still streaming. The entries of a vbucket are freed once
+// it is diffed, so only the vbuckets still streaming are held in memory. Canceling ctx has the same effect as with Run()
+func (m *MemoryDiffer) RunStreaming(ctx context.Context, srcVbsReady, tgtVbsReady <-chan uint16, dataGenDoneChan <-chan bool) error {
+	vbChan := make(chan uint16, base.NumberOfVbuckets)
+	go dispatchReadyVbs(ctx, m.vbRange, srcVbsReady, tgtVbsReady, dataGenDoneChan, vbChan)
+
+	var firstErr error
+	for vbno := range vbChan {
+		if firstErr != nil || ctx.Err() != nil {
+			// Keep draining so that the dispatcher can finish
+			continue
+		}
+		firstErr = m.diffVb(vbno)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := m.writeOutput(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Returns the number of vbuckets diffed, out of those in the vbucket range
+func (m *MemoryDiffer) Progress() (uint64, uint64) {
+	return uint64(atomic.LoadUint32(&m.vbDiffed)), uint64(m.vbRange.Count())
+}
+
+// Returns the number of differences found so far
+func (m *MemoryDiffer) NumDiffs() uint64 {
+	m.resultsLock.RLock()
+	defer m.resultsLock.RUnlock()
+	return uint64(len(m.BothExistButMismatch) + len(m.MissingFromSource) + len(m.MissingFromTarget))
+}
+
+// Diffs the entries of the vb and frees them
+func (m *MemoryDiffer) diffVb(vbno uint16) error {
+	vbJoin := m.vbJoins[vbno]
+	vbJoin.lock.Lock()
+	defer vbJoin.lock.Unlock()
+	if vbJoin.spilled {
+		if err := m.loadSpilledNoLock(vbno, vbJoin); err != nil {
+			return err
+		}
+	}
+
+	var sourceItemCount, targetItemCount int64
+	var mismatches []*entryPair
+	var missingFromSource, missingFromTarget []*oneEntry
+	srcDiffKeys := make(DiffKeysMap)
+	tgtDiffKeys := make(DiffKeysMap)
+	srcDedupMap := make(map[memoryJoinKey]bool)
+	for joinKey, joinEntry := range vbJoin.entries {
+		if joinEntry.source != nil {
+			srcJoinKey := memoryJoinKey{tgtColId: joinEntry.source.ColId, key: joinKey.key}
+			if !srcDedupMap[srcJoinKey] {
+				srcDedupMap[srcJoinKey] = true
+				sourceItemCount++
+			}
+		}
+		if joinEntry.target != nil {
+			targetItemCount++
+		}
+
+		var srcColId uint32
+		switch {
+		case joinEntry.source != nil && joinEntry.target != nil:
+			if _, match := joinEntry.source.Diff(*joinEntry.target); match {
+				continue
+			}
+			mismatches = append(mismatches, &entryPair{joinEntry.source, joinEntry.target})
+			srcColId = joinEntry.source.ColId
+		case joinEntry.source != nil:
+			missingFromTarget = append(missingFromTarget, joinEntry.source)
+			srcColId = joinEntry.source.ColId
+		default:
+			missingFromSource = append(missingFromSource, joinEntry.target)
+			var found bool
+			for chkSrcColId, tgtColIds := range m.collectionMapping {
+				for _, tgtColId := range tgtColIds {
+					if tgtColId == joinKey.tgtColId {
+						srcColId = chkSrcColId
+						found = true
+						break
+					}
+				}
+				if found {
+					break
+				}
+			}
+			if !found {
+				// Target collection is not replicated to
+				continue
+			}
+		}
+		srcDiffKeys[srcColId] = append(srcDiffKeys[srcColId], joinKey.key)
+		tgtDiffKeys[joinKey.tgtColId] = append(tgtDiffKeys[joinKey.tgtColId], joinKey.key)
+	}
+
+	atomic.AddInt64(&m.memoryUsed, -vbJoin.size)
+	vbJoin.size = 0
+	vbJoin.entries = make(map[memoryJoinKey]*memoryJoinEntry)
+
+	m.resultsLock.Lock()
+	defer m.resultsLock.Unlock()
+	m.SourceItemCount += sourceItemCount
+	m.TargetItemCount += targetItemCount
+	m.BothExistButMismatch = append(m.BothExistButMismatch, mismatches...)
+	m.MissingFromSource = append(m.MissingFromSource, missingFromSource...)
+	m.MissingFromTarget = append(m.MissingFromTarget, missingFromTarget...)
+	for colId, keys := range srcDiffKeys {
+		m.srcDiffKeys[colId] = append(m.srcDiffKeys[colId], keys...)
+	}
+	for colId, keys := range tgtDiffKeys {
+		m.tgtDiffKeys[colId] = append(m.tgtDiffKeys[colId], keys...)
+	}
+	atomic.AddUint32(&m.vbDiffed, 1)
+	return nil
+}
+
+func (m *MemoryDiffer) writeOutput() error {
+	m.resultsLock.RLock()
+	defer m.resultsLock.RUnlock()
+
+	// A key could be listed once per target collection
+	dedupSrcDiffKeys := make(DiffKeysMap)
+	dedupSrcDiffKeys.Merge(m.srcDiffKeys)
+
+	// Reuse the file differ's output format and writer so that the mutation differ can pick it up as is
+	driver := NewDifferDriver("", "", m.diffFileDir, m.diffKeysFileName, 1, 1, 0, m.collectionMapping, nil, nil)
+	driver.SetEncryptionKey(m.encryptionKey)
+	driver.addSrcDiffKeys(dedupSrcDiffKeys, nil)
+	driver.addTgtDiffKeys(m.tgtDiffKeys)
+	err := driver.writeDiffKeys()
+	if err != nil {
+		return err
+	}
+	return m.writeDiffDetails()
+}
+
+func (m *MemoryDiffer) writeDiffDetails() error {
+	outputMap := map[string]interface{}{
+		"Mismatch":          m.BothExistButMismatch,
+		"MissingFromSource": m.MissingFromSource,
+		"MissingFromTarget": m.MissingFromTarget,
+	}
+	diffBytes, err := json.Marshal(outputMap)
+	if err != nil {
+		return err
+	}
+
+	diffDetailsFileName := utils.JoinPath(m.diffFileDir, base.DiffDetailsFileName+base.FileNameDelimiter+fmt.Sprintf("%v", 0))
+	return utils.WriteDataFile(m.encryptionKey, diffDetailsFileName, diffBytes, base.FileModeReadWrite)
+}
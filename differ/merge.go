@@ -0,0 +1,311 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Combines the outputs of runs that each diffed a disjoint range of vbuckets into fileDiffDir and mutationDiffDir
+// Each of outputDirs holds the fileDiff and mutationDiff directories of one run. Files that a run did not write,
+// i.e. because it skipped a phase, are skipped. Encrypted outputs are read, and the merged ones written, with
+// encryptionKey
+func MergeOutputs(outputDirs []string, fileDiffDir, mutationDiffDir string, encryptionKey []byte) error {
+	var fileDiffDirs, mutationDiffDirs []string
+	for _, outputDir := range outputDirs {
+		fileDiffDirs = append(fileDiffDirs, utils.JoinPath(outputDir, base.FileDifferDir))
+		mutationDiffDirs = append(mutationDiffDirs, utils.JoinPath(outputDir, base.MutationDifferDir))
+	}
+
+	err := os.MkdirAll(fileDiffDir, 0777)
+	if err != nil {
+		return err
+	}
+	err = mergeFileDiffOutputs(fileDiffDirs, fileDiffDir, encryptionKey)
+	if err != nil {
+		return fmt.Errorf("error merging file differ outputs: %v", err)
+	}
+
+	err = os.MkdirAll(mutationDiffDir, 0777)
+	if err != nil {
+		return err
+	}
+	err = mergeMutationDiffOutputs(mutationDiffDirs, mutationDiffDir, encryptionKey)
+	if err != nil {
+		return fmt.Errorf("error merging mutation differ outputs: %v", err)
+	}
+	return nil
+}
+
+// Returns false if the file does not exist
+func readJsonFile(encryptionKey []byte, fileName string, v interface{}) (bool, error) {
+	data, err := utils.ReadDataFile(encryptionKey, fileName)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("%v: %v", fileName, err)
+	}
+	return true, nil
+}
+
+func writeJsonFile(encryptionKey []byte, fileName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return utils.WriteDataFile(encryptionKey, fileName, data, base.FileModeReadWrite)
+}
+
+func mergeFileDiffOutputs(diffFileDirs []string, mergedDir string, encryptionKey []byte) error {
+	for _, isSrc := range []bool{true, false} {
+		merged := make(DiffKeysMap)
+		mergedHints := make(MigrationHintMap)
+		var found, foundHints bool
+		for _, diffFileDir := range diffFileDirs {
+			diffKeysFileName := utils.DiffKeysFileName(isSrc, diffFileDir, base.DiffKeysFileName)
+			var diffKeys DiffKeysMap
+			exists, err := readJsonFile(encryptionKey, diffKeysFileName, &diffKeys)
+			if err != nil {
+				return err
+			}
+			found = found || exists
+			merged.Merge(diffKeys)
+
+			var hints MigrationHintMap
+			exists, err = readJsonFile(encryptionKey, fmt.Sprintf("%v_%v", diffKeysFileName, base.DiffKeysSrcMigrationHintSuffix), &hints)
+			if err != nil {
+				return err
+			}
+			foundHints = foundHints || exists
+			for key, colIds := range hints {
+				mergedHints[key] = colIds
+			}
+		}
+		if !found {
+			continue
+		}
+
+		mergedFileName := utils.DiffKeysFileName(isSrc, mergedDir, base.DiffKeysFileName)
+		err := writeJsonFile(encryptionKey, mergedFileName, merged)
+		if err != nil {
+			return err
+		}
+		err = merged.WritePerCollection(encryptionKey, mergedFileName)
+		if err != nil {
+			return err
+		}
+		if foundHints {
+			err = writeJsonFile(encryptionKey, fmt.Sprintf("%v_%v", mergedFileName, base.DiffKeysSrcMigrationHintSuffix), mergedHints)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	summary := &FileDiffSummary{}
+	var found bool
+	for _, diffFileDir := range diffFileDirs {
+		var dirSummary FileDiffSummary
+		exists, err := readJsonFile(encryptionKey, utils.JoinPath(diffFileDir, base.FileDiffSummaryFileName), &dirSummary)
+		if err != nil {
+			return err
+		}
+		found = found || exists
+		summary.add(&dirSummary)
+	}
+	if !found {
+		return nil
+	}
+	return writeSummaryFile(utils.JoinPath(mergedDir, base.FileDiffSummaryFileName), summary)
+}
+
+func mergeMutationDiffOutputs(mutationDiffDirs []string, mergedDir string, encryptionKey []byte) error {
+	summary := &MutationDiffSummary{}
+	var foundSummary bool
+	severityReport := NewSeverityReport()
+	var foundSeverity bool
+	// category -> colId -> key -> results, as written by writeDiffDetails()
+	details := make(map[string]map[string]map[string]json.RawMessage)
+	var foundDetails bool
+	var keysWithError, unverifiedKeys []json.RawMessage
+	var foundKeysWithError, foundUnverifiedKeys bool
+	var colIdMapping json.RawMessage
+
+	for _, dir := range mutationDiffDirs {
+		var dirSummary MutationDiffSummary
+		exists, err := readJsonFile(encryptionKey, utils.JoinPath(dir, base.MutationDiffSummaryFileName), &dirSummary)
+		if err != nil {
+			return err
+		}
+		foundSummary = foundSummary || exists
+		summary.add(&dirSummary)
+
+		var dirSeverityReport SeverityReport
+		exists, err = readJsonFile(encryptionKey, utils.JoinPath(dir, base.MutationDiffSeverityFileName), &dirSeverityReport)
+		if err != nil {
+			return err
+		}
+		foundSeverity = foundSeverity || exists
+		severityReport.merge(&dirSeverityReport)
+
+		var dirDetails map[string]map[string]map[string]json.RawMessage
+		exists, err = readJsonFile(encryptionKey, utils.JoinPath(dir, base.MutationDiffFileName), &dirDetails)
+		if err != nil {
+			return err
+		}
+		foundDetails = foundDetails || exists
+		for category, perCol := range dirDetails {
+			if _, ok := details[category]; !ok {
+				details[category] = make(map[string]map[string]json.RawMessage)
+			}
+			for colId, perKey := range perCol {
+				if _, ok := details[category][colId]; !ok {
+					details[category][colId] = make(map[string]json.RawMessage)
+				}
+				for key, results := range perKey {
+					details[category][colId][key] = results
+				}
+			}
+		}
+
+		var dirKeys []json.RawMessage
+		exists, err = readJsonFile(encryptionKey, utils.JoinPath(dir, base.DiffErrorKeysFileName), &dirKeys)
+		if err != nil {
+			return err
+		}
+		foundKeysWithError = foundKeysWithError || exists
+		keysWithError = append(keysWithError, dirKeys...)
+
+		dirKeys = nil
+		exists, err = readJsonFile(encryptionKey, utils.JoinPath(dir, base.MutationDiffUnverifiedKeysFileName), &dirKeys)
+		if err != nil {
+			return err
+		}
+		foundUnverifiedKeys = foundUnverifiedKeys || exists
+		unverifiedKeys = append(unverifiedKeys, dirKeys...)
+
+		// The same for every run of the same replication
+		if colIdMapping == nil {
+			_, err = readJsonFile(encryptionKey, utils.JoinPath(dir, base.MutationDiffColIdMapping), &colIdMapping)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if foundSummary {
+		if err := writeSummaryFile(utils.JoinPath(mergedDir, base.MutationDiffSummaryFileName), summary); err != nil {
+			return err
+		}
+	}
+	if foundSeverity {
+		severityReport.sort()
+		if err := writeJsonFile(encryptionKey, utils.JoinPath(mergedDir, base.MutationDiffSeverityFileName), severityReport); err != nil {
+			return err
+		}
+	}
+	if foundDetails {
+		if err := writeJsonFile(encryptionKey, utils.JoinPath(mergedDir, base.MutationDiffFileName), details); err != nil {
+			return err
+		}
+	}
+	if foundKeysWithError {
+		if err := writeJsonFile(encryptionKey, utils.JoinPath(mergedDir, base.DiffErrorKeysFileName), keysWithError); err != nil {
+			return err
+		}
+	}
+	if foundUnverifiedKeys {
+		if err := writeJsonFile(encryptionKey, utils.JoinPath(mergedDir, base.MutationDiffUnverifiedKeysFileName), unverifiedKeys); err != nil {
+			return err
+		}
+	}
+	if colIdMapping != nil {
+		if err := os.WriteFile(utils.JoinPath(mergedDir, base.MutationDiffColIdMapping), colIdMapping, base.FileModeReadWrite); err != nil {
+			return err
+		}
+	}
+	return mergeDiffDetailsJsonLines(mutationDiffDirs, mergedDir, summary, encryptionKey)
+}
+
+// Concatenates the records of the JSON lines details files, followed by a single footer holding the merged summary
+func mergeDiffDetailsJsonLines(mutationDiffDirs []string, mergedDir string, summary *MutationDiffSummary, encryptionKey []byte) error {
+	var fileNames []string
+	for _, dir := range mutationDiffDirs {
+		fileName := utils.JoinPath(dir, base.MutationDiffJsonLinesFileName)
+		if _, err := os.Stat(fileName); err == nil {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	if len(fileNames) == 0 {
+		return nil
+	}
+
+	mergedFile, err := os.OpenFile(utils.JoinPath(mergedDir, base.MutationDiffJsonLinesFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer mergedFile.Close()
+	encrypter := utils.NewDataFileEncrypter(encryptionKey, mergedFile)
+	writer := bufio.NewWriter(encrypter)
+
+	for _, fileName := range fileNames {
+		err = copyDiffRecords(fileName, writer, encryptionKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = json.NewEncoder(writer).Encode(map[string]interface{}{"Summary": summary})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
+// Copies every line but the summary footer
+func copyDiffRecords(fileName string, writer *bufio.Writer, encryptionKey []byte) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := utils.NewDataFileReader(encryptionKey, file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", fileName, err)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	// Records hold the documents fetched from both sides
+	scanner.Buffer(nil, base.MaxDiffRecordSize)
+	for scanner.Scan() {
+		var footer struct {
+			Summary *MutationDiffSummary
+		}
+		if json.Unmarshal(scanner.Bytes(), &footer) == nil && footer.Summary != nil {
+			continue
+		}
+		writer.Write(scanner.Bytes())
+		writer.WriteByte('\n')
+	}
+	return scanner.Err()
+}
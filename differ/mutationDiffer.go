@@ -10,23 +10,30 @@
 package differ
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/gocbcore/v9"
+	"github.com/couchbase/gomemcached"
 	xdcrBase "github.com/couchbase/goxdcr/base"
+	xdcrParts "github.com/couchbase/goxdcr/base/filter"
 	xdcrLog "github.com/couchbase/goxdcr/log"
 	"github.com/couchbase/goxdcr/metadata"
 	xdcrUtils "github.com/couchbase/goxdcr/utils"
 	"xdcrDiffer/base"
+	"xdcrDiffer/dashboard"
+	"xdcrDiffer/dcp"
 	"xdcrDiffer/utils"
 )
 
@@ -54,12 +61,19 @@ type MutationDiffer struct {
 	tgtDiff           map[uint32]map[string][]*GocbResult
 	deletedFromSource map[uint32]map[string][]*GocbResult
 	deletedFromTarget map[uint32]map[string][]*GocbResult
+	// Keys missing from target because the replication filter expression excludes the source doc
+	filteredFromTarget map[uint32]map[string]*GocbResult
+	// Mismatches where only the expiry differs, because the target bucket maxTTL capped it
+	expiryCappedByMaxTTL map[uint32]map[string][]*GocbResult
 
 	keysWithError []*MutationDifferFetchEntry
 	stateLock     *sync.RWMutex
 
 	numKeysProcessed  uint32
 	numKeysWithErrors uint32
+	numKeysToProcess  uint32
+	numKeysChecked    uint32
+	numKeysUnverified uint32
 
 	maxNumOfSendBatchRetry int
 	sendBatchRetryInterval time.Duration
@@ -80,31 +94,105 @@ type MutationDiffer struct {
 	migrationHintMap MigrationHintMap
 	duplicateMap     DuplicatedHintMap
 
+	// If set, only the diff keys of these source collections, and of the target collections they
+	// map to, are loaded from the per-collection diff keys files
+	srcColIdsToDiff []uint32
+
 	srcKvSSLPortMap xdcrBase.SSLPortMap
 	tgtKvSSLPortMap xdcrBase.SSLPortMap
 	srcKvVbMap      map[string][]uint16
 	tgtKvVbMap      map[string][]uint16
-	utils           xdcrUtils.UtilsIface
+	// KV node of each source vbucket, from srcKvVbMap
+	srcVbKvNodes map[uint16]string
+	utils        xdcrUtils.UtilsIface
+	// Target bucket maxTTL in seconds, 0 if not set
+	tgtMaxTTL uint32
+	// Conflict resolution types of the buckets, i.e. seqno, lww or custom
+	srcConflictResolutionType string
+	tgtConflictResolutionType string
+
+	// Replication filter, only set if the replication has a filter expression
+	filter xdcrParts.Filter
+	// Whether the filter expression refers to xattrs, which a plain get does not return
+	filterUsesXattrs bool
+	// CAS-only mismatches within this tolerance are considered low severity
+	casTolerance time.Duration
+	// Seconds that the expiries of the same doc may be apart on the two clusters
+	expiryTolerance uint32
+	// Optional custom equality rules, set by callers embedding the differ
+	comparator Comparator
+	// Optional additional destinations of the results
+	outputSinks []OutputSink
+	// Format of the diff details file, json by default
+	outputFormat string
+	// Compare JSON bodies by value rather than byte for byte
+	jsonAwareBodyCompare bool
+	// Also look up and compare the xattrs of docs that exist on both sides
+	compareXattrs bool
+	// Docs that are otherwise the same but whose xattrs differ, keyed by source collection
+	xattrMismatch map[uint32]map[string][]*GocbResult
+	// Leave the Sync Gateway xattrs out when comparing xattrs
+	ignoreSyncGatewayXattrs bool
+	// Also look up the tombstones of docs not found on either side when comparing bodies, and compare tombstones
+	compareTombstones bool
+	// Docs deleted on both sides whose tombstones differ, keyed by source collection
+	tombstoneMismatch map[uint32]map[string][]*GocbResult
+	// Keys that could not be fetched from either side, even after retrying, and thus were not diffed
+	unverifiedKeys []*UnverifiedKey
+	// Max reads per second issued to each cluster, 0 if unlimited
+	opsPerSecLimit int
+	// KV ports to bootstrap from the addresses of the clusters with on the external network, 0 for the default ones
+	srcKvPort uint16
+	tgtKvPort uint16
+	// Only report docs missing from either side. Docs that exist on both sides are the same
+	keyOnly bool
+	// How long to wait before verifying the keys found different once more, 0 to not recheck them
+	settlePeriod time.Duration
+	// Bytes of each binary body to hex dump from where mismatched bodies diverge, 0 to not dump them
+	binaryHexDumpLen int
+	// Key the diff keys files are read with and the outputs are encrypted with, nil for plaintext
+	encryptionKey []byte
+	// When Run has to stop fetching further keys, zero if it has no time limit
+	deadline time.Time
+	// Set to 1 once the deadline has stopped Run
+	deadlineReached uint32
 }
 
 // GocbResult is a wrapper struct that is composed with properties for both get and getMeta results from gocb
 type GocbResult struct {
 	*gocbcore.GetResult
 	*gocbcore.GetMetaResult
+	// Only set for xattr mismatches
+	Xattrs map[string]json.RawMessage
 }
 
+// Along with the result, CasTime is when the revision was written, as decoded from its CAS
 func (r *GocbResult) MarshalJSON() ([]byte, error) {
+	var resultBytes []byte
+	var err error
 	if r.GetResult != nil {
-		return json.Marshal(r.GetResult)
+		resultBytes, err = json.Marshal(&struct {
+			*gocbcore.GetResult
+			CasTime string `json:",omitempty"`
+		}{r.GetResult, base.CasTimestamp(uint64(r.GetResult.Cas))})
 	} else if r.GetMetaResult != nil {
-		return json.Marshal(r.GetMetaResult)
+		resultBytes, err = json.Marshal(&struct {
+			*gocbcore.GetMetaResult
+			CasTime string `json:",omitempty"`
+		}{r.GetMetaResult, base.CasTimestamp(uint64(r.GetMetaResult.Cas))})
+	}
+	if err == nil && base.IsRedactionOn() {
+		return r.marshalRedacted(resultBytes)
+	}
+	if err != nil || r.Xattrs == nil {
+		return resultBytes, err
 	}
-	return nil, nil
+	return marshalWithXattrs(resultBytes, r.Xattrs)
 }
 
-func NewMutationDiffer(sourceBucketName string, sourceRef *metadata.RemoteClusterReference, targetBucketName string, targetRef *metadata.RemoteClusterReference, fileDifferDir string, mutationDifferFileDir string, numberOfWorkers int, batchSize int, timeout int, maxNumOfSendBatchRetry int, sendBatchRetryInterval time.Duration, sendBatchMaxBackoff time.Duration, compareType string, logger *xdcrLog.CommonLogger, colIdsMap map[uint32][]uint32, srcCapability metadata.Capability, tgtCapability metadata.Capability, xdcrUtils xdcrUtils.UtilsIface, retries int, retriesWaitSecs int, duplMapping DuplicatedHintMap) *MutationDiffer {
+func NewMutationDiffer(sourceBucketName string, sourceRef *metadata.RemoteClusterReference, targetBucketName string, targetRef *metadata.RemoteClusterReference, fileDifferDir string, mutationDifferFileDir string, numberOfWorkers int, batchSize int, timeout int, maxNumOfSendBatchRetry int, sendBatchRetryInterval time.Duration, sendBatchMaxBackoff time.Duration, compareType string, logger *xdcrLog.CommonLogger, colIdsMap map[uint32][]uint32, srcCapability metadata.Capability, tgtCapability metadata.Capability, xdcrUtils xdcrUtils.UtilsIface, retries int, retriesWaitSecs int, duplMapping DuplicatedHintMap, filter xdcrParts.Filter, casTolerance time.Duration) *MutationDiffer {
 	// this indicates that mutation differ is expected to read srcDiff fetchList generated by file differ,
-	inputDiffKeysFileName := fileDifferDir + base.FileDirDelimiter + base.DiffKeysFileName
+	inputDiffKeysFileName := utils.JoinPath(fileDifferDir, base.DiffKeysFileName)
 	if len(colIdsMap) == 0 {
 		// legacy mode
 		colIdsMap = make(map[uint32][]uint32)
@@ -126,7 +214,12 @@ func NewMutationDiffer(sourceBucketName string, sourceRef *metadata.RemoteCluste
 		tgtDiff:                make(map[uint32]map[string][]*GocbResult),
 		deletedFromSource:      make(map[uint32]map[string][]*GocbResult),
 		deletedFromTarget:      make(map[uint32]map[string][]*GocbResult),
+		filteredFromTarget:     make(map[uint32]map[string]*GocbResult),
+		expiryCappedByMaxTTL:   make(map[uint32]map[string][]*GocbResult),
+		xattrMismatch:          make(map[uint32]map[string][]*GocbResult),
+		tombstoneMismatch:      make(map[uint32]map[string][]*GocbResult),
 		keysWithError:          MutationDiffFetchList{},
+		unverifiedKeys:         []*UnverifiedKey{},
 		stateLock:              &sync.RWMutex{},
 		maxNumOfSendBatchRetry: maxNumOfSendBatchRetry,
 		sendBatchRetryInterval: sendBatchRetryInterval,
@@ -143,133 +236,407 @@ func NewMutationDiffer(sourceBucketName string, sourceRef *metadata.RemoteCluste
 		conflictRetries:        retries,
 		retriesWaitSec:         retriesWaitSecs,
 		duplicateMap:           duplMapping,
+		filter:                 filter,
+		casTolerance:           casTolerance,
 	}
 }
 
-func (d *MutationDiffer) Run() error {
-	srcDiffKeys, tgtDiffKeys, migrationHintMap, err := d.loadDiffKeys()
+// Must be called before Run()
+// The absolute expiry of a doc written with a TTL is worked out on each cluster, and may be off by a few seconds
+func (d *MutationDiffer) SetExpiryTolerance(seconds uint32) {
+	d.expiryTolerance = seconds
+}
+
+// Must be called before Run()
+// Limits the reads issued to each of the source and target clusters, across all the workers
+func (d *MutationDiffer) SetOpsPerSecLimit(opsPerSec int) {
+	d.opsPerSecLimit = opsPerSec
+}
+
+// Must be called before Run()
+// Otherwise the KV ports of the nodes are looked up from the clusters
+func (d *MutationDiffer) SetKvPorts(sourceKvPort, targetKvPort uint16) {
+	d.srcKvPort = sourceKvPort
+	d.tgtKvPort = targetKvPort
+}
+
+// Must be called before Run()
+// The source docs of the keys missing from the target are then looked up along with their xattrs, so that
+// the filter expression sees the doc as XDCR did
+func (d *MutationDiffer) SetFilterUsesXattrs(filterUsesXattrs bool) {
+	d.filterUsesXattrs = filterUsesXattrs
+}
+
+// Must be called before Run()
+func (d *MutationDiffer) SetKeyOnly(keyOnly bool) {
+	d.keyOnly = keyOnly
+}
+
+// Must be called before Run()
+// On live systems most differences are replication lag, which is gone by the time the keys are verified again
+func (d *MutationDiffer) SetSettlePeriod(settlePeriod time.Duration) {
+	d.settlePeriod = settlePeriod
+}
+
+// Must be called before Run()
+func (d *MutationDiffer) SetEncryptionKey(key []byte) {
+	d.encryptionKey = key
+}
+
+// Must be called before Run()
+func (d *MutationDiffer) SetBinaryHexDumpLen(hexDumpLen int) {
+	d.binaryHexDumpLen = hexDumpLen
+}
+
+// Must be called before Run()
+// Once the deadline passes, the keys not yet fetched are recorded as unverified instead, and Run returns what was
+// diffed so far
+func (d *MutationDiffer) SetDeadline(deadline time.Time) {
+	d.deadline = deadline
+}
+
+// Whether the deadline stopped Run before all the keys were verified
+func (d *MutationDiffer) DeadlineReached() bool {
+	return atomic.LoadUint32(&d.deadlineReached) == 1
+}
+
+// Restricts the mutation differ to the given source collections and the target collections they map to
+func (d *MutationDiffer) SetCollectionsToDiff(srcColIds []uint32) {
+	d.srcColIdsToDiff = srcColIds
+}
+
+// Canceling ctx stops fetching further batches. The keys not fetched are recorded as keys with errors, what was
+// fetched is still diffed and written out, and ctx.Err() is returned. Reaching the deadline stops it the same way,
+// except that the keys not fetched are recorded as unverified and no error is returned
+func (d *MutationDiffer) Run(ctx context.Context) error {
+	parentCtx := ctx
+	if !d.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		timer := time.AfterFunc(time.Until(d.deadline), func() {
+			atomic.StoreUint32(&d.deadlineReached, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	srcDiffKeysFiles, tgtDiffKeysFiles, migrationHintMap, err := d.loadDiffKeys()
 	if err != nil {
 		return err
 	}
 	d.migrationHintMap = migrationHintMap
 
-	srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
-	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
-	combinedFetchList := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
-
-	d.logger.Infof("Mutation srcDiff to work on %v srcPovFetchList with diffs.\n", len(combinedFetchList))
-
 	err = d.initialize()
 	if err != nil {
 		d.logger.Errorf("Error initializing: %v\n", err)
 		return err
 	}
 
-	d.fetchAndDiff(combinedFetchList)
+	err = d.streamAndDiff(ctx, srcDiffKeysFiles, tgtDiffKeysFiles)
+	if err != nil {
+		return err
+	}
+
+	if d.settlePeriod > 0 && d.containsDiff() && ctx.Err() == nil {
+		d.logger.Infof("Waiting %v for replication to settle before rechecking the diffs...", d.settlePeriod)
+		select {
+		case <-time.After(d.settlePeriod):
+			numKeys := d.recheckDiffs(ctx)
+			d.logger.Infof("Settle recheck of %v keys left %v diffs\n", numKeys, d.NumDiffs())
+		case <-ctx.Done():
+		}
+	}
 
 	// Retry multiple times if asked to, in order to minimize in flight differences
-	for i := 0; d.containsDiff() && i < d.conflictRetries; i++ {
+	for i := 0; d.containsDiff() && i < d.conflictRetries && ctx.Err() == nil; i++ {
 		if i > 0 {
 			d.logger.Infof("Waiting %v seconds before retrying...", d.retriesWaitSec)
-			time.Sleep(time.Duration(d.retriesWaitSec) * time.Second)
+			select {
+			case <-time.After(time.Duration(d.retriesWaitSec) * time.Second):
+			case <-ctx.Done():
+				continue
+			}
+		}
+		d.logger.Infof("Retrying %v out of %v times to resolve in-flight differences...", i+1, d.conflictRetries)
+		d.recheckDiffs(ctx)
+	}
+
+	if err := d.writeDiff(); err != nil {
+		return err
+	}
+	if d.DeadlineReached() && parentCtx.Err() == nil {
+		d.logger.Warnf("Stopped at the deadline with %v keys left unverified\n", atomic.LoadUint32(&d.numKeysUnverified))
+		return nil
+	}
+	return ctx.Err()
+}
+
+// Diffs the keys of the source diff keys files together with those of the target ones, deduplicated the way
+// dedupFetchLists does. Neither side is loaded at once: the source keys, which there can be tens of millions of,
+// are fed to the workers one at a time, and large target diff keys are split by key hash into partitions, whose
+// target keys are loaded one partition at a time
+func (d *MutationDiffer) streamAndDiff(ctx context.Context, srcDiffKeysFiles, tgtDiffKeysFiles []string) error {
+	partitionDir := utils.JoinPath(d.mutationDifferFileDir, base.DiffKeysPartitionDirName)
+	partitions, err := d.partitionDiffKeys(srcDiffKeysFiles, tgtDiffKeysFiles, partitionDir, base.MutationDifferTgtDiffKeysPartitionBytes)
+	if err != nil {
+		d.logger.Errorf("Error partitioning the diff keys: %v\n", err)
+		return err
+	}
+	defer os.RemoveAll(partitionDir)
+	if len(partitions) > 1 {
+		d.logger.Infof("Diffing the diff keys in %v partitions, so that only the target keys of one are loaded at once\n", len(partitions))
+	}
+
+	fetchChan := make(chan *MutationDifferFetchEntry, base.MutationDifferFetchChanSize)
+	atomic.StoreUint32(&d.numKeysToProcess, 0)
+	sendEntry := func(entry *MutationDifferFetchEntry) {
+		atomic.AddUint32(&d.numKeysToProcess, 1)
+		fetchChan <- entry
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(fetchChan)
+		for _, partition := range partitions {
+			err := d.sendPartitionFetchEntries(partition, sendEntry)
+			if err != nil {
+				errCh <- err
+				return
+			}
 		}
-		srcDiffKeys = d.getDiffKeysFromSourceGocbResult()
-		tgtDiffKeys = d.getDiffKeysFromTargetGocbResult()
-		srcPovFetchList, srcPovFetchIdx = srcDiffKeys.ToFetchEntries(d.colIdsMap, migrationHintMap)
-		tgtPovFetchList, tgtPovFetchIdx = tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
-		combinedFetchList = dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
-		d.logger.Infof("With %v diffs, retrying %v out of %v times to resolve in-flight differences...",
-			len(combinedFetchList), i+1, d.conflictRetries)
-		d.fetchAndDiff(combinedFetchList)
+		errCh <- nil
+	}()
+
+	d.fetchAndDiffFromChan(ctx, fetchChan)
+	err = <-errCh
+	if err != nil {
+		d.logger.Errorf("Error reading the diff keys: %v\n", err)
+		return err
 	}
 
-	return d.writeDiff()
+	numKeys := atomic.LoadUint32(&d.numKeysToProcess)
+	d.logger.Infof("Mutation differ worked on %v keys with diffs.\n", numKeys)
+	atomic.StoreUint32(&d.numKeysChecked, numKeys)
+	return nil
+}
+
+// Fetches and diffs again only the keys that the previous round found different, which replace the results of that
+// round. Returns the number of keys fetched
+func (d *MutationDiffer) recheckDiffs(ctx context.Context) int {
+	srcDiffKeys := d.getDiffKeysFromSourceGocbResult()
+	tgtDiffKeys := d.getDiffKeysFromTargetGocbResult()
+	srcPovFetchList, srcPovFetchIdx := srcDiffKeys.ToFetchEntries(d.colIdsMap, d.migrationHintMap)
+	tgtPovFetchList, tgtPovFetchIdx := tgtDiffKeys.ToFetchEntries(d.reverseTgtColIdsMap, nil)
+	combinedFetchList := dedupFetchLists(srcPovFetchList, srcPovFetchIdx, tgtPovFetchList, tgtPovFetchIdx)
+	d.logger.Infof("Rechecking %v diffs...", len(combinedFetchList))
+	d.fetchAndDiff(ctx, combinedFetchList)
+	return len(combinedFetchList)
+}
+
+func (d *MutationDiffer) fetchAndDiff(ctx context.Context, combinedFetchList MutationDiffFetchList) {
+	fetchChan := make(chan *MutationDifferFetchEntry, len(combinedFetchList))
+	for _, fetchItem := range combinedFetchList {
+		fetchChan <- fetchItem
+	}
+	close(fetchChan)
+	atomic.StoreUint32(&d.numKeysToProcess, uint32(len(combinedFetchList)))
+	d.fetchAndDiffFromChan(ctx, fetchChan)
 }
 
-func (d *MutationDiffer) fetchAndDiff(combinedFetchList MutationDiffFetchList) {
+// Has the workers fetch and diff what is sent to fetchChan until it is closed. Whoever sends to fetchChan
+// accounts for it in numKeysToProcess
+func (d *MutationDiffer) fetchAndDiffFromChan(ctx context.Context, fetchChan <-chan *MutationDifferFetchEntry) {
 	// First clear the results that the differWorker will be working on
 	d.clearGoCbResults()
+	atomic.StoreUint32(&d.numKeysProcessed, 0)
 	finCh := make(chan bool)
 
-	go d.reportStatus(len(combinedFetchList), finCh)
-	loadDistribution := utils.BalanceLoad(d.numberOfWorkers, len(combinedFetchList))
+	go d.reportStatus(finCh)
 	waitGroup := &sync.WaitGroup{}
 	for i := 0; i < d.numberOfWorkers; i++ {
-		lowIndex := loadDistribution[i][0]
-		highIndex := loadDistribution[i][1]
-		if lowIndex == highIndex {
-			// skip workers with 0 load
-			continue
-		}
-		diffWorker := NewDifferWorker(d, d.sourceDcpAgent, d.targetDcpAgent, d.sourceBucket, d.targetBucket,
-			combinedFetchList[lowIndex:highIndex], waitGroup, d.colIdsMap, d.reverseTgtColIdsMap, d.migrationHintMap,
+		diffWorker := NewDifferWorker(ctx, d, d.sourceDcpAgent, d.targetDcpAgent, d.sourceBucket, d.targetBucket,
+			fetchChan, waitGroup, d.colIdsMap, d.reverseTgtColIdsMap, d.migrationHintMap,
 			d.compareType, d.conflictRetries)
 		waitGroup.Add(1)
 		go diffWorker.run()
 	}
 	waitGroup.Wait()
 	close(finCh)
+
+	d.separateFilteredFromMissing(ctx)
+	d.separateMaxTTLFromMismatch()
+}
+
+// Returns the number of keys processed out of the keys to process in the current round
+func (d *MutationDiffer) Progress() (uint64, uint64) {
+	return uint64(atomic.LoadUint32(&d.numKeysProcessed)), uint64(atomic.LoadUint32(&d.numKeysToProcess))
+}
+
+// Returns the number of keys currently considered different
+func (d *MutationDiffer) NumDiffs() uint64 {
+	return uint64(d.getDiffKeysFromSourceGocbResult().GetTotalCount() + d.getDiffKeysFromTargetGocbResult().GetTotalCount())
+}
+
+// Writes the keys that are still different as diff keys files in dir, so that a subsequent run pointed at dir only
+// verifies the keys that have yet to converge
+func (d *MutationDiffer) WriteRemainingDiffKeys(dir string) (int, int, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, 0, err
+	}
+	srcDiffKeys := d.getDiffKeysFromSourceGocbResult()
+	tgtDiffKeys := d.getDiffKeysFromTargetGocbResult()
+
+	if len(d.srcColIdsToDiff) > 0 {
+		// Only the files of the collections being diffed are written, which are all a subsequent run restricted to
+		// the same collections reads
+		err := d.writeRemainingCollectionDiffKeys(dir, srcDiffKeys, tgtDiffKeys)
+		if err != nil {
+			return 0, 0, err
+		}
+		return srcDiffKeys.GetTotalCount(), tgtDiffKeys.GetTotalCount(), nil
+	}
+
+	for i, diffKeys := range []DiffKeysMap{srcDiffKeys, tgtDiffKeys} {
+		diffKeysBytes, err := json.Marshal(diffKeys)
+		if err != nil {
+			return 0, 0, err
+		}
+		diffKeysFileName := utils.DiffKeysFileName(i == 0, dir, base.DiffKeysFileName)
+		err = utils.WriteDataFile(d.encryptionKey, diffKeysFileName, diffKeysBytes, base.FileModeReadWrite)
+		if err != nil {
+			return 0, 0, err
+		}
+		err = diffKeys.WritePerCollection(d.encryptionKey, diffKeysFileName)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(d.migrationHintMap) > 0 {
+		// The hints the keys were read with still apply to the keys that remain
+		migrationHintBytes, err := json.Marshal(d.migrationHintMap)
+		if err != nil {
+			return 0, 0, err
+		}
+		migrationHintFile := fmt.Sprintf("%v_%v", utils.DiffKeysFileName(true, dir, base.DiffKeysFileName), base.DiffKeysSrcMigrationHintSuffix)
+		err = utils.WriteDataFile(d.encryptionKey, migrationHintFile, migrationHintBytes, base.FileModeReadWrite)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return srcDiffKeys.GetTotalCount(), tgtDiffKeys.GetTotalCount(), nil
+}
+
+func (d *MutationDiffer) writeRemainingCollectionDiffKeys(dir string, srcDiffKeys, tgtDiffKeys DiffKeysMap) error {
+	writeFile := func(fileName string, colId uint32, diffKeys DiffKeysMap) error {
+		colFileName := utils.DiffKeysCollectionFileName(fileName, colId)
+		if len(diffKeys[colId]) == 0 {
+			err := os.Remove(colFileName)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		diffKeysBytes, err := json.Marshal(DiffKeysMap{colId: diffKeys[colId]})
+		if err != nil {
+			return err
+		}
+		return utils.WriteDataFile(d.encryptionKey, colFileName, diffKeysBytes, base.FileModeReadWrite)
+	}
+
+	for _, srcColId := range d.srcColIdsToDiff {
+		err := writeFile(utils.DiffKeysFileName(true, dir, base.DiffKeysFileName), srcColId, srcDiffKeys)
+		if err != nil {
+			return err
+		}
+		for _, tgtColId := range d.colIdsMap[srcColId] {
+			err = writeFile(utils.DiffKeysFileName(false, dir, base.DiffKeysFileName), tgtColId, tgtDiffKeys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func dedupFetchLists(srcPovList MutationDiffFetchList, srcIdx MutationDiffFetchListIdx, tgtPovList MutationDiffFetchList, tgtIdx MutationDiffFetchListIdx) MutationDiffFetchList {
 	// The goal is to combine and deduplicate into a single source-side view of the fetch list
 	var combinedFetchList MutationDiffFetchList
 	combinedFetchIdx := make(MutationDiffFetchListIdx)
+	addEntry := func(entry *MutationDifferFetchEntry) {
+		combinedFetchList = append(combinedFetchList, entry)
+	}
 
 	// First go through the source side - and make sure that all matching entries are fetched
 	for _, srcFetchEntry := range srcPovList {
-		combinedEntry := srcFetchEntry.Clone()
+		combinedEntry := combineWithTargetEntries(srcFetchEntry, tgtIdx)
+		addEntry(combinedEntry)
+		combinedFetchIdx.AddEntry(combinedEntry)
+	}
 
-		potentialTgtEntries, exists := tgtIdx[combinedEntry.Key]
-		if !exists {
-			// Make sure this entry at least has non nil src list
-			if len(combinedEntry.TgtColIds) == 0 {
-				panic("Will be missing target")
-			}
+	// Now, go through the target side to ensure that if anything the source missed, it is covered
+	addUncoveredTargetEntries(tgtPovList, combinedFetchIdx, addEntry)
+	return combinedFetchList
+}
+
+// Returns a copy of srcFetchEntry that also fetches the target collection of the matching target entry, if any
+func combineWithTargetEntries(srcFetchEntry *MutationDifferFetchEntry, tgtIdx MutationDiffFetchListIdx) *MutationDifferFetchEntry {
+	combinedEntry := srcFetchEntry.Clone()
+
+	potentialTgtEntries, exists := tgtIdx[combinedEntry.Key]
+	if !exists {
+		// Make sure this entry at least has non nil src list
+		if len(combinedEntry.TgtColIds) == 0 {
+			panic("Will be missing target")
 		}
-		// potentialTgtEntries are based off of the index and so need to ensure that only matching entries are combined
-		for _, chkTgtEntry := range potentialTgtEntries {
-			var foundMatching bool
-			// From target's pov, the TgtColIds are to be source's
-			for _, chkSrcId := range chkTgtEntry.TgtColIds {
-				if chkSrcId == combinedEntry.SrcColId {
-					// This entry matches
-					foundMatching = true
-					// Make sure that this target's colId exists in the centralized fetch list
-					var foundTgt bool
-					for _, chkTgtId := range combinedEntry.TgtColIds {
-						// chkTgtEntry is from tgt's pov... ensure that tgt's pov, the srcColId is covered
-						if chkTgtId == chkTgtEntry.SrcColId {
-							foundTgt = true
-							break
-						}
-					}
-					if !foundTgt {
-						// This target's colId needs to be in the combinedEntry to ensure it is fetched from target KV
-						combinedEntry.TgtColIds = append(combinedEntry.TgtColIds, chkTgtEntry.SrcColId)
+	}
+	// potentialTgtEntries are based off of the index and so need to ensure that only matching entries are combined
+	for _, chkTgtEntry := range potentialTgtEntries {
+		var foundMatching bool
+		// From target's pov, the TgtColIds are to be source's
+		for _, chkSrcId := range chkTgtEntry.TgtColIds {
+			if chkSrcId == combinedEntry.SrcColId {
+				// This entry matches
+				foundMatching = true
+				// Make sure that this target's colId exists in the centralized fetch list
+				var foundTgt bool
+				for _, chkTgtId := range combinedEntry.TgtColIds {
+					// chkTgtEntry is from tgt's pov... ensure that tgt's pov, the srcColId is covered
+					if chkTgtId == chkTgtEntry.SrcColId {
+						foundTgt = true
+						break
 					}
-					break
 				}
-			}
-			if foundMatching {
+				if !foundTgt {
+					// This target's colId needs to be in the combinedEntry to ensure it is fetched from target KV
+					combinedEntry.TgtColIds = append(combinedEntry.TgtColIds, chkTgtEntry.SrcColId)
+				}
 				break
 			}
 		}
-		combinedFetchList = append(combinedFetchList, combinedEntry)
-		combinedFetchIdx.AddEntry(combinedEntry)
+		if foundMatching {
+			break
+		}
+	}
+	return combinedEntry
+}
+
+// Calls addEntry with the source side view of the target entries that the combined entries indexed so far do not
+// cover, and indexes them too. combinedFetchIdx need only index the combined entries of keys the target entries have
+func addUncoveredTargetEntries(tgtPovList MutationDiffFetchList, combinedFetchIdx MutationDiffFetchListIdx, addEntry func(entry *MutationDifferFetchEntry)) {
+	addReversed := func(tgtFetchEntry *MutationDifferFetchEntry) {
+		for _, addOneEntry := range tgtFetchEntry.Reverse() {
+			addEntry(addOneEntry)
+			combinedFetchIdx.AddEntry(addOneEntry)
+		}
 	}
 
-	// Now, go through the target side to ensure that if anything the source missed, it is covered
 	for _, tgtFetchEntry := range tgtPovList {
 		potentialCombinedEntries, exists := combinedFetchIdx[tgtFetchEntry.Key]
 		if !exists {
 			// This means that this key is not even being fetched from the source at all
 			// need to add it to be fetched so that the diff algo can find it
-			srcEntries := tgtFetchEntry.Reverse()
-			for _, addOneEntry := range srcEntries {
-				combinedFetchList = append(combinedFetchList, addOneEntry)
-				combinedFetchIdx.AddEntry(addOneEntry)
-			}
+			addReversed(tgtFetchEntry)
 			continue
 		}
 
@@ -290,27 +657,25 @@ func dedupFetchLists(srcPovList MutationDiffFetchList, srcIdx MutationDiffFetchL
 				// This means that for a key that exists in the source's collection, it isn't aware that
 				// this target collection also needs to be fetched
 				// Add them into the combinedFetchList
-				srcEntries := tgtFetchEntry.Reverse()
-				for _, addOneEntry := range srcEntries {
-					combinedFetchList = append(combinedFetchList, addOneEntry)
-					combinedFetchIdx.AddEntry(addOneEntry)
-				}
+				addReversed(tgtFetchEntry)
 			}
 		}
 	}
-	return combinedFetchList
 }
 
-func (d *MutationDiffer) reportStatus(totalKeys int, finCh chan bool) {
+// The keys to process can still grow while the diff keys are being read
+func (d *MutationDiffer) reportStatus(finCh chan bool) {
 	ticker := time.NewTicker(time.Duration(base.StatsReportInterval) * time.Second)
 	defer ticker.Stop()
 
 	var prevNumKeysProcessed uint32 = math.MaxUint32
+	startTime := time.Now()
 
 	for {
 		select {
 		case <-ticker.C:
 			numKeysProcessed := atomic.LoadUint32(&d.numKeysProcessed)
+			totalKeys := atomic.LoadUint32(&d.numKeysToProcess)
 			numKeysWithErrors := atomic.LoadUint32(&d.numKeysWithErrors)
 			if prevNumKeysProcessed != math.MaxUint32 {
 				d.logger.Infof("%v Mutation differ processed %v fetchList out of %v fetchList. processing rate=%v key/sec\n", time.Now(), numKeysProcessed, totalKeys, (numKeysProcessed-prevNumKeysProcessed)/base.StatsReportInterval)
@@ -318,12 +683,12 @@ func (d *MutationDiffer) reportStatus(totalKeys int, finCh chan bool) {
 				d.logger.Infof("%v Mutation differ processed %v fetchList out of %v fetchList.\n", time.Now(), numKeysProcessed, totalKeys)
 
 			}
+			d.logger.Infof("%v Mutation differ progress %v%v\n", time.Now(),
+				dashboard.ProgressBar(uint64(numKeysProcessed), uint64(totalKeys), base.StatusLogProgressBarWidth),
+				dashboard.FormatEta(uint64(numKeysProcessed), uint64(totalKeys), time.Since(startTime)))
 			if numKeysWithErrors > 0 {
 				d.logger.Warnf("%v skipped %v fetchList because of errors\n", time.Now(), numKeysWithErrors)
 			}
-			if numKeysProcessed == uint32(totalKeys) {
-				return
-			}
 			prevNumKeysProcessed = numKeysProcessed
 		case <-finCh:
 			return
@@ -337,6 +702,11 @@ func (d *MutationDiffer) writeDiff() error {
 		d.logger.Errorf("Error writing fetchList with errors. err=%v\n", err)
 	}
 
+	err = d.writeUnverifiedKeys()
+	if err != nil {
+		d.logger.Errorf("Error writing unverified keys. err=%v\n", err)
+	}
+
 	err = d.writeCollectionMapping()
 	if err != nil {
 		d.logger.Errorf("Error collection mapping with errors. err=%v\n", err)
@@ -351,10 +721,48 @@ func (d *MutationDiffer) writeDiff() error {
 	if err != nil {
 		d.logger.Errorf("Error writing migration details. err=%v\n", err)
 	}
+
+	err = d.writeSeverityReport()
+	if err != nil {
+		d.logger.Errorf("Error writing severity report. err=%v\n", err)
+	}
+
+	err = d.writeSummary()
+	if err != nil {
+		d.logger.Errorf("Error writing summary. err=%v\n", err)
+	}
+
+	err = d.writeBinaryDetails()
+	if err != nil {
+		d.logger.Errorf("Error writing binary details. err=%v\n", err)
+	}
+
+	err = d.writeJsonFieldDetails()
+	if err != nil {
+		d.logger.Errorf("Error writing JSON field details. err=%v\n", err)
+	}
+
+	err = d.writeConflictResolutionReport()
+	if err != nil {
+		d.logger.Errorf("Error writing conflict resolution report. err=%v\n", err)
+	}
+
+	err = d.writeToOutputSinks()
+	if err != nil {
+		d.logger.Errorf("Error writing to output sinks. err=%v\n", err)
+	}
 	return err
 }
 
+// Must be called before Run()
+func (d *MutationDiffer) SetOutputFormat(format string) {
+	d.outputFormat = format
+}
+
 func (d *MutationDiffer) writeDiffDetails() error {
+	if d.outputFormat == base.MutationDiffOutputFormatJsonLines {
+		return d.writeDiffDetailsJsonLines()
+	}
 	diffBytes, err := d.getDiffBytes()
 	if err != nil {
 		return err
@@ -362,9 +770,53 @@ func (d *MutationDiffer) writeDiffDetails() error {
 	return d.writeDiffBytesToFile(diffBytes)
 }
 
+// Writes one record per line as each difference is visited, instead of marshalling all of them at once,
+// followed by a footer line holding the summary
+func (d *MutationDiffer) writeDiffDetailsJsonLines() error {
+	fullFileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffJsonLinesFileName)
+	diffFile, err := os.OpenFile(fullFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer diffFile.Close()
+
+	encrypter := utils.NewDataFileEncrypter(d.encryptionKey, diffFile)
+	writer := bufio.NewWriter(encrypter)
+	encoder := json.NewEncoder(writer)
+	crType := d.commonConflictResolutionType()
+	d.forEachDiff(func(category string, colId uint32, key string, severity Severity, results []*GocbResult) {
+		if err != nil {
+			return
+		}
+		err = encoder.Encode(&DiffRecord{
+			Category:   category,
+			ColId:      colId,
+			Key:        base.TagKey(key),
+			Severity:   severity,
+			Finding:    recordConflictFinding(crType, category, results),
+			FieldDiff:  recordFieldDiff(category, results),
+			BinaryDiff: d.recordBinaryDiff(category, results),
+			Results:    results,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = encoder.Encode(map[string]interface{}{"Summary": d.compileSummary()})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return encrypter.Close()
+}
+
 func (d *MutationDiffer) writeCollectionMapping() error {
 	fileName := base.MutationDiffColIdMapping
-	srcMapFilename := d.mutationDifferFileDir + base.FileDirDelimiter + fileName
+	srcMapFilename := utils.JoinPath(d.mutationDifferFileDir, fileName)
 
 	srcMappingBytes, srcErr := json.Marshal(d.colIdsMap)
 	if srcErr != nil {
@@ -381,12 +833,20 @@ func (d *MutationDiffer) writeCollectionMapping() error {
 }
 
 func (d *MutationDiffer) writeKeysWithError() error {
-	keysWithErrorBytes, err := json.Marshal(d.keysWithError)
+	keysWithError := make([]*MutationDifferFetchEntry, len(d.keysWithError))
+	for i, entry := range d.keysWithError {
+		keysWithError[i] = entry.withEncodedKey()
+	}
+	keysWithErrorBytes, err := json.Marshal(keysWithError)
+	if err != nil {
+		return err
+	}
+	keysWithErrorBytes, err = utils.EncryptDataFile(d.encryptionKey, keysWithErrorBytes)
 	if err != nil {
 		return err
 	}
 
-	keysWithErrorFileName := d.mutationDifferFileDir + base.FileDirDelimiter + base.DiffErrorKeysFileName
+	keysWithErrorFileName := utils.JoinPath(d.mutationDifferFileDir, base.DiffErrorKeysFileName)
 	keysWithErrorFile, err := os.OpenFile(keysWithErrorFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
 	if err != nil {
 		return err
@@ -400,21 +860,37 @@ func (d *MutationDiffer) writeKeysWithError() error {
 
 func (d *MutationDiffer) getDiffBytes() ([]byte, error) {
 	outputMap := map[string]interface{}{
-		"Mismatch":          d.srcDiff,
-		"MissingFromSource": d.missingFromSource,
-		"MissingFromTarget": d.missingFromTarget,
+		"Mismatch":          redactKeys(d.srcDiff),
+		"MissingFromSource": redactKeys(d.missingFromSource),
+		"MissingFromTarget": redactKeys(d.missingFromTarget),
+	}
+	if d.compareType == base.MutationCompareTypeMetadata || d.compareTombstones {
+		outputMap["DeletedFromSource"] = redactKeys(d.deletedFromSource)
+		outputMap["DeletedFromTarget"] = redactKeys(d.deletedFromTarget)
+	}
+	if d.compareTombstones {
+		outputMap["TombstoneMismatch"] = redactKeys(d.tombstoneMismatch)
 	}
-	if d.compareType == base.MutationCompareTypeMetadata {
-		outputMap["DeletedFromSource"] = d.deletedFromSource
-		outputMap["DeletedFromTarget"] = d.deletedFromTarget
+	if d.filter != nil {
+		outputMap["IntentionallyNotReplicated"] = redactKeys(d.filteredFromTarget)
+	}
+	if d.compareType == base.MutationCompareTypeMetadata && d.tgtMaxTTL > 0 {
+		outputMap["ExpiryCappedByMaxTTL"] = redactKeys(d.expiryCappedByMaxTTL)
+	}
+	if d.compareXattrs {
+		outputMap["XattrMismatch"] = redactKeys(d.xattrMismatch)
 	}
 	return json.Marshal(outputMap)
 }
 
 func (d *MutationDiffer) writeDiffBytesToFile(diffBytes []byte) error {
 	fileName := base.MutationDiffFileName
-	fullFileName := d.mutationDifferFileDir + base.FileDirDelimiter + fileName
+	fullFileName := utils.JoinPath(d.mutationDifferFileDir, fileName)
 
+	diffBytes, err := utils.EncryptDataFile(d.encryptionKey, diffBytes)
+	if err != nil {
+		return err
+	}
 	diffFile, err := os.OpenFile(fullFileName, os.O_RDWR|os.O_CREATE, base.FileModeReadWrite)
 	if err != nil {
 		return err
@@ -427,46 +903,68 @@ func (d *MutationDiffer) writeDiffBytesToFile(diffBytes []byte) error {
 
 }
 
-func (d *MutationDiffer) loadDiffKeys() (DiffKeysMap, DiffKeysMap, MigrationHintMap, error) {
-	srcDiffKeysBytes, err := ioutil.ReadFile(d.srcDiffKeysFileName)
-	if err != nil {
-		return nil, nil, nil, err
+// Returns the source and the target diff keys files, which are too large to load and are streamed instead, alongside
+// the loaded migration hints
+func (d *MutationDiffer) loadDiffKeys() ([]string, []string, MigrationHintMap, error) {
+	if len(d.srcColIdsToDiff) > 0 {
+		return d.loadCollectionDiffKeys()
 	}
 
-	tgtDiffKeyBytes, err := ioutil.ReadFile(d.tgtDiffKeysFileName)
-	if err != nil {
+	if _, err := os.Stat(d.srcDiffKeysFileName); err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := os.Stat(d.tgtDiffKeysFileName); err != nil {
 		return nil, nil, nil, err
 	}
 
 	// migration hint map may or may not exist
-	var migrationHintFound bool
+	migrationHintMap := make(MigrationHintMap)
 	migrationHintFile := fmt.Sprintf("%v_%v", d.srcDiffKeysFileName, base.DiffKeysSrcMigrationHintSuffix)
-	migrationHintBytes, err := ioutil.ReadFile(migrationHintFile)
+	migrationHintBytes, err := utils.ReadDataFile(d.encryptionKey, migrationHintFile)
 	if err == nil {
-		migrationHintFound = true
+		err = json.Unmarshal(migrationHintBytes, &migrationHintMap)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("hintUnmarshal %v", err)
+		}
 	}
 
-	srcDiffKeys := make(DiffKeysMap)
-	tgtDiffKeys := make(DiffKeysMap)
-	migrationHintMap := make(MigrationHintMap)
+	return []string{d.srcDiffKeysFileName}, []string{d.tgtDiffKeysFileName}, migrationHintMap, nil
+}
 
-	err = json.Unmarshal(srcDiffKeysBytes, &srcDiffKeys)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("srcUnmarshal %v", err)
-	}
-	err = json.Unmarshal(tgtDiffKeyBytes, &tgtDiffKeys)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("tgtUnmarshal %v", err)
+// Returns the per-collection diff keys files of only srcColIdsToDiff, and those of the target collections they map
+// to. A collection without a file has no diffs
+func (d *MutationDiffer) loadCollectionDiffKeys() ([]string, []string, MigrationHintMap, error) {
+	var srcDiffKeysFiles, tgtDiffKeysFiles []string
+	tgtColIdsAdded := make(map[uint32]bool)
+
+	addFile := func(fileName string, fileNames []string) ([]string, error) {
+		_, err := os.Stat(fileName)
+		if os.IsNotExist(err) {
+			return fileNames, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return append(fileNames, fileName), nil
 	}
 
-	if migrationHintFound {
-		err = json.Unmarshal(migrationHintBytes, &migrationHintMap)
+	var err error
+	for _, srcColId := range d.srcColIdsToDiff {
+		srcDiffKeysFiles, err = addFile(utils.DiffKeysCollectionFileName(d.srcDiffKeysFileName, srcColId), srcDiffKeysFiles)
 		if err != nil {
-			return nil, nil, nil, fmt.Errorf("hintUnmarshal %v", err)
+			return nil, nil, nil, err
+		}
+		for _, tgtColId := range d.colIdsMap[srcColId] {
+			if tgtColIdsAdded[tgtColId] {
+				continue
+			}
+			tgtColIdsAdded[tgtColId] = true
+			tgtDiffKeysFiles, err = addFile(utils.DiffKeysCollectionFileName(d.tgtDiffKeysFileName, tgtColId), tgtDiffKeysFiles)
+			if err != nil {
+				return nil, nil, nil, err
+			}
 		}
 	}
-
-	return srcDiffKeys, tgtDiffKeys, migrationHintMap, nil
+	return srcDiffKeysFiles, tgtDiffKeysFiles, make(MigrationHintMap), nil
 }
 
 func (d *MutationDiffer) addDocDiff(missingFromSource, missingFromTarget map[uint32]map[string]*GocbResult, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget map[uint32]map[string][]*GocbResult) {
@@ -535,8 +1033,24 @@ func (d *MutationDiffer) addKeysWithError(keysWithError MutationDiffFetchList) {
 	atomic.AddUint32(&d.numKeysWithErrors, uint32(len(keysWithError)))
 }
 
+// Keys that were not fetched because the context is done. Those the deadline stopped are left to a follow-up run
+func (d *MutationDiffer) addSkippedKeys(skippedKeys MutationDiffFetchList) {
+	if !d.DeadlineReached() {
+		d.addKeysWithError(skippedKeys)
+		return
+	}
+	unverifiedKeys := make([]*UnverifiedKey, 0, len(skippedKeys))
+	for _, fetchItem := range skippedKeys {
+		unverifiedKeys = append(unverifiedKeys, &UnverifiedKey{MutationDifferFetchEntry: fetchItem, Error: base.MutationDifferMaxDurationError})
+	}
+	d.addUnverifiedKeys(unverifiedKeys)
+}
+
 type DifferWorker struct {
-	differ           *MutationDiffer
+	ctx       context.Context
+	differ    *MutationDiffer
+	fetchChan <-chan *MutationDifferFetchEntry
+	// The chunk of the fetch list currently worked on
 	fetchList        MutationDiffFetchList
 	sourceBucket     *GocbcoreAgent
 	targetBucket     *GocbcoreAgent
@@ -545,6 +1059,10 @@ type DifferWorker struct {
 	waitGroup        *sync.WaitGroup
 	sourceResults    map[uint32]map[string]Result
 	targetResults    map[uint32]map[string]Result
+	sourceXattrs     map[uint32]map[string]map[string]json.RawMessage
+	targetXattrs     map[uint32]map[string]map[string]json.RawMessage
+	sourceMetas      map[uint32]map[string]*gocbcore.GetMetaResult
+	targetMetas      map[uint32]map[string]*gocbcore.GetMetaResult
 	resultsLock      sync.RWMutex
 	logger           *xdcrLog.CommonLogger
 	colIds           map[uint32][]uint32
@@ -554,17 +1072,22 @@ type DifferWorker struct {
 	retries          int
 }
 
-func NewDifferWorker(differ *MutationDiffer, sourceDCPAgent, targetDCPAgent *gocbcore.DCPAgent, sourceBucket,
-	targetBucket *GocbcoreAgent, fetchList MutationDiffFetchList, waitGroup *sync.WaitGroup, colIds,
+func NewDifferWorker(ctx context.Context, differ *MutationDiffer, sourceDCPAgent, targetDCPAgent *gocbcore.DCPAgent, sourceBucket,
+	targetBucket *GocbcoreAgent, fetchChan <-chan *MutationDifferFetchEntry, waitGroup *sync.WaitGroup, colIds,
 	reverseColIds map[uint32][]uint32, migrationHintMap MigrationHintMap, compareType string, retries int) *DifferWorker {
 	return &DifferWorker{
+		ctx:              ctx,
 		differ:           differ,
 		sourceBucket:     sourceBucket,
 		targetBucket:     targetBucket,
-		fetchList:        fetchList,
+		fetchChan:        fetchChan,
 		waitGroup:        waitGroup,
 		sourceResults:    make(map[uint32]map[string]Result),
 		targetResults:    make(map[uint32]map[string]Result),
+		sourceXattrs:     make(map[uint32]map[string]map[string]json.RawMessage),
+		targetXattrs:     make(map[uint32]map[string]map[string]json.RawMessage),
+		sourceMetas:      make(map[uint32]map[string]*gocbcore.GetMetaResult),
+		targetMetas:      make(map[uint32]map[string]*gocbcore.GetMetaResult),
 		logger:           differ.logger,
 		sourceDcpAgent:   sourceDCPAgent,
 		targetDcpAgent:   targetDCPAgent,
@@ -599,29 +1122,132 @@ func compileReverseMap(srcToTgts map[uint32][]uint32) map[uint32][]uint32 {
 	return reverseMap
 }
 
+// Works on the fetch list one chunk at a time, so that only the results of a chunk are held at once
 func (dw *DifferWorker) run() {
 	defer dw.waitGroup.Done()
-	dw.getResults()
-	dw.diff()
+	for dw.nextChunk() {
+		dw.getResults()
+		if dw.differ.compareXattrs {
+			dw.getXattrs()
+		}
+		if dw.differ.compareTombstones && dw.compareType != base.MutationCompareTypeMetadata {
+			dw.getTombstones()
+		}
+		dw.diff()
+	}
 }
 
-func (dw *DifferWorker) getResults() {
-	index := 0
-	for {
-		if index >= len(dw.fetchList) {
+// Takes the next chunk of the fetch list off fetchChan, waiting for its first entry but not for the rest, and
+// clears the results of the previous chunk. Returns false once fetchChan is closed and drained
+func (dw *DifferWorker) nextChunk() bool {
+	fetchItem, ok := <-dw.fetchChan
+	if !ok {
+		return false
+	}
+	chunkSize := dw.differ.batchSize * base.MutationDifferBatchesPerChunk
+	dw.fetchList = MutationDiffFetchList{fetchItem}
+	for len(dw.fetchList) < chunkSize {
+		select {
+		case fetchItem, ok = <-dw.fetchChan:
+		default:
+			ok = false
+		}
+		if !ok {
 			break
 		}
+		dw.fetchList = append(dw.fetchList, fetchItem)
+	}
 
-		if index+dw.differ.batchSize < len(dw.fetchList) {
-			dw.sendBatchWithRetry(index, index+dw.differ.batchSize)
-			index += dw.differ.batchSize
-			continue
+	dw.sourceResults = make(map[uint32]map[string]Result)
+	dw.targetResults = make(map[uint32]map[string]Result)
+	dw.sourceXattrs = make(map[uint32]map[string]map[string]json.RawMessage)
+	dw.targetXattrs = make(map[uint32]map[string]map[string]json.RawMessage)
+	dw.sourceMetas = make(map[uint32]map[string]*gocbcore.GetMetaResult)
+	dw.targetMetas = make(map[uint32]map[string]*gocbcore.GetMetaResult)
+	return true
+}
+
+// Sends the batches of each KV node back to back, keeping up to base.MutationDifferBatchesInFlightPerKvNode of them
+// in flight on each node, instead of waiting for each batch before sending the next. Batches that fail are sent
+// again with sendBatchWithRetry
+func (dw *DifferWorker) getResults() {
+	kvNodeBatches := dw.batchRangesByKvNode()
+	doneCh := make(chan *batch, len(kvNodeBatches)*base.MutationDifferBatchesInFlightPerKvNode)
+	var numInFlight int
+
+	// Sends the next batch of the node, if any, unless the context is done
+	sendNext := func(kvNode int) {
+		if dw.ctx.Err() != nil || len(kvNodeBatches[kvNode]) == 0 {
+			return
 		}
+		batchRange := kvNodeBatches[kvNode][0]
+		kvNodeBatches[kvNode] = kvNodeBatches[kvNode][1:]
+		b := NewBatch(dw, batchRange[0], batchRange[1])
+		b.kvNode = kvNode
+		b.start(doneCh)
+		numInFlight++
+	}
 
-		dw.sendBatchWithRetry(index, len(dw.fetchList))
-		break
+	for kvNode := range kvNodeBatches {
+		for i := 0; i < base.MutationDifferBatchesInFlightPerKvNode; i++ {
+			sendNext(kvNode)
+		}
+	}
+	for numInFlight > 0 {
+		b := <-doneCh
+		numInFlight--
+		if b.err() != nil {
+			dw.sendBatchWithRetry(b.startIndex, b.endIndex)
+		} else {
+			dw.mergeResults(b)
+			dw.retryKeysWithErrors(dw.fetchList[b.startIndex:b.endIndex])
+			// fetchList with error are also counted toward keysProcessed
+			atomic.AddUint32(&dw.differ.numKeysProcessed, uint32(b.endIndex-b.startIndex))
+		}
+		sendNext(b.kvNode)
+	}
+
+	var numSkipped int
+	for _, batchRanges := range kvNodeBatches {
+		for _, batchRange := range batchRanges {
+			dw.differ.addSkippedKeys(dw.fetchList[batchRange[0]:batchRange[1]])
+			numSkipped += batchRange[1] - batchRange[0]
+		}
+	}
+	if numSkipped > 0 {
+		dw.logger.Warnf("Skipped check on %v fetchList since the context is done\n", numSkipped)
 	}
+}
 
+// Orders the fetch list by the KV node of the source docs, and returns the index ranges of the batches of each
+// node. Keys of unknown nodes are batched together
+func (dw *DifferWorker) batchRangesByKvNode() [][][2]int {
+	kvNodeFetchLists := make(map[string]MutationDiffFetchList)
+	for _, fetchItem := range dw.fetchList {
+		kvNode := dw.differ.srcVbKvNodes[utils.GetVbucketFromKey([]byte(fetchItem.Key))]
+		kvNodeFetchLists[kvNode] = append(kvNodeFetchLists[kvNode], fetchItem)
+	}
+	kvNodes := make([]string, 0, len(kvNodeFetchLists))
+	for kvNode := range kvNodeFetchLists {
+		kvNodes = append(kvNodes, kvNode)
+	}
+	sort.Strings(kvNodes)
+
+	var kvNodeBatches [][][2]int
+	fetchList := make(MutationDiffFetchList, 0, len(dw.fetchList))
+	for _, kvNode := range kvNodes {
+		var batchRanges [][2]int
+		for _, fetchItem := range kvNodeFetchLists[kvNode] {
+			if len(batchRanges) == 0 || batchRanges[len(batchRanges)-1][1]-batchRanges[len(batchRanges)-1][0] == dw.differ.batchSize {
+				batchRanges = append(batchRanges, [2]int{len(fetchList), len(fetchList)})
+			}
+			fetchList = append(fetchList, fetchItem)
+			batchRanges[len(batchRanges)-1][1]++
+		}
+		kvNodeBatches = append(kvNodeBatches, batchRanges)
+	}
+	dw.fetchList = fetchList
+	return kvNodeBatches
 }
 
 func (dw *DifferWorker) sendBatchWithRetry(startIndex, endIndex int) {
@@ -635,11 +1261,13 @@ func (dw *DifferWorker) sendBatchWithRetry(startIndex, endIndex int) {
 		return nil
 	}
 
-	opErr := utils.ExponentialBackoffExecutor("sendBatchWithRetry", dw.differ.sendBatchRetryInterval, dw.differ.maxNumOfSendBatchRetry,
+	opErr := utils.ExponentialBackoffExecutorWithContext(dw.ctx, "sendBatchWithRetry", dw.differ.sendBatchRetryInterval, dw.differ.maxNumOfSendBatchRetry,
 		base.SendBatchBackoffFactor, dw.differ.sendBatchMaxBackoff, sendBatchFunc)
 	if opErr != nil {
 		dw.logger.Warnf("Skipped check on %v fetchList because of err=%v.\n", endIndex-startIndex, opErr)
-		dw.differ.addKeysWithError(dw.fetchList[startIndex:endIndex])
+		dw.differ.addSkippedKeys(dw.fetchList[startIndex:endIndex])
+	} else {
+		dw.retryKeysWithErrors(dw.fetchList[startIndex:endIndex])
 	}
 	// fetchList with error are also counted toward keysProcessed
 	atomic.AddUint32(&dw.differ.numKeysProcessed, uint32(endIndex-startIndex))
@@ -674,8 +1302,8 @@ func (dw *DifferWorker) diff() {
 	tgtDiff := make(map[uint32]map[string][]*GocbResult)
 	deletedFromSource := make(map[uint32]map[string][]*GocbResult)
 	deletedFromTarget := make(map[uint32]map[string][]*GocbResult)
-
-	migrationMode := len(dw.migrationHintMap) > 0
+	xattrMismatch := make(map[uint32]map[string][]*GocbResult)
+	tombstoneMismatch := make(map[uint32]map[string][]*GocbResult)
 
 	var gocbResultConstructor func(input interface{}) *GocbResult
 	var areResultsTheSame func(a, b interface{}) bool
@@ -688,6 +1316,9 @@ func (dw *DifferWorker) diff() {
 			}
 		}
 		areResultsTheSame = areGetResultsBodyTheSame
+		if dw.differ.jsonAwareBodyCompare {
+			areResultsTheSame = areGetResultsJsonBodyTheSame
+		}
 	case base.MutationCompareTypeBodyAndMeta:
 		gocbResultConstructor = func(input interface{}) *GocbResult {
 			return &GocbResult{
@@ -695,6 +1326,9 @@ func (dw *DifferWorker) diff() {
 			}
 		}
 		areResultsTheSame = areGetResultsTheSame
+		if dw.differ.jsonAwareBodyCompare {
+			areResultsTheSame = areGetResultsJsonAwareTheSame
+		}
 	case base.MutationCompareTypeMetadata:
 		gocbResultConstructor = func(input interface{}) *GocbResult {
 			return &GocbResult{
@@ -702,6 +1336,11 @@ func (dw *DifferWorker) diff() {
 			}
 		}
 		areResultsTheSame = areGetMetaResultsTheSame
+		if expiryTolerance := dw.differ.expiryTolerance; expiryTolerance > 0 {
+			areResultsTheSame = func(a, b interface{}) bool {
+				return areGetMetaResultsTheSameWithExpiryTolerance(a, b, expiryTolerance)
+			}
+		}
 		isDeletedPerMetadata = func(input interface{}) bool {
 			return isDeleted(input.(*gocbcore.GetMetaResult))
 		}
@@ -713,18 +1352,14 @@ func (dw *DifferWorker) diff() {
 				continue
 			}
 
-			var tgtColIds []uint32
-			if migrationMode {
-				tgtColIds = dw.migrationHintMap[key]
-			} else {
-				tgtColIds = dw.colIds[srcColId]
-			}
-
-			for _, tgtColId := range tgtColIds {
+			for _, tgtColId := range dw.getTargetColIds(srcColId, key) {
 				targetResult := dw.targetResults[tgtColId][key]
 				if targetResult.Key() == "" {
 					continue
 				}
+				if dw.differ.compareTombstones && dw.diffTombstones(srcColId, tgtColId, key, sourceResult, targetResult, deletedFromSource, deletedFromTarget, tombstoneMismatch) {
+					continue
+				}
 				if isKeyNotFoundError(sourceResult.Error()) && !isKeyNotFoundError(targetResult.Error()) {
 					if _, exists := missingFromSource[srcColId]; !exists {
 						missingFromSource[srcColId] = make(map[string]*GocbResult)
@@ -739,7 +1374,7 @@ func (dw *DifferWorker) diff() {
 					missingFromTarget[tgtColId][key] = gocbResultConstructor(sourceResult.GoCbResult())
 					continue
 				}
-				if !areResultsTheSame(sourceResult.GoCbResult(), targetResult.GoCbResult()) {
+				if !dw.differ.areResultsTheSame(key, areResultsTheSame, sourceResult.GoCbResult(), targetResult.GoCbResult()) {
 					if isDeletedPerMetadata != nil && isDeletedPerMetadata(sourceResult.GoCbResult()) {
 						if _, exists := deletedFromSource[srcColId]; !exists {
 							deletedFromSource[srcColId] = make(map[string][]*GocbResult)
@@ -762,6 +1397,19 @@ func (dw *DifferWorker) diff() {
 						tgtDiff[tgtColId] = make(map[string][]*GocbResult)
 					}
 					tgtDiff[tgtColId][key] = append(tgtDiff[tgtColId][key], []*GocbResult{gocbResultConstructor(targetResult.GoCbResult()), gocbResultConstructor(sourceResult.GoCbResult())}...)
+				} else if dw.differ.compareXattrs {
+					srcXattrs, srcFound := dw.sourceXattrs[srcColId][key]
+					tgtXattrs, tgtFound := dw.targetXattrs[tgtColId][key]
+					if srcFound && tgtFound && !areXattrsTheSameIgnoringSyncGateway(srcXattrs, tgtXattrs, dw.differ.ignoreSyncGatewayXattrs) {
+						if _, exists := xattrMismatch[srcColId]; !exists {
+							xattrMismatch[srcColId] = make(map[string][]*GocbResult)
+						}
+						srcXattrResult := gocbResultConstructor(sourceResult.GoCbResult())
+						srcXattrResult.Xattrs = srcXattrs
+						tgtXattrResult := gocbResultConstructor(targetResult.GoCbResult())
+						tgtXattrResult.Xattrs = tgtXattrs
+						xattrMismatch[srcColId][key] = append(xattrMismatch[srcColId][key], srcXattrResult, tgtXattrResult)
+					}
 				}
 			}
 		}
@@ -796,23 +1444,49 @@ func (dw *DifferWorker) diff() {
 	}
 
 	dw.differ.addDocDiff(missingFromSource, missingFromTarget, srcDiff, tgtDiff, deletedFromSource, deletedFromTarget)
+	dw.differ.addXattrDiff(xattrMismatch)
+	dw.differ.addTombstoneDiff(tombstoneMismatch)
+}
+
+func (dw *DifferWorker) getTargetColIds(srcColId uint32, key string) []uint32 {
+	if len(dw.migrationHintMap) > 0 {
+		return dw.migrationHintMap[key]
+	}
+	return dw.colIds[srcColId]
 }
 
 type batch struct {
 	dw                *DifferWorker
 	fetchList         MutationDiffFetchList
-	waitGroup         sync.WaitGroup
 	sourceResultCount uint32
 	targetResultCount uint32
 	sourceResults     map[uint32]map[string]Result
 	targetResults     map[uint32]map[string]Result
 	resultsLock       sync.RWMutex
+	// Where the batch is in the fetch list of dw, and the index of the KV node it is sent to, for pipelined batches
+	startIndex int
+	endIndex   int
+	kvNode     int
+	// Gets that have not completed yet
+	numPending int32
+	doneOnce   sync.Once
+	timer      *time.Timer
+	timerLock  sync.Mutex
+	timedOut   bool
+	doneCh     chan<- *batch
 }
 
 func NewBatch(dw *DifferWorker, startIndex, endIndex int) *batch {
+	b := newBatchFromFetchList(dw, dw.fetchList[startIndex:endIndex])
+	b.startIndex = startIndex
+	b.endIndex = endIndex
+	return b
+}
+
+func newBatchFromFetchList(dw *DifferWorker, fetchList MutationDiffFetchList) *batch {
 	b := &batch{
 		dw:            dw,
-		fetchList:     dw.fetchList[startIndex:endIndex],
+		fetchList:     fetchList,
 		sourceResults: make(map[uint32]map[string]Result),
 		targetResults: make(map[uint32]map[string]Result),
 	}
@@ -858,25 +1532,65 @@ func NewBatch(dw *DifferWorker, startIndex, endIndex int) *batch {
 // then try a few times to see if the same CAS are ever the same. If they are, then it means
 // this is not a diff
 func (b *batch) send() error {
+	doneCh := make(chan *batch, 1)
+	b.start(doneCh)
+	<-doneCh
+	return b.err()
+}
+
+// Sends all the gets of the batch without waiting for them. The batch is sent to doneCh once they have all
+// completed, or once the timeout has passed
+func (b *batch) start(doneCh chan<- *batch) {
+	b.doneCh = doneCh
+	numGets := 0
+	for _, fetchItem := range b.fetchList {
+		numGets += 1 + len(fetchItem.TgtColIds)
+	}
+	if numGets == 0 {
+		b.done(false)
+		return
+	}
+	// One more than the gets, so that the batch is not done before they have all been sent and the timer started
+	atomic.StoreInt32(&b.numPending, int32(numGets+1))
 	for _, fetchItem := range b.fetchList {
 		b.fetchItemAndStoreResult(fetchItem)
 	}
 
-	doneChan := make(chan bool, 1)
-	go utils.WaitForWaitGroup(&b.waitGroup, doneChan)
+	b.timerLock.Lock()
+	b.timer = time.AfterFunc(time.Duration(b.dw.differ.timeout)*time.Second, func() {
+		b.done(true)
+	})
+	b.timerLock.Unlock()
+	b.getCompleted()
+}
 
-	timer := time.NewTimer(time.Duration(b.dw.differ.timeout) * time.Second)
-	defer timer.Stop()
-	for {
-		select {
-		case <-doneChan:
-			return nil
-		case <-timer.C:
-			return fmt.Errorf("mutation differ batch timed out")
+func (b *batch) done(timedOut bool) {
+	b.doneOnce.Do(func() {
+		b.timerLock.Lock()
+		if b.timer != nil {
+			b.timer.Stop()
 		}
+		b.timerLock.Unlock()
+		b.timedOut = timedOut
+		b.doneCh <- b
+	})
+}
+
+// Called once for each get, whether it succeeded or not
+func (b *batch) getCompleted() {
+	if atomic.AddInt32(&b.numPending, -1) == 0 {
+		b.done(false)
 	}
 }
 
+// Only valid once the batch has been sent to doneCh
+func (b *batch) err() error {
+	if b.timedOut {
+		return fmt.Errorf("mutation differ batch timed out")
+	}
+	return nil
+}
+
 func (b *batch) fetchItemAndStoreResult(fetchItem *MutationDifferFetchEntry) {
 	getBody := false
 	if b.dw.differ.compareType == base.MutationCompareTypeBodyOnly ||
@@ -899,7 +1613,7 @@ func (b *batch) get(key string, isSource bool, getBody bool, colId uint32) {
 		}
 		resultInMap := resultsMap[key]
 		resultInMap.Set(key, result, err)
-		b.waitGroup.Done()
+		b.getCompleted()
 	}
 
 	getMetaCallbackFunc := func(result *gocbcore.GetMetaResult, err error) {
@@ -911,10 +1625,9 @@ func (b *batch) get(key string, isSource bool, getBody bool, colId uint32) {
 		}
 		resultInMap := resultsMap[key]
 		resultInMap.Set(key, result, err)
-		b.waitGroup.Done()
+		b.getCompleted()
 	}
 
-	b.waitGroup.Add(1)
 	var err error
 	if isSource {
 		if getBody {
@@ -935,6 +1648,14 @@ func (b *batch) get(key string, isSource bool, getBody bool, colId uint32) {
 			b.dw.logger.Errorf("targetBucketGetErr %v\n", err)
 		}
 	}
+	// The callback is not called for gets that could not be sent
+	if err != nil {
+		if getBody {
+			getCallbackFunc(nil, err)
+		} else {
+			getMetaCallbackFunc(nil, err)
+		}
+	}
 }
 
 func isKeyNotFoundError(err error) bool {
@@ -942,12 +1663,12 @@ func isKeyNotFoundError(err error) bool {
 }
 
 func areGetResultsTheSame(result1Raw, result2Raw interface{}) bool {
+	return areGetResultsBodyTheSame(result1Raw, result2Raw) && areGetResultsMetaTheSame(result1Raw, result2Raw)
+}
+
+func areGetResultsMetaTheSame(result1Raw, result2Raw interface{}) bool {
 	result1 := result1Raw.(*gocbcore.GetResult)
 	result2 := result2Raw.(*gocbcore.GetResult)
-	if !areGetResultsBodyTheSame(result1, result2) {
-		return false
-	}
-
 	if result1 == nil && result2 != nil || result1 != nil && result2 == nil {
 		return false
 	} else if result1 == nil && result2 == nil {
@@ -968,10 +1689,15 @@ func areGetResultsBodyTheSame(result1Raw, result2Raw interface{}) bool {
 		return false
 	}
 
-	return reflect.DeepEqual(result1.Value, result2.Value)
+	return areRawBodiesTheSame(result1.Value, result2.Value)
 }
 
 func areGetMetaResultsTheSame(result1Raw, result2Raw interface{}) bool {
+	return areGetMetaResultsTheSameWithExpiryTolerance(result1Raw, result2Raw, 0)
+}
+
+// Expiries are the same if they are no more than expiryTolerance seconds apart
+func areGetMetaResultsTheSameWithExpiryTolerance(result1Raw, result2Raw interface{}, expiryTolerance uint32) bool {
 	result1 := result1Raw.(*gocbcore.GetMetaResult)
 	result2 := result2Raw.(*gocbcore.GetMetaResult)
 	if result1 == nil && result2 == nil {
@@ -993,8 +1719,23 @@ func areGetMetaResultsTheSame(result1Raw, result2Raw interface{}) bool {
 	} else {
 		// Only compare json part of datatype
 		return result1.Cas == result2.Cas && result1.SeqNo == result2.SeqNo && result1.Flags == result2.Flags &&
-			result1.Expiry == result2.Expiry && result1.Deleted == result2.Deleted && (result1.Datatype&base.JSONDataType == result2.Datatype&base.JSONDataType)
+			isExpiryWithinTolerance(result1.Expiry, result2.Expiry, expiryTolerance) && result1.Deleted == result2.Deleted &&
+			(result1.Datatype&base.JSONDataType == result2.Datatype&base.JSONDataType)
+	}
+}
+
+// A doc without expiry never matches one with an expiry, however close
+func isExpiryWithinTolerance(expiry1, expiry2, expiryTolerance uint32) bool {
+	if expiry1 == expiry2 {
+		return true
+	}
+	if expiry1 == 0 || expiry2 == 0 {
+		return false
+	}
+	if expiry1 > expiry2 {
+		return expiry1-expiry2 <= expiryTolerance
 	}
+	return expiry2-expiry1 <= expiryTolerance
 }
 func isDeleted(result *gocbcore.GetMetaResult) bool {
 	if result != nil {
@@ -1097,6 +1838,13 @@ func (d *MutationDiffer) initialize() error {
 	if err != nil {
 		return err
 	}
+
+	d.srcVbKvNodes = make(map[uint16]string)
+	for kvNode, vbnos := range d.srcKvVbMap {
+		for _, vbno := range vbnos {
+			d.srcVbKvNodes[vbno] = kvNode
+		}
+	}
 	return nil
 }
 
@@ -1131,8 +1879,10 @@ func (d *MutationDiffer) openBucket(bucketName string, reference *metadata.Remot
 
 	if reference.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
 		auth = &base.CertificateAuth{
-			PasswordAuth:     pwAuth,
-			CertificateBytes: reference.Certificates(),
+			PasswordAuth:      pwAuth,
+			CertificateBytes:  reference.Certificates(),
+			ClientCertificate: reference.ClientCertificate(),
+			ClientKey:         reference.ClientKey(),
 		}
 		err = d.initializeKvSSLMap(source)
 		if err != nil {
@@ -1142,30 +1892,42 @@ func (d *MutationDiffer) openBucket(bucketName string, reference *metadata.Remot
 		if err != nil {
 			return err
 		}
-		// For SSL, the connStr will be secure SSL port to KV directly through CCCP
-		var sslPort uint16
-		var kvVbMap = d.srcKvVbMap
-		var sslPortMap = d.srcKvSSLPortMap
-		if !source {
-			kvVbMap = d.tgtKvVbMap
-			sslPortMap = d.tgtKvSSLPortMap
-		}
-		for k, _ := range kvVbMap {
-			connStr = k
-			break
-		}
-		sslPort, found := sslPortMap[connStr]
-		if !found {
-			return fmt.Errorf("Cannot find SSL port for %v in map %v", connStr, sslPortMap)
+		if base.GetNetworkType() == base.NetworkTypeExternal {
+			// The vbucket map only holds the internal addresses of the nodes. gocbcore picks the alternate ones
+			kvPort := d.srcKvPort
+			if !source {
+				kvPort = d.tgtKvPort
+			}
+			connStr = utils.PopulateCCCPConnectString(reference.HostName(), true, kvPort)
+		} else {
+			// For SSL, the connStr will be secure SSL port to KV directly through CCCP
+			var sslPort uint16
+			var kvVbMap = d.srcKvVbMap
+			var sslPortMap = d.srcKvSSLPortMap
+			if !source {
+				kvVbMap = d.tgtKvVbMap
+				sslPortMap = d.tgtKvSSLPortMap
+			}
+			for k, _ := range kvVbMap {
+				connStr = k
+				break
+			}
+			sslPort, found := sslPortMap[connStr]
+			if !found {
+				return fmt.Errorf("Cannot find SSL port for %v in map %v", connStr, sslPortMap)
+			}
+			connStr = xdcrBase.GetHostAddr(xdcrBase.GetHostName(connStr), sslPort)
+			base.TagCouchbaseSecurePrefix(&connStr)
 		}
-		connStr = xdcrBase.GetHostAddr(xdcrBase.GetHostName(connStr), sslPort)
-		base.TagCouchbaseSecurePrefix(&connStr)
 	} else {
 		auth = &pwAuth
 		base.TagHttpPrefix(&connStr)
 	}
 
 	agent, err := NewGocbcoreAgent(name, []string{connStr}, bucketName, auth, d.batchSize, capability)
+	if err == nil {
+		agent.SetRateLimit(d.opsPerSecLimit)
+	}
 
 	if source {
 		d.sourceBucket = agent
@@ -1214,15 +1976,19 @@ func (d *MutationDiffer) initializeKVVBMap(source bool) error {
 	}
 
 	if source {
-		_, _, _, _, _, d.srcKvVbMap, err = d.utils.BucketValidationInfo(connStr, d.sourceBucketName, d.sourceReference.UserName(),
+		_, _, _, d.srcConflictResolutionType, _, d.srcKvVbMap, err = d.utils.BucketValidationInfo(connStr, d.sourceBucketName, d.sourceReference.UserName(),
 			d.sourceReference.Password(), d.sourceReference.HttpAuthMech(), d.sourceReference.Certificates(),
 			d.sourceReference.SANInCertificate(), d.sourceReference.ClientCertificate(), d.sourceReference.ClientKey(),
 			d.logger)
 	} else {
-		_, _, _, _, _, d.tgtKvVbMap, err = d.utils.BucketValidationInfo(connStr, d.targetBucketName, d.targetReference.UserName(),
+		var bucketInfo map[string]interface{}
+		bucketInfo, _, _, d.tgtConflictResolutionType, _, d.tgtKvVbMap, err = d.utils.BucketValidationInfo(connStr, d.targetBucketName, d.targetReference.UserName(),
 			d.targetReference.Password(), d.targetReference.HttpAuthMech(), d.targetReference.Certificates(),
 			d.targetReference.SANInCertificate(), d.targetReference.ClientCertificate(), d.targetReference.ClientKey(),
 			d.logger)
+		if err == nil {
+			d.tgtMaxTTL = getMaxTTLFromBucketInfo(bucketInfo)
+		}
 	}
 
 	return err
@@ -1256,7 +2022,8 @@ func (d *MutationDiffer) containsDiff() bool {
 
 	return resultMapContainsAtLeastOne(d.missingFromSource) || resultMapContainsAtLeastOne(d.missingFromTarget) ||
 		resultMapContainsAtLeastOne(d.srcDiff) || resultMapContainsAtLeastOne(d.tgtDiff) ||
-		resultMapContainsAtLeastOne(d.deletedFromSource) || resultMapContainsAtLeastOne(d.deletedFromTarget)
+		resultMapContainsAtLeastOne(d.deletedFromSource) || resultMapContainsAtLeastOne(d.deletedFromTarget) ||
+		resultMapContainsAtLeastOne(d.xattrMismatch) || resultMapContainsAtLeastOne(d.tombstoneMismatch)
 }
 
 func resultMapToDiffKeysMap(generic interface{}) DiffKeysMap {
@@ -1297,6 +2064,8 @@ func (d *MutationDiffer) getDiffKeysFromSourceGocbResult() DiffKeysMap {
 	resultMap.Merge(resultMapToDiffKeysMap(d.missingFromSource))
 	resultMap.Merge(resultMapToDiffKeysMap(d.srcDiff))
 	resultMap.Merge(resultMapToDiffKeysMap(d.deletedFromSource))
+	resultMap.Merge(resultMapToDiffKeysMap(d.xattrMismatch))
+	resultMap.Merge(resultMapToDiffKeysMap(d.tombstoneMismatch))
 	return resultMap
 }
 
@@ -1321,17 +2090,252 @@ func (d *MutationDiffer) clearGoCbResults() {
 	d.tgtDiff = make(map[uint32]map[string][]*GocbResult)
 	d.deletedFromSource = make(map[uint32]map[string][]*GocbResult)
 	d.deletedFromTarget = make(map[uint32]map[string][]*GocbResult)
+	d.filteredFromTarget = make(map[uint32]map[string]*GocbResult)
+	d.expiryCappedByMaxTTL = make(map[uint32]map[string][]*GocbResult)
+	d.xattrMismatch = make(map[uint32]map[string][]*GocbResult)
+	d.tombstoneMismatch = make(map[uint32]map[string][]*GocbResult)
+}
+
+// A key missing from the target, and the source doc to run through the filter expression
+type filterCheckDoc struct {
+	tgtColId uint32
+	srcColId uint32
+	key      string
+	// Set once the doc is fetched, or found gone from the source
+	fetched bool
+	result  *gocbcore.GetResult
+	xattrs  map[string]json.RawMessage
+}
+
+// What one attempt at fetching a filterCheckDoc got back. A timed out attempt is abandoned along with its
+// callbacks, which may still complete
+type filterCheckFetch struct {
+	result    *gocbcore.GetResult
+	getErr    error
+	xattrs    map[string]json.RawMessage
+	xattrsErr error
+}
+
+// Keys missing from the target may have been skipped on purpose by the replication filter expression
+// Fetch the source docs of these keys and run them through the filter. The ones that do not pass
+// are moved out of missingFromTarget, so that they are neither reported as missing nor retried
+// The docs are fetched batchSize at a time, each batch with its own timeout and retries
+func (d *MutationDiffer) separateFilteredFromMissing(ctx context.Context) {
+	if d.filter == nil || len(d.migrationHintMap) > 0 {
+		return
+	}
+
+	d.stateLock.RLock()
+	var docs []*filterCheckDoc
+	for tgtColId, missingPerCol := range d.missingFromTarget {
+		srcColIds := d.reverseTgtColIdsMap[tgtColId]
+		if len(srcColIds) == 0 {
+			continue
+		}
+		for key := range missingPerCol {
+			docs = append(docs, &filterCheckDoc{tgtColId: tgtColId, srcColId: srcColIds[0], key: key})
+		}
+	}
+	d.stateLock.RUnlock()
+
+	for start := 0; start < len(docs) && ctx.Err() == nil; start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batchDocs := docs[start:end]
+		opErr := utils.ExponentialBackoffExecutorWithContext(ctx, "separateFilteredFromMissing", d.sendBatchRetryInterval,
+			d.maxNumOfSendBatchRetry, base.SendBatchBackoffFactor, d.sendBatchMaxBackoff, func() error {
+				return d.fetchFilterCheckDocs(batchDocs)
+			})
+		if opErr != nil {
+			d.logger.Warnf("Unable to fetch source docs to check against the filter expression because of err=%v. Their keys will be reported as missing from target", opErr)
+		}
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	var numFiltered int
+	for _, doc := range docs {
+		if doc.result == nil {
+			// Deleted since, or unable to tell. Leave it as missing
+			continue
+		}
+		mut := dcp.CreateMutation(utils.GetVbucketFromKey([]byte(doc.key)), []byte(doc.key), 0, 0, uint64(doc.result.Cas),
+			doc.result.Flags, 0, gomemcached.UPR_MUTATION, doc.result.Value, doc.result.Datatype, doc.srcColId)
+		mut.PrependXattrs(doc.xattrs)
+		matched, err, errStr, _ := d.filter.FilterUprEvent(mut.ToUprEvent())
+		if err != nil {
+			d.logger.Warnf("Err %v - (%v) when filtering key %v. It will be reported as missing from target", err, errStr, base.TagUD(doc.key))
+			continue
+		}
+		if matched {
+			continue
+		}
+		if _, exists := d.filteredFromTarget[doc.tgtColId]; !exists {
+			d.filteredFromTarget[doc.tgtColId] = make(map[string]*GocbResult)
+		}
+		d.filteredFromTarget[doc.tgtColId][doc.key] = d.missingFromTarget[doc.tgtColId][doc.key]
+		delete(d.missingFromTarget[doc.tgtColId], doc.key)
+		numFiltered++
+	}
+	if numFiltered > 0 {
+		d.logger.Infof("%v keys missing from target are excluded by the filter expression and reported as intentionally not replicated", numFiltered)
+	}
+}
+
+// Fetches the source docs of the batch not fetched yet, along with their xattrs if the filter expression refers to
+// them. Returns an error, for the batch to be retried, if the fetches time out or any of them fails for another
+// reason than the doc being gone from the source
+func (d *MutationDiffer) fetchFilterCheckDocs(docs []*filterCheckDoc) error {
+	var pending []*filterCheckDoc
+	for _, doc := range docs {
+		if !doc.fetched {
+			pending = append(pending, doc)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	fetches := make([]*filterCheckFetch, len(pending))
+	var waitGroup sync.WaitGroup
+	for i, doc := range pending {
+		fetch := &filterCheckFetch{}
+		fetches[i] = fetch
+		waitGroup.Add(1)
+		err := d.sourceBucket.Get(doc.key, func(result *gocbcore.GetResult, err error) {
+			fetch.result = result
+			fetch.getErr = err
+			waitGroup.Done()
+		}, doc.srcColId)
+		if err != nil {
+			fetch.getErr = err
+			waitGroup.Done()
+		}
+		if !d.filterUsesXattrs {
+			continue
+		}
+		waitGroup.Add(1)
+		err = d.sourceBucket.LookupXattrs(doc.key, func(xattrs map[string]json.RawMessage, err error) {
+			fetch.xattrs = xattrs
+			fetch.xattrsErr = err
+			waitGroup.Done()
+		}, doc.srcColId)
+		if err != nil {
+			fetch.xattrsErr = err
+			waitGroup.Done()
+		}
+	}
+
+	doneChan := make(chan bool, 1)
+	go utils.WaitForWaitGroup(&waitGroup, doneChan)
+	timer := time.NewTimer(time.Duration(d.timeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-doneChan:
+	case <-timer.C:
+		return fmt.Errorf("timed out fetching %v source docs", len(pending))
+	}
+
+	var numFailed int
+	var lastErr error
+	for i, doc := range pending {
+		fetch := fetches[i]
+		switch {
+		case isKeyNotFoundError(fetch.getErr) || isKeyNotFoundError(fetch.xattrsErr):
+			doc.fetched = true
+		case fetch.getErr != nil:
+			numFailed++
+			lastErr = fetch.getErr
+		case fetch.xattrsErr != nil:
+			numFailed++
+			lastErr = fetch.xattrsErr
+		default:
+			doc.fetched = true
+			doc.result = fetch.result
+			doc.xattrs = fetch.xattrs
+		}
+	}
+	if numFailed > 0 {
+		return fmt.Errorf("failed to fetch %v of %v source docs, last err=%v", numFailed, len(pending), lastErr)
+	}
+	return nil
+}
+
+func getMaxTTLFromBucketInfo(bucketInfo map[string]interface{}) uint32 {
+	maxTTL, ok := bucketInfo[base.MaxTTLKey].(float64)
+	if !ok || maxTTL <= 0 {
+		return 0
+	}
+	return uint32(maxTTL)
+}
+
+// When the target bucket has a maxTTL, the target caps the expiry of replicated docs that either have no expiry
+// or one further out than the maxTTL allows. Given two live docs that are otherwise identical, returns true if
+// the difference in expiry is explained by this. The target expiry cannot be more than maxTTL away from now
+func isExpiryExplainedByMaxTTL(src, tgt *gocbcore.GetMetaResult, maxTTL uint32, now time.Time) bool {
+	if maxTTL == 0 || src == nil || tgt == nil || isDeleted(src) || isDeleted(tgt) {
+		return false
+	}
+	if src.Cas != tgt.Cas || src.SeqNo != tgt.SeqNo || src.Flags != tgt.Flags ||
+		src.Datatype&base.JSONDataType != tgt.Datatype&base.JSONDataType {
+		return false
+	}
+	if tgt.Expiry == 0 || tgt.Expiry == src.Expiry {
+		return false
+	}
+	if src.Expiry != 0 && tgt.Expiry > src.Expiry {
+		return false
+	}
+	return uint64(tgt.Expiry) <= uint64(now.Unix())+uint64(maxTTL)
+}
+
+// Metadata mismatches that only differ in expiry because of the target bucket maxTTL are not divergences
+// Move them out of srcDiff and tgtDiff, so that they are neither reported as mismatches nor retried
+func (d *MutationDiffer) separateMaxTTLFromMismatch() {
+	if d.tgtMaxTTL == 0 || d.compareType != base.MutationCompareTypeMetadata || len(d.migrationHintMap) > 0 {
+		return
+	}
+
+	now := time.Now()
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	var numCapped int
+	for srcColId, srcDiffPerCol := range d.srcDiff {
+		for key, pair := range srcDiffPerCol {
+			if len(pair) < 2 || pair[0] == nil || pair[1] == nil {
+				continue
+			}
+			if !isExpiryExplainedByMaxTTL(pair[0].GetMetaResult, pair[1].GetMetaResult, d.tgtMaxTTL, now) {
+				continue
+			}
+			if _, exists := d.expiryCappedByMaxTTL[srcColId]; !exists {
+				d.expiryCappedByMaxTTL[srcColId] = make(map[string][]*GocbResult)
+			}
+			d.expiryCappedByMaxTTL[srcColId][key] = pair
+			delete(srcDiffPerCol, key)
+			for _, tgtColId := range d.colIdsMap[srcColId] {
+				delete(d.tgtDiff[tgtColId], key)
+			}
+			numCapped++
+		}
+	}
+	if numCapped > 0 {
+		d.logger.Infof("%v mismatches only differ in expiry because of the target bucket maxTTL of %v seconds and are reported as expiry capped by maxTTL",
+			numCapped, d.tgtMaxTTL)
+	}
 }
 
 func (d *MutationDiffer) writeMigrationDetails() error {
 	fileName := base.MutationDiffMigrationDetails
-	srcMapFilename := d.mutationDifferFileDir + base.FileDirDelimiter + fileName
+	srcMapFilename := utils.JoinPath(d.mutationDifferFileDir, fileName)
 
 	bytes, err := json.Marshal(d.duplicateMap.ToIntMap())
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(srcMapFilename, bytes, 0644)
+	err = utils.WriteDataFile(d.encryptionKey, srcMapFilename, bytes, 0644)
 	if err != nil {
 		return err
 	}
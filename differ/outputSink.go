@@ -0,0 +1,335 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+)
+
+// One confirmed difference, as streamed to output sinks
+// Finding is which side wins under the buckets' conflict resolution type, so that a target legitimately holding
+// a newer LWW revision is not mistaken for a replication gap. It is only set for docs that exist on both sides
+// FieldDiff is only set for mismatches whose bodies are both JSON and hold different values, and BinaryDiff for
+// mismatches where either body is binary
+type DiffRecord struct {
+	Category   string
+	ColId      uint32
+	Key        string
+	Severity   Severity
+	Finding    ConflictFinding `json:",omitempty"`
+	FieldDiff  *JsonFieldDiff  `json:",omitempty"`
+	BinaryDiff *BinaryDiff     `json:",omitempty"`
+	Results    []*GocbResult
+}
+
+type DiffSummary struct {
+	// Number of differences per category, i.e. Mismatch or MissingFromTarget
+	Categories map[string]int
+	Severities map[Severity]int
+}
+
+// OutputSink receives the results of the mutation differ, in addition to the files under mutationDifferDir
+// Records are written first, followed by the summary, then the sink is closed
+type OutputSink interface {
+	WriteRecord(record *DiffRecord) error
+	WriteSummary(summary *DiffSummary) error
+	Close() error
+}
+
+// Must be called before Run()
+func (d *MutationDiffer) RegisterOutputSink(sink OutputSink) {
+	d.outputSinks = append(d.outputSinks, sink)
+}
+
+func (d *MutationDiffer) writeToOutputSinks() error {
+	if len(d.outputSinks) == 0 {
+		return nil
+	}
+
+	summary := &DiffSummary{
+		Categories: make(map[string]int),
+		Severities: make(map[Severity]int),
+	}
+	crType := d.commonConflictResolutionType()
+	var records []*DiffRecord
+	d.forEachDiff(func(category string, colId uint32, key string, severity Severity, results []*GocbResult) {
+		records = append(records, &DiffRecord{
+			Category:   category,
+			ColId:      colId,
+			Key:        base.TagKey(key),
+			Severity:   severity,
+			Finding:    recordConflictFinding(crType, category, results),
+			FieldDiff:  recordFieldDiff(category, results),
+			BinaryDiff: d.recordBinaryDiff(category, results),
+			Results:    results,
+		})
+		summary.Categories[category]++
+		summary.Severities[severity]++
+	})
+
+	var firstErr error
+	for _, sink := range d.outputSinks {
+		err := writeToOutputSink(sink, records, summary)
+		if err != nil {
+			d.logger.Errorf("Error writing to output sink %v. err=%v\n", sink, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func writeToOutputSink(sink OutputSink, records []*DiffRecord, summary *DiffSummary) error {
+	defer sink.Close()
+	for _, record := range records {
+		if err := sink.WriteRecord(record); err != nil {
+			return err
+		}
+	}
+	return sink.WriteSummary(summary)
+}
+
+// Writes one JSON record per line to a file, and the summary to a separate file with the summary suffix
+type FileOutputSink struct {
+	fileName string
+	file     *os.File
+	writer   *bufio.Writer
+}
+
+func NewFileOutputSink(fileName string) (*FileOutputSink, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOutputSink{
+		fileName: fileName,
+		file:     file,
+		writer:   bufio.NewWriter(file),
+	}, nil
+}
+
+func (s *FileOutputSink) WriteRecord(record *DiffRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Write(append(recordBytes, '\n'))
+	return err
+}
+
+func (s *FileOutputSink) WriteSummary(summary *DiffSummary) error {
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.fileName+base.FileNameDelimiter+base.OutputSinkSummarySuffix, summaryBytes, base.FileModeReadWrite)
+}
+
+func (s *FileOutputSink) Close() error {
+	err := s.writer.Flush()
+	closeErr := s.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (s *FileOutputSink) String() string {
+	return fmt.Sprintf("file %v", s.fileName)
+}
+
+// Writes each record as a JSON document into a bucket, keyed by run ID, category, collection ID and key,
+// and the summary as a document of its own keyed by run ID, so that the results of several runs can be kept
+// side by side and queried
+type BucketOutputSink struct {
+	agent          *GocbcoreAgent
+	bucketName     string
+	scopeName      string
+	collectionName string
+	runId          string
+	runTime        time.Time
+	timeout        time.Duration
+}
+
+// The documents written by BucketOutputSink
+type bucketDiffRecord struct {
+	RunId   string
+	RunTime time.Time
+	*DiffRecord
+}
+
+type bucketDiffSummary struct {
+	RunId   string
+	RunTime time.Time
+	*DiffSummary
+}
+
+// Only password authentication is supported, so the reference must not require TLS
+// The documents go into the default collection if scopeName and collectionName are empty
+func NewBucketOutputSink(reference *metadata.RemoteClusterReference, bucketName, scopeName, collectionName, runId string, capability metadata.Capability, timeout time.Duration) (*BucketOutputSink, error) {
+	if reference.HttpAuthMech() == xdcrBase.HttpAuthMechHttps {
+		return nil, fmt.Errorf("bucket output sink does not support TLS")
+	}
+	connStr, err := reference.MyConnectionStr()
+	if err != nil {
+		return nil, err
+	}
+	base.TagHttpPrefix(&connStr)
+	auth := &base.PasswordAuth{
+		Username: reference.UserName(),
+		Password: reference.Password(),
+	}
+	agent, err := NewGocbcoreAgent("xdcrDifferOutputSink", []string{connStr}, bucketName, auth, 1, capability)
+	if err != nil {
+		return nil, err
+	}
+	return &BucketOutputSink{
+		agent:          agent,
+		bucketName:     bucketName,
+		scopeName:      scopeName,
+		collectionName: collectionName,
+		runId:          runId,
+		runTime:        time.Now(),
+		timeout:        timeout,
+	}, nil
+}
+
+func (s *BucketOutputSink) set(key string, value interface{}) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	err = s.agent.SetInCollection(key, valueBytes, s.scopeName, s.collectionName, func(result *gocbcore.StoreResult, err error) {
+		errCh <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case err = <-errCh:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("timed out writing %v to bucket %v", key, s.bucketName)
+	}
+}
+
+func (s *BucketOutputSink) WriteRecord(record *DiffRecord) error {
+	return s.set(fmt.Sprintf("%v::%v::%v::%v", s.runId, record.Category, record.ColId, record.Key),
+		&bucketDiffRecord{RunId: s.runId, RunTime: s.runTime, DiffRecord: record})
+}
+
+func (s *BucketOutputSink) WriteSummary(summary *DiffSummary) error {
+	return s.set(fmt.Sprintf("%v::%v", s.runId, base.OutputSinkSummarySuffix),
+		&bucketDiffSummary{RunId: s.runId, RunTime: s.runTime, DiffSummary: summary})
+}
+
+func (s *BucketOutputSink) Close() error {
+	return s.agent.Close()
+}
+
+func (s *BucketOutputSink) String() string {
+	if s.collectionName != "" {
+		return fmt.Sprintf("bucket %v collection %v.%v", s.bucketName, s.scopeName, s.collectionName)
+	}
+	return fmt.Sprintf("bucket %v", s.bucketName)
+}
+
+// POSTs records to a URL as JSON arrays in batches, and then the summary as a JSON object
+type WebhookOutputSink struct {
+	url       string
+	client    *http.Client
+	batchSize int
+	batch     []*DiffRecord
+	mtx       sync.Mutex
+}
+
+func NewWebhookOutputSink(url string, batchSize int, timeout time.Duration) *WebhookOutputSink {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &WebhookOutputSink{
+		url:       url,
+		client:    &http.Client{Timeout: timeout},
+		batchSize: batchSize,
+	}
+}
+
+func (s *WebhookOutputSink) post(payload interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook %v returned status %v", s.url, resp.Status)
+	}
+	return nil
+}
+
+// Mutex should be held
+func (s *WebhookOutputSink) flushNoLock() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	err := s.post(map[string]interface{}{"Records": s.batch})
+	s.batch = nil
+	return err
+}
+
+func (s *WebhookOutputSink) WriteRecord(record *DiffRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.batch = append(s.batch, record)
+	if len(s.batch) >= s.batchSize {
+		return s.flushNoLock()
+	}
+	return nil
+}
+
+func (s *WebhookOutputSink) WriteSummary(summary *DiffSummary) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err := s.flushNoLock(); err != nil {
+		return err
+	}
+	return s.post(map[string]interface{}{"Summary": summary})
+}
+
+func (s *WebhookOutputSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.flushNoLock()
+}
+
+func (s *WebhookOutputSink) String() string {
+	return fmt.Sprintf("webhook %v", s.url)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"xdcrDiffer/base"
+)
+
+// Replaces the body and the xattr values of the result with their tagged user data. The metadata and the xattr
+// names are kept as they are
+func (r *GocbResult) marshalRedacted(resultBytes []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(resultBytes) > 0 {
+		err := json.Unmarshal(resultBytes, &fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.GetResult != nil {
+		valueBytes, err := json.Marshal(base.TagUD(r.GetResult.Value))
+		if err != nil {
+			return nil, err
+		}
+		fields["Value"] = valueBytes
+	}
+	if r.Xattrs != nil {
+		xattrs := make(map[string]string, len(r.Xattrs))
+		for name, value := range r.Xattrs {
+			xattrs[name] = base.TagUD([]byte(value))
+		}
+		xattrsBytes, err := json.Marshal(xattrs)
+		if err != nil {
+			return nil, err
+		}
+		fields["Xattrs"] = xattrsBytes
+	}
+	return json.Marshal(fields)
+}
+
+// Given a map of collection IDs to maps keyed by doc key, i.e. map[uint32]map[string]*GocbResult, returns a copy
+// with the doc keys encoded by base.EncodeKey and tagged as user data, for the reports
+func redactKeys(resultMap interface{}) interface{} {
+	mapValue := reflect.ValueOf(resultMap)
+	if mapValue.IsNil() {
+		return resultMap
+	}
+	redacted := reflect.MakeMapWithSize(mapValue.Type(), mapValue.Len())
+	iter := mapValue.MapRange()
+	for iter.Next() {
+		perCol := iter.Value()
+		if perCol.IsNil() {
+			redacted.SetMapIndex(iter.Key(), perCol)
+			continue
+		}
+		redactedPerCol := reflect.MakeMapWithSize(perCol.Type(), perCol.Len())
+		perColIter := perCol.MapRange()
+		for perColIter.Next() {
+			redactedPerCol.SetMapIndex(reflect.ValueOf(base.TagKey(perColIter.Key().String())), perColIter.Value())
+		}
+		redacted.SetMapIndex(iter.Key(), redactedPerCol)
+	}
+	return redacted.Interface()
+}
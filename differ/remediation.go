@@ -0,0 +1,151 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+const remediationScriptHeader = `#!/bin/sh
+# Generated by xdcrDiffer. Copies each doc that is missing from, deleted from or different on the target from
+# the source to the target with cbc. The copies get new metadata on the target. Review before running.
+# SOURCE_URL and TARGET_URL are connection strings including the bucket, i.e. couchbase://host/bucket
+# CBC_SOURCE_OPTS and CBC_TARGET_OPTS hold any other cbc options, i.e. "-u user -P password"
+: "${SOURCE_URL:?SOURCE_URL must be set}"
+: "${TARGET_URL:?TARGET_URL must be set}"
+
+# key, source collection options, target collection options
+copy_doc() {
+	cbc cat "$1" -U "$SOURCE_URL" $CBC_SOURCE_OPTS $2 2>/dev/null | cbc create "$1" -U "$TARGET_URL" $CBC_TARGET_OPTS $3 -M upsert ||
+		echo "Failed to copy $1" >&2
+}
+
+`
+
+// A doc to copy from a source collection to a target collection
+type remediationEntry struct {
+	key      string
+	srcColId uint32
+	tgtColId uint32
+}
+
+// WriteRemediation writes, under dir, the artifacts to remediate the differences found by Run() with, without hand
+// crafting scripts: for each source collection, a keysToReplicate file listing the keys that are missing from,
+// deleted from or different on the target one per line, and a shell script that copies these docs with cbc
+// srcNamespaces and tgtNamespaces hold the scope.collection names of the collection IDs. Without them, i.e. in
+// legacy mode, the default collections are addressed
+// Not supported for migration mode replications, whose keys cannot be traced back to a source collection
+func (d *MutationDiffer) WriteRemediation(dir string, srcNamespaces, tgtNamespaces map[uint32]string) (int, error) {
+	entries := d.getRemediationEntries()
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	keysPerCol := make(map[uint32][]string)
+	for i, entry := range entries {
+		if i > 0 && entries[i-1].srcColId == entry.srcColId && entries[i-1].key == entry.key {
+			// Different on several target collections
+			continue
+		}
+		keysPerCol[entry.srcColId] = append(keysPerCol[entry.srcColId], entry.key)
+	}
+	for srcColId, keys := range keysPerCol {
+		fileName := utils.JoinPath(dir, base.RemediationKeysFileName)
+		if namespace, exists := srcNamespaces[srcColId]; exists {
+			fileName = fmt.Sprintf("%v%v%v", fileName, base.FileNameDelimiter, namespace)
+		}
+		err = os.WriteFile(fileName, []byte(strings.Join(keys, "\n")+"\n"), base.FileModeReadWrite)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	scriptFile, err := os.OpenFile(utils.JoinPath(dir, base.RemediationScriptFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return 0, err
+	}
+	defer scriptFile.Close()
+	writer := bufio.NewWriter(scriptFile)
+	writer.WriteString(remediationScriptHeader)
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "copy_doc %v %v %v\n", shellQuote(entry.key),
+			shellQuote(cbcCollectionOptions(srcNamespaces, entry.srcColId)), shellQuote(cbcCollectionOptions(tgtNamespaces, entry.tgtColId)))
+	}
+	return len(entries), writer.Flush()
+}
+
+// Ordered by source collection, key and then target collection
+func (d *MutationDiffer) getRemediationEntries() []*remediationEntry {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+
+	pairs := make(map[remediationEntry]bool)
+	addEntries := func(tgtColId uint32, key string) {
+		for _, srcColId := range d.reverseTgtColIdsMap[tgtColId] {
+			pairs[remediationEntry{key: key, srcColId: srcColId, tgtColId: tgtColId}] = true
+		}
+	}
+	for tgtColId, missingPerCol := range d.missingFromTarget {
+		for key := range missingPerCol {
+			addEntries(tgtColId, key)
+		}
+	}
+	for tgtColId, diffPerCol := range d.tgtDiff {
+		for key := range diffPerCol {
+			addEntries(tgtColId, key)
+		}
+	}
+	for tgtColId, deletedPerCol := range d.deletedFromTarget {
+		for key := range deletedPerCol {
+			addEntries(tgtColId, key)
+		}
+	}
+
+	entries := make([]*remediationEntry, 0, len(pairs))
+	for pair := range pairs {
+		entry := pair
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].srcColId != entries[j].srcColId {
+			return entries[i].srcColId < entries[j].srcColId
+		}
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].tgtColId < entries[j].tgtColId
+	})
+	return entries
+}
+
+// Empty for the default collection
+func cbcCollectionOptions(namespaces map[uint32]string, colId uint32) string {
+	namespace, exists := namespaces[colId]
+	if !exists {
+		return ""
+	}
+	parts := strings.SplitN(namespace, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return fmt.Sprintf("--scope=%v --collection=%v", parts[0], parts[1])
+}
+
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	"github.com/couchbase/gomemcached"
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+	"xdcrDiffer/utils"
+)
+
+// One line of the repair log
+type RepairLogEntry struct {
+	Key      string
+	SrcColId uint32
+	// Not set when touching the source, since one touch repairs the doc on every target collection
+	TgtColId uint32 `json:",omitempty"`
+	Mode     string
+	DryRun   bool `json:",omitempty"`
+	// With DryRun, whether the doc would have been repaired
+	Repaired bool
+	Error    string `json:",omitempty"`
+}
+
+type RepairSummary struct {
+	Mode        string
+	DryRun      bool
+	NumKeys     int
+	NumRepaired int
+	NumFailed   int
+}
+
+func (s *RepairSummary) String() string {
+	if s.DryRun {
+		return fmt.Sprintf("Repair dry run with %v: %v of %v keys would be repaired, %v would fail", s.Mode, s.NumRepaired, s.NumKeys, s.NumFailed)
+	}
+	return fmt.Sprintf("Repair with %v: %v of %v keys repaired, %v failed", s.Mode, s.NumRepaired, s.NumKeys, s.NumFailed)
+}
+
+// Repair re-replicates the docs that Run() confirmed to be missing from the target, either by writing the source doc
+// to the target with its metadata (base.RepairModeSetWithMeta), or by touching it on the source so that XDCR
+// replicates it again (base.RepairModeTouchSource). Docs that are no longer on the source are not repaired
+// With dryRun, the docs are only looked up on the source, to preview what would be repaired
+// Each key is recorded in the repair log under mutationDifferFileDir. Must be called after Run()
+// Not supported for migration mode replications, whose missing keys cannot be traced back to a source collection
+func (d *MutationDiffer) Repair(mode string, dryRun bool) (*RepairSummary, error) {
+	entries := d.getRepairLogEntries(mode, dryRun)
+	summary := &RepairSummary{Mode: mode, DryRun: dryRun, NumKeys: len(entries)}
+	d.logger.Infof("Repairing %v keys missing from target with %v, dryRun=%v\n", len(entries), mode, dryRun)
+
+	entriesChan := make(chan *RepairLogEntry, len(entries))
+	for _, entry := range entries {
+		entriesChan <- entry
+	}
+	close(entriesChan)
+	waitGroup := &sync.WaitGroup{}
+	for i := 0; i < d.numberOfWorkers && i < len(entries); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for entry := range entriesChan {
+				err := d.repairKey(entry)
+				if err != nil {
+					entry.Error = err.Error()
+				} else {
+					entry.Repaired = true
+				}
+			}
+		}()
+	}
+	waitGroup.Wait()
+
+	for _, entry := range entries {
+		if entry.Repaired {
+			summary.NumRepaired++
+		} else {
+			summary.NumFailed++
+		}
+	}
+	return summary, d.writeRepairLog(entries)
+}
+
+// Touching the source repairs the key on every target collection at once
+func (d *MutationDiffer) getRepairLogEntries(mode string, dryRun bool) []*RepairLogEntry {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+
+	var entries []*RepairLogEntry
+	touched := make(map[uint32]map[string]bool)
+	for tgtColId, missingPerCol := range d.missingFromTarget {
+		for key := range missingPerCol {
+			for _, srcColId := range d.reverseTgtColIdsMap[tgtColId] {
+				entry := &RepairLogEntry{
+					Key:      key,
+					SrcColId: srcColId,
+					TgtColId: tgtColId,
+					Mode:     mode,
+					DryRun:   dryRun,
+				}
+				if mode == base.RepairModeTouchSource {
+					if touched[srcColId][key] {
+						continue
+					}
+					if _, exists := touched[srcColId]; !exists {
+						touched[srcColId] = make(map[string]bool)
+					}
+					touched[srcColId][key] = true
+					entry.TgtColId = 0
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].SrcColId != entries[j].SrcColId {
+			return entries[i].SrcColId < entries[j].SrcColId
+		}
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].TgtColId < entries[j].TgtColId
+	})
+	return entries
+}
+
+func (d *MutationDiffer) repairKey(entry *RepairLogEntry) error {
+	var meta *gocbcore.GetMetaResult
+	err := d.waitForOp(func(done func(error)) error {
+		return d.sourceBucket.GetMeta(entry.Key, func(result *gocbcore.GetMetaResult, err error) {
+			meta = result
+			done(err)
+		}, entry.SrcColId)
+	})
+	if isKeyNotFoundError(err) || err == nil && isDeleted(meta) {
+		return fmt.Errorf("no longer on source")
+	} else if err != nil {
+		return fmt.Errorf("getMeta from source: %v", err)
+	}
+
+	switch entry.Mode {
+	case base.RepairModeTouchSource:
+		if entry.DryRun {
+			return nil
+		}
+		// Keeps the expiry the doc already has
+		err = d.waitForOp(func(done func(error)) error {
+			return d.sourceBucket.Touch(entry.Key, meta.Expiry, func(result *gocbcore.TouchResult, err error) {
+				done(err)
+			}, entry.SrcColId)
+		})
+		if err != nil {
+			return fmt.Errorf("touch on source: %v", err)
+		}
+	case base.RepairModeSetWithMeta:
+		// A get returns the body alone. The xattrs, such as the Sync Gateway metadata, are looked up before it,
+		// so that a change in between shows as a CAS other than the one of the meta
+		var xattrs map[string]json.RawMessage
+		err = d.waitForOp(func(done func(error)) error {
+			return d.sourceBucket.LookupXattrs(entry.Key, func(result map[string]json.RawMessage, err error) {
+				xattrs = result
+				done(err)
+			}, entry.SrcColId)
+		})
+		if err != nil {
+			return fmt.Errorf("lookup xattrs from source: %v", err)
+		}
+		var doc *gocbcore.GetResult
+		err = d.waitForOp(func(done func(error)) error {
+			return d.sourceBucket.Get(entry.Key, func(result *gocbcore.GetResult, err error) {
+				doc = result
+				done(err)
+			}, entry.SrcColId)
+		})
+		if err != nil {
+			return fmt.Errorf("get from source: %v", err)
+		}
+		if doc.Cas != meta.Cas {
+			// Changed in between, so XDCR will replicate it anyway
+			return fmt.Errorf("changed on source while repairing")
+		}
+		mut := dcp.CreateMutation(utils.GetVbucketFromKey([]byte(entry.Key)), []byte(entry.Key), 0, 0, uint64(doc.Cas),
+			doc.Flags, meta.Expiry, gomemcached.UPR_MUTATION, doc.Value, doc.Datatype, entry.SrcColId)
+		err = mut.Decompress()
+		if err != nil {
+			return fmt.Errorf("decompress source doc: %v", err)
+		}
+		mut.PrependXattrs(xattrs)
+		if entry.DryRun {
+			return nil
+		}
+		err = d.waitForOp(func(done func(error)) error {
+			return d.targetBucket.SetWithMeta(entry.Key, mut.Value, mut.Datatype, doc.Flags, meta.Expiry, meta.Cas,
+				uint64(meta.SeqNo), func(result *gocbcore.SetMetaResult, err error) {
+					done(err)
+				}, entry.TgtColId)
+		})
+		if err != nil {
+			return fmt.Errorf("setWithMeta on target: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown repair mode %v", entry.Mode)
+	}
+	return nil
+}
+
+// Issues an async op and waits for its callback, up to the mutation differ timeout
+func (d *MutationDiffer) waitForOp(op func(done func(error)) error) error {
+	errChan := make(chan error, 1)
+	err := op(func(err error) {
+		errChan <- err
+	})
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(time.Duration(d.timeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case err = <-errChan:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("timed out after %v seconds", d.timeout)
+	}
+}
+
+// One JSON entry per line
+func (d *MutationDiffer) writeRepairLog(entries []*RepairLogEntry) error {
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffRepairLogFileName)
+	repairLogFile, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer repairLogFile.Close()
+
+	writer := bufio.NewWriter(repairLogFile)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		err = encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+type Severity string
+
+const (
+	// A live document differs in body, or is missing on one side
+	SeverityHigh Severity = "High"
+	// Metadata differs beyond CAS alone, xattrs differ, or a deletion did not make it to the other side
+	SeverityMedium Severity = "Medium"
+	// Only the CAS differs, and by no more than the tolerance, or the doc is deleted on both sides with different tombstones
+	SeverityLow Severity = "Low"
+	// Not a divergence of live data, i.e. a tombstone vs a purged doc, a doc excluded by the filter,
+	// or an expiry capped by the target bucket maxTTL
+	SeverityInfo Severity = "Info"
+)
+
+var SeverityOrder = []Severity{SeverityHigh, SeverityMedium, SeverityLow, SeverityInfo}
+
+type SeverityEntry struct {
+	Category string
+	ColId    uint32
+	Key      string
+}
+
+type SeverityReport struct {
+	Summary map[Severity]int
+	Details map[Severity][]*SeverityEntry
+}
+
+func NewSeverityReport() *SeverityReport {
+	report := &SeverityReport{
+		Summary: make(map[Severity]int),
+		Details: make(map[Severity][]*SeverityEntry),
+	}
+	for _, severity := range SeverityOrder {
+		report.Summary[severity] = 0
+		report.Details[severity] = []*SeverityEntry{}
+	}
+	return report
+}
+
+func (r *SeverityReport) add(severity Severity, category string, colId uint32, key string) {
+	r.Summary[severity]++
+	r.Details[severity] = append(r.Details[severity], &SeverityEntry{
+		Category: category,
+		ColId:    colId,
+		Key:      base.TagKey(key),
+	})
+}
+
+func (r *SeverityReport) merge(other *SeverityReport) {
+	for severity, count := range other.Summary {
+		r.Summary[severity] += count
+	}
+	for severity, entries := range other.Details {
+		r.Details[severity] = append(r.Details[severity], entries...)
+	}
+}
+
+// Keep the output stable across runs
+func (r *SeverityReport) sort() {
+	for _, entries := range r.Details {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Category != entries[j].Category {
+				return entries[i].Category < entries[j].Category
+			}
+			if entries[i].ColId != entries[j].ColId {
+				return entries[i].ColId < entries[j].ColId
+			}
+			return entries[i].Key < entries[j].Key
+		})
+	}
+}
+
+func isTombstoneResult(result *GocbResult) bool {
+	return result != nil && result.GetMetaResult != nil && isDeleted(result.GetMetaResult)
+}
+
+func isCasWithinTolerance(cas1, cas2 gocbcore.Cas, casTolerance time.Duration) bool {
+	var delta uint64
+	if cas1 > cas2 {
+		delta = uint64(cas1 - cas2)
+	} else {
+		delta = uint64(cas2 - cas1)
+	}
+	return delta <= uint64(casTolerance.Nanoseconds())
+}
+
+// Given the source and the target results of a mismatched doc
+func mismatchSeverity(srcResult, tgtResult *GocbResult, casTolerance time.Duration) Severity {
+	return mismatchSeverityJsonAware(srcResult, tgtResult, casTolerance, false)
+}
+
+func mismatchSeverityJsonAware(srcResult, tgtResult *GocbResult, casTolerance time.Duration, jsonAware bool) Severity {
+	if srcResult == nil || tgtResult == nil {
+		return SeverityHigh
+	}
+
+	if srcResult.GetResult != nil && tgtResult.GetResult != nil {
+		src := srcResult.GetResult
+		tgt := tgtResult.GetResult
+		if !areBodiesTheSame(src, tgt, jsonAware) {
+			return SeverityHigh
+		}
+		if src.Flags == tgt.Flags && src.Datatype == tgt.Datatype && isCasWithinTolerance(src.Cas, tgt.Cas, casTolerance) {
+			return SeverityLow
+		}
+		return SeverityMedium
+	}
+
+	if srcResult.GetMetaResult != nil && tgtResult.GetMetaResult != nil {
+		src := srcResult.GetMetaResult
+		tgt := tgtResult.GetMetaResult
+		if src.SeqNo == tgt.SeqNo && src.Flags == tgt.Flags && src.Expiry == tgt.Expiry && src.Deleted == tgt.Deleted &&
+			src.Datatype&base.JSONDataType == tgt.Datatype&base.JSONDataType && isCasWithinTolerance(src.Cas, tgt.Cas, casTolerance) {
+			return SeverityLow
+		}
+		return SeverityMedium
+	}
+	return SeverityHigh
+}
+
+// The result given is from the side where the doc does exist
+func missingSeverity(existingResult *GocbResult) Severity {
+	if isTombstoneResult(existingResult) {
+		// Tombstone on one side and already purged on the other
+		return SeverityInfo
+	}
+	return SeverityHigh
+}
+
+// Calls f once for each confirmed difference, along with its severity and the results that were compared
+// For categories where the doc exists on one side only, results contains the result of that side
+func (d *MutationDiffer) forEachDiff(f func(category string, colId uint32, key string, severity Severity, results []*GocbResult)) {
+	d.stateLock.RLock()
+	defer d.stateLock.RUnlock()
+
+	for colId, resultsPerCol := range d.srcDiff {
+		for key, pair := range resultsPerCol {
+			var srcResult, tgtResult *GocbResult
+			if len(pair) >= 2 {
+				srcResult, tgtResult = pair[0], pair[1]
+			}
+			f("Mismatch", colId, key, mismatchSeverityJsonAware(srcResult, tgtResult, d.casTolerance, d.jsonAwareBodyCompare), pair)
+		}
+	}
+	for colId, resultsPerCol := range d.missingFromSource {
+		for key, result := range resultsPerCol {
+			f("MissingFromSource", colId, key, missingSeverity(result), []*GocbResult{result})
+		}
+	}
+	for colId, resultsPerCol := range d.missingFromTarget {
+		for key, result := range resultsPerCol {
+			f("MissingFromTarget", colId, key, missingSeverity(result), []*GocbResult{result})
+		}
+	}
+	for colId, resultsPerCol := range d.deletedFromSource {
+		for key, results := range resultsPerCol {
+			f("DeletedFromSource", colId, key, SeverityMedium, results)
+		}
+	}
+	for colId, resultsPerCol := range d.deletedFromTarget {
+		for key, results := range resultsPerCol {
+			f("DeletedFromTarget", colId, key, SeverityMedium, results)
+		}
+	}
+	for colId, resultsPerCol := range d.expiryCappedByMaxTTL {
+		for key, results := range resultsPerCol {
+			f("ExpiryCappedByMaxTTL", colId, key, SeverityInfo, results)
+		}
+	}
+	for colId, resultsPerCol := range d.xattrMismatch {
+		for key, results := range resultsPerCol {
+			f("XattrMismatch", colId, key, SeverityMedium, results)
+		}
+	}
+	for colId, resultsPerCol := range d.tombstoneMismatch {
+		for key, results := range resultsPerCol {
+			f("TombstoneMismatch", colId, key, SeverityLow, results)
+		}
+	}
+	for colId, resultsPerCol := range d.filteredFromTarget {
+		for key, result := range resultsPerCol {
+			f("IntentionallyNotReplicated", colId, key, SeverityInfo, []*GocbResult{result})
+		}
+	}
+}
+
+func (d *MutationDiffer) compileSeverityReport() *SeverityReport {
+	report := NewSeverityReport()
+	d.forEachDiff(func(category string, colId uint32, key string, severity Severity, results []*GocbResult) {
+		report.add(severity, category, colId, key)
+	})
+	report.sort()
+	return report
+}
+
+func (d *MutationDiffer) writeSeverityReport() error {
+	report := d.compileSeverityReport()
+	d.logger.Infof("Differences by severity: High=%v Medium=%v Low=%v Info=%v", report.Summary[SeverityHigh],
+		report.Summary[SeverityMedium], report.Summary[SeverityLow], report.Summary[SeverityInfo])
+
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	fileName := utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffSeverityFileName)
+	return utils.WriteDataFile(d.encryptionKey, fileName, reportBytes, base.FileModeReadWrite)
+}
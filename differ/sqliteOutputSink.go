@@ -0,0 +1,197 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The diffs table holds one row per confirmed difference. The CAS columns, and the CAS time columns that hold when
+// each side's revision was written as RFC3339 timestamps, are NULL on the side where the doc is missing, finding is NULL for the categories that have no conflict finding, and results holds the same JSON
+// as the records of the file sink
+// The summary table holds the counts per category and per severity, told apart by kind
+var sqliteSchema = []string{
+	`CREATE TABLE diffs (
+		category      TEXT NOT NULL,
+		colId         INTEGER NOT NULL,
+		key           TEXT NOT NULL,
+		vbno          INTEGER NOT NULL,
+		severity      TEXT NOT NULL,
+		sourceCas     INTEGER,
+		targetCas     INTEGER,
+		sourceCasTime TEXT,
+		targetCasTime TEXT,
+		finding       TEXT,
+		results       TEXT NOT NULL
+	)`,
+	`CREATE INDEX diffsKey ON diffs (key)`,
+	`CREATE INDEX diffsVbno ON diffs (vbno)`,
+	`CREATE INDEX diffsCategory ON diffs (category)`,
+	`CREATE INDEX diffsSourceCas ON diffs (sourceCas)`,
+	`CREATE INDEX diffsTargetCas ON diffs (targetCas)`,
+	`CREATE TABLE summary (
+		kind  TEXT NOT NULL,
+		name  TEXT NOT NULL,
+		count INTEGER NOT NULL
+	)`,
+}
+
+const sqliteInsertDiff = `INSERT INTO diffs (category, colId, key, vbno, severity, sourceCas, targetCas, sourceCasTime, targetCasTime, finding, results)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const sqliteInsertSummary = `INSERT INTO summary (kind, name, count) VALUES (?, ?, ?)`
+
+// Writes the records into the diffs table of a SQLite database file, and the summary into its summary table,
+// so that the results can be queried with SQL. The file is recreated on each run, like the file sink's
+// Everything is written in one transaction, committed on Close
+type SqliteOutputSink struct {
+	fileName   string
+	db         *sql.DB
+	tx         *sql.Tx
+	insertDiff *sql.Stmt
+}
+
+func NewSqliteOutputSink(fileName string) (*SqliteOutputSink, error) {
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return nil, err
+	}
+	sink := &SqliteOutputSink{
+		fileName: fileName,
+		db:       db,
+	}
+	err = sink.init()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *SqliteOutputSink) init() error {
+	for _, statement := range sqliteSchema {
+		if _, err := s.db.Exec(statement); err != nil {
+			return fmt.Errorf("create schema of %v: %v", s.fileName, err)
+		}
+	}
+	var err error
+	s.tx, err = s.db.Begin()
+	if err != nil {
+		return err
+	}
+	s.insertDiff, err = s.tx.Prepare(sqliteInsertDiff)
+	if err != nil {
+		s.tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func (s *SqliteOutputSink) WriteRecord(record *DiffRecord) error {
+	resultsBytes, err := json.Marshal(record.Results)
+	if err != nil {
+		return err
+	}
+	sourceCas, targetCas := recordCas(record)
+	var finding interface{}
+	if record.Finding != "" {
+		finding = string(record.Finding)
+	}
+	_, err = s.insertDiff.Exec(record.Category, record.ColId, record.Key, utils.GetVbucketFromKey([]byte(record.Key)),
+		string(record.Severity), sourceCas, targetCas, casTimestamp(sourceCas), casTimestamp(targetCas), finding, string(resultsBytes))
+	return err
+}
+
+func (s *SqliteOutputSink) WriteSummary(summary *DiffSummary) error {
+	for category, count := range summary.Categories {
+		if _, err := s.tx.Exec(sqliteInsertSummary, "category", category, count); err != nil {
+			return err
+		}
+	}
+	for severity, count := range summary.Severities {
+		if _, err := s.tx.Exec(sqliteInsertSummary, "severity", string(severity), count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commits what was written, even if writing did not get to the summary
+func (s *SqliteOutputSink) Close() error {
+	s.insertDiff.Close()
+	err := s.tx.Commit()
+	closeErr := s.db.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (s *SqliteOutputSink) String() string {
+	return fmt.Sprintf("sqlite %v", s.fileName)
+}
+
+// The CAS of the source and of the target doc of the record, nil for a side that has no doc
+// Records of categories with a single result only have the doc of the side the key was found on
+func recordCas(record *DiffRecord) (sourceCas, targetCas interface{}) {
+	switch {
+	case len(record.Results) >= 2:
+		return record.Results[0].cas(), record.Results[1].cas()
+	case len(record.Results) == 1 && record.Category == "MissingFromSource":
+		return nil, record.Results[0].cas()
+	case len(record.Results) == 1:
+		return record.Results[0].cas(), nil
+	}
+	return nil, nil
+}
+
+// SQLite integers are signed 64 bits, which a CAS, being nanoseconds since the epoch, fits in
+func (r *GocbResult) cas() interface{} {
+	switch {
+	case r == nil:
+		return nil
+	case r.GetResult != nil:
+		return int64(r.GetResult.Cas)
+	case r.GetMetaResult != nil:
+		return int64(r.GetMetaResult.Cas)
+	}
+	return nil
+}
+
+// RFC3339 timestamp of a CAS from recordCas, NULL along with it
+func casTimestamp(cas interface{}) interface{} {
+	if cas == nil {
+		return nil
+	}
+	return base.CasTimestamp(uint64(cas.(int64)))
+}
+
+// When the revision of the result was written, empty if there is none
+func (r *GocbResult) casTimestamp() string {
+	switch {
+	case r == nil:
+		return ""
+	case r.GetResult != nil:
+		return base.CasTimestamp(uint64(r.GetResult.Cas))
+	case r.GetMetaResult != nil:
+		return base.CasTimestamp(uint64(r.GetMetaResult.Cas))
+	}
+	return ""
+}
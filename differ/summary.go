@@ -0,0 +1,307 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Totals of a file differ run
+type FileDiffSummary struct {
+	SourceKeysScanned int
+	TargetKeysScanned int
+	Matched           int
+	MissingFromSource int
+	MissingFromTarget int
+	// Exists on both sides, and the body hashes differ
+	BodyMismatch int
+	// Exists on both sides with the same body hash, and the metadata differs
+	MetaMismatch int
+	// Mutations excluded from the data files by the replication filter
+	SourceFiltered int64
+	TargetFiltered int64
+	// What the replication filter did with the mutations of each side during data generation, in total and by
+	// collection ID, to tell whether filtering explains the difference between the item counts of the sides
+	SourceFilterCounts             *base.FilterCounts            `json:",omitempty"`
+	TargetFilterCounts             *base.FilterCounts            `json:",omitempty"`
+	SourceFilterCountsByCollection map[uint32]*base.FilterCounts `json:",omitempty"`
+	TargetFilterCountsByCollection map[uint32]*base.FilterCounts `json:",omitempty"`
+	// Bins that could not be diffed
+	Errors int
+	// vbuckets of each side that kept changing while they were streamed, and by how many seqnos they moved past their
+	// end seqno. Their diffs may only be changes made during the capture, which Warning then points out
+	SourceChangedVbuckets map[uint16]uint64 `json:",omitempty"`
+	TargetChangedVbuckets map[uint16]uint64 `json:",omitempty"`
+	Warning               string            `json:",omitempty"`
+}
+
+func (s *FileDiffSummary) add(other *FileDiffSummary) {
+	s.SourceKeysScanned += other.SourceKeysScanned
+	s.TargetKeysScanned += other.TargetKeysScanned
+	s.Matched += other.Matched
+	s.MissingFromSource += other.MissingFromSource
+	s.MissingFromTarget += other.MissingFromTarget
+	s.BodyMismatch += other.BodyMismatch
+	s.MetaMismatch += other.MetaMismatch
+	s.SourceFiltered += other.SourceFiltered
+	s.TargetFiltered += other.TargetFiltered
+	s.SourceFilterCounts = addFilterCounts(s.SourceFilterCounts, other.SourceFilterCounts)
+	s.TargetFilterCounts = addFilterCounts(s.TargetFilterCounts, other.TargetFilterCounts)
+	s.SourceFilterCountsByCollection = addFilterCountsByCollection(s.SourceFilterCountsByCollection, other.SourceFilterCountsByCollection)
+	s.TargetFilterCountsByCollection = addFilterCountsByCollection(s.TargetFilterCountsByCollection, other.TargetFilterCountsByCollection)
+	s.Errors += other.Errors
+	s.SourceChangedVbuckets = addChangedVbuckets(s.SourceChangedVbuckets, other.SourceChangedVbuckets)
+	s.TargetChangedVbuckets = addChangedVbuckets(s.TargetChangedVbuckets, other.TargetChangedVbuckets)
+	if other.Warning != "" {
+		s.Warning = other.Warning
+	}
+}
+
+// The summaries added together cover different vbuckets, e.g. when merging the outputs of several instances
+func addChangedVbuckets(changedVbs, other map[uint16]uint64) map[uint16]uint64 {
+	if len(other) == 0 {
+		return changedVbs
+	}
+	if changedVbs == nil {
+		changedVbs = make(map[uint16]uint64)
+	}
+	for vbno, moved := range other {
+		changedVbs[vbno] = moved
+	}
+	return changedVbs
+}
+
+func addFilterCounts(counts, other *base.FilterCounts) *base.FilterCounts {
+	if other == nil {
+		return counts
+	}
+	if counts == nil {
+		counts = &base.FilterCounts{}
+	}
+	counts.Add(other)
+	return counts
+}
+
+func addFilterCountsByCollection(byCollection, other map[uint32]*base.FilterCounts) map[uint32]*base.FilterCounts {
+	if len(other) == 0 {
+		return byCollection
+	}
+	if byCollection == nil {
+		byCollection = make(map[uint32]*base.FilterCounts)
+	}
+	for colId, colCounts := range other {
+		byCollection[colId] = addFilterCounts(byCollection[colId], colCounts)
+	}
+	return byCollection
+}
+
+// Keys that differ between the data files, before they are verified by the mutation differ
+func (s *FileDiffSummary) NumDiffs() int {
+	return s.MissingFromSource + s.MissingFromTarget + s.BodyMismatch + s.MetaMismatch
+}
+
+func (s *FileDiffSummary) String() string {
+	str := fmt.Sprintf("scanned source=%v target=%v, matched=%v, missingFromSource=%v, missingFromTarget=%v, bodyMismatch=%v, metaMismatch=%v, filtered source=%v target=%v, errors=%v",
+		s.SourceKeysScanned, s.TargetKeysScanned, s.Matched, s.MissingFromSource, s.MissingFromTarget, s.BodyMismatch,
+		s.MetaMismatch, s.SourceFiltered, s.TargetFiltered, s.Errors)
+	if s.SourceFilterCounts != nil {
+		str += fmt.Sprintf(", source filter {%v}", s.SourceFilterCounts)
+	}
+	if s.TargetFilterCounts != nil {
+		str += fmt.Sprintf(", target filter {%v}", s.TargetFilterCounts)
+	}
+	if s.Warning != "" {
+		str += fmt.Sprintf(", %v in source vbuckets %v and target vbuckets %v", s.Warning, s.SourceChangedVbuckets, s.TargetChangedVbuckets)
+	}
+	return str
+}
+
+// Totals of a mutation differ run, after all retries
+type MutationDiffSummary struct {
+	// Distinct keys fetched from both sides in the first round
+	KeysChecked       int
+	Matched           int
+	MissingFromSource int
+	MissingFromTarget int
+	// Live on both sides, and the bodies differ
+	BodyMismatch int
+	// Everything else that differs between docs on both sides, i.e. metadata only, or when bodies are not compared
+	MetaMismatch         int
+	DeletedFromSource    int
+	DeletedFromTarget    int
+	ExpiryCappedByMaxTTL int
+	// Otherwise the same on both sides, and the xattrs differ
+	XattrMismatch int
+	// Deleted on both sides, and the tombstones differ
+	TombstoneMismatch int
+	// Missing from target because the replication filter excludes the source doc
+	Filtered int
+	// Keys that could not be fetched
+	Errors int
+	// Keys that kept failing on either side after retrying, and thus were not diffed
+	Unverified int
+}
+
+func (s *MutationDiffSummary) add(other *MutationDiffSummary) {
+	s.KeysChecked += other.KeysChecked
+	s.Matched += other.Matched
+	s.MissingFromSource += other.MissingFromSource
+	s.MissingFromTarget += other.MissingFromTarget
+	s.BodyMismatch += other.BodyMismatch
+	s.MetaMismatch += other.MetaMismatch
+	s.DeletedFromSource += other.DeletedFromSource
+	s.DeletedFromTarget += other.DeletedFromTarget
+	s.ExpiryCappedByMaxTTL += other.ExpiryCappedByMaxTTL
+	s.XattrMismatch += other.XattrMismatch
+	s.TombstoneMismatch += other.TombstoneMismatch
+	s.Filtered += other.Filtered
+	s.Errors += other.Errors
+	s.Unverified += other.Unverified
+}
+
+// Keys that diverge between the clusters. Filtered keys and expiries capped by maxTTL are expected, and not counted
+func (s *MutationDiffSummary) NumDiffs() int {
+	return s.MissingFromSource + s.MissingFromTarget + s.BodyMismatch + s.MetaMismatch + s.DeletedFromSource +
+		s.DeletedFromTarget + s.XattrMismatch + s.TombstoneMismatch
+}
+
+func (s *MutationDiffSummary) String() string {
+	return fmt.Sprintf("checked=%v, matched=%v, missingFromSource=%v, missingFromTarget=%v, bodyMismatch=%v, metaMismatch=%v, deletedFromSource=%v, deletedFromTarget=%v, expiryCappedByMaxTTL=%v, xattrMismatch=%v, tombstoneMismatch=%v, filtered=%v, errors=%v, unverified=%v",
+		s.KeysChecked, s.Matched, s.MissingFromSource, s.MissingFromTarget, s.BodyMismatch, s.MetaMismatch,
+		s.DeletedFromSource, s.DeletedFromTarget, s.ExpiryCappedByMaxTTL, s.XattrMismatch, s.TombstoneMismatch, s.Filtered, s.Errors, s.Unverified)
+}
+
+func writeSummaryFile(fileName string, summary interface{}) error {
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, summaryBytes, base.FileModeReadWrite)
+}
+
+func (differ *FilesDiffer) summary() *FileDiffSummary {
+	summary := &FileDiffSummary{
+		SourceKeysScanned: differ.file1ItemCount,
+		TargetKeysScanned: differ.file2ItemCount,
+		Matched:           differ.matchedCount,
+		MissingFromSource: len(differ.MissingFromFile1),
+		MissingFromTarget: len(differ.MissingFromFile2),
+	}
+	for _, pair := range differ.BothExistButMismatch {
+		if shaCompare(pair[0].BodyHash, pair[1].BodyHash) {
+			summary.MetaMismatch++
+		} else {
+			summary.BodyMismatch++
+		}
+	}
+	return summary
+}
+
+// Sets the number of mutations the replication filter excluded during data generation, for the summary
+func (dr *DifferDriver) SetFilteredCounts(sourceFiltered, targetFiltered int64) {
+	dr.Summary.SourceFiltered = sourceFiltered
+	dr.Summary.TargetFiltered = targetFiltered
+}
+
+// Sets what the replication filter did with the mutations of one side during data generation, for the summary
+func (dr *DifferDriver) SetFilterCounts(isSource bool, counts *base.FilterCounts, byCollection map[uint32]*base.FilterCounts) {
+	if isSource {
+		dr.Summary.SourceFilterCounts = counts
+		dr.Summary.SourceFilterCountsByCollection = byCollection
+	} else {
+		dr.Summary.TargetFilterCounts = counts
+		dr.Summary.TargetFilterCountsByCollection = byCollection
+	}
+}
+
+// Sets the vbuckets of one side that were changing during data generation, for the summary to warn about
+func (dr *DifferDriver) SetChangedVbuckets(isSource bool, changedVbs map[uint16]uint64) {
+	if len(changedVbs) == 0 {
+		return
+	}
+	if isSource {
+		dr.Summary.SourceChangedVbuckets = changedVbs
+	} else {
+		dr.Summary.TargetChangedVbuckets = changedVbs
+	}
+	dr.Summary.Warning = base.DataChangingWarning
+}
+
+// Should be called once Run() has returned
+func (dr *DifferDriver) WriteSummary() error {
+	return writeSummaryFile(utils.JoinPath(dr.diffFileDir, base.FileDiffSummaryFileName), &dr.Summary)
+}
+
+func isBodyMismatch(results []*GocbResult, jsonAware bool) bool {
+	if len(results) < 2 || results[0] == nil || results[1] == nil {
+		return false
+	}
+	src := results[0].GetResult
+	tgt := results[1].GetResult
+	return src != nil && tgt != nil && !areBodiesTheSame(src, tgt, jsonAware)
+}
+
+func (d *MutationDiffer) compileSummary() *MutationDiffSummary {
+	summary := &MutationDiffSummary{
+		KeysChecked: int(atomic.LoadUint32(&d.numKeysChecked)),
+		Errors:      int(atomic.LoadUint32(&d.numKeysWithErrors)),
+		Unverified:  int(atomic.LoadUint32(&d.numKeysUnverified)),
+	}
+	var numDiffs int
+	d.forEachDiff(func(category string, colId uint32, key string, severity Severity, results []*GocbResult) {
+		numDiffs++
+		switch category {
+		case "Mismatch":
+			if isBodyMismatch(results, d.jsonAwareBodyCompare) {
+				summary.BodyMismatch++
+			} else {
+				summary.MetaMismatch++
+			}
+		case "MissingFromSource":
+			summary.MissingFromSource++
+		case "MissingFromTarget":
+			summary.MissingFromTarget++
+		case "DeletedFromSource":
+			summary.DeletedFromSource++
+		case "DeletedFromTarget":
+			summary.DeletedFromTarget++
+		case "ExpiryCappedByMaxTTL":
+			summary.ExpiryCappedByMaxTTL++
+		case "XattrMismatch":
+			summary.XattrMismatch++
+		case "TombstoneMismatch":
+			summary.TombstoneMismatch++
+		case "IntentionallyNotReplicated":
+			summary.Filtered++
+		}
+	})
+	summary.Matched = summary.KeysChecked - numDiffs - summary.Errors - summary.Unverified
+	if summary.Matched < 0 {
+		summary.Matched = 0
+	}
+	return summary
+}
+
+// Totals of the run, complete once Run() returns
+func (d *MutationDiffer) Summary() *MutationDiffSummary {
+	return d.compileSummary()
+}
+
+func (d *MutationDiffer) writeSummary() error {
+	summary := d.compileSummary()
+	d.logger.Infof("Mutation differ summary: %v", summary)
+	return writeSummaryFile(utils.JoinPath(d.mutationDifferFileDir, base.MutationDiffSummaryFileName), summary)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocbcore/v9"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Must be called before Run()
+// A Get does not find a deleted doc, so without tombstones a doc deleted on one side only is reported as missing,
+// the same as one that never existed there, and docs deleted on both sides are not compared at all
+func (d *MutationDiffer) SetCompareTombstones(compareTombstones bool) {
+	d.compareTombstones = compareTombstones
+}
+
+// Deletions are resolved like any other mutation, so the tombstones of a doc are expected to have the same
+// CAS and revId on both sides
+func areTombstonesTheSame(tombstone1, tombstone2 *gocbcore.GetMetaResult) bool {
+	return tombstone1.Cas == tombstone2.Cas && tombstone1.SeqNo == tombstone2.SeqNo
+}
+
+type tombstoneFetch struct {
+	isSource bool
+	colId    uint32
+	key      string
+	meta     *gocbcore.GetMetaResult
+	err      error
+	done     bool
+}
+
+// Looks up the metadata of both sides of the keys that were not found on either side, batchSize keys at a time
+// Only needed when comparing bodies, since the metadata results already include the tombstones
+// Keys not found by the lookup either never existed or were purged, and are left missing
+func (dw *DifferWorker) getTombstones() {
+	var fetches []*tombstoneFetch
+	tgtFetched := make(map[uint32]map[string]bool)
+	for srcColId, sourceResultMap := range dw.sourceResults {
+		for key, sourceResult := range sourceResultMap {
+			if sourceResult.Key() == "" {
+				continue
+			}
+			var tgtFetches []*tombstoneFetch
+			for _, tgtColId := range dw.getTargetColIds(srcColId, key) {
+				targetResult := dw.targetResults[tgtColId][key]
+				if targetResult == nil || targetResult.Key() == "" || tgtFetched[tgtColId][key] {
+					continue
+				}
+				if !isKeyNotFoundError(sourceResult.Error()) && !isKeyNotFoundError(targetResult.Error()) {
+					continue
+				}
+				if _, exists := tgtFetched[tgtColId]; !exists {
+					tgtFetched[tgtColId] = make(map[string]bool)
+				}
+				tgtFetched[tgtColId][key] = true
+				tgtFetches = append(tgtFetches, &tombstoneFetch{colId: tgtColId, key: key})
+			}
+			if len(tgtFetches) == 0 {
+				continue
+			}
+			fetches = append(fetches, &tombstoneFetch{isSource: true, colId: srcColId, key: key})
+			fetches = append(fetches, tgtFetches...)
+		}
+	}
+
+	var numErrors int
+	for startIndex := 0; startIndex < len(fetches); startIndex += dw.differ.batchSize {
+		endIndex := startIndex + dw.differ.batchSize
+		if endIndex > len(fetches) {
+			endIndex = len(fetches)
+		}
+		numErrors += dw.sendTombstonesBatch(fetches[startIndex:endIndex])
+	}
+	if numErrors > 0 {
+		dw.logger.Warnf("Unable to look up the metadata of %v keys. They are not checked for tombstones\n", numErrors)
+	}
+
+	dw.resultsLock.RLock()
+	defer dw.resultsLock.RUnlock()
+	for _, fetch := range fetches {
+		if !fetch.done || fetch.err != nil {
+			continue
+		}
+		metaMap := dw.targetMetas
+		if fetch.isSource {
+			metaMap = dw.sourceMetas
+		}
+		if _, exists := metaMap[fetch.colId]; !exists {
+			metaMap[fetch.colId] = make(map[string]*gocbcore.GetMetaResult)
+		}
+		metaMap[fetch.colId][fetch.key] = fetch.meta
+	}
+}
+
+// Returns the number of lookups that failed, other than for keys that do not exist, or did not finish before the timeout
+func (dw *DifferWorker) sendTombstonesBatch(fetches []*tombstoneFetch) int {
+	var waitGroup sync.WaitGroup
+	for _, fetch := range fetches {
+		fetch := fetch
+		bucket := dw.targetBucket
+		if fetch.isSource {
+			bucket = dw.sourceBucket
+		}
+		waitGroup.Add(1)
+		err := bucket.GetMeta(fetch.key, func(result *gocbcore.GetMetaResult, err error) {
+			dw.resultsLock.Lock()
+			fetch.meta = result
+			fetch.err = err
+			fetch.done = true
+			dw.resultsLock.Unlock()
+			waitGroup.Done()
+		}, fetch.colId)
+		if err != nil {
+			dw.resultsLock.Lock()
+			fetch.err = err
+			fetch.done = true
+			dw.resultsLock.Unlock()
+			waitGroup.Done()
+		}
+	}
+
+	doneChan := make(chan bool, 1)
+	go utils.WaitForWaitGroup(&waitGroup, doneChan)
+	timer := time.NewTimer(time.Duration(dw.differ.timeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-doneChan:
+	case <-timer.C:
+	}
+
+	dw.resultsLock.RLock()
+	defer dw.resultsLock.RUnlock()
+	var numErrors int
+	for _, fetch := range fetches {
+		if !fetch.done || fetch.err != nil && !isKeyNotFoundError(fetch.err) {
+			numErrors++
+		}
+	}
+	return numErrors
+}
+
+// The metadata of the doc on one side, which is the result itself when comparing metadata
+// nil if the doc does not exist on that side at all, or if its metadata could not be looked up
+func (dw *DifferWorker) metaOf(isSource bool, colId uint32, key string, result Result) *gocbcore.GetMetaResult {
+	if dw.compareType == base.MutationCompareTypeMetadata {
+		if result.Error() != nil {
+			return nil
+		}
+		meta, _ := result.GoCbResult().(*gocbcore.GetMetaResult)
+		return meta
+	}
+	if isSource {
+		return dw.sourceMetas[colId][key]
+	}
+	return dw.targetMetas[colId][key]
+}
+
+// Classifies the keys deleted on at least one side. A doc deleted on one side and alive on the other is deleted
+// from that side, and docs deleted on both sides are compared by their tombstones
+// Returns false if the key is not deleted on either side, or if one side has no metadata, to be diffed as usual
+func (dw *DifferWorker) diffTombstones(srcColId, tgtColId uint32, key string, sourceResult, targetResult Result,
+	deletedFromSource, deletedFromTarget, tombstoneMismatch map[uint32]map[string][]*GocbResult) bool {
+	srcMeta := dw.metaOf(true, srcColId, key, sourceResult)
+	tgtMeta := dw.metaOf(false, tgtColId, key, targetResult)
+	if srcMeta == nil || tgtMeta == nil {
+		return false
+	}
+
+	results := []*GocbResult{{GetMetaResult: srcMeta}, {GetMetaResult: tgtMeta}}
+	switch {
+	case isDeleted(srcMeta) && isDeleted(tgtMeta):
+		if !areTombstonesTheSame(srcMeta, tgtMeta) {
+			addResults(tombstoneMismatch, srcColId, key, results)
+		}
+	case isDeleted(srcMeta):
+		addResults(deletedFromSource, srcColId, key, results)
+	case isDeleted(tgtMeta):
+		addResults(deletedFromTarget, tgtColId, key, results)
+	default:
+		return false
+	}
+	return true
+}
+
+func addResults(resultMap map[uint32]map[string][]*GocbResult, colId uint32, key string, results []*GocbResult) {
+	if _, exists := resultMap[colId]; !exists {
+		resultMap[colId] = make(map[string][]*GocbResult)
+	}
+	resultMap[colId][key] = append(resultMap[colId][key], results...)
+}
+
+func (d *MutationDiffer) addTombstoneDiff(tombstoneMismatch map[uint32]map[string][]*GocbResult) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	for colId, tombstoneMismatchPerCol := range tombstoneMismatch {
+		if _, exists := d.tombstoneMismatch[colId]; !exists {
+			d.tombstoneMismatch[colId] = make(map[string][]*GocbResult)
+		}
+		for key, results := range tombstoneMismatchPerCol {
+			d.tombstoneMismatch[colId][key] = results
+		}
+	}
+}
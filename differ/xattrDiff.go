@@ -0,0 +1,236 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package differ
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Must be called before Run()
+// XDCR replicates xattrs, and a drift in them does not show in the body or the metadata
+func (d *MutationDiffer) SetCompareXattrs(compareXattrs bool) {
+	d.compareXattrs = compareXattrs
+}
+
+// Must be called before Run()
+// Buckets fronted by Sync Gateway on both sides each get their own mobile metadata, which would otherwise
+// show up as an xattr difference on every doc
+func (d *MutationDiffer) SetIgnoreSyncGatewayXattrs(ignoreSyncGatewayXattrs bool) {
+	d.ignoreSyncGatewayXattrs = ignoreSyncGatewayXattrs
+}
+
+func isXattrIgnoredByDiff(name string, ignoreSyncGatewayXattrs bool) bool {
+	for _, ignored := range base.XattrsIgnoredByDiff {
+		if name == ignored {
+			return true
+		}
+	}
+	if ignoreSyncGatewayXattrs {
+		for _, ignored := range base.SyncGatewayXattrs {
+			if name == ignored {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func areXattrsTheSame(xattrs1, xattrs2 map[string]json.RawMessage) bool {
+	return areXattrsTheSameIgnoringSyncGateway(xattrs1, xattrs2, false)
+}
+
+// Values are compared as JSON, so that the same value written by different clients is not a difference
+func areXattrsTheSameIgnoringSyncGateway(xattrs1, xattrs2 map[string]json.RawMessage, ignoreSyncGatewayXattrs bool) bool {
+	for name, value1 := range xattrs1 {
+		if isXattrIgnoredByDiff(name, ignoreSyncGatewayXattrs) {
+			continue
+		}
+		value2, exists := xattrs2[name]
+		if !exists || !areXattrValuesTheSame(value1, value2) {
+			return false
+		}
+	}
+	for name := range xattrs2 {
+		if isXattrIgnoredByDiff(name, ignoreSyncGatewayXattrs) {
+			continue
+		}
+		if _, exists := xattrs1[name]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+func areXattrValuesTheSame(value1, value2 json.RawMessage) bool {
+	if areRawBodiesTheSame(value1, value2) {
+		return true
+	}
+	parsed1, err := unmarshalJsonBody(value1)
+	if err != nil {
+		return false
+	}
+	parsed2, err := unmarshalJsonBody(value2)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(parsed1, parsed2)
+}
+
+// Adds the xattrs to the marshalled get or getMeta result
+func marshalWithXattrs(resultBytes []byte, xattrs map[string]json.RawMessage) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(resultBytes) > 0 {
+		err := json.Unmarshal(resultBytes, &fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	xattrsBytes, err := json.Marshal(xattrs)
+	if err != nil {
+		return nil, err
+	}
+	fields["Xattrs"] = xattrsBytes
+	return json.Marshal(fields)
+}
+
+type xattrsFetch struct {
+	isSource bool
+	colId    uint32
+	key      string
+	xattrs   map[string]json.RawMessage
+	err      error
+	done     bool
+}
+
+// Looks up the xattrs of the keys that exist on both sides, batchSize keys at a time
+// Keys whose xattrs could not be looked up on either side are not compared
+func (dw *DifferWorker) getXattrs() {
+	var fetches []*xattrsFetch
+	tgtFetched := make(map[uint32]map[string]bool)
+	for srcColId, sourceResultMap := range dw.sourceResults {
+		for key, sourceResult := range sourceResultMap {
+			if sourceResult.Key() == "" || sourceResult.Error() != nil {
+				continue
+			}
+			var tgtFetches []*xattrsFetch
+			for _, tgtColId := range dw.getTargetColIds(srcColId, key) {
+				targetResult := dw.targetResults[tgtColId][key]
+				if targetResult == nil || targetResult.Key() == "" || targetResult.Error() != nil || tgtFetched[tgtColId][key] {
+					continue
+				}
+				if _, exists := tgtFetched[tgtColId]; !exists {
+					tgtFetched[tgtColId] = make(map[string]bool)
+				}
+				tgtFetched[tgtColId][key] = true
+				tgtFetches = append(tgtFetches, &xattrsFetch{colId: tgtColId, key: key})
+			}
+			if len(tgtFetches) == 0 {
+				continue
+			}
+			fetches = append(fetches, &xattrsFetch{isSource: true, colId: srcColId, key: key})
+			fetches = append(fetches, tgtFetches...)
+		}
+	}
+
+	var numErrors int
+	for startIndex := 0; startIndex < len(fetches); startIndex += dw.differ.batchSize {
+		endIndex := startIndex + dw.differ.batchSize
+		if endIndex > len(fetches) {
+			endIndex = len(fetches)
+		}
+		numErrors += dw.sendXattrsBatch(fetches[startIndex:endIndex])
+	}
+	if numErrors > 0 {
+		dw.logger.Warnf("Unable to look up the xattrs of %v keys. Their xattrs are not compared\n", numErrors)
+	}
+
+	dw.resultsLock.RLock()
+	defer dw.resultsLock.RUnlock()
+	for _, fetch := range fetches {
+		if !fetch.done || fetch.err != nil {
+			continue
+		}
+		xattrsMap := dw.targetXattrs
+		if fetch.isSource {
+			xattrsMap = dw.sourceXattrs
+		}
+		if _, exists := xattrsMap[fetch.colId]; !exists {
+			xattrsMap[fetch.colId] = make(map[string]map[string]json.RawMessage)
+		}
+		xattrsMap[fetch.colId][fetch.key] = fetch.xattrs
+	}
+}
+
+// Returns the number of lookups that failed or did not finish before the timeout
+func (dw *DifferWorker) sendXattrsBatch(fetches []*xattrsFetch) int {
+	var waitGroup sync.WaitGroup
+	for _, fetch := range fetches {
+		fetch := fetch
+		bucket := dw.targetBucket
+		if fetch.isSource {
+			bucket = dw.sourceBucket
+		}
+		waitGroup.Add(1)
+		err := bucket.LookupXattrs(fetch.key, func(xattrs map[string]json.RawMessage, err error) {
+			dw.resultsLock.Lock()
+			fetch.xattrs = xattrs
+			fetch.err = err
+			fetch.done = true
+			dw.resultsLock.Unlock()
+			waitGroup.Done()
+		}, fetch.colId)
+		if err != nil {
+			dw.resultsLock.Lock()
+			fetch.err = err
+			fetch.done = true
+			dw.resultsLock.Unlock()
+			waitGroup.Done()
+		}
+	}
+
+	doneChan := make(chan bool, 1)
+	go utils.WaitForWaitGroup(&waitGroup, doneChan)
+	timer := time.NewTimer(time.Duration(dw.differ.timeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-doneChan:
+	case <-timer.C:
+	}
+
+	dw.resultsLock.RLock()
+	defer dw.resultsLock.RUnlock()
+	var numErrors int
+	for _, fetch := range fetches {
+		if !fetch.done || fetch.err != nil {
+			numErrors++
+		}
+	}
+	return numErrors
+}
+
+func (d *MutationDiffer) addXattrDiff(xattrMismatch map[uint32]map[string][]*GocbResult) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	for colId, xattrMismatchPerCol := range xattrMismatch {
+		if _, exists := d.xattrMismatch[colId]; !exists {
+			d.xattrMismatch[colId] = make(map[string][]*GocbResult)
+		}
+		for key, results := range xattrMismatchPerCol {
+			d.xattrMismatch[colId][key] = results
+		}
+	}
+}
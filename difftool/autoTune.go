@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Replaces numberOfBins, numberOfFileDesc and the worker counts with values sized for the buckets and this machine
+// Data files that already exist, i.e. when resuming or only diffing, keep the numberOfBins they were written with
+func (difftool *xdcrDiffTool) autoTune() error {
+	config := difftool.config
+	numCPU := uint64(runtime.NumCPU())
+	numVbs := uint64(config.vbucketRange().Count())
+
+	config.NumberOfWorkersPerSourceDcpClient = autoTuneDcpWorkers(numCPU, numVbs, config.NumberOfSourceDcpClients)
+	config.NumberOfWorkersPerTargetDcpClient = autoTuneDcpWorkers(numCPU, numVbs, config.NumberOfTargetDcpClients)
+	config.NumberOfWorkersForFileDiffer = numCPU * base.AutoTuneFileDifferWorkersPerCPU
+	config.NumberOfWorkersForMutationDiffer = numCPU * base.AutoTuneMutationDifferWorkersPerCPU
+
+	if config.DataStore == base.DataStoreFiles {
+		if config.RunDataGeneration && config.OldSourceCheckpointFileName == "" {
+			// The high seqnos of the vbuckets are only known once the dcp drivers have started, but both clusters must
+			// be streamed into the same number of bins. The larger item count of the two buckets stands in for them
+			var itemCount uint64
+			for _, bucket := range []struct {
+				clusterName string
+				ref         *metadata.RemoteClusterReference
+				bucketName  string
+			}{
+				{"source", difftool.selfRef, config.SourceBucketName},
+				{"target", difftool.specifiedRef, config.TargetBucketName},
+			} {
+				count, err := difftool.bucketItemCount(bucket.clusterName, bucket.ref, bucket.bucketName)
+				if err != nil {
+					return err
+				}
+				if count > itemCount {
+					itemCount = count
+				}
+			}
+			config.NumberOfBins = autoTuneBins(itemCount, config.SamplePercent)
+		}
+
+		fileDescLimit, err := utils.FileDescLimit()
+		if err != nil {
+			return fmt.Errorf("unable to get the file descriptor limit: %v", err)
+		}
+		config.NumberOfFileDesc = autoTuneFileDesc(fileDescLimit, numVbs, config.NumberOfBins)
+	}
+
+	tuned := fmt.Sprintf("Auto tuned for %v CPUs and %v vbuckets: numberOfBins=%v numberOfFileDesc=%v numberOfWorkersPerSourceDcpClient=%v numberOfWorkersPerTargetDcpClient=%v numberOfWorkersForFileDiffer=%v numberOfWorkersForMutationDiffer=%v",
+		numCPU, numVbs, config.NumberOfBins, config.NumberOfFileDesc, config.NumberOfWorkersPerSourceDcpClient,
+		config.NumberOfWorkersPerTargetDcpClient, config.NumberOfWorkersForFileDiffer, config.NumberOfWorkersForMutationDiffer)
+	fmt.Println(tuned)
+	difftool.logger.Infof("%v\n", tuned)
+	return nil
+}
+
+// Returns the item count in the basic stats of the bucket
+func (difftool *xdcrDiffTool) bucketItemCount(clusterName string, ref *metadata.RemoteClusterReference, bucketName string) (uint64, error) {
+	if ref == nil {
+		return 0, fmt.Errorf("%v cluster: unable to find the remote cluster reference", clusterName)
+	}
+	connStr, err := ref.MyConnectionStr()
+	if err != nil {
+		return 0, fmt.Errorf("%v cluster: unable to get connection string: %v", clusterName, err)
+	}
+
+	bucketInfo, _, _, _, _, _, err := difftool.utils.BucketValidationInfo(connStr, bucketName, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	if err != nil {
+		return 0, fmt.Errorf("%v cluster %v: unable to validate bucket %v: %v", clusterName, connStr, bucketName, err)
+	}
+	basicStats, ok := bucketInfo[base.BasicStatsKey].(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("%v cluster %v: bucket %v has no %v", clusterName, connStr, bucketName, base.BasicStatsKey)
+	}
+	itemCount, ok := basicStats[base.ItemCountKey].(float64)
+	if !ok {
+		return 0, fmt.Errorf("%v cluster %v: bucket %v has no %v in %v", clusterName, connStr, bucketName, base.ItemCountKey, base.BasicStatsKey)
+	}
+	return uint64(itemCount), nil
+}
+
+// Workers past one per vbucket would have nothing to stream
+func autoTuneDcpWorkers(numCPU, numVbs, numClients uint64) uint64 {
+	if numClients == 0 {
+		return 1
+	}
+	workers := numCPU * base.AutoTuneDcpWorkersPerCPU / numClients
+	if maxWorkers := (numVbs + numClients - 1) / numClients; workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers == 0 {
+		workers = 1
+	}
+	return workers
+}
+
+// Items are spread evenly over the vbuckets, so the bins of each vbucket are sized from its share of the items
+func autoTuneBins(itemCount uint64, samplePercent float64) uint64 {
+	itemsPerVb := uint64(float64(itemCount) * samplePercent / 100 / base.NumberOfVbuckets)
+	bins := (itemsPerVb + base.AutoTuneItemsPerBin - 1) / base.AutoTuneItemsPerBin
+	if bins < 1 {
+		bins = 1
+	} else if bins > base.AutoTuneMaxBins {
+		bins = base.AutoTuneMaxBins
+	}
+	return bins
+}
+
+// Both clusters stream into the same file descriptor pool, which need not be any larger than all their data files
+// It gets what the limit leaves once AutoTuneReservedFileDesc is set aside, or half the limit if that is too low
+func autoTuneFileDesc(fileDescLimit, numVbs, numBins uint64) uint64 {
+	fileDesc := 2 * numVbs * numBins
+	available := fileDescLimit / 2
+	if fileDescLimit > 2*base.AutoTuneReservedFileDesc {
+		available = fileDescLimit - base.AutoTuneReservedFileDesc
+	}
+	if available < fileDesc {
+		fileDesc = available
+	}
+	if fileDesc == 0 {
+		fileDesc = 1
+	}
+	return fileDesc
+}
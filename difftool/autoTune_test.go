@@ -0,0 +1,35 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+)
+
+func TestAutoTune(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(uint64(1), autoTuneBins(0, 100))
+	assert.Equal(uint64(1), autoTuneBins(base.NumberOfVbuckets*base.AutoTuneItemsPerBin, 100))
+	assert.Equal(uint64(2), autoTuneBins(base.NumberOfVbuckets*base.AutoTuneItemsPerBin+base.NumberOfVbuckets, 100))
+	assert.Equal(uint64(5), autoTuneBins(10*base.NumberOfVbuckets*base.AutoTuneItemsPerBin, 50))
+	assert.Equal(uint64(base.AutoTuneMaxBins), autoTuneBins(1<<40, 100))
+
+	assert.Equal(uint64(2*base.NumberOfVbuckets*5), autoTuneFileDesc(1<<20, base.NumberOfVbuckets, 5))
+	assert.Equal(uint64(1024-base.AutoTuneReservedFileDesc), autoTuneFileDesc(1024, base.NumberOfVbuckets, 5))
+	assert.Equal(uint64(128), autoTuneFileDesc(256, base.NumberOfVbuckets, 5))
+
+	assert.Equal(uint64(4*base.AutoTuneDcpWorkersPerCPU/2), autoTuneDcpWorkers(4, base.NumberOfVbuckets, 2))
+	assert.Equal(uint64(8), autoTuneDcpWorkers(64, 16, 2))
+	assert.Equal(uint64(1), autoTuneDcpWorkers(1, base.NumberOfVbuckets, 64))
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+)
+
+// CompareCheckpoints reports how far each vbucket moved on from the old checkpoint file to the newer one, telling how
+// much changed between two runs and whether resuming from the old one is safe. newCheckpoint is either a checkpoint
+// file, or source or target to compare to the current high seqnos of that bucket
+func CompareCheckpoints(ctx context.Context, cfg *Config, oldCheckpointFileName, newCheckpoint string) (*dcp.CheckpointComparison, error) {
+	oldDoc, err := dcp.LoadCheckpointFile(oldCheckpointFileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load checkpoint file %v: %v", oldCheckpointFileName, err)
+	}
+
+	var newDoc *dcp.CheckpointDoc
+	if newCheckpoint == base.SourceClusterName || newCheckpoint == base.TargetClusterName {
+		newDoc, err = liveCheckpointDoc(ctx, cfg, newCheckpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the high seqnos of the %v bucket: %v", newCheckpoint, err)
+		}
+	} else {
+		newDoc, err = dcp.LoadCheckpointFile(newCheckpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load checkpoint file %v: %v", newCheckpoint, err)
+		}
+	}
+	return dcp.CompareCheckpoints(oldDoc, newDoc), nil
+}
+
+func liveCheckpointDoc(ctx context.Context, cfg *Config, clusterName string) (*dcp.CheckpointDoc, error) {
+	config := *cfg
+	config.resolveConnectionStrings()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	base.SetNetworkType(config.Network)
+	base.SetRedactionLevel(config.RedactionLevel)
+
+	difftool, err := newDiffTool(ctx, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating difftool: %v", err)
+	}
+	if difftool.legacyMode {
+		if err = difftool.populateTemporarySpecAndRef(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := time.Duration(config.BucketOpTimeout) * time.Second
+	if clusterName == base.SourceClusterName {
+		return dcp.LiveCheckpointDoc(difftool.selfRef, uint16(config.SourceKvPort), config.SourceBucketName, timeout)
+	}
+	if difftool.specifiedRef == nil {
+		return nil, fmt.Errorf("unable to find the remote cluster reference")
+	}
+	return dcp.LiveCheckpointDoc(difftool.specifiedRef, uint16(config.TargetKvPort), config.TargetBucketName, timeout)
+}
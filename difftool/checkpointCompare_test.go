@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+)
+
+func TestCompareCheckpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	writeDoc := func(name string, update func(vbno uint16, ckpt *dcp.Checkpoint)) string {
+		doc := &dcp.CheckpointDoc{Checkpoints: make(map[uint16]*dcp.Checkpoint)}
+		for vbno := uint16(0); vbno < base.NumberOfVbuckets; vbno++ {
+			ckpt := &dcp.Checkpoint{Vbuuid: 100, Seqno: 10}
+			update(vbno, ckpt)
+			doc.Checkpoints[vbno] = ckpt
+		}
+		bytes, err := json.Marshal(doc)
+		assert.Nil(err)
+		fileName := filepath.Join(dir, name)
+		assert.Nil(os.WriteFile(fileName, bytes, 0644))
+		return fileName
+	}
+	oldFile := writeDoc("source_run1", func(vbno uint16, ckpt *dcp.Checkpoint) {})
+	sameFile := writeDoc("source_run2", func(vbno uint16, ckpt *dcp.Checkpoint) {})
+	newFile := writeDoc("source_run3", func(vbno uint16, ckpt *dcp.Checkpoint) {
+		switch vbno {
+		case 1:
+			ckpt.Seqno = 15
+		case 2:
+			ckpt.Vbuuid = 200
+			ckpt.Seqno = 12
+		case 3:
+			ckpt.Seqno = 4
+		}
+	})
+
+	comparison, err := CompareCheckpoints(context.Background(), DefaultConfig(), oldFile, sameFile)
+	assert.Nil(err)
+	assert.Len(comparison.Diffs, 0)
+	assert.True(comparison.ResumeSafe())
+
+	comparison, err = CompareCheckpoints(context.Background(), DefaultConfig(), oldFile, newFile)
+	assert.Nil(err)
+	assert.Len(comparison.Diffs, 3)
+	assert.Equal(uint64(7), comparison.TotalSeqnoDelta)
+	assert.Equal([]uint16{2}, comparison.VbuuidChangedVbs)
+	assert.Equal([]uint16{3}, comparison.SeqnoWentBackVbs)
+	assert.Equal(int64(-6), comparison.Diffs[2].SeqnoDelta())
+	assert.False(comparison.ResumeSafe())
+
+	_, err = CompareCheckpoints(context.Background(), DefaultConfig(), oldFile, filepath.Join(dir, "missing"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,651 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+	"xdcrDiffer/objectStore"
+	"xdcrDiffer/utils"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+)
+
+// Config holds everything a run of the differ needs. Each field matches the command line option of the same name,
+// starting with a lowercase letter. Start from DefaultConfig(), which holds the same defaults as the command line
+type Config struct {
+	SourceUrl                         string
+	SourceUsername                    string
+	SourcePassword                    string
+	SourceBucketName                  string
+	RemoteClusterName                 string
+	SourceFileDir                     string
+	TargetUrl                         string
+	TargetUsername                    string
+	TargetPassword                    string
+	TargetBucketName                  string
+	TargetFileDir                     string
+	NumberOfSourceDcpClients          uint64
+	NumberOfWorkersPerSourceDcpClient uint64
+	NumberOfTargetDcpClients          uint64
+	NumberOfWorkersPerTargetDcpClient uint64
+	NumberOfWorkersForFileDiffer      uint64
+	NumberOfWorkersForMutationDiffer  uint64
+	NumberOfBins                      uint64
+	NumberOfFileDesc                  uint64
+	// If set, numberOfBins, numberOfFileDesc and the worker counts are sized from the item counts of the buckets,
+	// the file descriptor limit and the number of CPUs instead
+	AutoTune bool
+	// memory budget, in MB, shared by the file differ workers. 0 means no limit
+	FileDifferMemoryBudgetMB uint64
+	// the duration that the tools should be run when not completing by seqno, in seconds
+	CompleteByDuration uint64
+	// whether tool should complete after processing all mutations at tool start time
+	CompleteBySeqno bool
+	// directory for checkpoint files
+	CheckpointFileDir string
+	// If set, checkpoints are kept as documents in this bucket on the source cluster instead of in checkpointFileDir
+	CheckpointBucket string
+	// scope.collection of checkpointBucket to keep the checkpoints in. The default collection if not specified
+	CheckpointCollection string
+	// Prefix of the checkpoint document keys, so that runs of different replications do not collide
+	CheckpointRunId string
+	// name of source cluster checkpoint file to load from when tool starts
+	// if not specified, source cluster will start from 0
+	OldSourceCheckpointFileName string
+	// Whether to resume from the newest checkpoint in checkpointFileDir that is complete for both clusters
+	Resume bool
+	// name of target cluster checkpoint file to load from when tool starts
+	// if not specified, target cluster will start from 0
+	OldTargetCheckpointFileName string
+	// Whether to only record and diff the mutations after the old checkpoints, instead of adding them to the data
+	// files of the run that saved the checkpoints
+	DeltaDiff bool
+	// name of new checkpoint file to write to when tool shuts down
+	// if not specified, tool will not save checkpoint files
+	NewCheckpointFileName string
+	// directory for storing diffs generated by file differ
+	FileDifferDir string
+	// output directory for mutation differ
+	MutationDifferDir string
+	// If set, the mutation differ verifies the diff keys files of this directory instead of those of fileDifferDir, e.g.
+	// the keys an earlier run left unverified. Unlike fileDifferDir, runsDir does not replace it
+	DiffKeysDir string
+	// If set, each run keeps its checkpoints, file differ and mutation differ outputs and manifest in a directory of its
+	// own under runsDir, named by its run ID, in place of checkpointFileDir, fileDifferDir and mutationDifferDir, so
+	// that the results of earlier runs are not removed
+	RunsDir string
+	// Name of the directory of the run under runsDir. The start time of the run if not specified
+	RunId string
+	// Number of most recent run directories to keep under runsDir, older ones are removed. 0 keeps all of them
+	RunRetention uint64
+	// size of batch used by mutation differ
+	MutationDifferBatchSize uint64
+	// timeout, in seconds, used by mutation differ
+	MutationDifferTimeout uint64
+	// size of source dcp handler channel
+	SourceDcpHandlerChanSize uint64
+	// size of target dcp handler channel
+	TargetDcpHandlerChanSize uint64
+	// timeout for bucket for stats collection, in seconds
+	BucketOpTimeout uint64
+	// max number of retry for get stats
+	MaxNumOfGetStatsRetry uint64
+	// max number of retry for send batch
+	MaxNumOfSendBatchRetry uint64
+	// retry interval for get stats, in seconds
+	GetStatsRetryInterval uint64
+	// retry interval for send batch, in milliseconds
+	SendBatchRetryInterval uint64
+	// max backoff for get stats, in seconds
+	GetStatsMaxBackoff uint64
+	// max backoff for send batch, in seconds
+	SendBatchMaxBackoff uint64
+	// delay between source cluster start up and target cluster start up, in seconds
+	DelayBetweenSourceAndTarget uint64
+	//interval for periodical checkpointing, in seconds
+	// value of 0 indicates no periodical checkpointing
+	CheckpointInterval uint64
+	// number of most recent periodical checkpoints to keep. Value of 0 keeps all of them
+	CheckpointRetention uint64
+	// whether to run data generation
+	RunDataGeneration bool
+	// whether to run file differ
+	RunFileDiffer bool
+	// whether to verify diff keys through aysnc Get on clusters
+	RunMutationDiffer bool
+	// Whether or not to enforce secure communications for data retrieval
+	EnforceTLS bool
+	// Number of items kept in memory per binary buffer bucket
+	BucketBufferCapacity int
+	// Size in bytes of the DCP connection buffer used for flow control. 0 disables flow control
+	DcpBufferSize int
+	// Whether to negotiate snappy compression on the source and target DCP connections
+	SourceDcpCompression bool
+	TargetDcpCompression bool
+	// Algorithm used to hash document bodies in the data files
+	HashAlgorithm string
+	// Record and diff only the keys, to find the docs missing from either side at the least CPU and disk cost
+	KeyOnly bool
+	// How the data files are compressed, one of base.DataFileCompressions
+	DataFileCompression string
+	// AES-256 key, in hex, or a file holding it, to encrypt the data files and the diff outputs with. Plaintext if neither is set
+	EncryptionKey     string
+	EncryptionKeyFile string
+	// Whether to check, before streaming, that the data file dirs have room for the estimated size of the data files
+	CheckDiskSpace bool
+	// Size in GB the data files may grow to before data generation is stopped with a checkpoint. 0 means no limit
+	MaxDiskGB uint64
+	// Percentage of keys, picked by hash, that are recorded and diffed. 100 diffs all keys
+	SamplePercent float64
+	// Only keys with this prefix, and within the start..end KeyRange, are recorded and diffed
+	KeyPrefix string
+	KeyRange  string
+	// Whether the replication filter is applied to the target stream as well as the source stream
+	FilterTarget bool
+	// Compare metadata, or body, or both
+	CompareType string
+	// Format of the mutation differ details file
+	MutationDifferOutputFormat string
+	// Whether to compare JSON bodies by value rather than byte for byte
+	JsonAwareBodyCompare bool
+	// Bytes of mismatched binary bodies to hex dump from where they diverge, 0 to not dump them
+	BinaryDiffHexDumpBytes uint64
+	// Whether to also compare the xattrs of docs that exist on both sides
+	CompareXattrs bool
+	// Whether to leave out the xattrs Sync Gateway keeps its metadata in, when hashing and when comparing xattrs
+	IgnoreSyncGatewayMetadata bool
+	// Whether to tell docs deleted on one side from docs that never existed there, and compare the tombstones of docs deleted on both sides
+	CompareTombstones bool
+	// Max reads per second the mutation differ issues to each cluster, 0 for unlimited
+	MutationDifferOpsPerSec uint64
+	// Number of times for mutationsDiffer to retry to resolve doc differences
+	MutationDifferRetries int
+	// Number of secs to wait between retries
+	MutationDifferRetriesWaitSecs uint64
+	// Seconds for mutationsDiffer to wait before verifying the keys it found different once more, 0 to not recheck them
+	MutationDifferSettleTime uint64
+	// Seconds the mutation differ phase may run for, retries included, before the keys left are written for a follow-up run. 0 for no limit
+	MutationDifferMaxDuration uint64
+	// Number of filters to be created for the filter pool to be shared
+	NumOfFiltersInFilterPool int
+	// DebugLogLevel set to true will show debug logs
+	DebugLogLevel bool
+	// If set, the lowest level of the logs to show: debug, info, warn or error. Info by default, or error with the dashboard
+	LogLevel string
+	// Whether to show a live terminal dashboard instead of relying on scrolling logs
+	Dashboard bool
+	// Where the dashboard is drawn. Stdout if nil
+	DashboardOutput io.Writer `json:"-"`
+	// host:port to serve the status of the run on, as JSON. Disabled if empty
+	StatusAddr string
+	// Whether to log the seqno of each vbucket that has not completed with each status report
+	VerboseProgress bool
+	// Whether to diff in memory as DCP streams in, skipping the data files and the file differ
+	InMemory bool
+	// Whether to start diffing vbuckets that have completed on both sides while others are still streaming
+	StreamingDiff bool
+	// Where the mutation records are kept, one of base.DataStores. The stores live in sourceFileDir and targetFileDir
+	DataStore string
+	// Mismatches where only the CAS differs by no more than this are reported as low severity, in milliseconds
+	CasToleranceMs uint64
+	// Expiries of the same doc no more than this many seconds apart are not a difference
+	ExpiryToleranceSeconds uint64
+	// Number of times to rerun the mutation differ on the keys still different, until none remain
+	ConvergenceRetries int
+	// Number of secs to wait between convergence retries
+	ConvergenceRetriesWaitSecs uint64
+	// If set, also write mutation differ results as JSON lines to this file
+	OutputSinkFile string
+	// If set, also write mutation differ results into tables of this SQLite database file
+	OutputSinkSqlite string
+	// If set, also POST mutation differ results to this URL
+	OutputSinkWebhook string
+	// If set, also write mutation differ results as documents into this bucket on the source cluster
+	OutputSinkBucket string
+	// scope.collection of outputSinkBucket to write to, the default collection if not set
+	OutputSinkCollection string
+	// Prefix of the keys of the documents written to outputSinkBucket. The start time of the run if not set
+	OutputSinkRunId string
+	// Whether to connect to the source cluster over TLS, verified with sourceCACertFile
+	SourceSecure     bool
+	SourceCACertFile string
+	// Whether to connect to the target cluster over TLS, verified with targetCACertFile
+	TargetSecure     bool
+	TargetCACertFile string
+	// Ports of the clusters, the TLS ones when connecting over TLS. 0 for the default ports. The management ports are
+	// those of sourceUrl and targetUrl when they have none, and the KV ports are the ones agents bootstrap from
+	SourceMgmtPort uint64
+	TargetMgmtPort uint64
+	SourceKvPort   uint64
+	TargetKvPort   uint64
+	// PEM files of the x.509 client certificates and keys to authenticate with instead of passwords. Require TLS
+	SourceClientCertFile string
+	SourceClientKeyFile  string
+	TargetClientCertFile string
+	TargetClientKeyFile  string
+	// If set, the only SASL mechanism to authenticate KV connections with, i.e. SCRAM-SHA512
+	KvAuthMechanism string
+	// If set, whether to connect to the nodes on their internal addresses, default, or their alternate addresses, external
+	Network string
+	// How user data is written to the logs and the mutation differ reports: none, partial for <ud> tags or full for hashes
+	RedactionLevel string
+	// Comma separated scope.collection names. If set, only these collections are streamed and diffed
+	SourceCollections string
+	TargetCollections string
+	// Comma separated source scope.collection names. If set, the mutation differ only verifies the diff keys of these collections
+	MutationDifferCollections string
+	// Whether to only validate the options, the clusters, the buckets and the permissions, then exit
+	DryRun bool
+	// vbuckets to stream and diff, both inclusive, so that several instances can each diff a disjoint part of the bucket
+	VbucketRangeStart uint64
+	VbucketRangeEnd   uint64
+	// In place of the vbucket range, the index, from 0, of this instance out of totalNodes instances that share the vbuckets evenly
+	// Disabled if totalNodes is 0
+	NodeIndex  uint64
+	TotalNodes uint64
+	// Whether to diff every replication to remoteClusterName, in place of the one given by sourceBucketName and targetBucketName
+	AllReplications bool
+	// If set, how to repair the keys the mutation differ confirmed to be missing from the target, one of base.RepairModes
+	Repair string
+	// Whether to only preview the repair, without writing anything
+	RepairDryRun bool
+	// If set, the keys list and cbc script to remediate the differences the mutation differ confirmed are written there
+	RemediationDir string
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		SourceFileDir:                     base.SourceFileDir,
+		TargetFileDir:                     base.TargetFileDir,
+		NumberOfSourceDcpClients:          1,
+		NumberOfWorkersPerSourceDcpClient: 64,
+		NumberOfTargetDcpClients:          1,
+		NumberOfWorkersPerTargetDcpClient: 64,
+		NumberOfWorkersForFileDiffer:      30,
+		NumberOfWorkersForMutationDiffer:  30,
+		NumberOfBins:                      5,
+		NumberOfFileDesc:                  500,
+		CompleteBySeqno:                   true,
+		CheckpointFileDir:                 base.CheckpointFileDir,
+		FileDifferDir:                     base.FileDifferDir,
+		MutationDifferDir:                 base.MutationDifferDir,
+		MutationDifferBatchSize:           100,
+		MutationDifferTimeout:             30,
+		SourceDcpHandlerChanSize:          base.DcpHandlerChanSize,
+		TargetDcpHandlerChanSize:          base.DcpHandlerChanSize,
+		BucketOpTimeout:                   base.BucketOpTimeout,
+		MaxNumOfGetStatsRetry:             base.MaxNumOfGetStatsRetry,
+		MaxNumOfSendBatchRetry:            base.MaxNumOfSendBatchRetry,
+		GetStatsRetryInterval:             base.GetStatsRetryInterval,
+		SendBatchRetryInterval:            base.SendBatchRetryInterval,
+		GetStatsMaxBackoff:                base.GetStatsMaxBackoff,
+		SendBatchMaxBackoff:               base.SendBatchMaxBackoff,
+		DelayBetweenSourceAndTarget:       base.DelayBetweenSourceAndTarget,
+		CheckpointInterval:                base.CheckpointInterval,
+		CheckpointRetention:               base.CheckpointRetention,
+		RunDataGeneration:                 true,
+		RunFileDiffer:                     true,
+		RunMutationDiffer:                 true,
+		BucketBufferCapacity:              base.BucketBufferCapacity,
+		DcpBufferSize:                     base.DcpConnectionBufferSize,
+		SourceDcpCompression:              true,
+		TargetDcpCompression:              true,
+		HashAlgorithm:                     base.HashAlgorithmSha512,
+		DataFileCompression:               base.DataFileCompressionNone,
+		CheckDiskSpace:                    true,
+		SamplePercent:                     100,
+		FilterTarget:                      true,
+		RedactionLevel:                    base.RedactionLevelNone,
+		DataStore:                         base.DataStoreFiles,
+		CompareType:                       base.MutationCompareTypeMetadata,
+		MutationDifferOutputFormat:        base.MutationDiffOutputFormatJson,
+		MutationDifferRetriesWaitSecs:     60,
+		NumOfFiltersInFilterPool:          32,
+		CasToleranceMs:                    base.CasToleranceMs,
+		ConvergenceRetriesWaitSecs:        60,
+		VbucketRangeEnd:                   base.NumberOfVbuckets - 1,
+	}
+}
+
+// With keyOnly, the data files hold no hashes at all
+func (c *Config) dataFileHashAlgorithm() string {
+	if c.KeyOnly {
+		return base.HashAlgorithmNone
+	}
+	return c.HashAlgorithm
+}
+
+// Targets the remote cluster with its own credentials, instead of through a remote cluster reference
+func (c *Config) legacyMode() bool {
+	return len(c.TargetUsername) > 0
+}
+
+func validateOneOf(name, value string, accepted []string) error {
+	for _, str := range accepted {
+		if value == str {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid %v '%v'. Accepted values are %v", name, value, accepted)
+}
+
+// Checks the options that are not compatible with each other, before anything is connected to
+func (c *Config) Validate() error {
+	if err := validateOneOf("compareType", c.CompareType, base.MutationDiffCompareType); err != nil {
+		return err
+	}
+	if err := validateOneOf("hashAlgorithm", c.HashAlgorithm, base.HashAlgorithms); err != nil {
+		return err
+	}
+	if c.HashAlgorithm == base.HashAlgorithmNone {
+		return fmt.Errorf("hashAlgorithm %v is set with keyOnly instead", base.HashAlgorithmNone)
+	}
+	if c.KeyOnly && (c.CompareType != base.MutationCompareTypeMetadata || c.CompareXattrs) {
+		return fmt.Errorf("keyOnly requires compareType %v, without compareXattrs", base.MutationCompareTypeMetadata)
+	}
+	if err := validateOneOf("dataFileCompression", c.DataFileCompression, base.DataFileCompressions); err != nil {
+		return err
+	}
+	if err := validateOneOf("dataStore", c.DataStore, base.DataStores); err != nil {
+		return err
+	}
+	if err := validateOneOf("mutationDifferOutputFormat", c.MutationDifferOutputFormat, base.MutationDiffOutputFormats); err != nil {
+		return err
+	}
+	if c.JsonAwareBodyCompare && c.CompareType == base.MutationCompareTypeMetadata {
+		return fmt.Errorf("jsonAwareBodyCompare requires compareType %v or %v", base.MutationCompareTypeBodyOnly, base.MutationCompareTypeBodyAndMeta)
+	}
+	if c.BinaryDiffHexDumpBytes > 0 && c.CompareType == base.MutationCompareTypeMetadata {
+		return fmt.Errorf("binaryDiffHexDumpBytes requires compareType %v or %v", base.MutationCompareTypeBodyOnly, base.MutationCompareTypeBodyAndMeta)
+	}
+	if c.BinaryDiffHexDumpBytes > base.MaxBinaryDiffHexDumpBytes {
+		return fmt.Errorf("binaryDiffHexDumpBytes must be no more than %v", base.MaxBinaryDiffHexDumpBytes)
+	}
+	if c.KvAuthMechanism != "" {
+		if _, err := base.ParseKVAuthMechanism(c.KvAuthMechanism); err != nil {
+			return err
+		}
+	}
+	for name, port := range map[string]uint64{"sourceMgmtPort": c.SourceMgmtPort, "targetMgmtPort": c.TargetMgmtPort,
+		"sourceKvPort": c.SourceKvPort, "targetKvPort": c.TargetKvPort} {
+		if port > math.MaxUint16 {
+			return fmt.Errorf("%v %v is not a valid port", name, port)
+		}
+	}
+	if c.Network != "" {
+		if err := base.ValidateNetworkType(c.Network); err != nil {
+			return err
+		}
+	}
+	if err := base.ValidateRedactionLevel(c.RedactionLevel); err != nil {
+		return err
+	}
+	if c.LogLevel != "" {
+		if err := base.ValidateLogLevel(c.LogLevel); err != nil {
+			return err
+		}
+		if c.DebugLogLevel && c.LogLevel != base.LogLevelDebug {
+			return fmt.Errorf("debugLogLevel cannot be set along with logLevel %v", c.LogLevel)
+		}
+	}
+	if c.InMemory && !c.RunDataGeneration {
+		return fmt.Errorf("inMemory option requires data generation to be run")
+	}
+	if c.InMemory && (c.Resume || c.OldSourceCheckpointFileName != "" || c.OldTargetCheckpointFileName != "") {
+		// Only the mutations streamed after the checkpoint would be diffed, and the docs that did not change since
+		// would be reported as missing
+		return fmt.Errorf("inMemory option only diffs what is streamed in the run, so it cannot be used with resume, oldSourceCheckpointFileName or oldTargetCheckpointFileName")
+	}
+	if c.StreamingDiff && (!c.RunDataGeneration || !c.RunFileDiffer || !c.CompleteBySeqno) {
+		return fmt.Errorf("streamingDiff option requires data generation and file differ to be run with completeBySeqno")
+	}
+	if c.RunDataGeneration && c.CompleteByDuration == 0 && !c.CompleteBySeqno {
+		return fmt.Errorf("completeByDuration is required when completeBySeqno is false")
+	}
+	if c.SourceSecure && c.SourceCACertFile == "" && !isURLLoopBack(c.SourceUrl) {
+		return fmt.Errorf("sourceSecure option requires sourceCACertFile unless source addr %v uses loopback device", c.SourceUrl)
+	}
+	if (c.SourceClientCertFile != "") != (c.SourceClientKeyFile != "") ||
+		(c.TargetClientCertFile != "") != (c.TargetClientKeyFile != "") {
+		return fmt.Errorf("client certificate and client key files must be given together")
+	}
+	if c.SourceClientCertFile != "" && !c.SourceSecure {
+		return fmt.Errorf("sourceClientCertFile option requires sourceSecure")
+	}
+	if c.TargetClientCertFile != "" && !c.TargetSecure {
+		return fmt.Errorf("targetClientCertFile option requires targetSecure")
+	}
+	if c.legacyMode() && (c.SourceCollections != "" || c.TargetCollections != "") {
+		return fmt.Errorf("sourceCollections and targetCollections options are not compatible with legacyMode")
+	}
+	if c.DcpBufferSize < 0 {
+		return fmt.Errorf("dcpBufferSize cannot be negative")
+	}
+	if c.legacyMode() && c.MutationDifferCollections != "" {
+		return fmt.Errorf("mutationDifferCollections option is not compatible with legacyMode")
+	}
+	if c.legacyMode() && c.TargetSecure && c.TargetCACertFile == "" {
+		return fmt.Errorf("targetSecure option requires targetCACertFile in legacyMode")
+	}
+	// For using certificates, the source cluster must be on a loopback device since we will be retrieving the
+	// source cluster's certificate to prevent sniffing
+	if c.EnforceTLS && !isURLLoopBack(c.SourceUrl) {
+		return fmt.Errorf("enforceTLS options requires that source addr %v to use loopback device", c.SourceUrl)
+	}
+	if c.EnforceTLS && c.legacyMode() {
+		return fmt.Errorf("enforceTLS option is not compatible with legacyMode")
+	}
+	if c.Resume && (c.OldSourceCheckpointFileName != "" || c.OldTargetCheckpointFileName != "") {
+		return fmt.Errorf("resume option is not compatible with oldSourceCheckpointFileName and oldTargetCheckpointFileName")
+	}
+	if c.DeltaDiff && !c.Resume && (c.OldSourceCheckpointFileName == "" || c.OldTargetCheckpointFileName == "") {
+		return fmt.Errorf("deltaDiff option requires resume, or both oldSourceCheckpointFileName and oldTargetCheckpointFileName")
+	}
+	if c.DeltaDiff && (!c.RunDataGeneration || !c.RunMutationDiffer) {
+		return fmt.Errorf("deltaDiff option requires data generation and mutation differ to be run, since a key changed on one side only since the checkpoint has to be looked up on the other")
+	}
+	if c.Resume && c.CheckpointBucket != "" {
+		return fmt.Errorf("resume option is not compatible with checkpointBucket")
+	}
+	if c.VbucketRangeStart > c.VbucketRangeEnd || c.VbucketRangeEnd >= base.NumberOfVbuckets {
+		return fmt.Errorf("vbucketRangeStart %v and vbucketRangeEnd %v must be in order, within 0-%v", c.VbucketRangeStart, c.VbucketRangeEnd, base.NumberOfVbuckets-1)
+	}
+	if c.AllReplications && (c.legacyMode() || c.RemoteClusterName == "") {
+		return fmt.Errorf("allReplications option requires remoteClusterName, and is not compatible with legacyMode")
+	}
+	if c.AllReplications && (c.SourceBucketName != "" || c.TargetBucketName != "") {
+		return fmt.Errorf("allReplications option is not compatible with sourceBucketName and targetBucketName")
+	}
+	if c.Repair != "" {
+		if err := validateOneOf("repair", c.Repair, base.RepairModes); err != nil {
+			return err
+		}
+		if !c.RunMutationDiffer {
+			return fmt.Errorf("repair option requires runMutationDiffer")
+		}
+	}
+	if c.RepairDryRun && c.Repair == "" {
+		return fmt.Errorf("repairDryRun option requires repair")
+	}
+	if c.OutputSinkBucket == "" && (c.OutputSinkCollection != "" || c.OutputSinkRunId != "") {
+		return fmt.Errorf("outputSinkCollection and outputSinkRunId options require outputSinkBucket")
+	}
+	if c.RemediationDir != "" && !c.RunMutationDiffer {
+		return fmt.Errorf("remediationDir option requires runMutationDiffer")
+	}
+	if c.MutationDifferMaxDuration > 0 && !c.RunMutationDiffer {
+		return fmt.Errorf("mutationDifferMaxDuration option requires runMutationDiffer")
+	}
+	if c.DiffKeysDir != "" {
+		if !c.RunMutationDiffer || c.RunFileDiffer {
+			return fmt.Errorf("diffKeysDir option requires runMutationDiffer, and runFileDiffer to be false")
+		}
+		if c.AllReplications {
+			return fmt.Errorf("diffKeysDir option is not compatible with allReplications")
+		}
+	}
+	if objectStore.IsURI(c.CheckpointFileDir) || objectStore.IsURI(c.FileDifferDir) || objectStore.IsURI(c.MutationDifferDir) ||
+		objectStore.IsURI(c.RunsDir) || objectStore.IsURI(c.DiffKeysDir) {
+		return fmt.Errorf("only sourceFileDir and targetFileDir can be in object storage")
+	}
+	if c.RunsDir == "" && (c.RunId != "" || c.RunRetention > 0) {
+		return fmt.Errorf("runId and runRetention options require runsDir")
+	}
+	if c.RunId != "" && (strings.ContainsAny(c.RunId, `/\`) || c.RunId == "." || c.RunId == "..") {
+		return fmt.Errorf("runId %v must be a plain directory name", c.RunId)
+	}
+	if c.RunsDir != "" && c.Resume && c.RunId == "" {
+		return fmt.Errorf("resume option with runsDir requires the runId of the run to resume")
+	}
+	if c.dataFilesInObjectStore() && (c.Resume || c.OldSourceCheckpointFileName != "" || c.OldTargetCheckpointFileName != "" || c.StreamingDiff) {
+		return fmt.Errorf("data files in object storage cannot be appended to or read while being written, so resume, oldSourceCheckpointFileName, oldTargetCheckpointFileName and streamingDiff options are not supported with them")
+	}
+	if c.EncryptionKey != "" && c.EncryptionKeyFile != "" {
+		return fmt.Errorf("encryptionKey and encryptionKeyFile options cannot both be set")
+	}
+	if c.EncryptionKey != "" {
+		if _, err := utils.ParseDataFileEncryptionKey(c.EncryptionKey); err != nil {
+			return err
+		}
+	}
+	if (c.EncryptionKey != "" || c.EncryptionKeyFile != "") && c.DataStore != base.DataStoreFiles {
+		return fmt.Errorf("encryption is only supported with dataStore %v", base.DataStoreFiles)
+	}
+	if c.DataStore != base.DataStoreFiles && (c.InMemory || c.StreamingDiff || c.dataFilesInObjectStore()) {
+		return fmt.Errorf("dataStore %v is not compatible with inMemory, streamingDiff and object storage", c.DataStore)
+	}
+	if c.MaxDiskGB > 0 && (c.InMemory || c.dataFilesInObjectStore()) {
+		return fmt.Errorf("maxDiskGB option only applies to data files on local disk, so it is not compatible with inMemory and object storage")
+	}
+	if c.SamplePercent <= 0 || c.SamplePercent > 100 {
+		return fmt.Errorf("samplePercent %v must be more than 0 and at most 100", c.SamplePercent)
+	}
+	if _, err := base.ParseKeyRange(c.KeyPrefix, c.KeyRange); err != nil {
+		return err
+	}
+	if c.TotalNodes > 0 {
+		if !c.vbucketRangeIsAll() {
+			return fmt.Errorf("totalNodes option is not compatible with vbucketRangeStart and vbucketRangeEnd")
+		}
+		if c.TotalNodes > base.NumberOfVbuckets || c.NodeIndex >= c.TotalNodes {
+			return fmt.Errorf("nodeIndex %v must be less than totalNodes %v, which must be at most %v", c.NodeIndex, c.TotalNodes, base.NumberOfVbuckets)
+		}
+	}
+	return nil
+}
+
+// Copy of the config that can be printed or written out, without the passwords and the encryption key
+func (c *Config) WithoutSecrets() *Config {
+	config := *c
+	config.SourcePassword = ""
+	config.TargetPassword = ""
+	config.EncryptionKey = ""
+	return &config
+}
+
+// Returns nil if the files are not to be encrypted
+func (c *Config) DataFileEncryptionKey() ([]byte, error) {
+	if c.EncryptionKeyFile != "" {
+		return utils.LoadDataFileEncryptionKey(c.EncryptionKeyFile)
+	}
+	if c.EncryptionKey != "" {
+		return utils.ParseDataFileEncryptionKey(c.EncryptionKey)
+	}
+	return nil, nil
+}
+
+func (c *Config) dataFilesInObjectStore() bool {
+	return objectStore.IsURI(c.SourceFileDir) || objectStore.IsURI(c.TargetFileDir)
+}
+
+func (c *Config) vbucketRangeIsAll() bool {
+	return c.VbucketRangeStart == 0 && c.VbucketRangeEnd == base.NumberOfVbuckets-1
+}
+
+// The vbuckets this instance streams and diffs. Only valid once Validate() has passed
+func (c *Config) vbucketRange() base.VbucketRange {
+	if c.TotalNodes > 0 {
+		return base.NodeVbucketRange(int(c.NodeIndex), int(c.TotalNodes))
+	}
+	return base.VbucketRange{Start: uint16(c.VbucketRangeStart), End: uint16(c.VbucketRangeEnd)}
+}
+
+// The keys this instance records and diffs. Only valid once Validate() has passed
+func (c *Config) keyRange() base.KeyRange {
+	keyRange, _ := base.ParseKeyRange(c.KeyPrefix, c.KeyRange)
+	return keyRange
+}
+
+// couchbases:// urls, i.e. for Capella, imply TLS
+func (c *Config) resolveConnectionStrings() {
+	var secure bool
+	if c.SourceUrl != "" {
+		c.SourceUrl, secure = utils.ResolveConnectionString(c.SourceUrl, uint16(c.SourceMgmtPort))
+		c.SourceSecure = c.SourceSecure || secure
+	}
+	if c.TargetUrl != "" {
+		c.TargetUrl, secure = utils.ResolveConnectionString(c.TargetUrl, uint16(c.TargetMgmtPort))
+		c.TargetSecure = c.TargetSecure || secure
+	}
+}
+
+// Sets the old checkpoint file names to those of the newest complete checkpoint
+func (c *Config) resolveResumeCheckpoint() error {
+	name, err := dcp.FindNewestCheckpoint(c.CheckpointFileDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error looking for checkpoints in %v: %v", c.CheckpointFileDir, err)
+	}
+	if name == "" {
+		fmt.Printf("No complete checkpoint found in %v. Starting from scratch\n", c.CheckpointFileDir)
+		return nil
+	}
+
+	fmt.Printf("Resuming from checkpoint %v in %v\n", name, c.CheckpointFileDir)
+	c.OldSourceCheckpointFileName = name
+	c.OldTargetCheckpointFileName = name
+	return nil
+}
+
+// Object storage has no directories, its keys only share the prefix
+func (c *Config) setupDirectories() error {
+	var err error
+	if !objectStore.IsURI(c.SourceFileDir) {
+		err = os.MkdirAll(c.SourceFileDir, 0777)
+		if err != nil {
+			fmt.Printf("Error mkdir sourceFileDir: %v\n", err)
+		}
+	}
+	if !objectStore.IsURI(c.TargetFileDir) {
+		err = os.MkdirAll(c.TargetFileDir, 0777)
+		if err != nil {
+			fmt.Printf("Error mkdir targetFileDir: %v\n", err)
+		}
+	}
+	err = os.MkdirAll(c.CheckpointFileDir, 0777)
+	if err != nil {
+		// it is ok for checkpoint dir to be existing, since we do not clean it up
+		fmt.Printf("Error mkdir checkpointFileDir: %v\n", err)
+	}
+	return nil
+}
+
+func isURLLoopBack(url string) bool {
+	IPLoopbackCheck := net.ParseIP(xdcrBase.GetHostName(url))
+	hostNameIsLocalHost := xdcrBase.GetHostName(url) == "localhost"
+	return IPLoopbackCheck.IsLoopback() || hostNameIsLocalHost
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+)
+
+func TestValidateConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	assert.Nil(config.Validate())
+
+	config.CompareType = "neither"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.JsonAwareBodyCompare = true
+	assert.NotNil(config.Validate())
+	config.CompareType = base.MutationCompareTypeBodyOnly
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.BinaryDiffHexDumpBytes = 64
+	assert.NotNil(config.Validate())
+	config.CompareType = base.MutationCompareTypeBodyAndMeta
+	assert.Nil(config.Validate())
+	config.BinaryDiffHexDumpBytes = base.MaxBinaryDiffHexDumpBytes + 1
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.CompleteBySeqno = false
+	assert.NotNil(config.Validate())
+	config.CompleteByDuration = 10
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.SourceKvPort = 70000
+	assert.NotNil(config.Validate())
+	config.SourceKvPort = 11000
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.Network = "internal"
+	assert.NotNil(config.Validate())
+	config.Network = base.NetworkTypeExternal
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.RedactionLevel = "some"
+	assert.NotNil(config.Validate())
+	config.RedactionLevel = base.RedactionLevelFull
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.LogLevel = "verbose"
+	assert.NotNil(config.Validate())
+	config.LogLevel = base.LogLevelWarn
+	assert.Nil(config.Validate())
+	config.DebugLogLevel = true
+	assert.NotNil(config.Validate())
+	config.LogLevel = base.LogLevelDebug
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.RunId = "nightly"
+	assert.NotNil(config.Validate())
+	config.RunsDir = "runs"
+	assert.Nil(config.Validate())
+	config.RunId = "../nightly"
+	assert.NotNil(config.Validate())
+	config.RunId = ""
+	config.Resume = true
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.EncryptionKey = "0123"
+	assert.NotNil(config.Validate())
+	config.EncryptionKey = strings.Repeat("0123456789abcdef", 4)
+	assert.Nil(config.Validate())
+	config.EncryptionKeyFile = "key"
+	assert.NotNil(config.Validate())
+	config.EncryptionKeyFile = ""
+	config.DataStore = base.DataStoreBadger
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.TargetUsername = "Administrator"
+	config.SourceCollections = "S1.col1"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.AllReplications = true
+	assert.NotNil(config.Validate())
+	config.RemoteClusterName = "C2"
+	assert.Nil(config.Validate())
+	config.SourceBucketName = "B1"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.RepairDryRun = true
+	assert.NotNil(config.Validate())
+	config.Repair = "overwrite"
+	assert.NotNil(config.Validate())
+	config.Repair = base.RepairModeTouchSource
+	assert.Nil(config.Validate())
+	config.RunMutationDiffer = false
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.DataFileCompression = "zstd"
+	assert.NotNil(config.Validate())
+	config.DataFileCompression = base.DataFileCompressionSnappy
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.MaxDiskGB = 100
+	assert.Nil(config.Validate())
+	config.InMemory = true
+	assert.NotNil(config.Validate())
+	config.InMemory = false
+	config.SourceFileDir = "s3://bucket/source"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.SamplePercent = 0
+	assert.NotNil(config.Validate())
+	config.SamplePercent = 100.5
+	assert.NotNil(config.Validate())
+	config.SamplePercent = 0.5
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.DeltaDiff = true
+	assert.NotNil(config.Validate())
+	config.OldSourceCheckpointFileName = "nightly"
+	config.OldTargetCheckpointFileName = "nightly"
+	assert.Nil(config.Validate())
+	config.RunMutationDiffer = false
+	assert.NotNil(config.Validate())
+	config.RunMutationDiffer = true
+	config.OldSourceCheckpointFileName = ""
+	config.OldTargetCheckpointFileName = ""
+	config.Resume = true
+	assert.Nil(config.Validate())
+
+	config = DefaultConfig()
+	config.MutationDifferMaxDuration = 3600
+	assert.Nil(config.Validate())
+	config.RunMutationDiffer = false
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.DiffKeysDir = "fileDiff/unverifiedDiffKeys"
+	assert.NotNil(config.Validate())
+	config.RunFileDiffer = false
+	assert.Nil(config.Validate())
+	config.RunMutationDiffer = false
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.KeyPrefix = "user_"
+	config.KeyRange = "user_1000..user_2000"
+	assert.Nil(config.Validate())
+	assert.True(config.keyRange().Contains([]byte("user_1500")))
+	assert.False(config.keyRange().Contains([]byte("user_2500")))
+	config.KeyRange = "user_1000.."
+	assert.Nil(config.Validate())
+	assert.True(config.keyRange().Contains([]byte("user_2500")))
+	config.KeyRange = "user_1000"
+	assert.NotNil(config.Validate())
+	config.KeyRange = "user_2000..user_1000"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.DataStore = "pebble"
+	assert.NotNil(config.Validate())
+	config.DataStore = base.DataStoreBadger
+	assert.Nil(config.Validate())
+	config.InMemory = true
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.InMemory = true
+	config.StreamingDiff = true
+	assert.Nil(config.Validate())
+	config.Resume = true
+	assert.NotNil(config.Validate())
+	config.Resume = false
+	config.OldSourceCheckpointFileName = "checkpoint"
+	assert.NotNil(config.Validate())
+	config.OldSourceCheckpointFileName = ""
+	config.OldTargetCheckpointFileName = "checkpoint"
+	assert.NotNil(config.Validate())
+	config.OldTargetCheckpointFileName = ""
+	config.CompleteBySeqno = false
+	config.CompleteByDuration = 10
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.SourceFileDir = "s3://bucket/source"
+	config.TargetFileDir = "gs://bucket/target"
+	assert.Nil(config.Validate())
+	config.Resume = true
+	assert.NotNil(config.Validate())
+	config.Resume = false
+	config.FileDifferDir = "s3://bucket/fileDiff"
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.VbucketRangeStart = 512
+	assert.Nil(config.Validate())
+	assert.Equal(base.VbucketRange{Start: 512, End: 1023}, config.vbucketRange())
+	config.VbucketRangeEnd = 1024
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.TotalNodes = 3
+	config.NodeIndex = 2
+	assert.Nil(config.Validate())
+	assert.Equal(base.VbucketRange{Start: 682, End: 1023}, config.vbucketRange())
+	config.NodeIndex = 3
+	assert.NotNil(config.Validate())
+	config.NodeIndex = 0
+	config.VbucketRangeEnd = 10
+	assert.NotNil(config.Validate())
+
+	config = DefaultConfig()
+	config.HashAlgorithm = base.HashAlgorithmNone
+	assert.NotNil(config.Validate())
+	config.HashAlgorithm = base.HashAlgorithmXxhash64
+	config.KeyOnly = true
+	assert.Nil(config.Validate())
+	assert.Equal(base.HashAlgorithmNone, config.dataFileHashAlgorithm())
+	config.CompareType = base.MutationCompareTypeBodyOnly
+	assert.NotNil(config.Validate())
+	config.CompareType = base.MutationCompareTypeMetadata
+	config.CompareXattrs = true
+	assert.NotNil(config.Validate())
+}
@@ -0,0 +1,2120 @@
+// Copyright (c) 2018 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/dashboard"
+	"xdcrDiffer/dcp"
+	"xdcrDiffer/differ"
+	fdp "xdcrDiffer/fileDescriptorPool"
+	"xdcrDiffer/filterPool"
+	"xdcrDiffer/objectStore"
+	"xdcrDiffer/status"
+	"xdcrDiffer/utils"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	xdcrParts "github.com/couchbase/goxdcr/base/filter"
+	xdcrLog "github.com/couchbase/goxdcr/log"
+	"github.com/couchbase/goxdcr/metadata"
+	"github.com/couchbase/goxdcr/metadata_svc"
+	"github.com/couchbase/goxdcr/service_def"
+	service_def_mock "github.com/couchbase/goxdcr/service_def/mocks"
+	"github.com/couchbase/goxdcr/service_impl"
+	"github.com/couchbase/goxdcr/streamApiWatcher"
+	xdcrUtils "github.com/couchbase/goxdcr/utils"
+	"github.com/stretchr/testify/mock"
+)
+
+type diffToolStateType int
+
+const (
+	StateInitial    diffToolStateType = iota
+	StateDcpStarted diffToolStateType = iota
+	StateFinal      diffToolStateType = iota
+)
+
+// Phases of the run, as reported by the status server
+const (
+	PhaseInitializing   = "initializing"
+	PhaseDataGeneration = "dataGeneration"
+	PhaseFileDiff       = "fileDiff"
+	PhaseMutationDiff   = "mutationDiff"
+	PhaseDone           = "done"
+)
+
+type difftoolState struct {
+	state diffToolStateType
+	phase string
+	mtx   sync.Mutex
+}
+
+type xdcrDiffTool struct {
+	config *Config
+
+	utils                   xdcrUtils.UtilsIface
+	metadataSvc             service_def.MetadataSvc
+	remoteClusterSvc        service_def.RemoteClusterSvc
+	replicationSpecSvc      service_def.ReplicationSpecSvc
+	collectionsManifestsSvc service_def.CollectionsManifestSvc
+	logger                  *xdcrLog.CommonLogger
+
+	xdcrTopologySvc service_def.XDCRCompTopologySvc
+
+	selfRef             *metadata.RemoteClusterReference
+	selfRefPopulated    uint32
+	specifiedRef        *metadata.RemoteClusterReference
+	specifiedSpec       *metadata.ReplicationSpecification
+	filter              xdcrParts.Filter
+	selfDefaultPoolInfo map[string]interface{}
+	selfPoolsNodes      map[string]interface{}
+
+	srcCapabilities  metadata.Capability
+	tgtCapabilities  metadata.Capability
+	srcClusterCompat int
+
+	srcBucketManifest *metadata.CollectionsManifest
+	tgtBucketManifest *metadata.CollectionsManifest
+
+	// If non-empty, just stream these collection IDs from each side's DCP
+	srcCollectionIds []uint32
+	tgtCollectionIds []uint32
+	// Logically there should only be 1-1 mapping, but make this flexible just in case
+	srcToTgtColIdsMap map[uint32][]uint32
+
+	// For collections migration mode, each filter should cause one or more target collection IDs
+	colFilterToTgtColIdsMap map[string][]uint32
+	// Each filter string above is translated into a consistent ordered list below. The *index* of each filter
+	// string will then be used for the remainder of the differ protocol, and used to determine if a source mutation
+	// has passed a certain filter or not
+	colFilterOrderedKeys        []string
+	colFilterOrderedTargetNs    []*xdcrBase.CollectionNamespace
+	colFilterOrderedTargetColId []uint32
+
+	// Used for migration mapping
+	migrationMapping  metadata.CollectionNamespaceMapping
+	duplicatedMapping differ.DuplicatedHintMap
+
+	sourceDcpDriver *dcp.DcpDriver
+	targetDcpDriver *dcp.DcpDriver
+	// Set only when running with the inMemory option
+	memoryDiffer *differ.MemoryDiffer
+	// Set only when the records are kept in stores instead of data files
+	sourceStore *differ.KVStore
+	targetStore *differ.KVStore
+	// Set only when running with the streamingDiff option. Receives the result of the file differ
+	streamingDiffErrChan chan error
+	// Shared by data generation and the file differ. nil if numberOfFileDesc is 0
+	fileDescPool *fdp.FdPool
+
+	// Optional live terminal dashboard; nil if not enabled
+	dashboard *dashboard.Dashboard
+	// Optional status server; nil if not enabled
+	statusServer *status.Server
+
+	curState difftoolState
+	// Manifest of the run, updated as each phase starts. nil for dry runs
+	manifest *RunManifest
+	// Whether the context was canceled while streaming, which only ends data generation early
+	streamingCanceled bool
+	// Context of the differs. Only canceled along with the context of the run if that is not canceled while streaming
+	diffCtx    context.Context
+	cancelDiff context.CancelFunc
+	// Closed once monitorContext() has handled the cancellation of the context
+	contextHandled chan bool
+
+	// Totals of the differs that have been run
+	fileDiffSummary     *differ.FileDiffSummary
+	mutationDiffSummary *differ.MutationDiffSummary
+	// When the mutation differ phase has to stop by, zero if mutationDifferMaxDuration is not set
+	mutationDifferDeadline time.Time
+	// Key the data files and the diff outputs are encrypted with, nil to write them in plaintext
+	encryptionKey []byte
+	// Where the previous convergence attempt wrote the keys that remain, for the next attempt to verify
+	convergenceDiffKeysDir string
+
+	legacyMode bool
+	// Identifies the run in the results written to outputSinkBucket, unless outputSinkRunId is given
+	startTime time.Time
+}
+
+func newDiffTool(ctx context.Context, config *Config) (*xdcrDiffTool, error) {
+	var err error
+	legacyMode := config.legacyMode()
+	difftool := newXdcrDiffTool(config)
+
+	if !legacyMode {
+		xdcrTopologyMock, uiLogSvcMock, err := difftool.setupReplicationSpecSvc()
+		if err != nil {
+			return nil, err
+		}
+
+		err = difftool.retrieveReplicationSpecInfo()
+		if err != nil {
+			return nil, err
+		}
+
+		checkpointSvcMock := &service_def_mock.CheckpointsService{}
+		manifestsSvcMock := &service_def_mock.ManifestsService{}
+		manifestsSvcMock.On("GetSourceManifests", mock.Anything).Return(nil, service_def.MetadataNotFoundErr)
+		manifestsSvcMock.On("GetTargetManifests", mock.Anything).Return(nil, service_def.MetadataNotFoundErr)
+
+		securitySvc := &service_def_mock.SecuritySvc{}
+		setupSecuritySvcMock(securitySvc)
+		err = setupMyKVNodes(xdcrTopologyMock, difftool)
+		if err != nil {
+			return nil, err
+		}
+
+		bucketTopologySvc, err := service_impl.NewBucketTopologyService(xdcrTopologyMock, difftool.remoteClusterSvc,
+			difftool.utils, xdcrBase.TopologyChangeCheckInterval, difftool.logger.LoggerContext(),
+			difftool.replicationSpecSvc, xdcrBase.HealthCheckInterval, securitySvc, streamApiWatcher.GetStreamApiWatcher)
+
+		difftool.collectionsManifestsSvc, err = metadata_svc.NewCollectionsManifestService(difftool.remoteClusterSvc,
+			difftool.replicationSpecSvc, uiLogSvcMock, difftool.logger.LoggerContext(), difftool.utils, checkpointSvcMock,
+			xdcrTopologyMock, bucketTopologySvc, manifestsSvcMock)
+		if err != nil {
+			return nil, err
+		}
+
+		difftool.logger.Infof("Source cluster supports collections: %v Target cluster supports collections: %v\n",
+			difftool.srcCapabilities.HasCollectionSupport(), difftool.tgtCapabilities.HasCollectionSupport())
+
+		if difftool.srcCapabilities.HasCollectionSupport() || difftool.tgtCapabilities.HasCollectionSupport() {
+			err = difftool.populateCollectionsPreReq()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// Need to do this outside of legacy mode
+		if err := difftool.retrieveClustersCapabilities(legacyMode, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	difftool.diffCtx, difftool.cancelDiff = context.WithCancel(context.Background())
+	difftool.contextHandled = make(chan bool)
+	go difftool.monitorContext(ctx)
+
+	return difftool, err
+}
+
+// Sets up the logger and the self reference, without connecting to anything
+func newXdcrDiffTool(config *Config) *xdcrDiffTool {
+	legacyMode := config.legacyMode()
+	difftool := &xdcrDiffTool{
+		config:                  config,
+		utils:                   xdcrUtils.NewUtilities(),
+		legacyMode:              legacyMode,
+		srcToTgtColIdsMap:       make(map[uint32][]uint32),
+		colFilterToTgtColIdsMap: map[string][]uint32{},
+		startTime:               time.Now(),
+	}
+	difftool.curState.phase = PhaseInitializing
+
+	// All the loggers share the default context, so that its level applies to every component
+	logCtx := xdcrLog.DefaultLoggerContext
+	difftool.logger = xdcrLog.NewLogger("xdcrDiffTool", xdcrLog.DefaultLoggerContext)
+	if difftool.config.DebugLogLevel {
+		logCtx.SetLogLevel(xdcrLog.LogLevelDebug)
+	} else if difftool.config.LogLevel != "" {
+		logCtx.SetLogLevel(xdcrLogLevel(difftool.config.LogLevel))
+	} else if difftool.config.Dashboard {
+		// Keep the dashboard readable by only letting errors scroll past it
+		logCtx.SetLogLevel(xdcrLog.LogLevelError)
+	}
+
+	difftool.selfRef, _ = metadata.NewRemoteClusterReference("", base.SelfReferenceName, difftool.config.SourceUrl, difftool.config.SourceUsername, difftool.config.SourcePassword,
+		"", false, "", nil, nil, nil, nil)
+
+	return difftool
+}
+
+// Maps a validated base.LogLevels name to the goxdcr log level
+func xdcrLogLevel(level string) xdcrLog.LogLevel {
+	switch level {
+	case base.LogLevelDebug:
+		return xdcrLog.LogLevelDebug
+	case base.LogLevelWarn:
+		return xdcrLog.LogLevelWarn
+	case base.LogLevelError:
+		return xdcrLog.LogLevelError
+	default:
+		return xdcrLog.LogLevelInfo
+	}
+}
+
+// Reads the remote cluster reference and the replication specs from metakv
+// Returns the topology and UI log mocks, which the services set up afterwards are to share
+func (difftool *xdcrDiffTool) setupReplicationSpecSvc() (*service_def_mock.XDCRCompTopologySvc, *service_def_mock.UILogSvc, error) {
+	var err error
+	difftool.metadataSvc, err = metadata_svc.NewMetaKVMetadataSvc(nil, difftool.utils, true /*readOnly*/)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uiLogSvcMock := &service_def_mock.UILogSvc{}
+	uiLogSvcMock.On("Write", mock.Anything).Run(func(args mock.Arguments) { fmt.Printf("%v", args.Get(0).(string)) }).Return(nil)
+	xdcrTopologyMock := &service_def_mock.XDCRCompTopologySvc{}
+	xdcrTopologyMockSetupCb := func() {
+		setupXdcrToplogyMock(xdcrTopologyMock, difftool)
+	}
+	resolverSvcMock := &service_def_mock.ResolverSvcIface{}
+
+	replicationSettingSvc := metadata_svc.NewReplicationSettingsSvc(difftool.metadataSvc, nil, xdcrTopologyMock)
+
+	difftool.remoteClusterSvc, err = metadata_svc.NewRemoteClusterService(uiLogSvcMock, difftool.metadataSvc, xdcrTopologyMock,
+		xdcrLog.DefaultLoggerContext, difftool.utils)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = difftool.retrieveClustersCapabilities(false /*legacyMode*/, xdcrTopologyMockSetupCb); err != nil {
+		return nil, nil, err
+	}
+
+	difftool.replicationSpecSvc, err = metadata_svc.NewReplicationSpecService(uiLogSvcMock, difftool.remoteClusterSvc,
+		difftool.metadataSvc, xdcrTopologyMock, resolverSvcMock, difftool.logger.LoggerContext(), difftool.utils,
+		replicationSettingSvc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return xdcrTopologyMock, uiLogSvcMock, nil
+}
+
+func setupSecuritySvcMock(securitySvc *service_def_mock.SecuritySvc) {
+	securitySvc.On("IsClusterEncryptionLevelStrict").Return(false)
+}
+
+// This may be re-set up once self-reference is populated
+func setupXdcrToplogyMock(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
+	xdcrTopologyMock.On("IsMyClusterEnterprise").Return(true, nil)
+	xdcrTopologyMock.On("IsKVNode").Return(true, nil)
+	xdcrTopologyMock.On("IsMyClusterEncryptionLevelStrict").Return(false)
+	xdcrTopologyMock.On("MyClusterCompatibility").Return(diffTool.srcClusterCompat, nil)
+	setupTopologyMockCredentials(xdcrTopologyMock, diffTool)
+	setupTopologyMockConnectionString(xdcrTopologyMock, diffTool)
+}
+
+func setupMyKVNodes(topologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) error {
+	// As of XDCR v8, pools/nodes endpoint is gone so we need to do things the legacy way
+	nodesInfo := diffTool.selfPoolsNodes
+	if nodes, ok := nodesInfo[base.NodesKey]; !ok {
+		return fmt.Errorf("%v is not found from pools/nodes output", base.NodesKey)
+	} else if nodesList, ok := nodes.([]interface{}); !ok {
+		return fmt.Errorf("nodesList is not an interface list")
+	} else {
+		var found bool
+		for _, node := range nodesList {
+			nodeInfoMap, ok := node.(map[string]interface{})
+			if !ok {
+				// should never get here
+				return fmt.Errorf("node type is %v", reflect.TypeOf(node))
+			}
+			thisNode, ok := nodeInfoMap[xdcrBase.ThisNodeKey]
+			if ok {
+				thisNodeBool, ok := thisNode.(bool)
+				if !ok {
+					// should never get here
+					return fmt.Errorf("thisNode is %v", reflect.TypeOf(thisNode))
+				}
+				if thisNodeBool {
+					// found current node
+					found = true
+				}
+			}
+			if found {
+				ports := nodeInfoMap[xdcrBase.PortsKey]
+				portsMap := ports.(map[string]interface{})
+				directPort := portsMap[xdcrBase.DirectPortKey]
+				directPortFloat := directPort.(float64)
+				memcachedPort := uint16(directPortFloat)
+
+				hostAddr := nodeInfoMap[xdcrBase.HostNameKey]
+				hostAddrStr := hostAddr.(string)
+
+				hostName := xdcrBase.GetHostName(hostAddrStr)
+				memcachedAddr := xdcrBase.GetHostAddr(hostName, memcachedPort)
+				topologyMock.On("MyKVNodes").Return([]string{memcachedAddr}, nil)
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unable to set memcached port")
+		}
+	}
+	return nil
+}
+
+func setupTopologyMockConnectionString(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
+	connFunc := func() string {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			connStr, _ := diffTool.selfRef.MyConnectionStr()
+			return connStr
+		} else {
+			return ""
+		}
+	}
+
+	errFunc := func() error {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return nil
+		} else {
+			return fmt.Errorf("Not initialized yet")
+		}
+	}
+
+	xdcrTopologyMock.On("MyConnectionStr").Return(connFunc, errFunc)
+}
+
+func setupTopologyMockCredentials(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
+	getUserName := func() string {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.UserName()
+		} else {
+			return ""
+		}
+	}
+	getPw := func() string {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.Password()
+		} else {
+			return ""
+		}
+	}
+	getAuthMech := func() xdcrBase.HttpAuthMech {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.HttpAuthMech()
+		} else {
+			return xdcrBase.HttpAuthMechPlain
+		}
+	}
+	getCert := func() []byte {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.Certificates()
+		} else {
+			return nil
+		}
+	}
+	getSanCert := func() bool {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.SANInCertificate()
+		} else {
+			return false
+		}
+	}
+	getClientCert := func() []byte {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.ClientCertificate()
+		} else {
+			return nil
+		}
+	}
+	getClientKey := func() []byte {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return diffTool.selfRef.ClientKey()
+		} else {
+			return nil
+		}
+	}
+	getErr := func() error {
+		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
+			return nil
+		} else {
+			return fmt.Errorf("Not initialized yet")
+		}
+	}
+	xdcrTopologyMock.On("MyCredentials").Return(getUserName, getPw, getAuthMech, getCert, getSanCert, getClientCert, getClientKey, getErr)
+}
+
+func (difftool *xdcrDiffTool) createFilter() error {
+	expr, err := difftool.filterExpression()
+	if err != nil {
+		return err
+	}
+	if len(expr) > 0 {
+		difftool.logger.Infof("Found filtering expression: %v\n", expr)
+	}
+
+	filterMode := difftool.specifiedSpec.Settings.GetExpDelMode()
+	filter, err := filterPool.NewFilterPool(difftool.config.NumOfFiltersInFilterPool, expr, difftool.utils, filterMode.IsSkipReplicateUncommittedTxnSet())
+	difftool.filter = filter
+	return err
+}
+
+// The filter expression of the replication, upgraded from a key only filter if need be. Empty if it has none
+func (difftool *xdcrDiffTool) filterExpression() (string, error) {
+	expr, ok := difftool.specifiedSpec.Settings.Values[metadata.FilterExpressionKey].(string)
+	if !ok || len(expr) == 0 {
+		return "", nil
+	}
+	filterVersion, ok := difftool.specifiedSpec.Settings.Values[metadata.FilterVersionKey].(xdcrBase.FilterVersionType)
+	if !ok {
+		return "", fmt.Errorf("Unable to find filter version given filter expression %v\nsettings:%v\n", expr, difftool.specifiedSpec.Settings)
+	}
+	if filterVersion == xdcrBase.FilterVersionKeyOnly {
+		expr = xdcrBase.UpgradeFilter(expr)
+	}
+	return expr, nil
+}
+
+// Filter expressions refer to the xattrs of a doc as META().xattrs
+var filterXattrsRegex = regexp.MustCompile(`(?i)META\(\s*\)\.xattrs`)
+
+func filterExpressionUsesXattrs(expr string) bool {
+	return filterXattrsRegex.MatchString(expr)
+}
+
+// A permission the tool needs on a bucket, and the role that grants it
+type bucketPermission struct {
+	// Formatted with the bucket name
+	permission string
+	role       string
+}
+
+var dcpReadPermission = bucketPermission{"cluster.bucket[%v].data.dcp!read", "data_dcp_reader"}
+var docsReadPermission = bucketPermission{"cluster.bucket[%v].data.docs!read", "data_reader"}
+
+// Permissions the tool needs on each bucket, to stream it and to fetch docs from it
+var preflightPermissions = []bucketPermission{dcpReadPermission, docsReadPermission}
+
+// Verifies that the bucket exists and that the reference credentials have the permissions needed on it
+func (difftool *xdcrDiffTool) checkBucketAccess(clusterName string, ref *metadata.RemoteClusterReference, bucketName string) error {
+	connStr, err := ref.MyConnectionStr()
+	if err != nil {
+		return fmt.Errorf("%v cluster: unable to get connection string: %v", clusterName, err)
+	}
+
+	_, _, _, _, _, _, err = difftool.utils.BucketValidationInfo(connStr, bucketName, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	if err != nil {
+		return fmt.Errorf("%v cluster %v: unable to validate bucket %v: %v", clusterName, connStr, bucketName, err)
+	}
+
+	missing, err := difftool.missingBucketPermissions(clusterName, connStr, ref, bucketName, preflightPermissions)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%v cluster %v: user %v is missing permissions %v", clusterName, connStr, ref.UserName(), strings.Join(missing, ", "))
+	}
+
+	fmt.Printf("%v cluster %v: bucket %v exists and %v has the DCP and document read permissions on it\n", clusterName, connStr, bucketName, ref.UserName())
+	return nil
+}
+
+// Returns the permissions on the bucket that the reference credentials do not have, each along with the role that grants it
+func (difftool *xdcrDiffTool) missingBucketPermissions(clusterName, connStr string, ref *metadata.RemoteClusterReference, bucketName string,
+	needed []bucketPermission) ([]string, error) {
+	permissions := make([]string, len(needed))
+	for i, permission := range needed {
+		permissions[i] = fmt.Sprintf(permission.permission, bucketName)
+	}
+	missing, err := difftool.missingPermissions(clusterName, connStr, ref, permissions)
+	if err != nil {
+		return nil, err
+	}
+	var described []string
+	for i, permission := range permissions {
+		for _, missingPermission := range missing {
+			if missingPermission == permission {
+				described = append(described, fmt.Sprintf("%v, granted by role %v[%v]", permission, needed[i].role, bucketName))
+			}
+		}
+	}
+	return described, nil
+}
+
+// Fails fast when the credentials of either cluster lack a permission that the phases to run need, which would
+// otherwise only show up as DCP streams or fetches timing out once they have started. The permissions are only
+// logged as unverified if the cluster cannot be asked about them
+func (difftool *xdcrDiffTool) verifyPrivileges() error {
+	var needed []bucketPermission
+	if difftool.config.RunDataGeneration {
+		needed = append(needed, dcpReadPermission)
+	}
+	if difftool.config.RunMutationDiffer {
+		needed = append(needed, docsReadPermission)
+	}
+	if len(needed) == 0 {
+		return nil
+	}
+
+	var errs []string
+	for _, cluster := range []struct {
+		clusterName string
+		ref         *metadata.RemoteClusterReference
+		bucketName  string
+	}{
+		{"source", difftool.selfRef, difftool.config.SourceBucketName},
+		{"target", difftool.specifiedRef, difftool.config.TargetBucketName},
+	} {
+		if cluster.ref == nil {
+			continue
+		}
+		connStr, err := cluster.ref.MyConnectionStr()
+		if err != nil {
+			return fmt.Errorf("%v cluster: unable to get connection string: %v", cluster.clusterName, err)
+		}
+		missing, err := difftool.missingBucketPermissions(cluster.clusterName, connStr, cluster.ref, cluster.bucketName, needed)
+		if err != nil {
+			difftool.logger.Warnf("Unable to verify the privileges: %v\n", err)
+			continue
+		}
+		if len(missing) > 0 {
+			errs = append(errs, fmt.Sprintf("%v cluster %v: user %v is missing permissions %v", cluster.clusterName, connStr,
+				cluster.ref.UserName(), strings.Join(missing, ", ")))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Returns the permissions that the reference credentials do not have
+func (difftool *xdcrDiffTool) missingPermissions(clusterName, connStr string, ref *metadata.RemoteClusterReference, permissions []string) ([]string, error) {
+	permissionsMap := make(map[string]bool)
+	err, statusCode := difftool.utils.QueryRestApiWithAuth(connStr, base.CheckPermissionsPath, false, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), xdcrBase.MethodPost,
+		xdcrBase.DefaultContentType, []byte(strings.Join(permissions, ",")), 0, &permissionsMap, nil, false, difftool.logger)
+	if err != nil {
+		return nil, fmt.Errorf("%v cluster %v: unable to check permissions of %v, status code %v: %v", clusterName, connStr, ref.UserName(), statusCode, err)
+	}
+	var missing []string
+	for _, permission := range permissions {
+		if !permissionsMap[permission] {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// Used by dryRun to validate everything that would otherwise only fail once data generation has started
+func (difftool *xdcrDiffTool) runPreflightChecks() error {
+	if difftool.specifiedRef == nil || difftool.specifiedSpec == nil {
+		return fmt.Errorf("unable to find the remote cluster reference or the replication to diff")
+	}
+
+	var errs []string
+	if err := difftool.checkBucketAccess("source", difftool.selfRef, difftool.config.SourceBucketName); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := difftool.checkBucketAccess("target", difftool.specifiedRef, difftool.config.TargetBucketName); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	fmt.Printf("Derived configuration:\n")
+	fmt.Printf("  Legacy mode: %v\n", difftool.legacyMode)
+	fmt.Printf("  Remote cluster reference: %v\n", difftool.specifiedRef.Name())
+	fmt.Printf("  Replication: %v\n", difftool.specifiedSpec.Id)
+	if expr, ok := difftool.specifiedSpec.Settings.Values[metadata.FilterExpressionKey].(string); ok && len(expr) > 0 {
+		fmt.Printf("  Filter expression: %v\n", expr)
+	}
+	fmt.Printf("  Source collections support: %v Target collections support: %v\n",
+		difftool.srcCapabilities.HasCollectionSupport(), difftool.tgtCapabilities.HasCollectionSupport())
+	if len(difftool.srcToTgtColIdsMap) > 0 {
+		fmt.Printf("  Source to target collection IDs: %v\n", difftool.srcToTgtColIdsMap)
+	}
+	fmt.Printf("  Run data generation: %v File differ: %v Mutation differ: %v\n",
+		difftool.config.RunDataGeneration, difftool.config.RunFileDiffer, difftool.config.RunMutationDiffer)
+	fmt.Printf("  Compare type: %v\n", difftool.config.CompareType)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// The DCP drivers stop, with their data files flushed and a checkpoint saved, once ctx is canceled
+func (difftool *xdcrDiffTool) generateDataFiles(ctx context.Context) error {
+	difftool.logger.Infof("GenerateDataFiles routine started\n")
+	defer difftool.logger.Infof("GenerateDataFiles routine completed\n")
+
+	errChan := make(chan error, 1)
+	waitGroup := &sync.WaitGroup{}
+
+	if vbRange := difftool.config.vbucketRange(); !vbRange.IsAll() {
+		difftool.logger.Infof("Streaming vbuckets %v only\n", vbRange)
+	}
+	if difftool.config.DeltaDiff {
+		if difftool.config.OldSourceCheckpointFileName == "" {
+			difftool.logger.Infof("No checkpoint to diff the changes since. Diffing the whole buckets\n")
+		} else {
+			difftool.logger.Infof("Only recording the mutations since checkpoints %v and %v. Item counts and diffs cover these mutations\n",
+				difftool.config.OldSourceCheckpointFileName, difftool.config.OldTargetCheckpointFileName)
+		}
+	}
+	if keyRange := difftool.config.keyRange(); !keyRange.IsAll() {
+		difftool.logger.Infof("Recording keys with %v only\n", keyRange)
+	}
+	if difftool.config.SamplePercent < 100 {
+		difftool.logger.Infof("Recording a %v%% sample of keys only. Item counts and diffs cover the sampled keys\n", difftool.config.SamplePercent)
+	}
+	if !difftool.config.FilterTarget {
+		difftool.logger.Infof("Not applying the replication filter to the target. Target docs the filter excludes are reported as missing from source by the file differ\n")
+	}
+	if difftool.config.IgnoreSyncGatewayMetadata {
+		difftool.logger.Infof("Stripping Sync Gateway xattrs %v before hashing\n", base.SyncGatewayXattrs)
+	}
+
+	var fileDescPool fdp.FdPoolIface
+	if pool := difftool.getFileDescPool(0); pool != nil {
+		fileDescPool = pool
+	}
+
+	if err := difftool.createFilter(); err != nil {
+		return fmt.Errorf("Error creating filter: %v", err)
+	}
+	targetFilter := difftool.filter
+	if !difftool.config.FilterTarget {
+		targetFilter = nil
+	}
+
+	checkpointStore, err := difftool.createCheckpointStore()
+	if err != nil {
+		return fmt.Errorf("Error creating checkpoint store: %v", err)
+	}
+	if bucketStore, ok := checkpointStore.(*dcp.BucketCheckpointStore); ok {
+		defer bucketStore.Close()
+	}
+
+	var sourceSink, targetSink dcp.MutationSink
+	if difftool.config.InMemory {
+		if difftool.colFilterOrderedKeys != nil {
+			return fmt.Errorf("inMemory option is not supported for replications in migration mode")
+		}
+		// The output is written into fileDifferDir, and with streamingDiff while still streaming
+		err = os.RemoveAll(difftool.config.FileDifferDir)
+		if err != nil {
+			difftool.logger.Errorf("Error removing fileDifferDir: %v\n", err)
+		}
+		err = os.MkdirAll(difftool.config.FileDifferDir, 0777)
+		if err != nil {
+			return fmt.Errorf("Error mkdir fileDifferDir: %v\n", err)
+		}
+		difftool.memoryDiffer = differ.NewMemoryDiffer(difftool.config.FileDifferDir, base.DiffKeysFileName, difftool.srcToTgtColIdsMap)
+		difftool.memoryDiffer.SetVbucketRange(difftool.config.vbucketRange())
+		difftool.memoryDiffer.SetEncryptionKey(difftool.encryptionKey)
+		if difftool.config.FileDifferMemoryBudgetMB > 0 {
+			spillDir := filepath.Join(difftool.config.FileDifferDir, base.SpillDirName)
+			err = os.MkdirAll(spillDir, 0777)
+			if err != nil {
+				return fmt.Errorf("Error mkdir %v: %v", spillDir, err)
+			}
+			difftool.memoryDiffer.SetMemoryBudget(int64(difftool.config.FileDifferMemoryBudgetMB)*1024*1024, spillDir)
+		}
+		sourceSink = difftool.memoryDiffer
+		targetSink = difftool.memoryDiffer
+	}
+	if difftool.sourceStore != nil {
+		for _, store := range []*differ.KVStore{difftool.sourceStore, difftool.targetStore} {
+			if err := store.CheckHashAlgorithm(difftool.config.dataFileHashAlgorithm()); err != nil {
+				return err
+			}
+		}
+		sourceSink = difftool.sourceStore
+		targetSink = difftool.targetStore
+		// The records are only readable once flushed
+		defer difftool.flushKVStores()
+	}
+
+	// The data files are only on local disk when not diffing in memory and not uploading them to object storage
+	localDataFiles := !difftool.config.InMemory && !difftool.config.dataFilesInObjectStore()
+	var diskSpaceCheck dcp.DiskSpaceCheck
+	if localDataFiles && difftool.config.CheckDiskSpace {
+		checker, err := difftool.newDiskSpaceChecker()
+		if err != nil {
+			return err
+		}
+		diskSpaceCheck = checker.check
+	}
+	if localDataFiles && difftool.config.MaxDiskGB > 0 {
+		quotaFinChan := make(chan bool)
+		defer close(quotaFinChan)
+		go difftool.enforceDiskQuota(errChan, quotaFinChan)
+	}
+
+	// Parts of the data files are staged locally until they are large enough to be uploaded
+	var uploadStagingDir string
+	if difftool.config.dataFilesInObjectStore() {
+		uploadStagingDir = filepath.Join(difftool.config.FileDifferDir, base.UploadStagingDirName)
+		// Left over if an earlier run was killed while uploading
+		err = os.RemoveAll(uploadStagingDir)
+		if err != nil {
+			return fmt.Errorf("Error removing %v: %v", uploadStagingDir, err)
+		}
+		err = os.MkdirAll(uploadStagingDir, 0777)
+		if err != nil {
+			return fmt.Errorf("Error mkdir %v: %v", uploadStagingDir, err)
+		}
+	}
+
+	sourceOptions := difftool.dcpDriverOptions(fileDescPool, checkpointStore, diskSpaceCheck)
+	sourceOptions.Name = base.SourceClusterName
+	sourceOptions.Url = difftool.config.SourceUrl
+	sourceOptions.BucketName = difftool.specifiedSpec.SourceBucketName
+	sourceOptions.Ref = difftool.selfRef
+	sourceOptions.FileDir = difftool.config.SourceFileDir
+	sourceOptions.OldCheckpointFileName = difftool.config.OldSourceCheckpointFileName
+	sourceOptions.NumberOfClients = int(difftool.config.NumberOfSourceDcpClients)
+	sourceOptions.NumberOfWorkers = int(difftool.config.NumberOfWorkersPerSourceDcpClient)
+	sourceOptions.DcpHandlerChanSize = int(difftool.config.SourceDcpHandlerChanSize)
+	sourceOptions.Filter = difftool.filter
+	sourceOptions.Capabilities = difftool.srcCapabilities
+	sourceOptions.CollectionIds = difftool.srcCollectionIds
+	sourceOptions.DcpCompression = difftool.config.SourceDcpCompression
+	sourceOptions.MutationSink = sourceSink
+	sourceOptions.KvPort = uint16(difftool.config.SourceKvPort)
+	sourceOptions.UploadStagingDir = uploadStagingDir
+	difftool.sourceDcpDriver = startDcpDriver(ctx, difftool.logger, sourceOptions, errChan, waitGroup)
+
+	delayDurationBetweenSourceAndTarget := time.Duration(difftool.config.DelayBetweenSourceAndTarget) * time.Second
+	difftool.logger.Infof("Waiting for %v before starting target dcp clients\n", delayDurationBetweenSourceAndTarget)
+	select {
+	case <-time.After(delayDurationBetweenSourceAndTarget):
+	case <-ctx.Done():
+	}
+
+	difftool.logger.Infof("Starting target dcp clients\n")
+	targetOptions := difftool.dcpDriverOptions(fileDescPool, checkpointStore, diskSpaceCheck)
+	targetOptions.Name = base.TargetClusterName
+	targetOptions.Url = difftool.specifiedRef.HostName_
+	targetOptions.BucketName = difftool.specifiedSpec.TargetBucketName
+	targetOptions.Ref = difftool.specifiedRef
+	targetOptions.FileDir = difftool.config.TargetFileDir
+	targetOptions.OldCheckpointFileName = difftool.config.OldTargetCheckpointFileName
+	targetOptions.NumberOfClients = int(difftool.config.NumberOfTargetDcpClients)
+	targetOptions.NumberOfWorkers = int(difftool.config.NumberOfWorkersPerTargetDcpClient)
+	targetOptions.DcpHandlerChanSize = int(difftool.config.TargetDcpHandlerChanSize)
+	targetOptions.Filter = targetFilter
+	targetOptions.Capabilities = difftool.tgtCapabilities
+	targetOptions.CollectionIds = difftool.tgtCollectionIds
+	targetOptions.DcpCompression = difftool.config.TargetDcpCompression
+	targetOptions.MutationSink = targetSink
+	targetOptions.KvPort = uint16(difftool.config.TargetKvPort)
+	targetOptions.UploadStagingDir = uploadStagingDir
+	difftool.targetDcpDriver = startDcpDriver(ctx, difftool.logger, targetOptions, errChan, waitGroup)
+
+	difftool.curState.mtx.Lock()
+	difftool.curState.state = StateDcpStarted
+	difftool.curState.mtx.Unlock()
+
+	for _, driver := range []*dcp.DcpDriver{difftool.sourceDcpDriver, difftool.targetDcpDriver} {
+		difftool.addStage(driver.Name+" DCP", driver.Progress)
+		if difftool.dashboard != nil {
+			difftool.dashboard.AddThroughput(driver.Name+" DCP", driver.NumReceived)
+			difftool.dashboard.AddVbHeatmap(driver.Name, driver.VbCompletionStates)
+		}
+		if difftool.statusServer != nil {
+			difftool.statusServer.AddCluster(driver.Name, driver.VbCompletionStates, driver.VbSeqnos)
+		}
+	}
+
+	if difftool.config.StreamingDiff {
+		dataGenDoneChan := make(chan bool)
+		defer close(dataGenDoneChan)
+		difftool.streamingDiffErrChan = make(chan error, 1)
+		srcVbsReady := difftool.sourceDcpDriver.VbFlushedChan()
+		tgtVbsReady := difftool.targetDcpDriver.VbFlushedChan()
+		go func() {
+			if difftool.memoryDiffer != nil {
+				difftool.streamingDiffErrChan <- difftool.diffInMemory(srcVbsReady, tgtVbsReady, dataGenDoneChan)
+			} else {
+				difftool.streamingDiffErrChan <- difftool.diffDataFiles(srcVbsReady, tgtVbsReady, dataGenDoneChan)
+			}
+		}()
+	}
+
+	if difftool.config.CompleteBySeqno {
+		err = difftool.waitForCompletion(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, waitGroup)
+	} else {
+		err = difftool.waitForDuration(ctx, difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, time.Duration(difftool.config.CompleteByDuration)*time.Second, delayDurationBetweenSourceAndTarget)
+	}
+
+	difftool.curState.mtx.Lock()
+	difftool.curState.state = StateFinal
+	difftool.curState.mtx.Unlock()
+	return err
+}
+
+// Opens the stores of the records in sourceFileDir and targetFileDir, unless the records are kept in data files
+func (difftool *xdcrDiffTool) openKVStores() error {
+	if difftool.config.DataStore == base.DataStoreFiles {
+		return nil
+	}
+	var err error
+	difftool.sourceStore, err = differ.OpenKVStore(difftool.config.DataStore, difftool.config.SourceFileDir)
+	if err != nil {
+		return fmt.Errorf("Error opening %v store in %v: %v", difftool.config.DataStore, difftool.config.SourceFileDir, err)
+	}
+	difftool.targetStore, err = differ.OpenKVStore(difftool.config.DataStore, difftool.config.TargetFileDir)
+	if err != nil {
+		difftool.sourceStore.Close()
+		difftool.sourceStore = nil
+		return fmt.Errorf("Error opening %v store in %v: %v", difftool.config.DataStore, difftool.config.TargetFileDir, err)
+	}
+	return nil
+}
+
+func (difftool *xdcrDiffTool) flushKVStores() {
+	for _, store := range []*differ.KVStore{difftool.sourceStore, difftool.targetStore} {
+		if err := store.Flush(); err != nil {
+			difftool.logger.Errorf("Error flushing store: %v\n", err)
+		}
+	}
+}
+
+func (difftool *xdcrDiffTool) closeKVStores() {
+	if difftool.sourceStore == nil {
+		return
+	}
+	for _, store := range []*differ.KVStore{difftool.sourceStore, difftool.targetStore} {
+		if err := store.Close(); err != nil {
+			difftool.logger.Errorf("Error closing store: %v\n", err)
+		}
+	}
+}
+
+// Checkpoints are kept in checkpointFileDir unless checkpointBucket is given
+func (difftool *xdcrDiffTool) createCheckpointStore() (dcp.CheckpointStore, error) {
+	if difftool.config.CheckpointBucket == "" {
+		return &dcp.FileCheckpointStore{}, nil
+	}
+
+	var scopeName, collectionName string
+	if difftool.config.CheckpointCollection != "" {
+		parts := strings.Split(difftool.config.CheckpointCollection, xdcrBase.ScopeCollectionDelimiter)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid checkpointCollection %v, expected scope%vcollection", difftool.config.CheckpointCollection, xdcrBase.ScopeCollectionDelimiter)
+		}
+		scopeName, collectionName = parts[0], parts[1]
+	}
+	runId := difftool.config.CheckpointRunId
+	if runId == "" {
+		runId = difftool.specifiedSpec.Id
+	}
+
+	difftool.logger.Infof("Keeping checkpoints in bucket %v collection %v with run ID %v\n", difftool.config.CheckpointBucket, difftool.config.CheckpointCollection, runId)
+	return dcp.NewBucketCheckpointStore(difftool.selfRef, uint16(difftool.config.SourceKvPort), difftool.config.CheckpointBucket, scopeName,
+		collectionName, runId, time.Duration(difftool.config.BucketOpTimeout)*time.Second)
+}
+
+// When the ready channels are given, vbuckets are diffed as soon as both sides have reported them as ready
+func (difftool *xdcrDiffTool) diffDataFiles(srcVbsReady, tgtVbsReady <-chan uint16, dataGenDoneChan <-chan bool) error {
+	difftool.logger.Infof("DiffDataFiles routine started\n")
+	defer difftool.logger.Infof("DiffDataFiles routine completed\n")
+
+	err := os.RemoveAll(difftool.config.FileDifferDir)
+	if err != nil {
+		difftool.logger.Errorf("Error removing fileDifferDir: %v\n", err)
+	}
+	err = os.MkdirAll(difftool.config.FileDifferDir, 0777)
+	if err != nil {
+		return fmt.Errorf("Error mkdir fileDifferDir: %v\n", err)
+	}
+
+	difftoolDriver := differ.NewDifferDriver(difftool.config.SourceFileDir, difftool.config.TargetFileDir, difftool.config.FileDifferDir,
+		base.DiffKeysFileName, int(difftool.config.NumberOfWorkersForFileDiffer), int(difftool.config.NumberOfBins),
+		0, difftool.srcToTgtColIdsMap, difftool.colFilterOrderedKeys, difftool.colFilterOrderedTargetColId)
+	// Each worker reads a source and a target file at a time. With streamingDiff, on top of what data generation uses
+	fileDescNeeded := 2 * difftool.config.NumberOfWorkersForFileDiffer
+	if srcVbsReady != nil && tgtVbsReady != nil {
+		fileDescNeeded += difftool.config.NumberOfFileDesc
+	}
+	difftoolDriver.SetFileDescPool(difftool.getFileDescPool(fileDescNeeded))
+	difftoolDriver.SetMemoryBudget(int64(difftool.config.FileDifferMemoryBudgetMB) * 1024 * 1024)
+	difftoolDriver.SetVbucketRange(difftool.config.vbucketRange())
+	difftoolDriver.SetEncryptionKey(difftool.encryptionKey)
+	if difftool.sourceStore != nil {
+		difftoolDriver.SetKVStores(difftool.sourceStore, difftool.targetStore)
+	}
+	difftool.addStage("File differ", difftoolDriver.Progress)
+	difftool.addCounter("File differ diff keys", difftoolDriver.NumSrcDiffKeys)
+	if srcVbsReady != nil && tgtVbsReady != nil {
+		err = difftoolDriver.RunStreaming(difftool.diffCtx, srcVbsReady, tgtVbsReady, dataGenDoneChan)
+	} else {
+		err = difftoolDriver.Run(difftool.diffCtx)
+	}
+	if err != nil {
+		difftool.logger.Errorf("Error from diffDataFiles = %v\n", err)
+	}
+	difftoolDriver.MapLock.RLock()
+	if difftool.colFilterOrderedKeys == nil {
+		difftool.logger.Infof("Source vb to item count map: %v", difftoolDriver.SrcVbItemCntMap)
+	}
+	difftool.logger.Infof("Target vb to item count map: %v", difftoolDriver.TgtVbItemCntMap)
+	difftoolDriver.MapLock.RUnlock()
+	if difftool.colFilterOrderedKeys == nil {
+		difftool.logger.Infof("Source bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.SourceItemCount, difftool.sourceDcpDriver.FilteredCount())
+	} else {
+		difftool.logger.Infof("Replication is in migration mode from the source bucket")
+	}
+	difftool.logger.Infof("Target bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.TargetItemCount, difftool.targetDcpDriver.FilteredCount())
+	if difftool.colFilterOrderedKeys == nil && difftoolDriver.SourceItemCount != difftoolDriver.TargetItemCount {
+		difftool.logger.Infof("Here are the vbuckets with different item counts:")
+		for vb, c1 := range difftoolDriver.SrcVbItemCntMap {
+			c2 := difftoolDriver.TgtVbItemCntMap[vb]
+			if c1 != c2 {
+				difftool.logger.Infof("vb:%v source count %v, target count %v", vb, c1, c2)
+			}
+		}
+	}
+	var sourceFiltered, targetFiltered int64
+	if difftool.sourceDcpDriver != nil {
+		sourceFiltered = difftool.sourceDcpDriver.FilteredCount()
+		counts, byCollection := difftool.logFilterCounts(difftool.sourceDcpDriver)
+		difftoolDriver.SetFilterCounts(true, counts, byCollection)
+		difftoolDriver.SetChangedVbuckets(true, difftool.logChangedVbuckets(difftool.sourceDcpDriver))
+	}
+	if difftool.targetDcpDriver != nil {
+		targetFiltered = difftool.targetDcpDriver.FilteredCount()
+		counts, byCollection := difftool.logFilterCounts(difftool.targetDcpDriver)
+		difftoolDriver.SetFilterCounts(false, counts, byCollection)
+		difftoolDriver.SetChangedVbuckets(false, difftool.logChangedVbuckets(difftool.targetDcpDriver))
+	}
+	difftoolDriver.SetFilteredCounts(sourceFiltered, targetFiltered)
+	difftool.logger.Infof("File differ summary: %v", &difftoolDriver.Summary)
+	difftool.fileDiffSummary = &difftoolDriver.Summary
+	if summaryErr := difftoolDriver.WriteSummary(); summaryErr != nil {
+		difftool.logger.Errorf("Error writing file differ summary. err=%v\n", summaryErr)
+	}
+	difftool.duplicatedMapping = difftoolDriver.DuplicatedHint
+	return err
+}
+
+// Logs what the replication filter did with the mutations of the cluster, in total and for each collection, so
+// that users can tell whether filtering explains the difference between the item counts of the clusters
+func (difftool *xdcrDiffTool) logFilterCounts(dcpDriver *dcp.DcpDriver) (*base.FilterCounts, map[uint32]*base.FilterCounts) {
+	counts, byCollection := dcpDriver.FilterCounts()
+	difftool.logger.Infof("%v replication filter: %v", dcpDriver.Name, counts)
+	colIds := make([]uint32, 0, len(byCollection))
+	for colId := range byCollection {
+		colIds = append(colIds, colId)
+	}
+	sort.Slice(colIds, func(i, j int) bool { return colIds[i] < colIds[j] })
+	for _, colId := range colIds {
+		difftool.logger.Infof("%v replication filter for collection ID %v: %v", dcpDriver.Name, colId, byCollection[colId])
+	}
+	return counts, byCollection
+}
+
+// Logs the vbuckets of the cluster that were changing during data generation, so that users can tell which diffs may
+// only be changes made during the capture
+func (difftool *xdcrDiffTool) logChangedVbuckets(dcpDriver *dcp.DcpDriver) map[uint16]uint64 {
+	changedVbs := dcpDriver.ChangedVbuckets()
+	if len(changedVbs) > 0 {
+		difftool.logger.Warnf("%v %v, diffs in vbuckets %v may be noise", dcpDriver.Name, base.DataChangingWarning, changedVbs)
+	}
+	return changedVbs
+}
+
+// Used in place of diffDataFiles when the DCP streams are diffed in memory
+// Like diffDataFiles, diffs each vbucket as it becomes ready on both clusters if srcVbsReady and tgtVbsReady are set
+func (difftool *xdcrDiffTool) diffInMemory(srcVbsReady, tgtVbsReady <-chan uint16, dataGenDoneChan <-chan bool) error {
+	difftool.logger.Infof("DiffInMemory routine started\n")
+	defer difftool.logger.Infof("DiffInMemory routine completed\n")
+
+	if difftool.memoryDiffer == nil {
+		return fmt.Errorf("in-memory data is not available since data generation was not run in memory")
+	}
+	defer os.RemoveAll(filepath.Join(difftool.config.FileDifferDir, base.SpillDirName))
+
+	difftool.addStage("In-memory differ", difftool.memoryDiffer.Progress)
+	difftool.addCounter("In-memory differ diffs", difftool.memoryDiffer.NumDiffs)
+	var err error
+	if srcVbsReady != nil && tgtVbsReady != nil {
+		err = difftool.memoryDiffer.RunStreaming(difftool.diffCtx, srcVbsReady, tgtVbsReady, dataGenDoneChan)
+	} else {
+		err = difftool.memoryDiffer.Run(difftool.diffCtx)
+	}
+	if err != nil {
+		difftool.logger.Errorf("Error from diffInMemory = %v\n", err)
+	}
+	difftool.logger.Infof("Source bucket item count including tombstones is %v (excluding %v filtered mutations)", difftool.memoryDiffer.SourceItemCount, difftool.sourceDcpDriver.FilteredCount())
+	difftool.logger.Infof("Target bucket item count including tombstones is %v (excluding %v filtered mutations)", difftool.memoryDiffer.TargetItemCount, difftool.targetDcpDriver.FilteredCount())
+	difftool.logFilterCounts(difftool.sourceDcpDriver)
+	difftool.logFilterCounts(difftool.targetDcpDriver)
+	difftool.logChangedVbuckets(difftool.sourceDcpDriver)
+	difftool.logChangedVbuckets(difftool.targetDcpDriver)
+	difftool.logger.Infof("In-memory diff found %v mismatched, %v missing from source and %v missing from target",
+		len(difftool.memoryDiffer.BothExistButMismatch), len(difftool.memoryDiffer.MissingFromSource), len(difftool.memoryDiffer.MissingFromTarget))
+	return err
+}
+
+func (difftool *xdcrDiffTool) runMutationDiffer() (*differ.MutationDiffer, error) {
+	difftool.logger.Infof("runMutationDiffer started with compareBody=%v\n", difftool.config.CompareType)
+	defer difftool.logger.Infof("runMutationDiffer completed\n")
+
+	// The manifest describes the run in progress, rather than the outputs of the previous one. The keys the previous
+	// convergence attempt left are the input of this one
+	keep := []string{base.RunManifestFileName}
+	if difftool.convergenceDiffKeysDir != "" {
+		keep = append(keep, base.ConvergenceDirName)
+	}
+	err := removeAllExcept(difftool.config.MutationDifferDir, keep...)
+	if err != nil {
+		difftool.logger.Errorf("Error removing mutationDifferDir: %v\n", err)
+	}
+	err = os.MkdirAll(difftool.config.MutationDifferDir, 0777)
+	if err != nil {
+		err = fmt.Errorf("Error mkdir mutationDifferDir: %v\n", err)
+		difftool.logger.Errorf(err.Error())
+		return nil, err
+	}
+
+	// Only needed to tell apart the keys that the filter expression intentionally did not replicate
+	var replicationFilter xdcrParts.Filter
+	var filterUsesXattrs bool
+	if expr, ok := difftool.specifiedSpec.Settings.Values[metadata.FilterExpressionKey].(string); ok && len(expr) > 0 {
+		var filterErr error
+		if difftool.filter == nil {
+			filterErr = difftool.createFilter()
+		}
+		if filterErr != nil {
+			difftool.logger.Errorf("Error creating filter: %v", filterErr.Error())
+		} else {
+			replicationFilter = difftool.filter
+			filterUsesXattrs = filterExpressionUsesXattrs(expr)
+		}
+	}
+
+	mutationDiffer := differ.NewMutationDiffer(difftool.specifiedSpec.SourceBucketName,
+		difftool.selfRef, difftool.specifiedSpec.TargetBucketName, difftool.specifiedRef,
+		difftool.diffKeysDir(), difftool.config.MutationDifferDir, int(difftool.config.NumberOfWorkersForMutationDiffer),
+		int(difftool.config.MutationDifferBatchSize), int(difftool.config.MutationDifferTimeout), int(difftool.config.MaxNumOfSendBatchRetry),
+		time.Duration(difftool.config.SendBatchRetryInterval)*time.Millisecond,
+		time.Duration(difftool.config.SendBatchMaxBackoff)*time.Second, difftool.config.CompareType, difftool.logger, difftool.srcToTgtColIdsMap,
+		difftool.srcCapabilities, difftool.tgtCapabilities, difftool.utils, difftool.config.MutationDifferRetries,
+		int(difftool.config.MutationDifferRetriesWaitSecs), difftool.duplicatedMapping, replicationFilter,
+		time.Duration(difftool.config.CasToleranceMs)*time.Millisecond)
+	mutationDiffer.SetOutputFormat(difftool.config.MutationDifferOutputFormat)
+	mutationDiffer.SetJsonAwareBodyCompare(difftool.config.JsonAwareBodyCompare)
+	mutationDiffer.SetBinaryHexDumpLen(int(difftool.config.BinaryDiffHexDumpBytes))
+	mutationDiffer.SetEncryptionKey(difftool.encryptionKey)
+	mutationDiffer.SetCompareXattrs(difftool.config.CompareXattrs)
+	mutationDiffer.SetFilterUsesXattrs(filterUsesXattrs)
+	mutationDiffer.SetKeyOnly(difftool.config.KeyOnly)
+	mutationDiffer.SetSettlePeriod(time.Duration(difftool.config.MutationDifferSettleTime) * time.Second)
+	mutationDiffer.SetDeadline(difftool.mutationDifferDeadline)
+	mutationDiffer.SetIgnoreSyncGatewayXattrs(difftool.config.IgnoreSyncGatewayMetadata)
+	mutationDiffer.SetCompareTombstones(difftool.config.CompareTombstones)
+	mutationDiffer.SetExpiryTolerance(uint32(difftool.config.ExpiryToleranceSeconds))
+	mutationDiffer.SetOpsPerSecLimit(int(difftool.config.MutationDifferOpsPerSec))
+	mutationDiffer.SetKvPorts(uint16(difftool.config.SourceKvPort), uint16(difftool.config.TargetKvPort))
+	err = difftool.registerOutputSinks(mutationDiffer)
+	if err != nil {
+		difftool.logger.Errorf("Error creating output sinks: %v\n", err)
+		return nil, err
+	}
+	err = difftool.applyMutationDifferCollections(mutationDiffer)
+	if err != nil {
+		difftool.logger.Errorf("Error applying mutationDifferCollections: %v\n", err)
+		return nil, err
+	}
+	difftool.addStage("Mutation differ", mutationDiffer.Progress)
+	difftool.addCounter("Mutation differ diffs", mutationDiffer.NumDiffs)
+	err = mutationDiffer.Run(difftool.diffCtx)
+	if err != nil {
+		difftool.logger.Errorf("Error from runMutationDiffer = %v\n", err)
+	}
+	difftool.mutationDiffSummary = mutationDiffer.Summary()
+	if err == nil && mutationDiffer.DeadlineReached() {
+		err = difftool.writeUnverifiedDiffKeys(mutationDiffer)
+	}
+	return mutationDiffer, err
+}
+
+// Where the mutation differ reads the diff keys from
+func (difftool *xdcrDiffTool) diffKeysDir() string {
+	if difftool.convergenceDiffKeysDir != "" {
+		return difftool.convergenceDiffKeysDir
+	}
+	if difftool.config.DiffKeysDir != "" {
+		return difftool.config.DiffKeysDir
+	}
+	return difftool.config.FileDifferDir
+}
+
+// Writes the keys mutationDifferMaxDuration left unverified for a follow-up run to verify
+func (difftool *xdcrDiffTool) writeUnverifiedDiffKeys(mutationDiffer *differ.MutationDiffer) error {
+	dir := utils.JoinPath(difftool.config.FileDifferDir, base.UnverifiedDiffKeysDirName)
+	numKeys, err := mutationDiffer.WriteUnverifiedDiffKeys(dir)
+	if err != nil {
+		difftool.logger.Errorf("Error writing unverified diff keys: %v\n", err)
+		return err
+	}
+	fmt.Printf("mutationDifferMaxDuration of %v reached. Results are partial, and %v keys were left unverified. To verify them, run again with -runDataGeneration=false -runFileDiffer=false -diffKeysDir %v\n",
+		time.Duration(difftool.config.MutationDifferMaxDuration)*time.Second, numKeys, dir)
+	return nil
+}
+
+func (difftool *xdcrDiffTool) registerOutputSinks(mutationDiffer *differ.MutationDiffer) error {
+	timeout := time.Duration(difftool.config.MutationDifferTimeout) * time.Second
+	if difftool.config.OutputSinkFile != "" {
+		fileSink, err := differ.NewFileOutputSink(difftool.config.OutputSinkFile)
+		if err != nil {
+			return err
+		}
+		mutationDiffer.RegisterOutputSink(fileSink)
+	}
+	if difftool.config.OutputSinkSqlite != "" {
+		sqliteSink, err := differ.NewSqliteOutputSink(difftool.config.OutputSinkSqlite)
+		if err != nil {
+			return err
+		}
+		mutationDiffer.RegisterOutputSink(sqliteSink)
+	}
+	if difftool.config.OutputSinkWebhook != "" {
+		mutationDiffer.RegisterOutputSink(differ.NewWebhookOutputSink(difftool.config.OutputSinkWebhook, int(difftool.config.MutationDifferBatchSize), timeout))
+	}
+	if difftool.config.OutputSinkBucket != "" {
+		var scopeName, collectionName string
+		if difftool.config.OutputSinkCollection != "" {
+			parts := strings.Split(difftool.config.OutputSinkCollection, xdcrBase.ScopeCollectionDelimiter)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid outputSinkCollection %v, expected scope%vcollection", difftool.config.OutputSinkCollection, xdcrBase.ScopeCollectionDelimiter)
+			}
+			scopeName, collectionName = parts[0], parts[1]
+		}
+		runId := difftool.config.OutputSinkRunId
+		if runId == "" {
+			runId = difftool.startTime.UTC().Format(time.RFC3339)
+		}
+		bucketSink, err := differ.NewBucketOutputSink(difftool.selfRef, difftool.config.OutputSinkBucket, scopeName, collectionName, runId,
+			difftool.srcCapabilities, timeout)
+		if err != nil {
+			return err
+		}
+		mutationDiffer.RegisterOutputSink(bucketSink)
+	}
+	return nil
+}
+
+type convergenceAttempt struct {
+	Attempt        int
+	Time           time.Time
+	NumSrcDiffKeys int
+	NumTgtDiffKeys int
+}
+
+// Reruns the mutation differ, each time on the keys that were still different after the previous run,
+// until no differences remain, convergenceRetries is exhausted or the context is canceled
+// Returns the mutation differ of the last attempt that completed
+func (difftool *xdcrDiffTool) runMutationDifferUntilConverged(ctx context.Context) (*differ.MutationDiffer, error) {
+	var history []*convergenceAttempt
+	var runErr error
+	var lastMutationDiffer *differ.MutationDiffer
+
+	for attempt := 0; attempt <= difftool.config.ConvergenceRetries; attempt++ {
+		if attempt > 0 {
+			difftool.logger.Infof("Waiting %v seconds before convergence retry %v out of %v...", difftool.config.ConvergenceRetriesWaitSecs, attempt, difftool.config.ConvergenceRetries)
+			// A nil channel never fires, so without mutationDifferMaxDuration only the wait and the context count
+			var deadlineCh <-chan time.Time
+			if !difftool.mutationDifferDeadline.IsZero() {
+				deadlineCh = time.After(time.Until(difftool.mutationDifferDeadline))
+			}
+			select {
+			case <-time.After(time.Duration(difftool.config.ConvergenceRetriesWaitSecs) * time.Second):
+			case <-deadlineCh:
+			case <-difftool.diffCtx.Done():
+			}
+			if runErr = difftool.canceled(ctx); runErr != nil {
+				difftool.logger.Warnf("Stopping convergence retries since the context is canceled")
+				break
+			}
+			if !difftool.mutationDifferDeadline.IsZero() && !time.Now().Before(difftool.mutationDifferDeadline) {
+				difftool.logger.Warnf("Stopping convergence retries since mutationDifferMaxDuration is reached")
+				break
+			}
+		}
+
+		mutationDiffer, err := difftool.runMutationDiffer()
+		if err != nil {
+			difftool.logger.Errorf("Stopping convergence retries due to error: %v\n", err)
+			runErr = err
+			break
+		}
+		lastMutationDiffer = mutationDiffer
+		if mutationDiffer.DeadlineReached() {
+			// The keys left unverified would be dropped from the remaining diff keys, which are left as they are
+			difftool.logger.Warnf("Stopping convergence retries since mutationDifferMaxDuration is reached")
+			break
+		}
+
+		// The remaining keys become the input of the next attempt. They are kept apart from the file differ's results
+		attemptDir := utils.JoinPath(difftool.config.MutationDifferDir, base.ConvergenceDirName, fmt.Sprintf("%v", attempt))
+		numSrcDiffKeys, numTgtDiffKeys, err := mutationDiffer.WriteRemainingDiffKeys(attemptDir)
+		if err != nil {
+			difftool.logger.Errorf("Error writing remaining diff keys: %v\n", err)
+			runErr = err
+			break
+		}
+		difftool.convergenceDiffKeysDir = attemptDir
+		history = append(history, &convergenceAttempt{
+			Attempt:        attempt,
+			Time:           time.Now(),
+			NumSrcDiffKeys: numSrcDiffKeys,
+			NumTgtDiffKeys: numTgtDiffKeys,
+		})
+		difftool.logger.Infof("Convergence attempt %v: %v source and %v target keys still different", attempt, numSrcDiffKeys, numTgtDiffKeys)
+		if numSrcDiffKeys == 0 && numTgtDiffKeys == 0 {
+			difftool.logger.Infof("Converged after %v attempts", attempt+1)
+			break
+		}
+	}
+
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		difftool.logger.Errorf("Error marshalling convergence history: %v\n", err)
+		return lastMutationDiffer, runErr
+	}
+	historyFileName := utils.JoinPath(difftool.config.MutationDifferDir, base.ConvergenceHistoryFileName)
+	err = os.WriteFile(historyFileName, historyBytes, base.FileModeReadWrite)
+	if err != nil {
+		difftool.logger.Errorf("Error writing convergence history: %v\n", err)
+	}
+	return lastMutationDiffer, runErr
+}
+
+// Writes the remediation artifacts of the differences the last run of the mutation differ confirmed
+func (difftool *xdcrDiffTool) writeRemediation(mutationDiffer *differ.MutationDiffer) error {
+	if difftool.specifiedSpec.Settings.GetCollectionModes().IsMigrationOn() {
+		return fmt.Errorf("remediationDir is not supported for migration mode replications")
+	}
+	srcNamespaces := make(map[uint32]string)
+	tgtNamespaces := make(map[uint32]string)
+	if difftool.srcBucketManifest != nil && difftool.tgtBucketManifest != nil {
+		for srcColId, tgtColIds := range difftool.srcToTgtColIdsMap {
+			if scopeName, collectionName, err := difftool.srcBucketManifest.GetScopeAndCollectionName(srcColId); err == nil {
+				srcNamespaces[srcColId] = scopeName + xdcrBase.ScopeCollectionDelimiter + collectionName
+			}
+			for _, tgtColId := range tgtColIds {
+				if scopeName, collectionName, err := difftool.tgtBucketManifest.GetScopeAndCollectionName(tgtColId); err == nil {
+					tgtNamespaces[tgtColId] = scopeName + xdcrBase.ScopeCollectionDelimiter + collectionName
+				}
+			}
+		}
+	}
+	numEntries, err := mutationDiffer.WriteRemediation(difftool.config.RemediationDir, srcNamespaces, tgtNamespaces)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote remediation of %v docs to %v\n", numEntries, difftool.config.RemediationDir)
+	return nil
+}
+
+// Repairs the keys that the last run of the mutation differ confirmed to be missing from the target
+func (difftool *xdcrDiffTool) repairMissingKeys(mutationDiffer *differ.MutationDiffer) (*differ.RepairSummary, error) {
+	if difftool.specifiedSpec.Settings.GetCollectionModes().IsMigrationOn() {
+		return nil, fmt.Errorf("repair is not supported for migration mode replications")
+	}
+	summary, err := mutationDiffer.Repair(difftool.config.Repair, difftool.config.RepairDryRun)
+	if summary != nil {
+		fmt.Printf("%v. See %v\n", summary, utils.JoinPath(difftool.config.MutationDifferDir, base.MutationDiffRepairLogFileName))
+	}
+	return summary, err
+}
+
+// Options shared by the source and target dcp drivers. The caller sets the ones of each side
+func (difftool *xdcrDiffTool) dcpDriverOptions(fdPool fdp.FdPoolIface, checkpointStore dcp.CheckpointStore, diskSpaceCheck dcp.DiskSpaceCheck) *dcp.DcpDriverOptions {
+	config := difftool.config
+	return &dcp.DcpDriverOptions{
+		CheckpointFileDir:       config.CheckpointFileDir,
+		NewCheckpointFileName:   config.NewCheckpointFileName,
+		NumberOfBins:            int(config.NumberOfBins),
+		BucketOpTimeout:         time.Duration(config.BucketOpTimeout) * time.Second,
+		MaxNumOfGetStatsRetry:   int(config.MaxNumOfGetStatsRetry),
+		GetStatsRetryInterval:   time.Duration(config.GetStatsRetryInterval) * time.Second,
+		GetStatsMaxBackoff:      time.Duration(config.GetStatsMaxBackoff) * time.Second,
+		CheckpointInterval:      int(config.CheckpointInterval),
+		CheckpointRetention:     int(config.CheckpointRetention),
+		CompleteBySeqno:         config.CompleteBySeqno,
+		FdPool:                  fdPool,
+		ColMigrationFilters:     difftool.colFilterOrderedKeys,
+		Utils:                   difftool.utils,
+		BufferCapacity:          config.BucketBufferCapacity,
+		DcpBufferSize:           config.DcpBufferSize,
+		HashAlgorithm:           config.dataFileHashAlgorithm(),
+		DataFileCompression:     config.DataFileCompression,
+		EncryptionKey:           difftool.encryptionKey,
+		MigrationMapping:        difftool.migrationMapping,
+		CheckpointStore:         checkpointStore,
+		VbRange:                 config.vbucketRange(),
+		DiskSpaceCheck:          diskSpaceCheck,
+		SamplePercent:           config.SamplePercent,
+		KeyRange:                config.keyRange(),
+		DeltaDiff:               config.DeltaDiff,
+		IgnoreSyncGatewayXattrs: config.IgnoreSyncGatewayMetadata,
+		VerboseProgress:         config.VerboseProgress,
+	}
+}
+
+func startDcpDriver(ctx context.Context, logger *xdcrLog.CommonLogger, options *dcp.DcpDriverOptions, errChan chan error, waitGroup *sync.WaitGroup) *dcp.DcpDriver {
+	waitGroup.Add(1)
+	dcpDriver := dcp.NewDcpDriver(ctx, logger, options, errChan, waitGroup)
+	// dcp driver startup may take some time. Do it asynchronously
+	go startDcpDriverAysnc(dcpDriver, errChan, logger)
+	return dcpDriver
+}
+
+func startDcpDriverAysnc(dcpDriver *dcp.DcpDriver, errChan chan error, logger *xdcrLog.CommonLogger) {
+	err := dcpDriver.Start()
+	if err != nil {
+		logger.Errorf("Error starting dcp driver %v. err=%v\n", dcpDriver.Name, err)
+		utils.AddToErrorChan(errChan, err)
+	}
+}
+
+func (difftool *xdcrDiffTool) waitForCompletion(sourceDcpDriver, targetDcpDriver *dcp.DcpDriver, errChan chan error, waitGroup *sync.WaitGroup) error {
+	doneChan := make(chan bool, 1)
+	go utils.WaitForWaitGroup(waitGroup, doneChan)
+
+	select {
+	case err := <-errChan:
+		difftool.logger.Errorf("Stop diff generation due to error from dcp client %v\n", err)
+		err1 := sourceDcpDriver.Stop()
+		if err1 != nil {
+			difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
+		}
+		err1 = targetDcpDriver.Stop()
+		if err1 != nil {
+			difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
+		}
+		return err
+	case <-doneChan:
+		difftool.logger.Infof("Source cluster and target cluster have completed\n")
+		return nil
+	}
+
+	return nil
+}
+
+func (difftool *xdcrDiffTool) waitForDuration(ctx context.Context, sourceDcpDriver, targetDcpDriver *dcp.DcpDriver, errChan chan error, duration, delayDurationBetweenSourceAndTarget time.Duration) (err error) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case err = <-errChan:
+		difftool.logger.Errorf("Stop diff generation due to error from dcp client %v\n", err)
+	case <-timer.C:
+		difftool.logger.Infof("Stop diff generation after specified processing duration\n")
+	case <-ctx.Done():
+		// The drivers stop themselves, and are already stopped by the time Stop() returns below
+		difftool.logger.Infof("Stop diff generation since the context is canceled\n")
+		delayDurationBetweenSourceAndTarget = 0
+	}
+
+	err1 := sourceDcpDriver.Stop()
+	if err1 != nil {
+		difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
+	}
+
+	time.Sleep(delayDurationBetweenSourceAndTarget)
+
+	err1 = targetDcpDriver.Stop()
+	if err1 != nil {
+		difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
+	}
+
+	return err
+}
+
+func (difftool *xdcrDiffTool) retrieveReplicationSpecInfo() error {
+	// CBAUTH has already been setup
+	var err error
+	if (difftool.config.EnforceTLS || difftool.config.TargetSecure) && !difftool.specifiedRef.IsHttps() {
+		err = fmt.Errorf("enforceTLS and targetSecure require that the remote cluster reference %v to use Full-Encryption mode", difftool.specifiedRef.Name())
+		difftool.logger.Errorf(err.Error())
+		return err
+	}
+
+	if difftool.config.TargetUsername != "" && difftool.config.TargetUsername != difftool.specifiedRef.UserName() && difftool.config.TargetPassword != "" && difftool.config.TargetPassword != difftool.specifiedRef.Password() {
+		err = fmt.Errorf("user-specified username and password is different from that of the credentials from reference %v", difftool.specifiedRef.Name())
+		difftool.logger.Errorf(err.Error())
+		return err
+	}
+
+	specMap, err := difftool.replicationSpecSvc.AllReplicationSpecs()
+	if err != nil {
+		difftool.logger.Errorf("Error retrieving specs: %v\n", err)
+		return err
+	}
+
+	for _, spec := range specMap {
+		if spec.SourceBucketName == difftool.config.SourceBucketName && spec.TargetBucketName == difftool.config.TargetBucketName && spec.TargetClusterUUID == difftool.specifiedRef.Uuid() {
+			difftool.specifiedSpec = spec
+			break
+		}
+	}
+
+	if difftool.specifiedSpec == nil {
+		difftool.logger.Warnf("Unable to find Replication Spec with source %v target %v, attempting to create a temporary one\n", difftool.config.SourceBucketName, difftool.config.TargetBucketName)
+		// Create a dummy spec
+		difftool.specifiedSpec, err = metadata.NewReplicationSpecification(difftool.config.SourceBucketName, "" /*sourceBucketUUID*/, difftool.specifiedRef.Uuid(), difftool.config.TargetBucketName, "" /*targetBucketUUID*/)
+		if err != nil {
+			difftool.logger.Errorf(err.Error())
+		}
+		return err
+	}
+
+	difftool.logger.Infof("Found Remote Cluster: %v and Replication Spec: %v\n", difftool.specifiedRef.String(), difftool.specifiedSpec.String())
+	return nil
+}
+
+func (difftool *xdcrDiffTool) populateTemporarySpecAndRef() error {
+	var err error
+	difftool.specifiedSpec, err = metadata.NewReplicationSpecification(difftool.config.SourceBucketName, "", /*sourceBucketUUID*/
+		"" /*targetClusterUUID*/, difftool.config.TargetBucketName, "" /*targetBucketUUID*/)
+	if err != nil {
+		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	}
+
+	difftool.specifiedRef, err = metadata.NewRemoteClusterReference("" /*uuid*/, difftool.config.RemoteClusterName /*name*/, difftool.config.TargetUrl, difftool.config.TargetUsername, difftool.config.TargetPassword,
+		"", false, "", nil, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	}
+
+	if difftool.config.TargetSecure {
+		cert, err := loadCACertificate(difftool.config.TargetCACertFile)
+		if err != nil {
+			return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+		}
+		difftool.specifiedRef.Certificate_ = cert
+		difftool.specifiedRef.ClientCertificate_, difftool.specifiedRef.ClientKey_, err =
+			loadClientCertificate(difftool.config.TargetClientCertFile, difftool.config.TargetClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+		}
+		difftool.specifiedRef.SetHttpAuthMech(xdcrBase.HttpAuthMechHttps)
+		difftool.setSecureHostName(difftool.specifiedRef, difftool.config.TargetUrl, difftool.config.TargetMgmtPort)
+	}
+
+	err = difftool.populateSelfRef()
+	if err != nil {
+		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	}
+	return err
+}
+
+// Need to get the secure port and attach it, unless hostAddr already has it. A given mgmtPort is the secure one
+func (difftool *xdcrDiffTool) setSecureHostName(ref *metadata.RemoteClusterReference, hostAddr string, mgmtPort uint64) {
+	if port, err := xdcrBase.GetPortNumber(hostAddr); err == nil && (port == base.MgmtSecurePort || mgmtPort > 0 && uint64(port) == mgmtPort) {
+		// Already the secure port, i.e. resolved from couchbases://, where the non-secure port may not be reachable
+		ref.SetHttpsHostName(hostAddr)
+		ref.SetActiveHttpsHostName(hostAddr)
+		return
+	}
+	internalSSLPort, internalSSLPortErr, _, _ := difftool.utils.GetRemoteSSLPorts(hostAddr, difftool.logger)
+	if internalSSLPortErr == nil {
+		sslHostString := xdcrBase.GetHostAddr(xdcrBase.GetHostName(hostAddr), internalSSLPort)
+		ref.SetHttpsHostName(sslHostString)
+		ref.SetActiveHttpsHostName(sslHostString)
+		difftool.logger.Infof("Received SSL port to be %v and setting TLS hostname to %v", internalSSLPort, sslHostString)
+	}
+}
+
+// Returns nils if no client certificate is given
+func loadClientCertificate(certFileName, keyFileName string) ([]byte, []byte, error) {
+	if certFileName == "" {
+		return nil, nil, nil
+	}
+	cert, err := os.ReadFile(certFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := os.ReadFile(keyFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = tls.X509KeyPair(cert, key); err != nil {
+		return nil, nil, fmt.Errorf("invalid client certificate %v and key %v: %v", certFileName, keyFileName, err)
+	}
+	return cert, key, nil
+}
+
+func loadCACertificate(fileName string) ([]byte, error) {
+	cert, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(cert) {
+		return nil, fmt.Errorf("no PEM encoded certificate found in %v", fileName)
+	}
+	return cert, nil
+}
+
+func (difftool *xdcrDiffTool) setPhase(phase string) {
+	difftool.curState.mtx.Lock()
+	difftool.curState.phase = phase
+	difftool.curState.mtx.Unlock()
+
+	if difftool.manifest != nil {
+		difftool.manifest.startPhase(phase, time.Now())
+		difftool.writeManifest()
+	}
+}
+
+func (difftool *xdcrDiffTool) getPhase() string {
+	difftool.curState.mtx.Lock()
+	defer difftool.curState.mtx.Unlock()
+	return difftool.curState.phase
+}
+
+// Returns the file descriptor pool, grown to minFds if it is smaller, or nil if numberOfFileDesc is 0
+// Its counters are reported from when it is first created
+func (difftool *xdcrDiffTool) getFileDescPool(minFds uint64) *fdp.FdPool {
+	if difftool.config.NumberOfFileDesc == 0 {
+		return nil
+	}
+	if difftool.fileDescPool == nil {
+		difftool.fileDescPool = fdp.NewFileDescriptorPool(int(difftool.config.NumberOfFileDesc))
+		difftool.addCounter("File descriptor limit", difftool.fileDescPool.MaxFds)
+		difftool.addCounter("Open file descriptors", difftool.fileDescPool.NumOpenFds)
+		difftool.addCounter("File descriptor waits", difftool.fileDescPool.NumWaits)
+		difftool.addCounter("File descriptor evictions", difftool.fileDescPool.NumEvictions)
+		difftool.addCounter("File descriptor wait ms", difftool.fileDescPool.WaitTimeMs)
+	}
+	if maxFds := difftool.fileDescPool.MaxFds(); maxFds < minFds {
+		difftool.logger.Infof("Growing the file descriptor pool from %v to %v\n", maxFds, minFds)
+		difftool.fileDescPool.Resize(int(minFds))
+	}
+	return difftool.fileDescPool
+}
+
+// Registers the stage with the dashboard and the status server, whichever are enabled
+func (difftool *xdcrDiffTool) addStage(name string, progress func() (uint64, uint64)) {
+	if difftool.dashboard != nil {
+		difftool.dashboard.AddStage(name, progress)
+	}
+	if difftool.statusServer != nil {
+		difftool.statusServer.AddStage(name, progress)
+	}
+}
+
+func (difftool *xdcrDiffTool) addCounter(name string, counter func() uint64) {
+	if difftool.dashboard != nil {
+		difftool.dashboard.AddCounter(name, counter)
+	}
+	if difftool.statusServer != nil {
+		difftool.statusServer.AddCounter(name, counter)
+	}
+}
+
+// Canceling the context while DCP is streaming stops the DCP drivers, which are created with it, so that what has
+// been streamed so far is diffed. Canceling it at any other time cancels the differs as well
+func (difftool *xdcrDiffTool) monitorContext(ctx context.Context) {
+	<-ctx.Done()
+	difftool.curState.mtx.Lock()
+	defer difftool.curState.mtx.Unlock()
+	defer close(difftool.contextHandled)
+	if difftool.curState.state == StateDcpStarted {
+		difftool.logger.Warnf("Context canceled. Stopping DCP drivers")
+		difftool.curState.state = StateFinal
+		difftool.streamingCanceled = true
+		return
+	}
+	difftool.cancelDiff()
+}
+
+// Returns the error of the context, unless it was canceled only to end data generation early
+func (difftool *xdcrDiffTool) canceled(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	// The DCP drivers stop on their own, possibly before monitorContext() has recorded that streaming was canceled
+	<-difftool.contextHandled
+	difftool.curState.mtx.Lock()
+	defer difftool.curState.mtx.Unlock()
+	if difftool.streamingCanceled {
+		return nil
+	}
+	return ctx.Err()
+}
+
+func (difftool *xdcrDiffTool) populateSelfRef() error {
+	difftool.selfRef.HttpsHostName_ = difftool.config.SourceUrl
+	difftool.selfRef.UserName_ = difftool.config.SourceUsername
+	difftool.selfRef.Password_ = difftool.config.SourcePassword
+	difftool.selfRef.HttpAuthMech_ = xdcrBase.HttpAuthMechPlain
+	clientCert, clientKey, err := loadClientCertificate(difftool.config.SourceClientCertFile, difftool.config.SourceClientKeyFile)
+	if err != nil {
+		return err
+	}
+	difftool.selfRef.ClientCertificate_ = clientCert
+	difftool.selfRef.ClientKey_ = clientKey
+
+	// Only grab certificate if on a loopback device. Otherwise, it must be given
+	if difftool.config.SourceSecure || (difftool.specifiedRef.IsHttps() && isURLLoopBack(difftool.config.SourceUrl)) {
+		var cert []byte
+		if difftool.config.SourceCACertFile != "" {
+			cert, err = loadCACertificate(difftool.config.SourceCACertFile)
+		} else {
+			cert, err = utils.GetCertificate(difftool.utils, difftool.config.SourceUrl, difftool.config.SourceUsername,
+				difftool.config.SourcePassword, xdcrBase.HttpAuthMechPlain)
+		}
+		if err != nil {
+			return err
+		}
+
+		internalHttpsHostname, _, err := difftool.utils.HttpsRemoteHostAddr(difftool.config.SourceUrl, nil)
+		if err != nil {
+			return fmt.Errorf("unable to get httpsRemoteHostAddr: %v", err)
+		}
+
+		difftool.selfRef.Certificate_ = cert
+		refHttpAuthMech, defaultPoolInfo, _, err := difftool.utils.GetSecuritySettingsAndDefaultPoolInfo(difftool.config.SourceUrl,
+			internalHttpsHostname, difftool.selfRef.UserName(), difftool.selfRef.Password(),
+			difftool.selfRef.Certificates(), difftool.selfRef.ClientCertificate(), difftool.selfRef.ClientKey(),
+			difftool.selfRef.IsHalfEncryption(), difftool.logger)
+		if err != nil {
+			return fmt.Errorf("unable to get security settings: %v", err)
+		}
+		if difftool.config.SourceSecure {
+			refHttpAuthMech = xdcrBase.HttpAuthMechHttps
+		}
+		difftool.selfRef.SetHttpAuthMech(refHttpAuthMech)
+		difftool.selfDefaultPoolInfo = defaultPoolInfo
+
+		if refHttpAuthMech == xdcrBase.HttpAuthMechHttps {
+			difftool.setSecureHostName(difftool.selfRef, difftool.config.SourceUrl, difftool.config.SourceMgmtPort)
+		}
+	}
+
+	poolsNodesPath := "/pools/nodes"
+	err, _ = difftool.utils.QueryRestApi(difftool.config.SourceUrl, poolsNodesPath, false, xdcrBase.MethodGet, "", nil, 0, &difftool.selfPoolsNodes, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get pools/nodes information: %v", err)
+	}
+
+	// Do this last
+	atomic.StoreUint32(&difftool.selfRefPopulated, 1)
+	return nil
+}
+
+func (difftool *xdcrDiffTool) retrieveClustersCapabilities(legacyMode bool, xdcrCompTopologyMockCb func()) error {
+	var err error
+	difftool.specifiedRef, err = difftool.remoteClusterSvc.RemoteClusterByRefName(difftool.config.RemoteClusterName, true /*refresh*/)
+	if err != nil {
+		for err != nil && err == metadata_svc.RefreshNotEnabledYet {
+			difftool.logger.Infof("Difftool hasn't finished reaching out to remote cluster. Sleeping 5 seconds and retrying...")
+			time.Sleep(5 * time.Second)
+			difftool.specifiedRef, err = difftool.remoteClusterSvc.RemoteClusterByRefName(difftool.config.RemoteClusterName, true /*refresh*/)
+		}
+		if err != nil {
+			difftool.logger.Errorf("Error retrieving remote clusters: %v\n", err)
+			return err
+		}
+	}
+	if err = difftool.populateSelfRef(); err != nil {
+		return err
+	}
+
+	if !legacyMode {
+		ref, err := difftool.remoteClusterSvc.RemoteClusterByRefName(difftool.specifiedRef.Name(), false)
+		if err != nil {
+			return fmt.Errorf("retrieveClusterCapabilities.RemoteClusterByRefName(%v) - %v", difftool.specifiedRef.Name(), err)
+		}
+
+		difftool.tgtCapabilities, err = difftool.remoteClusterSvc.GetCapability(ref)
+		if err != nil {
+			return fmt.Errorf("retrieveClusterCapabilities.GetCapability(%v) - %v", difftool.specifiedRef.Name(), err)
+		}
+	}
+
+	// Self capabilities
+	if atomic.LoadUint32(&difftool.selfRefPopulated) == 0 {
+		return fmt.Errorf("SelfRef has not been populated\n")
+	}
+	connStr, err := difftool.selfRef.MyConnectionStr()
+	if err != nil {
+		return fmt.Errorf("retrieveClusterCapabilities.myConnStr(%v) - %v", difftool.selfRef.Name(), err)
+	}
+	defaultPoolInfo, err := difftool.utils.GetClusterInfo(connStr, xdcrBase.DefaultPoolPath, difftool.selfRef.UserName(),
+		difftool.selfRef.Password(), difftool.selfRef.HttpAuthMech(), difftool.selfRef.Certificates(),
+		difftool.selfRef.SANInCertificate(), difftool.selfRef.ClientCertificate(), difftool.selfRef.ClientKey(),
+		difftool.logger)
+	if err != nil {
+		return fmt.Errorf("retrieveClusterCapabilities.getClusterInfo(%v) - %v", difftool.selfRef.Name(), err)
+	}
+
+	err = difftool.srcCapabilities.LoadFromDefaultPoolInfo(defaultPoolInfo, difftool.logger)
+	if err != nil {
+		return fmt.Errorf("retrieveClusterCapabilities.LoadFromDefaultPoolInfo(%v) - %v", defaultPoolInfo, err)
+	} else {
+		// At this point, clusterCompat is parsable and just cache it for later mocks
+		nodeList, _ := xdcrBase.GetNodeListFromInfoMap(defaultPoolInfo, difftool.logger)
+		difftool.srcClusterCompat, _ = xdcrBase.GetClusterCompatibilityFromNodeList(nodeList)
+	}
+
+	if xdcrCompTopologyMockCb != nil {
+		xdcrCompTopologyMockCb()
+	}
+	return nil
+}
+
+func (difftool *xdcrDiffTool) populateCollectionsPreReq() error {
+	if (difftool.config.SourceCollections != "" || difftool.config.TargetCollections != "") &&
+		!(difftool.srcCapabilities.HasCollectionSupport() && difftool.tgtCapabilities.HasCollectionSupport()) {
+		return fmt.Errorf("sourceCollections and targetCollections require both clusters to support collections")
+	}
+	if difftool.srcCapabilities.HasCollectionSupport() && difftool.tgtCapabilities.HasCollectionSupport() {
+		// Both have collections support
+		if err := difftool.PopulateManifestsAndMappings(); err != nil {
+			return err
+		}
+	} else if difftool.srcCapabilities.HasCollectionSupport() && !difftool.tgtCapabilities.HasCollectionSupport() {
+		// Source has collections but target does not - stream only default collection from the source
+		difftool.srcCollectionIds = append(difftool.srcCollectionIds, 0)
+	} else if !difftool.srcCapabilities.HasCollectionSupport() && difftool.tgtCapabilities.HasCollectionSupport() {
+		// Source does not have collections but target does - stream only default collection from the target
+		difftool.tgtCollectionIds = append(difftool.tgtCollectionIds, 0)
+	} else {
+		// neither have collections - dont' do anything
+	}
+	return nil
+}
+
+// This is needed whenever source and tgt clusters are >= 7.0
+func (difftool *xdcrDiffTool) PopulateManifestsAndMappings() error {
+	var err error
+	difftool.logger.Infof("Waiting 15 sec for manfiest service to initialize and then getting manifest for source Bucket %v target Bucket %v...\n", difftool.specifiedSpec.SourceBucketName, difftool.specifiedSpec.TargetBucketName)
+	time.Sleep(15 * time.Second)
+
+	difftool.srcBucketManifest, difftool.tgtBucketManifest, err = difftool.collectionsManifestsSvc.GetLatestManifests(difftool.specifiedSpec, false)
+	if err != nil {
+		difftool.logger.Errorf("PopulateManifestsAndMappings() - %v\n", err)
+		return err
+	}
+
+	difftool.logger.Infof("Source manifest: %v", difftool.srcBucketManifest)
+	difftool.logger.Infof("Target manifest: %v", difftool.tgtBucketManifest)
+	// Store the manifests in files
+	err = difftool.outputManifestsToFiles(err)
+	if err != nil {
+		return err
+	}
+
+	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
+	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
+	if modes.IsMigrationOn() && rules.IsExplicitMigrationRule() {
+		difftool.logger.Infof("Replication spec is using special migration mapping")
+	} else if modes.IsMigrationOn() {
+		difftool.logger.Infof("Replication spec is using migration mode")
+	} else if modes.IsExplicitMapping() {
+		difftool.logger.Infof("Replication spec is using explicit mapping")
+	} else {
+		difftool.logger.Infof("Replication spec is using implicit mapping")
+	}
+	err = difftool.compileCollectionMapping()
+	if err != nil {
+		return err
+	}
+
+	err = difftool.applyCollectionFilters()
+	if err != nil {
+		return err
+	}
+
+	// Once hardcoded compilation map has been generated, just stream these Collection IDs from DCP to minimize other noise
+	difftool.generateSrcAndTgtColIds()
+
+	return nil
+}
+
+func (difftool *xdcrDiffTool) outputManifestsToFiles(err error) error {
+	srcManJson, err := json.Marshal(difftool.srcBucketManifest)
+	if err != nil {
+		difftool.logger.Errorf("SrcManifestMarshal - %v\n", err)
+		return err
+	}
+
+	tgtManJson, err := json.Marshal(difftool.tgtBucketManifest)
+	if err != nil {
+		difftool.logger.Errorf("TgtManifestMarshal - %v\n", err)
+		return err
+	}
+
+	err = writeDataDirFile(utils.GetManifestFileName(difftool.config.SourceFileDir), srcManJson)
+	if err != nil {
+		difftool.logger.Errorf("SrcManifestWrite - %v\n", err)
+		return err
+	}
+
+	err = writeDataDirFile(utils.GetManifestFileName(difftool.config.TargetFileDir), tgtManJson)
+	if err != nil {
+		difftool.logger.Errorf("TgtManifestWrite - %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Writes a file next to the data files, which may be in object storage
+func writeDataDirFile(fileName string, data []byte) error {
+	if objectStore.IsURI(fileName) {
+		return objectStore.WriteFile(fileName, data)
+	}
+	return ioutil.WriteFile(fileName, data, 0644)
+}
+
+func (difftool *xdcrDiffTool) compileCollectionMapping() error {
+	pair := metadata.CollectionsManifestPair{
+		Source: difftool.srcBucketManifest,
+		Target: difftool.tgtBucketManifest,
+	}
+	namespaceMapping, err := metadata.NewCollectionNamespaceMappingFromRules(pair, difftool.specifiedSpec.Settings.GetCollectionModes(), difftool.specifiedSpec.Settings.GetCollectionsRoutingRules(), false, false)
+	if err != nil {
+		difftool.logger.Errorf("NewCollectionNamespaceMappingFromRules err: %v", err)
+		return err
+	}
+
+	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
+	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
+	if modes.IsMigrationOn() && !rules.IsExplicitMigrationRule() {
+		return difftool.compileMigrationMapping(namespaceMapping)
+	} else {
+		difftool.compileHardcodedColToColMapping(namespaceMapping)
+	}
+	return nil
+}
+
+func (difftool *xdcrDiffTool) compileHardcodedColToColMapping(namespaceMapping metadata.CollectionNamespaceMapping) {
+	for srcNs, tgtNamespaces := range namespaceMapping {
+		for _, tgtNs := range tgtNamespaces {
+			scopeName := srcNs.GetCollectionNamespace().ScopeName
+			collectionName := srcNs.GetCollectionNamespace().CollectionName
+			tgtScopeName := tgtNs.ScopeName
+			tgtCollectionName := tgtNs.CollectionName
+			srcColId, srcErr := difftool.srcBucketManifest.GetCollectionId(scopeName, collectionName)
+			tgtColId, tgtErr := difftool.tgtBucketManifest.GetCollectionId(tgtScopeName, tgtCollectionName)
+
+			if srcErr != nil {
+				difftool.logger.Errorf("Cannot find %v - %v from source manifest %v\n", scopeName, collectionName, srcErr)
+				continue
+			}
+			if tgtErr != nil {
+				difftool.logger.Errorf("Cannot find %v - %v from target manifest %v\n", scopeName, collectionName, tgtErr)
+				continue
+			}
+
+			tgtList := []uint32{tgtColId}
+			difftool.srcToTgtColIdsMap[srcColId] = tgtList
+		}
+	}
+
+	difftool.logger.Infof("Collection namespace mapping: %v idsMap: %v", namespaceMapping, difftool.srcToTgtColIdsMap)
+}
+
+// Returns the IDs of the given comma separated scope.collection names
+func parseCollectionIds(namespaces string, manifest *metadata.CollectionsManifest) (map[uint32]bool, error) {
+	colIds := make(map[uint32]bool)
+	for _, namespace := range strings.Split(namespaces, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace == "" {
+			continue
+		}
+		parts := strings.Split(namespace, xdcrBase.ScopeCollectionDelimiter)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid collection %v, expected scope%vcollection", namespace, xdcrBase.ScopeCollectionDelimiter)
+		}
+		colId, err := manifest.GetCollectionId(parts[0], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("collection %v: %v", namespace, err)
+		}
+		colIds[colId] = true
+	}
+	return colIds, nil
+}
+
+// Restricts the mutation differ to the per-collection diff keys files of mutationDifferCollections
+func (difftool *xdcrDiffTool) applyMutationDifferCollections(mutationDiffer *differ.MutationDiffer) error {
+	if difftool.config.MutationDifferCollections == "" {
+		return nil
+	}
+	if difftool.specifiedSpec.Settings.GetCollectionModes().IsMigrationOn() {
+		return fmt.Errorf("mutationDifferCollections is not supported for migration mode replications")
+	}
+	srcColIds, err := parseCollectionIds(difftool.config.MutationDifferCollections, difftool.srcBucketManifest)
+	if err != nil {
+		return err
+	}
+	var colIdsToDiff []uint32
+	for srcColId := range srcColIds {
+		if _, exists := difftool.srcToTgtColIdsMap[srcColId]; !exists {
+			return fmt.Errorf("source collection ID %v is not replicated", srcColId)
+		}
+		colIdsToDiff = append(colIdsToDiff, srcColId)
+	}
+	mutationDiffer.SetCollectionsToDiff(colIdsToDiff)
+	return nil
+}
+
+// Narrows srcToTgtColIdsMap down to the collections given by sourceCollections and targetCollections
+// Must be done before generateSrcAndTgtColIds, so that only these collections are streamed
+func (difftool *xdcrDiffTool) applyCollectionFilters() error {
+	if difftool.config.SourceCollections == "" && difftool.config.TargetCollections == "" {
+		return nil
+	}
+	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
+	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
+	if modes.IsMigrationOn() && !rules.IsExplicitMigrationRule() {
+		return fmt.Errorf("sourceCollections and targetCollections are not supported for migration mode replications")
+	}
+
+	var srcColIds, tgtColIds map[uint32]bool
+	var err error
+	if difftool.config.SourceCollections != "" {
+		if srcColIds, err = parseCollectionIds(difftool.config.SourceCollections, difftool.srcBucketManifest); err != nil {
+			return fmt.Errorf("sourceCollections - %v", err)
+		}
+	}
+	if difftool.config.TargetCollections != "" {
+		if tgtColIds, err = parseCollectionIds(difftool.config.TargetCollections, difftool.tgtBucketManifest); err != nil {
+			return fmt.Errorf("targetCollections - %v", err)
+		}
+	}
+
+	for srcColId, mappedTgtColIds := range difftool.srcToTgtColIdsMap {
+		if srcColIds != nil && !srcColIds[srcColId] {
+			delete(difftool.srcToTgtColIdsMap, srcColId)
+			continue
+		}
+		if tgtColIds == nil {
+			continue
+		}
+		var kept []uint32
+		for _, tgtColId := range mappedTgtColIds {
+			if tgtColIds[tgtColId] {
+				kept = append(kept, tgtColId)
+			}
+		}
+		if len(kept) == 0 {
+			delete(difftool.srcToTgtColIdsMap, srcColId)
+		} else {
+			difftool.srcToTgtColIdsMap[srcColId] = kept
+		}
+	}
+
+	if len(difftool.srcToTgtColIdsMap) == 0 {
+		return fmt.Errorf("none of the replicated collections are left after applying sourceCollections and targetCollections")
+	}
+	difftool.logger.Infof("Collections to diff after applying sourceCollections and targetCollections: idsMap: %v", difftool.srcToTgtColIdsMap)
+	return nil
+}
+
+func (difftool *xdcrDiffTool) generateSrcAndTgtColIds() {
+	tgtColIdDedupMap := make(map[uint32]bool)
+
+	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
+	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
+	var migrationMode bool
+
+	if modes.IsMigrationOn() && !rules.IsExplicitMigrationRule() {
+		migrationMode = true
+		for _, tgtColIds := range difftool.colFilterToTgtColIdsMap {
+			difftool.populateDedupColIds(tgtColIds, tgtColIdDedupMap)
+		}
+	} else {
+		for srcColId, tgtColIds := range difftool.srcToTgtColIdsMap {
+			if !migrationMode {
+				difftool.srcCollectionIds = append(difftool.srcCollectionIds, srcColId)
+			}
+			difftool.populateDedupColIds(tgtColIds, tgtColIdDedupMap)
+		}
+	}
+
+	if migrationMode {
+		// Migration mode wise we only pull from the source collectionID
+		difftool.srcCollectionIds = []uint32{xdcrBase.DefaultCollectionId}
+	}
+}
+
+func (difftool *xdcrDiffTool) populateDedupColIds(tgtColIds []uint32, tgtColIdDedupMap map[uint32]bool) {
+	for _, tgtColId := range tgtColIds {
+		_, exists := tgtColIdDedupMap[tgtColId]
+		if !exists {
+			tgtColIdDedupMap[tgtColId] = true
+			difftool.tgtCollectionIds = append(difftool.tgtCollectionIds, tgtColId)
+		}
+	}
+}
+
+func (difftool *xdcrDiffTool) compileMigrationMapping(nsMappings metadata.CollectionNamespaceMapping) error {
+	for srcNs, tgtNsList := range nsMappings {
+		if len(tgtNsList) > 1 {
+			return fmt.Errorf("Migration rules with more than one target namespace is not supported")
+		}
+		for _, tgtNs := range tgtNsList {
+			colId, err := difftool.tgtBucketManifest.GetCollectionId(tgtNs.ScopeName, tgtNs.CollectionName)
+			if err != nil {
+				difftool.logger.Errorf("Cannot find target namespace in manifest: %v", tgtNs.ToIndexString())
+				continue
+			}
+			if _, exists := difftool.colFilterToTgtColIdsMap[srcNs.String()]; !exists {
+				difftool.colFilterToTgtColIdsMap[srcNs.String()] = []uint32{colId}
+			} else {
+				difftool.colFilterToTgtColIdsMap[srcNs.String()] = append(difftool.colFilterToTgtColIdsMap[srcNs.String()], colId)
+			}
+			difftool.colFilterOrderedTargetNs = append(difftool.colFilterOrderedTargetNs, tgtNs)
+		}
+		difftool.colFilterOrderedKeys = append(difftool.colFilterOrderedKeys, srcNs.String())
+	}
+
+	difftool.logger.Infof("Collections Migrations filters ordered list:\n")
+	for i, filterStr := range difftool.colFilterOrderedKeys {
+		difftool.logger.Infof("%v : %v -> %v", i, filterStr, difftool.colFilterOrderedTargetNs[i].ToIndexString())
+	}
+
+	// Ensure that the colIdMappings are handled accordingly
+	for _, targetNs := range difftool.colFilterOrderedTargetNs {
+		targetColId, err := difftool.tgtBucketManifest.GetCollectionId(targetNs.ScopeName, targetNs.CollectionName)
+		if err != nil {
+			return fmt.Errorf("cannot find collection %v from manifest %v", targetNs.ToIndexString(), difftool.tgtBucketManifest.String())
+		}
+		difftool.srcToTgtColIdsMap[0] = append(difftool.srcToTgtColIdsMap[0], targetColId)
+		difftool.colFilterOrderedTargetColId = append(difftool.colFilterOrderedTargetColId, targetColId)
+	}
+
+	// The migrationMapping will be shared among many components, so we need to make sure it is sharable
+	return difftool.populateMigrationMapping(nsMappings)
+}
+
+func (difftool *xdcrDiffTool) populateMigrationMapping(namespaceMappings metadata.CollectionNamespaceMapping) error {
+	difftool.migrationMapping = namespaceMappings.Clone()
+	filterMode := difftool.specifiedSpec.Settings.GetExpDelMode()
+	for srcNamespacePtr, _ := range difftool.migrationMapping {
+		// For each sourceNamespace, its filter needs to be a pool
+		expr := srcNamespacePtr.GetFilterString()
+		pool, err := filterPool.NewFilterPool(difftool.config.NumOfFiltersInFilterPool, expr, difftool.utils, filterMode.IsSkipReplicateUncommittedTxnSet())
+		if err != nil {
+			return err
+		}
+		srcNamespacePtr.ReplaceFilter(pool)
+	}
+	return nil
+}
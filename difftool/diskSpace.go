@@ -0,0 +1,119 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+const bytesPerGB = 1024 * 1024 * 1024
+
+// Checks the estimated size of the data files of each cluster against the space left in the data file dirs
+// and against maxDiskGB. sourceFileDir and targetFileDir are usually on the same disk, so the estimates of
+// both clusters are added up, and the smaller of the two free spaces is used
+type diskSpaceChecker struct {
+	freeSpace uint64
+	usedSpace uint64
+	quota     uint64
+	estimates map[string]uint64
+	lock      sync.Mutex
+}
+
+func (difftool *xdcrDiffTool) newDiskSpaceChecker() (*diskSpaceChecker, error) {
+	checker := &diskSpaceChecker{
+		quota:     difftool.config.MaxDiskGB * bytesPerGB,
+		estimates: make(map[string]uint64),
+	}
+	for i, dir := range difftool.dataFileDirs() {
+		free, err := utils.FreeDiskSpace(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting free disk space of %v: %v", dir, err)
+		}
+		if i == 0 || free < checker.freeSpace {
+			checker.freeSpace = free
+		}
+	}
+	var err error
+	checker.usedSpace, err = difftool.dataFilesSize()
+	if err != nil {
+		return nil, err
+	}
+	return checker, nil
+}
+
+func (c *diskSpaceChecker) check(name string, estimatedBytes uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.estimates[name] = estimatedBytes
+	var total uint64
+	for _, estimate := range c.estimates {
+		total += estimate
+	}
+	if total > c.freeSpace {
+		return fmt.Errorf("data files are estimated to take %v bytes, %v of them for %v, but only %v bytes are free in the data file dirs",
+			total, estimatedBytes, name, c.freeSpace)
+	}
+	if c.quota > 0 && c.usedSpace+total > c.quota {
+		return fmt.Errorf("data files are estimated to take %v bytes, %v of them for %v, which on top of the %v bytes already used would exceed maxDiskGB",
+			total, estimatedBytes, name, c.usedSpace)
+	}
+	return nil
+}
+
+func (difftool *xdcrDiffTool) dataFileDirs() []string {
+	if difftool.config.SourceFileDir == difftool.config.TargetFileDir {
+		return []string{difftool.config.SourceFileDir}
+	}
+	return []string{difftool.config.SourceFileDir, difftool.config.TargetFileDir}
+}
+
+func (difftool *xdcrDiffTool) dataFilesSize() (uint64, error) {
+	var total uint64
+	for _, dir := range difftool.dataFileDirs() {
+		size, err := utils.DirSize(dir)
+		if err != nil {
+			return 0, fmt.Errorf("Error getting size of %v: %v", dir, err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// Periodically checks the size of the data files against maxDiskGB until finChan is closed. Going over it is
+// reported as an error on errChan, which stops the dcp drivers the same way as any other dcp error, saving a checkpoint
+func (difftool *xdcrDiffTool) enforceDiskQuota(errChan chan error, finChan chan bool) {
+	quota := difftool.config.MaxDiskGB * bytesPerGB
+	ticker := time.NewTicker(base.DiskQuotaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-finChan:
+			return
+		case <-ticker.C:
+			size, err := difftool.dataFilesSize()
+			if err != nil {
+				difftool.logger.Warnf("Error checking data files against maxDiskGB: %v\n", err)
+				continue
+			}
+			if size > quota {
+				utils.AddToErrorChan(errChan, fmt.Errorf("data files take %v bytes, more than maxDiskGB %v. Stopping with a checkpoint, which can be resumed from with a larger maxDiskGB",
+					size, difftool.config.MaxDiskGB))
+				return
+			}
+		}
+	}
+}
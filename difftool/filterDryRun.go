@@ -0,0 +1,170 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	xdcrParts "github.com/couchbase/goxdcr/base/filter"
+	xdcrUtils "github.com/couchbase/goxdcr/utils"
+	"xdcrDiffer/base"
+	"xdcrDiffer/dcp"
+	"xdcrDiffer/filterPool"
+	"xdcrDiffer/utils"
+)
+
+type FilterDryRunResult struct {
+	Key     string
+	Matched bool
+	// Set if the doc could not be filtered, which data generation counts as unable to filter
+	Error string `json:",omitempty"`
+}
+
+// Which docs a filter expression would let through to the target, and which it would skip
+type FilterDryRunReport struct {
+	Expression string
+	Matched    int
+	Skipped    int
+	Errors     int
+	Results    []*FilterDryRunResult
+}
+
+func (r *FilterDryRunReport) String() string {
+	return fmt.Sprintf("Expression %q: %v docs matched, %v skipped, %v could not be filtered", r.Expression, r.Matched, r.Skipped, r.Errors)
+}
+
+// DryRunFilter runs a filter expression over docs, so that it can be checked before a diff is started with it
+// The docs are read from docsFile, a JSON object of doc keys to docs, or otherwise up to sampleSize of them are
+// streamed from the start of the source bucket, in the vbuckets of the config. Without an expression, the filter
+// expression of the replication is used, which requires the docs to be streamed
+func DryRunFilter(ctx context.Context, cfg *Config, expression, docsFile string, sampleSize int) (*FilterDryRunReport, error) {
+	if docsFile != "" {
+		if expression == "" {
+			return nil, fmt.Errorf("a filter expression is required to dry run on %v", docsFile)
+		}
+		mutations, err := loadFilterDryRunDocs(docsFile)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := filterPool.NewFilterPool(1, expression, xdcrUtils.NewUtilities(), false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter expression %v: %v", expression, err)
+		}
+		return runFilterDryRun(expression, filter, mutations), nil
+	}
+
+	if sampleSize <= 0 {
+		return nil, fmt.Errorf("sample size %v must be more than 0", sampleSize)
+	}
+	config := *cfg
+	config.resolveConnectionStrings()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	base.SetNetworkType(config.Network)
+	base.SetRedactionLevel(config.RedactionLevel)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	difftool, err := newDiffTool(ctx, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating difftool: %v", err)
+	}
+	if difftool.legacyMode {
+		if err := difftool.populateTemporarySpecAndRef(); err != nil {
+			return nil, err
+		}
+	}
+
+	var filter xdcrParts.Filter
+	if expression == "" {
+		expression, err = difftool.filterExpression()
+		if err != nil {
+			return nil, err
+		}
+		if expression == "" {
+			return nil, fmt.Errorf("the replication has no filter expression. Give one to dry run")
+		}
+		if err = difftool.createFilter(); err != nil {
+			return nil, err
+		}
+		filter = difftool.filter
+	} else {
+		filterMode := difftool.specifiedSpec.Settings.GetExpDelMode()
+		filter, err = filterPool.NewFilterPool(1, expression, difftool.utils, filterMode.IsSkipReplicateUncommittedTxnSet())
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter expression %v: %v", expression, err)
+		}
+	}
+
+	mutations, err := dcp.SampleMutations(ctx, difftool.logger, base.SourceClusterName, config.SourceBucketName, difftool.selfRef,
+		difftool.srcCapabilities, difftool.srcCollectionIds, difftool.utils, config.vbucketRange().Vbnos(), sampleSize,
+		time.Duration(config.BucketOpTimeout)*time.Second, uint16(config.SourceKvPort))
+	if err != nil {
+		return nil, fmt.Errorf("Error sampling docs from %v: %v", config.SourceBucketName, err)
+	}
+	return runFilterDryRun(expression, filter, mutations), nil
+}
+
+// Docs that are not JSON objects are taken as binary docs
+func loadFilterDryRunDocs(fileName string) ([]*dcp.Mutation, error) {
+	docsBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var docs map[string]json.RawMessage
+	if err = json.Unmarshal(docsBytes, &docs); err != nil {
+		return nil, fmt.Errorf("%v must hold a JSON object of doc keys to docs: %v", fileName, err)
+	}
+
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	mutations := make([]*dcp.Mutation, 0, len(keys))
+	for _, key := range keys {
+		var datatype uint8
+		if len(docs[key]) > 0 && docs[key][0] == '{' {
+			datatype = base.JSONDataType
+		}
+		mutations = append(mutations, dcp.CreateMutation(utils.GetVbucketFromKey([]byte(key)), []byte(key), 0, 0, 0, 0, 0,
+			gomemcached.UPR_MUTATION, docs[key], datatype, 0))
+	}
+	return mutations, nil
+}
+
+func runFilterDryRun(expression string, filter xdcrParts.Filter, mutations []*dcp.Mutation) *FilterDryRunReport {
+	report := &FilterDryRunReport{
+		Expression: expression,
+		Results:    make([]*FilterDryRunResult, 0, len(mutations)),
+	}
+	for _, mut := range mutations {
+		result := &FilterDryRunResult{Key: string(mut.Key)}
+		matched, err, errStr, _ := filter.FilterUprEvent(mut.ToUprEvent())
+		switch {
+		case err != nil:
+			result.Error = fmt.Sprintf("%v - %v", err, errStr)
+			report.Errors++
+		case matched:
+			result.Matched = true
+			report.Matched++
+		default:
+			report.Skipped++
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+const (
+	PhaseOutcomeRunning   = "running"
+	PhaseOutcomeCompleted = "completed"
+	PhaseOutcomeFailed    = "failed"
+	PhaseOutcomeCanceled  = "canceled"
+)
+
+// When a phase of a run started and ended, and how
+type RunPhase struct {
+	Phase     string
+	StartTime time.Time
+	// Not set while the phase is running
+	EndTime time.Time
+	Outcome string
+	Error   string `json:",omitempty"`
+}
+
+// RunManifest describes a run, so that its results can be told apart and audited. It is written to mutationDifferDir
+// once the run has connected to both clusters, and rewritten as each phase ends
+type RunManifest struct {
+	// Only set with runsDir
+	RunId       string `json:",omitempty"`
+	ToolVersion string
+	StartTime   time.Time
+	// Not set while the run is in progress, or if it never completed
+	EndTime           time.Time
+	SourceClusterUUID string
+	SourceBucketUUID  string
+	TargetClusterUUID string
+	TargetBucketUUID  string
+	// The options of the run once resolved, i.e. by resume and autoTune, without the passwords and the encryption key
+	Options *Config
+	Phases  []*RunPhase
+	Error   string      `json:",omitempty"`
+	Result  *DiffResult `json:",omitempty"`
+}
+
+func newRunManifest(config *Config, startTime time.Time) *RunManifest {
+	return &RunManifest{
+		RunId:       config.RunId,
+		ToolVersion: base.ToolVersion,
+		StartTime:   startTime,
+		Options:     config.WithoutSecrets(),
+	}
+}
+
+func (m *RunManifest) write(mutationDifferDir string) error {
+	if err := os.MkdirAll(mutationDifferDir, 0777); err != nil {
+		return err
+	}
+	manifestBytes, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(utils.JoinPath(mutationDifferDir, base.RunManifestFileName), manifestBytes, base.FileModeReadWrite)
+}
+
+// Ends the phase in progress, if any, and starts phase unless the run is done
+func (m *RunManifest) startPhase(phase string, now time.Time) {
+	m.endPhase(now, nil)
+	if phase != PhaseDone {
+		m.Phases = append(m.Phases, &RunPhase{Phase: phase, StartTime: now, Outcome: PhaseOutcomeRunning})
+	}
+}
+
+func (m *RunManifest) endPhase(now time.Time, err error) {
+	if len(m.Phases) == 0 || m.Phases[len(m.Phases)-1].Outcome != PhaseOutcomeRunning {
+		return
+	}
+	phase := m.Phases[len(m.Phases)-1]
+	phase.EndTime = now
+	switch {
+	case err == nil:
+		phase.Outcome = PhaseOutcomeCompleted
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		phase.Outcome = PhaseOutcomeCanceled
+		phase.Error = err.Error()
+	default:
+		phase.Outcome = PhaseOutcomeFailed
+		phase.Error = err.Error()
+	}
+}
+
+// Records the outcome of the run, and of the phase it ended in
+func (m *RunManifest) finish(endTime time.Time, result *DiffResult, runErr error) {
+	m.endPhase(endTime, runErr)
+	m.EndTime = endTime
+	m.Result = result
+	if runErr != nil {
+		m.Error = runErr.Error()
+	}
+}
+
+// Records the resolved options and the UUIDs of the clusters and buckets, then writes the manifest for the first
+// time. UUIDs that cannot be looked up are left empty, as the manifest is not worth failing the run over
+func (difftool *xdcrDiffTool) startManifest() {
+	manifest := difftool.manifest
+	manifest.Options = difftool.config.WithoutSecrets()
+
+	var err error
+	manifest.SourceClusterUUID, manifest.SourceBucketUUID, err = difftool.clusterAndBucketUUIDs(difftool.selfRef, difftool.config.SourceBucketName)
+	if err != nil {
+		difftool.logger.Warnf("Unable to look up the source cluster and bucket UUIDs for the run manifest: %v\n", err)
+	}
+	manifest.TargetClusterUUID, manifest.TargetBucketUUID, err = difftool.clusterAndBucketUUIDs(difftool.specifiedRef, difftool.config.TargetBucketName)
+	if err != nil {
+		difftool.logger.Warnf("Unable to look up the target cluster and bucket UUIDs for the run manifest: %v\n", err)
+	}
+	difftool.writeManifest()
+}
+
+func (difftool *xdcrDiffTool) writeManifest() {
+	if err := difftool.manifest.write(difftool.config.MutationDifferDir); err != nil {
+		difftool.logger.Warnf("Unable to write the run manifest to %v: %v\n", difftool.config.MutationDifferDir, err)
+	}
+}
+
+func (difftool *xdcrDiffTool) clusterAndBucketUUIDs(ref *metadata.RemoteClusterReference, bucketName string) (string, string, error) {
+	if ref == nil {
+		return "", "", fmt.Errorf("unable to find the remote cluster reference")
+	}
+	connStr, err := ref.MyConnectionStr()
+	if err != nil {
+		return "", "", err
+	}
+	poolsInfo, err := difftool.utils.GetClusterInfo(connStr, base.PoolsPath, ref.UserName(), ref.Password(), ref.HttpAuthMech(),
+		ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	if err != nil {
+		return "", "", err
+	}
+	clusterUUID, _ := poolsInfo[base.ClusterUUIDKey].(string)
+
+	_, _, bucketUUID, _, _, _, err := difftool.utils.BucketValidationInfo(connStr, bucketName, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	return clusterUUID, bucketUUID, err
+}
+
+// Same as os.RemoveAll, but keeps the directory itself and the entries named keep in it
+func removeAllExcept(dir string, keep ...string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		kept := false
+		for _, name := range keep {
+			kept = kept || entry.Name() == name
+		}
+		if kept {
+			continue
+		}
+		if err = os.RemoveAll(utils.JoinPath(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
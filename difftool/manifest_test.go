@@ -0,0 +1,82 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+)
+
+func TestRunManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	config.SourcePassword = "secret"
+	config.MutationDifferDir = filepath.Join(t.TempDir(), base.MutationDifferDir)
+	startTime := time.Date(2024, 6, 1, 2, 0, 0, 0, time.UTC)
+	manifest := newRunManifest(config, startTime)
+	assert.Equal("", manifest.Options.SourcePassword)
+	assert.Equal("secret", config.SourcePassword)
+
+	manifest.startPhase(PhaseDataGeneration, startTime)
+	manifest.startPhase(PhaseFileDiff, startTime.Add(time.Minute))
+	manifest.startPhase(PhaseMutationDiff, startTime.Add(2*time.Minute))
+	manifest.finish(startTime.Add(3*time.Minute), &DiffResult{}, fmt.Errorf("mutation differ failed"))
+	assert.Len(manifest.Phases, 3)
+	assert.Equal(PhaseOutcomeCompleted, manifest.Phases[0].Outcome)
+	assert.Equal(startTime.Add(time.Minute), manifest.Phases[0].EndTime)
+	assert.Equal(PhaseOutcomeFailed, manifest.Phases[2].Outcome)
+	assert.Equal("mutation differ failed", manifest.Phases[2].Error)
+
+	manifest = newRunManifest(config, startTime)
+	manifest.startPhase(PhaseDataGeneration, startTime)
+	manifest.finish(startTime.Add(time.Minute), nil, context.Canceled)
+	assert.Equal(PhaseOutcomeCanceled, manifest.Phases[0].Outcome)
+
+	manifest = newRunManifest(config, startTime)
+	manifest.startPhase(PhaseDataGeneration, startTime)
+	manifest.startPhase(PhaseDone, startTime.Add(time.Minute))
+	manifest.finish(startTime.Add(time.Minute), &DiffResult{}, nil)
+	assert.Len(manifest.Phases, 1)
+	assert.Equal(PhaseOutcomeCompleted, manifest.Phases[0].Outcome)
+	assert.Nil(manifest.write(config.MutationDifferDir))
+
+	// Outputs of the previous run are removed, but not the manifest of the current one
+	assert.Nil(os.WriteFile(filepath.Join(config.MutationDifferDir, base.MutationDiffFileName), []byte("{}"), 0644))
+	assert.Nil(removeAllExcept(config.MutationDifferDir, base.RunManifestFileName))
+	manifestBytes, err := os.ReadFile(filepath.Join(config.MutationDifferDir, base.RunManifestFileName))
+	assert.Nil(err)
+	written := &RunManifest{}
+	assert.Nil(json.Unmarshal(manifestBytes, written))
+	assert.Equal(base.ToolVersion, written.ToolVersion)
+	assert.Equal(manifest.EndTime, written.EndTime)
+	entries, err := os.ReadDir(config.MutationDifferDir)
+	assert.Nil(err)
+	assert.Len(entries, 1)
+
+	// Convergence retries keep the keys the previous attempt left
+	convergenceDir := filepath.Join(config.MutationDifferDir, base.ConvergenceDirName, "0")
+	assert.Nil(os.MkdirAll(convergenceDir, 0777))
+	assert.Nil(os.WriteFile(filepath.Join(config.MutationDifferDir, base.MutationDiffFileName), []byte("{}"), 0644))
+	assert.Nil(removeAllExcept(config.MutationDifferDir, base.RunManifestFileName, base.ConvergenceDirName))
+	entries, err = os.ReadDir(config.MutationDifferDir)
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	_, err = os.Stat(convergenceDir)
+	assert.Nil(err)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// The outcome of diffing one of the replications of RunAll()
+type ReplicationResult struct {
+	SourceBucketName string
+	TargetBucketName string
+	// Holds the data, checkpoint and result directories of the replication
+	Subdir string
+	Result *DiffResult `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// RunAll diffs every replication to the remote cluster of cfg one after another, as Run() does for a single one
+// Each replication keeps its data, checkpoints and results in a subdirectory of each directory of cfg, named after
+// its source and target buckets. A replication that fails does not stop the others, while canceling ctx does
+// Returns an error if the replications cannot be listed, or if ctx is canceled
+func RunAll(ctx context.Context, cfg *Config) ([]*ReplicationResult, error) {
+	config := *cfg
+	config.resolveConnectionStrings()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.AllReplications = false
+
+	replications, err := listReplications(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing the replications to %v: %v", config.RemoteClusterName, err)
+	}
+	fmt.Printf("Diffing %v replications to %v\n", len(replications), config.RemoteClusterName)
+
+	var results []*ReplicationResult
+	for _, replication := range replications {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		replication.Subdir = fmt.Sprintf("%v%v%v", replication.SourceBucketName, base.FileNameDelimiter, replication.TargetBucketName)
+		fmt.Printf("Diffing replication from %v to %v\n", replication.SourceBucketName, replication.TargetBucketName)
+
+		replicationConfig := config
+		replicationConfig.SourceBucketName = replication.SourceBucketName
+		replicationConfig.TargetBucketName = replication.TargetBucketName
+		for _, dir := range []*string{&replicationConfig.SourceFileDir, &replicationConfig.TargetFileDir,
+			&replicationConfig.CheckpointFileDir, &replicationConfig.FileDifferDir, &replicationConfig.MutationDifferDir} {
+			*dir = utils.JoinPath(*dir, replication.Subdir)
+		}
+		if replicationConfig.RunsDir != "" {
+			replicationConfig.RunsDir = utils.JoinPath(replicationConfig.RunsDir, replication.Subdir)
+		}
+
+		replication.Result, err = Run(ctx, &replicationConfig)
+		if err != nil {
+			fmt.Printf("Replication from %v to %v failed: %v\n", replication.SourceBucketName, replication.TargetBucketName, err)
+			replication.Error = err.Error()
+		}
+		results = append(results, replication)
+	}
+	return results, ctx.Err()
+}
+
+// Returns the replications to the remote cluster of config, ordered by source and then target bucket
+func listReplications(config *Config) ([]*ReplicationResult, error) {
+	difftool := newXdcrDiffTool(config)
+	_, _, err := difftool.setupReplicationSpecSvc()
+	if err != nil {
+		return nil, err
+	}
+	specMap, err := difftool.replicationSpecSvc.AllReplicationSpecs()
+	if err != nil {
+		return nil, err
+	}
+
+	var replications []*ReplicationResult
+	for _, spec := range specMap {
+		if spec.TargetClusterUUID == difftool.specifiedRef.Uuid() {
+			replications = append(replications, &ReplicationResult{
+				SourceBucketName: spec.SourceBucketName,
+				TargetBucketName: spec.TargetBucketName,
+			})
+		}
+	}
+	sort.Slice(replications, func(i, j int) bool {
+		if replications[i].SourceBucketName != replications[j].SourceBucketName {
+			return replications[i].SourceBucketName < replications[j].SourceBucketName
+		}
+		return replications[i].TargetBucketName < replications[j].TargetBucketName
+	})
+	return replications, nil
+}
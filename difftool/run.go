@@ -0,0 +1,270 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/dashboard"
+	"xdcrDiffer/differ"
+	"xdcrDiffer/status"
+	"xdcrDiffer/utils"
+)
+
+// DiffResult holds the totals of a run. The differences themselves are in the files under
+// Config.FileDifferDir and Config.MutationDifferDir
+type DiffResult struct {
+	// Set once the file differ has diffed the data files. Not set when diffing in memory
+	FileDiff *differ.FileDiffSummary
+	// Set once the mutation differ has run. With convergence retries, the totals of the last attempt
+	MutationDiff *differ.MutationDiffSummary
+	// Set once the keys missing from the target have been repaired, when Config.Repair is set
+	Repair *differ.RepairSummary
+}
+
+// The differences confirmed by the mutation differ, or those found by the file differ if the mutation differ did not run
+func (r *DiffResult) NumDiffs() int {
+	switch {
+	case r.MutationDiff != nil:
+		return r.MutationDiff.NumDiffs()
+	case r.FileDiff != nil:
+		return r.FileDiff.NumDiffs()
+	default:
+		return 0
+	}
+}
+
+// Run runs the phases enabled in config, as the xdcrDiffer command does, and returns once they have completed
+// Canceling ctx while DCP is streaming ends data generation early, and what has been streamed so far is still diffed,
+// as interrupting the command does. Canceling it at any other time stops the phase in progress once what it has done
+// so far is written out, and makes Run return ctx.Err()
+// Logging, the KV authentication mechanism, the network and redaction are process wide, so runs in progress at the same
+// time must agree on them. jobs.Server rejects parallel jobs that do not
+// Unless it is a dry run, a manifest of the run is kept in mutationDifferDir. With runsDir, the checkpoints and outputs
+// of the run are kept in a directory of its own, and the oldest runs past runRetention are removed once it is done
+func Run(ctx context.Context, cfg *Config) (*DiffResult, error) {
+	if cfg.DryRun {
+		return run(ctx, cfg, nil)
+	}
+
+	config := *cfg
+	validated := config
+	validated.resolveConnectionStrings()
+	if err := validated.Validate(); err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	if config.RunsDir != "" {
+		if err := config.setupRunDir(startTime); err != nil {
+			return nil, fmt.Errorf("Unable to set up the directory of the run under %v: %v", config.RunsDir, err)
+		}
+		fmt.Printf("Keeping the checkpoints and results of run %v in %v\n", config.RunId, utils.JoinPath(config.RunsDir, config.RunId))
+	}
+	manifest := newRunManifest(&config, startTime)
+
+	result, runErr := run(ctx, &config, manifest)
+	manifest.finish(time.Now(), result, runErr)
+	if err := manifest.write(config.MutationDifferDir); err != nil {
+		fmt.Printf("Unable to write the run manifest to %v: %v\n", config.MutationDifferDir, err)
+	}
+	if config.RunsDir != "" {
+		removed, err := removeOldRuns(config.RunsDir, config.RunRetention, config.RunId)
+		if len(removed) > 0 {
+			fmt.Printf("Removed the directories of runs %v under %v\n", removed, config.RunsDir)
+		}
+		if err != nil {
+			fmt.Printf("Unable to remove old runs under %v: %v\n", config.RunsDir, err)
+		}
+	}
+	return result, runErr
+}
+
+// manifest is nil for dry runs
+func run(ctx context.Context, cfg *Config, manifest *RunManifest) (*DiffResult, error) {
+	// Resolving the connection strings and the checkpoint to resume from must not change the caller's config
+	config := *cfg
+	config.resolveConnectionStrings()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.AllReplications {
+		return nil, fmt.Errorf("allReplications option requires RunAll()")
+	}
+	// Runs in the same process, i.e. jobs and scheduled runs, must not inherit the mechanism a previous run forced
+	base.SetForcedKVAuthMechanism("")
+	if config.KvAuthMechanism != "" {
+		mechanism, err := base.ParseKVAuthMechanism(config.KvAuthMechanism)
+		if err != nil {
+			return nil, err
+		}
+		base.SetForcedKVAuthMechanism(mechanism)
+	}
+	base.SetNetworkType(config.Network)
+	base.SetRedactionLevel(config.RedactionLevel)
+	encryptionKey, err := config.DataFileEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.setupDirectories(); err != nil {
+		return nil, fmt.Errorf("Unable to set up directory structure: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	difftool, err := newDiffTool(ctx, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating difftool: %v", err)
+	}
+	difftool.encryptionKey = encryptionKey
+
+	if config.Dashboard && !config.DryRun {
+		out := config.DashboardOutput
+		if out == nil {
+			out = os.Stdout
+		}
+		difftool.dashboard = dashboard.NewDashboard(out, time.Second)
+		difftool.dashboard.Start()
+		defer difftool.dashboard.Stop()
+	}
+	if config.StatusAddr != "" && !config.DryRun {
+		difftool.statusServer = status.NewServer(config.StatusAddr)
+		difftool.statusServer.SetPhaseFunc(difftool.getPhase)
+		if err := difftool.statusServer.Start(); err != nil {
+			return nil, fmt.Errorf("Unable to start the status server on %v: %v", config.StatusAddr, err)
+		}
+		defer difftool.statusServer.Stop()
+	}
+
+	if difftool.legacyMode {
+		// OK to ignore metakv err in manual mode
+		if err := difftool.populateTemporarySpecAndRef(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Resume {
+		if err := config.resolveResumeCheckpoint(); err != nil {
+			return nil, err
+		}
+	}
+	if config.AutoTune {
+		if err := difftool.autoTune(); err != nil {
+			return nil, fmt.Errorf("Unable to auto tune: %v", err)
+		}
+	}
+
+	result := &DiffResult{}
+	if config.DryRun {
+		if err := difftool.runPreflightChecks(); err != nil {
+			return nil, fmt.Errorf("Dry run failed: %v", err)
+		}
+		return result, nil
+	}
+	if err := difftool.verifyPrivileges(); err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		difftool.manifest = manifest
+		difftool.startManifest()
+	}
+
+	if err := difftool.openKVStores(); err != nil {
+		return result, err
+	}
+	defer difftool.closeKVStores()
+
+	if err := difftool.canceled(ctx); err != nil {
+		return result, err
+	}
+	if config.RunDataGeneration {
+		difftool.setPhase(PhaseDataGeneration)
+		err := difftool.generateDataFiles(ctx)
+		if canceledErr := difftool.canceled(ctx); canceledErr != nil {
+			return result, canceledErr
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error generating data files. err=%v", err)
+		}
+	} else {
+		fmt.Printf("Skipping  generating data files since it has been disabled\n")
+	}
+
+	if err := difftool.canceled(ctx); err != nil {
+		return result, err
+	}
+	if config.RunFileDiffer {
+		var err error
+		difftool.setPhase(PhaseFileDiff)
+		if config.StreamingDiff {
+			// Already started alongside data generation
+			err = <-difftool.streamingDiffErrChan
+		} else if config.InMemory {
+			err = difftool.diffInMemory(nil, nil, nil)
+		} else {
+			err = difftool.diffDataFiles(nil, nil, nil)
+		}
+		result.FileDiff = difftool.fileDiffSummary
+		if canceledErr := difftool.canceled(ctx); canceledErr != nil {
+			return result, canceledErr
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error running file difftool. err=%v", err)
+		}
+	} else {
+		fmt.Printf("Skipping file difftool since it has been disabled\n")
+	}
+
+	if err := difftool.canceled(ctx); err != nil {
+		return result, err
+	}
+	if config.RunMutationDiffer {
+		var mutationDiffer *differ.MutationDiffer
+		var err error
+		difftool.setPhase(PhaseMutationDiff)
+		if config.MutationDifferMaxDuration > 0 {
+			difftool.mutationDifferDeadline = time.Now().Add(time.Duration(config.MutationDifferMaxDuration) * time.Second)
+		}
+		if config.ConvergenceRetries > 0 {
+			mutationDiffer, err = difftool.runMutationDifferUntilConverged(ctx)
+		} else {
+			mutationDiffer, err = difftool.runMutationDiffer()
+		}
+		result.MutationDiff = difftool.mutationDiffSummary
+		if canceledErr := difftool.canceled(ctx); canceledErr != nil {
+			return result, canceledErr
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error running mutation differ. err=%v", err)
+		}
+
+		if config.Repair != "" && mutationDiffer != nil {
+			result.Repair, err = difftool.repairMissingKeys(mutationDiffer)
+			if err != nil {
+				return result, fmt.Errorf("Error repairing missing keys. err=%v", err)
+			}
+		}
+		if config.RemediationDir != "" && mutationDiffer != nil {
+			err = difftool.writeRemediation(mutationDiffer)
+			if err != nil {
+				return result, fmt.Errorf("Error writing remediation. err=%v", err)
+			}
+		}
+	} else {
+		fmt.Printf("Skipping mutation diff since it has been disabled\n")
+	}
+
+	difftool.setPhase(PhaseDone)
+	return result, nil
+}
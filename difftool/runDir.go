@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/utils"
+)
+
+// Creates the directory of the run under runsDir and points checkpointFileDir, fileDifferDir and mutationDifferDir
+// into it. A run ID that is not given is taken from startTime, with a suffix if a run started in the same second
+// A run ID that is given may be that of an earlier run, to resume it
+func (c *Config) setupRunDir(startTime time.Time) error {
+	if err := os.MkdirAll(c.RunsDir, 0777); err != nil {
+		return err
+	}
+	if c.RunId != "" {
+		if err := os.MkdirAll(utils.JoinPath(c.RunsDir, c.RunId), 0777); err != nil {
+			return err
+		}
+	} else {
+		timeId := startTime.Format(base.RunIdTimeFormat)
+		c.RunId = timeId
+		for i := 1; ; i++ {
+			err := os.Mkdir(utils.JoinPath(c.RunsDir, c.RunId), 0777)
+			if err == nil {
+				break
+			}
+			if !os.IsExist(err) {
+				return err
+			}
+			c.RunId = fmt.Sprintf("%v-%v", timeId, i)
+		}
+	}
+
+	runDir := utils.JoinPath(c.RunsDir, c.RunId)
+	c.CheckpointFileDir = utils.JoinPath(runDir, base.CheckpointFileDir)
+	c.FileDifferDir = utils.JoinPath(runDir, base.FileDifferDir)
+	c.MutationDifferDir = utils.JoinPath(runDir, base.MutationDifferDir)
+	return nil
+}
+
+// Returns the manifests of the runs under runsDir, the newest first. Directories without a readable manifest were not
+// created by a run, and are left out
+func listRuns(runsDir string) ([]*RunManifest, error) {
+	entries, err := os.ReadDir(runsDir)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*RunManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifestBytes, err := os.ReadFile(utils.JoinPath(runsDir, entry.Name(), base.MutationDifferDir, base.RunManifestFileName))
+		if err != nil {
+			continue
+		}
+		manifest := &RunManifest{}
+		if err = json.Unmarshal(manifestBytes, manifest); err != nil || manifest.RunId != entry.Name() {
+			continue
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return manifests[i].StartTime.After(manifests[j].StartTime)
+	})
+	return manifests, nil
+}
+
+// Removes the directories of all but the retention most recent runs under runsDir. The current run is always kept
+func removeOldRuns(runsDir string, retention uint64, currentRunId string) ([]string, error) {
+	if retention == 0 {
+		return nil, nil
+	}
+	manifests, err := listRuns(runsDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	kept := uint64(0)
+	for _, manifest := range manifests {
+		if manifest.RunId == currentRunId || kept < retention {
+			kept++
+			continue
+		}
+		if err = os.RemoveAll(utils.JoinPath(runsDir, manifest.RunId)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, manifest.RunId)
+	}
+	return removed, nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+)
+
+func TestRunDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	runsDir := t.TempDir()
+	startTime := time.Date(2024, 6, 1, 2, 0, 0, 0, time.UTC)
+	var runIds []string
+	for i := 0; i < 3; i++ {
+		config := DefaultConfig()
+		config.RunsDir = runsDir
+		runStartTime := startTime.Add(time.Duration(i/2) * time.Hour)
+		assert.Nil(config.setupRunDir(runStartTime))
+		assert.Equal(filepath.Join(runsDir, config.RunId, base.MutationDifferDir), config.MutationDifferDir)
+		assert.Nil(newRunManifest(config, runStartTime).write(config.MutationDifferDir))
+		runIds = append(runIds, config.RunId)
+	}
+	// The first two started in the same second
+	assert.Equal([]string{"20240601-020000", "20240601-020000-1", "20240601-030000"}, runIds)
+
+	// Not created by a run
+	assert.Nil(os.Mkdir(filepath.Join(runsDir, "other"), 0777))
+
+	manifests, err := listRuns(runsDir)
+	assert.Nil(err)
+	assert.Len(manifests, 3)
+	assert.Equal("20240601-030000", manifests[0].RunId)
+
+	removed, err := removeOldRuns(runsDir, 1, "20240601-020000")
+	assert.Nil(err)
+	assert.Equal([]string{"20240601-020000-1"}, removed)
+	entries, err := os.ReadDir(runsDir)
+	assert.Nil(err)
+	assert.Len(entries, 3)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"github.com/couchbase/goxdcr/metadata"
+	"xdcrDiffer/base"
+	"xdcrDiffer/objectStore"
+	"xdcrDiffer/utils"
+)
+
+// Outcome of one of the checks that SelfCheck runs
+type SelfCheckResult struct {
+	Check  string
+	Passed bool
+	// What was checked if it passed, or why it failed
+	Detail string
+}
+
+// What SelfCheck found, in the order the checks were run
+type SelfCheckReport struct {
+	Results []*SelfCheckResult
+}
+
+func (r *SelfCheckReport) add(check, detail string, err error) {
+	result := &SelfCheckResult{Check: check, Passed: err == nil, Detail: detail}
+	if err != nil {
+		result.Detail = err.Error()
+	}
+	r.Results = append(r.Results, result)
+}
+
+// Number of checks that failed
+func (r *SelfCheckReport) NumFailed() int {
+	var failed int
+	for _, result := range r.Results {
+		if !result.Passed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// A table of the checks, with whether each passed or failed
+func (r *SelfCheckReport) String() string {
+	var builder strings.Builder
+	writer := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "CHECK\tRESULT\tDETAIL\n")
+	for _, result := range r.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", result.Check, status, result.Detail)
+	}
+	writer.Flush()
+	return builder.String()
+}
+
+// Permissions the tool needs on each bucket, checked one by one so that the report tells which is missing
+var selfCheckPermissions = []struct {
+	check      string
+	permission string
+}{
+	{"DCP open", "cluster.bucket[%v].data.dcp!read"},
+	{"stats access", "cluster.bucket[%v].stats!read"},
+	{"data read", "cluster.bucket[%v].data.docs!read"},
+}
+
+// SelfCheck verifies what a run needs before any long work begins: that both clusters can be reached, that the
+// buckets exist, that the credentials may open DCP streams, read stats and read docs on them, that the working
+// directories can be written to and that the file descriptor limit is high enough. Checks that fail are reported,
+// rather than returned as errors, so that all of them are run. The working directories are created if missing
+func SelfCheck(ctx context.Context, cfg *Config) (*SelfCheckReport, error) {
+	config := *cfg
+	config.resolveConnectionStrings()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	base.SetNetworkType(config.Network)
+	base.SetRedactionLevel(config.RedactionLevel)
+
+	report := &SelfCheckReport{}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	selfCheckClusters(ctx, &config, report)
+	selfCheckDirectories(&config, report)
+	selfCheckFileDescLimit(&config, report)
+	return report, nil
+}
+
+func selfCheckClusters(ctx context.Context, config *Config, report *SelfCheckReport) {
+	difftool, err := newDiffTool(ctx, config)
+	if err != nil {
+		report.add("cluster connectivity", "", fmt.Errorf("Error creating difftool: %v", err))
+		return
+	}
+	if difftool.legacyMode {
+		if err = difftool.populateTemporarySpecAndRef(); err != nil {
+			report.add("cluster connectivity", "", err)
+			return
+		}
+	}
+	if difftool.specifiedRef == nil {
+		report.add("cluster connectivity", "", fmt.Errorf("unable to find the remote cluster reference"))
+		return
+	}
+	difftool.selfCheckCluster(report, "source", difftool.selfRef, config.SourceBucketName)
+	difftool.selfCheckCluster(report, "target", difftool.specifiedRef, config.TargetBucketName)
+}
+
+// Stops at the first check that the rest depend on
+func (difftool *xdcrDiffTool) selfCheckCluster(report *SelfCheckReport, clusterName string, ref *metadata.RemoteClusterReference, bucketName string) {
+	connStr, err := ref.MyConnectionStr()
+	if err == nil {
+		_, err = difftool.utils.GetClusterInfo(connStr, xdcrBase.DefaultPoolPath, ref.UserName(), ref.Password(), ref.HttpAuthMech(),
+			ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	}
+	report.add(clusterName+" connectivity", connStr, err)
+	if err != nil {
+		return
+	}
+
+	_, _, _, _, _, _, err = difftool.utils.BucketValidationInfo(connStr, bucketName, ref.UserName(), ref.Password(),
+		ref.HttpAuthMech(), ref.Certificates(), ref.SANInCertificate(), ref.ClientCertificate(), ref.ClientKey(), difftool.logger)
+	report.add(clusterName+" bucket exists", bucketName, err)
+	if err != nil {
+		return
+	}
+
+	var permissions []string
+	for _, permission := range selfCheckPermissions {
+		permissions = append(permissions, fmt.Sprintf(permission.permission, bucketName))
+	}
+	missing, err := difftool.missingPermissions(clusterName, connStr, ref, permissions)
+	if err != nil {
+		report.add(clusterName+" permissions", "", err)
+		return
+	}
+	for i, permission := range selfCheckPermissions {
+		err = nil
+		for _, missingPermission := range missing {
+			if missingPermission == permissions[i] {
+				err = fmt.Errorf("user %v is missing permission %v", ref.UserName(), permissions[i])
+			}
+		}
+		report.add(fmt.Sprintf("%v %v", clusterName, permission.check), permissions[i], err)
+	}
+}
+
+// Data file dirs in object storage are only reached once data generation starts, so they are not checked
+func selfCheckDirectories(config *Config, report *SelfCheckReport) {
+	for _, dir := range []struct {
+		option string
+		dir    string
+	}{
+		{"sourceFileDir", config.SourceFileDir},
+		{"targetFileDir", config.TargetFileDir},
+		{"fileDifferDir", config.FileDifferDir},
+		{"mutationDifferDir", config.MutationDifferDir},
+		{"checkpointFileDir", config.CheckpointFileDir},
+		{"remediationDir", config.RemediationDir},
+	} {
+		if dir.dir == "" || objectStore.IsURI(dir.dir) {
+			continue
+		}
+		report.add(dir.option+" write access", dir.dir, checkDirWritable(dir.dir))
+	}
+}
+
+// Creates the directory if missing, then writes and removes a file in it
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".selfCheck")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte("xdcrDiffer check"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func selfCheckFileDescLimit(config *Config, report *SelfCheckReport) {
+	limit, err := utils.FileDescLimit()
+	if err != nil {
+		report.add("file descriptor limit", "", err)
+		return
+	}
+	needed := selfCheckFileDescNeeded(config)
+	if limit < needed {
+		err = fmt.Errorf("limit of %v is below the %v file descriptors needed. Raise it with ulimit -n, or lower numberOfFileDesc", limit, needed)
+	}
+	report.add("file descriptor limit", fmt.Sprintf("limit of %v, %v needed", limit, needed), err)
+}
+
+// The file descriptor pool, or all the data files when there is none, on top of what autoTune reserves for
+// connections, logs and checkpoints. autoTune sizes the pool to the limit itself
+func selfCheckFileDescNeeded(config *Config) uint64 {
+	needed := uint64(base.AutoTuneReservedFileDesc)
+	switch {
+	case config.AutoTune || config.DataStore != base.DataStoreFiles:
+	case config.NumberOfFileDesc > 0:
+		needed += config.NumberOfFileDesc
+	default:
+		needed += 2 * uint64(config.vbucketRange().Count()) * config.NumberOfBins
+	}
+	return needed
+}
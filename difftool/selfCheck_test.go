@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package difftool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+)
+
+func TestSelfCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	report := &SelfCheckReport{}
+	report.add("source connectivity", "http://localhost:8091", nil)
+	report.add("target bucket exists", "", fmt.Errorf("bucket not found"))
+	assert.Equal(1, report.NumFailed())
+	lines := strings.Split(strings.TrimSuffix(report.String(), "\n"), "\n")
+	assert.Len(lines, 3)
+	assert.True(strings.HasPrefix(lines[1], "source connectivity   PASS    http://localhost:8091"))
+	assert.True(strings.HasPrefix(lines[2], "target bucket exists  FAIL    bucket not found"))
+
+	dir := filepath.Join(t.TempDir(), "fileDiffer")
+	assert.Nil(checkDirWritable(dir))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(entries, 0)
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(os.WriteFile(file, nil, base.FileModeReadWrite))
+	assert.NotNil(checkDirWritable(file))
+
+	config := DefaultConfig()
+	config.NumberOfFileDesc = 0
+	config.NumberOfBins = 2
+	assert.Equal(uint64(base.AutoTuneReservedFileDesc+2*base.NumberOfVbuckets*2), selfCheckFileDescNeeded(config))
+	config.NumberOfFileDesc = 100
+	assert.Equal(uint64(base.AutoTuneReservedFileDesc+100), selfCheckFileDescNeeded(config))
+	config.AutoTune = true
+	assert.Equal(uint64(base.AutoTuneReservedFileDesc), selfCheckFileDescNeeded(config))
+}
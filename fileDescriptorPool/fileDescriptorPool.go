@@ -10,14 +10,20 @@
 package fileDescriptorPool
 
 import (
+	"container/list"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /**
  * A portable file descriptor pool that allows the caller to run file ops without worrying about
  * going over the max number of open files
+ * When all fds are in use, the least recently used file that is not in the middle of an op is closed to free one
+ * Callers that still have to wait are given fds in the order they asked for them, so no file is starved
  */
 type FdPoolIface interface {
 	RegisterFileHandle(fileName string) (FileOp, FileOp, error) // Read, Write, err
@@ -36,12 +42,23 @@ const (
 type FileOp func([]byte) (int, error)
 
 type FdPool struct {
-	mtx    sync.Mutex
-	curFds uint64
-	fdMap  map[string]*internalFd
+	// Counters for the status report, accessed atomically
+	numWaits     uint64
+	numEvictions uint64
+	waitNanos    uint64
+
+	mtx   sync.Mutex
+	fdMap map[string]*internalFd
 
-	fdsInUseChan chan (*internalFd)
-	fdNeedsOpen  chan bool
+	// Guards the fields below, and the lruElem of each fd. Taken after the mtx of an fd, never before
+	fdsMtx sync.Mutex
+	// Number of fds given out, kept at most maxFds
+	curFds uint64
+	maxFds uint64
+	// Open files, the least recently used at the front
+	lru *list.List
+	// Channels of the callers waiting for an fd, the first to ask at the front
+	waiters *list.List
 }
 
 type internalFd struct {
@@ -50,23 +67,168 @@ type internalFd struct {
 	state      State
 	mtx        sync.Mutex
 
-	// Channels to file descriptor pool to request open or ask someone to give up their open fds
-	requestOpenChan *(chan (*internalFd))
-	requestRelease  *(chan bool)
-	exitChan        chan bool
-
-	wg sync.WaitGroup
+	pool *FdPool
+	// Position in pool.lru while open
+	lruElem *list.Element
+	// Where reads resume from when the file is opened again after being closed to free its fd
+	readOffset int64
 }
 
 func NewFileDescriptorPool(maxFds int) *FdPool {
 	pool := &FdPool{
-		fdMap:        make(map[string]*internalFd),
-		fdsInUseChan: make(chan *internalFd, maxFds),
-		fdNeedsOpen:  make(chan bool),
+		fdMap:   make(map[string]*internalFd),
+		maxFds:  uint64(maxFds),
+		lru:     list.New(),
+		waiters: list.New(),
 	}
 	return pool
 }
 
+// Changes the max number of open fds. Callers waiting for an fd get one right away when it grows. When it shrinks,
+// the least recently used files are closed until it is met, apart from those in the middle of an op
+func (fdp *FdPool) Resize(maxFds int) {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	fdp.maxFds = uint64(maxFds)
+	fdp.shrinkNoLock()
+	fdp.serveWaitersNoLock()
+}
+
+func (fdp *FdPool) MaxFds() uint64 {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	return fdp.maxFds
+}
+
+func (fdp *FdPool) NumOpenFds() uint64 {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	return fdp.curFds
+}
+
+// Number of times a file had to wait for an fd
+func (fdp *FdPool) NumWaits() uint64 {
+	return atomic.LoadUint64(&fdp.numWaits)
+}
+
+// Number of open files closed to give their fd to another file
+func (fdp *FdPool) NumEvictions() uint64 {
+	return atomic.LoadUint64(&fdp.numEvictions)
+}
+
+// Total time files have waited for an fd, in milliseconds
+func (fdp *FdPool) WaitTimeMs() uint64 {
+	return atomic.LoadUint64(&fdp.waitNanos) / uint64(time.Millisecond)
+}
+
+// Takes an fd if one is free and no one is waiting for one already, without closing any file
+func (fdp *FdPool) tryAcquire() bool {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	if fdp.waiters.Len() == 0 && fdp.curFds < fdp.maxFds {
+		fdp.curFds++
+		return true
+	}
+	return false
+}
+
+// Takes an fd, closing the least recently used file if none are free. If all open files are in the middle of an op,
+// waits for one behind the callers that are already waiting. The mtx of the calling fd must be held
+func (fdp *FdPool) acquire() {
+	fdp.fdsMtx.Lock()
+	if fdp.waiters.Len() == 0 {
+		fdp.shrinkNoLock()
+		if fdp.curFds < fdp.maxFds {
+			fdp.curFds++
+			fdp.fdsMtx.Unlock()
+			return
+		}
+		if fdp.evictNoLock() {
+			// The fd of the evicted file is taken over as is
+			fdp.fdsMtx.Unlock()
+			return
+		}
+	}
+	given := make(chan bool, 1)
+	fdp.waiters.PushBack(given)
+	fdp.fdsMtx.Unlock()
+
+	atomic.AddUint64(&fdp.numWaits, 1)
+	start := time.Now()
+	<-given
+	atomic.AddUint64(&fdp.waitNanos, uint64(time.Since(start)))
+}
+
+// Gives back the fd of a file that has been closed, or that could not be opened
+func (fdp *FdPool) release(fd *internalFd) {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	if fd.lruElem != nil {
+		fdp.lru.Remove(fd.lruElem)
+		fd.lruElem = nil
+	}
+	if fdp.curFds > 0 {
+		fdp.curFds--
+	}
+	fdp.serveWaitersNoLock()
+}
+
+// Gives waiting callers the fds that are free or can be freed, as files that were in the middle of an op become
+// idle. Must be called without holding the mtx of any fd, so that the files just used can be closed
+func (fdp *FdPool) serveWaiters() {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	fdp.serveWaitersNoLock()
+}
+
+func (fdp *FdPool) serveWaitersNoLock() {
+	for fdp.waiters.Len() > 0 {
+		if fdp.curFds < fdp.maxFds {
+			fdp.curFds++
+		} else if !fdp.evictNoLock() {
+			return
+		}
+		given := fdp.waiters.Remove(fdp.waiters.Front()).(chan bool)
+		given <- true
+	}
+}
+
+// Marks the fd as the most recently used one. Its mtx must be held
+func (fdp *FdPool) touch(fd *internalFd) {
+	fdp.fdsMtx.Lock()
+	defer fdp.fdsMtx.Unlock()
+	if fd.lruElem == nil {
+		fd.lruElem = fdp.lru.PushBack(fd)
+	} else {
+		fdp.lru.MoveToBack(fd.lruElem)
+	}
+}
+
+// Closes the least recently used files, and gives back their fds, while more than maxFds are open
+func (fdp *FdPool) shrinkNoLock() {
+	for fdp.curFds > fdp.maxFds && fdp.evictNoLock() {
+		fdp.curFds--
+	}
+}
+
+// Closes the least recently used file that is not in the middle of an op, so that its fd can be given to another
+// Returns false if there is none. The mtx of the files is only tried, as the order they are taken in is fd then pool
+func (fdp *FdPool) evictNoLock() bool {
+	for elem := fdp.lru.Front(); elem != nil; elem = elem.Next() {
+		fd := elem.Value.(*internalFd)
+		if !fd.mtx.TryLock() {
+			continue
+		}
+		fd.closeNoLock()
+		fdp.lru.Remove(elem)
+		fd.lruElem = nil
+		fd.mtx.Unlock()
+		atomic.AddUint64(&fdp.numEvictions, 1)
+		return true
+	}
+	return false
+}
+
 func (fdp *FdPool) RegisterFileHandle(fileName string) (FileOp, FileOp, error) {
 	fdp.mtx.Lock()
 	defer fdp.mtx.Unlock()
@@ -103,17 +265,17 @@ func (fdp *FdPool) registerInternalNoLock(fileName string) (*internalFd, error)
 	}
 
 	ifd := &internalFd{
-		fileName:        fileName,
-		state:           Closed,
-		requestOpenChan: &(fdp.fdsInUseChan),
-		requestRelease:  &(fdp.fdNeedsOpen),
-		exitChan:        make(chan bool, 1),
+		fileName: fileName,
+		state:    Closed,
+		pool:     fdp,
 	}
 	fdp.fdMap[fileName] = ifd
 
 	return ifd, nil
 }
 
+// Closes the file, giving back its fd, so that the file can be registered again, i.e. by the file differ once data
+// generation is done with it
 func (fdp *FdPool) DeRegisterFileHandle(fileName string) error {
 	fdp.mtx.Lock()
 	defer fdp.mtx.Unlock()
@@ -122,6 +284,7 @@ func (fdp *FdPool) DeRegisterFileHandle(fileName string) error {
 	if fd, ok = fdp.fdMap[fileName]; !ok {
 		return fmt.Errorf("FileName %v has not been registered", fileName)
 	}
+	delete(fdp.fdMap, fileName)
 	return fd.Close()
 }
 
@@ -131,16 +294,14 @@ func (fd *internalFd) InitOpen(readOnly bool) (err error) {
 	defer fd.mtx.Unlock()
 
 	if fd.state == Closed {
-		// Try to put itself in the fds to be in use. If not successful, request a release then try again
-		select {
-		case *fd.requestOpenChan <- fd:
+		if fd.pool.tryAcquire() {
 			// Got permission to open and stay open
 			err = fd.open(readOnly)
 			if err != nil {
 				fmt.Printf("Error opening file %v - %v\n", fd.fileName, err)
-				<-*fd.requestOpenChan
+				fd.pool.release(fd)
 			}
-		default:
+		} else {
 			// Hit the max limit so don't keep it open
 			err = fmt.Errorf("Not opened")
 		}
@@ -153,52 +314,47 @@ func (fd *internalFd) readWriteOpInternal(input []byte, read bool) (bytes int, e
 	defer fd.mtx.Unlock()
 
 	if fd.state == Closed {
-		// Try to put itself in the fds to be in use. If not successful, request a release then try again
-		select {
-		case *fd.requestOpenChan <- fd:
-			// Got permission to open and stay open
-			if read {
-				bytes, err = fd.openAndRead(input)
-			} else {
-				bytes, err = fd.openAndWrite(input)
-			}
-			if err != nil {
-				return
-			}
-		default:
-			*fd.requestRelease <- true // This will notify and block until someone frees up
-			*fd.requestOpenChan <- fd
-			if read {
-				bytes, err = fd.openAndRead(input)
-			} else {
-				bytes, err = fd.openAndWrite(input)
-			}
-			if err != nil {
-				return
-			}
+		// Wait for an fd, closing the least recently used file if there are none free
+		fd.pool.acquire()
+		err = fd.open(read)
+		if err != nil {
+			fd.pool.release(fd)
+			return
 		}
 	} else {
-		if read {
-			bytes, err = fd.fileHandle.Read(input)
-		} else {
-			bytes, err = fd.fileHandle.Write(input)
-		}
+		fd.pool.touch(fd)
+	}
+	if read {
+		bytes, err = fd.fileHandle.Read(input)
+		fd.readOffset += int64(bytes)
+	} else {
+		bytes, err = fd.fileHandle.Write(input)
 	}
 	return
 }
 
 func (fd *internalFd) Read(input []byte) (int, error) {
-	return fd.readWriteOpInternal(input, true /*read*/)
+	bytes, err := fd.readWriteOpInternal(input, true /*read*/)
+	fd.pool.serveWaiters()
+	return bytes, err
 }
 
 func (fd *internalFd) Write(input []byte) (bytesWritten int, err error) {
-	return fd.readWriteOpInternal(input, false /*read*/)
+	bytesWritten, err = fd.readWriteOpInternal(input, false /*read*/)
+	fd.pool.serveWaiters()
+	return
 }
 
-// Mtx needs to be held
+// Mtx needs to be held. Writes always append, and reads resume from where they were when the file was last closed
 func (fd *internalFd) open(readonly bool) (err error) {
 	if readonly {
 		fd.fileHandle, err = os.OpenFile(fd.fileName, os.O_RDONLY, 0444)
+		if err == nil && fd.readOffset > 0 {
+			_, err = fd.fileHandle.Seek(fd.readOffset, io.SeekStart)
+			if err != nil {
+				fd.fileHandle.Close()
+			}
+		}
 	} else {
 		fd.fileHandle, err = os.OpenFile(fd.fileName, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	}
@@ -206,68 +362,23 @@ func (fd *internalFd) open(readonly bool) (err error) {
 		return
 	}
 	fd.state = Open
-	fd.wg.Add(1)
-	go fd.waitForClose()
+	fd.pool.touch(fd)
 	return
 }
 
-// Mtx should be held
-func (fd *internalFd) openAndWrite(input []byte) (int, error) {
-	var err error
-	err = fd.open(false /*readonly*/)
-	if err != nil {
-		return 0, err
-	}
-
-	fd.state = Open
-	return fd.fileHandle.Write(input)
-}
-
-// Mtx should be held
-func (fd *internalFd) openAndRead(requested []byte) (int, error) {
-	var err error
-	err = fd.open(true /*readonly*/)
-	if err != nil {
-		return 0, err
-	}
-
-	fd.state = Open
-	return fd.fileHandle.Read(requested)
-}
-
 // External API only
 func (fd *internalFd) Close() error {
-	fd.exitChan <- true
-	fd.closeInternal()
-	fd.wg.Wait()
-	return nil
-}
-
-func (fd *internalFd) closeInternal() {
 	fd.mtx.Lock()
 	defer fd.mtx.Unlock()
 	if fd.state != Closed {
-		fd.fileHandle.Close()
-		fd.state = Closed
+		fd.closeNoLock()
+		fd.pool.release(fd)
 	}
+	return nil
 }
 
-func (fd *internalFd) waitForClose() {
-	defer fd.wg.Done()
-	select {
-	case <-*fd.requestRelease:
-		fd.closeInternal()
-		// Free up one fd from the max queue
-		select {
-		case <-*fd.requestOpenChan:
-		default:
-		}
-	case <-fd.exitChan:
-		// Exit path - no need for closeInternal() because this is only called by Close()
-		// Free up one fd from the max queue, if possible
-		select {
-		case <-*fd.requestOpenChan:
-		default:
-		}
-	}
+// Mtx needs to be held
+func (fd *internalFd) closeNoLock() {
+	fd.fileHandle.Close()
+	fd.state = Closed
 }
@@ -1,8 +1,10 @@
 package fileDescriptorPool
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -43,7 +45,7 @@ func TestFD(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(lenCheck, written)
 
-	assert.Equal(1, len(fdp.fdsInUseChan))
+	assert.Equal(uint64(1), fdp.NumOpenFds())
 	assert.Equal(2, len(fdp.fdMap))
 
 	//	fmt.Printf("Deregistering... ")
@@ -51,3 +53,151 @@ func TestFD(t *testing.T) {
 	fdp.DeRegisterFileHandle(testFile2)
 	//	fmt.Printf("Done\n ")
 }
+
+func TestFDResize(t *testing.T) {
+	assert := assert.New(t)
+	fdp := NewFileDescriptorPool(1)
+
+	testFile := "/tmp/poolResizeTest"
+	testFile2 := "/tmp/poolResizeTest2"
+
+	defer os.Remove(testFile)
+	defer os.Remove(testFile2)
+
+	_, cb, err := fdp.RegisterFileHandle(testFile)
+	assert.Nil(err)
+	_, cb2, err := fdp.RegisterFileHandle(testFile2)
+	assert.Nil(err)
+
+	testBytes := []byte("TestString")
+	_, err = cb(testBytes)
+	assert.Nil(err)
+	// File1 is idle, so it gives up its fd without file2 having to wait
+	_, err = cb2(testBytes)
+	assert.Nil(err)
+	assert.Equal(uint64(1), fdp.NumOpenFds())
+	assert.Equal(uint64(0), fdp.NumWaits())
+	assert.Equal(uint64(1), fdp.NumEvictions())
+
+	fdp.Resize(2)
+	assert.Equal(uint64(2), fdp.MaxFds())
+	_, err = cb(testBytes)
+	assert.Nil(err)
+	assert.Equal(uint64(2), fdp.NumOpenFds())
+	assert.Equal(uint64(0), fdp.NumWaits())
+	assert.Equal(uint64(1), fdp.NumEvictions())
+
+	fdp.Resize(1)
+	assert.Equal(uint64(1), fdp.NumOpenFds())
+	assert.Equal(uint64(2), fdp.NumEvictions())
+
+	fdp.DeRegisterFileHandle(testFile)
+	fdp.DeRegisterFileHandle(testFile2)
+	assert.Equal(uint64(0), fdp.NumOpenFds())
+}
+
+func TestFDReopenAtOffset(t *testing.T) {
+	assert := assert.New(t)
+	fdp := NewFileDescriptorPool(1)
+
+	testFile := "/tmp/poolOffsetTest"
+	testFile2 := "/tmp/poolOffsetTest2"
+
+	defer os.Remove(testFile)
+	defer os.Remove(testFile2)
+
+	assert.Nil(os.WriteFile(testFile, []byte("0123456789"), 0644))
+	assert.Nil(os.WriteFile(testFile2, []byte("abcdefghij"), 0644))
+
+	read, err := fdp.RegisterReadOnlyFileHandle(testFile)
+	assert.Nil(err)
+	read2, err := fdp.RegisterReadOnlyFileHandle(testFile2)
+	assert.Nil(err)
+
+	buf := make([]byte, 4)
+	_, err = read(buf)
+	assert.Nil(err)
+	assert.Equal("0123", string(buf))
+	// Evicts file1, which picks up from where it was once it gets an fd back
+	_, err = read2(buf)
+	assert.Nil(err)
+	assert.Equal("abcd", string(buf))
+	_, err = read(buf)
+	assert.Nil(err)
+	assert.Equal("4567", string(buf))
+	_, err = read2(buf)
+	assert.Nil(err)
+	assert.Equal("efgh", string(buf))
+	assert.Equal(uint64(3), fdp.NumEvictions())
+
+	fdp.DeRegisterFileHandle(testFile)
+	fdp.DeRegisterFileHandle(testFile2)
+}
+
+func TestFDRegisterAfterDeRegister(t *testing.T) {
+	assert := assert.New(t)
+	fdp := NewFileDescriptorPool(1)
+
+	testFile := "/tmp/poolReregisterTest"
+	defer os.Remove(testFile)
+
+	// Written by data generation, then read by the file differ through the same pool
+	_, write, err := fdp.RegisterFileHandle(testFile)
+	assert.Nil(err)
+	_, err = write([]byte("0123456789"))
+	assert.Nil(err)
+	assert.Nil(fdp.DeRegisterFileHandle(testFile))
+	assert.Equal(uint64(0), fdp.NumOpenFds())
+	assert.Equal(0, len(fdp.fdMap))
+	assert.Equal(0, fdp.lru.Len())
+
+	read, err := fdp.RegisterReadOnlyFileHandle(testFile)
+	assert.Nil(err)
+	buf := make([]byte, 10)
+	_, err = read(buf)
+	assert.Nil(err)
+	assert.Equal("0123456789", string(buf))
+	assert.Nil(fdp.DeRegisterFileHandle(testFile))
+	assert.NotNil(fdp.DeRegisterFileHandle(testFile))
+}
+
+func TestFDManyFilesFewFds(t *testing.T) {
+	assert := assert.New(t)
+	fdp := NewFileDescriptorPool(2)
+
+	numFiles := 20
+	numWrites := 50
+	testBytes := []byte("TestString")
+
+	var writes []FileOp
+	for i := 0; i < numFiles; i++ {
+		testFile := fmt.Sprintf("/tmp/poolManyTest%v", i)
+		defer os.Remove(testFile)
+		_, cb, err := fdp.RegisterFileHandle(testFile)
+		assert.Nil(err)
+		writes = append(writes, cb)
+	}
+
+	var wg sync.WaitGroup
+	for _, cb := range writes {
+		wg.Add(1)
+		go func(cb FileOp) {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				_, err := cb(testBytes)
+				assert.Nil(err)
+			}
+		}(cb)
+	}
+	wg.Wait()
+	assert.True(fdp.NumOpenFds() <= 2)
+
+	for i := 0; i < numFiles; i++ {
+		testFile := fmt.Sprintf("/tmp/poolManyTest%v", i)
+		info, err := os.Stat(testFile)
+		assert.Nil(err)
+		assert.Equal(int64(numWrites*len(testBytes)), info.Size())
+		fdp.DeRegisterFileHandle(testFile)
+	}
+	assert.Equal(uint64(0), fdp.NumOpenFds())
+}
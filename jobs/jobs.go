@@ -0,0 +1,428 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+	"xdcrDiffer/difftool"
+	"xdcrDiffer/utils"
+)
+
+const JobsPath = "/jobs"
+
+type JobState string
+
+const (
+	JobStateQueued    JobState = "queued"
+	JobStateRunning   JobState = "running"
+	JobStateSucceeded JobState = "succeeded"
+	JobStateFailed    JobState = "failed"
+	JobStateCanceled  JobState = "canceled"
+)
+
+// Job is what is reported of a diff job. The config of the job is not reported, as it holds the passwords
+type Job struct {
+	Id                string
+	State             JobState
+	SourceUrl         string
+	SourceBucketName  string
+	RemoteClusterName string
+	TargetUrl         string
+	TargetBucketName  string
+	// Holds the data files, checkpoints and results of the job
+	WorkDir    string
+	SubmitTime time.Time
+	StartTime  time.Time
+	EndTime    time.Time
+	Error      string               `json:",omitempty"`
+	Result     *difftool.DiffResult `json:",omitempty"`
+}
+
+type RunFunc func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error)
+
+type job struct {
+	Job
+	seq    uint64
+	config *difftool.Config
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Server accepts diff jobs over REST and runs up to maxParallelJobs of them at a time, in the order they were submitted
+// Each job runs in its own directory under workDir, so that jobs do not share data files, checkpoints or outputs
+// Logging, the network, redaction and the KV authentication mechanism are process wide, so jobs that may run at the
+// same time must agree on the last three
+//
+//	POST   /jobs       submits a job. The body holds the difftool.Config fields to set, on top of the default config
+//	GET    /jobs       lists the jobs
+//	GET    /jobs/<id>  reports a job, along with its result once it is done
+//	DELETE /jobs/<id>  cancels a job, which has the same effect on a running job as interrupting the command
+type Server struct {
+	addr            string
+	workDir         string
+	maxParallelJobs int
+	defaultConfig   difftool.Config
+	run             RunFunc
+	jobDone         func(j *Job)
+
+	mtx        sync.Mutex
+	jobs       map[string]*job
+	counter    uint64
+	queue      []*job
+	numRunning int
+	stopped    bool
+
+	listener   net.Listener
+	httpServer *http.Server
+	wg         sync.WaitGroup
+}
+
+// Jobs start from a copy of defaultConfig. maxParallelJobs is raised to 1 if it is not positive
+func NewServer(addr, workDir string, maxParallelJobs int, defaultConfig *difftool.Config) *Server {
+	if maxParallelJobs <= 0 {
+		maxParallelJobs = 1
+	}
+	return &Server{
+		addr:            addr,
+		workDir:         workDir,
+		maxParallelJobs: maxParallelJobs,
+		defaultConfig:   *defaultConfig,
+		run:             difftool.Run,
+		jobs:            make(map[string]*job),
+	}
+}
+
+// Must be called before Start()
+func (s *Server) SetRunFunc(run RunFunc) {
+	s.run = run
+}
+
+// Sets a func to be called with each job once it is done, whether it succeeded, failed or was canceled
+// Must be called before Start()
+func (s *Server) SetJobDoneFunc(jobDone func(j *Job)) {
+	s.jobDone = jobDone
+}
+
+// Does not serve REST when addr is empty, in which case jobs are only submitted through Submit()
+func (s *Server) Start() error {
+	err := os.MkdirAll(s.workDir, 0777)
+	if err != nil {
+		return err
+	}
+	if s.addr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle(JobsPath, s)
+	mux.Handle(JobsPath+"/", s)
+	s.httpServer = &http.Server{Handler: mux}
+	go s.httpServer.Serve(listener)
+	return nil
+}
+
+// Returns the address the server listens on, which is useful when started on port 0
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.addr
+	}
+	return s.listener.Addr().String()
+}
+
+// Stops accepting jobs, cancels the jobs that are queued or running and waits for them to return, and for the
+// job done func to return for each of them
+func (s *Server) Stop() error {
+	var err error
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = s.httpServer.Shutdown(ctx)
+	}
+	s.mtx.Lock()
+	s.stopped = true
+	for _, j := range s.jobs {
+		j.cancel()
+	}
+	for _, j := range s.queue {
+		s.finishJob(j, nil, j.ctx.Err())
+	}
+	s.queue = nil
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, JobsPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		s.handleSubmit(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, s.List())
+	case id != "" && r.Method == http.MethodGet:
+		j, ok := s.Get(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("job %v not found", id), http.StatusNotFound)
+			return
+		}
+		writeJson(w, http.StatusOK, j)
+	case id != "" && r.Method == http.MethodDelete:
+		if !s.Cancel(id) {
+			http.Error(w, fmt.Sprintf("job %v not found", id), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, fmt.Sprintf("%v is not supported on %v", r.Method, r.URL.Path), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	config := s.defaultConfig
+	decoder := json.NewDecoder(r.Body)
+	// Catch misspelled options, which would otherwise silently take their default
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.Submit(&config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, http.StatusCreated, j)
+}
+
+// Validates the config and queues the job. The directories of the config are replaced by those of the job, and the output
+// sink files are kept in the job directory under the names given
+func (s *Server) Submit(config *difftool.Config) (*Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.stopped {
+		return nil, fmt.Errorf("the server is stopped")
+	}
+
+	s.counter++
+	id := fmt.Sprintf("%v-%v", time.Now().Format("20060102150405"), s.counter)
+	jobDir := utils.JoinPath(s.workDir, id)
+	jobConfig := *config
+	jobConfig.SourceFileDir = utils.JoinPath(jobDir, base.SourceFileDir)
+	jobConfig.TargetFileDir = utils.JoinPath(jobDir, base.TargetFileDir)
+	jobConfig.CheckpointFileDir = utils.JoinPath(jobDir, base.CheckpointFileDir)
+	jobConfig.FileDifferDir = utils.JoinPath(jobDir, base.FileDifferDir)
+	jobConfig.MutationDifferDir = utils.JoinPath(jobDir, base.MutationDifferDir)
+	if jobConfig.RemediationDir != "" {
+		jobConfig.RemediationDir = utils.JoinPath(jobDir, base.RemediationDir)
+	}
+	if jobConfig.OutputSinkFile != "" {
+		jobConfig.OutputSinkFile = utils.JoinPath(jobDir, filepath.Base(jobConfig.OutputSinkFile))
+	}
+	if jobConfig.OutputSinkSqlite != "" {
+		jobConfig.OutputSinkSqlite = utils.JoinPath(jobDir, filepath.Base(jobConfig.OutputSinkSqlite))
+	}
+	// The job directory already keeps the results of each job apart
+	jobConfig.RunsDir = ""
+	jobConfig.RunId = ""
+	jobConfig.RunRetention = 0
+	// These are served by the process, and would conflict between jobs
+	jobConfig.Dashboard = false
+	jobConfig.StatusAddr = ""
+	if jobConfig.AllReplications {
+		return nil, fmt.Errorf("allReplications is not supported for jobs. Submit a job per replication instead")
+	}
+	if err := jobConfig.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.checkProcessWideOptions(&jobConfig); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		Job: Job{
+			Id:                id,
+			State:             JobStateQueued,
+			SourceUrl:         jobConfig.SourceUrl,
+			SourceBucketName:  jobConfig.SourceBucketName,
+			RemoteClusterName: jobConfig.RemoteClusterName,
+			TargetUrl:         jobConfig.TargetUrl,
+			TargetBucketName:  jobConfig.TargetBucketName,
+			WorkDir:           jobDir,
+			SubmitTime:        time.Now(),
+		},
+		seq:    s.counter,
+		config: &jobConfig,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.jobs[id] = j
+	s.queue = append(s.queue, j)
+	s.startQueuedJobs()
+
+	jobCopy := j.Job
+	return &jobCopy, nil
+}
+
+// With parallel jobs, rejects a job that does not agree with the jobs queued or running on the options that are set for
+// the whole process, as whichever job started last would otherwise apply its own to the others
+// Must be called with mtx held
+func (s *Server) checkProcessWideOptions(config *difftool.Config) error {
+	if s.maxParallelJobs == 1 {
+		return nil
+	}
+	for _, j := range s.jobs {
+		if j.State != JobStateQueued && j.State != JobStateRunning {
+			continue
+		}
+		switch {
+		case config.Network != j.config.Network:
+			return fmt.Errorf("network %q differs from %q of job %v. It is set for the whole process", config.Network, j.config.Network, j.Id)
+		case config.RedactionLevel != j.config.RedactionLevel:
+			return fmt.Errorf("redactionLevel %q differs from %q of job %v. It is set for the whole process", config.RedactionLevel, j.config.RedactionLevel, j.Id)
+		case config.KvAuthMechanism != j.config.KvAuthMechanism:
+			return fmt.Errorf("kvAuthMechanism %q differs from %q of job %v. It is set for the whole process", config.KvAuthMechanism, j.config.KvAuthMechanism, j.Id)
+		}
+	}
+	return nil
+}
+
+// Starts jobs in the order they were submitted, as long as fewer than maxParallelJobs are running
+// Must be called with mtx held
+func (s *Server) startQueuedJobs() {
+	for s.numRunning < s.maxParallelJobs && len(s.queue) > 0 {
+		j := s.queue[0]
+		s.queue = s.queue[1:]
+		s.numRunning++
+		j.State = JobStateRunning
+		j.StartTime = time.Now()
+		s.wg.Add(1)
+		go s.runJob(j)
+	}
+}
+
+func (s *Server) runJob(j *job) {
+	defer s.wg.Done()
+	result, err := s.run(j.ctx, j.config)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j.cancel()
+	s.finishJob(j, result, err)
+	s.numRunning--
+	if !s.stopped {
+		s.startQueuedJobs()
+	}
+}
+
+// Must be called with mtx held
+func (s *Server) finishJob(j *job, result *difftool.DiffResult, err error) {
+	j.EndTime = time.Now()
+	j.Result = result
+	switch {
+	case err == nil:
+		j.State = JobStateSucceeded
+	case j.ctx.Err() != nil && err == j.ctx.Err():
+		j.State = JobStateCanceled
+		j.Error = err.Error()
+	default:
+		j.State = JobStateFailed
+		j.Error = err.Error()
+	}
+	if s.jobDone != nil {
+		jobCopy := j.Job
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.jobDone(&jobCopy)
+		}()
+	}
+}
+
+// Returns false if there is no such job. Canceling a job that is done has no effect
+func (s *Server) Cancel(id string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return false
+	}
+	j.cancel()
+	if j.State == JobStateQueued {
+		for i, queued := range s.queue {
+			if queued == j {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+		s.finishJob(j, nil, j.ctx.Err())
+	}
+	return true
+}
+
+func (s *Server) Get(id string) (*Job, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	jobCopy := j.Job
+	return &jobCopy, true
+}
+
+// Returns the jobs in the order they were submitted
+func (s *Server) List() []*Job {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].seq < jobs[k].seq
+	})
+	list := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		jobCopy := j.Job
+		list = append(list, &jobCopy)
+	}
+	return list
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(bytes)
+}
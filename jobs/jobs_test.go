@@ -0,0 +1,262 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"xdcrDiffer/base"
+	"xdcrDiffer/differ"
+	"xdcrDiffer/difftool"
+	"xdcrDiffer/utils"
+)
+
+func waitForState(server *Server, id string, state JobState) *Job {
+	for i := 0; i < 100; i++ {
+		if j, _ := server.Get(id); j.State == state {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	j, _ := server.Get(id)
+	return j
+}
+
+func TestJobsRunInOrder(t *testing.T) {
+	assert := assert.New(t)
+	workDir, err := os.MkdirTemp("", "jobsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	release := make(chan bool)
+	var started []string
+	server := NewServer("127.0.0.1:0", workDir, 1, difftool.DefaultConfig())
+	server.SetRunFunc(func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error) {
+		started = append(started, config.SourceBucketName)
+		<-release
+		return &difftool.DiffResult{MutationDiff: &differ.MutationDiffSummary{KeysChecked: 10}}, nil
+	})
+
+	config := difftool.DefaultConfig()
+	config.SourceBucketName = "B1"
+	first, err := server.Submit(config)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(first.WorkDir, workDir))
+	config.SourceBucketName = "B2"
+	second, err := server.Submit(config)
+	assert.Nil(err)
+	assert.NotEqual(first.WorkDir, second.WorkDir)
+
+	assert.Equal(JobStateRunning, waitForState(server, first.Id, JobStateRunning).State)
+	j, _ := server.Get(second.Id)
+	assert.Equal(JobStateQueued, j.State)
+
+	release <- true
+	assert.Equal(JobStateSucceeded, waitForState(server, first.Id, JobStateSucceeded).State)
+	assert.Equal(JobStateRunning, waitForState(server, second.Id, JobStateRunning).State)
+	assert.True(server.Cancel(second.Id))
+	release <- true
+	j = waitForState(server, second.Id, JobStateSucceeded)
+	assert.Equal(10, j.Result.MutationDiff.KeysChecked)
+	assert.Equal([]string{"B1", "B2"}, started)
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	assert := assert.New(t)
+	workDir, err := os.MkdirTemp("", "jobsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	server := NewServer("127.0.0.1:0", workDir, 1, difftool.DefaultConfig())
+	server.SetRunFunc(func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	first, err := server.Submit(difftool.DefaultConfig())
+	assert.Nil(err)
+	second, err := server.Submit(difftool.DefaultConfig())
+	assert.Nil(err)
+	assert.True(server.Cancel(second.Id))
+	assert.Equal(JobStateCanceled, waitForState(server, second.Id, JobStateCanceled).State)
+	assert.False(server.Cancel("unknown"))
+
+	server.Stop()
+	j, _ := server.Get(first.Id)
+	assert.Equal(JobStateCanceled, j.State)
+}
+
+func TestParallelJobsDoNotShareOutputs(t *testing.T) {
+	assert := assert.New(t)
+	workDir, err := os.MkdirTemp("", "jobsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	server := NewServer("", workDir, 2, difftool.DefaultConfig())
+	server.SetRunFunc(func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer server.Stop()
+
+	config := difftool.DefaultConfig()
+	config.OutputSinkFile = "/tmp/diffs.json"
+	config.RemediationDir = "/tmp/remediation"
+	first, err := server.Submit(config)
+	assert.Nil(err)
+	server.mtx.Lock()
+	firstConfig := *server.jobs[first.Id].config
+	server.mtx.Unlock()
+	assert.Equal(utils.JoinPath(first.WorkDir, "diffs.json"), firstConfig.OutputSinkFile)
+	assert.Equal(utils.JoinPath(first.WorkDir, base.RemediationDir), firstConfig.RemediationDir)
+	assert.Equal("", firstConfig.OutputSinkSqlite)
+
+	// Network, redaction and the KV auth mechanism are set for the whole process
+	config = difftool.DefaultConfig()
+	config.RedactionLevel = base.RedactionLevelFull
+	_, err = server.Submit(config)
+	assert.NotNil(err)
+	config = difftool.DefaultConfig()
+	config.KvAuthMechanism = "SCRAM-SHA512"
+	_, err = server.Submit(config)
+	assert.NotNil(err)
+
+	// Unless the jobs that differ are done
+	assert.True(server.Cancel(first.Id))
+	waitForState(server, first.Id, JobStateCanceled)
+	_, err = server.Submit(config)
+	assert.Nil(err)
+}
+
+func TestSubmitOverHttp(t *testing.T) {
+	assert := assert.New(t)
+	workDir, err := os.MkdirTemp("", "jobsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	server := NewServer("127.0.0.1:0", workDir, 2, difftool.DefaultConfig())
+	server.SetRunFunc(func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error) {
+		return &difftool.DiffResult{}, nil
+	})
+	assert.Nil(server.Start())
+	defer server.Stop()
+	url := "http://" + server.Addr() + JobsPath
+
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(`{"SourceBucketName": "B1", "TargetBucketName": "B2"}`))
+	assert.Nil(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	var submitted Job
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&submitted))
+	resp.Body.Close()
+	assert.Equal("B2", submitted.TargetBucketName)
+
+	resp, err = http.Post(url, "application/json", bytes.NewBufferString(`{"SourceBucket": "B1"}`))
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	waitForState(server, submitted.Id, JobStateSucceeded)
+	resp, err = http.Get(url)
+	assert.Nil(err)
+	var list []*Job
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&list))
+	resp.Body.Close()
+	assert.Len(list, 1)
+	assert.Equal(JobStateSucceeded, list[0].State)
+
+	resp, err = http.Get(url + "/unknown")
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	schedule, err := ParseSchedule("0 2 * * *")
+	assert.Nil(err)
+	start := time.Date(2024, 3, 10, 1, 30, 15, 0, time.UTC)
+	assert.Equal(time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC), schedule.Next(start))
+	assert.Equal(time.Date(2024, 3, 11, 2, 0, 0, 0, time.UTC), schedule.Next(time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC)))
+
+	schedule, err = ParseSchedule("*/15 9-17 * * 1-5")
+	assert.Nil(err)
+	// Saturday
+	assert.Equal(time.Date(2024, 3, 11, 9, 0, 0, 0, time.UTC), schedule.Next(time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)))
+	assert.Equal(time.Date(2024, 3, 11, 9, 45, 0, 0, time.UTC), schedule.Next(time.Date(2024, 3, 11, 9, 31, 0, 0, time.UTC)))
+
+	// Either the 1st or a Sunday
+	schedule, err = ParseSchedule("30 0 1 * 0")
+	assert.Nil(err)
+	assert.Equal(time.Date(2024, 3, 3, 0, 30, 0, 0, time.UTC), schedule.Next(time.Date(2024, 3, 1, 1, 0, 0, 0, time.UTC)))
+
+	schedule, err = ParseSchedule("0 0 30 2 *")
+	assert.Nil(err)
+	assert.True(schedule.Next(start).IsZero())
+
+	for _, expr := range []string{"0 2 * *", "60 * * * *", "* * * * 7", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err = ParseSchedule(expr)
+		assert.NotNil(err, expr)
+	}
+}
+
+func TestSchedulerAlerts(t *testing.T) {
+	assert := assert.New(t)
+	workDir, err := os.MkdirTemp("", "jobsTest")
+	assert.Nil(err)
+	defer os.RemoveAll(workDir)
+
+	alerts := make(chan *Alert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		assert.Nil(json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- &alert
+	}))
+	defer webhook.Close()
+
+	numDiffs := []int{5, 20, 20}
+	server := NewServer("", workDir, 1, difftool.DefaultConfig())
+	server.SetRunFunc(func(ctx context.Context, config *difftool.Config) (*difftool.DiffResult, error) {
+		diffs := numDiffs[0]
+		numDiffs = numDiffs[1:]
+		return &difftool.DiffResult{MutationDiff: &differ.MutationDiffSummary{BodyMismatch: diffs}}, nil
+	})
+	schedule, err := ParseSchedule("0 2 * * *")
+	assert.Nil(err)
+	scheduler := NewScheduler(server, schedule, difftool.DefaultConfig(), webhook.URL, 10)
+	assert.Nil(server.Start())
+	defer server.Stop()
+
+	// Not alerted, as it is below the threshold
+	scheduler.submit()
+	// Not alerted, as it was not scheduled
+	_, err = server.Submit(difftool.DefaultConfig())
+	assert.Nil(err)
+	scheduler.submit()
+
+	select {
+	case alert := <-alerts:
+		assert.Equal(20, alert.NumDiffs)
+		assert.Equal(JobStateSucceeded, alert.Job.State)
+	case <-time.After(5 * time.Second):
+		assert.Fail("no alert")
+	}
+	server.Stop()
+	assert.Len(alerts, 0)
+}
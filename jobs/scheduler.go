@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"xdcrDiffer/difftool"
+)
+
+// What is posted to the alert webhook
+type Alert struct {
+	Job *Job
+	// Differences found by the job, see difftool.DiffResult.NumDiffs()
+	NumDiffs int
+}
+
+// Scheduler submits the same diff to a Server at each time of a schedule, so that each run keeps its results in its
+// own job directory. A run that is due while the previous ones are still running is queued behind them
+// Runs that fail, or that find more than alertThreshold differences, are alerted on by posting them to alertWebhook,
+// or by logging them if there is no webhook. A negative alertThreshold alerts on every run
+type Scheduler struct {
+	server         *Server
+	schedule       *Schedule
+	config         *difftool.Config
+	alertWebhook   string
+	alertThreshold int
+	client         *http.Client
+
+	mtx sync.Mutex
+	// Jobs submitted by the scheduler, as opposed to over REST
+	scheduledIds map[string]bool
+
+	finChan  chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Must be called before server.Start()
+func NewScheduler(server *Server, schedule *Schedule, config *difftool.Config, alertWebhook string, alertThreshold int) *Scheduler {
+	scheduler := &Scheduler{
+		server:         server,
+		schedule:       schedule,
+		config:         config,
+		alertWebhook:   alertWebhook,
+		alertThreshold: alertThreshold,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		scheduledIds:   make(map[string]bool),
+		finChan:        make(chan bool),
+	}
+	server.SetJobDoneFunc(scheduler.jobDone)
+	return scheduler
+}
+
+func (sc *Scheduler) Start() {
+	sc.wg.Add(1)
+	go sc.run()
+}
+
+// Stops submitting runs. Runs already submitted are stopped along with the server
+func (sc *Scheduler) Stop() {
+	sc.stopOnce.Do(func() {
+		close(sc.finChan)
+		sc.wg.Wait()
+	})
+}
+
+func (sc *Scheduler) run() {
+	defer sc.wg.Done()
+	for {
+		next := sc.schedule.Next(time.Now())
+		if next.IsZero() {
+			fmt.Printf("Schedule has no upcoming runs\n")
+			return
+		}
+		fmt.Printf("Next scheduled run at %v\n", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			sc.submit()
+		case <-sc.finChan:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (sc *Scheduler) submit() {
+	// Holding mtx until the ID is recorded, in case the job is done before Submit() returns
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	j, err := sc.server.Submit(sc.config)
+	if err != nil {
+		fmt.Printf("Unable to submit scheduled run: %v\n", err)
+		return
+	}
+	fmt.Printf("Submitted scheduled run %v\n", j.Id)
+	sc.scheduledIds[j.Id] = true
+}
+
+func (sc *Scheduler) jobDone(j *Job) {
+	sc.mtx.Lock()
+	scheduled := sc.scheduledIds[j.Id]
+	delete(sc.scheduledIds, j.Id)
+	sc.mtx.Unlock()
+	if !scheduled {
+		return
+	}
+
+	alert := &Alert{Job: j}
+	if j.Result != nil {
+		alert.NumDiffs = j.Result.NumDiffs()
+	}
+	if j.State == JobStateSucceeded && alert.NumDiffs <= sc.alertThreshold {
+		fmt.Printf("Scheduled run %v found %v differences\n", j.Id, alert.NumDiffs)
+		return
+	}
+
+	if sc.alertWebhook == "" {
+		if j.State != JobStateSucceeded {
+			fmt.Printf("ALERT: scheduled run %v %v: %v. Results so far are in %v\n", j.Id, j.State, j.Error, j.WorkDir)
+		} else {
+			fmt.Printf("ALERT: scheduled run %v found %v differences. Results are in %v\n", j.Id, alert.NumDiffs, j.WorkDir)
+		}
+		return
+	}
+	err := sc.postAlert(alert)
+	if err != nil {
+		fmt.Printf("Unable to post alert for scheduled run %v to %v: %v\n", j.Id, sc.alertWebhook, err)
+	}
+}
+
+func (sc *Scheduler) postAlert(alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := sc.client.Post(sc.alertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
@@ -10,556 +10,496 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"reflect"
-	"sync"
-	"sync/atomic"
+	"strings"
 	"time"
 
 	"xdcrDiffer/base"
-	"xdcrDiffer/dcp"
 	"xdcrDiffer/differ"
-	fdp "xdcrDiffer/fileDescriptorPool"
-	"xdcrDiffer/filterPool"
+	"xdcrDiffer/difftool"
+	"xdcrDiffer/jobs"
+	"xdcrDiffer/status"
 	"xdcrDiffer/utils"
 
-	xdcrBase "github.com/couchbase/goxdcr/base"
-	xdcrParts "github.com/couchbase/goxdcr/base/filter"
-	xdcrLog "github.com/couchbase/goxdcr/log"
-	"github.com/couchbase/goxdcr/metadata"
-	"github.com/couchbase/goxdcr/metadata_svc"
-	"github.com/couchbase/goxdcr/service_def"
-	service_def_mock "github.com/couchbase/goxdcr/service_def/mocks"
-	"github.com/couchbase/goxdcr/service_impl"
-	"github.com/couchbase/goxdcr/streamApiWatcher"
-	xdcrUtils "github.com/couchbase/goxdcr/utils"
-	"github.com/stretchr/testify/mock"
+	"golang.org/x/term"
 )
 
 var done = make(chan bool)
 
+// Options of the run itself, which are also the defaults of the command line options
+var config = difftool.DefaultConfig()
+
+// Options that only apply to the command line tool
 var options struct {
-	sourceUrl                         string
-	sourceUsername                    string
-	sourcePassword                    string
-	sourceBucketName                  string
-	remoteClusterName                 string
-	sourceFileDir                     string
-	targetUrl                         string
-	targetUsername                    string
-	targetPassword                    string
-	targetBucketName                  string
-	targetFileDir                     string
-	numberOfSourceDcpClients          uint64
-	numberOfWorkersPerSourceDcpClient uint64
-	numberOfTargetDcpClients          uint64
-	numberOfWorkersPerTargetDcpClient uint64
-	numberOfWorkersForFileDiffer      uint64
-	numberOfWorkersForMutationDiffer  uint64
-	numberOfBins                      uint64
-	numberOfFileDesc                  uint64
-	// the duration that the tools should be run, in minutes
-	completeByDuration uint64
-	// whether tool should complete after processing all mutations at tool start time
-	completeBySeqno bool
-	// directory for checkpoint files
-	checkpointFileDir string
-	// name of source cluster checkpoint file to load from when tool starts
-	// if not specified, source cluster will start from 0
-	oldSourceCheckpointFileName string
-	// name of target cluster checkpoint file to load from when tool starts
-	// if not specified, target cluster will start from 0
-	oldTargetCheckpointFileName string
-	// name of new checkpoint file to write to when tool shuts down
-	// if not specified, tool will not save checkpoint files
-	newCheckpointFileName string
-	// directory for storing diffs generated by file differ
-	fileDifferDir string
-	// output directory for mutation differ
-	mutationDifferDir string
-	// size of batch used by mutation differ
-	mutationDifferBatchSize uint64
-	// timeout, in seconds, used by mutation differ
-	mutationDifferTimeout uint64
-	// size of source dcp handler channel
-	sourceDcpHandlerChanSize uint64
-	// size of target dcp handler channel
-	targetDcpHandlerChanSize uint64
-	// timeout for bucket for stats collection, in seconds
-	bucketOpTimeout uint64
-	// max number of retry for get stats
-	maxNumOfGetStatsRetry uint64
-	// max number of retry for send batch
-	maxNumOfSendBatchRetry uint64
-	// retry interval for get stats, in seconds
-	getStatsRetryInterval uint64
-	// retry interval for send batch, in milliseconds
-	sendBatchRetryInterval uint64
-	// max backoff for get stats, in seconds
-	getStatsMaxBackoff uint64
-	// max backoff for send batch, in seconds
-	sendBatchMaxBackoff uint64
-	// delay between source cluster start up and target cluster start up, in seconds
-	delayBetweenSourceAndTarget uint64
-	//interval for periodical checkpointing, in seconds
-	// value of 0 indicates no periodical checkpointing
-	checkpointInterval uint64
-	// whether to run data generation
-	runDataGeneration bool
-	// whether to run file differ
-	runFileDiffer bool
-	// whether to verify diff keys through aysnc Get on clusters
-	runMutationDiffer bool
-	// Whether or not to enforce secure communications for data retrieval
-	enforceTLS bool
-	// Number of items kept in memory per binary buffer bucket
-	bucketBufferCapacity int
-	// Compare metadata, or body, or both
-	compareType string
-	// Number of times for mutationsDiffer to retry to resolve doc differences
-	mutationDifferRetries int
-	// Number of secs to wait between retries
-	mutationDifferRetriesWaitSecs int
-	// Number of filters to be created for the filter pool to be shared
-	numOfFiltersInFilterPool int
-	// DebugLogLevel set to true will show debug logs
-	debugLogLevel bool
-}
+	// If specified, print the vbucket, bin and data files for this key and exit
+	mapKey string
+	// Port to serve net/http/pprof on, on localhost. Disabled if 0
+	pprofPort uint64
+	// host:port to accept diff jobs on, instead of running a single diff. Disabled if empty
+	serverAddr string
+	// Directory under which each job gets its own directory
+	serverWorkDir string
+	// Number of jobs run at the same time, in the order they were submitted
+	serverMaxParallelJobs int
+	// If set, stay up and run the diff at the times of this cron expression
+	schedule string
+	// URL to post the scheduled runs that need attention to. They are logged if empty
+	alertWebhook string
+	// Scheduled runs that find more differences than this are alerted on. Negative to alert on every run
+	alertThreshold int
+	// File to write the output to instead of stdout and stderr, if set
+	logFile string
+	// Rotate the log file once it reaches this size in MB, 0 for no size limit
+	logFileMaxSizeMB uint64
+	// Rotate the log file once it is this many hours old, 0 for no age limit
+	logFileMaxAgeHours uint64
+	// Number of rotated log files to keep
+	logFileMaxBackups uint64
+	// If set, compact the data files in sourceFileDir and targetFileDir and exit
+	compactDataFiles bool
+	// If set, merge the outputs of the runs in these comma separated directories into fileDifferDir and mutationDifferDir and exit
+	mergeOutputDirs string
+	// If set, report which docs a filter expression would match and exit
+	filterDryRun bool
+	// Expression to dry run. The filter expression of the replication if empty
+	filterDryRunExpression string
+	// JSON file of doc keys to docs to dry run on. Docs are sampled from the source bucket if empty
+	filterDryRunDocs string
+	// Number of docs sampled from the source bucket
+	filterDryRunSampleSize int
+	// If set, load options from this YAML or JSON file. Options given on the command line take precedence
+	configFile string
+	// Whether to read the passwords from a terminal prompt, or from stdin one per line when it is not a terminal
+	promptPasswords bool
+	// Command given before the options, run in place of a diff. Empty for a diff
+	command string
+}
+
+// Verifies the clusters, the permissions, the directories and the file descriptor limit without diffing
+const checkCommand = "check"
+
+// Reports the per-vbucket differences between an old checkpoint file and a newer one, or the live high seqnos of
+// the source or target bucket, given after the options
+const compareCheckpointsCommand = "compareCheckpoints"
 
 func argParse() {
-	flag.StringVar(&options.sourceUrl, "sourceUrl", "",
+	flag.StringVar(&config.SourceUrl, "sourceUrl", config.SourceUrl,
 		"url for source cluster")
-	flag.StringVar(&options.sourceUsername, "sourceUsername", "",
+	flag.StringVar(&config.SourceUsername, "sourceUsername", config.SourceUsername,
 		"username for source cluster")
-	flag.StringVar(&options.sourcePassword, "sourcePassword", "",
+	flag.StringVar(&config.SourcePassword, "sourcePassword", config.SourcePassword,
 		"password for source cluster")
-	flag.StringVar(&options.sourceBucketName, "sourceBucketName", "",
+	flag.StringVar(&config.SourceBucketName, "sourceBucketName", config.SourceBucketName,
 		"bucket name for source cluster")
-	flag.StringVar(&options.remoteClusterName, "remoteClusterName", "",
+	flag.StringVar(&config.RemoteClusterName, "remoteClusterName", config.RemoteClusterName,
 		"Remote cluster reference name used when creating it")
-	flag.StringVar(&options.sourceFileDir, "sourceFileDir", base.SourceFileDir,
-		"directory to store mutations in source cluster")
-	flag.StringVar(&options.targetUrl, "targetUrl", "",
+	flag.StringVar(&config.SourceFileDir, "sourceFileDir", config.SourceFileDir,
+		"directory to store mutations in source cluster, or an s3:// or gs:// URI to store them in object storage")
+	flag.StringVar(&config.TargetUrl, "targetUrl", config.TargetUrl,
 		"url for target cluster")
-	flag.StringVar(&options.targetUsername, "targetUsername", "",
+	flag.StringVar(&config.TargetUsername, "targetUsername", config.TargetUsername,
 		"username for target cluster")
-	flag.StringVar(&options.targetPassword, "targetPassword", "",
+	flag.StringVar(&config.TargetPassword, "targetPassword", config.TargetPassword,
 		"password for target cluster")
-	flag.StringVar(&options.targetBucketName, "targetBucketName", "",
+	flag.StringVar(&config.TargetBucketName, "targetBucketName", config.TargetBucketName,
 		"bucket name for target cluster")
-	flag.StringVar(&options.targetFileDir, "targetFileDir", base.TargetFileDir,
-		"directory to store mutations in target cluster")
-	flag.Uint64Var(&options.numberOfSourceDcpClients, "numberOfSourceDcpClients", 1,
+	flag.StringVar(&config.TargetFileDir, "targetFileDir", config.TargetFileDir,
+		"directory to store mutations in target cluster, or an s3:// or gs:// URI to store them in object storage")
+	flag.Uint64Var(&config.NumberOfSourceDcpClients, "numberOfSourceDcpClients", config.NumberOfSourceDcpClients,
 		"number of source dcp clients")
-	flag.Uint64Var(&options.numberOfWorkersPerSourceDcpClient, "numberOfWorkersPerSourceDcpClient", 64,
+	flag.Uint64Var(&config.NumberOfWorkersPerSourceDcpClient, "numberOfWorkersPerSourceDcpClient", config.NumberOfWorkersPerSourceDcpClient,
 		"number of workers for each source dcp client")
-	flag.Uint64Var(&options.numberOfTargetDcpClients, "numberOfTargetDcpClients", 1,
+	flag.Uint64Var(&config.NumberOfTargetDcpClients, "numberOfTargetDcpClients", config.NumberOfTargetDcpClients,
 		"number of target dcp clients")
-	flag.Uint64Var(&options.numberOfWorkersPerTargetDcpClient, "numberOfWorkersPerTargetDcpClient", 64,
+	flag.Uint64Var(&config.NumberOfWorkersPerTargetDcpClient, "numberOfWorkersPerTargetDcpClient", config.NumberOfWorkersPerTargetDcpClient,
 		"number of workers for each target dcp client")
-	flag.Uint64Var(&options.numberOfWorkersForFileDiffer, "numberOfWorkersForFileDiffer", 30,
+	flag.Uint64Var(&config.NumberOfWorkersForFileDiffer, "numberOfWorkersForFileDiffer", config.NumberOfWorkersForFileDiffer,
 		"number of worker threads for file differ ")
-	flag.Uint64Var(&options.numberOfWorkersForMutationDiffer, "numberOfWorkersForMutationDiffer", 30,
+	flag.Uint64Var(&config.NumberOfWorkersForMutationDiffer, "numberOfWorkersForMutationDiffer", config.NumberOfWorkersForMutationDiffer,
 		"number of worker threads for mutation differ ")
-	flag.Uint64Var(&options.numberOfBins, "numberOfBins", 5,
+	flag.Uint64Var(&config.NumberOfBins, "numberOfBins", config.NumberOfBins,
 		"number of buckets per vbucket")
-	flag.Uint64Var(&options.numberOfFileDesc, "numberOfFileDesc", 500,
+	flag.Uint64Var(&config.NumberOfFileDesc, "numberOfFileDesc", config.NumberOfFileDesc,
 		"number of file descriptors")
-	flag.Uint64Var(&options.completeByDuration, "completeByDuration", 0,
-		"duration that the tool should run")
-	flag.BoolVar(&options.completeBySeqno, "completeBySeqno", true,
+	flag.BoolVar(&config.AutoTune, "autoTune", config.AutoTune,
+		"size numberOfBins, numberOfFileDesc and the worker counts from the bucket item counts, the file descriptor limit and the number of CPUs, overriding the values given")
+	flag.Uint64Var(&config.FileDifferMemoryBudgetMB, "fileDifferMemoryBudgetMB", config.FileDifferMemoryBudgetMB,
+		"memory budget, in MB, shared by the file differ workers. Data files that do not fit are sorted on disk. 0 means no limit")
+	flag.Var(utils.NewDurationFlag(&config.CompleteByDuration, time.Second), "completeByDuration",
+		"duration that the tool should run when completeBySeqno is false, e.g. 90m, or a number of seconds")
+	flag.BoolVar(&config.CompleteBySeqno, "completeBySeqno", config.CompleteBySeqno,
 		"whether tool should automatically complete (after processing all mutations at start time)")
-	flag.StringVar(&options.checkpointFileDir, "checkpointFileDir", base.CheckpointFileDir,
+	flag.StringVar(&config.CheckpointFileDir, "checkpointFileDir", config.CheckpointFileDir,
 		"directory for checkpoint files")
-	flag.StringVar(&options.oldSourceCheckpointFileName, "oldSourceCheckpointFileName", "",
+	flag.StringVar(&config.CheckpointBucket, "checkpointBucket", config.CheckpointBucket,
+		"bucket on the source cluster to keep checkpoints in instead of checkpointFileDir, so that a run can be resumed from another machine")
+	flag.StringVar(&config.CheckpointCollection, "checkpointCollection", config.CheckpointCollection,
+		"scope.collection of checkpointBucket to keep checkpoints in. By default, the default collection")
+	flag.StringVar(&config.CheckpointRunId, "checkpointRunId", config.CheckpointRunId,
+		"prefix of the checkpoint document keys in checkpointBucket. By default, the replication ID")
+	flag.StringVar(&config.OldSourceCheckpointFileName, "oldSourceCheckpointFileName", config.OldSourceCheckpointFileName,
 		"old source checkpoint file to load from when tool starts")
-	flag.StringVar(&options.oldTargetCheckpointFileName, "oldTargetCheckpointFileName", "",
+	flag.StringVar(&config.OldTargetCheckpointFileName, "oldTargetCheckpointFileName", config.OldTargetCheckpointFileName,
 		"old target checkpoint file to load from when tool starts")
-	flag.StringVar(&options.newCheckpointFileName, "newCheckpointFileName", "",
+	flag.BoolVar(&config.Resume, "resume", config.Resume,
+		"resume from the newest checkpoint in checkpointFileDir, periodic or final, that is complete for both source and target, in place of oldSourceCheckpointFileName and oldTargetCheckpointFileName")
+	flag.BoolVar(&config.DeltaDiff, "deltaDiff", config.DeltaDiff,
+		"only record and diff the mutations since the old checkpoints, given by resume or oldSourceCheckpointFileName and oldTargetCheckpointFileName, dropping the data files of earlier runs")
+	flag.StringVar(&config.NewCheckpointFileName, "newCheckpointFileName", config.NewCheckpointFileName,
 		"new checkpoint file to write to when tool shuts down")
-	flag.StringVar(&options.fileDifferDir, "fileDifferDir", base.FileDifferDir,
+	flag.StringVar(&config.FileDifferDir, "fileDifferDir", config.FileDifferDir,
 		" directory for storing diffs generated by file differ")
-	flag.StringVar(&options.mutationDifferDir, "mutationDifferDir", base.MutationDifferDir,
+	flag.StringVar(&config.MutationDifferDir, "mutationDifferDir", config.MutationDifferDir,
 		" output directory for mutation differ")
-	flag.Uint64Var(&options.mutationDifferBatchSize, "mutationDifferBatchSize", 100,
+	flag.StringVar(&config.DiffKeysDir, "diffKeysDir", config.DiffKeysDir,
+		"directory of the diff keys files for the mutation differ to verify instead of those of fileDifferDir, e.g. the unverifiedDiffKeys an earlier run left. Requires -runFileDiffer=false")
+	flag.StringVar(&config.RunsDir, "runsDir", config.RunsDir,
+		"keep the checkpoints, the file and mutation differ outputs and a manifest of each run in a directory of its own under this one, in place of checkpointFileDir, fileDifferDir and mutationDifferDir, instead of clearing the outputs of the previous run")
+	flag.StringVar(&config.RunId, "runId", config.RunId,
+		"name of the directory of the run under runsDir, e.g. to resume an earlier run. By default, the start time of the run")
+	flag.Uint64Var(&config.RunRetention, "runRetention", config.RunRetention,
+		"number of most recent run directories to keep under runsDir, older ones are removed once a run is done. 0 keeps all of them")
+	flag.Uint64Var(&config.MutationDifferBatchSize, "mutationDifferBatchSize", config.MutationDifferBatchSize,
 		"size of batch used by mutation differ")
-	flag.Uint64Var(&options.mutationDifferTimeout, "mutationDifferTimeout", 30,
-		"timeout, in seconds, used by mutation differ")
-	flag.Uint64Var(&options.sourceDcpHandlerChanSize, "sourceDcpHandlerChanSize", base.DcpHandlerChanSize,
+	flag.Var(utils.NewDurationFlag(&config.MutationDifferTimeout, time.Second), "mutationDifferTimeout",
+		"timeout used by mutation differ, e.g. 45s, or a number of seconds")
+	flag.Uint64Var(&config.SourceDcpHandlerChanSize, "sourceDcpHandlerChanSize", config.SourceDcpHandlerChanSize,
 		"size of source dcp handler channel")
-	flag.Uint64Var(&options.targetDcpHandlerChanSize, "targetDcpHandlerChanSize", base.DcpHandlerChanSize,
+	flag.Uint64Var(&config.TargetDcpHandlerChanSize, "targetDcpHandlerChanSize", config.TargetDcpHandlerChanSize,
 		"size of target dcp handler channel")
-	flag.Uint64Var(&options.bucketOpTimeout, "bucketOpTimeout", base.BucketOpTimeout,
-		" timeout for bucket for stats collection, in seconds")
-	flag.Uint64Var(&options.maxNumOfGetStatsRetry, "maxNumOfGetStatsRetry", base.MaxNumOfGetStatsRetry,
+	flag.Var(utils.NewDurationFlag(&config.BucketOpTimeout, time.Second), "bucketOpTimeout",
+		" timeout for bucket for stats collection, e.g. 2m, or a number of seconds")
+	flag.Uint64Var(&config.MaxNumOfGetStatsRetry, "maxNumOfGetStatsRetry", config.MaxNumOfGetStatsRetry,
 		"max number of retry for get stats")
-	flag.Uint64Var(&options.maxNumOfSendBatchRetry, "maxNumOfSendBatchRetry", base.MaxNumOfSendBatchRetry,
+	flag.Uint64Var(&config.MaxNumOfSendBatchRetry, "maxNumOfSendBatchRetry", config.MaxNumOfSendBatchRetry,
 		"max number of retry for send batch")
-	flag.Uint64Var(&options.getStatsRetryInterval, "getStatsRetryInterval", base.GetStatsRetryInterval,
-		" retry interval for get stats, in seconds")
-	flag.Uint64Var(&options.sendBatchRetryInterval, "sendBatchRetryInterval", base.SendBatchRetryInterval,
-		"retry interval for send batch, in milliseconds")
-	flag.Uint64Var(&options.getStatsMaxBackoff, "getStatsMaxBackoff", base.GetStatsMaxBackoff,
-		"max backoff for get stats, in seconds")
-	flag.Uint64Var(&options.sendBatchMaxBackoff, "sendBatchMaxBackoff", base.SendBatchMaxBackoff,
-		"max backoff for send batch, in seconds")
-	flag.Uint64Var(&options.delayBetweenSourceAndTarget, "delayBetweenSourceAndTarget", base.DelayBetweenSourceAndTarget,
-		"delay between source cluster start up and target cluster start up, in seconds")
-	flag.Uint64Var(&options.checkpointInterval, "checkpointInterval", base.CheckpointInterval,
-		"interval for periodical checkpointing, in seconds")
-	flag.BoolVar(&options.runDataGeneration, "runDataGeneration", true,
+	flag.Var(utils.NewDurationFlag(&config.GetStatsRetryInterval, time.Second), "getStatsRetryInterval",
+		" retry interval for get stats, e.g. 2s, or a number of seconds")
+	flag.Var(utils.NewDurationFlag(&config.SendBatchRetryInterval, time.Millisecond), "sendBatchRetryInterval",
+		"retry interval for send batch, e.g. 500ms, or a number of milliseconds")
+	flag.Var(utils.NewDurationFlag(&config.GetStatsMaxBackoff, time.Second), "getStatsMaxBackoff",
+		"max backoff for get stats, e.g. 10s, or a number of seconds")
+	flag.Var(utils.NewDurationFlag(&config.SendBatchMaxBackoff, time.Second), "sendBatchMaxBackoff",
+		"max backoff for send batch, e.g. 5s, or a number of seconds")
+	flag.Var(utils.NewDurationFlag(&config.DelayBetweenSourceAndTarget, time.Second), "delayBetweenSourceAndTarget",
+		"delay between source cluster start up and target cluster start up, e.g. 2s, or a number of seconds")
+	flag.Var(utils.NewDurationFlag(&config.CheckpointInterval, time.Second), "checkpointInterval",
+		"interval for periodical checkpointing, e.g. 10m, or a number of seconds")
+	flag.Uint64Var(&config.CheckpointRetention, "checkpointRetention", config.CheckpointRetention,
+		"number of most recent periodical checkpoints to keep, older ones are removed. 0 keeps all of them")
+	flag.BoolVar(&config.RunDataGeneration, "runDataGeneration", config.RunDataGeneration,
 		" whether to run data generation")
-	flag.BoolVar(&options.runFileDiffer, "runFileDiffer", true,
+	flag.BoolVar(&config.RunFileDiffer, "runFileDiffer", config.RunFileDiffer,
 		" whether to file differ")
-	flag.BoolVar(&options.runMutationDiffer, "runMutationDiffer", true,
+	flag.BoolVar(&config.RunMutationDiffer, "runMutationDiffer", config.RunMutationDiffer,
 		" whether to verify diff keys through aysnc Get on clusters")
-	flag.BoolVar(&options.enforceTLS, "enforceTLS", false,
+	flag.BoolVar(&config.EnforceTLS, "enforceTLS", config.EnforceTLS,
 		" stops executing if pre-requisites are not in place to ensure TLS communications")
-	flag.IntVar(&options.bucketBufferCapacity, "bucketBufferCapacity", base.BucketBufferCapacity,
+	flag.IntVar(&config.BucketBufferCapacity, "bucketBufferCapacity", config.BucketBufferCapacity,
 		"  number of items kept in memory per binary buffer bucket")
-	flag.StringVar(&options.compareType, "compareType", base.MutationCompareTypeMetadata,
+	flag.IntVar(&config.DcpBufferSize, "dcpBufferSize", config.DcpBufferSize,
+		"  size in bytes of the DCP connection buffer. kv-engine stops sending once it is filled until the received mutations are handled and acknowledged. 0 disables flow control")
+	flag.BoolVar(&config.SourceDcpCompression, "sourceDcpCompression", config.SourceDcpCompression,
+		"  negotiate snappy compression on the source DCP connections, so that values are sent compressed")
+	flag.BoolVar(&config.TargetDcpCompression, "targetDcpCompression", config.TargetDcpCompression,
+		"  negotiate snappy compression on the target DCP connections, so that values are sent compressed")
+	flag.StringVar(&config.HashAlgorithm, "hashAlgorithm", config.HashAlgorithm,
+		"  algorithm used to hash document bodies in the data files. One of sha512, xxhash64 or blake3")
+	flag.BoolVar(&config.KeyOnly, "keyOnly", config.KeyOnly,
+		"  record only the keys in the data files, without hashing the bodies, and only report the docs missing from either side")
+	flag.StringVar(&config.DataFileCompression, "dataFileCompression", config.DataFileCompression,
+		"  compress the data files as they are written, to save disk space. One of none, gzip or snappy. Compressed data files are detected and decompressed when read")
+	flag.StringVar(&config.EncryptionKey, "encryptionKey", config.EncryptionKey,
+		"  AES-256 key, as 64 hex digits, to encrypt the data files and the diff outputs with AES-GCM. Best given through XDCR_DIFFER_ENCRYPTION_KEY instead")
+	flag.StringVar(&config.EncryptionKeyFile, "encryptionKeyFile", config.EncryptionKeyFile,
+		"  file holding the AES-256 key, as 64 hex digits, to encrypt the data files and the diff outputs with, in place of encryptionKey")
+	flag.BoolVar(&config.CheckDiskSpace, "checkDiskSpace", config.CheckDiskSpace,
+		"  before streaming, estimate the size of the data files from the seqnos to stream and fail if sourceFileDir and targetFileDir do not have the space. Only with completeBySeqno")
+	flag.Uint64Var(&config.MaxDiskGB, "maxDiskGB", config.MaxDiskGB,
+		"  stop data generation, saving a checkpoint, once the data files in sourceFileDir and targetFileDir take more than this many GB. 0 for no limit")
+	flag.Float64Var(&config.SamplePercent, "samplePercent", config.SamplePercent,
+		"  only record and diff this percentage of keys, picked by a hash of the key, for a quick check of a large bucket. 100 for all keys")
+	flag.StringVar(&config.KeyPrefix, "keyPrefix", config.KeyPrefix,
+		"  only record and diff keys starting with this prefix. Applied on top of the replication filter")
+	flag.StringVar(&config.KeyRange, "keyRange", config.KeyRange,
+		"  only record and diff keys between start and end, both inclusive and compared byte-wise, given as start..end. Either end may be left out")
+	flag.BoolVar(&config.FilterTarget, "filterTarget", config.FilterTarget,
+		" apply the replication filter to the target stream too. false records every target doc, to find docs the filter should have kept from being replicated")
+	flag.StringVar(&config.CompareType, "compareType", config.CompareType,
 		" whether to compare meta, body, or both. Default meta")
-	flag.IntVar(&options.mutationDifferRetries, "mutationRetries", 0,
+	flag.StringVar(&config.MutationDifferOutputFormat, "mutationDifferOutputFormat", config.MutationDifferOutputFormat,
+		" format of the mutation differ details. json writes one JSON map, jsonl streams one JSON record per line followed by a summary line")
+	flag.BoolVar(&config.JsonAwareBodyCompare, "jsonAwareBodyCompare", config.JsonAwareBodyCompare,
+		" with compareType body or both, consider JSON bodies the same if they hold the same values, regardless of key order and whitespace")
+	flag.Uint64Var(&config.BinaryDiffHexDumpBytes, "binaryDiffHexDumpBytes", config.BinaryDiffHexDumpBytes,
+		" with compareType body or both, hex dump up to this many bytes of mismatched binary bodies from where they diverge. 0 to not dump them")
+	flag.BoolVar(&config.CompareXattrs, "compareXattrs", config.CompareXattrs,
+		" look up the user and system xattrs of docs that exist on both sides, and report the docs whose xattrs differ")
+	flag.BoolVar(&config.IgnoreSyncGatewayMetadata, "ignoreSyncGatewayMetadata", config.IgnoreSyncGatewayMetadata,
+		" leave out the _sync and _globalSync xattrs Sync Gateway maintains on each cluster, when hashing docs during data generation and when comparing xattrs")
+	flag.BoolVar(&config.CompareTombstones, "compareTombstones", config.CompareTombstones,
+		" look up the tombstones of docs not found on one side, to report docs deleted on one side only as deleted rather than missing, and compare the tombstones of docs deleted on both sides")
+	flag.Uint64Var(&config.MutationDifferOpsPerSec, "mutationDifferOpsPerSec", config.MutationDifferOpsPerSec,
+		" max Get/GetMeta/xattr lookups per second the mutation differ issues to each of the source and target clusters, shared by all workers. 0 for unlimited")
+	flag.IntVar(&config.MutationDifferRetries, "mutationRetries", config.MutationDifferRetries,
 		"Additional number of times to retry to resolve the mutation differences")
-	flag.IntVar(&options.mutationDifferRetriesWaitSecs, "mutationRetriesWaitSecs", 60,
-		"Seconds to wait in between retries for mutation differences")
-	flag.IntVar(&options.numOfFiltersInFilterPool, "numOfFiltersInFilterPool", 32,
+	flag.Var(utils.NewDurationFlag(&config.MutationDifferRetriesWaitSecs, time.Second), "mutationRetriesWaitSecs",
+		"time to wait in between retries for mutation differences, e.g. 2m, or a number of seconds")
+	flag.Var(utils.NewDurationFlag(&config.MutationDifferSettleTime, time.Second), "mutationSettleTime",
+		"time to wait before verifying the mutation differences once more, before any retries, e.g. 2m, or a number of seconds. 0 to not recheck them")
+	flag.Var(utils.NewDurationFlag(&config.MutationDifferMaxDuration, time.Second), "mutationDifferMaxDuration",
+		"time the mutation differ may run for, retries included, after which partial results are written and the keys left unverified are written for a follow-up run, e.g. 2h, or a number of seconds. 0 for no limit")
+	flag.IntVar(&config.NumOfFiltersInFilterPool, "numOfFiltersInFilterPool", config.NumOfFiltersInFilterPool,
 		"Number of filters to be created and shared among all DCP handlers")
-	flag.BoolVar(&options.debugLogLevel, "debugLogLevel", false,
+	flag.BoolVar(&config.DebugLogLevel, "debugLogLevel", config.DebugLogLevel,
 		"The differ to be run with debug log level")
-
-	flag.Parse()
-}
-
-func validateCompareType(method string) {
-	for _, str := range base.MutationDiffCompareType {
-		if method == str {
-			return
+	flag.StringVar(&config.LogLevel, "logLevel", config.LogLevel,
+		"lowest level of the logs to show: debug, info, warn or error. By default info, or error with -dashboard. -debugLogLevel is the same as debug")
+	flag.StringVar(&options.mapKey, "mapKey", "",
+		"print the vbucket, bin index and data file paths for the given key, then exit")
+	flag.BoolVar(&config.Dashboard, "dashboard", config.Dashboard,
+		"show a live terminal dashboard with per-stage progress, throughput and vbucket completion")
+	flag.StringVar(&options.logFile, "logFile", "",
+		"file to write the logs to instead of stdout and stderr. The dashboard, if shown, stays on the terminal")
+	flag.Uint64Var(&options.logFileMaxSizeMB, "logFileMaxSizeMB", 100,
+		"rotate logFile once it reaches this size in MB. 0 for no size limit")
+	flag.Uint64Var(&options.logFileMaxAgeHours, "logFileMaxAgeHours", 0,
+		"rotate logFile once it is this many hours old. 0 for no age limit")
+	flag.Uint64Var(&options.logFileMaxBackups, "logFileMaxBackups", 5,
+		"number of rotated log files to keep, as logFile.1 (the most recent) to logFile.<logFileMaxBackups>")
+	flag.Uint64Var(&options.pprofPort, "pprofPort", 0,
+		"localhost port to serve CPU, heap and goroutine profiles on, under /debug/pprof/. Disabled if 0")
+	flag.StringVar(&options.serverAddr, "serverAddr", "",
+		"host:port to stay up on and accept diff jobs as JSON under "+jobs.JobsPath+", instead of running a single diff. The other options are the defaults of each job")
+	flag.StringVar(&options.serverWorkDir, "serverWorkDir", base.JobsWorkDir,
+		"directory under which each job accepted by serverAddr gets its own data, checkpoint and result directories")
+	flag.IntVar(&options.serverMaxParallelJobs, "serverMaxParallelJobs", 1,
+		"number of jobs accepted by serverAddr that are run at the same time, in the order they were submitted")
+	flag.StringVar(&options.schedule, "schedule", "",
+		"cron expression, i.e. \"0 2 * * *\", to stay up and run the diff at, each run in its own directory under serverWorkDir")
+	flag.StringVar(&options.alertWebhook, "alertWebhook", "",
+		"URL to post scheduled runs to as JSON when they fail or find more than alertThreshold differences. Logged if empty")
+	flag.IntVar(&options.alertThreshold, "alertThreshold", -1,
+		"alert on scheduled runs that find more than this many differences. Negative to alert on every run")
+	flag.StringVar(&config.StatusAddr, "statusAddr", config.StatusAddr,
+		"host:port to serve the current phase, progress and per-vbucket seqnos of the run on, as JSON under "+status.StatusPath+". Disabled if empty")
+	flag.BoolVar(&config.VerboseProgress, "verboseProgress", config.VerboseProgress,
+		"log the seqno of each vbucket that has not completed, the furthest behind first, with each data generation progress report")
+	flag.BoolVar(&config.InMemory, "inMemory", config.InMemory,
+		"for small buckets, diff both DCP streams in memory instead of writing and then diffing data files")
+	flag.BoolVar(&config.StreamingDiff, "streamingDiff", config.StreamingDiff,
+		"start diffing vbuckets that have completed on both clusters while other vbuckets are still streaming. Requires completeBySeqno. With inMemory, each vbucket is diffed and freed from memory as soon as it completes")
+	flag.StringVar(&config.DataStore, "dataStore", config.DataStore,
+		"where to keep the mutation records in sourceFileDir and targetFileDir. files writes a data file per vbucket and bin, badger an embedded key value store per cluster that keeps the newest record per key")
+	flag.StringVar(&config.Repair, "repair", config.Repair,
+		"repair the keys the mutation differ confirmed to be missing from the target. setWithMeta writes the source doc and its metadata to the target, touchSource touches the source doc so that XDCR replicates it again")
+	flag.BoolVar(&config.RepairDryRun, "repairDryRun", config.RepairDryRun,
+		"with repair, only record in the repair log what would be repaired, without writing anything")
+	flag.StringVar(&config.RemediationDir, "remediationDir", config.RemediationDir,
+		"directory to write, for the keys the mutation differ confirmed to be missing or different on the target, keys lists per source collection and a cbc script copying them from the source")
+	flag.BoolVar(&config.AllReplications, "allReplications", config.AllReplications,
+		"diff every replication to remoteClusterName one after another, each in a subdirectory of each directory option named sourceBucket_targetBucket")
+	flag.Uint64Var(&config.VbucketRangeStart, "vbucketRangeStart", config.VbucketRangeStart,
+		"first vbucket to stream and diff, so that several instances can each diff a disjoint part of the bucket")
+	flag.Uint64Var(&config.VbucketRangeEnd, "vbucketRangeEnd", config.VbucketRangeEnd,
+		"last vbucket to stream and diff, inclusive")
+	flag.Uint64Var(&config.NodeIndex, "nodeIndex", config.NodeIndex,
+		"index, from 0, of this instance out of totalNodes instances. Streams and diffs an even share of the vbuckets in place of vbucketRangeStart and vbucketRangeEnd")
+	flag.Uint64Var(&config.TotalNodes, "totalNodes", config.TotalNodes,
+		"number of instances sharing the vbuckets by nodeIndex. Disabled if 0")
+	flag.BoolVar(&options.compactDataFiles, "compactDataFiles", false,
+		"rewrite the data files in sourceFileDir and targetFileDir keeping only the newest record per key, then exit")
+	flag.StringVar(&options.mergeOutputDirs, "mergeOutputDirs", "",
+		"comma separated directories, each holding the fileDiff and mutationDiff directories of a run over a part of the vbuckets. Merges them into fileDifferDir and mutationDifferDir, then exit")
+	flag.BoolVar(&options.filterDryRun, "filterDryRun", false,
+		"report which docs filterDryRunExpression, or the filter expression of the replication, would match or skip, then exit")
+	flag.StringVar(&options.filterDryRunExpression, "filterDryRunExpression", "",
+		"filter expression to dry run. The filter expression of the replication if empty")
+	flag.StringVar(&options.filterDryRunDocs, "filterDryRunDocs", "",
+		"JSON file holding an object of doc keys to docs to dry run the filter on. If empty, docs are streamed from the source bucket")
+	flag.IntVar(&options.filterDryRunSampleSize, "filterDryRunSampleSize", 100,
+		"number of docs streamed from the source bucket to dry run the filter on")
+	flag.Uint64Var(&config.CasToleranceMs, "casToleranceMs", config.CasToleranceMs,
+		"mismatches where only the CAS differs by no more than this many milliseconds are reported as low severity")
+	flag.Uint64Var(&config.ExpiryToleranceSeconds, "expiryToleranceSeconds", config.ExpiryToleranceSeconds,
+		"with compareType meta, expiries of the same doc no more than this many seconds apart are not a difference. 0 requires them to be the same")
+	flag.IntVar(&config.ConvergenceRetries, "convergenceRetries", config.ConvergenceRetries,
+		"number of times to rerun the verification on the keys that are still different, until no differences remain")
+	flag.Var(utils.NewDurationFlag(&config.ConvergenceRetriesWaitSecs, time.Second), "convergenceRetriesWaitSecs",
+		"time to wait in between convergence retries, e.g. 2m, or a number of seconds")
+	flag.StringVar(&config.OutputSinkFile, "outputSinkFile", config.OutputSinkFile,
+		"also write each confirmed difference as a JSON line to this file, and the summary to <file>_summary")
+	flag.StringVar(&config.OutputSinkSqlite, "outputSinkSqlite", config.OutputSinkSqlite,
+		"also write the confirmed differences and the summary into the diffs and summary tables of this SQLite database file, which is recreated")
+	flag.StringVar(&config.OutputSinkWebhook, "outputSinkWebhook", config.OutputSinkWebhook,
+		"also POST the confirmed differences and the summary as JSON to this URL")
+	flag.StringVar(&config.OutputSinkBucket, "outputSinkBucket", config.OutputSinkBucket,
+		"also write each confirmed difference and the summary as a document into this bucket on the source cluster")
+	flag.StringVar(&config.OutputSinkCollection, "outputSinkCollection", config.OutputSinkCollection,
+		"scope.collection of outputSinkBucket to write the documents to. The default collection if not set")
+	flag.StringVar(&config.OutputSinkRunId, "outputSinkRunId", config.OutputSinkRunId,
+		"run ID the keys of the documents written to outputSinkBucket start with, so that the results of several runs are kept apart. Defaults to the start time of the run")
+	flag.StringVar(&options.configFile, "configFile", "",
+		"load options from a YAML (name: value per line) or JSON (.json) file. Options given on the command line override the file")
+	flag.BoolVar(&config.SourceSecure, "sourceSecure", config.SourceSecure,
+		"connect to the source cluster over TLS for cluster, DCP and KV connections")
+	flag.StringVar(&config.SourceCACertFile, "sourceCACertFile", config.SourceCACertFile,
+		"PEM file of the CA certificate to verify the source cluster with. Required by sourceSecure unless the source is on a loopback device")
+	flag.BoolVar(&config.TargetSecure, "targetSecure", config.TargetSecure,
+		"connect to the target cluster over TLS for cluster, DCP and KV connections. Outside of legacy mode, the remote cluster reference must use full encryption")
+	flag.StringVar(&config.TargetCACertFile, "targetCACertFile", config.TargetCACertFile,
+		"PEM file of the CA certificate to verify the target cluster with. Required by targetSecure in legacy mode")
+	flag.Uint64Var(&config.SourceMgmtPort, "sourceMgmtPort", config.SourceMgmtPort,
+		"management port of the source cluster, the TLS one with sourceSecure, when sourceUrl has none. 0 for the default port")
+	flag.Uint64Var(&config.TargetMgmtPort, "targetMgmtPort", config.TargetMgmtPort,
+		"management port of the target cluster, the TLS one with targetSecure, when targetUrl has none, in legacy mode. 0 for the default port")
+	flag.Uint64Var(&config.SourceKvPort, "sourceKvPort", config.SourceKvPort,
+		"KV port of the source cluster, the TLS one with sourceSecure, to bootstrap cluster, stats and checkpoint connections from. 0 for the default port")
+	flag.Uint64Var(&config.TargetKvPort, "targetKvPort", config.TargetKvPort,
+		"KV port of the target cluster, the TLS one with targetSecure, to bootstrap cluster and stats connections from. 0 for the default port")
+	flag.StringVar(&config.SourceClientCertFile, "sourceClientCertFile", config.SourceClientCertFile,
+		"PEM file of the x.509 client certificate to authenticate with the source cluster. Requires sourceClientKeyFile and sourceSecure")
+	flag.StringVar(&config.SourceClientKeyFile, "sourceClientKeyFile", config.SourceClientKeyFile,
+		"PEM file of the private key of sourceClientCertFile")
+	flag.StringVar(&config.TargetClientCertFile, "targetClientCertFile", config.TargetClientCertFile,
+		"PEM file of the x.509 client certificate to authenticate with the target cluster in legacy mode. Requires targetClientKeyFile and targetSecure")
+	flag.StringVar(&config.TargetClientKeyFile, "targetClientKeyFile", config.TargetClientKeyFile,
+		"PEM file of the private key of targetClientCertFile")
+	flag.StringVar(&config.KvAuthMechanism, "kvAuthMechanism", config.KvAuthMechanism,
+		"force KV and DCP connections to authenticate with this SASL mechanism: PLAIN, SCRAM-SHA1, SCRAM-SHA256 or SCRAM-SHA512. By default, SCRAM-SHA512 or SCRAM-SHA256 is negotiated over non-TLS connections")
+	flag.StringVar(&config.Network, "network", config.Network,
+		"network to connect to the nodes of both clusters on: default for their internal addresses, or external for the alternate addresses they expose, e.g. behind Kubernetes or cloud NAT. By default, the network of the cluster address given is used")
+	flag.StringVar(&config.RedactionLevel, "redactionLevel", config.RedactionLevel,
+		"how document keys, bodies and xattrs are written to the logs and the mutation differ reports: none, partial to wrap them in <ud></ud> tags, or full to replace them with their SHA1 hash within the tags")
+	flag.StringVar(&config.SourceCollections, "sourceCollections", config.SourceCollections,
+		"comma separated scope.collection names of the source collections to stream and diff. By default, all replicated collections are")
+	flag.StringVar(&config.TargetCollections, "targetCollections", config.TargetCollections,
+		"comma separated scope.collection names of the target collections to stream and diff. By default, all replicated collections are")
+	flag.StringVar(&config.MutationDifferCollections, "mutationDifferCollections", config.MutationDifferCollections,
+		"comma separated scope.collection names of the source collections whose per-collection diff keys files the mutation differ verifies. By default, the diff keys of all collections are")
+	flag.BoolVar(&config.DryRun, "dryRun", config.DryRun,
+		"validate the options, connect to both clusters, verify that the buckets exist and the credentials have DCP and read permissions, print the derived configuration, then exit without streaming")
+	flag.BoolVar(&options.promptPasswords, "promptPasswords", false,
+		"prompt for the source password, and the target password if targetUsername is set, without echoing them. When stdin is not a terminal, they are read from stdin one per line")
+
+	// Commands take the same options as a run, after them
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == checkCommand || args[0] == compareCheckpointsCommand) {
+		options.command = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+}
+
+// Environment variables that credentials and keys can be read from, so that they do not show up in ps output or shell history
+var credentialEnvVars = []struct {
+	envVar string
+	option string
+}{
+	{"XDCR_DIFFER_SOURCE_USERNAME", "sourceUsername"},
+	{"XDCR_DIFFER_SOURCE_PASSWORD", "sourcePassword"},
+	{"XDCR_DIFFER_TARGET_USERNAME", "targetUsername"},
+	{"XDCR_DIFFER_TARGET_PASSWORD", "targetPassword"},
+	{"XDCR_DIFFER_ENCRYPTION_KEY", "encryptionKey"},
+}
+
+// Sets the credentials from the environment that have not been given on the command line
+// Must be called before applyConfigFile, so that the environment takes precedence over the config file
+func applyEnvironmentVariables() error {
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	for _, credential := range credentialEnvVars {
+		value, ok := os.LookupEnv(credential.envVar)
+		if !ok || setOnCommandLine[credential.option] {
+			continue
+		}
+		if err := flag.Set(credential.option, value); err != nil {
+			return fmt.Errorf("invalid value from %v for option %v: %v", credential.envVar, credential.option, err)
 		}
 	}
-	fmt.Fprintf(os.Stderr, "Invalid compareType '%v'. Accepted values are %v\n", options.compareType, base.MutationDiffCompareType)
-	os.Exit(1)
-}
-
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage : %s [OPTIONS] \n", os.Args[0])
-	flag.PrintDefaults()
-}
-
-type diffToolStateType int
-
-const (
-	StateInitial    diffToolStateType = iota
-	StateDcpStarted diffToolStateType = iota
-	StateFinal      diffToolStateType = iota
-)
-
-type difftoolState struct {
-	state diffToolStateType
-	mtx   sync.Mutex
-}
-
-type xdcrDiffTool struct {
-	utils                   xdcrUtils.UtilsIface
-	metadataSvc             service_def.MetadataSvc
-	remoteClusterSvc        service_def.RemoteClusterSvc
-	replicationSpecSvc      service_def.ReplicationSpecSvc
-	collectionsManifestsSvc service_def.CollectionsManifestSvc
-	logger                  *xdcrLog.CommonLogger
-
-	xdcrTopologySvc service_def.XDCRCompTopologySvc
-
-	selfRef             *metadata.RemoteClusterReference
-	selfRefPopulated    uint32
-	specifiedRef        *metadata.RemoteClusterReference
-	specifiedSpec       *metadata.ReplicationSpecification
-	filter              xdcrParts.Filter
-	selfDefaultPoolInfo map[string]interface{}
-	selfPoolsNodes      map[string]interface{}
-
-	srcCapabilities  metadata.Capability
-	tgtCapabilities  metadata.Capability
-	srcClusterCompat int
-
-	srcBucketManifest *metadata.CollectionsManifest
-	tgtBucketManifest *metadata.CollectionsManifest
-
-	// If non-empty, just stream these collection IDs from each side's DCP
-	srcCollectionIds []uint32
-	tgtCollectionIds []uint32
-	// Logically there should only be 1-1 mapping, but make this flexible just in case
-	srcToTgtColIdsMap map[uint32][]uint32
-
-	// For collections migration mode, each filter should cause one or more target collection IDs
-	colFilterToTgtColIdsMap map[string][]uint32
-	// Each filter string above is translated into a consistent ordered list below. The *index* of each filter
-	// string will then be used for the remainder of the differ protocol, and used to determine if a source mutation
-	// has passed a certain filter or not
-	colFilterOrderedKeys        []string
-	colFilterOrderedTargetNs    []*xdcrBase.CollectionNamespace
-	colFilterOrderedTargetColId []uint32
-
-	// Used for migration mapping
-	migrationMapping  metadata.CollectionNamespaceMapping
-	duplicatedMapping differ.DuplicatedHintMap
-
-	sourceDcpDriver *dcp.DcpDriver
-	targetDcpDriver *dcp.DcpDriver
-
-	curState difftoolState
-
-	legacyMode bool
+	return nil
 }
 
-func NewDiffTool(legacyMode bool) (*xdcrDiffTool, error) {
-	var err error
-	difftool := &xdcrDiffTool{
-		utils:                   xdcrUtils.NewUtilities(),
-		legacyMode:              legacyMode,
-		srcToTgtColIdsMap:       make(map[uint32][]uint32),
-		colFilterToTgtColIdsMap: map[string][]uint32{},
-	}
-
-	logCtx := xdcrLog.DefaultLoggerContext
-	difftool.logger = xdcrLog.NewLogger("xdcrDiffTool", xdcrLog.DefaultLoggerContext)
-	if options.debugLogLevel {
-		logCtx.SetLogLevel(xdcrLog.LogLevelDebug)
+// Sets the options in the config file that have not been given on the command line or the environment
+func applyConfigFile(fileName string) error {
+	config, err := utils.ParseConfigFile(fileName)
+	if err != nil {
+		return err
 	}
 
-	difftool.selfRef, _ = metadata.NewRemoteClusterReference("", base.SelfReferenceName, options.sourceUrl, options.sourceUsername, options.sourcePassword,
-		"", false, "", nil, nil, nil, nil)
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
 
-	if !legacyMode {
-		difftool.metadataSvc, err = metadata_svc.NewMetaKVMetadataSvc(nil, difftool.utils, true /*readOnly*/)
-		if err != nil {
-			return nil, err
+	for name, value := range config {
+		if name == "configFile" {
+			return fmt.Errorf("configFile cannot be set from a config file")
 		}
-
-		uiLogSvcMock := &service_def_mock.UILogSvc{}
-		uiLogSvcMock.On("Write", mock.Anything).Run(func(args mock.Arguments) { fmt.Printf("%v", args.Get(0).(string)) }).Return(nil)
-		xdcrTopologyMock := &service_def_mock.XDCRCompTopologySvc{}
-		xdcrTopologyMockSetupCb := func() {
-			setupXdcrToplogyMock(xdcrTopologyMock, difftool)
-		}
-		resolverSvcMock := &service_def_mock.ResolverSvcIface{}
-		checkpointSvcMock := &service_def_mock.CheckpointsService{}
-		manifestsSvcMock := &service_def_mock.ManifestsService{}
-		manifestsSvcMock.On("GetSourceManifests", mock.Anything).Return(nil, service_def.MetadataNotFoundErr)
-		manifestsSvcMock.On("GetTargetManifests", mock.Anything).Return(nil, service_def.MetadataNotFoundErr)
-
-		replicationSettingSvc := metadata_svc.NewReplicationSettingsSvc(difftool.metadataSvc, nil, xdcrTopologyMock)
-
-		difftool.remoteClusterSvc, err = metadata_svc.NewRemoteClusterService(uiLogSvcMock, difftool.metadataSvc, xdcrTopologyMock,
-			xdcrLog.DefaultLoggerContext, difftool.utils)
-		if err != nil {
-			return nil, err
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %v", name)
 		}
-
-		if err = difftool.retrieveClustersCapabilities(legacyMode, xdcrTopologyMockSetupCb); err != nil {
-			return nil, err
+		if setOnCommandLine[name] {
+			continue
 		}
-
-		difftool.replicationSpecSvc, err = metadata_svc.NewReplicationSpecService(uiLogSvcMock, difftool.remoteClusterSvc,
-			difftool.metadataSvc, xdcrTopologyMock, resolverSvcMock, difftool.logger.LoggerContext(), difftool.utils,
-			replicationSettingSvc)
-		if err != nil {
-			return nil, err
-		}
-
-		err = difftool.retrieveReplicationSpecInfo()
-		if err != nil {
-			return nil, err
-		}
-
-		securitySvc := &service_def_mock.SecuritySvc{}
-		setupSecuritySvcMock(securitySvc)
-		err = setupMyKVNodes(xdcrTopologyMock, difftool)
-		if err != nil {
-			return nil, err
-		}
-
-		bucketTopologySvc, err := service_impl.NewBucketTopologyService(xdcrTopologyMock, difftool.remoteClusterSvc,
-			difftool.utils, xdcrBase.TopologyChangeCheckInterval, difftool.logger.LoggerContext(),
-			difftool.replicationSpecSvc, xdcrBase.HealthCheckInterval, securitySvc, streamApiWatcher.GetStreamApiWatcher)
-
-		difftool.collectionsManifestsSvc, err = metadata_svc.NewCollectionsManifestService(difftool.remoteClusterSvc,
-			difftool.replicationSpecSvc, uiLogSvcMock, difftool.logger.LoggerContext(), difftool.utils, checkpointSvcMock,
-			xdcrTopologyMock, bucketTopologySvc, manifestsSvcMock)
-		if err != nil {
-			return nil, err
-		}
-
-		difftool.logger.Infof("Source cluster supports collections: %v Target cluster supports collections: %v\n",
-			difftool.srcCapabilities.HasCollectionSupport(), difftool.tgtCapabilities.HasCollectionSupport())
-
-		if difftool.srcCapabilities.HasCollectionSupport() || difftool.tgtCapabilities.HasCollectionSupport() {
-			err = difftool.populateCollectionsPreReq()
-			if err != nil {
-				return nil, err
-			}
-		}
-	} else {
-		// Need to do this outside of legacy mode
-		if err := difftool.retrieveClustersCapabilities(legacyMode, nil); err != nil {
-			return nil, err
+		if err = flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for option %v: %v", value, name, err)
 		}
 	}
-
-	// Capture any Ctrl-C for continuing to next steps or cleanup
-	go difftool.monitorInterruptSignal()
-
-	return difftool, err
-}
-
-func setupSecuritySvcMock(securitySvc *service_def_mock.SecuritySvc) {
-	securitySvc.On("IsClusterEncryptionLevelStrict").Return(false)
-}
-
-// This may be re-set up once self-reference is populated
-func setupXdcrToplogyMock(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
-	xdcrTopologyMock.On("IsMyClusterEnterprise").Return(true, nil)
-	xdcrTopologyMock.On("IsKVNode").Return(true, nil)
-	xdcrTopologyMock.On("IsMyClusterEncryptionLevelStrict").Return(false)
-	xdcrTopologyMock.On("MyClusterCompatibility").Return(diffTool.srcClusterCompat, nil)
-	setupTopologyMockCredentials(xdcrTopologyMock, diffTool)
-	setupTopologyMockConnectionString(xdcrTopologyMock, diffTool)
+	return nil
 }
 
-func setupMyKVNodes(topologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) error {
-	// As of XDCR v8, pools/nodes endpoint is gone so we need to do things the legacy way
-	nodesInfo := diffTool.selfPoolsNodes
-	if nodes, ok := nodesInfo[base.NodesKey]; !ok {
-		return fmt.Errorf("%v is not found from pools/nodes output", base.NodesKey)
-	} else if nodesList, ok := nodes.([]interface{}); !ok {
-		return fmt.Errorf("nodesList is not an interface list")
-	} else {
-		var found bool
-		for _, node := range nodesList {
-			nodeInfoMap, ok := node.(map[string]interface{})
-			if !ok {
-				// should never get here
-				return fmt.Errorf("node type is %v", reflect.TypeOf(node))
-			}
-			thisNode, ok := nodeInfoMap[xdcrBase.ThisNodeKey]
-			if ok {
-				thisNodeBool, ok := thisNode.(bool)
-				if !ok {
-					// should never get here
-					return fmt.Errorf("thisNode is %v", reflect.TypeOf(thisNode))
-				}
-				if thisNodeBool {
-					// found current node
-					found = true
-				}
-			}
-			if found {
-				ports := nodeInfoMap[xdcrBase.PortsKey]
-				portsMap := ports.(map[string]interface{})
-				directPort := portsMap[xdcrBase.DirectPortKey]
-				directPortFloat := directPort.(float64)
-				memcachedPort := uint16(directPortFloat)
-
-				hostAddr := nodeInfoMap[xdcrBase.HostNameKey]
-				hostAddrStr := hostAddr.(string)
+// Overrides the passwords given in any other way
+func promptForPasswords() error {
+	stdinFd := int(os.Stdin.Fd())
+	isTerminal := term.IsTerminal(stdinFd)
+	stdinReader := bufio.NewReader(os.Stdin)
 
-				hostName := xdcrBase.GetHostName(hostAddrStr)
-				memcachedAddr := xdcrBase.GetHostAddr(hostName, memcachedPort)
-				topologyMock.On("MyKVNodes").Return([]string{memcachedAddr}, nil)
-				break
+	readPassword := func(prompt string) (string, error) {
+		if !isTerminal {
+			line, err := stdinReader.ReadString('\n')
+			if err != nil && !(err == io.EOF && len(line) > 0) {
+				return "", err
 			}
+			return strings.TrimRight(line, "\r\n"), nil
 		}
-		if !found {
-			return fmt.Errorf("Unable to set memcached port")
-		}
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(stdinFd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
 	}
-	return nil
-}
 
-func setupTopologyMockConnectionString(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
-	connFunc := func() string {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			connStr, _ := diffTool.selfRef.MyConnectionStr()
-			return connStr
-		} else {
-			return ""
-		}
+	var err error
+	config.SourcePassword, err = readPassword(fmt.Sprintf("Password for %v on the source cluster: ", config.SourceUsername))
+	if err != nil {
+		return fmt.Errorf("unable to read source password: %v", err)
 	}
-
-	errFunc := func() error {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return nil
-		} else {
-			return fmt.Errorf("Not initialized yet")
+	if len(config.TargetUsername) > 0 {
+		config.TargetPassword, err = readPassword(fmt.Sprintf("Password for %v on the target cluster: ", config.TargetUsername))
+		if err != nil {
+			return fmt.Errorf("unable to read target password: %v", err)
 		}
 	}
-
-	xdcrTopologyMock.On("MyConnectionStr").Return(connFunc, errFunc)
+	return nil
 }
 
-func setupTopologyMockCredentials(xdcrTopologyMock *service_def_mock.XDCRCompTopologySvc, diffTool *xdcrDiffTool) {
-	getUserName := func() string {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.UserName()
-		} else {
-			return ""
-		}
-	}
-	getPw := func() string {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.Password()
-		} else {
-			return ""
-		}
-	}
-	getAuthMech := func() xdcrBase.HttpAuthMech {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.HttpAuthMech()
-		} else {
-			return xdcrBase.HttpAuthMechPlain
-		}
-	}
-	getCert := func() []byte {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.Certificates()
-		} else {
-			return nil
-		}
-	}
-	getSanCert := func() bool {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.SANInCertificate()
-		} else {
-			return false
-		}
-	}
-	getClientCert := func() []byte {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.ClientCertificate()
-		} else {
-			return nil
-		}
-	}
-	getClientKey := func() []byte {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return diffTool.selfRef.ClientKey()
-		} else {
-			return nil
-		}
-	}
-	getErr := func() error {
-		if atomic.LoadUint32(&diffTool.selfRefPopulated) == 1 {
-			return nil
-		} else {
-			return fmt.Errorf("Not initialized yet")
-		}
-	}
-	xdcrTopologyMock.On("MyCredentials").Return(getUserName, getPw, getAuthMech, getCert, getSanCert, getClientCert, getClientKey, getErr)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage : %s [%v] [OPTIONS] \n", os.Args[0], checkCommand)
+	fmt.Fprintf(os.Stderr, "        %s %v [OPTIONS] <old checkpoint file> <new checkpoint file|%v|%v>\n", os.Args[0],
+		compareCheckpointsCommand, base.SourceClusterName, base.TargetClusterName)
+	flag.PrintDefaults()
 }
 
 func maybeSetEnv(key, value string) {
@@ -571,740 +511,273 @@ func maybeSetEnv(key, value string) {
 
 func main() {
 	argParse()
-	validateCompareType(options.compareType)
-
-	fmt.Printf("differ is run with options: %+v\n", options)
-	legacyMode := len(options.targetUsername) > 0
-
-	if err := setupDirectories(); err != nil {
-		fmt.Printf("Unable to set up directory structure: %v\n", err)
+	if err := applyEnvironmentVariables(); err != nil {
+		fmt.Printf("Error reading environment variables: %v\n", err)
 		os.Exit(1)
 	}
-
-	difftool, err := NewDiffTool(legacyMode)
-	if err != nil {
-		fmt.Printf("Error creating difftool: %v\n", err)
-		os.Exit(1)
-	}
-
-	if options.enforceTLS {
-		// For using certificates, the source cluster must be on a loopback device since we will be retrieving the
-		// source cluster's certificate to prevent sniffing
-		if !isURLLoopBack(options.sourceUrl) {
-			fmt.Printf("enforceTLS options requires that source addr %v to use loopback device\n", options.sourceUrl)
+	if options.configFile != "" {
+		if err := applyConfigFile(options.configFile); err != nil {
+			fmt.Printf("Error loading configFile %v: %v\n", options.configFile, err)
 			os.Exit(1)
 		}
 	}
-
-	if legacyMode {
-		if options.enforceTLS {
-			fmt.Printf("enforceTLS option is not compatible with legacyMode")
+	if options.promptPasswords {
+		if err := promptForPasswords(); err != nil {
+			fmt.Printf("Error reading passwords: %v\n", err)
 			os.Exit(1)
 		}
-		// OK to ignore metakv err in manual mode
-		if err := difftool.populateTemporarySpecAndRef(); err != nil {
-			fmt.Printf("%v\n", err)
+	}
+	if options.mapKey != "" {
+		printKeyMapping(options.mapKey)
+		os.Exit(0)
+	}
+	if options.compactDataFiles {
+		if err := compactDataFiles(); err != nil {
+			fmt.Printf("Error compacting data files: %v\n", err)
 			os.Exit(1)
 		}
+		os.Exit(0)
 	}
-
-	if options.runDataGeneration {
-		err := difftool.generateDataFiles()
+	if options.mergeOutputDirs != "" {
+		outputDirs := strings.Split(options.mergeOutputDirs, ",")
+		encryptionKey, err := config.DataFileEncryptionKey()
 		if err != nil {
-			fmt.Printf("Error generating data files. err=%v\n", err)
+			fmt.Printf("Error loading the encryption key: %v\n", err)
 			os.Exit(1)
 		}
-	} else {
-		fmt.Printf("Skipping  generating data files since it has been disabled\n")
-	}
-
-	if options.runFileDiffer {
-		err := difftool.diffDataFiles()
-		if err != nil {
-			fmt.Printf("Error running file difftool. err=%v\n", err)
+		if err := differ.MergeOutputs(outputDirs, config.FileDifferDir, config.MutationDifferDir, encryptionKey); err != nil {
+			fmt.Printf("Error merging outputs: %v\n", err)
 			os.Exit(1)
 		}
-	} else {
-		fmt.Printf("Skipping file difftool since it has been disabled\n")
-	}
-
-	if options.runMutationDiffer {
-		difftool.runMutationDiffer()
-	} else {
-		fmt.Printf("Skipping mutation diff since it has been disabled\n")
+		fmt.Printf("Merged the outputs of %v into %v and %v\n", outputDirs, config.FileDifferDir, config.MutationDifferDir)
+		os.Exit(0)
 	}
-}
-
-func isURLLoopBack(url string) bool {
-	IPLoopbackCheck := net.ParseIP(xdcrBase.GetHostName(url))
-	hostNameIsLocalHost := xdcrBase.GetHostName(url) == "localhost"
-	return IPLoopbackCheck.IsLoopback() || hostNameIsLocalHost
-}
-
-func setupDirectories() error {
-	err := os.MkdirAll(options.sourceFileDir, 0777)
-	if err != nil {
-		fmt.Printf("Error mkdir sourceFileDir: %v\n", err)
-	}
-	err = os.MkdirAll(options.targetFileDir, 0777)
-	if err != nil {
-		fmt.Printf("Error mkdir targetFileDir: %v\n", err)
-	}
-	err = os.MkdirAll(options.checkpointFileDir, 0777)
-	if err != nil {
-		// it is ok for checkpoint dir to be existing, since we do not clean it up
-		fmt.Printf("Error mkdir checkpointFileDir: %v\n", err)
-	}
-	return nil
-}
-
-func (difftool *xdcrDiffTool) createFilter() error {
-	var ok bool
-	var expr string
-	expr, ok = difftool.specifiedSpec.Settings.Values[metadata.FilterExpressionKey].(string)
-	filterMode := difftool.specifiedSpec.Settings.GetExpDelMode()
-	if ok && len(expr) > 0 {
-		var filterVersion xdcrBase.FilterVersionType
-		if filterVersion, ok = difftool.specifiedSpec.Settings.Values[metadata.FilterVersionKey].(xdcrBase.FilterVersionType); !ok {
-			err := fmt.Errorf("Unable to find filter version given filter expression %v\nsettings:%v\n", expr, difftool.specifiedSpec.Settings)
-			return err
-		}
-
-		if filterVersion == xdcrBase.FilterVersionKeyOnly {
-			expr = xdcrBase.UpgradeFilter(expr)
+	if options.filterDryRun {
+		if err := dryRunFilter(); err != nil {
+			fmt.Printf("Error dry running the filter: %v\n", err)
+			os.Exit(1)
 		}
-		difftool.logger.Infof("Found filtering expression: %v\n", expr)
+		os.Exit(0)
 	}
-
-	filter, err := filterPool.NewFilterPool(options.numOfFiltersInFilterPool, expr, difftool.utils, filterMode.IsSkipReplicateUncommittedTxnSet())
-	difftool.filter = filter
-	return err
-}
-
-func (difftool *xdcrDiffTool) generateDataFiles() error {
-	difftool.logger.Infof("GenerateDataFiles routine started\n")
-	defer difftool.logger.Infof("GenerateDataFiles routine completed\n")
-
-	if options.completeByDuration == 0 && !options.completeBySeqno {
-		difftool.logger.Infof("completeByDuration is required when completeBySeqno is false\n")
-		os.Exit(1)
-	}
-
-	errChan := make(chan error, 1)
-	waitGroup := &sync.WaitGroup{}
-
-	var fileDescPool fdp.FdPoolIface
-	if options.numberOfFileDesc > 0 {
-		fileDescPool = fdp.NewFileDescriptorPool(int(options.numberOfFileDesc))
-	}
-
-	if err := difftool.createFilter(); err != nil {
-		difftool.logger.Errorf("Error creating filter: %v", err.Error())
-		os.Exit(1)
-	}
-
-	difftool.sourceDcpDriver = startDcpDriver(difftool.logger, base.SourceClusterName, options.sourceUrl, difftool.specifiedSpec.SourceBucketName,
-		difftool.selfRef, options.sourceFileDir, options.checkpointFileDir,
-		options.oldSourceCheckpointFileName, options.newCheckpointFileName, options.numberOfSourceDcpClients,
-		options.numberOfWorkersPerSourceDcpClient, options.numberOfBins, options.sourceDcpHandlerChanSize,
-		options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval,
-		options.getStatsMaxBackoff, options.checkpointInterval, errChan, waitGroup, options.completeBySeqno, fileDescPool, difftool.filter,
-		difftool.srcCapabilities, difftool.srcCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity,
-		difftool.migrationMapping)
-
-	delayDurationBetweenSourceAndTarget := time.Duration(options.delayBetweenSourceAndTarget) * time.Second
-	difftool.logger.Infof("Waiting for %v before starting target dcp clients\n", delayDurationBetweenSourceAndTarget)
-	time.Sleep(delayDurationBetweenSourceAndTarget)
-
-	difftool.logger.Infof("Starting target dcp clients\n")
-	difftool.targetDcpDriver = startDcpDriver(difftool.logger, base.TargetClusterName, difftool.specifiedRef.HostName_,
-		difftool.specifiedSpec.TargetBucketName, difftool.specifiedRef,
-		options.targetFileDir, options.checkpointFileDir, options.oldTargetCheckpointFileName, options.newCheckpointFileName,
-		options.numberOfTargetDcpClients, options.numberOfWorkersPerTargetDcpClient, options.numberOfBins, options.targetDcpHandlerChanSize,
-		options.bucketOpTimeout, options.maxNumOfGetStatsRetry, options.getStatsRetryInterval, options.getStatsMaxBackoff,
-		options.checkpointInterval, errChan, waitGroup, options.completeBySeqno, fileDescPool, difftool.filter,
-		difftool.tgtCapabilities, difftool.tgtCollectionIds, difftool.colFilterOrderedKeys, difftool.utils, options.bucketBufferCapacity,
-		difftool.migrationMapping)
-
-	difftool.curState.mtx.Lock()
-	difftool.curState.state = StateDcpStarted
-	difftool.curState.mtx.Unlock()
-
-	var err error
-	if options.completeBySeqno {
-		err = difftool.waitForCompletion(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, waitGroup)
-	} else {
-		err = difftool.waitForDuration(difftool.sourceDcpDriver, difftool.targetDcpDriver, errChan, options.completeByDuration, delayDurationBetweenSourceAndTarget)
-	}
-
-	return err
-}
-
-func (difftool *xdcrDiffTool) diffDataFiles() error {
-	difftool.logger.Infof("DiffDataFiles routine started\n")
-	defer difftool.logger.Infof("DiffDataFiles routine completed\n")
-
-	err := os.RemoveAll(options.fileDifferDir)
-	if err != nil {
-		difftool.logger.Errorf("Error removing fileDifferDir: %v\n", err)
+	if options.command == checkCommand {
+		if err := selfCheck(); err != nil {
+			fmt.Printf("Check failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-	err = os.MkdirAll(options.fileDifferDir, 0777)
-	if err != nil {
-		return fmt.Errorf("Error mkdir fileDifferDir: %v\n", err)
+	if options.command == compareCheckpointsCommand {
+		if err := compareCheckpoints(flag.Args()); err != nil {
+			fmt.Printf("Error comparing checkpoints: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	difftoolDriver := differ.NewDifferDriver(options.sourceFileDir, options.targetFileDir, options.fileDifferDir,
-		base.DiffKeysFileName, int(options.numberOfWorkersForFileDiffer), int(options.numberOfBins),
-		int(options.numberOfFileDesc), difftool.srcToTgtColIdsMap, difftool.colFilterOrderedKeys, difftool.colFilterOrderedTargetColId)
-	err = difftoolDriver.Run()
-	if err != nil {
-		difftool.logger.Errorf("Error from diffDataFiles = %v\n", err)
-	}
-	difftoolDriver.MapLock.RLock()
-	if difftool.colFilterOrderedKeys == nil {
-		difftool.logger.Infof("Source vb to item count map: %v", difftoolDriver.SrcVbItemCntMap)
-	}
-	difftool.logger.Infof("Target vb to item count map: %v", difftoolDriver.TgtVbItemCntMap)
-	difftoolDriver.MapLock.RUnlock()
-	if difftool.colFilterOrderedKeys == nil {
-		difftool.logger.Infof("Source bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.SourceItemCount, difftool.sourceDcpDriver.FilteredCount())
-	} else {
-		difftool.logger.Infof("Replication is in migration mode from the source bucket")
-	}
-	difftool.logger.Infof("Target bucket item count including tombstones is %v (excluding %v filtered mutations)", difftoolDriver.TargetItemCount, difftool.targetDcpDriver.FilteredCount())
-	if difftool.colFilterOrderedKeys == nil && difftoolDriver.SourceItemCount != difftoolDriver.TargetItemCount {
-		difftool.logger.Infof("Here are the vbuckets with different item counts:")
-		for vb, c1 := range difftoolDriver.SrcVbItemCntMap {
-			c2 := difftoolDriver.TgtVbItemCntMap[vb]
-			if c1 != c2 {
-				difftool.logger.Infof("vb:%v source count %v, target count %v", vb, c1, c2)
-			}
+	if options.logFile != "" {
+		fmt.Printf("Writing logs to %v\n", options.logFile)
+		logFileRotator := utils.NewLogFileRotator(options.logFile, int64(options.logFileMaxSizeMB)*1024*1024,
+			time.Duration(options.logFileMaxAgeHours)*time.Hour, int(options.logFileMaxBackups))
+		terminal, err := logFileRotator.Start()
+		if err != nil {
+			fmt.Printf("Unable to write logs to %v: %v\n", options.logFile, err)
+			os.Exit(1)
 		}
+		defer logFileRotator.Stop()
+		config.DashboardOutput = terminal
 	}
-	difftool.duplicatedMapping = difftoolDriver.DuplicatedHint
-	return err
-}
 
-func (difftool *xdcrDiffTool) runMutationDiffer() {
-	difftool.logger.Infof("runMutationDiffer started with compareBody=%v\n", options.compareType)
-	defer difftool.logger.Infof("runMutationDiffer completed\n")
+	fmt.Printf("differ is run with options: %+v\n", *config.WithoutSecrets())
 
-	err := os.RemoveAll(options.mutationDifferDir)
-	if err != nil {
-		difftool.logger.Errorf("Error removing mutationDifferDir: %v\n", err)
+	if options.pprofPort > 0 {
+		startPprofServer(options.pprofPort)
 	}
-	err = os.MkdirAll(options.mutationDifferDir, 0777)
-	if err != nil {
-		err = fmt.Errorf("Error mkdir mutationDifferDir: %v\n", err)
+	if options.serverAddr != "" || options.schedule != "" {
+		runJobServer()
 		return
 	}
 
-	mutationDiffer := differ.NewMutationDiffer(difftool.specifiedSpec.SourceBucketName,
-		difftool.selfRef, difftool.specifiedSpec.TargetBucketName, difftool.specifiedRef,
-		options.fileDifferDir, options.mutationDifferDir, int(options.numberOfWorkersForMutationDiffer),
-		int(options.mutationDifferBatchSize), int(options.mutationDifferTimeout), int(options.maxNumOfSendBatchRetry),
-		time.Duration(options.sendBatchRetryInterval)*time.Millisecond,
-		time.Duration(options.sendBatchMaxBackoff)*time.Second, options.compareType, difftool.logger, difftool.srcToTgtColIdsMap,
-		difftool.srcCapabilities, difftool.tgtCapabilities, difftool.utils, options.mutationDifferRetries,
-		options.mutationDifferRetriesWaitSecs, difftool.duplicatedMapping)
-	err = mutationDiffer.Run()
-	if err != nil {
-		difftool.logger.Errorf("Error from runMutationDiffer = %v\n", err)
+	if config.AllReplications {
+		runAllReplications()
+		return
 	}
-}
 
-func startDcpDriver(logger *xdcrLog.CommonLogger, name, url, bucketName string, ref *metadata.RemoteClusterReference, fileDir, checkpointFileDir, oldCheckpointFileName, newCheckpointFileName string, numberOfDcpClients, numberOfWorkersPerDcpClient, numberOfBins, dcpHandlerChanSize, bucketOpTimeout, maxNumOfGetStatsRetry, getStatsRetryInterval, getStatsMaxBackoff, checkpointInterval uint64, errChan chan error, waitGroup *sync.WaitGroup, completeBySeqno bool, fdPool fdp.FdPoolIface, filter xdcrParts.Filter, capabilities metadata.Capability, collectionIDs []uint32, colMigrationFilters []string, utils xdcrUtils.UtilsIface, bucketBufferCap int, migrationMapping metadata.CollectionNamespaceMapping) *dcp.DcpDriver {
-	waitGroup.Add(1)
-	dcpDriver := dcp.NewDcpDriver(logger, name, url, bucketName, ref, fileDir, checkpointFileDir, oldCheckpointFileName,
-		newCheckpointFileName, int(numberOfDcpClients), int(numberOfWorkersPerDcpClient), int(numberOfBins),
-		int(dcpHandlerChanSize), time.Duration(bucketOpTimeout)*time.Second, int(maxNumOfGetStatsRetry),
-		time.Duration(getStatsRetryInterval)*time.Second, time.Duration(getStatsMaxBackoff)*time.Second,
-		int(checkpointInterval), errChan, waitGroup, completeBySeqno, fdPool, filter, capabilities, collectionIDs, colMigrationFilters,
-		utils, bucketBufferCap, migrationMapping)
-	// dcp driver startup may take some time. Do it asynchronously
-	go startDcpDriverAysnc(dcpDriver, errChan, logger)
-	return dcpDriver
-}
-
-func startDcpDriverAysnc(dcpDriver *dcp.DcpDriver, errChan chan error, logger *xdcrLog.CommonLogger) {
-	err := dcpDriver.Start()
+	_, err := difftool.Run(interruptContext(), config)
 	if err != nil {
-		logger.Errorf("Error starting dcp driver %v. err=%v\n", dcpDriver.Name, err)
-		utils.AddToErrorChan(errChan, err)
-	}
-}
-
-func (difftool *xdcrDiffTool) waitForCompletion(sourceDcpDriver, targetDcpDriver *dcp.DcpDriver, errChan chan error, waitGroup *sync.WaitGroup) error {
-	doneChan := make(chan bool, 1)
-	go utils.WaitForWaitGroup(waitGroup, doneChan)
-
-	select {
-	case err := <-errChan:
-		difftool.logger.Errorf("Stop diff generation due to error from dcp client %v\n", err)
-		err1 := sourceDcpDriver.Stop()
-		if err1 != nil {
-			difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
-		}
-		err1 = targetDcpDriver.Stop()
-		if err1 != nil {
-			difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
-		}
-		return err
-	case <-doneChan:
-		difftool.logger.Infof("Source cluster and target cluster have completed\n")
-		return nil
-	}
-
-	return nil
-}
-
-func (difftool *xdcrDiffTool) waitForDuration(sourceDcpDriver, targetDcpDriver *dcp.DcpDriver, errChan chan error, duration uint64, delayDurationBetweenSourceAndTarget time.Duration) (err error) {
-	timer := time.NewTimer(time.Duration(duration) * time.Second)
-
-	select {
-	case err = <-errChan:
-		difftool.logger.Errorf("Stop diff generation due to error from dcp client %v\n", err)
-	case <-timer.C:
-		difftool.logger.Infof("Stop diff generation after specified processing duration\n")
-	}
-
-	err1 := sourceDcpDriver.Stop()
-	if err1 != nil {
-		difftool.logger.Errorf("Error stopping source dcp client. err=%v\n", err1)
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
 	}
-
-	time.Sleep(delayDurationBetweenSourceAndTarget)
-
-	err1 = targetDcpDriver.Stop()
-	if err1 != nil {
-		difftool.logger.Errorf("Error stopping target dcp client. err=%v\n", err1)
+	if config.DryRun {
+		fmt.Printf("Dry run succeeded\n")
 	}
-
-	return err
 }
 
-func (difftool *xdcrDiffTool) retrieveReplicationSpecInfo() error {
-	// CBAUTH has already been setup
-	var err error
-	if options.enforceTLS && !difftool.specifiedRef.IsHttps() {
-		err = fmt.Errorf("enforceTLS requires that the remote cluster reference %v to use Full-Encryption mode", difftool.specifiedRef.Name())
-		difftool.logger.Errorf(err.Error())
-		return err
-	}
-
-	if options.targetUsername != "" && options.targetUsername != difftool.specifiedRef.UserName() && options.targetPassword != "" && options.targetPassword != difftool.specifiedRef.Password() {
-		err = fmt.Errorf("user-specified username and password is different from that of the credentials from reference %v", difftool.specifiedRef.Name())
-		difftool.logger.Errorf(err.Error())
-		return err
-	}
-
-	specMap, err := difftool.replicationSpecSvc.AllReplicationSpecs()
+// Exits with 1 if any of the replications failed
+func runAllReplications() {
+	results, err := difftool.RunAll(interruptContext(), config)
 	if err != nil {
-		difftool.logger.Errorf("Error retrieving specs: %v\n", err)
-		return err
-	}
-
-	for _, spec := range specMap {
-		if spec.SourceBucketName == options.sourceBucketName && spec.TargetBucketName == options.targetBucketName && spec.TargetClusterUUID == difftool.specifiedRef.Uuid() {
-			difftool.specifiedSpec = spec
-			break
-		}
+		fmt.Printf("%v\n", err)
+	}
+	failed := err != nil
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			failed = true
+			fmt.Printf("%v to %v: failed: %v\n", result.SourceBucketName, result.TargetBucketName, result.Error)
+		case result.Result.MutationDiff != nil:
+			fmt.Printf("%v to %v: %v\n", result.SourceBucketName, result.TargetBucketName, result.Result.MutationDiff)
+		case result.Result.FileDiff != nil:
+			fmt.Printf("%v to %v: %v\n", result.SourceBucketName, result.TargetBucketName, result.Result.FileDiff)
+		default:
+			fmt.Printf("%v to %v: done\n", result.SourceBucketName, result.TargetBucketName)
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
+}
 
-	if difftool.specifiedSpec == nil {
-		difftool.logger.Warnf("Unable to find Replication Spec with source %v target %v, attempting to create a temporary one\n", options.sourceBucketName, options.targetBucketName)
-		// Create a dummy spec
-		difftool.specifiedSpec, err = metadata.NewReplicationSpecification(options.sourceBucketName, "" /*sourceBucketUUID*/, difftool.specifiedRef.Uuid(), options.targetBucketName, "" /*targetBucketUUID*/)
+// Runs until interrupted, which cancels the jobs that are queued or running
+func runJobServer() {
+	server := jobs.NewServer(options.serverAddr, options.serverWorkDir, options.serverMaxParallelJobs, config)
+	var scheduler *jobs.Scheduler
+	if options.schedule != "" {
+		schedule, err := jobs.ParseSchedule(options.schedule)
 		if err != nil {
-			difftool.logger.Errorf(err.Error())
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
 		}
-		return err
+		if err = config.Validate(); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		scheduler = jobs.NewScheduler(server, schedule, config, options.alertWebhook, options.alertThreshold)
 	}
-
-	difftool.logger.Infof("Found Remote Cluster: %v and Replication Spec: %v\n", difftool.specifiedRef.String(), difftool.specifiedSpec.String())
-	return nil
-}
-
-func (difftool *xdcrDiffTool) populateTemporarySpecAndRef() error {
-	var err error
-	difftool.specifiedSpec, err = metadata.NewReplicationSpecification(options.sourceBucketName, "", /*sourceBucketUUID*/
-		"" /*targetClusterUUID*/, options.targetBucketName, "" /*targetBucketUUID*/)
-	if err != nil {
-		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	if err := server.Start(); err != nil {
+		fmt.Printf("Unable to start the job server on %v: %v\n", options.serverAddr, err)
+		os.Exit(1)
 	}
-
-	difftool.specifiedRef, err = metadata.NewRemoteClusterReference("" /*uuid*/, options.remoteClusterName /*name*/, options.targetUrl, options.targetUsername, options.targetPassword,
-		"", false, "", nil, nil, nil, nil)
-	if err != nil {
-		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	if options.serverAddr != "" {
+		fmt.Printf("Accepting diff jobs on http://%v%v\n", server.Addr(), jobs.JobsPath)
 	}
-
-	err = difftool.populateSelfRef()
-	if err != nil {
-		return fmt.Errorf("populateTemporarySpecAndRef() - %v", err)
+	if scheduler != nil {
+		scheduler.Start()
 	}
-	return err
-}
 
-func (difftool *xdcrDiffTool) monitorInterruptSignal() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	for sig := range c {
-		if sig.String() == "interrupt" {
-			difftool.curState.mtx.Lock()
-			switch difftool.curState.state {
-			case StateInitial:
-				os.Exit(0)
-			case StateDcpStarted:
-				difftool.logger.Warnf("Received interrupt. Closing DCP drivers")
-				difftool.sourceDcpDriver.Stop()
-				difftool.targetDcpDriver.Stop()
-				difftool.curState.state = StateFinal
-			case StateFinal:
-				os.Exit(0)
-			}
-			difftool.curState.mtx.Unlock()
-		}
-	}
-}
-
-func (difftool *xdcrDiffTool) populateSelfRef() error {
-	difftool.selfRef.HttpsHostName_ = options.sourceUrl
-	difftool.selfRef.UserName_ = options.sourceUsername
-	difftool.selfRef.Password_ = options.sourcePassword
-	difftool.selfRef.HttpAuthMech_ = xdcrBase.HttpAuthMechPlain
-
-	// Only grab certificate if on a loopback device
-	if difftool.specifiedRef.IsHttps() && isURLLoopBack(options.sourceUrl) {
-		cert, err := utils.GetCertificate(difftool.utils, options.sourceUrl, options.sourceUsername,
-			options.sourcePassword, xdcrBase.HttpAuthMechPlain)
-		if err != nil {
-			return err
-		}
-
-		internalHttpsHostname, _, err := difftool.utils.HttpsRemoteHostAddr(options.sourceUrl, nil)
-		if err != nil {
-			return fmt.Errorf("unable to get httpsRemoteHostAddr: %v", err)
-		}
-
-		difftool.selfRef.Certificate_ = cert
-		refHttpAuthMech, defaultPoolInfo, _, err := difftool.utils.GetSecuritySettingsAndDefaultPoolInfo(options.sourceUrl,
-			internalHttpsHostname, difftool.selfRef.UserName(), difftool.selfRef.Password(),
-			difftool.selfRef.Certificates(), difftool.selfRef.ClientCertificate(), difftool.selfRef.ClientKey(),
-			difftool.selfRef.IsHalfEncryption(), difftool.logger)
-		if err != nil {
-			return fmt.Errorf("unable to get security settings: %v", err)
-		}
-		difftool.selfRef.SetHttpAuthMech(refHttpAuthMech)
-		difftool.selfDefaultPoolInfo = defaultPoolInfo
-
-		if refHttpAuthMech == xdcrBase.HttpAuthMechHttps {
-			// Need to get the secure port and attach it
-			internalSSLPort, internalSSLPortErr, _, _ := difftool.utils.GetRemoteSSLPorts(options.sourceUrl, difftool.logger)
-			if internalSSLPortErr == nil {
-				sslHostString := xdcrBase.GetHostAddr(xdcrBase.GetHostName(options.sourceUrl), internalSSLPort)
-				difftool.selfRef.SetHttpsHostName(sslHostString)
-				difftool.selfRef.SetActiveHttpsHostName(sslHostString)
-				difftool.logger.Infof("Received SSL port to be %v and setting TLS hostname to %v", internalSSLPort, sslHostString)
-			}
-		}
-	}
-
-	poolsNodesPath := "/pools/nodes"
-	err, _ := difftool.utils.QueryRestApi(options.sourceUrl, poolsNodesPath, false, xdcrBase.MethodGet, "", nil, 0, &difftool.selfPoolsNodes, nil)
+	<-c
+	fmt.Printf("Received interrupt. Canceling the jobs\n")
+	go func() {
+		<-c
+		os.Exit(0)
+	}()
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	server.Stop()
+}
+
+// The first interrupt is passed on to the run, which stops streaming and goes on to diff what has been streamed so far,
+// or otherwise stops the phase in progress. Any further interrupt exits right away
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+		<-c
+		os.Exit(0)
+	}()
+	return ctx
+}
+
+// Profiles are served from the default mux, which net/http/pprof registers itself with
+// Only listens on localhost, as the profiles expose the internals of the process
+func startPprofServer(port uint64) {
+	addr := fmt.Sprintf("localhost:%v", port)
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("unable to get pools/nodes information: %v", err)
+		fmt.Printf("Unable to start the pprof server on %v: %v\n", addr, err)
+		os.Exit(1)
 	}
+	fmt.Printf("Serving pprof on http://%v/debug/pprof/\n", addr)
+	go http.Serve(listener, nil)
+}
 
-	// Do this last
-	atomic.StoreUint32(&difftool.selfRefPopulated, 1)
-	return nil
+func printKeyMapping(key string) {
+	vbno := utils.GetVbucketFromKey([]byte(key))
+	binIdx := utils.GetBucketIndexFromKey([]byte(key), int(config.NumberOfBins))
+	fmt.Printf("Key: %v\n", key)
+	fmt.Printf("VBucket: %v\n", vbno)
+	fmt.Printf("Bin index: %v (numberOfBins=%v)\n", binIdx, config.NumberOfBins)
+	fmt.Printf("Source data file: %v\n", utils.GetFileName(config.SourceFileDir, vbno, binIdx))
+	fmt.Printf("Target data file: %v\n", utils.GetFileName(config.TargetFileDir, vbno, binIdx))
 }
 
-func (difftool *xdcrDiffTool) retrieveClustersCapabilities(legacyMode bool, xdcrCompTopologyMockCb func()) error {
-	var err error
-	difftool.specifiedRef, err = difftool.remoteClusterSvc.RemoteClusterByRefName(options.remoteClusterName, true /*refresh*/)
+// Lists each doc as matched or skipped, followed by the totals
+func dryRunFilter() error {
+	report, err := difftool.DryRunFilter(interruptContext(), config, options.filterDryRunExpression, options.filterDryRunDocs,
+		options.filterDryRunSampleSize)
 	if err != nil {
-		for err != nil && err == metadata_svc.RefreshNotEnabledYet {
-			difftool.logger.Infof("Difftool hasn't finished reaching out to remote cluster. Sleeping 5 seconds and retrying...")
-			time.Sleep(5 * time.Second)
-			difftool.specifiedRef, err = difftool.remoteClusterSvc.RemoteClusterByRefName(options.remoteClusterName, true /*refresh*/)
-		}
-		if err != nil {
-			difftool.logger.Errorf("Error retrieving remote clusters: %v\n", err)
-			return err
-		}
-	}
-	if err = difftool.populateSelfRef(); err != nil {
 		return err
 	}
-
-	if !legacyMode {
-		ref, err := difftool.remoteClusterSvc.RemoteClusterByRefName(difftool.specifiedRef.Name(), false)
-		if err != nil {
-			return fmt.Errorf("retrieveClusterCapabilities.RemoteClusterByRefName(%v) - %v", difftool.specifiedRef.Name(), err)
-		}
-
-		difftool.tgtCapabilities, err = difftool.remoteClusterSvc.GetCapability(ref)
-		if err != nil {
-			return fmt.Errorf("retrieveClusterCapabilities.GetCapability(%v) - %v", difftool.specifiedRef.Name(), err)
-		}
-	}
-
-	// Self capabilities
-	if atomic.LoadUint32(&difftool.selfRefPopulated) == 0 {
-		return fmt.Errorf("SelfRef has not been populated\n")
-	}
-	connStr, err := difftool.selfRef.MyConnectionStr()
-	if err != nil {
-		return fmt.Errorf("retrieveClusterCapabilities.myConnStr(%v) - %v", difftool.selfRef.Name(), err)
-	}
-	defaultPoolInfo, err := difftool.utils.GetClusterInfo(connStr, xdcrBase.DefaultPoolPath, difftool.selfRef.UserName(),
-		difftool.selfRef.Password(), difftool.selfRef.HttpAuthMech(), difftool.selfRef.Certificates(),
-		difftool.selfRef.SANInCertificate(), difftool.selfRef.ClientCertificate(), difftool.selfRef.ClientKey(),
-		difftool.logger)
-	if err != nil {
-		return fmt.Errorf("retrieveClusterCapabilities.getClusterInfo(%v) - %v", difftool.selfRef.Name(), err)
-	}
-
-	err = difftool.srcCapabilities.LoadFromDefaultPoolInfo(defaultPoolInfo, difftool.logger)
-	if err != nil {
-		return fmt.Errorf("retrieveClusterCapabilities.LoadFromDefaultPoolInfo(%v) - %v", defaultPoolInfo, err)
-	} else {
-		// At this point, clusterCompat is parsable and just cache it for later mocks
-		nodeList, _ := xdcrBase.GetNodeListFromInfoMap(defaultPoolInfo, difftool.logger)
-		difftool.srcClusterCompat, _ = xdcrBase.GetClusterCompatibilityFromNodeList(nodeList)
-	}
-
-	if xdcrCompTopologyMockCb != nil {
-		xdcrCompTopologyMockCb()
-	}
-	return nil
-}
-
-func (difftool *xdcrDiffTool) populateCollectionsPreReq() error {
-	if difftool.srcCapabilities.HasCollectionSupport() && difftool.tgtCapabilities.HasCollectionSupport() {
-		// Both have collections support
-		if err := difftool.PopulateManifestsAndMappings(); err != nil {
-			return err
+	for _, result := range report.Results {
+		switch {
+		case result.Error != "":
+			fmt.Printf("error    %v: %v\n", result.Key, result.Error)
+		case result.Matched:
+			fmt.Printf("matched  %v\n", result.Key)
+		default:
+			fmt.Printf("skipped  %v\n", result.Key)
 		}
-	} else if difftool.srcCapabilities.HasCollectionSupport() && !difftool.tgtCapabilities.HasCollectionSupport() {
-		// Source has collections but target does not - stream only default collection from the source
-		difftool.srcCollectionIds = append(difftool.srcCollectionIds, 0)
-	} else if !difftool.srcCapabilities.HasCollectionSupport() && difftool.tgtCapabilities.HasCollectionSupport() {
-		// Source does not have collections but target does - stream only default collection from the target
-		difftool.tgtCollectionIds = append(difftool.tgtCollectionIds, 0)
-	} else {
-		// neither have collections - dont' do anything
 	}
+	fmt.Printf("%v\n", report)
 	return nil
 }
 
-// This is needed whenever source and tgt clusters are >= 7.0
-func (difftool *xdcrDiffTool) PopulateManifestsAndMappings() error {
-	var err error
-	difftool.logger.Infof("Waiting 15 sec for manfiest service to initialize and then getting manifest for source Bucket %v target Bucket %v...\n", difftool.specifiedSpec.SourceBucketName, difftool.specifiedSpec.TargetBucketName)
-	time.Sleep(15 * time.Second)
-
-	difftool.srcBucketManifest, difftool.tgtBucketManifest, err = difftool.collectionsManifestsSvc.GetLatestManifests(difftool.specifiedSpec, false)
+// Prints a pass/fail table of the checks, and returns an error if any of them failed
+func selfCheck() error {
+	report, err := difftool.SelfCheck(interruptContext(), config)
 	if err != nil {
-		difftool.logger.Errorf("PopulateManifestsAndMappings() - %v\n", err)
 		return err
 	}
-
-	difftool.logger.Infof("Source manifest: %v", difftool.srcBucketManifest)
-	difftool.logger.Infof("Target manifest: %v", difftool.tgtBucketManifest)
-	// Store the manifests in files
-	err = difftool.outputManifestsToFiles(err)
-	if err != nil {
-		return err
+	fmt.Printf("%v", report)
+	if failed := report.NumFailed(); failed > 0 {
+		return fmt.Errorf("%v of %v checks failed", failed, len(report.Results))
 	}
-
-	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
-	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
-	if modes.IsMigrationOn() && rules.IsExplicitMigrationRule() {
-		difftool.logger.Infof("Replication spec is using special migration mapping")
-	} else if modes.IsMigrationOn() {
-		difftool.logger.Infof("Replication spec is using migration mode")
-	} else if modes.IsExplicitMapping() {
-		difftool.logger.Infof("Replication spec is using explicit mapping")
-	} else {
-		difftool.logger.Infof("Replication spec is using implicit mapping")
-	}
-	err = difftool.compileCollectionMapping()
-	if err != nil {
-		return err
-	}
-
-	// Once hardcoded compilation map has been generated, just stream these Collection IDs from DCP to minimize other noise
-	difftool.generateSrcAndTgtColIds()
-
+	fmt.Printf("All %v checks passed\n", len(report.Results))
 	return nil
 }
 
-func (difftool *xdcrDiffTool) outputManifestsToFiles(err error) error {
-	srcManJson, err := json.Marshal(difftool.srcBucketManifest)
-	if err != nil {
-		difftool.logger.Errorf("SrcManifestMarshal - %v\n", err)
-		return err
-	}
-
-	tgtManJson, err := json.Marshal(difftool.tgtBucketManifest)
-	if err != nil {
-		difftool.logger.Errorf("TgtManifestMarshal - %v\n", err)
-		return err
+func compareCheckpoints(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%v takes an old checkpoint file, and a new checkpoint file or %v or %v", compareCheckpointsCommand,
+			base.SourceClusterName, base.TargetClusterName)
 	}
-
-	err = ioutil.WriteFile(utils.GetManifestFileName(options.sourceFileDir), srcManJson, 0644)
-	if err != nil {
-		difftool.logger.Errorf("SrcManifestWrite - %v\n", err)
-		return err
-	}
-
-	err = ioutil.WriteFile(utils.GetManifestFileName(options.targetFileDir), tgtManJson, 0644)
+	comparison, err := difftool.CompareCheckpoints(interruptContext(), config, args[0], args[1])
 	if err != nil {
-		difftool.logger.Errorf("TgtManifestWrite - %v\n", err)
 		return err
 	}
+	fmt.Printf("%v", comparison)
 	return nil
 }
 
-func (difftool *xdcrDiffTool) compileCollectionMapping() error {
-	pair := metadata.CollectionsManifestPair{
-		Source: difftool.srcBucketManifest,
-		Target: difftool.tgtBucketManifest,
+func compactDataFiles() error {
+	if config.DataStore != base.DataStoreFiles {
+		return fmt.Errorf("dataStore %v already keeps only the newest record per key", config.DataStore)
 	}
-	namespaceMapping, err := metadata.NewCollectionNamespaceMappingFromRules(pair, difftool.specifiedSpec.Settings.GetCollectionModes(), difftool.specifiedSpec.Settings.GetCollectionsRoutingRules(), false, false)
+	encryptionKey, err := config.DataFileEncryptionKey()
 	if err != nil {
-		difftool.logger.Errorf("NewCollectionNamespaceMappingFromRules err: %v", err)
 		return err
 	}
-
-	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
-	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
-	if modes.IsMigrationOn() && !rules.IsExplicitMigrationRule() {
-		return difftool.compileMigrationMapping(namespaceMapping)
-	} else {
-		difftool.compileHardcodedColToColMapping(namespaceMapping)
-	}
-	return nil
-}
-
-func (difftool *xdcrDiffTool) compileHardcodedColToColMapping(namespaceMapping metadata.CollectionNamespaceMapping) {
-	for srcNs, tgtNamespaces := range namespaceMapping {
-		for _, tgtNs := range tgtNamespaces {
-			scopeName := srcNs.GetCollectionNamespace().ScopeName
-			collectionName := srcNs.GetCollectionNamespace().CollectionName
-			tgtScopeName := tgtNs.ScopeName
-			tgtCollectionName := tgtNs.CollectionName
-			srcColId, srcErr := difftool.srcBucketManifest.GetCollectionId(scopeName, collectionName)
-			tgtColId, tgtErr := difftool.tgtBucketManifest.GetCollectionId(tgtScopeName, tgtCollectionName)
-
-			if srcErr != nil {
-				difftool.logger.Errorf("Cannot find %v - %v from source manifest %v\n", scopeName, collectionName, srcErr)
-				continue
-			}
-			if tgtErr != nil {
-				difftool.logger.Errorf("Cannot find %v - %v from target manifest %v\n", scopeName, collectionName, tgtErr)
-				continue
-			}
-
-			tgtList := []uint32{tgtColId}
-			difftool.srcToTgtColIdsMap[srcColId] = tgtList
-		}
-	}
-
-	difftool.logger.Infof("Collection namespace mapping: %v idsMap: %v", namespaceMapping, difftool.srcToTgtColIdsMap)
-}
-
-func (difftool *xdcrDiffTool) generateSrcAndTgtColIds() {
-	tgtColIdDedupMap := make(map[uint32]bool)
-
-	modes := difftool.specifiedSpec.Settings.GetCollectionModes()
-	rules := difftool.specifiedSpec.Settings.GetCollectionsRoutingRules()
-	var migrationMode bool
-
-	if modes.IsMigrationOn() && !rules.IsExplicitMigrationRule() {
-		migrationMode = true
-		for _, tgtColIds := range difftool.colFilterToTgtColIdsMap {
-			difftool.populateDedupColIds(tgtColIds, tgtColIdDedupMap)
-		}
-	} else {
-		for srcColId, tgtColIds := range difftool.srcToTgtColIdsMap {
-			if !migrationMode {
-				difftool.srcCollectionIds = append(difftool.srcCollectionIds, srcColId)
-			}
-			difftool.populateDedupColIds(tgtColIds, tgtColIdDedupMap)
-		}
-	}
-
-	if migrationMode {
-		// Migration mode wise we only pull from the source collectionID
-		difftool.srcCollectionIds = []uint32{xdcrBase.DefaultCollectionId}
-	}
-}
-
-func (difftool *xdcrDiffTool) populateDedupColIds(tgtColIds []uint32, tgtColIdDedupMap map[uint32]bool) {
-	for _, tgtColId := range tgtColIds {
-		_, exists := tgtColIdDedupMap[tgtColId]
-		if !exists {
-			tgtColIdDedupMap[tgtColId] = true
-			difftool.tgtCollectionIds = append(difftool.tgtCollectionIds)
-		}
-	}
-}
-
-func (difftool *xdcrDiffTool) compileMigrationMapping(nsMappings metadata.CollectionNamespaceMapping) error {
-	for srcNs, tgtNsList := range nsMappings {
-		if len(tgtNsList) > 1 {
-			return fmt.Errorf("Migration rules with more than one target namespace is not supported")
-		}
-		for _, tgtNs := range tgtNsList {
-			colId, err := difftool.tgtBucketManifest.GetCollectionId(tgtNs.ScopeName, tgtNs.CollectionName)
-			if err != nil {
-				difftool.logger.Errorf("Cannot find target namespace in manifest: %v", tgtNs.ToIndexString())
-				continue
-			}
-			if _, exists := difftool.colFilterToTgtColIdsMap[srcNs.String()]; !exists {
-				difftool.colFilterToTgtColIdsMap[srcNs.String()] = []uint32{colId}
-			} else {
-				difftool.colFilterToTgtColIdsMap[srcNs.String()] = append(difftool.colFilterToTgtColIdsMap[srcNs.String()], colId)
-			}
-			difftool.colFilterOrderedTargetNs = append(difftool.colFilterOrderedTargetNs, tgtNs)
-		}
-		difftool.colFilterOrderedKeys = append(difftool.colFilterOrderedKeys, srcNs.String())
-	}
-
-	difftool.logger.Infof("Collections Migrations filters ordered list:\n")
-	for i, filterStr := range difftool.colFilterOrderedKeys {
-		difftool.logger.Infof("%v : %v -> %v", i, filterStr, difftool.colFilterOrderedTargetNs[i].ToIndexString())
-	}
-
-	// Ensure that the colIdMappings are handled accordingly
-	for _, targetNs := range difftool.colFilterOrderedTargetNs {
-		targetColId, err := difftool.tgtBucketManifest.GetCollectionId(targetNs.ScopeName, targetNs.CollectionName)
-		if err != nil {
-			return fmt.Errorf("cannot find collection %v from manifest %v", targetNs.ToIndexString(), difftool.tgtBucketManifest.String())
-		}
-		difftool.srcToTgtColIdsMap[0] = append(difftool.srcToTgtColIdsMap[0], targetColId)
-		difftool.colFilterOrderedTargetColId = append(difftool.colFilterOrderedTargetColId, targetColId)
-	}
-
-	// The migrationMapping will be shared among many components, so we need to make sure it is sharable
-	return difftool.populateMigrationMapping(nsMappings)
-}
-
-func (difftool *xdcrDiffTool) populateMigrationMapping(namespaceMappings metadata.CollectionNamespaceMapping) error {
-	difftool.migrationMapping = namespaceMappings.Clone()
-	filterMode := difftool.specifiedSpec.Settings.GetExpDelMode()
-	for srcNamespacePtr, _ := range difftool.migrationMapping {
-		// For each sourceNamespace, its filter needs to be a pool
-		expr := srcNamespacePtr.GetFilterString()
-		pool, err := filterPool.NewFilterPool(options.numOfFiltersInFilterPool, expr, difftool.utils, filterMode.IsSkipReplicateUncommittedTxnSet())
+	for _, fileDir := range []string{config.SourceFileDir, config.TargetFileDir} {
+		before, after, err := differ.CompactDataFiles(fileDir, int(config.NumberOfBins), encryptionKey)
 		if err != nil {
 			return err
 		}
-		srcNamespacePtr.ReplaceFilter(pool)
+		fmt.Printf("Compacted data files in %v from %v bytes to %v bytes\n", fileDir, before, after)
 	}
 	return nil
 }
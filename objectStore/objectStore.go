@@ -0,0 +1,639 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+// Package objectStore reads and writes the data files in S3, or in any store with an S3 compatible API
+// such as GCS, so that large clusters can be diffed without local disks big enough for the data files
+package objectStore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	S3Scheme  = "s3://"
+	GCSScheme = "gs://"
+)
+
+// Parts of a multipart upload, but the last, must be at least this large
+const MinPartSize = 5 * 1024 * 1024
+
+// Size of the ranged gets that readers issue
+const ReadChunkSize = 4 * 1024 * 1024
+
+const gcsEndpoint = "https://storage.googleapis.com"
+const maxAttempts = 3
+const signingAlgorithm = "AWS4-HMAC-SHA256"
+
+// Whether the path is an s3:// or gs:// URI rather than a local path
+func IsURI(path string) bool {
+	return strings.HasPrefix(path, S3Scheme) || strings.HasPrefix(path, GCSScheme)
+}
+
+// Client issues signed requests to an S3 compatible API
+type Client struct {
+	// If set, buckets are addressed as the first path segment of this endpoint
+	// Otherwise, as the host of the AWS regional endpoint
+	Endpoint        string
+	Region          string
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	HttpClient      *http.Client
+	// Returns the time requests are signed at, time.Now if not set
+	Now func() time.Time
+}
+
+var clientsMtx sync.Mutex
+var clients = make(map[string]*Client)
+
+// Returns the client for the scheme of uri, set up from the environment the first time
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, which for GCS
+// are HMAC keys. AWS_REGION defaults to us-east-1, and AWS_ENDPOINT_URL, i.e. for MinIO, overrides the
+// AWS endpoint
+func clientFor(uri string) (*Client, error) {
+	scheme := S3Scheme
+	if strings.HasPrefix(uri, GCSScheme) {
+		scheme = GCSScheme
+	}
+	clientsMtx.Lock()
+	defer clientsMtx.Unlock()
+	if client, exists := clients[scheme]; exists {
+		return client, nil
+	}
+
+	client := &Client{
+		Region:          os.Getenv("AWS_REGION"),
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		AccessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		HttpClient:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	if client.AccessKeyId == "" || client.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to access %v", uri)
+	}
+	if scheme == GCSScheme {
+		client.Endpoint = gcsEndpoint
+		client.Region = "auto"
+	} else if client.Region == "" {
+		client.Region = "us-east-1"
+	}
+	clients[scheme] = client
+	return client, nil
+}
+
+// Returns the bucket and the key of an s3:// or gs:// URI
+func ParseURI(uri string) (string, string, error) {
+	var rest string
+	switch {
+	case strings.HasPrefix(uri, S3Scheme):
+		rest = strings.TrimPrefix(uri, S3Scheme)
+	case strings.HasPrefix(uri, GCSScheme):
+		rest = strings.TrimPrefix(uri, GCSScheme)
+	default:
+		return "", "", fmt.Errorf("%v is not an %v or %v URI", uri, S3Scheme, GCSScheme)
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if parts[0] == "" || len(parts) < 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("%v does not name both a bucket and a key", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+func (c *Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", RawQuery: canonicalQuery(query)}
+	if c.Endpoint != "" {
+		endpoint, err := url.Parse(c.Endpoint)
+		if err == nil {
+			u.Scheme = endpoint.Scheme
+			u.Host = endpoint.Host
+		}
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = fmt.Sprintf("%v.s3.%v.amazonaws.com", bucket, c.Region)
+		u.Path = "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	return u
+}
+
+// Issues the request, retrying on network errors and server errors
+// Returns an error for any status other than 2xx
+func (c *Client) do(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		req, err := http.NewRequest(method, c.objectURL(bucket, key, query).String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		c.sign(req, body)
+
+		resp, err := c.HttpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		lastErr = fmt.Errorf("%v %v/%v: %v %s", method, bucket, key, resp.Status, bytes.TrimSpace(respBody))
+		if resp.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// Signs the request with AWS signature version 4. Host, Range and the x-amz headers are signed
+func (c *Client) sign(req *http.Request, body []byte) {
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+	t := now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%v/%v/s3/aws4_request", date, c.Region)
+	stringToSign := strings.Join([]string{signingAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+c.SecretAccessKey), date)
+	signingKey = hmacSha256(signingKey, c.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		signingAlgorithm, c.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escapes everything but the unreserved characters, as signature version 4 expects
+func uriEncode(str string) string {
+	var buf strings.Builder
+	for _, b := range []byte(str) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Sorted by name, with values that are empty still followed by =
+func canonicalQuery(query url.Values) string {
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (c *Client) Put(bucket, key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, bucket, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Returns the size of the object
+func (c *Client) Head(bucket, key string) (int64, error) {
+	resp, err := c.do(http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Returns the length bytes of the object from offset on, fewer at the end of the object
+func (c *Client) GetRange(bucket, key string, offset, length int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%v-%v", offset, offset+length-1))
+	resp, err := c.do(http.MethodGet, bucket, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// Returns the upload ID
+func (c *Client) CreateMultipartUpload(bucket, key string) (string, error) {
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("creating multipart upload of %v/%v: %v", bucket, key, err)
+	}
+	return result.UploadId, nil
+}
+
+// Returns the ETag of the part, numbered from 1
+func (c *Client) UploadPart(bucket, key, uploadId string, partNumber int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadId}}
+	resp, err := c.do(http.MethodPut, bucket, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// The ETags of the parts, in order
+func (c *Client) CompleteMultipartUpload(bucket, key, uploadId string, etags []string) error {
+	complete := completeMultipartUpload{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploadId": {uploadId}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Failures may come back as an Error document along with 200 OK
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return fmt.Errorf("completing multipart upload of %v/%v: %s", bucket, key, respBody)
+	}
+	return nil
+}
+
+func (c *Client) AbortMultipartUpload(bucket, key, uploadId string) error {
+	resp, err := c.do(http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Parts read back from the staging files to be uploaded, across all the writers
+const maxPartBuffers = 4
+
+// Shared by all the writers, so that however many objects are written at once, no more than maxPartBuffers
+// parts are held in memory
+var partBuffers = newPartBuffers()
+
+func newPartBuffers() chan []byte {
+	buffers := make(chan []byte, maxPartBuffers)
+	for i := 0; i < maxPartBuffers; i++ {
+		buffers <- nil
+	}
+	return buffers
+}
+
+// Writer uploads what is written to it as parts of partSize, once there is more than one part
+// What is written is staged in a local file until it makes up a part, rather than held in memory, since
+// a run writes to thousands of objects at once. The object only appears once the writer is closed
+type Writer struct {
+	client      *Client
+	bucket      string
+	key         string
+	partSize    int
+	stagingFile string
+	staged      int
+	uploadId    string
+	etags       []string
+	err         error
+}
+
+// Creates the object at uri, or replaces it once the writer is closed
+// partSize is raised to MinPartSize if smaller. Up to partSize bytes are staged in a file under stagingDir,
+// which must exist
+func Create(uri string, partSize int, stagingDir string) (*Writer, error) {
+	bucket, key, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientFor(uri)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(client, bucket, key, partSize, stagingDir)
+}
+
+func NewWriter(client *Client, bucket, key string, partSize int, stagingDir string) (*Writer, error) {
+	if partSize < MinPartSize {
+		partSize = MinPartSize
+	}
+	stagingFile, err := os.CreateTemp(stagingDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	err = stagingFile.Close()
+	if err != nil {
+		os.Remove(stagingFile.Name())
+		return nil, err
+	}
+	return &Writer{
+		client:      client,
+		bucket:      bucket,
+		key:         key,
+		partSize:    partSize,
+		stagingFile: stagingFile.Name(),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	// Opened for each write, since there may be more writers than file descriptors to spare
+	file, err := os.OpenFile(w.stagingFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		w.err = err
+		return 0, w.err
+	}
+	n, err := file.Write(p)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		w.err = err
+		return n, w.err
+	}
+	w.staged += n
+	if w.staged >= w.partSize {
+		w.err = w.uploadStaged(w.uploadPart)
+		if w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(p), nil
+}
+
+// Reads the staged bytes back into one of the shared part buffers, uploads them and empties the staging file
+func (w *Writer) uploadStaged(upload func(data []byte) error) error {
+	buf := <-partBuffers
+	defer func() {
+		partBuffers <- buf
+	}()
+	if cap(buf) < w.staged {
+		buf = make([]byte, w.staged)
+	}
+	buf = buf[:w.staged]
+
+	file, err := os.Open(w.stagingFile)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(file, buf)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	err = upload(buf)
+	if err != nil {
+		return err
+	}
+	w.staged = 0
+	return os.Truncate(w.stagingFile, 0)
+}
+
+func (w *Writer) uploadPart(data []byte) error {
+	var err error
+	if w.uploadId == "" {
+		w.uploadId, err = w.client.CreateMultipartUpload(w.bucket, w.key)
+		if err != nil {
+			return err
+		}
+	}
+	etag, err := w.client.UploadPart(w.bucket, w.key, w.uploadId, len(w.etags)+1, data)
+	if err != nil {
+		return err
+	}
+	w.etags = append(w.etags, etag)
+	return nil
+}
+
+func (w *Writer) putObject(data []byte) error {
+	return w.client.Put(w.bucket, w.key, data)
+}
+
+// Objects smaller than a part are put at once. The staging file is removed either way
+func (w *Writer) Close() error {
+	if w.stagingFile == "" {
+		return w.err
+	}
+	if w.err == nil {
+		if w.uploadId == "" {
+			w.err = w.uploadStaged(w.putObject)
+		} else {
+			w.err = w.uploadStaged(w.uploadPart)
+			if w.err == nil {
+				w.err = w.client.CompleteMultipartUpload(w.bucket, w.key, w.uploadId, w.etags)
+			}
+		}
+	}
+	if w.err != nil && w.uploadId != "" {
+		// Otherwise the uploaded parts are billed until they expire
+		w.client.AbortMultipartUpload(w.bucket, w.key, w.uploadId)
+	}
+	err := os.Remove(w.stagingFile)
+	if w.err == nil {
+		w.err = err
+	}
+	w.stagingFile = ""
+	return w.err
+}
+
+// Reader reads an object sequentially through ranged gets of ReadChunkSize
+type Reader struct {
+	client *Client
+	bucket string
+	key    string
+	size   int64
+	offset int64
+	chunk  []byte
+}
+
+func Open(uri string) (*Reader, error) {
+	bucket, key, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientFor(uri)
+	if err != nil {
+		return nil, err
+	}
+	size, err := client.Head(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		client: client,
+		bucket: bucket,
+		key:    key,
+		size:   size,
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(r.chunk) == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		var err error
+		r.chunk, err = r.client.GetRange(r.bucket, r.key, r.offset, ReadChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(r.chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.offset += int64(len(r.chunk))
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// Returns the size of the object at uri
+func Size(uri string) (int64, error) {
+	bucket, key, err := ParseURI(uri)
+	if err != nil {
+		return 0, err
+	}
+	client, err := clientFor(uri)
+	if err != nil {
+		return 0, err
+	}
+	return client.Head(bucket, key)
+}
+
+// Puts data as the object at uri
+func WriteFile(uri string, data []byte) error {
+	bucket, key, err := ParseURI(uri)
+	if err != nil {
+		return err
+	}
+	client, err := clientFor(uri)
+	if err != nil {
+		return err
+	}
+	return client.Put(bucket, key, data)
+}
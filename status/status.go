@@ -0,0 +1,279 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const StatusPath = "/status"
+
+// Returns the number of units done and the total number of units for a stage
+type ProgressFunc func() (done uint64, total uint64)
+
+// Returns a counter to report as is
+type CounterFunc func() uint64
+
+// Returns the current phase of the run
+type PhaseFunc func() string
+
+// Returns whether each vbucket has completed, indexed by vbno
+type VbStatesFunc func() []bool
+
+// Returns the seqno processed so far and the seqno to complete at, indexed by vbno
+// endSeqnos may be nil if the vbuckets do not complete at a given seqno
+type VbSeqnosFunc func() (seqnos []uint64, endSeqnos []uint64)
+
+type StageStatus struct {
+	Name    string
+	Done    uint64
+	Total   uint64
+	Percent float64
+	// Estimated from the rate since the stage started. Only set while the stage is in progress
+	EtaSecs float64 `json:",omitempty"`
+}
+
+type VbStatus struct {
+	Vbno      uint16
+	Completed bool
+	Seqno     uint64
+	EndSeqno  uint64 `json:",omitempty"`
+	// Seqnos left to reach EndSeqno
+	Remaining uint64 `json:",omitempty"`
+	// How long the seqno has not moved for, as seen by the polls of the status. Only set while not completed
+	StalledSecs float64 `json:",omitempty"`
+}
+
+type ClusterStatus struct {
+	Name         string
+	NumCompleted int
+	Vbuckets     []*VbStatus
+}
+
+type Status struct {
+	Phase       string
+	StartTime   time.Time
+	ElapsedSecs float64
+	Stages      []*StageStatus
+	Counters    map[string]uint64
+	Clusters    []*ClusterStatus
+}
+
+type stage struct {
+	name      string
+	progress  ProgressFunc
+	startTime time.Time
+}
+
+type counter struct {
+	name    string
+	counter CounterFunc
+}
+
+type cluster struct {
+	name     string
+	vbStates VbStatesFunc
+	vbSeqnos VbSeqnosFunc
+	// Seqnos of the previous poll, and when each last moved
+	lastSeqnos []uint64
+	movedAt    []time.Time
+}
+
+// Server serves the status of a live run as JSON, so that a long-running diff can be polled
+type Server struct {
+	addr      string
+	startTime time.Time
+
+	mtx      sync.Mutex
+	phase    PhaseFunc
+	stages   []*stage
+	counters []*counter
+	clusters []*cluster
+
+	listener   net.Listener
+	httpServer *http.Server
+}
+
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:      addr,
+		startTime: time.Now(),
+	}
+}
+
+func (s *Server) SetPhaseFunc(phase PhaseFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.phase = phase
+}
+
+// The ETA of the stage is estimated from the time it is added
+func (s *Server) AddStage(name string, progress ProgressFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stages = append(s.stages, &stage{name: name, progress: progress, startTime: time.Now()})
+}
+
+func (s *Server) AddCounter(name string, c CounterFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.counters = append(s.counters, &counter{name: name, counter: c})
+}
+
+func (s *Server) AddCluster(name string, vbStates VbStatesFunc, vbSeqnos VbSeqnosFunc) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.clusters = append(s.clusters, &cluster{name: name, vbStates: vbStates, vbSeqnos: vbSeqnos})
+}
+
+// Starts listening right away, so that an address already in use is reported to the caller
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle(StatusPath, s)
+	s.httpServer = &http.Server{Handler: mux}
+	go s.httpServer.Serve(listener)
+	return nil
+}
+
+// Returns the address the server listens on, which is useful when started on port 0
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.addr
+	}
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Stop() error {
+	if s.httpServer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	statusBytes, err := json.Marshal(s.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(statusBytes)
+}
+
+func (s *Server) Status() *Status {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	status := &Status{
+		StartTime:   s.startTime,
+		ElapsedSecs: now.Sub(s.startTime).Seconds(),
+		Stages:      []*StageStatus{},
+		Counters:    make(map[string]uint64),
+		Clusters:    []*ClusterStatus{},
+	}
+	if s.phase != nil {
+		status.Phase = s.phase()
+	}
+
+	for _, st := range s.stages {
+		done, total := st.progress()
+		status.Stages = append(status.Stages, newStageStatus(st.name, done, total, now.Sub(st.startTime)))
+	}
+	for _, c := range s.counters {
+		status.Counters[c.name] = c.counter()
+	}
+	for _, c := range s.clusters {
+		clusterStatus := newClusterStatus(c.name, c.vbStates(), c.vbSeqnos)
+		c.setStalled(clusterStatus, now)
+		status.Clusters = append(status.Clusters, clusterStatus)
+	}
+	return status
+}
+
+func newStageStatus(name string, done, total uint64, elapsed time.Duration) *StageStatus {
+	stageStatus := &StageStatus{Name: name, Done: done, Total: total}
+	if total == 0 {
+		return stageStatus
+	}
+	if done > total {
+		done = total
+	}
+	stageStatus.Percent = float64(done) * 100 / float64(total)
+	if done > 0 && done < total {
+		rate := float64(done) / elapsed.Seconds()
+		stageStatus.EtaSecs = float64(total-done) / rate
+	}
+	return stageStatus
+}
+
+func newClusterStatus(name string, vbStates []bool, vbSeqnosFunc VbSeqnosFunc) *ClusterStatus {
+	var seqnos, endSeqnos []uint64
+	if vbSeqnosFunc != nil {
+		seqnos, endSeqnos = vbSeqnosFunc()
+	}
+	clusterStatus := &ClusterStatus{Name: name, Vbuckets: make([]*VbStatus, 0, len(vbStates))}
+	for vbno, completed := range vbStates {
+		vbStatus := &VbStatus{Vbno: uint16(vbno), Completed: completed}
+		if completed {
+			clusterStatus.NumCompleted++
+		}
+		if vbno < len(seqnos) {
+			vbStatus.Seqno = seqnos[vbno]
+		}
+		if vbno < len(endSeqnos) {
+			vbStatus.EndSeqno = endSeqnos[vbno]
+			if vbStatus.EndSeqno > vbStatus.Seqno {
+				vbStatus.Remaining = vbStatus.EndSeqno - vbStatus.Seqno
+			}
+		}
+		clusterStatus.Vbuckets = append(clusterStatus.Vbuckets, vbStatus)
+	}
+	return clusterStatus
+}
+
+// Sets how long the vbuckets that have not completed have gone without their seqno moving. The first poll
+// counts as a move
+func (c *cluster) setStalled(clusterStatus *ClusterStatus, now time.Time) {
+	if len(c.lastSeqnos) != len(clusterStatus.Vbuckets) {
+		c.lastSeqnos = make([]uint64, len(clusterStatus.Vbuckets))
+		c.movedAt = make([]time.Time, len(clusterStatus.Vbuckets))
+		for i, vbStatus := range clusterStatus.Vbuckets {
+			c.lastSeqnos[i] = vbStatus.Seqno
+			c.movedAt[i] = now
+		}
+	}
+	for i, vbStatus := range clusterStatus.Vbuckets {
+		if vbStatus.Seqno != c.lastSeqnos[i] {
+			c.lastSeqnos[i] = vbStatus.Seqno
+			c.movedAt[i] = now
+		}
+		if !vbStatus.Completed {
+			vbStatus.StalledSecs = now.Sub(c.movedAt[i]).Seconds()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	inProgress := newStageStatus("file differ", 25, 100, 10*time.Second)
+	assert.Equal(float64(25), inProgress.Percent)
+	assert.Equal(float64(30), inProgress.EtaSecs)
+
+	notStarted := newStageStatus("mutation differ", 0, 0, time.Second)
+	assert.Equal(float64(0), notStarted.Percent)
+	assert.Equal(float64(0), notStarted.EtaSecs)
+
+	done := newStageStatus("source DCP", 120, 100, time.Second)
+	assert.Equal(float64(100), done.Percent)
+	assert.Equal(float64(0), done.EtaSecs)
+}
+
+func TestServeStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewServer("127.0.0.1:0")
+	server.SetPhaseFunc(func() string { return "dataGeneration" })
+	server.AddStage("source DCP", func() (uint64, uint64) { return 1, 2 })
+	server.AddCounter("diff keys", func() uint64 { return 42 })
+	server.AddCluster("source", func() []bool { return []bool{true, false} },
+		func() ([]uint64, []uint64) { return []uint64{10, 5}, []uint64{10, 20} })
+	assert.Nil(server.Start())
+	defer server.Stop()
+
+	resp, err := http.Get("http://" + server.Addr() + StatusPath)
+	assert.Nil(err)
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var status Status
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&status))
+	assert.Equal("dataGeneration", status.Phase)
+	assert.Len(status.Stages, 1)
+	assert.Equal(float64(50), status.Stages[0].Percent)
+	assert.Equal(uint64(42), status.Counters["diff keys"])
+	assert.Len(status.Clusters, 1)
+	assert.Equal(1, status.Clusters[0].NumCompleted)
+	assert.Equal(uint64(5), status.Clusters[0].Vbuckets[1].Seqno)
+	assert.Equal(uint64(20), status.Clusters[0].Vbuckets[1].EndSeqno)
+	assert.Equal(uint64(15), status.Clusters[0].Vbuckets[1].Remaining)
+}
+
+func TestVbStalled(t *testing.T) {
+	assert := assert.New(t)
+
+	seqnos := []uint64{10, 5}
+	c := &cluster{name: "source"}
+	start := time.Now()
+	vbSeqnos := func() ([]uint64, []uint64) { return seqnos, []uint64{10, 20} }
+
+	clusterStatus := newClusterStatus(c.name, []bool{true, false}, vbSeqnos)
+	c.setStalled(clusterStatus, start)
+	assert.Equal(float64(0), clusterStatus.Vbuckets[1].StalledSecs)
+
+	clusterStatus = newClusterStatus(c.name, []bool{true, false}, vbSeqnos)
+	c.setStalled(clusterStatus, start.Add(30*time.Second))
+	assert.Equal(float64(0), clusterStatus.Vbuckets[0].StalledSecs)
+	assert.Equal(float64(30), clusterStatus.Vbuckets[1].StalledSecs)
+
+	seqnos = []uint64{10, 6}
+	clusterStatus = newClusterStatus(c.name, []bool{true, false}, vbSeqnos)
+	c.setStalled(clusterStatus, start.Add(40*time.Second))
+	assert.Equal(float64(0), clusterStatus.Vbuckets[1].StalledSecs)
+}
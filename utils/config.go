@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Reads a config file of option names to values, i.e. {"sourceUrl": "localhost:8091", "numberOfBins": 5}
+// Files ending in .json are parsed as a JSON object. Otherwise the file is parsed as flat YAML, one
+// "name: value" per line, with # comments and optionally quoted values. Values are returned as
+// strings, to be parsed the same way as the flag of the same name
+func ParseConfigFile(fileName string) (map[string]string, error) {
+	configBytes, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		return parseJsonConfig(configBytes)
+	}
+	return parseYamlConfig(configBytes)
+}
+
+func parseJsonConfig(configBytes []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	// Keep numbers as they are written, so that large integers are not turned into floats
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]string)
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			config[name] = v
+		case json.Number:
+			config[name] = v.String()
+		case bool:
+			config[name] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("option %v has a value of unsupported type %T", name, value)
+		}
+	}
+	return config, nil
+}
+
+func parseYamlConfig(configBytes []byte) (map[string]string, error) {
+	config := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(configBytes))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		sepIdx := strings.Index(line, ":")
+		if sepIdx <= 0 {
+			return nil, fmt.Errorf("line %v: expected \"name: value\", got %q", lineNum, line)
+		}
+		name := strings.TrimSpace(line[:sepIdx])
+		value, err := parseYamlValue(strings.TrimSpace(line[sepIdx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNum, err)
+		}
+		config[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func parseYamlValue(value string) (string, error) {
+	if strings.HasPrefix(value, "\"") {
+		// Double quoted values may contain escapes and #
+		endIdx := strings.LastIndex(value, "\"")
+		if endIdx == 0 {
+			return "", fmt.Errorf("unterminated quote in %v", value)
+		}
+		return strconv.Unquote(value[:endIdx+1])
+	}
+	if strings.HasPrefix(value, "'") {
+		endIdx := strings.LastIndex(value, "'")
+		if endIdx == 0 {
+			return "", fmt.Errorf("unterminated quote in %v", value)
+		}
+		return strings.ReplaceAll(value[1:endIdx], "''", "'"), nil
+	}
+	if commentIdx := strings.Index(value, " #"); commentIdx >= 0 {
+		value = strings.TrimSpace(value[:commentIdx])
+	}
+	return value, nil
+}
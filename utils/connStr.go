@@ -0,0 +1,62 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	xdcrBase "github.com/couchbase/goxdcr/base"
+	"xdcrDiffer/base"
+)
+
+// Turns a couchbase:// or couchbases:// connection string, i.e. for Capella, into the ns_server address of one node
+// The host is resolved through its DNS SRV record if it has one, the same way the SDKs do
+// Any port in the connection string is a KV port, so mgmtPort is used instead, or the default management port if 0
+// Other urls are returned as they are, with secure being false, and with mgmtPort added if they have no port
+func ResolveConnectionString(url string, mgmtPort uint16) (hostAddr string, secure bool) {
+	var scheme string
+	if strings.HasPrefix(url, base.CouchbaseSecurePrefix) {
+		secure = true
+		scheme = "couchbases"
+		hostAddr = strings.TrimPrefix(url, base.CouchbaseSecurePrefix)
+	} else if strings.HasPrefix(url, base.CouchbasePrefix) {
+		scheme = "couchbase"
+		hostAddr = strings.TrimPrefix(url, base.CouchbasePrefix)
+	} else {
+		if _, err := xdcrBase.GetPortNumber(url); err != nil && mgmtPort > 0 {
+			// url may still have its http:// prefix, so the port is tacked on as is
+			url = fmt.Sprintf("%v:%v", url, mgmtPort)
+		}
+		return url, false
+	}
+
+	// Drop any options, and all hosts but the first
+	if idx := strings.IndexAny(hostAddr, "?/"); idx >= 0 {
+		hostAddr = hostAddr[:idx]
+	}
+	if idx := strings.Index(hostAddr, ","); idx >= 0 {
+		hostAddr = hostAddr[:idx]
+	}
+
+	hostName := xdcrBase.GetHostName(hostAddr)
+	if _, srvAddrs, err := net.LookupSRV(scheme, "tcp", hostName); err == nil && len(srvAddrs) > 0 {
+		hostName = strings.TrimSuffix(srvAddrs[0].Target, ".")
+	}
+
+	port := uint16(base.MgmtPort)
+	if mgmtPort > 0 {
+		port = mgmtPort
+	} else if secure {
+		port = base.MgmtSecurePort
+	}
+	return xdcrBase.GetHostAddr(hostName, port), secure
+}
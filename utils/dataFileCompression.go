@@ -0,0 +1,93 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"xdcrDiffer/base"
+
+	"github.com/golang/snappy"
+)
+
+// A gzip member, and a snappy framed stream, start with these. Neither is a valid key length, nor the data file
+// header marker, so uncompressed data files are never mistaken for compressed ones
+var gzipMagic = []byte{0x1f, 0x8b}
+var snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+// Number of bytes DetectDataFileCompression needs to tell compressed data files apart
+var DataFileCompressionMagicLen = len(snappyMagic)
+
+// Returns the compression of the data file that starts with prefix
+func DetectDataFileCompression(prefix []byte) string {
+	if bytes.HasPrefix(prefix, gzipMagic) {
+		return base.DataFileCompressionGzip
+	}
+	if bytes.HasPrefix(prefix, snappyMagic) {
+		return base.DataFileCompressionSnappy
+	}
+	return base.DataFileCompressionNone
+}
+
+// Compresses data into a block that can be read back on its own, or as part of the blocks appended before and
+// after it. Gzip readers read on across members, and snappy readers across stream identifiers
+func CompressDataFileBlock(compression string, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case base.DataFileCompressionNone:
+		return data, nil
+	case base.DataFileCompressionGzip:
+		writer = gzip.NewWriter(&buffer)
+	case base.DataFileCompressionSnappy:
+		writer = snappy.NewBufferedWriter(&buffer)
+	default:
+		return nil, fmt.Errorf("unknown data file compression %v", compression)
+	}
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Returns a reader of the decompressed content of reader
+func NewDataFileDecompressor(compression string, reader io.Reader) (io.Reader, error) {
+	switch compression {
+	case base.DataFileCompressionNone:
+		return reader, nil
+	case base.DataFileCompressionGzip:
+		return gzip.NewReader(reader)
+	case base.DataFileCompressionSnappy:
+		return snappy.NewReader(reader), nil
+	}
+	return nil, fmt.Errorf("unknown data file compression %v", compression)
+}
+
+// Returns the decompressed content of a whole data file, along with its compression
+func DecompressDataFile(data []byte) ([]byte, string, error) {
+	compression := DetectDataFileCompression(data)
+	if compression == base.DataFileCompressionNone {
+		return data, compression, nil
+	}
+	reader, err := NewDataFileDecompressor(compression, bytes.NewReader(data))
+	if err != nil {
+		return nil, compression, err
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	return decompressed, compression, err
+}
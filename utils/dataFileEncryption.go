@@ -0,0 +1,355 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypted files are made of blocks sealed on their own with AES-GCM, so that they can be appended to and
+// streamed. Each block is the magic, the big endian length of the rest of the block, the nonce and the sealed
+// data. The magic is neither a valid key length, the data file header marker, a compression magic nor the start
+// of a JSON document, so plaintext files are never mistaken for encrypted ones
+// The index of the block in the file, and whether it is the last block its writer sealed, are bound in as additional
+// data, so that blocks that are dropped, reordered or cut off the end of the file fail to decrypt. A file that is
+// appended to holds the last block of each writer, so it can only be cut short unnoticed where a writer was closed
+var dataFileEncryptionMagic = []byte("\xfeXDENC")
+
+const dataFileEncryptionBlockLenLen = 4
+
+// Larger writes are split into blocks of this much data, so that readers can refuse longer blocks rather than
+// allocating whatever length a corrupted file holds
+const dataFileEncryptionMaxBlockData = 16 * 1024 * 1024
+
+// Longest block length readers accept, i.e. the AES-GCM nonce, the most data a block holds and the AES-GCM tag
+const dataFileEncryptionMaxBlockLen = 12 + dataFileEncryptionMaxBlockData + 16
+
+// Number of bytes IsDataFileEncrypted needs to tell encrypted files apart
+var DataFileEncryptionMagicLen = len(dataFileEncryptionMagic)
+
+// Keys are AES-256 keys given as 64 hex digits
+func ParseDataFileEncryptionKey(hexKey string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key must be given in hex: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, i.e. 64 hex digits, not %v bytes", len(key))
+	}
+	return key, nil
+}
+
+// Reads the hex key that a key file holds
+func LoadDataFileEncryptionKey(fileName string) ([]byte, error) {
+	hexKey, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseDataFileEncryptionKey(string(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", fileName, err)
+	}
+	return key, nil
+}
+
+func newDataFileAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, fmt.Errorf("file is encrypted, but no encryption key is given")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns whether the file that starts with prefix is encrypted
+func IsDataFileEncrypted(prefix []byte) bool {
+	return bytes.HasPrefix(prefix, dataFileEncryptionMagic)
+}
+
+// The additional data of a block
+func dataFileBlockAAD(blockIndex uint64, last bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, blockIndex)
+	if last {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// Encrypts data as the whole content of a file. data is returned as is when key is nil
+func EncryptDataFile(key, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	encrypter := NewDataFileEncrypter(key, &buf)
+	_, err := encrypter.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = encrypter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encrypts each write into blocks of its own, numbered from the first block given. Close seals the last block
+type dataFileEncrypter struct {
+	writer    io.Writer
+	aead      cipher.AEAD
+	nextBlock uint64
+	closed    bool
+	err       error
+}
+
+func (e *dataFileEncrypter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	for written := 0; written < len(p); {
+		end := written + dataFileEncryptionMaxBlockData
+		if end > len(p) {
+			end = len(p)
+		}
+		e.err = e.sealBlock(p[written:end], false)
+		if e.err != nil {
+			return written, e.err
+		}
+		written = end
+	}
+	return len(p), nil
+}
+
+// Seals an empty last block, which tells readers that the file was not cut short. The writer below is not closed
+func (e *dataFileEncrypter) Close() error {
+	if e.err != nil || e.closed {
+		return e.err
+	}
+	e.closed = true
+	e.err = e.sealBlock(nil, true)
+	return e.err
+}
+
+func (e *dataFileEncrypter) sealBlock(data []byte, last bool) error {
+	blockLen := e.aead.NonceSize() + len(data) + e.aead.Overhead()
+	headerLen := len(dataFileEncryptionMagic) + dataFileEncryptionBlockLenLen
+	block := make([]byte, headerLen, headerLen+blockLen)
+	copy(block, dataFileEncryptionMagic)
+	binary.BigEndian.PutUint32(block[len(dataFileEncryptionMagic):], uint32(blockLen))
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	block = append(block, nonce...)
+	block = e.aead.Seal(block, nonce, data, dataFileBlockAAD(e.nextBlock, last))
+	n, err := e.writer.Write(block)
+	if err != nil {
+		return err
+	}
+	if n != len(block) {
+		return io.ErrShortWrite
+	}
+	e.nextBlock++
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Returns a writer that encrypts what is written to writer with key, or writer itself when key is nil. Each write is
+// sealed into a block of its own, so writes are best buffered above it. Close must be called once everything is
+// written, and does not close writer
+func NewDataFileEncrypter(key []byte, writer io.Writer) io.WriteCloser {
+	return NewDataFileAppender(key, writer, 0)
+}
+
+// Same as NewDataFileEncrypter, for a file that already holds numBlocks blocks, as counted by CountDataFileBlocks
+func NewDataFileAppender(key []byte, writer io.Writer, numBlocks uint64) io.WriteCloser {
+	if key == nil {
+		return nopWriteCloser{writer}
+	}
+	aead, err := newDataFileAEAD(key)
+	return &dataFileEncrypter{writer: writer, aead: aead, nextBlock: numBlocks, err: err}
+}
+
+// Returns the number of blocks of an encrypted file, reading only their headers
+func CountDataFileBlocks(file io.ReadSeeker) (uint64, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, len(dataFileEncryptionMagic)+dataFileEncryptionBlockLenLen)
+	var numBlocks uint64
+	for {
+		_, err = io.ReadFull(file, header)
+		if err == io.EOF {
+			return numBlocks, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("unable to read encrypted block: %v", err)
+		}
+		if !IsDataFileEncrypted(header) {
+			return 0, fmt.Errorf("encrypted block does not start with the encryption magic")
+		}
+		_, err = file.Seek(int64(binary.BigEndian.Uint32(header[len(dataFileEncryptionMagic):])), io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		numBlocks++
+	}
+}
+
+type dataFileDecrypter struct {
+	reader    io.Reader
+	aead      cipher.AEAD
+	decrypted []byte
+	nextBlock uint64
+	// Whether the block read last was the last one its writer sealed
+	lastSealed bool
+	// Whether the file may end without such a block, as when its writer was not closed
+	unclosed bool
+}
+
+func (d *dataFileDecrypter) Read(p []byte) (int, error) {
+	for len(d.decrypted) == 0 {
+		err := d.readBlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.decrypted)
+	d.decrypted = d.decrypted[n:]
+	return n, nil
+}
+
+func (d *dataFileDecrypter) readBlock() error {
+	header := make([]byte, len(dataFileEncryptionMagic)+dataFileEncryptionBlockLenLen)
+	_, err := io.ReadFull(d.reader, header)
+	if err == io.EOF {
+		if d.nextBlock > 0 && !d.lastSealed && !d.unclosed {
+			return fmt.Errorf("encrypted file ends after block %v, which is not the last block it was written with", d.nextBlock-1)
+		}
+		return io.EOF
+	} else if err != nil {
+		return fmt.Errorf("unable to read encrypted block: %v", err)
+	}
+	if !IsDataFileEncrypted(header) {
+		return fmt.Errorf("encrypted block does not start with the encryption magic")
+	}
+	blockLen := binary.BigEndian.Uint32(header[len(dataFileEncryptionMagic):])
+	if blockLen > dataFileEncryptionMaxBlockLen {
+		return fmt.Errorf("encrypted block of %v bytes is longer than the %v bytes blocks are written with", blockLen, dataFileEncryptionMaxBlockLen)
+	}
+	block := make([]byte, blockLen)
+	_, err = io.ReadFull(d.reader, block)
+	if err != nil {
+		return fmt.Errorf("unable to read encrypted block: %v", err)
+	}
+	if len(block) < d.aead.NonceSize() {
+		return fmt.Errorf("encrypted block of %v bytes is too short", len(block))
+	}
+	nonce := block[:d.aead.NonceSize()]
+	sealed := block[d.aead.NonceSize():]
+	d.lastSealed = false
+	d.decrypted, err = d.aead.Open(nil, nonce, sealed, dataFileBlockAAD(d.nextBlock, false))
+	if err != nil {
+		d.lastSealed = true
+		d.decrypted, err = d.aead.Open(nil, nonce, sealed, dataFileBlockAAD(d.nextBlock, true))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to decrypt block %v. Blocks may be missing or out of order, or the encryption key may not be the one the file was written with: %v", d.nextBlock, err)
+	}
+	d.nextBlock++
+	return nil
+}
+
+// Returns a reader of the content of reader decrypted with key. reader must be encrypted
+func NewDataFileDecrypter(key []byte, reader io.Reader) (io.Reader, error) {
+	aead, err := newDataFileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataFileDecrypter{reader: reader, aead: aead}, nil
+}
+
+// Returns a reader of the content of reader decrypted with key if it is encrypted, or of its content as it is otherwise
+func NewDataFileReader(key []byte, reader io.Reader) (io.Reader, error) {
+	bufReader := bufio.NewReader(reader)
+	prefix, err := bufReader.Peek(DataFileEncryptionMagicLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !IsDataFileEncrypted(prefix) {
+		return bufReader, nil
+	}
+	return NewDataFileDecrypter(key, bufReader)
+}
+
+// Returns the content of a whole file decrypted with key, or data as it is if it is not encrypted
+func DecryptDataFile(key, data []byte) ([]byte, error) {
+	return decryptDataFile(key, data, false)
+}
+
+// Same as DecryptDataFile, for a file whose last writer may not have been closed, such as a data file of a run that
+// was stopped abruptly. Blocks that are dropped or reordered still fail to decrypt
+func DecryptUnclosedDataFile(key, data []byte) ([]byte, error) {
+	return decryptDataFile(key, data, true)
+}
+
+func decryptDataFile(key, data []byte, unclosed bool) ([]byte, error) {
+	if !IsDataFileEncrypted(data) {
+		return data, nil
+	}
+	aead, err := newDataFileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(&dataFileDecrypter{reader: bytes.NewReader(data), aead: aead, unclosed: unclosed})
+}
+
+// Same as os.WriteFile, but encrypted with key when key is not nil
+func WriteDataFile(key []byte, fileName string, data []byte, perm os.FileMode) error {
+	data, err := EncryptDataFile(key, data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, perm)
+}
+
+// Same as os.ReadFile, but decrypted with key if the file is encrypted
+func ReadDataFile(key []byte, fileName string) ([]byte, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	data, err = DecryptDataFile(key, data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", fileName, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A flag.Value for the time options, which are kept as a number of units, i.e. seconds, so that configs and
+// job submissions that give them as numbers keep working. Accepts a Go duration string, e.g. 90m or 45s,
+// or a bare number in the unit of the option
+type DurationFlag struct {
+	value *uint64
+	unit  time.Duration
+}
+
+func NewDurationFlag(value *uint64, unit time.Duration) *DurationFlag {
+	return &DurationFlag{value: value, unit: unit}
+}
+
+func (f *DurationFlag) Set(s string) error {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		*f.value = n
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as 90m or 45s, or a number of %v: %v", unitName(f.unit), err)
+	}
+	if d < 0 {
+		return fmt.Errorf("duration %v is negative", s)
+	}
+	if d%f.unit != 0 {
+		return fmt.Errorf("duration %v is not a whole number of %v", s, unitName(f.unit))
+	}
+	*f.value = uint64(d / f.unit)
+	return nil
+}
+
+// Used by flag.PrintDefaults on a zero DurationFlag as well
+func (f *DurationFlag) String() string {
+	if f == nil || f.value == nil {
+		return ""
+	}
+	return (time.Duration(*f.value) * f.unit).String()
+}
+
+func unitName(unit time.Duration) string {
+	switch unit {
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Second:
+		return "seconds"
+	case time.Minute:
+		return "minutes"
+	}
+	return unit.String()
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"xdcrDiffer/base"
+)
+
+// Redirects stdout and stderr to a log file, and rotates the file once it grows past maxSize or is older than maxAge
+// The file descriptors themselves are redirected, so that the output of every logger and of fmt goes to the file,
+// and nothing is lost when the process exits without going through Stop(). On Windows, the standard handles and
+// os.Stdout and os.Stderr are replaced instead
+// Rotation is checked periodically, so the size of a file may go somewhat past maxSize
+type LogFileRotator struct {
+	fileName   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	openTime time.Time
+
+	finChan  chan bool
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// A maxSize or maxAge of 0 disables rotation by that criterion
+// maxBackups is the number of rotated files kept, as fileName.1 (the most recent) to fileName.<maxBackups>
+func NewLogFileRotator(fileName string, maxSize int64, maxAge time.Duration, maxBackups int) *LogFileRotator {
+	return &LogFileRotator{
+		fileName:   fileName,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		finChan:    make(chan bool),
+	}
+}
+
+// Returns a copy of the original stdout, for output that should still reach the terminal
+func (r *LogFileRotator) Start() (*os.File, error) {
+	originalStdout, err := dupStdout()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.open()
+	if err != nil {
+		originalStdout.Close()
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return originalStdout, nil
+}
+
+func (r *LogFileRotator) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.finChan)
+		r.wg.Wait()
+	})
+}
+
+func (r *LogFileRotator) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(base.LogFileRotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := r.rotateIfNeeded()
+			if err != nil {
+				// Goes to the current log file
+				fmt.Printf("Error rotating log file %v: %v\n", r.fileName, err)
+			}
+		case <-r.finChan:
+			return
+		}
+	}
+}
+
+// Appends to an existing log file, so that a resumed run keeps its history
+func (r *LogFileRotator) open() error {
+	file, err := os.OpenFile(r.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, base.FileModeReadWrite)
+	if err != nil {
+		return err
+	}
+	err = redirectStdoutAndStderr(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = file
+	r.openTime = time.Now()
+	return nil
+}
+
+func (r *LogFileRotator) rotateIfNeeded() error {
+	if r.maxAge > 0 && time.Since(r.openTime) >= r.maxAge {
+		return r.rotate()
+	}
+	if r.maxSize > 0 {
+		fileInfo, err := r.file.Stat()
+		if err != nil {
+			return err
+		}
+		if fileInfo.Size() >= r.maxSize {
+			return r.rotate()
+		}
+	}
+	return nil
+}
+
+// Output written between the rename and the reopen still goes to the renamed file
+func (r *LogFileRotator) rotate() error {
+	if r.maxBackups > 0 {
+		err := os.Remove(r.backupFileName(r.maxBackups))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			err = os.Rename(r.backupFileName(i), r.backupFileName(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(r.fileName, r.backupFileName(1))
+		if err != nil {
+			return err
+		}
+	} else {
+		err := os.Remove(r.fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.open()
+}
+
+func (r *LogFileRotator) backupFileName(i int) string {
+	return fmt.Sprintf("%v.%v", r.fileName, i)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the bytes available to unprivileged users on the filesystem of dir
+func FreeDiskSpace(dir string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Returns the soft limit on the file descriptors the process may open
+func FileDescLimit() (uint64, error) {
+	var limit unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(limit.Cur), nil
+}
+
+// Returns a copy of the original stdout, which still reaches the terminal once stdout is redirected
+func dupStdout() (*os.File, error) {
+	stdoutFd, err := unix.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(stdoutFd), "stdout"), nil
+}
+
+// The file descriptors themselves are redirected, so that the output of every logger and of fmt goes to file
+func redirectStdoutAndStderr(file *os.File) error {
+	for _, fd := range []int{int(os.Stdout.Fd()), int(os.Stderr.Fd())} {
+		err := unix.Dup2(int(file.Fd()), fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Returns the bytes available to the user on the volume of dir
+func FreeDiskSpace(dir string) (uint64, error) {
+	dirPtr, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytesAvailable uint64
+	err = windows.GetDiskFreeSpaceEx(dirPtr, &freeBytesAvailable, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	return freeBytesAvailable, nil
+}
+
+// Windows has no per process limit on open file handles that is low enough to matter
+func FileDescLimit() (uint64, error) {
+	return 16 * 1024 * 1024, nil
+}
+
+// Stdout is redirected by replacing the standard handles and os.Stdout, so the original file still reaches the console
+func dupStdout() (*os.File, error) {
+	return os.Stdout, nil
+}
+
+// Handles cannot be duplicated onto each other as file descriptors are, so output written through an os.Stdout or
+// os.Stderr captured before the redirection still goes to the console
+func redirectStdoutAndStderr(file *os.File) error {
+	handle := windows.Handle(file.Fd())
+	err := windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, handle)
+	if err != nil {
+		return err
+	}
+	err = windows.SetStdHandle(windows.STD_ERROR_HANDLE, handle)
+	if err != nil {
+		return err
+	}
+	os.Stdout = file
+	os.Stderr = file
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Token bucket that allows opsPerSec operations per second on average, in bursts of up to one second's worth
+// Safe for concurrent use
+type RateLimiter struct {
+	lock       sync.Mutex
+	opsPerSec  float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Returns nil, which never blocks, if opsPerSec is not positive
+func NewRateLimiter(opsPerSec int) *RateLimiter {
+	if opsPerSec <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		opsPerSec:  float64(opsPerSec),
+		tokens:     float64(opsPerSec),
+		lastRefill: time.Now(),
+	}
+}
+
+// Blocks until one more operation is allowed
+// A token is reserved up front, so that concurrent callers are let through in the order they arrived
+func (r *RateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.lastRefill).Seconds() * r.opsPerSec
+	if r.tokens > r.opsPerSec {
+		r.tokens = r.opsPerSec
+	}
+	r.lastRefill = now
+	r.tokens--
+	tokens := r.tokens
+	r.lock.Unlock()
+
+	if tokens < 0 {
+		time.Sleep(time.Duration(-tokens / r.opsPerSec * float64(time.Second)))
+	}
+}
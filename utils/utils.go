@@ -11,41 +11,56 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/cespare/xxhash/v2"
 	xdcrBase "github.com/couchbase/goxdcr/base"
 	xdcrUtils "github.com/couchbase/goxdcr/utils"
 	"hash/crc32"
 	"io/ioutil"
 	"math"
 	mrand "math/rand"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 	"xdcrDiffer/base"
+	"xdcrDiffer/objectStore"
 )
 
+// Joins dir and the names under it with the separator of the OS, so that paths work on Windows as well
+// Object storage URIs are always joined with /, since filepath.Join would clean s3://bucket into s3:/bucket
+func JoinPath(dir string, names ...string) string {
+	if objectStore.IsURI(dir) {
+		return strings.Join(append([]string{strings.TrimSuffix(dir, base.FileDirDelimiter)}, names...), base.FileDirDelimiter)
+	}
+	return filepath.Join(append([]string{dir}, names...)...)
+}
+
 func GetFileName(fileDir string, vbno uint16, bucketIndex int) string {
 	var buffer bytes.Buffer
-	buffer.WriteString(fileDir)
-	buffer.WriteString(base.FileDirDelimiter)
 	buffer.WriteString(base.FileNamePrefix)
 	buffer.WriteString(base.FileNameDelimiter)
 	buffer.WriteString(fmt.Sprintf("%v", vbno))
 	buffer.WriteString(base.FileNameDelimiter)
 	buffer.WriteString(fmt.Sprintf("%v", bucketIndex))
-	return buffer.String()
+	return JoinPath(fileDir, buffer.String())
 }
 
 func GetManifestFileName(fileDir string) string {
 	var buffer bytes.Buffer
-	buffer.WriteString(fileDir)
-	buffer.WriteString(base.FileDirDelimiter)
 	buffer.WriteString(base.FileNamePrefix)
 	buffer.WriteString(base.FileNameDelimiter)
 	buffer.WriteString(fmt.Sprintf("%v", base.ManifestFileName))
-	return buffer.String()
+	return JoinPath(fileDir, buffer.String())
+}
+
+// hash key into a vbucket number in range [0, NumberOfVbuckets), the same way as the SDK
+func GetVbucketFromKey(key []byte) uint16 {
+	crc := crc32.ChecksumIEEE(key)
+	return uint16(((crc >> 16) & 0x7fff) % base.NumberOfVbuckets)
 }
 
 // hash key into a bucket index in range [0, NumberOfBucketsPerVbucket)
@@ -54,6 +69,16 @@ func GetBucketIndexFromKey(key []byte, numberOfBins int) int {
 	return int(math.Mod(float64(crc), float64(numberOfBins)))
 }
 
+// Whether the key falls in a sample of samplePercent percent of all keys. The sample only depends on the key, so the
+// same keys are picked on both clusters and across runs. xxhash is used so that the sample is spread evenly over
+// the vbuckets and bins, which are picked from the crc32 of the key
+func IsKeyInSample(key []byte, samplePercent float64) bool {
+	if samplePercent >= 100 {
+		return true
+	}
+	return float64(xxhash.Sum64(key)%base.SampleResolution) < samplePercent*base.SampleResolution/100
+}
+
 // evenly distribute load across workers
 // assumes that num_of_worker <= num_of_load
 // returns load_distribution [][]int, where
@@ -153,15 +178,29 @@ type ExponentialOpFunc func() error
  * Factor == exponential backoff factor based off of initialWait
  */
 func ExponentialBackoffExecutor(name string, initialWait time.Duration, maxRetries int, factor int, maxBackoff time.Duration, op ExponentialOpFunc) error {
+	return ExponentialBackoffExecutorWithContext(context.Background(), name, initialWait, maxRetries, factor, maxBackoff, op)
+}
+
+// Same as ExponentialBackoffExecutor, but stops retrying and returns ctx.Err() once ctx is done
+func ExponentialBackoffExecutorWithContext(ctx context.Context, name string, initialWait time.Duration, maxRetries int, factor int, maxBackoff time.Duration, op ExponentialOpFunc) error {
 	waitTime := initialWait
 	var opErr error
 	for i := 0; i <= maxRetries; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		opErr = op()
 		if opErr == nil {
 			return nil
 		} else if i != maxRetries {
 			fmt.Printf("%v executor failed with %v. retry=%v\n", name, opErr, i)
-			time.Sleep(waitTime)
+			timer := time.NewTimer(waitTime)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
 			waitTime *= time.Duration(factor)
 			if waitTime > maxBackoff {
 				waitTime = maxBackoff
@@ -237,7 +276,9 @@ func EncodeVersionToEffectiveVersion(version []int) int {
 	return effectiveVersion
 }
 
-func PopulateCCCPConnectString(url string) string {
+// With secure, the connection string uses TLS and the port, if any, must be the secure KV port
+// A kvPort other than 0 replaces the port of url. Otherwise the port is stripped off, for the default KV port to be used
+func PopulateCCCPConnectString(url string, secure bool, kvPort uint16) string {
 	var cccpUrl string
 	if strings.HasPrefix(url, base.HttpPrefix) {
 		cccpUrl = strings.TrimPrefix(url, base.HttpPrefix)
@@ -247,14 +288,19 @@ func PopulateCCCPConnectString(url string) string {
 		cccpUrl = url
 	}
 
-	// For production environment (non-cluster-run), strip off the port
-	portNo, portErr := xdcrBase.GetPortNumber(cccpUrl)
-	if portErr == nil && (portNo < base.ClusterRunMinPortNo || portNo > base.ClusterRunMaxPortNo) {
+	if kvPort > 0 {
+		cccpUrl = xdcrBase.GetHostAddr(xdcrBase.GetHostName(cccpUrl), kvPort)
+	} else if portNo, portErr := xdcrBase.GetPortNumber(cccpUrl); portErr == nil && (portNo < base.ClusterRunMinPortNo || portNo > base.ClusterRunMaxPortNo) {
+		// For production environment (non-cluster-run), strip off the port
 		cccpUrl = xdcrBase.GetHostName(cccpUrl)
 	}
 
-	if !strings.HasPrefix(cccpUrl, base.CouchbasePrefix) {
-		cccpUrl = fmt.Sprintf("%v%v", base.CouchbasePrefix, cccpUrl)
+	prefix := base.CouchbasePrefix
+	if secure {
+		prefix = base.CouchbaseSecurePrefix
+	}
+	if !strings.HasPrefix(cccpUrl, prefix) {
+		cccpUrl = fmt.Sprintf("%v%v", prefix, cccpUrl)
 	}
 	return cccpUrl
 }
@@ -264,7 +310,7 @@ func DiffKeysFileName(isSource bool, diffFileDir, diffKeysFileName string) strin
 	if !isSource {
 		suffix = base.TargetClusterName
 	}
-	return diffFileDir + base.FileDirDelimiter + diffKeysFileName + base.FileNameDelimiter + suffix
+	return JoinPath(diffFileDir, diffKeysFileName+base.FileNameDelimiter+suffix)
 }
 
 func GetCertificate(u xdcrUtils.UtilsIface, hostname string, username, password string, authMech xdcrBase.HttpAuthMech) ([]byte, error) {
@@ -310,3 +356,8 @@ func SearchUint8List(seqno_list []uint8, seqno uint8) (int, bool) {
 		return index, false
 	}
 }
+
+// Name of the file holding the diff keys of a single collection, alongside the given diff keys file
+func DiffKeysCollectionFileName(diffKeysFileName string, colId uint32) string {
+	return fmt.Sprintf("%v%v%v%v%v", diffKeysFileName, base.FileNameDelimiter, base.DiffKeysCollectionSuffix, base.FileNameDelimiter, colId)
+}